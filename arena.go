@@ -0,0 +1,75 @@
+package gostatsd
+
+import (
+	"sync/atomic"
+)
+
+// MetricArena allocates the metrics of a batch, e.g. the lines of a datagram, from a single buffer so that
+// parsing the batch does not allocate a metric per line. Metrics are released with Release once they are
+// aggregated. The arena is reset, and can be reused for the next batch, once all its metrics are released
+// and the producer of the batch has called Done.
+type MetricArena struct {
+	metrics []Metric
+	next    int                // Index of the next metric to allocate
+	refs    int32              // Allocated metrics not released yet, plus one until Done is called
+	onReset func(*MetricArena) // Called when the arena is reset, nil if not set
+}
+
+// NewMetricArena initialises a new arena allocating up to size metrics per batch. The function is called when
+// the arena is reset, e.g. to return it to a pool, if it is not nil.
+func NewMetricArena(size int, onReset func(*MetricArena)) *MetricArena {
+	return &MetricArena{
+		metrics: make([]Metric, size),
+		refs:    1,
+		onReset: onReset,
+	}
+}
+
+// Alloc returns an empty metric from the arena, nil if the arena is full. Must not be called concurrently or
+// after Done.
+func (a *MetricArena) Alloc() *Metric {
+	if a.next == len(a.metrics) {
+		return nil
+	}
+	m := &a.metrics[a.next]
+	m.arena = a
+	m.arenaIndex = a.next
+	a.next++
+	atomic.AddInt32(&a.refs, 1)
+	return m
+}
+
+// Done is called by the producer of the batch once it allocated all metrics of the batch.
+func (a *MetricArena) Done() {
+	a.release()
+}
+
+func (a *MetricArena) release() {
+	if atomic.AddInt32(&a.refs, -1) != 0 {
+		return
+	}
+	// All metrics are released and cleared
+	a.next = 0
+	a.refs = 1
+	if a.onReset != nil {
+		a.onReset(a)
+	}
+}
+
+// Release clears the metric and releases it to the arena it was allocated from, returning true. It returns false
+// if the metric was not allocated by an arena, including copies of metrics allocated by an arena. The metric must
+// not be used after it is released.
+func (m *Metric) Release() bool {
+	a := m.arena
+	if a == nil {
+		return false
+	}
+	if m.arenaIndex >= len(a.metrics) || &a.metrics[m.arenaIndex] != m {
+		// A copy, the original is released separately
+		m.arena = nil
+		return false
+	}
+	*m = Metric{}
+	a.release()
+	return true
+}
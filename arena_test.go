@@ -0,0 +1,56 @@
+package gostatsd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricArena(t *testing.T) {
+	t.Parallel()
+	resets := 0
+	a := NewMetricArena(2, func(*MetricArena) {
+		resets++
+	})
+	m1 := a.Alloc()
+	m2 := a.Alloc()
+	require.NotNil(t, m1)
+	require.NotNil(t, m2)
+	assert.Nil(t, a.Alloc(), "arena is full")
+	m1.Name = "a"
+	m2.Name = "b"
+
+	assert.True(t, m1.Release())
+	assert.Equal(t, Metric{}, *m1)
+	a.Done()
+	assert.Zero(t, resets, "m2 is not released yet")
+	assert.True(t, m2.Release())
+	assert.Equal(t, 1, resets)
+
+	// The arena is reused
+	m := a.Alloc()
+	assert.True(t, m == m1)
+	a.Done()
+	assert.True(t, m.Release())
+	assert.Equal(t, 2, resets)
+}
+
+func TestMetricArenaReleaseCopy(t *testing.T) {
+	t.Parallel()
+	resets := 0
+	a := NewMetricArena(1, func(*MetricArena) {
+		resets++
+	})
+	m := a.Alloc()
+	m.Name = "a"
+	a.Done()
+	c := *m
+	assert.False(t, c.Release(), "copies are not released to the arena")
+	assert.Equal(t, "a", m.Name)
+	assert.Zero(t, resets)
+	assert.True(t, m.Release())
+	assert.Equal(t, 1, resets)
+
+	assert.False(t, (&Metric{}).Release())
+}
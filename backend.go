@@ -31,3 +31,30 @@ type RunnableBackend interface {
 	// Run executes backend send operations. Should be started in a goroutine.
 	Run(context.Context) error
 }
+
+// PayloadObserver is notified with the size in bytes of each payload serialized by a Backend.
+// Must be safe for concurrent use.
+type PayloadObserver func(size int)
+
+// Observe notifies the observer with the size of a payload, it does nothing if the observer is nil.
+func (o PayloadObserver) Observe(size int) {
+	if o != nil {
+		o(size)
+	}
+}
+
+// PayloadReporter represents a backend that reports sizes of the payloads it serializes.
+type PayloadReporter interface {
+	Backend
+	// SetPayloadObserver sets the observer notified after each payload is serialized.
+	// Must be called before metrics are sent.
+	SetPayloadObserver(PayloadObserver)
+}
+
+// ValuePrecisionSetter represents a backend that serializes float values as text.
+type ValuePrecisionSetter interface {
+	Backend
+	// SetValuePrecision sets the number of significant digits of float values, see FormatValue.
+	// Must be called before metrics are sent.
+	SetValuePrecision(digits int)
+}
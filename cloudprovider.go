@@ -25,3 +25,14 @@ type CloudProvider interface {
 	// SelfIP returns host's IPv4 address.
 	SelfIP() (IP, error)
 }
+
+// TagsResolverFactory is a function that returns a TagsResolver.
+type TagsResolverFactory func(*viper.Viper) (TagsResolver, error)
+
+// TagsResolver is a narrower alternative to CloudProvider that only enriches metrics and events with tags.
+type TagsResolver interface {
+	// Name returns the name of the tags resolver.
+	Name() string
+	// Tags returns the tags for the source IP. The returned tags are cached by the caller.
+	Tags(context.Context, IP) (Tags, error)
+}
@@ -0,0 +1,145 @@
+// Command adminclient is an example client of the gRPC admin service of gostatsd.
+//
+// Usage:
+//
+//	adminclient [--addr localhost:8127] stats
+//	adminclient [--addr localhost:8127] list [all|counter|timer|gauge|set]
+//	adminclient [--addr localhost:8127] search <pattern> [all|counter|timer|gauge|set]
+//	adminclient [--addr localhost:8127] delete <counter|timer|gauge|set> <name>...
+//	adminclient [--addr localhost:8127] flush
+//
+// The --user username:password flag authenticates to a server with users configured.
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/atlassian/gostatsd/pkg/statsd/adminpb"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+func main() {
+	addr := pflag.String("addr", "localhost:8127", "Address of the gRPC admin service")
+	timeout := pflag.Duration("timeout", 10*time.Second, "Timeout of the request")
+	user := pflag.String("user", "", "username:password of the user to authenticate as, if the server has users")
+	pflag.Parse()
+
+	if err := run(*addr, *timeout, *user, pflag.Args()); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+func run(addr string, timeout time.Duration, user string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("command is required, one of stats, list, search, delete, flush")
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := adminpb.NewAdminClient(conn)
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), timeout)
+	defer cancelFunc()
+	if user != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user)))
+	}
+
+	switch args[0] {
+	case "stats":
+		stats, err := client.GetStats(ctx, &adminpb.GetStatsRequest{})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Invalid messages received: %d\n", stats.BadLines)
+		fmt.Printf("Metrics received: %d\n", stats.MetricsReceived)
+		fmt.Printf("Packets received: %d\n", stats.PacketsReceived)
+		fmt.Printf("Events received: %d\n", stats.EventsReceived)
+		fmt.Printf("Last packet received: %v\n", stats.LastPacket.AsTime())
+		fmt.Printf("Last flush to backends: %v\n", stats.LastFlush.AsTime())
+		fmt.Printf("Last error from backends: %v\n", stats.LastFlushError.AsTime())
+	case "list":
+		metricType, err := parseMetricType(args[1:])
+		if err != nil {
+			return err
+		}
+		resp, err := client.ListMetrics(ctx, &adminpb.ListMetricsRequest{Type: metricType})
+		if err != nil {
+			return err
+		}
+		printMetrics(resp.Metrics)
+	case "search":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: search <pattern> [type]")
+		}
+		metricType, err := parseMetricType(args[2:])
+		if err != nil {
+			return err
+		}
+		resp, err := client.SearchMetrics(ctx, &adminpb.SearchMetricsRequest{Type: metricType, Pattern: args[1]})
+		if err != nil {
+			return err
+		}
+		printMetrics(resp.Metrics)
+	case "delete":
+		if len(args) < 3 {
+			return fmt.Errorf("usage: delete <type> <name>...")
+		}
+		metricType, err := parseMetricType(args[1:2])
+		if err != nil {
+			return err
+		}
+		resp, err := client.DeleteMetrics(ctx, &adminpb.DeleteMetricsRequest{Type: metricType, Names: args[2:]})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("deleted %d metrics\n", resp.Deleted)
+	case "flush":
+		if _, err := client.ForceFlush(ctx, &adminpb.ForceFlushRequest{}); err != nil {
+			return err
+		}
+		fmt.Println("flushed")
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	return nil
+}
+
+// parseMetricType parses the optional metric type argument. All types are returned if it is omitted.
+func parseMetricType(args []string) (adminpb.MetricType, error) {
+	if len(args) == 0 {
+		return adminpb.MetricType_ALL, nil
+	}
+	value, ok := adminpb.MetricType_value[strings.ToUpper(args[0])]
+	if !ok {
+		return 0, fmt.Errorf("unknown metric type %q", args[0])
+	}
+	return adminpb.MetricType(value), nil
+}
+
+func printMetrics(metrics []*adminpb.Metric) {
+	for _, m := range metrics {
+		name := m.Name
+		if m.TagsKey != "" {
+			name += "{" + m.TagsKey + "}"
+		}
+		switch m.Type {
+		case adminpb.MetricType_TIMER:
+			fmt.Printf("%s [timer]: %v\n", name, m.TimerValues)
+		case adminpb.MetricType_SET:
+			fmt.Printf("%s [set]: %v\n", name, m.SetValues)
+		default:
+			fmt.Printf("%s [%s]: %v\n", name, strings.ToLower(m.Type.String()), m.Value)
+		}
+	}
+}
@@ -0,0 +1,399 @@
+// Command gostatsd-bench sends metrics to a statsd server at a fixed rate and reports packet loss and latency.
+//
+// Packet loss is measured by running the preview command of the console of gostatsd for the duration of the
+// benchmark, so it includes metrics sent by other clients. Latency is measured by sending probe metrics with
+// unique names and waiting for their updates streamed by the REST API of gostatsd.
+//
+// Usage:
+//
+//	gostatsd-bench [--addr localhost:8125] [--rate 10000] [--duration 10s] [--workers 4] \
+//		[--metric-types counter,gauge,timer,set] [--tag-count 0] \
+//		[--console-addr localhost:8126] [--api-addr localhost:8128]
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+	"github.com/spf13/pflag"
+)
+
+const (
+	consolePrompt = "console> "
+	// sendTick is how often workers send a batch of metrics to keep up the rate.
+	sendTick = 10 * time.Millisecond
+	// drainTimeout is how long to wait for metrics in flight after sending stops.
+	drainTimeout = 1 * time.Second
+	// maxPreviewDuration is the maximum duration of the preview console command.
+	maxPreviewDuration = 1 * time.Minute
+)
+
+var metricTypeSuffixes = map[string]string{
+	"counter": "c",
+	"gauge":   "g",
+	"timer":   "ms",
+	"set":     "s",
+}
+
+type options struct {
+	addr          string
+	rate          int
+	duration      time.Duration
+	workers       int
+	metricTypes   []string
+	tagCount      int
+	names         int
+	prefix        string
+	consoleAddr   string
+	consoleLogin  string
+	apiAddr       string
+	apiKey        string
+	probeInterval time.Duration
+}
+
+func main() {
+	rand.Seed(time.Now().UnixNano())
+	var o options
+	pflag.StringVar(&o.addr, "addr", "localhost:8125", "Address of the statsd server")
+	pflag.IntVar(&o.rate, "rate", 10000, "Number of metrics sent per second")
+	pflag.DurationVar(&o.duration, "duration", 10*time.Second, "Duration of the benchmark")
+	pflag.IntVar(&o.workers, "workers", 4, "Number of goroutines sending metrics")
+	pflag.StringSliceVar(&o.metricTypes, "metric-types", []string{"counter", "gauge", "timer", "set"}, "Comma-separated list of types of sent metrics")
+	pflag.IntVar(&o.tagCount, "tag-count", 0, "Number of tags of each metric")
+	pflag.IntVar(&o.names, "names", 100, "Number of distinct metric names of each type")
+	pflag.StringVar(&o.prefix, "prefix", "gostatsd_bench", "Prefix of the names of sent metrics")
+	pflag.StringVar(&o.consoleAddr, "console-addr", "", "If set, address of the console of gostatsd used to measure packet loss")
+	pflag.StringVar(&o.consoleLogin, "console-login", "", "Credentials of the console in the username:password format, if required")
+	pflag.StringVar(&o.apiAddr, "api-addr", "", "If set, address of the REST API of gostatsd used to measure latency")
+	pflag.StringVar(&o.apiKey, "api-key", "", "API key of the REST API, if required")
+	pflag.DurationVar(&o.probeInterval, "probe-interval", 100*time.Millisecond, "How often to send latency probes")
+	pflag.Parse()
+
+	if err := run(o); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+func run(o options) error {
+	if o.rate <= 0 || o.workers <= 0 || o.duration <= 0 || o.names <= 0 {
+		return errors.New("rate, workers, duration and names must be positive")
+	}
+	for _, t := range o.metricTypes {
+		if _, ok := metricTypeSuffixes[t]; !ok {
+			return fmt.Errorf("unknown metric type %q, must be one of counter, gauge, timer, set", t)
+		}
+	}
+
+	var preview *consolePreview
+	if o.consoleAddr != "" {
+		var err error
+		if preview, err = startPreview(o.consoleAddr, o.consoleLogin, o.duration+drainTimeout); err != nil {
+			return fmt.Errorf("failed to start preview: %v", err)
+		}
+	}
+	var probes *prober
+	if o.apiAddr != "" {
+		var err error
+		if probes, err = startProber(o.apiAddr, o.apiKey, o.prefix); err != nil {
+			return fmt.Errorf("failed to subscribe to metric updates: %v", err)
+		}
+		defer probes.close()
+	}
+
+	var sent uint64
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(o.duration)
+	errs := make(chan error, o.workers+1)
+	for i := 0; i < o.workers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			rate := o.rate / o.workers
+			if id < o.rate%o.workers {
+				rate++
+			}
+			if err := send(o, rate, deadline, &sent); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	if probes != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := probes.send(o.addr, o.probeInterval, deadline, &sent); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(errs)
+	if err, ok := <-errs; ok {
+		return err
+	}
+
+	total := atomic.LoadUint64(&sent)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Sent\t%d metrics in %v (%.0f/s)\n", total, elapsed, float64(total)/elapsed.Seconds())
+	if preview != nil {
+		received, err := preview.wait()
+		if err != nil {
+			return fmt.Errorf("failed to measure packet loss: %v", err)
+		}
+		loss := 0.0
+		if received < total {
+			loss = float64(total-received) / float64(total) * 100
+		}
+		fmt.Fprintf(w, "Received\t%d metrics (%.2f%% loss)\n", received, loss)
+	}
+	if probes != nil {
+		time.Sleep(drainTimeout) // Wait for the updates of the last probes
+		latencies, lost := probes.results()
+		fmt.Fprintf(w, "Probes\t%d received, %d lost\n", len(latencies), lost)
+		if len(latencies) > 0 {
+			fmt.Fprintln(w, "\nPercentile\tLatency")
+			for _, p := range []float64{50, 90, 95, 99, 99.9, 100} {
+				fmt.Fprintf(w, "p%s\t%v\n", strconv.FormatFloat(p, 'f', -1, 64), percentile(latencies, p))
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// send sends metrics at the rate per second until the deadline, one metric per packet.
+func send(o options, rate int, deadline time.Time, sent *uint64) error {
+	conn, err := net.Dial("udp", o.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	tags := make([]string, o.tagCount)
+	for i := range tags {
+		tags[i] = fmt.Sprintf("tag%d:value%d", i, rand.Intn(10))
+	}
+	tagsSuffix := ""
+	if len(tags) > 0 {
+		tagsSuffix = "|#" + strings.Join(tags, ",")
+	}
+	ticker := time.NewTicker(sendTick)
+	defer ticker.Stop()
+	var due, done float64
+	perTick := float64(rate) * sendTick.Seconds()
+	for now := range ticker.C {
+		if now.After(deadline) {
+			return nil
+		}
+		for due += perTick; done < due; done++ {
+			t := o.metricTypes[rand.Intn(len(o.metricTypes))]
+			line := fmt.Sprintf("%s.%s.%d:%d|%s%s", o.prefix, t, rand.Intn(o.names), rand.Intn(1000), metricTypeSuffixes[t], tagsSuffix)
+			if _, err := conn.Write([]byte(line)); err != nil {
+				return err
+			}
+			atomic.AddUint64(sent, 1)
+		}
+	}
+	return nil
+}
+
+var previewReceived = regexp.MustCompile(`Received (\d+) metrics`)
+
+// consolePreview is a preview command running on the console of gostatsd.
+type consolePreview struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// startPreview connects to the console and starts the preview command for the duration.
+func startPreview(addr, login string, duration time.Duration) (*consolePreview, error) {
+	if duration > maxPreviewDuration {
+		return nil, fmt.Errorf("duration must not be longer than %v", maxPreviewDuration-drainTimeout)
+	}
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	p := &consolePreview{conn: conn, r: bufio.NewReader(conn)}
+	if login != "" {
+		if _, err = fmt.Fprintln(conn, login); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if _, err = p.readUntilPrompt(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err = fmt.Fprintf(conn, "preview %v\n", duration); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	time.Sleep(100 * time.Millisecond) // Let the console attach the tap before sending starts
+	return p, nil
+}
+
+// wait waits for the preview to finish and returns the number of received metrics.
+func (p *consolePreview) wait() (uint64, error) {
+	defer p.conn.Close()
+	output, err := p.readUntilPrompt()
+	if err != nil {
+		return 0, err
+	}
+	match := previewReceived.FindStringSubmatch(output)
+	if match == nil {
+		return 0, fmt.Errorf("unexpected preview output: %s", strings.TrimSpace(output))
+	}
+	return strconv.ParseUint(match[1], 10, 64)
+}
+
+// readUntilPrompt reads the output of the console until the next prompt.
+func (p *consolePreview) readUntilPrompt() (string, error) {
+	var buf []byte
+	for !strings.HasSuffix(string(buf), consolePrompt) {
+		b, err := p.r.ReadByte()
+		if err != nil {
+			if len(buf) > 0 {
+				return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(buf)))
+			}
+			return "", err
+		}
+		buf = append(buf, b)
+	}
+	return strings.TrimSuffix(string(buf), consolePrompt), nil
+}
+
+// prober sends probe metrics with unique names and measures how long it takes to receive their updates.
+type prober struct {
+	conn   *websocket.Conn
+	prefix string // Prefix of the names of probes
+
+	mu        sync.Mutex
+	sentAt    map[string]time.Time // Names of probes without updates to the time they were sent
+	latencies []time.Duration
+	done      chan struct{}
+}
+
+// startProber subscribes to the updates of probe metrics streamed by the REST API.
+func startProber(apiAddr, apiKey, prefix string) (*prober, error) {
+	p := &prober{
+		prefix: fmt.Sprintf("%s.probe.%d.", prefix, rand.Int63()),
+		sentAt: make(map[string]time.Time),
+		done:   make(chan struct{}),
+	}
+	header := http.Header{}
+	if apiKey != "" {
+		header.Set("Authorization", "Bearer "+apiKey)
+	}
+	u := "ws://" + apiAddr + "/ws/metrics?type=counter&q=" + url.QueryEscape("^"+regexp.QuoteMeta(p.prefix))
+	conn, _, err := websocket.DefaultDialer.Dial(u, header)
+	if err != nil {
+		return nil, err
+	}
+	p.conn = conn
+	go p.receive()
+	return p, nil
+}
+
+func (p *prober) receive() {
+	defer close(p.done)
+	for {
+		var u struct {
+			Name string `json:"name"`
+		}
+		if err := p.conn.ReadJSON(&u); err != nil {
+			return
+		}
+		now := time.Now()
+		p.mu.Lock()
+		if sentAt, ok := p.sentAt[u.Name]; ok {
+			p.latencies = append(p.latencies, now.Sub(sentAt))
+			delete(p.sentAt, u.Name)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// send sends a probe every interval until the deadline.
+func (p *prober) send(addr string, interval time.Duration, deadline time.Time, sent *uint64) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		now := <-ticker.C
+		if now.After(deadline) {
+			return nil
+		}
+		name := p.prefix + strconv.Itoa(i)
+		p.mu.Lock()
+		p.sentAt[name] = time.Now()
+		p.mu.Unlock()
+		if _, err := conn.Write([]byte(name + ":1|c")); err != nil {
+			return err
+		}
+		atomic.AddUint64(sent, 1)
+	}
+}
+
+// results returns the sorted latencies of received probes and the number of probes without updates.
+func (p *prober) results() ([]time.Duration, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	latencies := make([]time.Duration, len(p.latencies))
+	copy(latencies, p.latencies)
+	sort.Sort(durations(latencies))
+	return latencies, len(p.sentAt)
+}
+
+func (p *prober) close() {
+	p.conn.Close() // #nosec
+	<-p.done
+}
+
+// durations sorts in ascending order.
+type durations []time.Duration
+
+func (d durations) Len() int {
+	return len(d)
+}
+
+func (d durations) Less(i, j int) bool {
+	return d[i] < d[j]
+}
+
+func (d durations) Swap(i, j int) {
+	d[i], d[j] = d[j], d[i]
+}
+
+// percentile returns the p-th percentile of the sorted latencies using the nearest-rank method.
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p/100*float64(len(latencies)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(latencies) {
+		rank = len(latencies) - 1
+	}
+	return latencies[rank]
+}
@@ -0,0 +1,211 @@
+// Command gostatsd-cli is a client of the REST API of gostatsd.
+//
+// Usage:
+//
+//	gostatsd-cli [--addr localhost:8128] [--tls] [--timeout 10s] [--api-key key] stats
+//	gostatsd-cli counters|timers|gauges|sets [pattern]
+//	gostatsd-cli delete <counter|timer|gauge|set> <name>...
+//	gostatsd-cli flush
+//
+// The exit code is non-zero if a request fails. delete deletes every name, printing the result for each, even
+// if deleting one of them fails.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func main() {
+	if err := newRootCommand(os.Stdout).Execute(); err != nil {
+		os.Exit(1) // Cobra prints the error
+	}
+}
+
+// client sends requests to the REST API.
+type client struct {
+	addr    string
+	tls     bool
+	timeout time.Duration
+	apiKey  string
+}
+
+// envelope is the JSON object all responses of the REST API are wrapped into.
+type envelope struct {
+	Data  json.RawMessage `json:"data"`
+	Error *string         `json:"error"`
+}
+
+// do sends the request and decodes the data of the response into result, unless result is nil.
+func (c *client) do(method, path string, query url.Values, result interface{}) error {
+	scheme := "http"
+	if c.tls {
+		scheme = "https"
+	}
+	u := url.URL{Scheme: scheme, Host: c.addr, Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	ctx, cancelFunc := context.WithTimeout(context.Background(), c.timeout)
+	defer cancelFunc()
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var e envelope
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<20)).Decode(&e); err != nil {
+		return fmt.Errorf("invalid response with status %s: %v", resp.Status, err)
+	}
+	if e.Error != nil {
+		return errors.New(*e.Error)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(e.Data, result)
+}
+
+type metric struct {
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	TagsKey     string    `json:"tags_key"`
+	Value       *float64  `json:"value"`
+	TimerValues []float64 `json:"timer_values"`
+	SetValues   []string  `json:"set_values"`
+}
+
+type stats struct {
+	BadLines        uint64    `json:"bad_lines"`
+	MetricsReceived uint64    `json:"metrics_received"`
+	PacketsReceived uint64    `json:"packets_received"`
+	EventsReceived  uint64    `json:"events_received"`
+	UnknownFields   uint64    `json:"unknown_fields"`
+	LastPacket      time.Time `json:"last_packet"`
+	LastFlush       time.Time `json:"last_flush"`
+	LastFlushError  time.Time `json:"last_flush_error"`
+}
+
+var metricTypes = []string{"counter", "timer", "gauge", "set"}
+
+func newRootCommand(out io.Writer) *cobra.Command {
+	c := &client{}
+	root := &cobra.Command{
+		Use:          "gostatsd-cli",
+		Short:        "Client of the REST API of gostatsd",
+		SilenceUsage: true, // Errors are printed without the usage
+	}
+	root.PersistentFlags().StringVar(&c.addr, "addr", "localhost:8128", "Address of the REST API")
+	root.PersistentFlags().BoolVar(&c.tls, "tls", false, "Connect using HTTPS")
+	root.PersistentFlags().DurationVar(&c.timeout, "timeout", 10*time.Second, "Timeout of the request")
+	root.PersistentFlags().StringVar(&c.apiKey, "api-key", os.Getenv("GSD_API_KEY"), "API key to authenticate with, defaults to $GSD_API_KEY")
+
+	root.AddCommand(&cobra.Command{
+		Use:   "stats",
+		Short: "Print statistics of the server",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var s stats
+			if err := c.do("GET", "/v1/stats", nil, &s); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Invalid messages received: %d\n", s.BadLines)
+			fmt.Fprintf(out, "Metrics received: %d\n", s.MetricsReceived)
+			fmt.Fprintf(out, "Packets received: %d\n", s.PacketsReceived)
+			fmt.Fprintf(out, "Events received: %d\n", s.EventsReceived)
+			fmt.Fprintf(out, "Unknown fields skipped: %d\n", s.UnknownFields)
+			fmt.Fprintf(out, "Last packet received: %v\n", s.LastPacket)
+			fmt.Fprintf(out, "Last flush to backends: %v\n", s.LastFlush)
+			fmt.Fprintf(out, "Last error from backends: %v\n", s.LastFlushError)
+			return nil
+		},
+	})
+	for _, metricType := range metricTypes {
+		metricType := metricType
+		root.AddCommand(&cobra.Command{
+			Use:   metricType + "s [pattern]",
+			Short: "Print " + metricType + "s with names matching the optional regular expression",
+			Args:  cobra.MaximumNArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				query := url.Values{"type": {metricType}}
+				if len(args) > 0 {
+					query.Set("q", args[0])
+				}
+				var metrics []metric
+				if err := c.do("GET", "/v1/metrics", query, &metrics); err != nil {
+					return err
+				}
+				printMetrics(out, metrics)
+				return nil
+			},
+		})
+	}
+	root.AddCommand(&cobra.Command{
+		Use:   "delete <" + strings.Join(metricTypes, "|") + "> <name>...",
+		Short: "Delete metrics of the type with the names",
+		Args:  cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Every name is deleted even if deleting one fails, the errors are returned together and printed by cobra
+			var errs []error
+			for _, name := range args[1:] {
+				var result struct {
+					Deleted uint32 `json:"deleted"`
+				}
+				path := "/v1/metrics/" + url.PathEscape(args[0]) + "/" + url.PathEscape(name)
+				if err := c.do("DELETE", path, nil, &result); err != nil {
+					errs = append(errs, fmt.Errorf("failed to delete %s: %v", name, err))
+					continue
+				}
+				fmt.Fprintf(out, "%s: deleted %d metrics\n", name, result.Deleted)
+			}
+			return errors.Join(errs...)
+		},
+	})
+	root.AddCommand(&cobra.Command{
+		Use:   "flush",
+		Short: "Flush metrics to backends immediately",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := c.do("POST", "/v1/flush", nil, nil); err != nil {
+				return err
+			}
+			fmt.Fprintln(out, "flushed")
+			return nil
+		},
+	})
+	return root
+}
+
+func printMetrics(out io.Writer, metrics []metric) {
+	for _, m := range metrics {
+		name := m.Name
+		if m.TagsKey != "" {
+			name += "{" + m.TagsKey + "}"
+		}
+		switch {
+		case m.Type == "timer":
+			fmt.Fprintf(out, "%s [timer]: %v\n", name, m.TimerValues)
+		case m.Type == "set":
+			fmt.Fprintf(out, "%s [set]: %v\n", name, m.SetValues)
+		case m.Value != nil:
+			fmt.Fprintf(out, "%s [%s]: %v\n", name, m.Type, *m.Value)
+		}
+	}
+}
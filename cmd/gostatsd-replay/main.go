@@ -0,0 +1,226 @@
+// Command gostatsd-replay replays statsd datagrams captured in a pcap or pcapng file to a statsd server.
+//
+// UDP packets sent to the port are replayed at the original rate scaled by the speed.
+//
+// With --lines, the file is a list of statsd lines instead, e.g. the output of the dump console command, which
+// are sent as fast as possible in datagrams of up to 1432 bytes. The prompts of the console are removed
+// and lines that are not metrics are skipped, so that the output of the console can be replayed as is. The lines
+// are read from the standard input if the file is -.
+//
+// Usage:
+//
+//	gostatsd-replay [--addr localhost:8125] [--port 8125] [--speed 1.0] <file>
+//	gostatsd-replay [--addr localhost:8125] --lines <file>
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/spf13/pflag"
+)
+
+// packetSource reads packets from a capture file.
+type packetSource interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+}
+
+const (
+	// maxPacketSize is the maximum size of the datagrams lines are sent in.
+	maxPacketSize = 1432
+	// consolePrompt is the prompt of the console, removed from replayed lines.
+	consolePrompt = "console> "
+)
+
+type stats struct {
+	lines   uint64 // Replayed lines
+	packets uint64 // Replayed packets
+	bytes   uint64 // Replayed bytes of payloads
+	skipped uint64 // Packets that are not statsd datagrams, or lines that are not metrics
+}
+
+func main() {
+	addr := pflag.String("addr", "localhost:8125", "Address of the statsd server to replay to")
+	port := pflag.Uint16("port", 8125, "Destination UDP port of the captured statsd datagrams")
+	speed := pflag.Float64("speed", 1.0, "Replay speed relative to the original packet rate, e.g. 2.0 replays twice as fast")
+	lines := pflag.Bool("lines", false, "Replay a file of statsd lines, e.g. the output of the dump console command, instead of a capture file")
+	pflag.Parse()
+
+	if pflag.NArg() != 1 {
+		log.Fatal("path of the file to replay is required")
+	}
+	if *lines {
+		s, elapsed, err := runLines(pflag.Arg(0), *addr)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		fmt.Printf("Replayed %d lines in %d packets (%d bytes) in %v, skipped %d lines\n", s.lines, s.packets, s.bytes, elapsed, s.skipped)
+		return
+	}
+	if *speed <= 0 {
+		log.Fatal("speed must be positive")
+	}
+	s, elapsed, err := run(pflag.Arg(0), *addr, *port, *speed)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	fmt.Printf("Replayed %d packets (%d bytes) in %v, skipped %d packets\n", s.packets, s.bytes, elapsed, s.skipped)
+}
+
+func run(path, addr string, port uint16, speed float64) (stats, time.Duration, error) {
+	var s stats
+	f, err := os.Open(path)
+	if err != nil {
+		return s, 0, err
+	}
+	defer f.Close()
+	source, err := newPacketSource(f)
+	if err != nil {
+		return s, 0, err
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return s, 0, err
+	}
+	defer conn.Close()
+
+	var start time.Time       // Wall clock time of the first packet
+	var firstPacket time.Time // Capture time of the first packet
+	for {
+		data, ci, err := source.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return s, time.Since(start), err
+		}
+		payload, ok := statsdPayload(data, source.LinkType(), port)
+		if !ok {
+			s.skipped++
+			continue
+		}
+		if start.IsZero() {
+			start = time.Now()
+			firstPacket = ci.Timestamp
+		} else {
+			offset := time.Duration(float64(ci.Timestamp.Sub(firstPacket)) / speed)
+			if wait := start.Add(offset).Sub(time.Now()); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		if _, err := conn.Write(payload); err != nil {
+			return s, time.Since(start), err
+		}
+		s.packets++
+		s.bytes += uint64(len(payload))
+	}
+	if start.IsZero() {
+		return s, 0, nil
+	}
+	return s, time.Since(start), nil
+}
+
+// runLines sends the statsd lines of the file, or of the standard input if the path is -, to the address.
+func runLines(path, addr string) (stats, time.Duration, error) {
+	var s stats
+	in := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return s, 0, err
+		}
+		defer f.Close()
+		in = f
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return s, 0, err
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	buf := new(bytes.Buffer)
+	send := func() error {
+		if buf.Len() == 0 {
+			return nil
+		}
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		s.packets++
+		s.bytes += uint64(buf.Len())
+		buf.Reset()
+		return nil
+	}
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line, ok := metricLine(scanner.Bytes())
+		if !ok {
+			s.skipped++
+			continue
+		}
+		if buf.Len() > 0 && buf.Len()+len(line) >= maxPacketSize {
+			if err := send(); err != nil {
+				return s, time.Since(start), err
+			}
+		}
+		buf.Write(line)     // #nosec
+		buf.WriteByte('\n') // #nosec
+		s.lines++
+	}
+	if err := scanner.Err(); err != nil {
+		return s, time.Since(start), err
+	}
+	if err := send(); err != nil {
+		return s, time.Since(start), err
+	}
+	return s, time.Since(start), nil
+}
+
+// metricLine returns the line without console prompts if it is a metric. Empty lines and console messages, which
+// have no value separator, are not metrics.
+func metricLine(line []byte) ([]byte, bool) {
+	line = bytes.TrimSpace(line)
+	for bytes.HasPrefix(line, []byte(consolePrompt)) {
+		line = line[len(consolePrompt):]
+	}
+	colon := bytes.IndexByte(line, ':')
+	return line, colon > 0 && bytes.IndexByte(line[colon:], '|') > 0
+}
+
+// newPacketSource returns a reader of the pcap or pcapng file.
+func newPacketSource(f *os.File) (packetSource, error) {
+	r, err := pcapgo.NewReader(f)
+	if err == nil {
+		return r, nil
+	}
+	if _, errSeek := f.Seek(0, io.SeekStart); errSeek != nil {
+		return nil, errSeek
+	}
+	ngr, errNg := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+	if errNg != nil {
+		return nil, errors.New("not a pcap or pcapng file: " + err.Error())
+	}
+	return ngr, nil
+}
+
+// statsdPayload returns the payload of the packet if it is a UDP datagram sent to the port.
+func statsdPayload(data []byte, linkType layers.LinkType, port uint16) ([]byte, bool) {
+	packet := gopacket.NewPacket(data, linkType, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok || uint16(udp.DstPort) != port || len(udp.Payload) == 0 {
+		return nil, false
+	}
+	return udp.Payload, true
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricLine(t *testing.T) {
+	t.Parallel()
+	for input, expected := range map[string]string{
+		"foo.bar:42|c":                   "foo.bar:42|c",
+		"console> foo.bar:1.5|g|#a:b\r":  "foo.bar:1.5|g|#a:b",
+		"console> console> foo:x|s|u:ms": "foo:x|s|u:ms",
+	} {
+		line, ok := metricLine([]byte(input))
+		assert.True(t, ok, input)
+		assert.Equal(t, expected, string(line))
+	}
+	for _, input := range []string{"", "console> ", "console> goodbye", "unknown metric type \"x\"", ":1|c", "foo:1"} {
+		_, ok := metricLine([]byte(input))
+		assert.False(t, ok, input)
+	}
+}
+
+// TestReplayDump replays the output of the dump console command of a server into another server.
+func TestReplayDump(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	newDispatcher := func() *statsd.MetricDispatcher {
+		d := statsd.NewMetricDispatcher(2, 10, statsd.AggregatorFactoryFunc(func() statsd.Aggregator {
+			return statsd.NewMetricAggregator([]float64{90}, time.Minute)
+		}))
+		go d.Run(ctx)
+		return d
+	}
+
+	source := newDispatcher()
+	metrics := []gostatsd.Metric{
+		{Name: "requests", Type: gostatsd.COUNTER, Value: 42, Tags: gostatsd.Tags{"env:prod"}},
+		{Name: "requests", Type: gostatsd.COUNTER, Value: 7},
+		{Name: "latency", Type: gostatsd.TIMER, Value: 12.5, Tags: gostatsd.Tags{"env:prod"}},
+		{Name: "latency", Type: gostatsd.TIMER, Value: 3, Tags: gostatsd.Tags{"env:prod"}},
+		{Name: "temperature", Type: gostatsd.GAUGE, Value: -4.25},
+		{Name: "memory", Type: gostatsd.GAUGE, Value: 1024, Unit: "bytes"},
+		{Name: "users", Type: gostatsd.SET, StringValue: "alice"},
+		{Name: "users", Type: gostatsd.SET, StringValue: "bob"},
+	}
+	for i := range metrics {
+		require.NoError(t, source.DispatchMetric(ctx, &metrics[i]))
+	}
+	expected := func() []string {
+		lines := dumpLines(t, ctx, source)
+		if len(lines) != len(metrics)+1 { // Negative gauges are dumped as two lines
+			return nil
+		}
+		return lines
+	}
+	require.Eventually(t, func() bool { return expected() != nil }, 5*time.Second, 10*time.Millisecond)
+
+	// The output of the console, with its prompts, is replayed as is
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go (&statsd.ConsoleServer{Dispatcher: source}).Serve(ctx, l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprint(conn, "dump\nquit\n")
+	require.NoError(t, err)
+	output, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	dir, err := ioutil.TempDir("", "gostatsd-replay")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dump.txt")
+	require.NoError(t, ioutil.WriteFile(path, output, 0600))
+
+	destination := newDispatcher()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	receiver := statsd.NewMetricReceiver("", statsd.NewDispatchingHandler(destination, nil, nil, 1))
+	go receiver.Receive(ctx, pc)
+
+	s, _, err := runLines(path, pc.LocalAddr().String())
+	require.NoError(t, err)
+	assert.EqualValues(t, len(metrics)+1, s.lines)
+	assert.EqualValues(t, 1, s.packets)
+	assert.EqualValues(t, 1, s.skipped) // goodbye
+
+	want := expected()
+	var got []string
+	assert.Eventually(t, func() bool {
+		got = dumpLines(t, ctx, destination)
+		return assert.ObjectsAreEqual(want, got)
+	}, 5*time.Second, 10*time.Millisecond, "dump of the destination %v", got)
+}
+
+func TestRunLinesSplitsPackets(t *testing.T) {
+	t.Parallel()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	line := "foo." + strings.Repeat("x", 100) + ":1|c\n"
+	dir, err := ioutil.TempDir("", "gostatsd-replay")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lines.txt")
+	require.NoError(t, ioutil.WriteFile(path, bytes.Repeat([]byte(line), 30), 0600))
+
+	s, _, err := runLines(path, pc.LocalAddr().String())
+	require.NoError(t, err)
+	assert.EqualValues(t, 30, s.lines)
+	assert.EqualValues(t, 3, s.packets)
+	buf := make([]byte, 65536)
+	var received int
+	for i := 0; i < 3; i++ {
+		require.NoError(t, pc.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, _, err := pc.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.True(t, n < maxPacketSize)
+		received += n
+	}
+	assert.Equal(t, 30*len(line), received)
+}
+
+// dumpLines returns the sorted statsd lines of the metrics aggregated by the dispatcher, as printed by the dump
+// console command.
+func dumpLines(t *testing.T, ctx context.Context, d statsd.Dispatcher) []string {
+	m, err := statsd.Snapshot(ctx, d)
+	require.NoError(t, err)
+	buf := new(bytes.Buffer)
+	require.NoError(t, m.MarshalLines(buf, nil))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	sort.Strings(lines)
+	return lines
+}
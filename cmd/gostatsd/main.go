@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	_ "expvar"
 	"fmt"
+	"io"
 	"math/rand"
 	"net/http"
 	_ "net/http/pprof"
@@ -16,8 +18,15 @@ import (
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/backends"
+	statsdclient "github.com/atlassian/gostatsd/pkg/client/statsd"
 	"github.com/atlassian/gostatsd/pkg/cloudproviders"
+	"github.com/atlassian/gostatsd/pkg/cluster"
+	"github.com/atlassian/gostatsd/pkg/ha"
+	"github.com/atlassian/gostatsd/pkg/receiver/ebpf"
+	"github.com/atlassian/gostatsd/pkg/receiver/otlp"
 	"github.com/atlassian/gostatsd/pkg/statsd"
+	"github.com/atlassian/gostatsd/pkg/statsd/api"
+	"github.com/atlassian/gostatsd/pkg/tracing/xray"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/spf13/pflag"
@@ -32,10 +41,12 @@ const (
 	ParamProfile = "profile"
 	// ParamJSON makes logger log in JSON format.
 	ParamJSON = "json"
-	// ParamConfigPath provides file with configuration.
+	// ParamConfigPath provides files with configuration.
 	ParamConfigPath = "config-path"
 	// ParamVersion makes program output its version.
 	ParamVersion = "version"
+	// ParamCheckConfig makes program validate its configuration and exit without serving.
+	ParamCheckConfig = "check-config"
 )
 
 // EnvPrefix is the prefix of the inspected environment variables.
@@ -54,11 +65,45 @@ func main() {
 		fmt.Printf("Version: %s - Commit: %s - Date: %s\n", Version, GitCommit, BuildDate)
 		return
 	}
+	if v.GetBool(ParamCheckConfig) {
+		if err := checkConfig(v); err != nil {
+			fmt.Fprintln(os.Stderr, "Configuration is invalid:")
+			if errs, ok := err.(statsd.ConfigErrors); ok {
+				for _, e := range errs {
+					fmt.Fprintf(os.Stderr, "  - %v\n", e)
+				}
+			} else {
+				fmt.Fprintf(os.Stderr, "  - %v\n", err)
+			}
+			os.Exit(1)
+		}
+		return
+	}
 	if err := run(v); err != nil {
 		log.Fatalf("%v", err)
 	}
 }
 
+// checkConfig constructs the server and validates its configuration without opening any listeners.
+func checkConfig(v *viper.Viper) error {
+	s, err := constructServer(v)
+	if err != nil {
+		return err
+	}
+	if auditLog, ok := s.AuditLogWriter.(io.Closer); ok {
+		defer auditLog.Close() // #nosec
+	}
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	names := make([]string, len(s.Backends))
+	for i, backend := range s.Backends {
+		names[i] = backend.Name()
+	}
+	fmt.Printf("Configuration is valid, backends: %s\n", strings.Join(names, ", "))
+	return nil
+}
+
 func run(v *viper.Viper) error {
 	profileAddr := v.GetString(ParamProfile)
 	if profileAddr != "" {
@@ -72,6 +117,9 @@ func run(v *viper.Viper) error {
 	if err != nil {
 		return err
 	}
+	if auditLog, ok := s.AuditLogWriter.(io.Closer); ok {
+		defer auditLog.Close() // #nosec
+	}
 
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
@@ -104,24 +152,283 @@ func constructServer(v *viper.Viper) (*statsd.Server, error) {
 	if err != nil {
 		return nil, err
 	}
+	percentileTemplate, err := statsd.ParsePercentileTemplate(v.GetString(statsd.ParamPercentileTemplate))
+	if err != nil {
+		return nil, err
+	}
+	// Negative counters
+	negativeCounters, err := statsd.ParseNegativeCounterPolicy(v.GetString(statsd.ParamNegativeCounters))
+	if err != nil {
+		return nil, err
+	}
+	// Set mode
+	setMode, err := statsd.ParseSetMode(v.GetString(statsd.ParamSetMode))
+	if err != nil {
+		return nil, err
+	}
+	// Timer mode
+	timerMode, err := statsd.ParseTimerMode(v.GetString(statsd.ParamTimerMode))
+	if err != nil {
+		return nil, err
+	}
+	// Expiry intervals of metric types
+	expiryIntervals, err := statsd.ParseExpiryIntervals(toSlice(v.GetString(statsd.ParamExpiryIntervals)))
+	if err != nil {
+		return nil, err
+	}
+	// Cardinality report
+	cardinalityReport, err := statsd.ParseCardinalityReport(v.GetString(statsd.ParamCardinalityReport))
+	if err != nil {
+		return nil, err
+	}
+	// Heartbeat
+	heartbeatType, err := statsd.ParseHeartbeatType(v.GetString(statsd.ParamHeartbeatType))
+	if err != nil {
+		return nil, err
+	}
+	// Type of metric lines without a type
+	untypedMetricType, err := statsd.ParseUntypedType(v.GetString(statsd.ParamUntypedMetricType))
+	if err != nil {
+		return nil, err
+	}
+	// Flush intervals of backends
+	backendFlushIntervals, err := getBackendDurations(toSlice(v.GetString(statsd.ParamBackendFlushIntervals)), "flush interval")
+	if err != nil {
+		return nil, err
+	}
+	// Timeouts of backends
+	backendTimeouts, err := getBackendDurations(toSlice(v.GetString(statsd.ParamBackendTimeouts)), "timeout")
+	if err != nil {
+		return nil, err
+	}
+	// Backend send queues
+	backendQueuePolicy, err := statsd.ParseQueuePolicy(v.GetString(statsd.ParamBackendQueuePolicy))
+	if err != nil {
+		return nil, err
+	}
+	// Cloud lookups
+	cloudLookupPolicy, err := statsd.ParseLookupPolicy(v.GetString(statsd.ParamCloudLookupPolicy))
+	if err != nil {
+		return nil, err
+	}
+	// Dispatch
+	dispatchKeyHash, err := statsd.ParseKeyHash(v.GetString(statsd.ParamDispatchKeyHash))
+	if err != nil {
+		return nil, err
+	}
+	// Tenants
+	tenantMode, err := statsd.ParseTenantMode(v.GetString(statsd.ParamTenantMode))
+	if err != nil {
+		return nil, err
+	}
+	tenants, err := statsd.NewTenantsFromViper(v)
+	if err != nil {
+		return nil, err
+	}
+	// Rename rules
+	renameRules, err := statsd.NewRenameRulesFromViper(v)
+	if err != nil {
+		return nil, err
+	}
+	// CPUs to pin to
+	pinCPUs, err := getCPUs(toSlice(v.GetString(statsd.ParamPinCPUs)))
+	if err != nil {
+		return nil, err
+	}
+	// Payload size histograms
+	payloadBuckets, err := getPayloadBuckets(toSlice(v.GetString(statsd.ParamPayloadBuckets)))
+	if err != nil {
+		return nil, err
+	}
+	// QUIC receiver
+	var quicTLSConfig *tls.Config
+	if quicAddr := v.GetString(statsd.ParamQUICAddr); quicAddr != "" {
+		cert, errCert := tls.LoadX509KeyPair(v.GetString(statsd.ParamQUICCertFile), v.GetString(statsd.ParamQUICKeyFile))
+		if errCert != nil {
+			return nil, fmt.Errorf("failed to load QUIC certificate: %v", errCert)
+		}
+		quicTLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS13}
+	}
+	// Users
+	credentials, err := statsd.NewCredentialsFromViper(v)
+	if err != nil {
+		return nil, err
+	}
+	// Audit log
+	var auditLog io.Writer
+	if auditLogPath := v.GetString(statsd.ParamAuditLog); auditLogPath != "" {
+		f, errOpen := os.OpenFile(auditLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if errOpen != nil {
+			return nil, fmt.Errorf("failed to open audit log: %v", errOpen)
+		}
+		auditLog = f
+	}
+	// Services
+	var services []statsd.Service
+	var updates *statsd.MetricBroadcaster
+	if apiAddr := v.GetString(api.ParamAddr); apiAddr != "" {
+		apiKeys, apiKeyExpiry, errKeys := api.NewAPIKeysFromViper(v)
+		if errKeys != nil {
+			return nil, errKeys
+		}
+		var apiTLSConfig *tls.Config
+		if certFile := v.GetString(api.ParamTLSCertFile); certFile != "" {
+			cert, errCert := tls.LoadX509KeyPair(certFile, v.GetString(api.ParamTLSKeyFile))
+			if errCert != nil {
+				return nil, fmt.Errorf("failed to load API certificate: %v", errCert)
+			}
+			apiTLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		}
+		updates = statsd.NewMetricBroadcaster(v.GetDuration(api.ParamMinUpdateInterval))
+		services = append(services, api.Service(api.Server{
+			Addr:           apiAddr,
+			Updates:        updates,
+			Credentials:    credentials,
+			APIKeys:        apiKeys,
+			APIKeyExpiry:   apiKeyExpiry,
+			AuditLogWriter: auditLog,
+			TLSConfig:      apiTLSConfig,
+			IngestRate:     v.GetFloat64(api.ParamIngestRate),
+			IngestBurst:    v.GetInt(api.ParamIngestBurst),
+		}))
+	}
+	if otlpAddr := v.GetString(otlp.ParamAddr); otlpAddr != "" {
+		services = append(services, otlp.Service(otlp.Server{Addr: otlpAddr}))
+	}
+	if ebpfInterface := v.GetString(ebpf.ParamInterface); ebpfInterface != "" {
+		services = append(services, ebpf.Service(ebpf.Server{Interface: ebpfInterface, Port: v.GetInt(ebpf.ParamPort)}))
+	}
+	var tracer statsd.Tracer
+	if daemonAddr := v.GetString(xray.ParamDaemonAddr); daemonAddr != "" {
+		xrayTracer, errTracer := xray.NewTracer(daemonAddr, v.GetFloat64(xray.ParamSamplingRate))
+		if errTracer != nil {
+			return nil, fmt.Errorf("failed to create X-Ray tracer: %v", errTracer)
+		}
+		tracer = xrayTracer
+	}
+	var leader statsd.Leader
+	if redisAddr := v.GetString(ha.ParamRedisAddr); redisAddr != "" {
+		hostname, errHostname := os.Hostname()
+		if errHostname != nil {
+			return nil, fmt.Errorf("failed to get the hostname for leader election: %v", errHostname)
+		}
+		elector, errLeader := ha.NewRedisLeaderElector(redisAddr, v.GetString(ha.ParamKey), fmt.Sprintf("%s:%d", hostname, os.Getpid()), v.GetDuration(ha.ParamTTL))
+		if errLeader != nil {
+			return nil, fmt.Errorf("failed to create leader election: %v", errLeader)
+		}
+		leader = elector
+	}
+	var internalClient statsd.MetricClient
+	if addr := v.GetString(statsdclient.ParamAddr); addr != "" {
+		client, errClient := statsdclient.NewClient(addr, v.GetInt(statsdclient.ParamPoolSize))
+		if errClient != nil {
+			return nil, fmt.Errorf("failed to create internal metrics client: %v", errClient)
+		}
+		internalClient = client
+	}
+	var clusterShards statsd.Cluster
+	if bindAddr := v.GetString(cluster.ParamBindAddr); bindAddr != "" {
+		secretKey, errCluster := cluster.ParseSecretKey(v.GetString(cluster.ParamSecretKey))
+		if errCluster != nil {
+			return nil, errCluster
+		}
+		c, errCluster := cluster.NewCluster(bindAddr, v.GetInt(cluster.ParamBindPort), v.GetString(cluster.ParamNodeName), toSlice(v.GetString(cluster.ParamJoin)), secretKey)
+		if errCluster != nil {
+			return nil, fmt.Errorf("failed to create cluster: %v", errCluster)
+		}
+		clusterShards = c
+	}
 	// Create server
 	return &statsd.Server{
-		Backends:            backendsList,
-		ConsoleAddr:         v.GetString(statsd.ParamConsoleAddr),
-		CloudProvider:       cloud,
-		Limiter:             rate.NewLimiter(rate.Limit(v.GetInt(statsd.ParamMaxCloudRequests)), v.GetInt(statsd.ParamBurstCloudRequests)),
-		DefaultTags:         toSlice(v.GetString(statsd.ParamDefaultTags)),
-		ExpiryInterval:      v.GetDuration(statsd.ParamExpiryInterval),
-		FlushInterval:       v.GetDuration(statsd.ParamFlushInterval),
-		MaxReaders:          v.GetInt(statsd.ParamMaxReaders),
-		MaxWorkers:          v.GetInt(statsd.ParamMaxWorkers),
-		MaxQueueSize:        v.GetInt(statsd.ParamMaxQueueSize),
-		MaxConcurrentEvents: v.GetInt(statsd.ParamMaxConcurrentEvents),
-		MetricsAddr:         v.GetString(statsd.ParamMetricsAddr),
-		Namespace:           v.GetString(statsd.ParamNamespace),
-		PercentThreshold:    pt,
-		WebConsoleAddr:      v.GetString(statsd.ParamWebAddr),
-		Viper:               v,
+		Backends:                backendsList,
+		ConsoleAddr:             v.GetString(statsd.ParamConsoleAddr),
+		ConsoleIdleTimeout:      v.GetDuration(statsd.ParamConsoleIdleTimeout),
+		ConsoleCommandInterval:  v.GetDuration(statsd.ParamConsoleCommandInterval),
+		ConsoleStateDir:         v.GetString(statsd.ParamConsoleStateDir),
+		DisableConsole:          v.GetBool(statsd.ParamDisableConsole),
+		GRPCAddr:                v.GetString(statsd.ParamGRPCAddr),
+		HealthAddr:              v.GetString(statsd.ParamHealthAddr),
+		CloudProvider:           cloud,
+		Limiter:                 rate.NewLimiter(rate.Limit(v.GetInt(statsd.ParamMaxCloudRequests)), v.GetInt(statsd.ParamBurstCloudRequests)),
+		MaxCloudLookups:         v.GetInt(statsd.ParamMaxConcurrentCloudLookups),
+		CloudLookupPolicy:       cloudLookupPolicy,
+		DefaultTags:             toSlice(v.GetString(statsd.ParamDefaultTags)),
+		DefaultTagsEnv:          toSlice(v.GetString(statsd.ParamDefaultTagsEnv)),
+		ExpiryInterval:          v.GetDuration(statsd.ParamExpiryInterval),
+		ExpiryIntervals:         expiryIntervals,
+		FlushInterval:           v.GetDuration(statsd.ParamFlushInterval),
+		BackendFlushIntervals:   backendFlushIntervals,
+		BackendTimeouts:         backendTimeouts,
+		SkipEmptyFlushBackends:  toSlice(v.GetString(statsd.ParamSkipEmptyFlushBackends)),
+		BackendQueueSize:        v.GetInt(statsd.ParamBackendQueueSize),
+		BackendQueuePolicy:      backendQueuePolicy,
+		ValuePrecision:          v.GetInt(statsd.ParamValuePrecision),
+		TenantMode:              tenantMode,
+		Tenants:                 tenants,
+		DefaultTenant:           v.GetString(statsd.ParamDefaultTenant),
+		NegativeCounters:        negativeCounters,
+		ZeroFillCounters:        v.GetBool(statsd.ParamZeroFillCounters),
+		ZeroFillGauges:          v.GetBool(statsd.ParamZeroFillGauges),
+		SetMode:                 setMode,
+		ExactSets:               toSlice(v.GetString(statsd.ParamExactSets)),
+		TimerMode:               timerMode,
+		TimerCompression:        v.GetFloat64(statsd.ParamTimerCompression),
+		CardinalityReport:       cardinalityReport,
+		CardinalityReportEvery:  v.GetInt(statsd.ParamCardinalityReportEvery),
+		PayloadBuckets:          payloadBuckets,
+		RenameRules:             renameRules,
+		MaxReaders:              v.GetInt(statsd.ParamMaxReaders),
+		MaxWorkers:              v.GetInt(statsd.ParamMaxWorkers),
+		MaxQueueSize:            v.GetInt(statsd.ParamMaxQueueSize),
+		DispatchKeyHash:         dispatchKeyHash,
+		MaxConcurrentEvents:     v.GetInt(statsd.ParamMaxConcurrentEvents),
+		MetricsAddr:             v.GetString(statsd.ParamMetricsAddr),
+		MetricsSocket:           v.GetString(statsd.ParamMetricsSocket),
+		MetricsSocketFramed:     v.GetBool(statsd.ParamMetricsSocketFramed),
+		QUICAddr:                v.GetString(statsd.ParamQUICAddr),
+		QUICTLSConfig:           quicTLSConfig,
+		QUICMaxStreams:          v.GetInt(statsd.ParamQUICMaxStreams),
+		Namespace:               v.GetString(statsd.ParamNamespace),
+		PercentThreshold:        pt,
+		PercentileTemplate:      percentileTemplate,
+		WebConsoleAddr:          v.GetString(statsd.ParamWebAddr),
+		TapCapacity:             v.GetInt(statsd.ParamTapCapacity),
+		BackendErrorLogInterval: v.GetDuration(statsd.ParamBackendErrorLogInterval),
+		DockerSocket:            v.GetString(statsd.ParamDockerSocket),
+		DockerLabels:            toSlice(v.GetString(statsd.ParamDockerLabels)),
+		HeartbeatName:           v.GetString(statsd.ParamHeartbeatName),
+		HeartbeatType:           heartbeatType,
+		HeartbeatValue:          v.GetFloat64(statsd.ParamHeartbeatValue),
+		RuntimeMetrics:          v.GetBool(statsd.ParamRuntimeMetrics),
+		RuntimeMetricsPrefix:    v.GetString(statsd.ParamRuntimeMetricsPrefix),
+		RuntimeMetricsInterval:  v.GetDuration(statsd.ParamRuntimeMetricsInterval),
+		HistogramBuckets:        v.GetBool(statsd.ParamHistogramBuckets),
+		UntypedMetricType:       untypedMetricType,
+		DebugMetrics:            v.GetBool(statsd.ParamDebugMetrics),
+		InternSize:              v.GetInt(statsd.ParamInternSize),
+		MetricArenaSize:         v.GetInt(statsd.ParamMetricArenaSize),
+		MaxKeysPerSource:        v.GetInt(statsd.ParamMaxKeysPerSource),
+		CardinalityLimit:        v.GetInt(statsd.ParamCardinalityLimit),
+		PinToCPU:                v.GetBool(statsd.ParamPinToCPU),
+		PinCPUs:                 pinCPUs,
+		HostTag:                 v.GetBool(statsd.ParamHostTag),
+		HostTagKey:              v.GetString(statsd.ParamHostTagKey),
+		HostTagValue:            v.GetString(statsd.ParamHostTagValue),
+		WarmRestartSocket:       v.GetString(statsd.ParamWarmRestartSocket),
+		Signals:                 v.GetBool(statsd.ParamSignals),
+		SnapshotPath:            v.GetString(statsd.ParamSnapshotPath),
+		SnapshotInterval:        v.GetDuration(statsd.ParamSnapshotInterval),
+		Credentials:             credentials,
+		AuditLogWriter:          auditLog,
+		MetricUpdates:           updates,
+		Services:                services,
+		Tracer:                  tracer,
+		Leader:                  leader,
+		Cluster:                 clusterShards,
+		InternalMetricsClient:   internalClient,
+		DropPrefixes:            toSlice(v.GetString(statsd.ParamDropPrefixes)),
+		MaxMetricsPerSecond:     v.GetInt(statsd.ParamMaxMetricsPerSecond),
+		Viper:                   v,
 	}, nil
 }
 
@@ -146,6 +453,46 @@ func getPercentiles(s []string) ([]float64, error) {
 	return percentThresholds, nil
 }
 
+func getPayloadBuckets(s []string) ([]int, error) {
+	bounds := make([]int, len(s))
+	for i, sBound := range s {
+		bound, err := strconv.Atoi(sBound)
+		if err != nil {
+			return nil, fmt.Errorf("invalid payload bucket %q: %v", sBound, err)
+		}
+		bounds[i] = bound
+	}
+	return bounds, nil
+}
+
+func getCPUs(s []string) ([]int, error) {
+	cpus := make([]int, len(s))
+	for i, sCPU := range s {
+		cpu, err := strconv.Atoi(sCPU)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPU %q: %v", sCPU, err)
+		}
+		cpus[i] = cpu
+	}
+	return cpus, nil
+}
+
+func getBackendDurations(s []string, what string) (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration, len(s))
+	for _, pair := range s {
+		i := strings.IndexByte(pair, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid backend %s %q, must be backend=duration", what, pair)
+		}
+		d, err := time.ParseDuration(pair[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s of backend %s: %v", what, pair[:i], err)
+		}
+		durations[pair[:i]] = d
+	}
+	return durations, nil
+}
+
 // cancelOnInterrupt calls f when os.Interrupt or SIGTERM is received.
 func cancelOnInterrupt(ctx context.Context, f context.CancelFunc) {
 	c := make(chan os.Signal, 1)
@@ -172,12 +519,20 @@ func setupConfiguration() (*viper.Viper, bool, error) {
 	cmd := pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
 
 	cmd.BoolVar(&version, ParamVersion, false, "Print the version and exit")
+	cmd.Bool(ParamCheckConfig, false, "Validate the configuration and exit with a non-zero status if it is invalid, without serving")
 	cmd.Bool(ParamVerbose, false, "Verbose")
 	cmd.Bool(ParamJSON, false, "Log in JSON format")
 	cmd.String(ParamProfile, "", "Enable profiler endpoint on the specified address and port")
-	cmd.String(ParamConfigPath, "", "Path to the configuration file")
+	cmd.String(ParamConfigPath, "", "Comma-separated list of paths of configuration files, later files override values of earlier ones")
 
 	statsd.AddFlags(cmd)
+	api.AddFlags(cmd)
+	otlp.AddFlags(cmd)
+	ebpf.AddFlags(cmd)
+	xray.AddFlags(cmd)
+	ha.AddFlags(cmd)
+	cluster.AddFlags(cmd)
+	statsdclient.AddFlags(cmd)
 
 	cmd.VisitAll(func(flag *pflag.Flag) {
 		if err := v.BindPFlag(flag.Name, flag); err != nil {
@@ -189,10 +544,9 @@ func setupConfiguration() (*viper.Viper, bool, error) {
 		return nil, false, err
 	}
 
-	configPath := v.GetString(ParamConfigPath)
-	if configPath != "" {
-		v.SetConfigFile(configPath)
-		if err := v.ReadInConfig(); err != nil {
+	configPaths := toSlice(v.GetString(ParamConfigPath))
+	if len(configPaths) > 0 {
+		if err := statsd.ReadConfigFiles(v, configPaths); err != nil {
 			return nil, false, err
 		}
 	}
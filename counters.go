@@ -7,6 +7,7 @@ type Counter struct {
 	Timestamp Nanotime // Last time value was updated
 	Hostname  string   // Hostname of the source of the metric
 	Tags      Tags     // The tags for the counter
+	Unit      string   // The unit of the value, empty if unknown
 }
 
 // NewCounter initialises a new counter.
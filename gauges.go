@@ -6,6 +6,7 @@ type Gauge struct {
 	Timestamp Nanotime // Last time value was updated
 	Hostname  string   // Hostname of the source of the metric
 	Tags      Tags     // The tags for the gauge
+	Unit      string   // The unit of the value, empty if unknown
 }
 
 // NewGauge initialises a new gauge.
@@ -0,0 +1,58 @@
+package gostatsd
+
+import (
+	"math"
+	"sort"
+)
+
+// HistogramBucket is a bucket of a histogram computed by a client, with the number of samples between the bounds.
+type HistogramBucket struct {
+	Lower float64 // Inclusive lower bound
+	Upper float64 // Exclusive upper bound, +Inf for the last bucket
+	Count uint64
+}
+
+// HistogramBuckets are buckets of a histogram sorted by bounds.
+type HistogramBuckets []HistogramBucket
+
+// Merge returns the buckets of both histograms sorted by bounds, counts of buckets with the same bounds are added.
+// Neither histogram is modified.
+func (hb HistogramBuckets) Merge(other HistogramBuckets) HistogramBuckets {
+	if len(hb) == 0 && len(other) == 0 {
+		return nil
+	}
+	all := make(HistogramBuckets, 0, len(hb)+len(other))
+	all = append(all, hb...)
+	all = append(all, other...)
+	sort.Sort(all)
+	result := all[:1]
+	for _, b := range all[1:] {
+		last := &result[len(result)-1]
+		if b.Lower == last.Lower && b.Upper == last.Upper {
+			last.Count += b.Count
+		} else {
+			result = append(result, b)
+		}
+	}
+	return result
+}
+
+// IsOpen returns whether the bucket has no upper bound.
+func (b HistogramBucket) IsOpen() bool {
+	return math.IsInf(b.Upper, 1)
+}
+
+func (hb HistogramBuckets) Len() int {
+	return len(hb)
+}
+
+func (hb HistogramBuckets) Less(i, j int) bool {
+	if hb[i].Lower != hb[j].Lower {
+		return hb[i].Lower < hb[j].Lower
+	}
+	return hb[i].Upper < hb[j].Upper
+}
+
+func (hb HistogramBuckets) Swap(i, j int) {
+	hb[i], hb[j] = hb[j], hb[i]
+}
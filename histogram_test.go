@@ -0,0 +1,27 @@
+package gostatsd
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogramBucketsMerge(t *testing.T) {
+	t.Parallel()
+	inf := math.Inf(1)
+	a := HistogramBuckets{{Lower: 10, Upper: 100, Count: 20}, {Lower: 0, Upper: 10, Count: 5}}
+	b := HistogramBuckets{{Lower: 100, Upper: inf, Count: 3}, {Lower: 0, Upper: 10, Count: 1}, {Lower: 0, Upper: 5, Count: 2}}
+	assert.Equal(t, HistogramBuckets{
+		{Lower: 0, Upper: 5, Count: 2},
+		{Lower: 0, Upper: 10, Count: 6},
+		{Lower: 10, Upper: 100, Count: 20},
+		{Lower: 100, Upper: inf, Count: 3},
+	}, a.Merge(b))
+	// Neither histogram is modified
+	assert.Equal(t, HistogramBuckets{{Lower: 10, Upper: 100, Count: 20}, {Lower: 0, Upper: 10, Count: 5}}, a)
+	assert.EqualValues(t, 1, b[1].Count)
+
+	assert.Nil(t, HistogramBuckets(nil).Merge(nil))
+	assert.Equal(t, a.Merge(nil), HistogramBuckets(nil).Merge(a))
+}
@@ -0,0 +1,94 @@
+package gostatsd
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+)
+
+// HyperLogLogPrecision is the number of bits of the hash of a value selecting its register, a sketch has
+// 2^HyperLogLogPrecision registers. The standard error of estimates is 1.04/sqrt(2^HyperLogLogPrecision), about 0.81%.
+const HyperLogLogPrecision = 14
+
+const hyperLogLogRegisters = 1 << HyperLogLogPrecision
+
+// HyperLogLog is a sketch estimating the number of distinct values added to it with a fixed amount of memory,
+// one byte per register, regardless of the number of values.
+type HyperLogLog struct {
+	registers []uint8
+}
+
+// NewHyperLogLog initialises a new empty sketch.
+func NewHyperLogLog() *HyperLogLog {
+	return &HyperLogLog{registers: make([]uint8, hyperLogLogRegisters)}
+}
+
+// Add adds the value to the sketch.
+func (h *HyperLogLog) Add(value string) {
+	hash := hyperLogLogHash(value)
+	index := hash >> (64 - HyperLogLogPrecision)
+	// Rank is the position of the first set bit of the remaining bits, the guard bit bounds it
+	w := hash<<HyperLogLogPrecision | 1<<(HyperLogLogPrecision-1)
+	rank := uint8(1)
+	for w&(1<<63) == 0 {
+		rank++
+		w <<= 1
+	}
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+}
+
+// Merge adds the values of the other sketch to the sketch.
+func (h *HyperLogLog) Merge(other *HyperLogLog) {
+	for i, rank := range other.registers {
+		if rank > h.registers[i] {
+			h.registers[i] = rank
+		}
+	}
+}
+
+// Clone returns a copy of the sketch.
+func (h *HyperLogLog) Clone() *HyperLogLog {
+	registers := make([]uint8, len(h.registers))
+	copy(registers, h.registers)
+	return &HyperLogLog{registers: registers}
+}
+
+// Estimate returns the estimated number of distinct values added to the sketch.
+func (h *HyperLogLog) Estimate() uint64 {
+	m := float64(hyperLogLogRegisters)
+	sum := 0.0
+	zeros := 0
+	for _, rank := range h.registers {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small cardinalities
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// String returns the estimate, e.g. for printing sets in the console.
+func (h *HyperLogLog) String() string {
+	return fmt.Sprintf("~%d", h.Estimate())
+}
+
+// hyperLogLogHash returns the FNV-1a hash of the value with the finalizer of MurmurHash3 so that all bits
+// are well distributed.
+func hyperLogLogHash(value string) uint64 {
+	f := fnv.New64a()
+	_, _ = f.Write([]byte(value))
+	hash := f.Sum64()
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	return hash
+}
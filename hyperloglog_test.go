@@ -0,0 +1,47 @@
+package gostatsd
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHyperLogLogEstimate(t *testing.T) {
+	t.Parallel()
+	// Three standard errors, estimates are within it with a probability of over 99%
+	maxError := 3 * 1.04 / math.Sqrt(hyperLogLogRegisters)
+	for _, cardinality := range []int{100, 10000, 1000000} {
+		h := NewHyperLogLog()
+		for i := 0; i < cardinality; i++ {
+			h.Add("value" + strconv.Itoa(i))
+			h.Add("value" + strconv.Itoa(i)) // Duplicates are not counted
+		}
+		assert.InEpsilon(t, cardinality, h.Estimate(), maxError, "cardinality %d", cardinality)
+	}
+	assert.EqualValues(t, 0, NewHyperLogLog().Estimate())
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	t.Parallel()
+	a := NewHyperLogLog()
+	b := NewHyperLogLog()
+	for i := 0; i < 1000; i++ {
+		a.Add("value" + strconv.Itoa(i))
+		b.Add("value" + strconv.Itoa(i+500))
+	}
+	c := a.Clone()
+	c.Merge(b)
+	assert.InEpsilon(t, 1500, c.Estimate(), 0.05)
+	assert.InEpsilon(t, 1000, a.Estimate(), 0.05) // The clone is merged, not the sketch
+}
+
+func TestSetCardinality(t *testing.T) {
+	t.Parallel()
+	s := NewSet(0, map[string]struct{}{"a": {}, "b": {}}, "", nil)
+	assert.Equal(t, 2, s.Cardinality())
+	s.Sketch = NewHyperLogLog()
+	s.Sketch.Add("a")
+	assert.Equal(t, 1, s.Cardinality())
+}
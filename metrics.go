@@ -3,6 +3,7 @@ package gostatsd
 import (
 	"bytes"
 	"fmt"
+	"sort"
 	"time"
 )
 
@@ -41,9 +42,18 @@ type Metric struct {
 	Value       float64    // The numeric value of the metric
 	Tags        Tags       // The tags for the metric
 	StringValue string     // The string value for some metrics e.g. Set
+	Unit        string     // The unit of the value e.g. bytes, empty if unknown
 	Hostname    string     // Hostname of the source of the metric
 	SourceIP    IP         // IP of the source of the metric
 	Type        MetricType // The type of metric
+	GaugeDelta  bool       // Whether the Value of a gauge is added to the current value rather than replacing it
+	// Buckets of a histogram computed by the client of a timer, nil if none. The Value is a sample of the timer.
+	Buckets HistogramBuckets
+	// Digest of values of a timer merged instead of the Value, nil if none, e.g. to restore a digested timer.
+	Digest *TDigest
+
+	arena      *MetricArena // Arena the metric was allocated from, nil if none
+	arenaIndex int          // Index of the metric in the arena
 }
 
 func (m *Metric) String() string {
@@ -60,8 +70,62 @@ type AggregatedMetrics interface {
 
 // MetricStats holds stats of an Aggregator.
 type MetricStats struct {
-	ProcessingTime time.Duration
-	NumStats       uint32
+	ProcessingTime  time.Duration
+	NumStats        uint32
+	DroppedCounters uint32 // Number of negative counters dropped by the flush
+
+	Keys        KeyCounts // Number of distinct keys when flushed
+	NewKeys     KeyCounts // Number of keys created since the previous flush
+	ExpiredKeys KeyCounts // Number of keys expired after the previous flush
+}
+
+// KeyCounts holds numbers of distinct keys, i.e. combinations of name and tags, per metric type.
+type KeyCounts struct {
+	Counters uint32
+	Timers   uint32
+	Gauges   uint32
+	Sets     uint32
+}
+
+// Add adds the numbers of keys of other.
+func (k *KeyCounts) Add(other KeyCounts) {
+	k.Counters += other.Counters
+	k.Timers += other.Timers
+	k.Gauges += other.Gauges
+	k.Sets += other.Sets
+}
+
+// Inc adds a key of the metric type, unknown types are ignored.
+func (k *KeyCounts) Inc(metricType MetricType) {
+	if n := k.of(metricType); n != nil {
+		*n++
+	}
+}
+
+// Dec removes a key of the metric type, unknown types are ignored.
+func (k *KeyCounts) Dec(metricType MetricType) {
+	if n := k.of(metricType); n != nil {
+		*n--
+	}
+}
+
+func (k *KeyCounts) of(metricType MetricType) *uint32 {
+	switch metricType {
+	case COUNTER:
+		return &k.Counters
+	case TIMER:
+		return &k.Timers
+	case GAUGE:
+		return &k.Gauges
+	case SET:
+		return &k.Sets
+	}
+	return nil
+}
+
+// Total returns the number of keys of all types.
+func (k KeyCounts) Total() uint32 {
+	return k.Counters + k.Timers + k.Gauges + k.Sets
 }
 
 // MetricMap is used for storing aggregated Metric values.
@@ -89,7 +153,97 @@ func (m *MetricMap) String() string {
 		fmt.Fprintf(buf, "stats.gauge.%s: %f tags=%s\n", k, gauge.Value, tags)
 	})
 	m.Sets.Each(func(k, tags string, set Set) {
-		fmt.Fprintf(buf, "stats.set.%s: %d tags=%s\n", k, len(set.Values), tags)
+		fmt.Fprintf(buf, "stats.set.%s: %d tags=%s\n", k, set.Cardinality(), tags)
 	})
 	return buf.String()
 }
+
+// ToSlice returns the metrics of the MetricMap as a flat slice sorted by name, tags and type, e.g. for
+// assertions in tests. Timers have a Metric per value in the order received, sets a Metric per value sorted
+// by value.
+func (m *MetricMap) ToSlice() []Metric {
+	var metrics keyedMetrics
+	m.Counters.Each(func(k, tags string, counter Counter) {
+		metrics = append(metrics, keyedMetric{tagsKey: tags, metric: Metric{
+			Name:     k,
+			Value:    float64(counter.Value),
+			Tags:     counter.Tags,
+			Unit:     counter.Unit,
+			Hostname: counter.Hostname,
+			Type:     COUNTER,
+		}})
+	})
+	m.Timers.Each(func(k, tags string, timer Timer) {
+		for _, value := range timer.Values {
+			metrics = append(metrics, keyedMetric{tagsKey: tags, metric: Metric{
+				Name:     k,
+				Value:    value,
+				Tags:     timer.Tags,
+				Unit:     timer.Unit,
+				Hostname: timer.Hostname,
+				Type:     TIMER,
+			}})
+		}
+	})
+	m.Gauges.Each(func(k, tags string, gauge Gauge) {
+		metrics = append(metrics, keyedMetric{tagsKey: tags, metric: Metric{
+			Name:     k,
+			Value:    gauge.Value,
+			Tags:     gauge.Tags,
+			Unit:     gauge.Unit,
+			Hostname: gauge.Hostname,
+			Type:     GAUGE,
+		}})
+	})
+	m.Sets.Each(func(k, tags string, set Set) {
+		values := make([]string, 0, len(set.Values))
+		for value := range set.Values {
+			values = append(values, value)
+		}
+		sort.Strings(values)
+		for _, value := range values {
+			metrics = append(metrics, keyedMetric{tagsKey: tags, metric: Metric{
+				Name:        k,
+				StringValue: value,
+				Tags:        set.Tags,
+				Unit:        set.Unit,
+				Hostname:    set.Hostname,
+				Type:        SET,
+			}})
+		}
+	})
+	sort.Stable(metrics)
+	result := make([]Metric, 0, len(metrics))
+	for _, km := range metrics {
+		result = append(result, km.metric)
+	}
+	return result
+}
+
+// keyedMetric is a Metric with the key of its tags in a MetricMap.
+type keyedMetric struct {
+	tagsKey string
+	metric  Metric
+}
+
+// keyedMetrics sorts metrics by name, tags key and type.
+type keyedMetrics []keyedMetric
+
+func (km keyedMetrics) Len() int {
+	return len(km)
+}
+
+func (km keyedMetrics) Less(i, j int) bool {
+	a, b := &km[i], &km[j]
+	if a.metric.Name != b.metric.Name {
+		return a.metric.Name < b.metric.Name
+	}
+	if a.tagsKey != b.tagsKey {
+		return a.tagsKey < b.tagsKey
+	}
+	return a.metric.Type < b.metric.Type
+}
+
+func (km keyedMetrics) Swap(i, j int) {
+	km[i], km[j] = km[j], km[i]
+}
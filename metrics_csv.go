@@ -0,0 +1,86 @@
+package gostatsd
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvHeader is the first row written by MarshalCSV.
+var csvHeader = []string{"name", "type", "value", "tags", "timestamp"}
+
+// csvTypes are the metric types written by MarshalCSV if no types are given, in the order they are written.
+var csvTypes = []MetricType{COUNTER, TIMER, GAUGE, SET}
+
+// MarshalCSV writes the metrics of the types to the writer as CSV with a header row and the columns name, type,
+// value, tags and timestamp, e.g. for spreadsheets. All types are written if types is empty. Metrics are written
+// in the order of the types and sorted by name and tags key. Timers have a row per value in the order received,
+// sets a row per value sorted by value. Tags are joined by commas and timestamps are formatted as RFC 3339 in UTC.
+func (m *MetricMap) MarshalCSV(w io.Writer, types []MetricType) error {
+	if len(types) == 0 {
+		types = csvTypes
+	}
+	data := m.schema()
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, t := range types {
+		if err := writeCSVType(cw, data, t); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeCSVType writes a row per value of the metrics of the type.
+func writeCSVType(cw *csv.Writer, data *metricMapJSON, t MetricType) error {
+	switch t {
+	case COUNTER:
+		for _, c := range data.Counters {
+			if err := writeCSVRow(cw, &c.metricKeyJSON, t, strconv.FormatInt(c.Value, 10)); err != nil {
+				return err
+			}
+		}
+	case TIMER:
+		for _, tm := range data.Timers {
+			for _, value := range tm.Values {
+				if err := writeCSVRow(cw, &tm.metricKeyJSON, t, formatCSVFloat(value)); err != nil {
+					return err
+				}
+			}
+		}
+	case GAUGE:
+		for _, g := range data.Gauges {
+			if err := writeCSVRow(cw, &g.metricKeyJSON, t, formatCSVFloat(g.Value)); err != nil {
+				return err
+			}
+		}
+	case SET:
+		for _, s := range data.Sets {
+			for _, value := range s.Values {
+				if err := writeCSVRow(cw, &s.metricKeyJSON, t, value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func writeCSVRow(cw *csv.Writer, key *metricKeyJSON, t MetricType, value string) error {
+	return cw.Write([]string{
+		key.Name,
+		t.String(),
+		value,
+		strings.Join(key.Tags, ","),
+		time.Unix(0, int64(key.Timestamp)).UTC().Format(time.RFC3339Nano),
+	})
+}
+
+func formatCSVFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,61 @@
+package gostatsd
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricMapMarshalCSV(t *testing.T) {
+	t.Parallel()
+	m := newJSONTestMetricMap()
+	buf := new(bytes.Buffer)
+	require.NoError(t, m.MarshalCSV(buf, nil))
+	records, err := csv.NewReader(buf).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"name", "type", "value", "tags", "timestamp"},
+		{"c", "counter", "-1", "", "1970-01-01T00:00:00.000000011Z"},
+		{"c", "counter", "3", "z:1,a:2", "1970-01-01T00:00:00.00000001Z"},
+		{"t", "timer", "2", "", "1970-01-01T00:00:00.000000012Z"},
+		{"t", "timer", "1", "", "1970-01-01T00:00:00.000000012Z"},
+		{"g", "gauge", "1.5", "b", "1970-01-01T00:00:00.000000013Z"},
+		{"s", "set", "bob", "", "1970-01-01T00:00:00.000000014Z"},
+		{"s", "set", "joe", "", "1970-01-01T00:00:00.000000014Z"},
+	}, records)
+}
+
+func TestMetricMapMarshalCSVTypes(t *testing.T) {
+	t.Parallel()
+	m := newJSONTestMetricMap()
+	buf := new(bytes.Buffer)
+	require.NoError(t, m.MarshalCSV(buf, []MetricType{GAUGE, COUNTER}))
+	records, err := csv.NewReader(buf).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+	assert.Equal(t, "gauge", records[1][1])
+	assert.Equal(t, "counter", records[2][1])
+	assert.Equal(t, "counter", records[3][1])
+}
+
+func TestMetricMapMarshalCSVQuoting(t *testing.T) {
+	t.Parallel()
+	name := "a,\"b\"\nc"
+	tags := Tags{"path:/x,y", `quote:"z"`}
+	m := &MetricMap{
+		Gauges: Gauges{
+			name: {"k": {Value: 1, Tags: tags}},
+		},
+	}
+	buf := new(bytes.Buffer)
+	require.NoError(t, m.MarshalCSV(buf, nil))
+	assert.Contains(t, buf.String(), `"a,""b""`+"\n"+`c",gauge,1,"path:/x,y,quote:""z""",`)
+	records, err := csv.NewReader(buf).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, name, records[1][0])
+	assert.Equal(t, `path:/x,y,quote:"z"`, records[1][3])
+}
@@ -0,0 +1,325 @@
+package gostatsd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// MetricMapJSONVersion is the version of the schema of MetricMap written by MarshalJSON and MarshalMsgpack.
+// UnmarshalJSON reads all versions up to it, and JSON without a version as the fields of MetricMap.
+const MetricMapJSONVersion = 1
+
+// metricMapJSON is version 1 of the schema of MetricMap, encoded as JSON and MessagePack. Fields must not be renamed
+// or removed, changes require a new version. Metrics are sorted by name and tags key so that the output is stable.
+type metricMapJSON struct {
+	Version         int           `json:"version"`
+	FlushInterval   time.Duration `json:"flush_interval"`
+	ProcessingTime  time.Duration `json:"processing_time"`
+	NumStats        uint32        `json:"num_stats"`
+	DroppedCounters uint32        `json:"dropped_counters"`
+	Keys            keyCountsJSON `json:"keys"`
+	NewKeys         keyCountsJSON `json:"new_keys"`
+	ExpiredKeys     keyCountsJSON `json:"expired_keys"`
+	Counters        []counterJSON `json:"counters"`
+	Timers          []timerJSON   `json:"timers"`
+	Gauges          []gaugeJSON   `json:"gauges"`
+	Sets            []setJSON     `json:"sets"`
+}
+
+type keyCountsJSON struct {
+	Counters uint32 `json:"counters"`
+	Timers   uint32 `json:"timers"`
+	Gauges   uint32 `json:"gauges"`
+	Sets     uint32 `json:"sets"`
+}
+
+// metricKeyJSON holds the fields common to all metric types. The tags key is kept because it cannot be
+// computed from the tags, e.g. it includes the hostname.
+type metricKeyJSON struct {
+	Name      string   `json:"name"`
+	TagsKey   string   `json:"tags_key"`
+	Tags      Tags     `json:"tags"`
+	Hostname  string   `json:"hostname"`
+	Unit      string   `json:"unit"`
+	Timestamp Nanotime `json:"timestamp"`
+}
+
+type counterJSON struct {
+	metricKeyJSON
+	Value     int64   `json:"value"`
+	PerSecond float64 `json:"per_second"`
+}
+
+type timerJSON struct {
+	metricKeyJSON
+	Count       int              `json:"count"`
+	PerSecond   float64          `json:"per_second"`
+	Mean        float64          `json:"mean"`
+	Median      float64          `json:"median"`
+	Min         float64          `json:"min"`
+	Max         float64          `json:"max"`
+	StdDev      float64          `json:"std_dev"`
+	Sum         float64          `json:"sum"`
+	SumSquares  float64          `json:"sum_squares"`
+	Values      []float64        `json:"values"`
+	Percentiles []percentileJSON `json:"percentiles"`
+	// Digest of the values of a digested timer, which has no values. Added to version 1, omitted if nil.
+	Digest *tdigestJSON `json:"digest,omitempty"`
+}
+
+type percentileJSON struct {
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+}
+
+type gaugeJSON struct {
+	metricKeyJSON
+	Value float64 `json:"value"`
+}
+
+type setJSON struct {
+	metricKeyJSON
+	Values []string `json:"values"` // Sorted
+}
+
+// unversionedMetricMap has the fields of MetricMap without its methods, it is the JSON written before
+// the schema was versioned.
+type unversionedMetricMap MetricMap
+
+// MarshalJSON encodes the MetricMap with the schema of MetricMapJSONVersion.
+func (m *MetricMap) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.schema())
+}
+
+// schema returns the MetricMap with the schema of MetricMapJSONVersion.
+func (m *MetricMap) schema() *metricMapJSON {
+	data := &metricMapJSON{
+		Version:         MetricMapJSONVersion,
+		FlushInterval:   m.FlushInterval,
+		ProcessingTime:  m.ProcessingTime,
+		NumStats:        m.NumStats,
+		DroppedCounters: m.DroppedCounters,
+		Keys:            keyCountsJSON(m.Keys),
+		NewKeys:         keyCountsJSON(m.NewKeys),
+		ExpiredKeys:     keyCountsJSON(m.ExpiredKeys),
+		Counters:        []counterJSON{},
+		Timers:          []timerJSON{},
+		Gauges:          []gaugeJSON{},
+		Sets:            []setJSON{},
+	}
+	m.Counters.Each(func(key, tagsKey string, counter Counter) {
+		data.Counters = append(data.Counters, counterJSON{
+			metricKeyJSON: metricKeyJSON{key, tagsKey, counter.Tags, counter.Hostname, counter.Unit, counter.Timestamp},
+			Value:         counter.Value,
+			PerSecond:     counter.PerSecond,
+		})
+	})
+	m.Timers.Each(func(key, tagsKey string, timer Timer) {
+		var percentiles []percentileJSON
+		if timer.Percentiles != nil {
+			percentiles = make([]percentileJSON, 0, len(timer.Percentiles))
+			for _, p := range timer.Percentiles {
+				percentiles = append(percentiles, percentileJSON{Name: p.Str, Value: p.Float})
+			}
+		}
+		var digest *tdigestJSON
+		if timer.Digest != nil {
+			digest = timer.Digest.state()
+		}
+		data.Timers = append(data.Timers, timerJSON{
+			metricKeyJSON: metricKeyJSON{key, tagsKey, timer.Tags, timer.Hostname, timer.Unit, timer.Timestamp},
+			Count:         timer.Count,
+			PerSecond:     timer.PerSecond,
+			Mean:          timer.Mean,
+			Median:        timer.Median,
+			Min:           timer.Min,
+			Max:           timer.Max,
+			StdDev:        timer.StdDev,
+			Sum:           timer.Sum,
+			SumSquares:    timer.SumSquares,
+			Values:        timer.Values,
+			Percentiles:   percentiles,
+			Digest:        digest,
+		})
+	})
+	m.Gauges.Each(func(key, tagsKey string, gauge Gauge) {
+		data.Gauges = append(data.Gauges, gaugeJSON{
+			metricKeyJSON: metricKeyJSON{key, tagsKey, gauge.Tags, gauge.Hostname, gauge.Unit, gauge.Timestamp},
+			Value:         gauge.Value,
+		})
+	})
+	m.Sets.Each(func(key, tagsKey string, set Set) {
+		var values []string
+		if set.Values != nil {
+			values = make([]string, 0, len(set.Values))
+			for value := range set.Values {
+				values = append(values, value)
+			}
+			sort.Strings(values)
+		}
+		data.Sets = append(data.Sets, setJSON{
+			metricKeyJSON: metricKeyJSON{key, tagsKey, set.Tags, set.Hostname, set.Unit, set.Timestamp},
+			Values:        values,
+		})
+	})
+	sort.Sort(metricKeySorter{len(data.Counters), func(i int) *metricKeyJSON { return &data.Counters[i].metricKeyJSON }, func(i, j int) {
+		data.Counters[i], data.Counters[j] = data.Counters[j], data.Counters[i]
+	}})
+	sort.Sort(metricKeySorter{len(data.Timers), func(i int) *metricKeyJSON { return &data.Timers[i].metricKeyJSON }, func(i, j int) {
+		data.Timers[i], data.Timers[j] = data.Timers[j], data.Timers[i]
+	}})
+	sort.Sort(metricKeySorter{len(data.Gauges), func(i int) *metricKeyJSON { return &data.Gauges[i].metricKeyJSON }, func(i, j int) {
+		data.Gauges[i], data.Gauges[j] = data.Gauges[j], data.Gauges[i]
+	}})
+	sort.Sort(metricKeySorter{len(data.Sets), func(i int) *metricKeyJSON { return &data.Sets[i].metricKeyJSON }, func(i, j int) {
+		data.Sets[i], data.Sets[j] = data.Sets[j], data.Sets[i]
+	}})
+	return data
+}
+
+// UnmarshalJSON decodes a MetricMap encoded by MarshalJSON with any version up to MetricMapJSONVersion,
+// or unversioned JSON with the fields of MetricMap.
+func (m *MetricMap) UnmarshalJSON(b []byte) error {
+	var version struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(b, &version); err != nil {
+		return err
+	}
+	switch version.Version {
+	case 0:
+		return json.Unmarshal(b, (*unversionedMetricMap)(m))
+	case 1:
+		var data metricMapJSON
+		if err := json.Unmarshal(b, &data); err != nil {
+			return err
+		}
+		*m = data.metricMap()
+		return nil
+	}
+	return unsupportedVersionError("JSON", version.Version)
+}
+
+func unsupportedVersionError(format string, version int) error {
+	return fmt.Errorf("unsupported MetricMap %s version %d, expected at most %d", format, version, MetricMapJSONVersion)
+}
+
+// metricMap returns the MetricMap of version 1 of the schema.
+func (data *metricMapJSON) metricMap() MetricMap {
+	m := MetricMap{
+		MetricStats: MetricStats{
+			ProcessingTime:  data.ProcessingTime,
+			NumStats:        data.NumStats,
+			DroppedCounters: data.DroppedCounters,
+			Keys:            KeyCounts(data.Keys),
+			NewKeys:         KeyCounts(data.NewKeys),
+			ExpiredKeys:     KeyCounts(data.ExpiredKeys),
+		},
+		FlushInterval: data.FlushInterval,
+		Counters:      Counters{},
+		Timers:        Timers{},
+		Gauges:        Gauges{},
+		Sets:          Sets{},
+	}
+	for _, c := range data.Counters {
+		if m.Counters[c.Name] == nil {
+			m.Counters[c.Name] = map[string]Counter{}
+		}
+		m.Counters[c.Name][c.TagsKey] = Counter{
+			PerSecond: c.PerSecond,
+			Value:     c.Value,
+			Timestamp: c.Timestamp,
+			Hostname:  c.Hostname,
+			Tags:      c.Tags,
+			Unit:      c.Unit,
+		}
+	}
+	for _, t := range data.Timers {
+		var percentiles Percentiles
+		if t.Percentiles != nil {
+			percentiles = make(Percentiles, 0, len(t.Percentiles))
+			for _, p := range t.Percentiles {
+				percentiles = append(percentiles, Percentile{Float: p.Value, Str: p.Name})
+			}
+		}
+		var digest *TDigest
+		if t.Digest != nil {
+			digest = t.Digest.digest()
+		}
+		if m.Timers[t.Name] == nil {
+			m.Timers[t.Name] = map[string]Timer{}
+		}
+		m.Timers[t.Name][t.TagsKey] = Timer{
+			Count:       t.Count,
+			PerSecond:   t.PerSecond,
+			Mean:        t.Mean,
+			Median:      t.Median,
+			Min:         t.Min,
+			Max:         t.Max,
+			StdDev:      t.StdDev,
+			Sum:         t.Sum,
+			SumSquares:  t.SumSquares,
+			Values:      t.Values,
+			Percentiles: percentiles,
+			Digest:      digest,
+			Timestamp:   t.Timestamp,
+			Hostname:    t.Hostname,
+			Tags:        t.Tags,
+			Unit:        t.Unit,
+		}
+	}
+	for _, g := range data.Gauges {
+		if m.Gauges[g.Name] == nil {
+			m.Gauges[g.Name] = map[string]Gauge{}
+		}
+		m.Gauges[g.Name][g.TagsKey] = Gauge{
+			Value:     g.Value,
+			Timestamp: g.Timestamp,
+			Hostname:  g.Hostname,
+			Tags:      g.Tags,
+			Unit:      g.Unit,
+		}
+	}
+	for _, s := range data.Sets {
+		values := make(map[string]struct{}, len(s.Values)) // Aggregators add values to the map
+		for _, value := range s.Values {
+			values[value] = struct{}{}
+		}
+		if m.Sets[s.Name] == nil {
+			m.Sets[s.Name] = map[string]Set{}
+		}
+		m.Sets[s.Name][s.TagsKey] = Set{
+			Values:    values,
+			Timestamp: s.Timestamp,
+			Hostname:  s.Hostname,
+			Tags:      s.Tags,
+			Unit:      s.Unit,
+		}
+	}
+	return m
+}
+
+// metricKeySorter sorts metrics of the JSON schema by name and tags key.
+type metricKeySorter struct {
+	n    int
+	key  func(i int) *metricKeyJSON
+	swap func(i, j int)
+}
+
+func (s metricKeySorter) Len() int {
+	return s.n
+}
+
+func (s metricKeySorter) Less(i, j int) bool {
+	a, b := s.key(i), s.key(j)
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	return a.TagsKey < b.TagsKey
+}
+
+func (s metricKeySorter) Swap(i, j int) {
+	s.swap(i, j)
+}
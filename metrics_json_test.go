@@ -0,0 +1,202 @@
+package gostatsd
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newJSONTestMetricMap() *MetricMap {
+	return &MetricMap{
+		MetricStats: MetricStats{
+			ProcessingTime:  2 * time.Millisecond,
+			NumStats:        5,
+			DroppedCounters: 1,
+			Keys:            KeyCounts{Counters: 2, Timers: 1, Gauges: 1, Sets: 1},
+			NewKeys:         KeyCounts{Counters: 1},
+			ExpiredKeys:     KeyCounts{Sets: 1},
+		},
+		FlushInterval: 10 * time.Second,
+		Counters: Counters{
+			"c": {
+				"z:1,a:2,s:h": {Value: 3, PerSecond: 0.3, Timestamp: 10, Hostname: "h", Tags: Tags{"z:1", "a:2"}, Unit: "bytes"},
+				"":            {Value: -1, Timestamp: 11, Tags: Tags{}},
+			},
+		},
+		Timers: Timers{
+			"t": {
+				"": {
+					Count:       2,
+					PerSecond:   0.2,
+					Mean:        1.5,
+					Median:      1.5,
+					Min:         1,
+					Max:         2,
+					StdDev:      0.5,
+					Sum:         3,
+					SumSquares:  5,
+					Values:      []float64{2, 1},
+					Percentiles: Percentiles{{Float: 2, Str: "upper_90"}},
+					Timestamp:   12,
+				},
+			},
+		},
+		Gauges: Gauges{
+			"g": {
+				"b": {Value: 1.5, Timestamp: 13, Tags: Tags{"b"}},
+			},
+		},
+		Sets: Sets{
+			"s": {
+				"": {Values: map[string]struct{}{"joe": {}, "bob": {}}, Timestamp: 14},
+			},
+		},
+	}
+}
+
+func TestMetricMapJSONRoundTrip(t *testing.T) {
+	t.Parallel()
+	m := newJSONTestMetricMap()
+	data, err := json.Marshal(m)
+	require.NoError(t, err)
+	var read MetricMap
+	require.NoError(t, json.Unmarshal(data, &read))
+	assert.Equal(t, m, &read)
+	assert.Equal(t, Tags{"z:1", "a:2"}, read.Counters["c"]["z:1,a:2,s:h"].Tags) // Tags are not sorted
+}
+
+func TestMetricMapJSONRoundTripDigest(t *testing.T) {
+	t.Parallel()
+	m := newDigestTestMetricMap()
+	data, err := json.Marshal(m)
+	require.NoError(t, err)
+	var read MetricMap
+	require.NoError(t, json.Unmarshal(data, &read))
+	assertDigestTimer(t, m, &read)
+}
+
+// newDigestTestMetricMap returns a MetricMap with a digested timer, which has no values.
+func newDigestTestMetricMap() *MetricMap {
+	d := NewTDigest(DefaultTDigestCompression)
+	for i := 1; i <= 1000; i++ {
+		d.Add(float64(i))
+	}
+	return &MetricMap{
+		Counters: Counters{},
+		Timers:   Timers{"t": {"": {Count: 1000, Digest: d, Timestamp: 10}}},
+		Gauges:   Gauges{},
+		Sets:     Sets{},
+	}
+}
+
+// assertDigestTimer asserts that the digest of the timer of newDigestTestMetricMap was read.
+func assertDigestTimer(t *testing.T, expected, read *MetricMap) {
+	expectedTimer := expected.Timers["t"][""]
+	timer := read.Timers["t"][""]
+	require.NotNil(t, timer.Digest)
+	assert.Equal(t, 1000, timer.NumValues())
+	assert.Equal(t, expectedTimer.Digest.Centroids(), timer.Digest.Centroids())
+	assert.Equal(t, 1.0, timer.Digest.Min())
+	assert.Equal(t, 1000.0, timer.Digest.Max())
+	assert.Equal(t, expectedTimer.Digest.Sum(), timer.Digest.Sum())
+	assert.Equal(t, expectedTimer.Digest.SumSquares(), timer.Digest.SumSquares())
+	assert.Empty(t, timer.Values)
+}
+
+func TestMetricMapJSONRoundTripEmpty(t *testing.T) {
+	t.Parallel()
+	m := &MetricMap{
+		Counters: Counters{},
+		Timers:   Timers{},
+		Gauges:   Gauges{},
+		Sets:     Sets{},
+	}
+	data, err := json.Marshal(m)
+	require.NoError(t, err)
+	var read MetricMap
+	require.NoError(t, json.Unmarshal(data, &read))
+	assert.Equal(t, m, &read)
+}
+
+func TestMetricMapJSONStable(t *testing.T) {
+	t.Parallel()
+	m := newJSONTestMetricMap()
+	data, err := json.Marshal(m)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ { // Map iteration order is random
+		again, err := json.Marshal(m)
+		require.NoError(t, err)
+		assert.Equal(t, string(data), string(again))
+	}
+	var decoded struct {
+		Version  int `json:"version"`
+		Counters []struct {
+			TagsKey string `json:"tags_key"`
+		} `json:"counters"`
+		Sets []struct {
+			Values []string `json:"values"`
+		} `json:"sets"`
+	}
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, MetricMapJSONVersion, decoded.Version)
+	require.Len(t, decoded.Counters, 2)
+	assert.Equal(t, "", decoded.Counters[0].TagsKey)
+	assert.Equal(t, "z:1,a:2,s:h", decoded.Counters[1].TagsKey)
+	require.Len(t, decoded.Sets, 1)
+	assert.Equal(t, []string{"bob", "joe"}, decoded.Sets[0].Values)
+}
+
+func TestMetricMapJSONVersion1(t *testing.T) {
+	t.Parallel()
+	// Snapshots written with version 1 must stay readable
+	data := `{
+		"version": 1,
+		"flush_interval": 10000000000,
+		"processing_time": 0,
+		"num_stats": 2,
+		"dropped_counters": 0,
+		"keys": {"counters": 1, "timers": 0, "gauges": 1, "sets": 0},
+		"new_keys": {"counters": 0, "timers": 0, "gauges": 0, "sets": 0},
+		"expired_keys": {"counters": 0, "timers": 0, "gauges": 0, "sets": 0},
+		"counters": [{"name": "c", "tags_key": "b,a", "tags": ["b", "a"], "hostname": "", "unit": "", "timestamp": 10, "value": 3, "per_second": 0.3}],
+		"timers": [],
+		"gauges": [{"name": "g", "tags_key": "", "tags": null, "hostname": "h", "unit": "", "timestamp": 11, "value": 1.5}],
+		"sets": []
+	}`
+	var m MetricMap
+	require.NoError(t, json.Unmarshal([]byte(data), &m))
+	assert.Equal(t, MetricMap{
+		MetricStats: MetricStats{
+			NumStats: 2,
+			Keys:     KeyCounts{Counters: 1, Gauges: 1},
+		},
+		FlushInterval: 10 * time.Second,
+		Counters: Counters{
+			"c": {"b,a": {Value: 3, PerSecond: 0.3, Timestamp: 10, Tags: Tags{"b", "a"}}},
+		},
+		Timers: Timers{},
+		Gauges: Gauges{
+			"g": {"": {Value: 1.5, Timestamp: 11, Hostname: "h"}},
+		},
+		Sets: Sets{},
+	}, m)
+}
+
+func TestMetricMapJSONUnversioned(t *testing.T) {
+	t.Parallel()
+	data := `{"NumStats": 1, "Counters": {"c": {"": {"Value": 3, "Tags": ["a"]}}}}`
+	var m MetricMap
+	require.NoError(t, json.Unmarshal([]byte(data), &m))
+	assert.EqualValues(t, 1, m.NumStats)
+	assert.Equal(t, Counters{"c": {"": {Value: 3, Tags: Tags{"a"}}}}, m.Counters)
+}
+
+func TestMetricMapJSONUnsupportedVersion(t *testing.T) {
+	t.Parallel()
+	var m MetricMap
+	err := json.Unmarshal([]byte(`{"version": 2}`), &m)
+	assert.EqualError(t, err, "unsupported MetricMap JSON version 2, expected at most 1")
+}
@@ -0,0 +1,69 @@
+package gostatsd
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// linesTypes are the metric types written by MarshalLines if no types are given, in the order they are written.
+var linesTypes = []MetricType{COUNTER, TIMER, GAUGE, SET}
+
+// MarshalLines writes the metrics of the types to the writer as statsd lines, e.g. foo.bar:42|c|#a:b, so that
+// they can be sent to another statsd server to migrate the state. All types are written if types is empty.
+// Metrics are written in the order of the types and sorted by name and tags key. Timers have a line per value
+// in the order received, timers aggregated as digests have no values and are skipped. Sets have a line per value
+// sorted by value. Negative gauges are preceded by a line setting the gauge to 0, because a signed gauge value
+// is a delta. Hostnames are not written, they are not part of the line format.
+func (m *MetricMap) MarshalLines(w io.Writer, types []MetricType) error {
+	if len(types) == 0 {
+		types = linesTypes
+	}
+	data := m.schema()
+	bw := bufio.NewWriter(w)
+	for _, t := range types {
+		switch t {
+		case COUNTER:
+			for _, c := range data.Counters {
+				writeLine(bw, &c.metricKeyJSON, strconv.FormatInt(c.Value, 10), "c")
+			}
+		case TIMER:
+			for _, tm := range data.Timers {
+				for _, value := range tm.Values {
+					writeLine(bw, &tm.metricKeyJSON, formatCSVFloat(value), "ms")
+				}
+			}
+		case GAUGE:
+			for _, g := range data.Gauges {
+				if g.Value < 0 {
+					writeLine(bw, &g.metricKeyJSON, "0", "g")
+				}
+				writeLine(bw, &g.metricKeyJSON, formatCSVFloat(g.Value), "g")
+			}
+		case SET:
+			for _, s := range data.Sets {
+				for _, value := range s.Values {
+					writeLine(bw, &s.metricKeyJSON, value, "s")
+				}
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// writeLine writes a statsd line with the value of the metric, errors are returned by Flush.
+func writeLine(bw *bufio.Writer, key *metricKeyJSON, value, statsdType string) {
+	bw.WriteString(key.Name)   // #nosec
+	bw.WriteByte(':')          // #nosec
+	bw.WriteString(value)      // #nosec
+	bw.WriteByte('|')          // #nosec
+	bw.WriteString(statsdType) // #nosec
+	if key.Unit != "" {
+		bw.WriteString("|u:" + key.Unit) // #nosec
+	}
+	if len(key.Tags) > 0 {
+		bw.WriteString("|#" + strings.Join(key.Tags, ",")) // #nosec
+	}
+	bw.WriteByte('\n') // #nosec
+}
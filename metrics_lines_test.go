@@ -0,0 +1,35 @@
+package gostatsd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricMapMarshalLines(t *testing.T) {
+	t.Parallel()
+	m := newJSONTestMetricMap()
+	m.Gauges["g"]["n"] = Gauge{Value: -2, Tags: Tags{"n"}}
+	buf := new(bytes.Buffer)
+	require.NoError(t, m.MarshalLines(buf, nil))
+	assert.Equal(t, "c:-1|c\n"+
+		"c:3|c|u:bytes|#z:1,a:2\n"+
+		"t:2|ms\n"+
+		"t:1|ms\n"+
+		"g:1.5|g|#b\n"+
+		"g:0|g|#n\n"+
+		"g:-2|g|#n\n"+
+		"s:bob|s\n"+
+		"s:joe|s\n", buf.String())
+}
+
+func TestMetricMapMarshalLinesTypes(t *testing.T) {
+	t.Parallel()
+	m := newJSONTestMetricMap()
+	m.Timers["d"] = map[string]Timer{"": {Count: 1, Digest: NewTDigest(0)}}
+	buf := new(bytes.Buffer)
+	require.NoError(t, m.MarshalLines(buf, []MetricType{SET, TIMER}))
+	assert.Equal(t, "s:bob|s\ns:joe|s\nt:2|ms\nt:1|ms\n", buf.String())
+}
@@ -0,0 +1,37 @@
+package gostatsd
+
+import (
+	"bytes"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MarshalMsgpack encodes the MetricMap as MessagePack with the schema of MetricMapJSONVersion. It is more compact
+// than JSON: empty fields are omitted and whole floats are encoded as integers, so empty lists are decoded as nil.
+func (m *MetricMap) MarshalMsgpack() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json") // Same field names as JSON
+	enc.SetOmitEmpty(true)
+	enc.UseCompactInts(true)
+	enc.UseCompactFloats(true)
+	if err := enc.Encode(m.schema()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalMsgpack decodes a MetricMap encoded by MarshalMsgpack with any version up to MetricMapJSONVersion.
+func (m *MetricMap) UnmarshalMsgpack(b []byte) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(b))
+	dec.SetCustomStructTag("json")
+	var data metricMapJSON
+	if err := dec.Decode(&data); err != nil {
+		return err
+	}
+	if data.Version != 1 {
+		return unsupportedVersionError("MessagePack", data.Version)
+	}
+	*m = data.metricMap()
+	return nil
+}
@@ -0,0 +1,131 @@
+package gostatsd
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestMetricMapMsgpackRoundTrip(t *testing.T) {
+	t.Parallel()
+	m := newJSONTestMetricMap()
+	data, err := msgpack.Marshal(m) // Uses MarshalMsgpack
+	require.NoError(t, err)
+	var read MetricMap
+	require.NoError(t, msgpack.Unmarshal(data, &read))
+	counter := m.Counters["c"][""]
+	counter.Tags = nil // Empty lists are omitted
+	m.Counters["c"][""] = counter
+	assert.Equal(t, m, &read)
+}
+
+func TestMetricMapMsgpackRoundTripDigest(t *testing.T) {
+	t.Parallel()
+	m := newDigestTestMetricMap()
+	data, err := m.MarshalMsgpack()
+	require.NoError(t, err)
+	var read MetricMap
+	require.NoError(t, read.UnmarshalMsgpack(data))
+	assertDigestTimer(t, m, &read)
+}
+
+func TestMetricMapMsgpackSmallerThanJSON(t *testing.T) {
+	t.Parallel()
+	m := newBenchmarkMetricMap()
+	jsonData, err := m.MarshalJSON()
+	require.NoError(t, err)
+	msgpackData, err := m.MarshalMsgpack()
+	require.NoError(t, err)
+	assert.True(t, len(msgpackData) < len(jsonData)*7/10, "MessagePack %d bytes, JSON %d bytes", len(msgpackData), len(jsonData))
+}
+
+func TestMetricMapMsgpackUnsupportedVersion(t *testing.T) {
+	t.Parallel()
+	data, err := msgpack.Marshal(map[string]int{"version": 2})
+	require.NoError(t, err)
+	var m MetricMap
+	assert.EqualError(t, m.UnmarshalMsgpack(data), "unsupported MetricMap MessagePack version 2, expected at most 1")
+}
+
+func newBenchmarkMetricMap() *MetricMap {
+	m := &MetricMap{
+		Counters: Counters{},
+		Timers:   Timers{},
+		Gauges:   Gauges{},
+		Sets:     Sets{},
+	}
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("service.requests.%d", i)
+		tags := Tags{"env:prod", fmt.Sprintf("instance:%d", i)}
+		tagsKey := tags.SortedString()
+		m.Counters[name] = map[string]Counter{tagsKey: {Value: int64(i), PerSecond: float64(i) / 10, Timestamp: 1500000000000000000, Tags: tags}}
+		m.Timers[name] = map[string]Timer{tagsKey: {Count: 3, Values: []float64{1.5, 2.5, float64(i)}, Percentiles: Percentiles{{Float: float64(i), Str: "upper_90"}}, Timestamp: 1500000000000000000, Tags: tags}}
+		m.Gauges[name] = map[string]Gauge{tagsKey: {Value: float64(i), Timestamp: 1500000000000000000, Tags: tags}}
+		m.Sets[name] = map[string]Set{tagsKey: {Values: map[string]struct{}{"a": {}, "b": {}}, Timestamp: 1500000000000000000, Tags: tags}}
+	}
+	return m
+}
+
+func BenchmarkMetricMapMarshalJSON(b *testing.B) {
+	m := newBenchmarkMetricMap()
+	b.ReportAllocs()
+	b.ResetTimer()
+	var size int
+	for i := 0; i < b.N; i++ {
+		data, err := json.Marshal(m)
+		if err != nil {
+			b.Fatal(err)
+		}
+		size = len(data)
+	}
+	b.ReportMetric(float64(size), "bytes/op")
+}
+
+func BenchmarkMetricMapMarshalMsgpack(b *testing.B) {
+	m := newBenchmarkMetricMap()
+	b.ReportAllocs()
+	b.ResetTimer()
+	var size int
+	for i := 0; i < b.N; i++ {
+		data, err := msgpack.Marshal(m)
+		if err != nil {
+			b.Fatal(err)
+		}
+		size = len(data)
+	}
+	b.ReportMetric(float64(size), "bytes/op")
+}
+
+func BenchmarkMetricMapUnmarshalJSON(b *testing.B) {
+	data, err := json.Marshal(newBenchmarkMetricMap())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var m MetricMap
+		if err := json.Unmarshal(data, &m); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMetricMapUnmarshalMsgpack(b *testing.B) {
+	data, err := msgpack.Marshal(newBenchmarkMetricMap())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var m MetricMap
+		if err := msgpack.Unmarshal(data, &m); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
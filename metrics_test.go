@@ -0,0 +1,57 @@
+package gostatsd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricMapToSlice(t *testing.T) {
+	t.Parallel()
+	m := &MetricMap{
+		Counters: Counters{
+			"c": {
+				"b:2": {Value: 3, Tags: Tags{"b:2"}},
+				"a:1": {Value: 5, Tags: Tags{"a:1"}, Unit: "bytes"},
+			},
+		},
+		Timers: Timers{
+			"t": {
+				"": {Values: []float64{3, 1, 2}, Hostname: "h"},
+			},
+		},
+		Gauges: Gauges{
+			"c": {
+				"a:1": {Value: 1.5, Tags: Tags{"a:1"}},
+			},
+			"g": {
+				"": {Value: -2},
+			},
+		},
+		Sets: Sets{
+			"s": {
+				"": {Values: map[string]struct{}{"joe": {}, "bob": {}}},
+			},
+		},
+	}
+	expected := []Metric{
+		{Name: "c", Value: 5, Tags: Tags{"a:1"}, Unit: "bytes", Type: COUNTER},
+		{Name: "c", Value: 1.5, Tags: Tags{"a:1"}, Type: GAUGE},
+		{Name: "c", Value: 3, Tags: Tags{"b:2"}, Type: COUNTER},
+		{Name: "g", Value: -2, Type: GAUGE},
+		{Name: "s", StringValue: "bob", Type: SET},
+		{Name: "s", StringValue: "joe", Type: SET},
+		{Name: "t", Value: 3, Hostname: "h", Type: TIMER},
+		{Name: "t", Value: 1, Hostname: "h", Type: TIMER},
+		{Name: "t", Value: 2, Hostname: "h", Type: TIMER},
+	}
+	for i := 0; i < 10; i++ { // Map iteration order is random
+		assert.Equal(t, expected, m.ToSlice())
+	}
+}
+
+func TestMetricMapToSliceEmpty(t *testing.T) {
+	t.Parallel()
+	m := &MetricMap{}
+	assert.Empty(t, m.ToSlice())
+}
@@ -7,6 +7,9 @@ import (
 	"github.com/atlassian/gostatsd/pkg/backends/datadog"
 	"github.com/atlassian/gostatsd/pkg/backends/graphite"
 	"github.com/atlassian/gostatsd/pkg/backends/null"
+	"github.com/atlassian/gostatsd/pkg/backends/otlp"
+	"github.com/atlassian/gostatsd/pkg/backends/redis"
+	"github.com/atlassian/gostatsd/pkg/backends/sqlite"
 	"github.com/atlassian/gostatsd/pkg/backends/statsdaemon"
 	"github.com/atlassian/gostatsd/pkg/backends/stdout"
 
@@ -19,6 +22,9 @@ var backends = map[string]gostatsd.BackendFactory{
 	datadog.BackendName:     datadog.NewClientFromViper,
 	graphite.BackendName:    graphite.NewClientFromViper,
 	null.BackendName:        null.NewClientFromViper,
+	otlp.BackendName:        otlp.NewClientFromViper,
+	redis.BackendName:       redis.NewClientFromViper,
+	sqlite.BackendName:      sqlite.NewClientFromViper,
 	statsdaemon.BackendName: statsdaemon.NewClientFromViper,
 	stdout.BackendName:      stdout.NewClientFromViper,
 }
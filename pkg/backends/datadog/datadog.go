@@ -44,6 +44,7 @@ type Client struct {
 	client                http.Client
 	metricsPerBatch       uint
 	now                   func() time.Time // Returns current time. Useful for testing.
+	payloadObserver       gostatsd.PayloadObserver
 }
 
 // event represents an event data structure for Datadog.
@@ -105,34 +106,34 @@ func (d *Client) processMetrics(metrics *gostatsd.MetricMap, cb func(*timeSeries
 	}
 
 	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
-		fl.addMetric(key, rate, counter.PerSecond, counter.Hostname, counter.Tags)
-		fl.addMetric(fmt.Sprintf("%s.count", key), gauge, float64(counter.Value), counter.Hostname, counter.Tags)
+		fl.addMetric(key, rate, counter.PerSecond, "", counter.Hostname, counter.Tags)
+		fl.addMetric(fmt.Sprintf("%s.count", key), gauge, float64(counter.Value), counter.Unit, counter.Hostname, counter.Tags)
 		fl.maybeFlush()
 	})
 
 	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
-		fl.addMetric(fmt.Sprintf("%s.lower", key), gauge, timer.Min, timer.Hostname, timer.Tags)
-		fl.addMetric(fmt.Sprintf("%s.upper", key), gauge, timer.Max, timer.Hostname, timer.Tags)
-		fl.addMetric(fmt.Sprintf("%s.count", key), gauge, float64(timer.Count), timer.Hostname, timer.Tags)
-		fl.addMetric(fmt.Sprintf("%s.count_ps", key), rate, timer.PerSecond, timer.Hostname, timer.Tags)
-		fl.addMetric(fmt.Sprintf("%s.mean", key), gauge, timer.Mean, timer.Hostname, timer.Tags)
-		fl.addMetric(fmt.Sprintf("%s.median", key), gauge, timer.Median, timer.Hostname, timer.Tags)
-		fl.addMetric(fmt.Sprintf("%s.std", key), gauge, timer.StdDev, timer.Hostname, timer.Tags)
-		fl.addMetric(fmt.Sprintf("%s.sum", key), gauge, timer.Sum, timer.Hostname, timer.Tags)
-		fl.addMetric(fmt.Sprintf("%s.sum_squares", key), gauge, timer.SumSquares, timer.Hostname, timer.Tags)
+		fl.addMetric(fmt.Sprintf("%s.lower", key), gauge, timer.Min, timer.Unit, timer.Hostname, timer.Tags)
+		fl.addMetric(fmt.Sprintf("%s.upper", key), gauge, timer.Max, timer.Unit, timer.Hostname, timer.Tags)
+		fl.addMetric(fmt.Sprintf("%s.count", key), gauge, float64(timer.Count), "", timer.Hostname, timer.Tags)
+		fl.addMetric(fmt.Sprintf("%s.count_ps", key), rate, timer.PerSecond, "", timer.Hostname, timer.Tags)
+		fl.addMetric(fmt.Sprintf("%s.mean", key), gauge, timer.Mean, timer.Unit, timer.Hostname, timer.Tags)
+		fl.addMetric(fmt.Sprintf("%s.median", key), gauge, timer.Median, timer.Unit, timer.Hostname, timer.Tags)
+		fl.addMetric(fmt.Sprintf("%s.std", key), gauge, timer.StdDev, timer.Unit, timer.Hostname, timer.Tags)
+		fl.addMetric(fmt.Sprintf("%s.sum", key), gauge, timer.Sum, timer.Unit, timer.Hostname, timer.Tags)
+		fl.addMetric(fmt.Sprintf("%s.sum_squares", key), gauge, timer.SumSquares, "", timer.Hostname, timer.Tags)
 		for _, pct := range timer.Percentiles {
-			fl.addMetric(fmt.Sprintf("%s.%s", key, pct.Str), gauge, pct.Float, timer.Hostname, timer.Tags)
+			fl.addMetric(fmt.Sprintf("%s.%s", key, pct.Str), gauge, pct.Float, timer.Unit, timer.Hostname, timer.Tags)
 		}
 		fl.maybeFlush()
 	})
 
 	metrics.Gauges.Each(func(key, tagsKey string, g gostatsd.Gauge) {
-		fl.addMetric(key, gauge, g.Value, g.Hostname, g.Tags)
+		fl.addMetric(key, gauge, g.Value, g.Unit, g.Hostname, g.Tags)
 		fl.maybeFlush()
 	})
 
 	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
-		fl.addMetric(key, gauge, float64(len(set.Values)), set.Hostname, set.Tags)
+		fl.addMetric(key, gauge, float64(set.Cardinality()), "", set.Hostname, set.Tags)
 		fl.maybeFlush()
 	})
 
@@ -140,7 +141,7 @@ func (d *Client) processMetrics(metrics *gostatsd.MetricMap, cb func(*timeSeries
 }
 
 func (d *Client) postMetrics(ctx context.Context, ts *timeSeries) error {
-	return d.post(ctx, "/api/v1/series", "metrics", ts)
+	return d.post(ctx, "/api/v1/series", "metrics", ts, d.payloadObserver)
 }
 
 // SendEvent sends an event to Datadog.
@@ -155,7 +156,12 @@ func (d *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
 		Tags:           e.Tags,
 		Priority:       e.Priority.StringWithEmptyDefault(),
 		AlertType:      e.AlertType.StringWithEmptyDefault(),
-	})
+	}, nil)
+}
+
+// SetPayloadObserver sets the observer notified with the size of each payload of metrics.
+func (d *Client) SetPayloadObserver(observer gostatsd.PayloadObserver) {
+	d.payloadObserver = observer
 }
 
 // Name returns the name of the backend.
@@ -163,11 +169,12 @@ func (c *Client) Name() string {
 	return BackendName
 }
 
-func (d *Client) post(ctx context.Context, path, typeOfPost string, data interface{}) error {
+func (d *Client) post(ctx context.Context, path, typeOfPost string, data interface{}, observer gostatsd.PayloadObserver) error {
 	tsBytes, err := json.Marshal(data)
 	if err != nil {
 		return fmt.Errorf("[%s] unable to marshal %s: %v", BackendName, typeOfPost, err)
 	}
+	observer.Observe(len(tsBytes))
 	log.Debugf("[%s] %s json: %s", BackendName, typeOfPost, tsBytes)
 
 	b := backoff.NewExponentialBackOff()
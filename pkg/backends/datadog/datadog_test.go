@@ -50,7 +50,7 @@ func TestRetries(t *testing.T) {
 
 func TestSendMetricsInMultipleBatches(t *testing.T) {
 	t.Parallel()
-	var requestNum uint32
+	var requestNum, receivedBytes, observedBytes, observedPayloads uint32
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/v1/series", func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
@@ -60,12 +60,17 @@ func TestSendMetricsInMultipleBatches(t *testing.T) {
 			return
 		}
 		assert.NotEmpty(t, data)
+		atomic.AddUint32(&receivedBytes, uint32(len(data)))
 	})
 	ts := httptest.NewServer(mux)
 	defer ts.Close()
 
 	client, err := NewClient(ts.URL, "apiKey123", 1, 1*time.Second, 2*time.Second)
 	require.NoError(t, err)
+	client.SetPayloadObserver(func(size int) {
+		atomic.AddUint32(&observedPayloads, 1)
+		atomic.AddUint32(&observedBytes, uint32(size))
+	})
 	res := make(chan []error, 1)
 	client.SendMetricsAsync(context.Background(), twoCounters(), func(errs []error) {
 		res <- errs
@@ -75,6 +80,8 @@ func TestSendMetricsInMultipleBatches(t *testing.T) {
 		assert.NoError(t, err)
 	}
 	assert.EqualValues(t, 2, requestNum)
+	assert.EqualValues(t, 2, observedPayloads)
+	assert.Equal(t, receivedBytes, observedBytes)
 }
 
 func TestSendMetrics(t *testing.T) {
@@ -121,6 +128,52 @@ func TestSendMetrics(t *testing.T) {
 	}
 }
 
+func TestSendMetricsWithUnits(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/series", func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		data, err := ioutil.ReadAll(r.Body)
+		if !assert.NoError(t, err) {
+			return
+		}
+		expected := `{"series":[` +
+			`{"interval":1,"metric":"c1","points":[[100,2]],"type":"rate"},` +
+			`{"interval":1,"metric":"c1.count","points":[[100,2]],"type":"gauge","unit":"byte"},` +
+			`{"interval":1,"metric":"g1","points":[[100,3]],"type":"gauge","unit":"percent"}]}`
+		assert.Equal(t, []byte(expected), data)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	cli, err := NewClient(ts.URL, "apiKey123", 1000, 1*time.Second, 2*time.Second)
+	require.NoError(t, err)
+	cli.now = func() time.Time {
+		return time.Unix(100, 0)
+	}
+	res := make(chan []error, 1)
+	cli.SendMetricsAsync(context.Background(), &gostatsd.MetricMap{
+		MetricStats:   gostatsd.MetricStats{NumStats: 2},
+		FlushInterval: 1 * time.Second,
+		Counters: gostatsd.Counters{
+			"c1": map[string]gostatsd.Counter{
+				"": {PerSecond: 2, Value: 2, Unit: "byte"},
+			},
+		},
+		Gauges: gostatsd.Gauges{
+			"g1": map[string]gostatsd.Gauge{
+				"": {Value: 3, Unit: "percent"},
+			},
+		},
+	}, func(errs []error) {
+		res <- errs
+	})
+	errs := <-res
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+}
+
 // twoCounters returns two counters.
 func twoCounters() *gostatsd.MetricMap {
 	return &gostatsd.MetricMap{
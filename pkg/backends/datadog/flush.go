@@ -35,13 +35,15 @@ type metric struct {
 	Points   [1]point   `json:"points"`
 	Tags     []string   `json:"tags,omitempty"`
 	Type     metricType `json:"type,omitempty"`
+	Unit     string     `json:"unit,omitempty"`
 }
 
 // point is a Datadog data point.
 type point [2]float64
 
 // AddMetric adds a metric to the series.
-func (f *flush) addMetric(name string, metricType metricType, value float64, hostname string, tags gostatsd.Tags) {
+// The unit is empty if the value is not measured in the unit of the original metric, e.g. a count.
+func (f *flush) addMetric(name string, metricType metricType, value float64, unit, hostname string, tags gostatsd.Tags) {
 	f.ts.Series = append(f.ts.Series, metric{
 		Host:     hostname,
 		Interval: f.flushIntervalSec,
@@ -49,6 +51,7 @@ func (f *flush) addMetric(name string, metricType metricType, value float64, hos
 		Points:   [1]point{{f.timestamp, value}},
 		Tags:     tags,
 		Type:     metricType,
+		Unit:     unit,
 	})
 }
 
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"net"
 	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -39,6 +41,17 @@ const (
 	DefaultGlobalSuffix = ""
 	// DefaultLegacyNamespace controls whether legacy namespace should be used by default.
 	DefaultLegacyNamespace = true
+	// DefaultProtocol is the default protocol metrics are sent with.
+	DefaultProtocol = ProtocolPlaintext
+	// DefaultBatchSize is the default maximum number of data points per pickle message.
+	DefaultBatchSize = 500
+)
+
+const (
+	// ProtocolPlaintext is the plaintext line protocol, usually received on port 2003.
+	ProtocolPlaintext = "plaintext"
+	// ProtocolPickle is the pickle protocol, usually received on port 2004.
+	ProtocolPickle = "pickle"
 )
 
 const (
@@ -65,6 +78,14 @@ type Config struct {
 	PrefixSet       *string
 	GlobalSuffix    *string
 	LegacyNamespace *bool
+	Protocol        *string // ProtocolPlaintext or ProtocolPickle
+	BatchSize       *int    // Maximum number of data points per pickle message
+	// Offsets of timestamps of data points of each metric type from the flush time, in whole seconds.
+	// Useful to avoid collisions of data points of different types in storages with a single resolution.
+	CounterTimestampOffset *time.Duration
+	TimerTimestampOffset   *time.Duration
+	GaugeTimestampOffset   *time.Duration
+	SetTimestampOffset     *time.Duration
 }
 
 // Client is an object that is used to send messages to a Graphite server's TCP interface.
@@ -76,6 +97,14 @@ type Client struct {
 	setsNamespace    string
 	globalSuffix     string
 	legacyNamespace  bool
+	protocol         string
+	batchSize        int
+	counterOffset    time.Duration
+	timerOffset      time.Duration
+	gaugeOffset      time.Duration
+	setOffset        time.Duration
+	payloadObserver  gostatsd.PayloadObserver
+	valuePrecision   int
 }
 
 func (client *Client) Run(ctx context.Context) error {
@@ -89,6 +118,7 @@ func (client *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.Me
 		return
 	}
 	buf := client.preparePayload(metrics, time.Now())
+	client.payloadObserver.Observe(buf.Len())
 	sink := make(chan *bytes.Buffer, 1)
 	sink <- buf
 	close(sink)
@@ -102,41 +132,54 @@ func (client *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.Me
 
 func (client *Client) preparePayload(metrics *gostatsd.MetricMap, ts time.Time) *bytes.Buffer {
 	buf := client.sender.GetBuffer()
-	now := ts.Unix()
+	var w payloadWriter
+	if client.protocol == ProtocolPickle {
+		w = newPickleWriter(buf, client.globalSuffix, client.batchSize)
+	} else {
+		w = &plaintextWriter{buf: buf, suffix: client.globalSuffix, digits: client.valuePrecision}
+	}
+	w.setTimestamp(ts.Add(client.counterOffset).Unix())
 	if client.legacyNamespace {
 		metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
 			k := sk(key)
-			fmt.Fprintf(buf, "stats_counts.%s%s %d %d\n", k, client.globalSuffix, counter.Value, now)                   // #nosec
-			fmt.Fprintf(buf, "%s%s%s %f %d\n", client.counterNamespace, k, client.globalSuffix, counter.PerSecond, now) // #nosec
+			w.writeInt("stats_counts.", k, "", counter.Value)
+			w.writeFloat(client.counterNamespace, k, "", counter.PerSecond)
 		})
 	} else {
 		metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
 			k := sk(key)
-			fmt.Fprintf(buf, "%s%s.count%s %d %d\n", client.counterNamespace, k, client.globalSuffix, counter.Value, now)    // #nosec
-			fmt.Fprintf(buf, "%s%s.rate%s %f %d\n", client.counterNamespace, k, client.globalSuffix, counter.PerSecond, now) // #nosec
+			w.writeInt(client.counterNamespace, k, ".count", counter.Value)
+			w.writeFloat(client.counterNamespace, k, ".rate", counter.PerSecond)
 		})
 	}
+	w.setTimestamp(ts.Add(client.timerOffset).Unix())
 	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
 		k := sk(key)
-		fmt.Fprintf(buf, "%s%s.lower%s %f %d\n", client.timerNamespace, k, client.globalSuffix, timer.Min, now)              // #nosec
-		fmt.Fprintf(buf, "%s%s.upper%s %f %d\n", client.timerNamespace, k, client.globalSuffix, timer.Max, now)              // #nosec
-		fmt.Fprintf(buf, "%s%s.count%s %d %d\n", client.timerNamespace, k, client.globalSuffix, timer.Count, now)            // #nosec
-		fmt.Fprintf(buf, "%s%s.count_ps%s %f %d\n", client.timerNamespace, k, client.globalSuffix, timer.PerSecond, now)     // #nosec
-		fmt.Fprintf(buf, "%s%s.mean%s %f %d\n", client.timerNamespace, k, client.globalSuffix, timer.Mean, now)              // #nosec
-		fmt.Fprintf(buf, "%s%s.median%s %f %d\n", client.timerNamespace, k, client.globalSuffix, timer.Median, now)          // #nosec
-		fmt.Fprintf(buf, "%s%s.std%s %f %d\n", client.timerNamespace, k, client.globalSuffix, timer.StdDev, now)             // #nosec
-		fmt.Fprintf(buf, "%s%s.sum%s %f %d\n", client.timerNamespace, k, client.globalSuffix, timer.Sum, now)                // #nosec
-		fmt.Fprintf(buf, "%s%s.sum_squares%s %f %d\n", client.timerNamespace, k, client.globalSuffix, timer.SumSquares, now) // #nosec
+		w.writeFloat(client.timerNamespace, k, ".lower", timer.Min)
+		w.writeFloat(client.timerNamespace, k, ".upper", timer.Max)
+		w.writeInt(client.timerNamespace, k, ".count", int64(timer.Count))
+		w.writeFloat(client.timerNamespace, k, ".count_ps", timer.PerSecond)
+		w.writeFloat(client.timerNamespace, k, ".mean", timer.Mean)
+		w.writeFloat(client.timerNamespace, k, ".median", timer.Median)
+		w.writeFloat(client.timerNamespace, k, ".std", timer.StdDev)
+		w.writeFloat(client.timerNamespace, k, ".sum", timer.Sum)
+		w.writeFloat(client.timerNamespace, k, ".sum_squares", timer.SumSquares)
 		for _, pct := range timer.Percentiles {
-			fmt.Fprintf(buf, "%s%s.%s%s %f %d\n", client.timerNamespace, k, pct.Str, client.globalSuffix, pct.Float, now) // #nosec
+			w.writeFloat(client.timerNamespace, k, "."+pct.Str, pct.Float)
+		}
+		for _, b := range timer.Buckets {
+			w.writeInt(client.timerNamespace, k, ".bucket."+bucketName(b), int64(b.Count))
 		}
 	})
+	w.setTimestamp(ts.Add(client.gaugeOffset).Unix())
 	metrics.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
-		fmt.Fprintf(buf, "%s%s%s %f %d\n", client.gaugesNamespace, sk(key), client.globalSuffix, gauge.Value, now) // #nosec
+		w.writeFloat(client.gaugesNamespace, sk(key), "", gauge.Value)
 	})
+	w.setTimestamp(ts.Add(client.setOffset).Unix())
 	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
-		fmt.Fprintf(buf, "%s%s%s %d %d\n", client.setsNamespace, sk(key), client.globalSuffix, len(set.Values), now) // #nosec
+		w.writeInt(client.setsNamespace, sk(key), "", int64(set.Cardinality()))
 	})
+	w.close()
 	return buf
 }
 
@@ -145,6 +188,17 @@ func (client *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
 	return nil
 }
 
+// SetPayloadObserver sets the observer notified with the size of each payload.
+func (client *Client) SetPayloadObserver(observer gostatsd.PayloadObserver) {
+	client.payloadObserver = observer
+}
+
+// SetValuePrecision sets the number of significant digits of float values of the plaintext protocol.
+// The pickle protocol sends float values in binary.
+func (client *Client) SetValuePrecision(digits int) {
+	client.valuePrecision = digits
+}
+
 // Name returns the name of the backend.
 func (c *Client) Name() string {
 	return BackendName
@@ -163,17 +217,25 @@ func NewClientFromViper(v *viper.Viper) (gostatsd.Backend, error) {
 	g.SetDefault("prefix_set", DefaultPrefixSet)
 	g.SetDefault("global_suffix", DefaultGlobalSuffix)
 	g.SetDefault("legacy_namespace", DefaultLegacyNamespace)
+	g.SetDefault("protocol", DefaultProtocol)
+	g.SetDefault("batch_size", DefaultBatchSize)
 	return NewClient(&Config{
-		Address:         addr(g.GetString("address")),
-		DialTimeout:     addrD(g.GetDuration("dial_timeout")),
-		WriteTimeout:    addrD(g.GetDuration("write_timeout")),
-		GlobalPrefix:    addr(g.GetString("global_prefix")),
-		PrefixCounter:   addr(g.GetString("prefix_counter")),
-		PrefixTimer:     addr(g.GetString("prefix_timer")),
-		PrefixGauge:     addr(g.GetString("prefix_gauge")),
-		PrefixSet:       addr(g.GetString("prefix_set")),
-		GlobalSuffix:    addr(g.GetString("global_suffix")),
-		LegacyNamespace: addrB(g.GetBool("legacy_namespace")),
+		Address:                addr(g.GetString("address")),
+		DialTimeout:            addrD(g.GetDuration("dial_timeout")),
+		WriteTimeout:           addrD(g.GetDuration("write_timeout")),
+		GlobalPrefix:           addr(g.GetString("global_prefix")),
+		PrefixCounter:          addr(g.GetString("prefix_counter")),
+		PrefixTimer:            addr(g.GetString("prefix_timer")),
+		PrefixGauge:            addr(g.GetString("prefix_gauge")),
+		PrefixSet:              addr(g.GetString("prefix_set")),
+		GlobalSuffix:           addr(g.GetString("global_suffix")),
+		LegacyNamespace:        addrB(g.GetBool("legacy_namespace")),
+		Protocol:               addr(g.GetString("protocol")),
+		BatchSize:              addrI(g.GetInt("batch_size")),
+		CounterTimestampOffset: addrD(g.GetDuration("counter_timestamp_offset")),
+		TimerTimestampOffset:   addrD(g.GetDuration("timer_timestamp_offset")),
+		GaugeTimestampOffset:   addrD(g.GetDuration("gauge_timestamp_offset")),
+		SetTimestampOffset:     addrD(g.GetDuration("set_timestamp_offset")),
 	})
 }
 
@@ -191,6 +253,26 @@ func NewClient(config *Config) (*Client, error) {
 	if writeTimeout < 0 {
 		return nil, fmt.Errorf("[%s] writeTimeout should be non-negative", BackendName)
 	}
+	protocol := getOrDefaultStr(config.Protocol, DefaultProtocol)
+	if protocol != ProtocolPlaintext && protocol != ProtocolPickle {
+		return nil, fmt.Errorf("[%s] unknown protocol %q, must be one of %s, %s", BackendName, protocol, ProtocolPlaintext, ProtocolPickle)
+	}
+	batchSize := DefaultBatchSize
+	if config.BatchSize != nil {
+		batchSize = *config.BatchSize
+	}
+	if batchSize <= 0 {
+		return nil, fmt.Errorf("[%s] batchSize should be positive", BackendName)
+	}
+	counterOffset := getOrDefaultDur(config.CounterTimestampOffset, 0)
+	timerOffset := getOrDefaultDur(config.TimerTimestampOffset, 0)
+	gaugeOffset := getOrDefaultDur(config.GaugeTimestampOffset, 0)
+	setOffset := getOrDefaultDur(config.SetTimestampOffset, 0)
+	for _, offset := range []time.Duration{counterOffset, timerOffset, gaugeOffset, setOffset} {
+		if offset%time.Second != 0 {
+			return nil, fmt.Errorf("[%s] timestamp offsets should be whole seconds", BackendName)
+		}
+	}
 	globalSuffix := getOrDefaultStr(config.GlobalSuffix, DefaultGlobalSuffix)
 	if globalSuffix != "" {
 		globalSuffix = `.` + globalSuffix
@@ -214,7 +296,7 @@ func NewClient(config *Config) (*Client, error) {
 		gaugesNamespace = globalPrefix + getOrDefaultPrefix(config.PrefixGauge, DefaultPrefixGauge)
 		setsNamespace = globalPrefix + getOrDefaultPrefix(config.PrefixSet, DefaultPrefixSet)
 	}
-	log.Infof("[%s] address=%s dialTimeout=%s writeTimeout=%s", BackendName, address, dialTimeout, writeTimeout)
+	log.Infof("[%s] address=%s dialTimeout=%s writeTimeout=%s protocol=%s", BackendName, address, dialTimeout, writeTimeout, protocol)
 	return &Client{
 		sender: sender.Sender{
 			ConnFactory: func() (net.Conn, error) {
@@ -236,6 +318,12 @@ func NewClient(config *Config) (*Client, error) {
 		setsNamespace:    setsNamespace,
 		globalSuffix:     globalSuffix,
 		legacyNamespace:  legacyNamespace,
+		protocol:         protocol,
+		batchSize:        batchSize,
+		counterOffset:    counterOffset,
+		timerOffset:      timerOffset,
+		gaugeOffset:      gaugeOffset,
+		setOffset:        setOffset,
 	}, nil
 }
 
@@ -261,6 +349,19 @@ func getOrDefaultDur(val *time.Duration, def time.Duration) time.Duration {
 	return def
 }
 
+// bucketName returns the name of the histogram bucket, e.g. 0_5-10 for [0.5, 10) and 100-inf for [100, +Inf).
+func bucketName(b gostatsd.HistogramBucket) string {
+	upper := "inf"
+	if !b.IsOpen() {
+		upper = formatBound(b.Upper)
+	}
+	return formatBound(b.Lower) + "-" + upper
+}
+
+func formatBound(f float64) string {
+	return strings.Replace(strconv.FormatFloat(f, 'f', -1, 64), ".", "_", -1)
+}
+
 func sk(s string) []byte {
 	r1 := regWhitespace.ReplaceAllLiteral([]byte(s), []byte{'_'})
 	r2 := bytes.Replace(r1, []byte{'/'}, []byte{'-'}, -1)
@@ -279,6 +380,10 @@ func addrD(d time.Duration) *time.Duration {
 	return &d
 }
 
+func addrI(i int) *int {
+	return &i
+}
+
 func getSubViper(v *viper.Viper, key string) *viper.Viper {
 	n := v.Sub(key)
 	if n == nil {
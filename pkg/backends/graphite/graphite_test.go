@@ -3,8 +3,10 @@ package graphite
 import (
 	"context"
 	"io"
+	"math"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -105,6 +107,65 @@ func TestPreparePayload(t *testing.T) {
 	}
 }
 
+func TestPreparePayloadTimestampOffsets(t *testing.T) {
+	t.Parallel()
+	cl, err := NewClient(&Config{
+		CounterTimestampOffset: addrD(-2 * time.Second),
+		TimerTimestampOffset:   addrD(time.Second),
+		GaugeTimestampOffset:   addrD(3 * time.Second),
+		SetTimestampOffset:     addrD(0),
+	})
+	require.NoError(t, err)
+	b := cl.preparePayload(metrics(), time.Unix(1234, 0))
+	offsets := map[string]int64{
+		"stats_counts.": -2,
+		"stats.stat1":   -2,
+		"stats.timers.": 1,
+		"stats.gauges.": 3,
+		"stats.sets.":   0,
+	}
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	require.Len(t, lines, 14)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		require.Len(t, fields, 3, line)
+		found := false
+		for prefix, offset := range offsets {
+			if strings.HasPrefix(fields[0], prefix) {
+				assert.Equal(t, strconv.FormatInt(1234+offset, 10), fields[2], line)
+				found = true
+			}
+		}
+		assert.True(t, found, line)
+	}
+}
+
+func TestPreparePayloadHistogramBuckets(t *testing.T) {
+	t.Parallel()
+	cl, err := NewClient(&Config{})
+	require.NoError(t, err)
+	metrics := &gostatsd.MetricMap{
+		Timers: gostatsd.Timers{
+			"t1": map[string]gostatsd.Timer{
+				"": {Buckets: gostatsd.HistogramBuckets{
+					{Lower: 0.5, Upper: 10, Count: 5},
+					{Lower: 100, Upper: math.Inf(1), Count: 3},
+				}},
+			},
+		},
+	}
+	b := cl.preparePayload(metrics, time.Unix(1234, 0))
+	assert.Contains(t, b.String(), "stats.timers.t1.sum_squares 0.000000 1234\n"+
+		"stats.timers.t1.bucket.0_5-10 5 1234\n"+
+		"stats.timers.t1.bucket.100-inf 3 1234\n")
+}
+
+func TestNewClientInvalidTimestampOffset(t *testing.T) {
+	t.Parallel()
+	_, err := NewClient(&Config{TimerTimestampOffset: addrD(1500 * time.Millisecond)})
+	assert.EqualError(t, err, "[graphite] timestamp offsets should be whole seconds")
+}
+
 func TestSendMetricsAsync(t *testing.T) {
 	t.Parallel()
 	l, err := net.Listen("tcp", "localhost:0")
@@ -115,6 +176,10 @@ func TestSendMetricsAsync(t *testing.T) {
 		Address: &addr,
 	})
 	require.NoError(t, err)
+	var sizes []int
+	c.SetPayloadObserver(func(size int) {
+		sizes = append(sizes, size)
+	})
 
 	var acceptWg sync.WaitGroup
 	acceptWg.Add(1)
@@ -155,6 +220,8 @@ func TestSendMetricsAsync(t *testing.T) {
 		}
 	})
 	wg.Wait()
+	require.Len(t, sizes, 1)
+	assert.Equal(t, c.preparePayload(metrics(), time.Now()).Len(), sizes[0])
 }
 
 func metrics() *gostatsd.MetricMap {
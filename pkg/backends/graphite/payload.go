@@ -0,0 +1,152 @@
+package graphite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// payloadWriter writes data points of flushed metrics to a payload. The path of a data point is the prefix,
+// the key and the stat followed by the global suffix.
+type payloadWriter interface {
+	// setTimestamp sets the timestamp in seconds of the data points written next.
+	setTimestamp(now int64)
+	writeInt(prefix string, key []byte, stat string, value int64)
+	writeFloat(prefix string, key []byte, stat string, value float64)
+	// close writes data points that are not written yet.
+	close()
+}
+
+// plaintextWriter writes data points with the plaintext protocol, one "<path> <value> <timestamp>" line each.
+type plaintextWriter struct {
+	buf    *bytes.Buffer
+	now    int64
+	suffix string
+	digits int // Significant digits of float values, see gostatsd.FormatValue
+}
+
+func (w *plaintextWriter) setTimestamp(now int64) {
+	w.now = now
+}
+
+func (w *plaintextWriter) writeInt(prefix string, key []byte, stat string, value int64) {
+	fmt.Fprintf(w.buf, "%s%s%s%s %d %d\n", prefix, key, stat, w.suffix, value, w.now) // #nosec
+}
+
+func (w *plaintextWriter) writeFloat(prefix string, key []byte, stat string, value float64) {
+	fmt.Fprintf(w.buf, "%s%s%s%s %s %d\n", prefix, key, stat, w.suffix, gostatsd.FormatValue(value, w.digits), w.now) // #nosec
+}
+
+func (w *plaintextWriter) close() {}
+
+// Pickle opcodes, see https://github.com/python/cpython/blob/main/Lib/pickletools.py
+const (
+	pickleProto      = 0x80 // Protocol version
+	pickleEmptyList  = ']'
+	pickleMark       = '('
+	pickleAppends    = 'e'  // Appends the items since the mark to the list
+	pickleBinUnicode = 'X'  // UTF-8 string with a 4-byte little-endian length
+	pickleBinInt     = 'J'  // 4-byte little-endian signed integer
+	pickleLong1      = 0x8a // Little-endian two's complement integer with a 1-byte length
+	pickleBinFloat   = 'G'  // 8-byte big-endian float
+	pickleTuple2     = 0x86 // Tuple of the top 2 items
+	pickleStop       = '.'
+)
+
+// pickleWriter writes data points with the pickle protocol. Each message is a 4-byte big-endian length followed
+// by a pickled list of at most batchSize (path, (timestamp, value)) tuples, as expected by carbon.
+type pickleWriter struct {
+	buf       *bytes.Buffer
+	now       int64
+	suffix    string
+	batchSize int
+	message   bytes.Buffer // Pickled data points of the current message
+	count     int          // Number of data points in the current message
+}
+
+func newPickleWriter(buf *bytes.Buffer, suffix string, batchSize int) *pickleWriter {
+	return &pickleWriter{
+		buf:       buf,
+		suffix:    suffix,
+		batchSize: batchSize,
+	}
+}
+
+func (w *pickleWriter) setTimestamp(now int64) {
+	w.now = now
+}
+
+func (w *pickleWriter) writeInt(prefix string, key []byte, stat string, value int64) {
+	w.writePath(prefix, key, stat)
+	w.writeInteger(value)
+	w.message.WriteByte(pickleTuple2)
+	w.message.WriteByte(pickleTuple2)
+	w.written()
+}
+
+func (w *pickleWriter) writeFloat(prefix string, key []byte, stat string, value float64) {
+	w.writePath(prefix, key, stat)
+	var b [9]byte
+	b[0] = pickleBinFloat
+	binary.BigEndian.PutUint64(b[1:], math.Float64bits(value))
+	w.message.Write(b[:])
+	w.message.WriteByte(pickleTuple2)
+	w.message.WriteByte(pickleTuple2)
+	w.written()
+}
+
+// writePath writes the path of a data point followed by the timestamp.
+func (w *pickleWriter) writePath(prefix string, key []byte, stat string) {
+	if w.count == 0 {
+		w.message.Write([]byte{pickleProto, 2, pickleEmptyList, pickleMark})
+	}
+	var b [5]byte
+	b[0] = pickleBinUnicode
+	binary.LittleEndian.PutUint32(b[1:], uint32(len(prefix)+len(key)+len(stat)+len(w.suffix)))
+	w.message.Write(b[:])
+	w.message.WriteString(prefix)
+	w.message.Write(key)
+	w.message.WriteString(stat)
+	w.message.WriteString(w.suffix)
+	w.writeInteger(w.now)
+}
+
+func (w *pickleWriter) writeInteger(value int64) {
+	if value >= math.MinInt32 && value <= math.MaxInt32 {
+		var b [5]byte
+		b[0] = pickleBinInt
+		binary.LittleEndian.PutUint32(b[1:], uint32(int32(value)))
+		w.message.Write(b[:])
+		return
+	}
+	var b [10]byte
+	b[0] = pickleLong1
+	b[1] = 8
+	binary.LittleEndian.PutUint64(b[2:], uint64(value))
+	w.message.Write(b[:])
+}
+
+// written ends the message if it has batchSize data points.
+func (w *pickleWriter) written() {
+	w.count++
+	if w.count >= w.batchSize {
+		w.close()
+	}
+}
+
+func (w *pickleWriter) close() {
+	if w.count == 0 {
+		return
+	}
+	w.message.WriteByte(pickleAppends)
+	w.message.WriteByte(pickleStop)
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(w.message.Len()))
+	w.buf.Write(header[:])
+	w.buf.Write(w.message.Bytes())
+	w.message.Reset()
+	w.count = 0
+}
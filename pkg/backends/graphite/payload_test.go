@@ -0,0 +1,211 @@
+package graphite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pythonPickle is pickle.dumps([("a.b", (1500000000, 1.5)), ("c", (1 << 40, -2.0))], protocol=2) from Python 3.
+const pythonPickle = "\x80\x02]q\x00(X\x03\x00\x00\x00a.bq\x01J\x00/hYG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03" +
+	"X\x01\x00\x00\x00cq\x04\x8a\x06\x00\x00\x00\x00\x00\x01G\xc0\x00\x00\x00\x00\x00\x00\x00\x86q\x05\x86q\x06e."
+
+// point is a decoded (path, (timestamp, value)) tuple.
+type point struct {
+	path      string
+	timestamp int64
+	value     float64
+}
+
+type tuple []interface{}
+
+type mark struct{}
+
+// unpickle decodes a pickled list of (path, (timestamp, value)) tuples. Only the opcodes Python uses to pickle
+// such lists with protocol 2 are supported.
+func unpickle(data []byte) ([]point, error) {
+	var stack []interface{}
+	pop := func() interface{} {
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v
+	}
+	r := bytes.NewReader(data)
+	read := func(n int) []byte {
+		b := make([]byte, n)
+		if _, err := r.Read(b); err != nil && n > 0 {
+			panic(err)
+		}
+		return b
+	}
+	for r.Len() > 0 {
+		op, _ := r.ReadByte()
+		switch op {
+		case pickleProto:
+			if v := read(1)[0]; v != 2 {
+				return nil, fmt.Errorf("unsupported protocol %d", v)
+			}
+		case pickleEmptyList:
+			stack = append(stack, &[]interface{}{})
+		case pickleMark:
+			stack = append(stack, mark{})
+		case pickleBinUnicode:
+			stack = append(stack, string(read(int(binary.LittleEndian.Uint32(read(4))))))
+		case 0x8c: // SHORT_BINUNICODE
+			stack = append(stack, string(read(int(read(1)[0]))))
+		case pickleBinInt:
+			stack = append(stack, int64(int32(binary.LittleEndian.Uint32(read(4)))))
+		case 'K': // BININT1
+			stack = append(stack, int64(read(1)[0]))
+		case 'M': // BININT2
+			stack = append(stack, int64(binary.LittleEndian.Uint16(read(2))))
+		case pickleLong1:
+			b := read(int(read(1)[0]))
+			var v int64
+			for i := len(b) - 1; i >= 0; i-- {
+				v = v<<8 | int64(b[i])
+			}
+			if len(b) > 0 && len(b) < 8 && b[len(b)-1]&0x80 != 0 {
+				v -= 1 << (8 * uint(len(b)))
+			}
+			stack = append(stack, v)
+		case pickleBinFloat:
+			stack = append(stack, math.Float64frombits(binary.BigEndian.Uint64(read(8))))
+		case pickleTuple2:
+			second := pop()
+			stack = append(stack, tuple{pop(), second})
+		case 'q': // BINPUT, the memo is not used by the supported opcodes
+			read(1)
+		case pickleAppends:
+			var items []interface{}
+			for {
+				v := pop()
+				if _, ok := v.(mark); ok {
+					break
+				}
+				items = append([]interface{}{v}, items...)
+			}
+			list := stack[len(stack)-1].(*[]interface{})
+			*list = append(*list, items...)
+		case 'a': // APPEND
+			v := pop()
+			list := stack[len(stack)-1].(*[]interface{})
+			*list = append(*list, v)
+		case pickleStop:
+			if r.Len() > 0 || len(stack) != 1 {
+				return nil, fmt.Errorf("unexpected stop")
+			}
+			var points []point
+			for _, item := range *stack[0].(*[]interface{}) {
+				t := item.(tuple)
+				datapoint := t[1].(tuple)
+				p := point{path: t[0].(string), timestamp: datapoint[0].(int64)}
+				switch v := datapoint[1].(type) {
+				case int64:
+					p.value = float64(v)
+				case float64:
+					p.value = v
+				}
+				points = append(points, p)
+			}
+			return points, nil
+		default:
+			return nil, fmt.Errorf("unsupported opcode %#x", op)
+		}
+	}
+	return nil, fmt.Errorf("missing stop")
+}
+
+// unpickleMessages decodes length-prefixed pickle messages.
+func unpickleMessages(t *testing.T, data []byte) [][]point {
+	var messages [][]point
+	for len(data) > 0 {
+		require.True(t, len(data) >= 4)
+		n := binary.BigEndian.Uint32(data)
+		require.True(t, len(data) >= int(4+n))
+		points, err := unpickle(data[4 : 4+n])
+		require.NoError(t, err)
+		messages = append(messages, points)
+		data = data[4+n:]
+	}
+	return messages
+}
+
+func TestUnpickle(t *testing.T) {
+	t.Parallel()
+	points, err := unpickle([]byte(pythonPickle))
+	require.NoError(t, err)
+	assert.Equal(t, []point{
+		{path: "a.b", timestamp: 1500000000, value: 1.5},
+		{path: "c", timestamp: 1 << 40, value: -2},
+	}, points)
+}
+
+func TestPickleWriter(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	w := newPickleWriter(&buf, "", 2)
+	w.setTimestamp(1500000000)
+	w.writeFloat("a", []byte("."), "b", 1.5)
+	w.writeInt("", []byte("c"), "", -1<<40)
+	w.writeInt("", []byte("d"), "", 7)
+	w.close()
+	w.close()
+
+	assert.Equal(t, [][]point{
+		{
+			{path: "a.b", timestamp: 1500000000, value: 1.5},
+			{path: "c", timestamp: 1500000000, value: -1 << 40},
+		},
+		{
+			{path: "d", timestamp: 1500000000, value: 7},
+		},
+	}, unpickleMessages(t, buf.Bytes()))
+}
+
+func TestPreparePayloadPickle(t *testing.T) {
+	t.Parallel()
+	cl, err := NewClient(&Config{
+		Protocol:  addr(ProtocolPickle),
+		BatchSize: addrI(10),
+	})
+	require.NoError(t, err)
+	b := cl.preparePayload(metrics(), time.Unix(1234, 0))
+	messages := unpickleMessages(t, b.Bytes())
+	require.Len(t, messages, 2)
+	assert.Len(t, messages[0], 10)
+	var points []point
+	for _, m := range messages {
+		points = append(points, m...)
+	}
+	assert.Equal(t, []point{
+		{path: "stats_counts.stat1", timestamp: 1234, value: 5},
+		{path: "stats.stat1", timestamp: 1234, value: 1.1},
+		{path: "stats.timers.t1.lower", timestamp: 1234},
+		{path: "stats.timers.t1.upper", timestamp: 1234},
+		{path: "stats.timers.t1.count", timestamp: 1234},
+		{path: "stats.timers.t1.count_ps", timestamp: 1234},
+		{path: "stats.timers.t1.mean", timestamp: 1234},
+		{path: "stats.timers.t1.median", timestamp: 1234},
+		{path: "stats.timers.t1.std", timestamp: 1234},
+		{path: "stats.timers.t1.sum", timestamp: 1234},
+		{path: "stats.timers.t1.sum_squares", timestamp: 1234},
+		{path: "stats.timers.t1.count_90", timestamp: 1234, value: 90},
+		{path: "stats.gauges.g1", timestamp: 1234, value: 3},
+		{path: "stats.sets.users", timestamp: 1234, value: 3},
+	}, points)
+}
+
+func TestNewClientInvalidProtocol(t *testing.T) {
+	t.Parallel()
+	_, err := NewClient(&Config{Protocol: addr("json")})
+	assert.EqualError(t, err, `[graphite] unknown protocol "json", must be one of plaintext, pickle`)
+	_, err = NewClient(&Config{Protocol: addr(ProtocolPickle), BatchSize: addrI(0)})
+	assert.Error(t, err)
+}
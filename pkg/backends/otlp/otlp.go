@@ -0,0 +1,369 @@
+// Package otlp implements a backend that exports flushed metrics to an OpenTelemetry collector with OTLP/gRPC.
+//
+// Counters are exported as delta sums, gauges as gauges, timers as delta histograms of their values and sets as
+// gauges of the number of their distinct values. The global tags are exported as attributes of the resource and
+// the other tags as attributes of the data points, the hostname of a metric as the host.name attribute.
+package otlp
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statsd"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+const (
+	// BackendName is the name of this backend.
+	BackendName = "otlp"
+	// DefaultAddress is the default address of the OTLP/gRPC endpoint.
+	DefaultAddress = "localhost:4317"
+	// DefaultTimeout is the default timeout of an export.
+	DefaultTimeout = 10 * time.Second
+	// hostNameAttribute is the attribute with the hostname of the source of a metric.
+	hostNameAttribute = "host.name"
+	// scopeName is the name of the instrumentation scope of exported metrics.
+	scopeName = "github.com/atlassian/gostatsd"
+	// maxConcurrentSends is the number of max concurrent SendMetricsAsync calls that can actually make progress.
+	// More calls will block.
+	maxConcurrentSends = 10
+)
+
+// DefaultHistogramBuckets are the default upper bounds of the buckets of histograms of timers.
+var DefaultHistogramBuckets = []float64{0, 5, 10, 25, 50, 75, 100, 250, 500, 750, 1000, 2500, 5000, 7500, 10000}
+
+// Config holds configuration for the OTLP backend.
+type Config struct {
+	Address          string            // Address of the OTLP/gRPC endpoint
+	Insecure         bool              // Whether to connect without TLS
+	Headers          map[string]string // Headers sent with each export, e.g. for authentication
+	Timeout          time.Duration     // Timeout of an export
+	HistogramBuckets []float64         // Upper bounds of the buckets of histograms of timers, in increasing order
+	ResourceTags     gostatsd.Tags     // Tags exported as attributes of the resource
+}
+
+// Client exports flushed metrics with OTLP/gRPC.
+type Client struct {
+	now      func() time.Time // Returns current time. Useful for testing.
+	exporter sdkmetric.Exporter
+	config   Config
+	resource *resource.Resource
+	// Tags of the resource, which are not exported as attributes of data points
+	resourceTags map[string]struct{}
+	sem          chan struct{} // Limits concurrent sends
+}
+
+// NewClientFromViper constructs an OTLP backend from the otlp section of the configuration. The resource tags
+// are the global tags given by the default-tags and default-tags-env parameters.
+func NewClientFromViper(v *viper.Viper) (gostatsd.Backend, error) {
+	o := getSubViper(v, "otlp")
+	o.SetDefault("address", DefaultAddress)
+	o.SetDefault("insecure", false)
+	o.SetDefault("timeout", DefaultTimeout)
+	o.SetDefault("histogram_buckets", DefaultHistogramBuckets)
+	buckets, err := toFloats(o.Get("histogram_buckets"))
+	if err != nil {
+		return nil, fmt.Errorf("[%s] histogram_buckets: %v", BackendName, err)
+	}
+	resourceTags := statsd.EnvTags(toSlice(v.GetString(statsd.ParamDefaultTagsEnv)))
+	resourceTags = append(gostatsd.Tags(toSlice(v.GetString(statsd.ParamDefaultTags))), resourceTags...)
+	return NewClient(Config{
+		Address:          o.GetString("address"),
+		Insecure:         o.GetBool("insecure"),
+		Headers:          o.GetStringMapString("headers"),
+		Timeout:          o.GetDuration("timeout"),
+		HistogramBuckets: buckets,
+		ResourceTags:     resourceTags,
+	})
+}
+
+// NewClient constructs an OTLP backend.
+func NewClient(config Config) (*Client, error) {
+	if config.Address == "" {
+		return nil, fmt.Errorf("[%s] address is required", BackendName)
+	}
+	if config.Timeout <= 0 {
+		return nil, fmt.Errorf("[%s] timeout should be positive", BackendName)
+	}
+	for i := 1; i < len(config.HistogramBuckets); i++ {
+		if config.HistogramBuckets[i] <= config.HistogramBuckets[i-1] {
+			return nil, fmt.Errorf("[%s] histogram buckets should be in increasing order", BackendName)
+		}
+	}
+	options := []otlpmetricgrpc.Option{
+		otlpmetricgrpc.WithEndpoint(config.Address),
+		otlpmetricgrpc.WithTimeout(config.Timeout),
+	}
+	if config.Insecure {
+		options = append(options, otlpmetricgrpc.WithInsecure())
+	}
+	if len(config.Headers) > 0 {
+		options = append(options, otlpmetricgrpc.WithHeaders(config.Headers))
+	}
+	exporter, err := otlpmetricgrpc.New(context.Background(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %v", BackendName, err)
+	}
+	log.Infof("[%s] address=%s insecure=%t timeout=%v resourceTags=%v", BackendName, config.Address, config.Insecure, config.Timeout, config.ResourceTags)
+	resourceTags := make(map[string]struct{}, len(config.ResourceTags))
+	for _, tag := range config.ResourceTags {
+		resourceTags[tag] = struct{}{}
+	}
+	return &Client{
+		now:          time.Now,
+		exporter:     exporter,
+		config:       config,
+		resource:     resource.NewSchemaless(tagAttributes(config.ResourceTags, nil)...),
+		resourceTags: resourceTags,
+		sem:          make(chan struct{}, maxConcurrentSends),
+	}, nil
+}
+
+// SendMetricsAsync converts the metrics synchronously and exports them asynchronously.
+func (c *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	if metrics.NumStats == 0 {
+		cb(nil)
+		return
+	}
+	rm := c.resourceMetrics(metrics)
+	select {
+	case <-ctx.Done():
+		cb([]error{ctx.Err()})
+		return
+	case c.sem <- struct{}{}:
+	}
+	go func() {
+		defer func() {
+			<-c.sem
+		}()
+		if err := c.exporter.Export(ctx, rm); err != nil {
+			cb([]error{fmt.Errorf("[%s] %v", BackendName, err)})
+			return
+		}
+		cb(nil)
+	}()
+}
+
+// resourceMetrics converts the metrics. Metrics are sorted by name and type.
+func (c *Client) resourceMetrics(metrics *gostatsd.MetricMap) *metricdata.ResourceMetrics {
+	now := c.now()
+	start := now.Add(-metrics.FlushInterval)
+	attributes := func(hostname string, tags gostatsd.Tags) attribute.Set {
+		kvs := tagAttributes(tags, c.resourceTags)
+		if hostname != "" {
+			kvs = append(kvs, attribute.String(hostNameAttribute, hostname))
+		}
+		return attribute.NewSet(kvs...)
+	}
+
+	sums := make(map[string]*metricdata.Sum[int64])
+	units := make(map[string]string)
+	metrics.Counters.Each(func(name, tagsKey string, counter gostatsd.Counter) {
+		sum, ok := sums[name]
+		if !ok {
+			sum = &metricdata.Sum[int64]{Temporality: metricdata.DeltaTemporality, IsMonotonic: true}
+			sums[name] = sum
+		}
+		if counter.Value < 0 {
+			sum.IsMonotonic = false
+		}
+		units[name] = counter.Unit
+		sum.DataPoints = append(sum.DataPoints, metricdata.DataPoint[int64]{
+			Attributes: attributes(counter.Hostname, counter.Tags),
+			StartTime:  start,
+			Time:       now,
+			Value:      counter.Value,
+		})
+	})
+	result := make(byName, 0, len(metrics.Counters)+len(metrics.Gauges)+len(metrics.Timers)+len(metrics.Sets))
+	for name, sum := range sums {
+		result = append(result, metricdata.Metrics{Name: name, Unit: units[name], Data: *sum})
+	}
+
+	gauges := make(map[string]*metricdata.Gauge[float64])
+	units = make(map[string]string)
+	metrics.Gauges.Each(func(name, tagsKey string, g gostatsd.Gauge) {
+		gauge, ok := gauges[name]
+		if !ok {
+			gauge = &metricdata.Gauge[float64]{}
+			gauges[name] = gauge
+		}
+		units[name] = g.Unit
+		gauge.DataPoints = append(gauge.DataPoints, metricdata.DataPoint[float64]{
+			Attributes: attributes(g.Hostname, g.Tags),
+			Time:       now,
+			Value:      g.Value,
+		})
+	})
+	for name, gauge := range gauges {
+		result = append(result, metricdata.Metrics{Name: name, Unit: units[name], Data: *gauge})
+	}
+
+	histograms := make(map[string]*metricdata.Histogram[float64])
+	units = make(map[string]string)
+	metrics.Timers.Each(func(name, tagsKey string, timer gostatsd.Timer) {
+		if len(timer.Values) == 0 {
+			return
+		}
+		histogram, ok := histograms[name]
+		if !ok {
+			histogram = &metricdata.Histogram[float64]{Temporality: metricdata.DeltaTemporality}
+			histograms[name] = histogram
+		}
+		units[name] = timer.Unit
+		dp := c.histogramDataPoint(timer.Values)
+		dp.Attributes = attributes(timer.Hostname, timer.Tags)
+		dp.StartTime = start
+		dp.Time = now
+		histogram.DataPoints = append(histogram.DataPoints, dp)
+	})
+	for name, histogram := range histograms {
+		result = append(result, metricdata.Metrics{Name: name, Unit: units[name], Data: *histogram})
+	}
+
+	cardinalities := make(map[string]*metricdata.Gauge[int64])
+	units = make(map[string]string)
+	metrics.Sets.Each(func(name, tagsKey string, set gostatsd.Set) {
+		gauge, ok := cardinalities[name]
+		if !ok {
+			gauge = &metricdata.Gauge[int64]{}
+			cardinalities[name] = gauge
+		}
+		units[name] = set.Unit
+		gauge.DataPoints = append(gauge.DataPoints, metricdata.DataPoint[int64]{
+			Attributes: attributes(set.Hostname, set.Tags),
+			Time:       now,
+			Value:      int64(set.Cardinality()),
+		})
+	})
+	for name, gauge := range cardinalities {
+		result = append(result, metricdata.Metrics{Name: name, Unit: units[name], Data: *gauge})
+	}
+
+	sort.Stable(result)
+	return &metricdata.ResourceMetrics{
+		Resource: c.resource,
+		ScopeMetrics: []metricdata.ScopeMetrics{{
+			Scope:   instrumentation.Scope{Name: scopeName},
+			Metrics: result,
+		}},
+	}
+}
+
+// byName sorts metrics by name.
+type byName []metricdata.Metrics
+
+func (b byName) Len() int {
+	return len(b)
+}
+
+func (b byName) Less(i, j int) bool {
+	return b[i].Name < b[j].Name
+}
+
+func (b byName) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+// histogramDataPoint returns the data point of the histogram of the values.
+func (c *Client) histogramDataPoint(values []float64) metricdata.HistogramDataPoint[float64] {
+	bounds := c.config.HistogramBuckets
+	dp := metricdata.HistogramDataPoint[float64]{
+		Count:        uint64(len(values)),
+		Bounds:       bounds,
+		BucketCounts: make([]uint64, len(bounds)+1),
+	}
+	min, max := values[0], values[0]
+	for _, value := range values {
+		dp.Sum += value
+		if value < min {
+			min = value
+		}
+		if value > max {
+			max = value
+		}
+		// Buckets include their upper bound
+		dp.BucketCounts[sort.SearchFloat64s(bounds, value)]++
+	}
+	dp.Min = metricdata.NewExtrema(min)
+	dp.Max = metricdata.NewExtrema(max)
+	return dp
+}
+
+// tagAttributes returns the attributes of the tags that are not excluded. The key of the attribute of a tag
+// without a value is the tag and its value is empty.
+func tagAttributes(tags gostatsd.Tags, excluded map[string]struct{}) []attribute.KeyValue {
+	result := make([]attribute.KeyValue, 0, len(tags)+1)
+	for _, tag := range tags {
+		if _, ok := excluded[tag]; ok {
+			continue
+		}
+		if i := strings.IndexByte(tag, ':'); i >= 0 {
+			result = append(result, attribute.String(tag[:i], tag[i+1:]))
+		} else {
+			result = append(result, attribute.String(tag, ""))
+		}
+	}
+	return result
+}
+
+// SendEvent discards events.
+func (c *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+// Name returns the name of the backend.
+func (c *Client) Name() string {
+	return BackendName
+}
+
+// Close closes the connection to the endpoint.
+func (c *Client) Close() error {
+	return c.exporter.Shutdown(context.Background())
+}
+
+// toFloats returns the numbers of the list.
+func toFloats(value interface{}) ([]float64, error) {
+	if floats, ok := value.([]float64); ok {
+		return floats, nil
+	}
+	values, err := cast.ToSliceE(value)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]float64, len(values))
+	for i, v := range values {
+		if result[i], err = cast.ToFloat64E(v); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func toSlice(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func getSubViper(v *viper.Viper, key string) *viper.Viper {
+	n := v.Sub(key)
+	if n == nil {
+		n = viper.New()
+	}
+	return n
+}
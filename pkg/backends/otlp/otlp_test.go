@@ -0,0 +1,206 @@
+package otlp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	collectormetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// collector captures exported requests.
+type collector struct {
+	collectormetricspb.UnimplementedMetricsServiceServer
+	mu       sync.Mutex
+	requests []*collectormetricspb.ExportMetricsServiceRequest
+	headers  metadata.MD
+}
+
+func (c *collector) Export(ctx context.Context, req *collectormetricspb.ExportMetricsServiceRequest) (*collectormetricspb.ExportMetricsServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, req)
+	c.headers, _ = metadata.FromIncomingContext(ctx)
+	return &collectormetricspb.ExportMetricsServiceResponse{}, nil
+}
+
+func startCollector(t *testing.T) (*collector, string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	c := &collector{}
+	server := grpc.NewServer()
+	collectormetricspb.RegisterMetricsServiceServer(server, c)
+	go server.Serve(l)
+	return c, l.Addr().String(), server.Stop
+}
+
+func sendMetrics(t *testing.T, c *Client, m *gostatsd.MetricMap) []error {
+	errs := make(chan []error, 1)
+	c.SendMetricsAsync(context.Background(), m, func(e []error) {
+		errs <- e
+	})
+	select {
+	case e := <-errs:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the send")
+		return nil
+	}
+}
+
+func attributes(kvs []*commonpb.KeyValue) map[string]string {
+	result := make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		result[kv.Key] = kv.Value.GetStringValue()
+	}
+	return result
+}
+
+func TestSendMetrics(t *testing.T) {
+	t.Parallel()
+	col, addr, stop := startCollector(t)
+	defer stop()
+	c, err := NewClient(Config{
+		Address:          addr,
+		Insecure:         true,
+		Headers:          map[string]string{"api-key": "secret"},
+		Timeout:          time.Second,
+		HistogramBuckets: []float64{1, 10},
+		ResourceTags:     gostatsd.Tags{"env:prod", "global"},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	now := time.Unix(1000, 0)
+	c.now = func() time.Time { return now }
+
+	errs := sendMetrics(t, c, &gostatsd.MetricMap{
+		MetricStats:   gostatsd.MetricStats{NumStats: 6},
+		FlushInterval: 10 * time.Second,
+		Counters: gostatsd.Counters{
+			"c": {"env:prod,a:b": gostatsd.Counter{Value: 5, Hostname: "web-1", Tags: gostatsd.Tags{"env:prod", "a:b"}, Unit: "1"}},
+		},
+		Gauges: gostatsd.Gauges{
+			"g": {"flag": gostatsd.NewGauge(1, 1.5, "", gostatsd.Tags{"flag"})},
+		},
+		Timers: gostatsd.Timers{
+			"t":     {"": gostatsd.NewTimer(1, []float64{0.5, 1, 5, 20}, "", nil)},
+			"empty": {"": gostatsd.NewTimer(1, nil, "", nil)},
+		},
+		Sets: gostatsd.Sets{
+			"s": {"": gostatsd.NewSet(1, map[string]struct{}{"x": {}, "y": {}}, "", nil)},
+		},
+	})
+	assert.Empty(t, errs)
+
+	col.mu.Lock()
+	defer col.mu.Unlock()
+	require.Len(t, col.requests, 1)
+	assert.Equal(t, []string{"secret"}, col.headers.Get("api-key"))
+	require.Len(t, col.requests[0].ResourceMetrics, 1)
+	rm := col.requests[0].ResourceMetrics[0]
+	assert.Equal(t, map[string]string{"env": "prod", "global": ""}, attributes(rm.Resource.Attributes))
+	require.Len(t, rm.ScopeMetrics, 1)
+	assert.Equal(t, scopeName, rm.ScopeMetrics[0].Scope.Name)
+	metrics := rm.ScopeMetrics[0].Metrics
+	require.Len(t, metrics, 4)
+
+	assert.Equal(t, "c", metrics[0].Name)
+	assert.Equal(t, "1", metrics[0].Unit)
+	sum := metrics[0].GetSum()
+	require.NotNil(t, sum)
+	assert.True(t, sum.IsMonotonic)
+	assert.Equal(t, metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA, sum.AggregationTemporality)
+	require.Len(t, sum.DataPoints, 1)
+	assert.EqualValues(t, 5, sum.DataPoints[0].GetAsInt())
+	assert.EqualValues(t, now.Add(-10*time.Second).UnixNano(), sum.DataPoints[0].StartTimeUnixNano)
+	assert.EqualValues(t, now.UnixNano(), sum.DataPoints[0].TimeUnixNano)
+	assert.Equal(t, map[string]string{"a": "b", "host.name": "web-1"}, attributes(sum.DataPoints[0].Attributes), "resource tags are not repeated")
+
+	assert.Equal(t, "g", metrics[1].Name)
+	require.NotNil(t, metrics[1].GetGauge())
+	assert.Equal(t, 1.5, metrics[1].GetGauge().DataPoints[0].GetAsDouble())
+	assert.Equal(t, map[string]string{"flag": ""}, attributes(metrics[1].GetGauge().DataPoints[0].Attributes))
+
+	assert.Equal(t, "s", metrics[2].Name)
+	require.NotNil(t, metrics[2].GetGauge())
+	assert.EqualValues(t, 2, metrics[2].GetGauge().DataPoints[0].GetAsInt())
+
+	assert.Equal(t, "t", metrics[3].Name, "timers without values are skipped")
+	histogram := metrics[3].GetHistogram()
+	require.NotNil(t, histogram)
+	assert.Equal(t, metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA, histogram.AggregationTemporality)
+	require.Len(t, histogram.DataPoints, 1)
+	dp := histogram.DataPoints[0]
+	assert.EqualValues(t, 4, dp.Count)
+	assert.Equal(t, 26.5, dp.GetSum())
+	assert.Equal(t, 0.5, dp.GetMin())
+	assert.Equal(t, 20.0, dp.GetMax())
+	assert.Equal(t, []float64{1, 10}, dp.ExplicitBounds)
+	assert.Equal(t, []uint64{2, 1, 1}, dp.BucketCounts)
+}
+
+func TestNegativeCountersAreNotMonotonic(t *testing.T) {
+	t.Parallel()
+	c, err := NewClient(Config{Address: DefaultAddress, Timeout: time.Second})
+	require.NoError(t, err)
+	rm := c.resourceMetrics(&gostatsd.MetricMap{
+		Counters: gostatsd.Counters{"c": {
+			"a": gostatsd.NewCounter(1, 2, "", gostatsd.Tags{"a"}),
+			"b": gostatsd.NewCounter(1, -1, "", gostatsd.Tags{"b"}),
+		}},
+	})
+	require.Len(t, rm.ScopeMetrics[0].Metrics, 1)
+	sum, ok := rm.ScopeMetrics[0].Metrics[0].Data.(metricdata.Sum[int64])
+	require.True(t, ok)
+	assert.False(t, sum.IsMonotonic)
+	assert.Len(t, sum.DataPoints, 2)
+}
+
+func TestSendMetricsError(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+	c, err := NewClient(Config{Address: addr, Insecure: true, Timeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+	defer c.Close()
+	errs := sendMetrics(t, c, &gostatsd.MetricMap{
+		MetricStats: gostatsd.MetricStats{NumStats: 1},
+		Gauges:      gostatsd.Gauges{"g": {"": gostatsd.NewGauge(1, 1, "", nil)}},
+	})
+	assert.Len(t, errs, 1)
+}
+
+func TestNewClientFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("default-tags", "env:prod,global")
+	v.Set("otlp.insecure", true)
+	v.Set("otlp.histogram_buckets", []interface{}{1, 2.5, "10"})
+	b, err := NewClientFromViper(v)
+	require.NoError(t, err)
+	c := b.(*Client)
+	defer c.Close()
+	assert.Equal(t, DefaultAddress, c.config.Address)
+	assert.True(t, c.config.Insecure)
+	assert.Equal(t, DefaultTimeout, c.config.Timeout)
+	assert.Equal(t, []float64{1, 2.5, 10}, c.config.HistogramBuckets)
+	assert.Equal(t, gostatsd.Tags{"env:prod", "global"}, c.config.ResourceTags)
+
+	v.Set("otlp.histogram_buckets", []interface{}{10, 1})
+	_, err = NewClientFromViper(v)
+	assert.Error(t, err)
+}
@@ -0,0 +1,280 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	log "github.com/Sirupsen/logrus"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/spf13/viper"
+)
+
+const (
+	// BackendName is the name of this backend.
+	BackendName = "redis"
+	// DefaultAddress is the default address of the Redis server.
+	DefaultAddress = "localhost:6379"
+	// DefaultKeyPrefix is the default prefix of keys metrics are written to.
+	DefaultKeyPrefix = "gostatsd"
+	// DefaultDialTimeout is the default timeout of connecting to Redis.
+	DefaultDialTimeout = 5 * time.Second
+	// DefaultWriteTimeout is the default timeout of writing commands to Redis.
+	DefaultWriteTimeout = 30 * time.Second
+	// DefaultTTL is the default time to live of keys of all metric types.
+	DefaultTTL = 24 * time.Hour
+	// DefaultTimerSamples is the default maximum number of timer samples kept per timer.
+	DefaultTimerSamples = 1000
+	// DefaultBatchSize is the default maximum number of commands sent in one pipeline.
+	DefaultBatchSize = 1000
+	// maxConcurrentSends is the number of max concurrent SendMetricsAsync calls that can actually make progress.
+	// More calls will block.
+	maxConcurrentSends = 10
+)
+
+// Config holds configuration for the Redis backend.
+type Config struct {
+	Addresses    []string      // Addresses of the server, or of the seed nodes of the cluster
+	Cluster      bool          // Whether the addresses are nodes of a Redis Cluster
+	Password     string        // Password to authenticate with, empty if authentication is disabled
+	DB           int           // Database to select, must be 0 for a cluster
+	KeyPrefix    string        // Prefix of keys metrics are written to
+	DialTimeout  time.Duration // Timeout of connecting to Redis
+	WriteTimeout time.Duration // Timeout of writing commands to Redis
+	CounterTTL   time.Duration // Time to live of counter keys, 0 disables expiry
+	GaugeTTL     time.Duration // Time to live of gauge keys, 0 disables expiry
+	TimerTTL     time.Duration // Time to live of timer keys, 0 disables expiry
+	SetTTL       time.Duration // Time to live of set keys, 0 disables expiry
+	TimerSamples int           // Maximum number of samples kept per timer, 0 keeps all samples
+	BatchSize    int           // Maximum number of commands sent in one pipeline
+}
+
+// Client writes flushed metrics to Redis.
+//
+// Counters and gauges are written with HSET to <prefix>:counters:<name> and <prefix>:gauges:<name> hashes keyed
+// by the tags key. Timer samples are written with LPUSH to <prefix>:timers:<name>[:<tags key>] lists and values
+// of sets with SADD to <prefix>:sets:<name>[:<tags key>] sets.
+type Client struct {
+	client goredis.UniversalClient
+	config Config
+	sem    chan struct{} // Limits concurrent sends
+}
+
+// NewClientFromViper constructs a Redis backend from the redis section of the configuration.
+func NewClientFromViper(v *viper.Viper) (gostatsd.Backend, error) {
+	r := getSubViper(v, "redis")
+	r.SetDefault("addresses", []string{DefaultAddress})
+	r.SetDefault("cluster", false)
+	r.SetDefault("key_prefix", DefaultKeyPrefix)
+	r.SetDefault("dial_timeout", DefaultDialTimeout)
+	r.SetDefault("write_timeout", DefaultWriteTimeout)
+	r.SetDefault("counter_ttl", DefaultTTL)
+	r.SetDefault("gauge_ttl", DefaultTTL)
+	r.SetDefault("timer_ttl", DefaultTTL)
+	r.SetDefault("set_ttl", DefaultTTL)
+	r.SetDefault("timer_samples", DefaultTimerSamples)
+	r.SetDefault("batch_size", DefaultBatchSize)
+	return NewClient(Config{
+		Addresses:    r.GetStringSlice("addresses"),
+		Cluster:      r.GetBool("cluster"),
+		Password:     r.GetString("password"),
+		DB:           r.GetInt("db"),
+		KeyPrefix:    r.GetString("key_prefix"),
+		DialTimeout:  r.GetDuration("dial_timeout"),
+		WriteTimeout: r.GetDuration("write_timeout"),
+		CounterTTL:   r.GetDuration("counter_ttl"),
+		GaugeTTL:     r.GetDuration("gauge_ttl"),
+		TimerTTL:     r.GetDuration("timer_ttl"),
+		SetTTL:       r.GetDuration("set_ttl"),
+		TimerSamples: r.GetInt("timer_samples"),
+		BatchSize:    r.GetInt("batch_size"),
+	})
+}
+
+// NewClient constructs a Redis backend.
+func NewClient(config Config) (*Client, error) {
+	if len(config.Addresses) == 0 {
+		return nil, fmt.Errorf("[%s] address is required", BackendName)
+	}
+	if !config.Cluster && len(config.Addresses) > 1 {
+		return nil, fmt.Errorf("[%s] multiple addresses require cluster mode", BackendName)
+	}
+	if config.Cluster && config.DB != 0 {
+		return nil, fmt.Errorf("[%s] db must be 0 in cluster mode", BackendName)
+	}
+	if config.DialTimeout <= 0 {
+		return nil, fmt.Errorf("[%s] dialTimeout should be positive", BackendName)
+	}
+	if config.WriteTimeout < 0 {
+		return nil, fmt.Errorf("[%s] writeTimeout should be non-negative", BackendName)
+	}
+	if config.CounterTTL < 0 || config.GaugeTTL < 0 || config.TimerTTL < 0 || config.SetTTL < 0 {
+		return nil, fmt.Errorf("[%s] TTLs should be non-negative", BackendName)
+	}
+	if config.TimerSamples < 0 {
+		return nil, fmt.Errorf("[%s] timerSamples should be non-negative", BackendName)
+	}
+	if config.BatchSize <= 0 {
+		return nil, fmt.Errorf("[%s] batchSize should be positive", BackendName)
+	}
+	var client goredis.UniversalClient
+	if config.Cluster {
+		client = goredis.NewClusterClient(&goredis.ClusterOptions{
+			Addrs:        config.Addresses,
+			Password:     config.Password,
+			DialTimeout:  config.DialTimeout,
+			WriteTimeout: config.WriteTimeout,
+		})
+	} else {
+		client = goredis.NewClient(&goredis.Options{
+			Addr:         config.Addresses[0],
+			Password:     config.Password,
+			DB:           config.DB,
+			DialTimeout:  config.DialTimeout,
+			WriteTimeout: config.WriteTimeout,
+		})
+	}
+	log.Infof("[%s] addresses=%v cluster=%t keyPrefix=%s batchSize=%d", BackendName, config.Addresses, config.Cluster, config.KeyPrefix, config.BatchSize)
+	return &Client{
+		client: client,
+		config: config,
+		sem:    make(chan struct{}, maxConcurrentSends),
+	}, nil
+}
+
+// SendMetricsAsync writes the metrics to Redis, preparing pipelines synchronously but executing them asynchronously.
+func (c *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	if metrics.NumStats == 0 {
+		cb(nil)
+		return
+	}
+	pipes := c.preparePipelines(ctx, metrics)
+	select {
+	case <-ctx.Done():
+		cb([]error{ctx.Err()})
+		return
+	case c.sem <- struct{}{}:
+	}
+	go func() {
+		defer func() {
+			<-c.sem
+		}()
+		var errs []error
+		for _, pipe := range pipes {
+			if _, err := pipe.Exec(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("[%s] %v", BackendName, err))
+			}
+		}
+		cb(errs)
+	}()
+}
+
+// preparePipelines queues the commands writing the metrics into pipelines. A pipeline is started after BatchSize
+// commands, commands of a metric are queued to the same pipeline.
+func (c *Client) preparePipelines(ctx context.Context, metrics *gostatsd.MetricMap) []goredis.Pipeliner {
+	var pipes []goredis.Pipeliner
+	pipe := c.client.Pipeline()
+	queued := func(key string, ttl time.Duration) {
+		if ttl > 0 {
+			pipe.Expire(ctx, key, ttl)
+		}
+		if pipe.Len() >= c.config.BatchSize {
+			pipes = append(pipes, pipe)
+			pipe = c.client.Pipeline()
+		}
+	}
+
+	for name, counters := range metrics.Counters {
+		if len(counters) == 0 {
+			continue
+		}
+		key := c.hashKey("counters", name)
+		values := make([]interface{}, 0, 2*len(counters))
+		for tagsKey, counter := range counters {
+			values = append(values, tagsKey, counter.Value)
+		}
+		pipe.HSet(ctx, key, values...)
+		queued(key, c.config.CounterTTL)
+	}
+	for name, gauges := range metrics.Gauges {
+		if len(gauges) == 0 {
+			continue
+		}
+		key := c.hashKey("gauges", name)
+		values := make([]interface{}, 0, 2*len(gauges))
+		for tagsKey, gauge := range gauges {
+			values = append(values, tagsKey, gauge.Value)
+		}
+		pipe.HSet(ctx, key, values...)
+		queued(key, c.config.GaugeTTL)
+	}
+	metrics.Timers.Each(func(name, tagsKey string, timer gostatsd.Timer) {
+		if len(timer.Values) == 0 {
+			return
+		}
+		key := c.metricKey("timers", name, tagsKey)
+		values := make([]interface{}, len(timer.Values))
+		for i, value := range timer.Values {
+			values[i] = value
+		}
+		pipe.LPush(ctx, key, values...)
+		if c.config.TimerSamples > 0 {
+			pipe.LTrim(ctx, key, 0, int64(c.config.TimerSamples-1))
+		}
+		queued(key, c.config.TimerTTL)
+	})
+	metrics.Sets.Each(func(name, tagsKey string, set gostatsd.Set) {
+		if len(set.Values) == 0 {
+			return
+		}
+		key := c.metricKey("sets", name, tagsKey)
+		members := make([]interface{}, 0, len(set.Values))
+		for value := range set.Values {
+			members = append(members, value)
+		}
+		pipe.SAdd(ctx, key, members...)
+		queued(key, c.config.SetTTL)
+	})
+	if pipe.Len() > 0 {
+		pipes = append(pipes, pipe)
+	}
+	return pipes
+}
+
+// hashKey returns the key of the hash with values of the metric keyed by tags.
+func (c *Client) hashKey(metricType, name string) string {
+	return c.config.KeyPrefix + ":" + metricType + ":" + name
+}
+
+// metricKey returns the key of the metric with the tags.
+func (c *Client) metricKey(metricType, name, tagsKey string) string {
+	if tagsKey == "" {
+		return c.hashKey(metricType, name)
+	}
+	return c.hashKey(metricType, name) + ":" + tagsKey
+}
+
+// SendEvent discards events.
+func (c *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+// Name returns the name of the backend.
+func (c *Client) Name() string {
+	return BackendName
+}
+
+// Close closes connections to Redis.
+func (c *Client) Close() error {
+	return c.client.Close()
+}
+
+func getSubViper(v *viper.Viper, key string) *viper.Viper {
+	n := v.Sub(key)
+	if n == nil {
+		n = viper.New()
+	}
+	return n
+}
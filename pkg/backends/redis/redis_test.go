@@ -0,0 +1,173 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestClient(t *testing.T, s *miniredis.Miniredis, f func(*Config)) *Client {
+	config := Config{
+		Addresses:    []string{s.Addr()},
+		KeyPrefix:    "p",
+		DialTimeout:  time.Second,
+		WriteTimeout: time.Second,
+		CounterTTL:   time.Minute,
+		GaugeTTL:     2 * time.Minute,
+		TimerTTL:     3 * time.Minute,
+		SetTTL:       0,
+		TimerSamples: 3,
+		BatchSize:    DefaultBatchSize,
+	}
+	if f != nil {
+		f(&config)
+	}
+	c, err := NewClient(config)
+	require.NoError(t, err)
+	return c
+}
+
+func sendMetrics(t *testing.T, c *Client, m *gostatsd.MetricMap) {
+	errs := make(chan []error, 1)
+	c.SendMetricsAsync(context.Background(), m, func(e []error) {
+		errs <- e
+	})
+	select {
+	case e := <-errs:
+		assert.Empty(t, e)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the send")
+	}
+}
+
+func testMetrics() *gostatsd.MetricMap {
+	return &gostatsd.MetricMap{
+		MetricStats: gostatsd.MetricStats{NumStats: 10},
+		Counters: gostatsd.Counters{
+			"c": {
+				"":    gostatsd.NewCounter(1, 5, "", nil),
+				"a:b": gostatsd.NewCounter(1, 7, "", gostatsd.Tags{"a:b"}),
+			},
+		},
+		Timers: gostatsd.Timers{
+			"t": {"a:b": gostatsd.NewTimer(1, []float64{1, 2, 3, 4}, "", gostatsd.Tags{"a:b"})},
+		},
+		Gauges: gostatsd.Gauges{
+			"g": {"": gostatsd.NewGauge(1, 1.5, "", nil)},
+		},
+		Sets: gostatsd.Sets{
+			"s": {"": gostatsd.NewSet(1, map[string]struct{}{"x": {}, "y": {}}, "", nil)},
+		},
+	}
+}
+
+func TestSendMetrics(t *testing.T) {
+	t.Parallel()
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	c := newTestClient(t, s, nil)
+	defer c.Close()
+
+	sendMetrics(t, c, testMetrics())
+
+	assert.Equal(t, "5", s.HGet("p:counters:c", ""))
+	assert.Equal(t, "7", s.HGet("p:counters:c", "a:b"))
+	assert.Equal(t, "1.5", s.HGet("p:gauges:g", ""))
+	samples, err := s.List("p:timers:t:a:b")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"4", "3", "2"}, samples) // Trimmed to the latest 3 samples
+	members, err := s.Members("p:sets:s")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"x", "y"}, members)
+
+	assert.Equal(t, time.Minute, s.TTL("p:counters:c"))
+	assert.Equal(t, 2*time.Minute, s.TTL("p:gauges:g"))
+	assert.Equal(t, 3*time.Minute, s.TTL("p:timers:t:a:b"))
+	assert.Zero(t, s.TTL("p:sets:s"))
+}
+
+func TestSendMetricsBatches(t *testing.T) {
+	t.Parallel()
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	c := newTestClient(t, s, func(config *Config) {
+		config.BatchSize = 2
+	})
+	defer c.Close()
+
+	m := testMetrics()
+	pipes := c.preparePipelines(context.Background(), m)
+	assert.Len(t, pipes, 4) // Each metric has 2 or 3 commands
+	for _, pipe := range pipes {
+		pipe.Discard()
+	}
+
+	sendMetrics(t, c, m)
+	assert.Equal(t, "5", s.HGet("p:counters:c", ""))
+	assert.True(t, s.Exists("p:sets:s"))
+}
+
+func TestSendMetricsError(t *testing.T) {
+	t.Parallel()
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	c := newTestClient(t, s, nil)
+	defer c.Close()
+	s.Close()
+
+	errs := make(chan []error, 1)
+	c.SendMetricsAsync(context.Background(), testMetrics(), func(e []error) {
+		errs <- e
+	})
+	assert.NotEmpty(t, <-errs)
+}
+
+func TestNewClientInvalidConfig(t *testing.T) {
+	t.Parallel()
+	valid := Config{Addresses: []string{DefaultAddress}, DialTimeout: time.Second, BatchSize: 1}
+	tests := map[string]func(*Config){
+		"no address":          func(c *Config) { c.Addresses = nil },
+		"multiple addresses":  func(c *Config) { c.Addresses = []string{"a:1", "b:1"} },
+		"db in cluster":       func(c *Config) { c.Cluster = true; c.DB = 1 },
+		"negative ttl":        func(c *Config) { c.SetTTL = -time.Second },
+		"negative samples":    func(c *Config) { c.TimerSamples = -1 },
+		"zero batch size":     func(c *Config) { c.BatchSize = 0 },
+		"zero dial timeout":   func(c *Config) { c.DialTimeout = 0 },
+		"negative write time": func(c *Config) { c.WriteTimeout = -1 },
+	}
+	for name, f := range tests {
+		config := valid
+		f(&config)
+		_, err := NewClient(config)
+		assert.Error(t, err, name)
+	}
+	c, err := NewClient(valid)
+	require.NoError(t, err)
+	c.Close()
+}
+
+func TestNewClientFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("redis.addresses", []string{"a:1", "b:1"})
+	v.Set("redis.cluster", true)
+	v.Set("redis.timer_ttl", "1h")
+	backend, err := NewClientFromViper(v)
+	require.NoError(t, err)
+	c := backend.(*Client)
+	defer c.Close()
+	assert.Equal(t, []string{"a:1", "b:1"}, c.config.Addresses)
+	assert.Equal(t, time.Hour, c.config.TimerTTL)
+	assert.Equal(t, DefaultTTL, c.config.CounterTTL)
+	assert.Equal(t, DefaultKeyPrefix, c.config.KeyPrefix)
+	assert.Equal(t, DefaultBatchSize, c.config.BatchSize)
+}
@@ -0,0 +1,266 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	log "github.com/Sirupsen/logrus"
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"github.com/spf13/viper"
+)
+
+const (
+	// BackendName is the name of this backend.
+	BackendName = "sqlite"
+	// DefaultPath is the default path of the database file.
+	DefaultPath = "gostatsd.db"
+	// DefaultRetention is the default time rows are kept before they are pruned.
+	DefaultRetention = 24 * time.Hour
+	// DefaultPruneInterval is the default interval between prunings of rows older than the retention.
+	DefaultPruneInterval = 10 * time.Minute
+	// DefaultBusyTimeout is the default time a write waits for the database to be unlocked by other connections.
+	DefaultBusyTimeout = 5 * time.Second
+)
+
+// tables are the names of the tables of each metric type.
+var tables = []string{"counters", "gauges", "timers", "sets"}
+
+// schema creates the tables and their indexes. Tags are stored as JSON arrays and timestamps as Unix seconds.
+const schema = `
+CREATE TABLE IF NOT EXISTS counters (name TEXT NOT NULL, tags TEXT NOT NULL, host TEXT NOT NULL, value INTEGER NOT NULL, per_second REAL NOT NULL, timestamp INTEGER NOT NULL);
+CREATE TABLE IF NOT EXISTS gauges (name TEXT NOT NULL, tags TEXT NOT NULL, host TEXT NOT NULL, value REAL NOT NULL, timestamp INTEGER NOT NULL);
+CREATE TABLE IF NOT EXISTS timers (name TEXT NOT NULL, tags TEXT NOT NULL, host TEXT NOT NULL, value REAL NOT NULL, count INTEGER NOT NULL, min REAL NOT NULL, max REAL NOT NULL, timestamp INTEGER NOT NULL);
+CREATE TABLE IF NOT EXISTS sets (name TEXT NOT NULL, tags TEXT NOT NULL, host TEXT NOT NULL, value INTEGER NOT NULL, timestamp INTEGER NOT NULL);
+CREATE INDEX IF NOT EXISTS counters_name ON counters (name, timestamp);
+CREATE INDEX IF NOT EXISTS gauges_name ON gauges (name, timestamp);
+CREATE INDEX IF NOT EXISTS timers_name ON timers (name, timestamp);
+CREATE INDEX IF NOT EXISTS sets_name ON sets (name, timestamp);
+CREATE INDEX IF NOT EXISTS counters_timestamp ON counters (timestamp);
+CREATE INDEX IF NOT EXISTS gauges_timestamp ON gauges (timestamp);
+CREATE INDEX IF NOT EXISTS timers_timestamp ON timers (timestamp);
+CREATE INDEX IF NOT EXISTS sets_timestamp ON sets (timestamp);
+`
+
+// inserts are the statements inserting a row of each table.
+var inserts = map[string]string{
+	"counters": "INSERT INTO counters (name, tags, host, value, per_second, timestamp) VALUES (?, ?, ?, ?, ?, ?)",
+	"gauges":   "INSERT INTO gauges (name, tags, host, value, timestamp) VALUES (?, ?, ?, ?, ?)",
+	"timers":   "INSERT INTO timers (name, tags, host, value, count, min, max, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+	"sets":     "INSERT INTO sets (name, tags, host, value, timestamp) VALUES (?, ?, ?, ?, ?)",
+}
+
+// Config holds configuration for the SQLite backend.
+type Config struct {
+	Path          string        // Path of the database file, created if it does not exist
+	Retention     time.Duration // Time rows are kept, 0 keeps them forever
+	PruneInterval time.Duration // Interval between prunings of rows older than Retention
+	BusyTimeout   time.Duration // Time a write waits for the database to be unlocked
+}
+
+// Client inserts flushed metrics into a local SQLite database for troubleshooting with SQL, e.g.
+//
+//	SELECT datetime(timestamp, 'unixepoch'), value FROM gauges WHERE name = 'queue.depth' ORDER BY timestamp;
+//
+// Each flush is inserted in a transaction into a table per type: counters with their value and rate, gauges
+// with their value, timers with their mean as value and their count, min and max, and sets with their number
+// of values. The database uses write-ahead logging so that queries do not block flushes. A flush is dropped
+// with an error if the database stays locked by another connection for longer than BusyTimeout.
+type Client struct {
+	db     *sql.DB
+	config Config
+}
+
+// row is a row of a table.
+type row struct {
+	table string
+	args  []interface{}
+}
+
+// NewClientFromViper constructs a SQLite backend from the sqlite section of the configuration.
+func NewClientFromViper(v *viper.Viper) (gostatsd.Backend, error) {
+	s := getSubViper(v, "sqlite")
+	s.SetDefault("path", DefaultPath)
+	s.SetDefault("retention", DefaultRetention)
+	s.SetDefault("prune_interval", DefaultPruneInterval)
+	s.SetDefault("busy_timeout", DefaultBusyTimeout)
+	return NewClient(Config{
+		Path:          s.GetString("path"),
+		Retention:     s.GetDuration("retention"),
+		PruneInterval: s.GetDuration("prune_interval"),
+		BusyTimeout:   s.GetDuration("busy_timeout"),
+	})
+}
+
+// NewClient constructs a SQLite backend, opening the database and creating its tables.
+func NewClient(config Config) (*Client, error) {
+	if config.Path == "" {
+		return nil, fmt.Errorf("[%s] path is required", BackendName)
+	}
+	if config.Retention < 0 {
+		return nil, fmt.Errorf("[%s] retention should be non-negative", BackendName)
+	}
+	if config.Retention > 0 && config.PruneInterval <= 0 {
+		return nil, fmt.Errorf("[%s] pruneInterval should be positive", BackendName)
+	}
+	if config.BusyTimeout < 0 {
+		return nil, fmt.Errorf("[%s] busyTimeout should be non-negative", BackendName)
+	}
+	dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=%d", config.Path, config.BusyTimeout/time.Millisecond)
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] failed to open %s: %v", BackendName, config.Path, err)
+	}
+	// A single connection serializes flushes and prunings, which would otherwise lock each other out
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close() // #nosec
+		return nil, fmt.Errorf("[%s] failed to create tables in %s: %v", BackendName, config.Path, err)
+	}
+	log.Infof("[%s] path=%s retention=%v", BackendName, config.Path, config.Retention)
+	return &Client{
+		db:     db,
+		config: config,
+	}, nil
+}
+
+// Run prunes rows older than the retention every prune interval until the context is done.
+func (c *Client) Run(ctx context.Context) error {
+	if c.config.Retention == 0 {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	ticker := time.NewTicker(c.config.PruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			if err := c.prune(ctx, now); err != nil {
+				log.Warnf("[%s] Failed to prune rows, retrying in %v: %v", BackendName, c.config.PruneInterval, err)
+			}
+		}
+	}
+}
+
+// prune deletes rows older than the retention.
+func (c *Client) prune(ctx context.Context, now time.Time) error {
+	cutoff := now.Add(-c.config.Retention).Unix()
+	for _, table := range tables {
+		if _, err := c.db.ExecContext(ctx, "DELETE FROM "+table+" WHERE timestamp < ?", cutoff); err != nil {
+			return describeError(err)
+		}
+	}
+	return nil
+}
+
+// SendMetricsAsync inserts the metrics into the database, preparing rows synchronously but inserting them
+// asynchronously.
+func (c *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	if metrics.NumStats == 0 {
+		cb(nil)
+		return
+	}
+	rows := prepareRows(metrics, time.Now().Unix())
+	go func() {
+		if err := c.insert(ctx, rows); err != nil {
+			cb([]error{fmt.Errorf("[%s] failed to insert %d rows: %v", BackendName, len(rows), err)})
+			return
+		}
+		cb(nil)
+	}()
+}
+
+// prepareRows returns the rows of the metrics flushed at the timestamp.
+func prepareRows(metrics *gostatsd.MetricMap, timestamp int64) []row {
+	var rows []row
+	metrics.Counters.Each(func(name, tagsKey string, counter gostatsd.Counter) {
+		rows = append(rows, row{"counters", []interface{}{name, tagsJSON(counter.Tags), counter.Hostname, counter.Value, counter.PerSecond, timestamp}})
+	})
+	metrics.Gauges.Each(func(name, tagsKey string, gauge gostatsd.Gauge) {
+		rows = append(rows, row{"gauges", []interface{}{name, tagsJSON(gauge.Tags), gauge.Hostname, gauge.Value, timestamp}})
+	})
+	metrics.Timers.Each(func(name, tagsKey string, timer gostatsd.Timer) {
+		rows = append(rows, row{"timers", []interface{}{name, tagsJSON(timer.Tags), timer.Hostname, timer.Mean, timer.Count, timer.Min, timer.Max, timestamp}})
+	})
+	metrics.Sets.Each(func(name, tagsKey string, set gostatsd.Set) {
+		rows = append(rows, row{"sets", []interface{}{name, tagsJSON(set.Tags), set.Hostname, set.Cardinality(), timestamp}})
+	})
+	return rows
+}
+
+// insert inserts the rows in a transaction.
+func (c *Client) insert(ctx context.Context, rows []row) (retErr error) {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return describeError(err)
+	}
+	defer func() {
+		if retErr != nil {
+			tx.Rollback() // #nosec
+		}
+	}()
+	statements := make(map[string]*sql.Stmt, len(inserts))
+	for _, r := range rows {
+		stmt := statements[r.table]
+		if stmt == nil {
+			if stmt, err = tx.PrepareContext(ctx, inserts[r.table]); err != nil {
+				return describeError(err)
+			}
+			defer stmt.Close() // #nosec
+			statements[r.table] = stmt
+		}
+		if _, err := stmt.ExecContext(ctx, r.args...); err != nil {
+			return describeError(err)
+		}
+	}
+	return describeError(tx.Commit())
+}
+
+// describeError explains errors of a database locked by another connection.
+func describeError(err error) error {
+	if sqliteErr, ok := err.(sqlite3.Error); ok && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked) {
+		return fmt.Errorf("database is locked by another connection: %v", err)
+	}
+	return err
+}
+
+// tagsJSON returns the tags as a JSON array.
+func tagsJSON(tags gostatsd.Tags) string {
+	if len(tags) == 0 {
+		return "[]"
+	}
+	data, err := json.Marshal(tags)
+	if err != nil {
+		return "[]"
+	}
+	return string(data)
+}
+
+// SendEvent discards events.
+func (c *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+// Name returns the name of the backend.
+func (c *Client) Name() string {
+	return BackendName
+}
+
+// Close closes the database.
+func (c *Client) Close() error {
+	return c.db.Close()
+}
+
+func getSubViper(v *viper.Viper, key string) *viper.Viper {
+	n := v.Sub(key)
+	if n == nil {
+		n = viper.New()
+	}
+	return n
+}
@@ -0,0 +1,184 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestClient(t *testing.T) (*Client, func()) {
+	dir, err := ioutil.TempDir("", "gostatsd")
+	require.NoError(t, err)
+	c, err := NewClient(Config{
+		Path:          filepath.Join(dir, "metrics.db"),
+		Retention:     time.Hour,
+		PruneInterval: time.Minute,
+		BusyTimeout:   50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	return c, func() {
+		c.Close() // #nosec
+		os.RemoveAll(dir)
+	}
+}
+
+func sendMetrics(c *Client, m *gostatsd.MetricMap) []error {
+	errs := make(chan []error, 1)
+	c.SendMetricsAsync(context.Background(), m, func(e []error) {
+		errs <- e
+	})
+	select {
+	case e := <-errs:
+		return e
+	case <-time.After(5 * time.Second):
+		return []error{context.DeadlineExceeded}
+	}
+}
+
+func testMetrics() *gostatsd.MetricMap {
+	timer := gostatsd.NewTimer(1, []float64{1, 2, 3}, "", nil)
+	timer.Count, timer.Mean, timer.Min, timer.Max = 3, 2, 1, 3
+	return &gostatsd.MetricMap{
+		MetricStats: gostatsd.MetricStats{NumStats: 8},
+		Counters: gostatsd.Counters{
+			"c": {
+				"":    gostatsd.Counter{Value: 5, PerSecond: 0.5},
+				"a:b": gostatsd.Counter{Value: 7, PerSecond: 0.7, Hostname: "h", Tags: gostatsd.Tags{"a:b"}},
+			},
+		},
+		Gauges: gostatsd.Gauges{
+			"g": {"": gostatsd.NewGauge(1, 1.5, "", nil)},
+		},
+		Timers: gostatsd.Timers{
+			"t": {"": timer},
+		},
+		Sets: gostatsd.Sets{
+			"s": {"": gostatsd.NewSet(1, map[string]struct{}{"x": {}, "y": {}}, "", nil)},
+		},
+	}
+}
+
+func count(t *testing.T, c *Client, table string) int {
+	var n int
+	require.NoError(t, c.db.QueryRow("SELECT COUNT(*) FROM "+table).Scan(&n))
+	return n
+}
+
+func TestSendMetrics(t *testing.T) {
+	t.Parallel()
+	c, cleanup := newTestClient(t)
+	defer cleanup()
+	before := time.Now().Unix()
+	require.Empty(t, sendMetrics(c, testMetrics()))
+
+	rows, err := c.db.Query("SELECT name, tags, host, value, per_second, timestamp FROM counters ORDER BY value")
+	require.NoError(t, err)
+	defer rows.Close()
+	type counterRow struct {
+		name, tags, host string
+		value            int64
+		perSecond        float64
+	}
+	var counters []counterRow
+	for rows.Next() {
+		var r counterRow
+		var timestamp int64
+		require.NoError(t, rows.Scan(&r.name, &r.tags, &r.host, &r.value, &r.perSecond, &timestamp))
+		assert.True(t, timestamp >= before && timestamp <= time.Now().Unix())
+		counters = append(counters, r)
+	}
+	require.NoError(t, rows.Err())
+	assert.Equal(t, []counterRow{
+		{name: "c", tags: "[]", value: 5, perSecond: 0.5},
+		{name: "c", tags: `["a:b"]`, host: "h", value: 7, perSecond: 0.7},
+	}, counters)
+
+	var gauge float64
+	require.NoError(t, c.db.QueryRow("SELECT value FROM gauges WHERE name = 'g'").Scan(&gauge))
+	assert.Equal(t, 1.5, gauge)
+	var mean, min, max float64
+	var timerCount int
+	require.NoError(t, c.db.QueryRow("SELECT value, count, min, max FROM timers WHERE name = 't'").Scan(&mean, &timerCount, &min, &max))
+	assert.Equal(t, []float64{2, 1, 3}, []float64{mean, min, max})
+	assert.Equal(t, 3, timerCount)
+	var cardinality int
+	require.NoError(t, c.db.QueryRow("SELECT value FROM sets WHERE name = 's'").Scan(&cardinality))
+	assert.Equal(t, 2, cardinality)
+
+	// Empty flushes are not inserted
+	require.Empty(t, sendMetrics(c, &gostatsd.MetricMap{}))
+	assert.Equal(t, 2, count(t, c, "counters"))
+}
+
+func TestPrune(t *testing.T) {
+	t.Parallel()
+	c, cleanup := newTestClient(t)
+	defer cleanup()
+	require.Empty(t, sendMetrics(c, testMetrics()))
+
+	require.NoError(t, c.prune(context.Background(), time.Now()))
+	assert.Equal(t, 2, count(t, c, "counters"))
+	require.NoError(t, c.prune(context.Background(), time.Now().Add(2*time.Hour)))
+	for _, table := range tables {
+		assert.Equal(t, 0, count(t, c, table), table)
+	}
+}
+
+func TestSendMetricsLocked(t *testing.T) {
+	t.Parallel()
+	c, cleanup := newTestClient(t)
+	defer cleanup()
+	other, err := sql.Open("sqlite3", c.config.Path)
+	require.NoError(t, err)
+	defer other.Close()
+	conn, err := other.Conn(context.Background())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.ExecContext(context.Background(), "BEGIN EXCLUSIVE")
+	require.NoError(t, err)
+
+	errs := sendMetrics(c, testMetrics())
+	require.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "database is locked by another connection")
+
+	// The flush after the lock is released is inserted
+	_, err = conn.ExecContext(context.Background(), "ROLLBACK")
+	require.NoError(t, err)
+	assert.Empty(t, sendMetrics(c, testMetrics()))
+	assert.Equal(t, 2, count(t, c, "counters"))
+}
+
+func TestNewClientFromViper(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "gostatsd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	v := viper.New()
+	v.Set("sqlite.path", filepath.Join(dir, "metrics.db"))
+	v.Set("sqlite.retention", "2h")
+	b, err := NewClientFromViper(v)
+	require.NoError(t, err)
+	c := b.(*Client)
+	defer c.Close()
+	assert.Equal(t, Config{
+		Path:          filepath.Join(dir, "metrics.db"),
+		Retention:     2 * time.Hour,
+		PruneInterval: DefaultPruneInterval,
+		BusyTimeout:   DefaultBusyTimeout,
+	}, c.config)
+
+	_, err = NewClient(Config{Path: "x.db", Retention: -time.Hour})
+	assert.Error(t, err)
+	_, err = NewClient(Config{})
+	assert.Error(t, err)
+}
@@ -36,9 +36,11 @@ const (
 
 // Client is an object that is used to send messages to a statsd server's UDP or TCP interface.
 type Client struct {
-	packetSize  int
-	disableTags bool
-	sender      sender.Sender
+	packetSize      int
+	disableTags     bool
+	sender          sender.Sender
+	payloadObserver gostatsd.PayloadObserver
+	valuePrecision  int
 }
 
 // overflowHandler is invoked when accumulated packed size has reached it's limit.
@@ -66,6 +68,7 @@ func (client *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.Me
 	}
 	defer close(sink)
 	client.processMetrics(metrics, func(buf *bytes.Buffer) (*bytes.Buffer, bool) {
+		client.payloadObserver.Observe(buf.Len())
 		select {
 		case <-ctx.Done():
 			return nil, true
@@ -118,11 +121,15 @@ func (client *Client) processMetrics(metrics *gostatsd.MetricMap, handler overfl
 	})
 	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
 		for _, tr := range timer.Values {
-			writeLine("%s:%f|ms", key, tagsKey, tr)
+			writeLine("%s:%s|ms", key, tagsKey, gostatsd.FormatValue(tr, client.valuePrecision))
 		}
 	})
 	metrics.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
-		writeLine("%s:%f|g", key, tagsKey, gauge.Value)
+		if gauge.Value < 0 {
+			// A negative value is a delta, the gauge is reset first
+			writeLine("%s:%d|g", key, tagsKey, 0)
+		}
+		writeLine("%s:%s|g", key, tagsKey, gostatsd.FormatValue(gauge.Value, client.valuePrecision))
 	})
 	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
 		for k := range set.Values {
@@ -255,6 +262,16 @@ func NewClientFromViper(v *viper.Viper) (gostatsd.Backend, error) {
 	)
 }
 
+// SetValuePrecision sets the number of significant digits of float values.
+func (client *Client) SetValuePrecision(digits int) {
+	client.valuePrecision = digits
+}
+
+// SetPayloadObserver sets the observer notified with the size of each payload.
+func (client *Client) SetPayloadObserver(observer gostatsd.PayloadObserver) {
+	client.payloadObserver = observer
+}
+
 // Name returns the name of the backend.
 func (c *Client) Name() string {
 	return BackendName
@@ -92,3 +92,20 @@ func TestProcessMetrics(t *testing.T) {
 		})
 	}
 }
+
+func TestProcessMetricsNegativeGauge(t *testing.T) {
+	t.Parallel()
+	c, err := NewClient("localhost:8125", 1*time.Second, 1*time.Second, false, false)
+	require.NoError(t, err)
+	metrics := gostatsd.MetricMap{
+		Gauges: gostatsd.Gauges{
+			"g": map[string]gostatsd.Gauge{
+				"": gostatsd.NewGauge(0, -2, "", nil),
+			},
+		},
+	}
+	c.processMetrics(&metrics, func(buf *bytes.Buffer) (*bytes.Buffer, bool) {
+		assert.Equal(t, "g:0|g\ng:-2.000000|g\n", buf.String())
+		return new(bytes.Buffer), false
+	})
+}
@@ -17,7 +17,9 @@ import (
 const BackendName = "stdout"
 
 // Client is an object that is used to send messages to stdout.
-type Client struct{}
+type Client struct {
+	valuePrecision int
+}
 
 // NewClientFromViper constructs a stdout backend.
 func NewClientFromViper(v *viper.Viper) (gostatsd.Backend, error) {
@@ -29,6 +31,11 @@ func NewClient() (*Client, error) {
 	return &Client{}, nil
 }
 
+// SetValuePrecision sets the number of significant digits of float values.
+func (client *Client) SetValuePrecision(digits int) {
+	client.valuePrecision = digits
+}
+
 // composeMetricName adds the key and the tags to compose the metric name.
 func composeMetricName(key string, tagsKey string) string {
 	tags := strings.Split(tagsKey, ",")
@@ -47,7 +54,7 @@ func tagToMetricName(tag string) string {
 
 // SendMetricsAsync prints the metrics in a MetricsMap to the stdout, preparing payload synchronously but doing the send asynchronously.
 func (client Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
-	buf := preparePayload(metrics)
+	buf := preparePayload(metrics, client.valuePrecision)
 	go func() {
 		cb([]error{writePayload(buf)})
 	}()
@@ -64,36 +71,37 @@ func writePayload(buf *bytes.Buffer) (retErr error) {
 	return err
 }
 
-func preparePayload(metrics *gostatsd.MetricMap) *bytes.Buffer {
+// preparePayload formats the metrics with float values of the number of significant digits, see gostatsd.FormatValue.
+func preparePayload(metrics *gostatsd.MetricMap, digits int) *bytes.Buffer {
 	buf := new(bytes.Buffer)
 	now := time.Now().Unix()
 	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
 		nk := composeMetricName(key, tagsKey)
-		fmt.Fprintf(buf, "stats.counter.%s.count %d %d\n", nk, counter.Value, now)          // #nosec
-		fmt.Fprintf(buf, "stats.counter.%s.per_second %f %d\n", nk, counter.PerSecond, now) // #nosec
+		fmt.Fprintf(buf, "stats.counter.%s.count %d %d\n", nk, counter.Value, now)                                        // #nosec
+		fmt.Fprintf(buf, "stats.counter.%s.per_second %s %d\n", nk, gostatsd.FormatValue(counter.PerSecond, digits), now) // #nosec
 	})
 	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
 		nk := composeMetricName(key, tagsKey)
-		fmt.Fprintf(buf, "stats.timers.%s.lower %f %d\n", nk, timer.Min, now)              // #nosec
-		fmt.Fprintf(buf, "stats.timers.%s.upper %f %d\n", nk, timer.Max, now)              // #nosec
-		fmt.Fprintf(buf, "stats.timers.%s.count %d %d\n", nk, timer.Count, now)            // #nosec
-		fmt.Fprintf(buf, "stats.timers.%s.count_ps %f %d\n", nk, timer.PerSecond, now)     // #nosec
-		fmt.Fprintf(buf, "stats.timers.%s.mean %f %d\n", nk, timer.Mean, now)              // #nosec
-		fmt.Fprintf(buf, "stats.timers.%s.median %f %d\n", nk, timer.Median, now)          // #nosec
-		fmt.Fprintf(buf, "stats.timers.%s.std %f %d\n", nk, timer.StdDev, now)             // #nosec
-		fmt.Fprintf(buf, "stats.timers.%s.sum %f %d\n", nk, timer.Sum, now)                // #nosec
-		fmt.Fprintf(buf, "stats.timers.%s.sum_squares %f %d\n", nk, timer.SumSquares, now) // #nosec
+		fmt.Fprintf(buf, "stats.timers.%s.lower %s %d\n", nk, gostatsd.FormatValue(timer.Min, digits), now)              // #nosec
+		fmt.Fprintf(buf, "stats.timers.%s.upper %s %d\n", nk, gostatsd.FormatValue(timer.Max, digits), now)              // #nosec
+		fmt.Fprintf(buf, "stats.timers.%s.count %d %d\n", nk, timer.Count, now)                                          // #nosec
+		fmt.Fprintf(buf, "stats.timers.%s.count_ps %s %d\n", nk, gostatsd.FormatValue(timer.PerSecond, digits), now)     // #nosec
+		fmt.Fprintf(buf, "stats.timers.%s.mean %s %d\n", nk, gostatsd.FormatValue(timer.Mean, digits), now)              // #nosec
+		fmt.Fprintf(buf, "stats.timers.%s.median %s %d\n", nk, gostatsd.FormatValue(timer.Median, digits), now)          // #nosec
+		fmt.Fprintf(buf, "stats.timers.%s.std %s %d\n", nk, gostatsd.FormatValue(timer.StdDev, digits), now)             // #nosec
+		fmt.Fprintf(buf, "stats.timers.%s.sum %s %d\n", nk, gostatsd.FormatValue(timer.Sum, digits), now)                // #nosec
+		fmt.Fprintf(buf, "stats.timers.%s.sum_squares %s %d\n", nk, gostatsd.FormatValue(timer.SumSquares, digits), now) // #nosec
 		for _, pct := range timer.Percentiles {
-			fmt.Fprintf(buf, "stats.timers.%s.%s %f %d\n", nk, pct.Str, pct.Float, now) // #nosec
+			fmt.Fprintf(buf, "stats.timers.%s.%s %s %d\n", nk, pct.Str, gostatsd.FormatValue(pct.Float, digits), now) // #nosec
 		}
 	})
 	metrics.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
 		nk := composeMetricName(key, tagsKey)
-		fmt.Fprintf(buf, "stats.gauge.%s %f %d\n", nk, gauge.Value, now) // #nosec
+		fmt.Fprintf(buf, "stats.gauge.%s %s %d\n", nk, gostatsd.FormatValue(gauge.Value, digits), now) // #nosec
 	})
 	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
 		nk := composeMetricName(key, tagsKey)
-		fmt.Fprintf(buf, "stats.set.%s %d %d\n", nk, len(set.Values), now) // #nosec
+		fmt.Fprintf(buf, "stats.set.%s %d %d\n", nk, set.Cardinality(), now) // #nosec
 	})
 	return buf
 }
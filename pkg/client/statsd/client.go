@@ -0,0 +1,169 @@
+// Package statsd provides a client sending metrics to a statsd server over UDP. gostatsd uses it to send its own
+// internal metrics to itself, so that they go through the same tagging and routing pipeline as received metrics.
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/pflag"
+
+	"github.com/atlassian/gostatsd"
+)
+
+const (
+	// DefaultPoolSize is the default number of idle connections kept by the Client.
+	DefaultPoolSize = 4
+	// ParamAddr is the name of parameter with the address internal metrics are sent to.
+	ParamAddr = "internal-metrics-addr"
+	// ParamPoolSize is the name of parameter with the number of idle connections of the internal metrics client.
+	ParamPoolSize = "internal-metrics-pool-size"
+	// maxPacketSize is the maximum size of a packet, lines are split between packets.
+	maxPacketSize = 1472
+)
+
+// AddFlags adds flags to the specified FlagSet.
+func AddFlags(fs *pflag.FlagSet) {
+	fs.String(ParamAddr, "", "If set, UDP address internal metrics are sent to as statsd lines, e.g. the loopback address of the server so that they are processed like received metrics")
+	fs.Int(ParamPoolSize, DefaultPoolSize, "Number of idle connections kept by the internal metrics client")
+}
+
+// Client sends metrics to a statsd server as UDP packets of statsd lines. Connections are taken from a pool so
+// that concurrent sends do not share a socket. Safe for concurrent use.
+type Client struct {
+	addr  string
+	conns chan net.Conn // Idle connections
+
+	bufPool sync.Pool
+}
+
+// NewClient returns a Client sending metrics to the UDP address, keeping at most poolSize idle connections.
+func NewClient(addr string, poolSize int) (*Client, error) {
+	if addr == "" {
+		return nil, errors.New("statsd client address must not be empty")
+	}
+	if poolSize <= 0 {
+		return nil, errors.New("statsd client pool size must be positive")
+	}
+	c := &Client{
+		addr:  addr,
+		conns: make(chan net.Conn, poolSize),
+		bufPool: sync.Pool{
+			New: func() interface{} {
+				return new(bytes.Buffer)
+			},
+		},
+	}
+	// Fail early if the address cannot be resolved
+	conn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	c.put(conn)
+	return c, nil
+}
+
+// SendMetrics sends the metrics in as few packets as possible, sets are sent with their string value. Hostnames and source IPs are not sent, they are not part of the line
+// format, the server takes the source from the packets.
+func (c *Client) SendMetrics(ctx context.Context, metrics []gostatsd.Metric) error {
+	buf := c.bufPool.Get().(*bytes.Buffer)
+	defer c.bufPool.Put(buf)
+	buf.Reset()
+	conn, err := c.get()
+	if err != nil {
+		return err
+	}
+	defer c.put(conn)
+	line := c.bufPool.Get().(*bytes.Buffer)
+	defer c.bufPool.Put(line)
+	for i := range metrics {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		line.Reset()
+		writeLine(line, &metrics[i])
+		if buf.Len() > 0 && buf.Len()+line.Len() > maxPacketSize {
+			if _, err := conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		buf.Write(line.Bytes()) // #nosec
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
+
+// Close closes the idle connections.
+func (c *Client) Close() error {
+	for {
+		select {
+		case conn := <-c.conns:
+			conn.Close() // #nosec
+		default:
+			return nil
+		}
+	}
+}
+
+// get returns an idle connection or a new one.
+func (c *Client) get() (net.Conn, error) {
+	select {
+	case conn := <-c.conns:
+		return conn, nil
+	default:
+		return net.Dial("udp", c.addr)
+	}
+}
+
+// put returns the connection to the pool, or closes it if the pool is full.
+func (c *Client) put(conn net.Conn) {
+	select {
+	case c.conns <- conn:
+	default:
+		conn.Close() // #nosec
+	}
+}
+
+// writeLine writes the metric as <name>:<value>|<type>[|u:<unit>][|#<tags>].
+func writeLine(buf *bytes.Buffer, m *gostatsd.Metric) {
+	buf.WriteString(m.Name)
+	buf.WriteByte(':')
+	switch m.Type {
+	case gostatsd.COUNTER:
+		buf.WriteString(strconv.FormatFloat(m.Value, 'f', -1, 64))
+		buf.WriteString("|c")
+	case gostatsd.TIMER:
+		buf.WriteString(strconv.FormatFloat(m.Value, 'f', -1, 64))
+		buf.WriteString("|ms")
+	case gostatsd.GAUGE:
+		if m.Value < 0 {
+			// A signed value is a delta, the gauge is reset first
+			buf.WriteString("0|g\n")
+			buf.WriteString(m.Name)
+			buf.WriteByte(':')
+		}
+		buf.WriteString(strconv.FormatFloat(m.Value, 'f', -1, 64))
+		buf.WriteString("|g")
+	case gostatsd.SET:
+		buf.WriteString(m.StringValue)
+		buf.WriteString("|s")
+	}
+	if m.Unit != "" {
+		buf.WriteString("|u:")
+		buf.WriteString(m.Unit)
+	}
+	if len(m.Tags) > 0 {
+		buf.WriteString("|#")
+		buf.WriteString(strings.Join(m.Tags, ","))
+	}
+	buf.WriteByte('\n')
+}
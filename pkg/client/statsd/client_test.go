@@ -0,0 +1,76 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func TestWriteLine(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		metric   gostatsd.Metric
+		expected string
+	}{
+		{gostatsd.Metric{Name: "c", Value: 3, Type: gostatsd.COUNTER}, "c:3|c\n"},
+		{gostatsd.Metric{Name: "t", Value: 1.5, Type: gostatsd.TIMER, Unit: "ms"}, "t:1.5|ms|u:ms\n"},
+		{gostatsd.Metric{Name: "g", Value: 42, Type: gostatsd.GAUGE, Tags: gostatsd.Tags{"a:b", "c"}}, "g:42|g|#a:b,c\n"},
+		{gostatsd.Metric{Name: "g", Value: -2, Type: gostatsd.GAUGE}, "g:0|g\ng:-2|g\n"},
+		{gostatsd.Metric{Name: "s", StringValue: "joe", Type: gostatsd.SET}, "s:joe|s\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		writeLine(&buf, &test.metric)
+		assert.Equal(t, test.expected, buf.String())
+	}
+}
+
+func TestClientSendMetrics(t *testing.T) {
+	t.Parallel()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	c, err := NewClient(pc.LocalAddr().String(), 2)
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Enough metrics to be split into several packets
+	metrics := make([]gostatsd.Metric, 200)
+	for i := range metrics {
+		metrics[i] = gostatsd.Metric{Name: "statsd.metric." + strconv.Itoa(i), Value: float64(i), Type: gostatsd.COUNTER}
+	}
+	require.NoError(t, c.SendMetrics(context.Background(), metrics))
+
+	var lines []string
+	packets := 0
+	buf := make([]byte, 65536)
+	for len(lines) < len(metrics) {
+		require.NoError(t, pc.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, _, err := pc.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.True(t, n <= maxPacketSize, "packet of %d bytes", n)
+		lines = append(lines, strings.Split(strings.TrimSuffix(string(buf[:n]), "\n"), "\n")...)
+		packets++
+	}
+	assert.True(t, packets > 1)
+	for i, line := range lines {
+		assert.Equal(t, "statsd.metric."+strconv.Itoa(i)+":"+strconv.Itoa(i)+"|c", line)
+	}
+}
+
+func TestNewClientInvalid(t *testing.T) {
+	t.Parallel()
+	_, err := NewClient("", DefaultPoolSize)
+	assert.Error(t, err)
+	_, err = NewClient("127.0.0.1:8125", 0)
+	assert.Error(t, err)
+}
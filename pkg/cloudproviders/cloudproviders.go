@@ -1,7 +1,10 @@
 package cloudproviders
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/cloudproviders/aws"
@@ -10,16 +13,98 @@ import (
 	"github.com/spf13/viper"
 )
 
+// providersLock protects providers.
+var providersLock sync.RWMutex
+
 // All registered cloud providers.
 var providers = map[string]gostatsd.CloudProviderFactory{
 	aws.ProviderName: aws.NewProviderFromViper,
 }
 
+// RegisterCloudProvider makes a cloud provider available by the provided name.
+// It allows plugging in custom source IP to instance resolvers without modifying this package.
+// Lookup results are cached by the statsd.CloudHandler so providers do not need to implement caching.
+// Use RegisterTagsResolver if only tags are needed.
+// An error is returned if the name is empty, factory is nil or a provider with the same name is already registered.
+func RegisterCloudProvider(name string, factory gostatsd.CloudProviderFactory) error {
+	if name == "" {
+		return errors.New("cloud provider name is required")
+	}
+	if factory == nil {
+		return fmt.Errorf("cloud provider factory for %q is nil", name)
+	}
+	providersLock.Lock()
+	defer providersLock.Unlock()
+	if _, found := providers[name]; found {
+		return fmt.Errorf("cloud provider %q is already registered", name)
+	}
+	providers[name] = factory
+	return nil
+}
+
+// RegisterTagsResolver makes a tags resolver available as a cloud provider by the provided name.
+// See RegisterCloudProvider for details.
+func RegisterTagsResolver(name string, factory gostatsd.TagsResolverFactory) error {
+	if factory == nil {
+		return fmt.Errorf("tags resolver factory for %q is nil", name)
+	}
+	return RegisterCloudProvider(name, func(v *viper.Viper) (gostatsd.CloudProvider, error) {
+		resolver, err := factory(v)
+		if err != nil {
+			return nil, err
+		}
+		return NewTagsResolverProvider(resolver), nil
+	})
+}
+
+// unregisterCloudProvider removes the named provider. Useful for testing.
+func unregisterCloudProvider(name string) {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+	delete(providers, name)
+}
+
+// tagsResolverProvider adapts a TagsResolver to the CloudProvider interface.
+type tagsResolverProvider struct {
+	resolver gostatsd.TagsResolver
+}
+
+// NewTagsResolverProvider returns a CloudProvider that uses the TagsResolver to look up tags.
+// Instances returned by the provider only have tags set so hostnames of metrics and events are not changed.
+func NewTagsResolverProvider(resolver gostatsd.TagsResolver) gostatsd.CloudProvider {
+	return &tagsResolverProvider{
+		resolver: resolver,
+	}
+}
+
+// Name returns the name of the tags resolver.
+func (p *tagsResolverProvider) Name() string {
+	return p.resolver.Name()
+}
+
+// Instance returns an instance with the tags of the source IP.
+func (p *tagsResolverProvider) Instance(ctx context.Context, ip gostatsd.IP) (*gostatsd.Instance, error) {
+	tags, err := p.resolver.Tags(ctx, ip)
+	if err != nil {
+		return nil, err
+	}
+	return &gostatsd.Instance{
+		Tags: tags,
+	}, nil
+}
+
+// SelfIP returns gostatsd.UnknownIP because tags resolvers do not know the host's address.
+func (p *tagsResolverProvider) SelfIP() (gostatsd.IP, error) {
+	return gostatsd.UnknownIP, nil
+}
+
 // Get creates an instance of the named provider, or nil if
 // the name is not known.  The error return is only used if the named provider
 // was known but failed to initialize.
 func Get(name string, v *viper.Viper) (gostatsd.CloudProvider, error) {
+	providersLock.RLock()
 	f, found := providers[name]
+	providersLock.RUnlock()
 	if !found {
 		return nil, nil
 	}
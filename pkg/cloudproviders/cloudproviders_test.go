@@ -0,0 +1,59 @@
+package cloudproviders
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const stubResolverName = "stub"
+
+type stubResolver struct{}
+
+func (sr *stubResolver) Name() string {
+	return stubResolverName
+}
+
+func (sr *stubResolver) Tags(ctx context.Context, ip gostatsd.IP) (gostatsd.Tags, error) {
+	if ip == "1.2.3.4" {
+		return gostatsd.Tags{"team:stub"}, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func newStubResolver(v *viper.Viper) (gostatsd.TagsResolver, error) {
+	return &stubResolver{}, nil
+}
+
+func TestRegisterCloudProvider(t *testing.T) {
+	defer unregisterCloudProvider(stubResolverName)
+	require.NoError(t, RegisterTagsResolver(stubResolverName, newStubResolver))
+
+	assert.EqualError(t, RegisterTagsResolver(stubResolverName, newStubResolver), `cloud provider "stub" is already registered`)
+	assert.Error(t, RegisterTagsResolver("", newStubResolver))
+	assert.Error(t, RegisterTagsResolver("nil-factory", nil))
+	assert.Error(t, RegisterCloudProvider("nil-factory", nil))
+
+	provider, err := Init(stubResolverName, viper.New())
+	require.NoError(t, err)
+	require.NotNil(t, provider)
+	assert.Equal(t, stubResolverName, provider.Name())
+
+	instance, err := provider.Instance(context.Background(), "1.2.3.4")
+	require.NoError(t, err)
+	assert.Equal(t, &gostatsd.Instance{Tags: gostatsd.Tags{"team:stub"}}, instance)
+
+	_, err = provider.Instance(context.Background(), "4.3.2.1")
+	assert.Error(t, err)
+}
+
+func TestInitUnknownCloudProvider(t *testing.T) {
+	_, err := Init(stubResolverName+"-unknown", viper.New())
+	assert.EqualError(t, err, `unknown cloud provider "stub-unknown"`)
+}
@@ -0,0 +1,410 @@
+// Package cluster shards the aggregation of metrics between gostatsd servers so that servers can be added to
+// scale horizontally, e.g. behind a load balancer spreading metrics of the same names between them.
+//
+// Servers discover each other with the gossip protocol of memberlist. Each metric name is owned by one server,
+// chosen by consistent hashing of the name over the servers. On each flush, a server sends the metrics of names it
+// does not own to their owners, then waits for the metrics shared by the other servers and merges them before
+// flushing the metrics it owns.
+package cluster
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/memberlist"
+	"github.com/spf13/pflag"
+
+	"github.com/atlassian/gostatsd"
+)
+
+const (
+	// DefaultBindPort is the default port of the gossip protocol.
+	DefaultBindPort = 7946
+	// ParamBindAddr is the name of parameter with the address the gossip protocol listens on.
+	ParamBindAddr = "cluster-bind-addr"
+	// ParamBindPort is the name of parameter with the port the gossip protocol listens on.
+	ParamBindPort = "cluster-bind-port"
+	// ParamJoin is the name of parameter with the addresses of servers of the cluster to join.
+	ParamJoin = "cluster-join"
+	// ParamNodeName is the name of parameter with the name of the server in the cluster.
+	ParamNodeName = "cluster-node-name"
+	// ParamSecretKey is the name of parameter with the base64 encoded key encrypting the gossip protocol.
+	ParamSecretKey = "cluster-secret-key"
+)
+
+// leaveTimeout is the time to wait for other servers to be notified that the server leaves the cluster.
+const leaveTimeout = 5 * time.Second
+
+// AddFlags adds flags to the specified FlagSet.
+func AddFlags(fs *pflag.FlagSet) {
+	fs.String(ParamBindAddr, "", "If set, address the gossip protocol listens on, enabling the cluster mode sharding the aggregation of metrics between servers")
+	fs.Int(ParamBindPort, DefaultBindPort, "Port the gossip protocol listens on")
+	fs.String(ParamJoin, "", "Comma-separated list of addresses of servers of the cluster to join, as host:port")
+	fs.String(ParamNodeName, "", "Unique name of the server in the cluster, defaults to the hostname")
+	fs.String(ParamSecretKey, "", "Base64 encoded key of 16, 24 or 32 bytes encrypting the gossip protocol, unencrypted if empty")
+}
+
+// ParseSecretKey decodes the base64 encoded key encrypting the gossip protocol, nil if empty.
+func ParseSecretKey(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cluster secret key: %v", err)
+	}
+	if err := memberlist.ValidateKey(key); err != nil {
+		return nil, fmt.Errorf("invalid cluster secret key: %v", err)
+	}
+	return key, nil
+}
+
+// Cluster shards the aggregation of metrics between the servers of the cluster by metric name.
+type Cluster struct {
+	ml      *memberlist.Memberlist
+	name    string
+	arrived chan struct{} // Signalled when a message is received
+
+	mu      sync.RWMutex // Protects fields below
+	nodes   map[string]*memberlist.Node
+	ring    *ring
+	pending map[string][][]byte // Messages not merged yet by the name of the server that sent them
+}
+
+// NewCluster initialises a new Cluster listening on the address and port, and joins the servers at the
+// addresses. The name must be unique among servers of the cluster, the hostname is used if empty. The gossip
+// protocol is encrypted with the secret key if not empty, all servers of the cluster must use the same key.
+func NewCluster(bindAddr string, bindPort int, name string, join []string, secretKey []byte) (*Cluster, error) {
+	if bindAddr == "" {
+		return nil, errors.New("cluster bind address must not be empty")
+	}
+	c := &Cluster{
+		arrived: make(chan struct{}, 1),
+		nodes:   make(map[string]*memberlist.Node),
+		ring:    newRing(nil),
+		pending: make(map[string][][]byte),
+	}
+	conf := memberlist.DefaultLANConfig()
+	conf.BindAddr = bindAddr
+	conf.BindPort = bindPort
+	if name != "" {
+		conf.Name = name
+	}
+	if len(secretKey) > 0 {
+		conf.SecretKey = secretKey
+	}
+	conf.Delegate = c
+	conf.Events = c
+	conf.LogOutput = logWriter{}
+	ml, err := memberlist.Create(conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start gossip: %v", err)
+	}
+	c.ml = ml
+	c.name = ml.LocalNode().Name
+	if len(join) > 0 {
+		n, err := ml.Join(join)
+		if err != nil {
+			ml.Shutdown() // #nosec
+			return nil, fmt.Errorf("failed to join cluster: %v", err)
+		}
+		log.Infof("Joined cluster of %d servers as %s", n+1, c.name)
+	}
+	return c, nil
+}
+
+// Name returns the name of the server in the cluster.
+func (c *Cluster) Name() string {
+	return c.name
+}
+
+// Port returns the port the gossip protocol listens on.
+func (c *Cluster) Port() int {
+	return int(c.ml.LocalNode().Port)
+}
+
+// Owns returns whether the server owns metrics with the name. A server owns all names until it knows the servers
+// of the cluster.
+func (c *Cluster) Owns(name string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	owner := c.ring.owner(name)
+	return owner == "" || owner == c.name
+}
+
+// Share sends the metrics to the servers owning their names, and an empty message to the other servers so that
+// they know that all metrics shared by this server for the flush have been sent. Metrics of names owned by the
+// server after the cluster changed are merged by the server with the next Gather. It returns the number of metrics
+// that could not be sent and were dropped.
+func (c *Cluster) Share(ctx context.Context, m *gostatsd.MetricMap) int {
+	byOwner := make(map[string]*gostatsd.MetricMap)
+	get := func(owner string) *gostatsd.MetricMap {
+		om := byOwner[owner]
+		if om == nil {
+			om = &gostatsd.MetricMap{
+				FlushInterval: m.FlushInterval,
+				Counters:      gostatsd.Counters{},
+				Timers:        gostatsd.Timers{},
+				Gauges:        gostatsd.Gauges{},
+				Sets:          gostatsd.Sets{},
+			}
+			byOwner[owner] = om
+		}
+		return om
+	}
+	c.mu.RLock()
+	split := func(name string) *gostatsd.MetricMap {
+		owner := c.ring.owner(name)
+		if owner == "" {
+			owner = c.name
+		}
+		return get(owner)
+	}
+	for name, v := range m.Counters {
+		split(name).Counters[name] = v
+	}
+	for name, v := range m.Timers {
+		split(name).Timers[name] = v
+	}
+	for name, v := range m.Gauges {
+		split(name).Gauges[name] = v
+	}
+	for name, v := range m.Sets {
+		split(name).Sets[name] = v
+	}
+	nodes := make(map[string]*memberlist.Node, len(c.nodes))
+	for owner, node := range c.nodes {
+		nodes[owner] = node
+		if owner != c.name {
+			get(owner) // Empty message to servers not owning any of the metrics
+		}
+	}
+	c.mu.RUnlock()
+
+	dropped := 0
+	for owner, om := range byOwner {
+		if ctx.Err() != nil {
+			return dropped + numMetrics(om)
+		}
+		data, err := om.MarshalMsgpack()
+		if err != nil {
+			log.Warnf("Failed to encode metrics shared with %s: %v", owner, err)
+			dropped += numMetrics(om)
+			continue
+		}
+		if owner == c.name {
+			c.receive(c.name, data)
+			continue
+		}
+		node := nodes[owner]
+		if node == nil {
+			log.Warnf("Failed to share metrics with %s: server left the cluster", owner)
+			dropped += numMetrics(om)
+			continue
+		}
+		if err := c.ml.SendReliable(node, encodeMessage(c.name, data)); err != nil {
+			log.Warnf("Failed to share metrics with %s: %v", owner, err)
+			dropped += numMetrics(om)
+		}
+	}
+	return dropped
+}
+
+// Gather waits until every other server of the cluster has shared its metrics since the previous call, or until
+// the timeout, and returns the metrics shared with this server. It does not wait if the timeout is 0. Metrics shared
+// after the timeout are returned by the next call.
+func (c *Cluster) Gather(ctx context.Context, timeout time.Duration) []*gostatsd.MetricMap {
+	if timeout > 0 {
+		c.wait(ctx, timeout)
+	}
+
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = make(map[string][][]byte, len(pending))
+	c.mu.Unlock()
+
+	var maps []*gostatsd.MetricMap
+	for from, msgs := range pending {
+		for _, data := range msgs {
+			m := &gostatsd.MetricMap{}
+			if err := m.UnmarshalMsgpack(data); err != nil {
+				log.Warnf("Failed to decode metrics shared by %s: %v", from, err)
+				continue
+			}
+			maps = append(maps, m)
+		}
+	}
+	return maps
+}
+
+// wait waits until every other server of the cluster has shared its metrics since the last Gather, at most for
+// the timeout.
+func (c *Cluster) wait(ctx context.Context, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		missing := c.notShared()
+		if len(missing) == 0 {
+			return
+		}
+		select {
+		case <-c.arrived:
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			log.Warnf("Flushing before %s shared metrics, they are merged with the next flush", strings.Join(missing, ", "))
+			return
+		}
+	}
+}
+
+// Run waits until the context is done, then leaves the cluster.
+func (c *Cluster) Run(ctx context.Context) error {
+	<-ctx.Done()
+	if err := c.ml.Leave(leaveTimeout); err != nil {
+		log.Warnf("Failed to leave cluster: %v", err)
+	}
+	c.ml.Shutdown() // #nosec
+	return ctx.Err()
+}
+
+// notShared returns the names of the other servers of the cluster that have not shared metrics since the last
+// Gather.
+func (c *Cluster) notShared() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var names []string
+	for name := range c.nodes {
+		if name != c.name && len(c.pending[name]) == 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// receive queues the message sent by the server to be merged by Gather.
+func (c *Cluster) receive(from string, data []byte) {
+	c.mu.Lock()
+	c.pending[from] = append(c.pending[from], data)
+	c.mu.Unlock()
+	select {
+	case c.arrived <- struct{}{}:
+	default:
+	}
+}
+
+// updateRing rebuilds the ring from the nodes. Must be called with mu held.
+func (c *Cluster) updateRing() {
+	names := make([]string, 0, len(c.nodes))
+	for name := range c.nodes {
+		names = append(names, name)
+	}
+	c.ring = newRing(names)
+}
+
+// NodeMeta implements memberlist.Delegate.
+func (c *Cluster) NodeMeta(limit int) []byte {
+	return nil
+}
+
+// NotifyMsg implements memberlist.Delegate.
+func (c *Cluster) NotifyMsg(b []byte) {
+	from, data, err := decodeMessage(b)
+	if err != nil {
+		log.Warnf("Failed to decode message of the cluster: %v", err)
+		return
+	}
+	// The buffer is only valid during the call
+	c.receive(from, append([]byte(nil), data...))
+}
+
+// GetBroadcasts implements memberlist.Delegate.
+func (c *Cluster) GetBroadcasts(overhead, limit int) [][]byte {
+	return nil
+}
+
+// LocalState implements memberlist.Delegate.
+func (c *Cluster) LocalState(join bool) []byte {
+	return nil
+}
+
+// MergeRemoteState implements memberlist.Delegate.
+func (c *Cluster) MergeRemoteState(buf []byte, join bool) {
+}
+
+// NotifyJoin implements memberlist.EventDelegate.
+func (c *Cluster) NotifyJoin(node *memberlist.Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nodes[node.Name] = node
+	c.updateRing()
+	log.Infof("Server %s joined the cluster of %d servers", node.Name, len(c.nodes))
+}
+
+// NotifyLeave implements memberlist.EventDelegate.
+func (c *Cluster) NotifyLeave(node *memberlist.Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.nodes, node.Name)
+	c.updateRing()
+	log.Infof("Server %s left the cluster of %d servers", node.Name, len(c.nodes))
+}
+
+// NotifyUpdate implements memberlist.EventDelegate.
+func (c *Cluster) NotifyUpdate(node *memberlist.Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nodes[node.Name] = node
+}
+
+// encodeMessage prefixes the data with the length and the name of the server sending it.
+func encodeMessage(from string, data []byte) []byte {
+	b := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(from)+len(data))
+	n := binary.PutUvarint(b, uint64(len(from)))
+	b = append(append(b[:n], from...), data...)
+	return b
+}
+
+// decodeMessage returns the name of the server that sent the message and its data.
+func decodeMessage(b []byte) (string, []byte, error) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < l {
+		return "", nil, errors.New("truncated message")
+	}
+	return string(b[n : n+int(l)]), b[n+int(l):], nil
+}
+
+// numMetrics returns the number of metrics in the MetricMap, counting each name and tags once.
+func numMetrics(m *gostatsd.MetricMap) int {
+	n := 0
+	for _, v := range m.Counters {
+		n += len(v)
+	}
+	for _, v := range m.Timers {
+		n += len(v)
+	}
+	for _, v := range m.Gauges {
+		n += len(v)
+	}
+	for _, v := range m.Sets {
+		n += len(v)
+	}
+	return n
+}
+
+// logWriter logs messages of memberlist at debug level.
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	log.Debug(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
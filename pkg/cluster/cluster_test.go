@@ -0,0 +1,153 @@
+package cluster
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func newTestCluster(t *testing.T, name string, secretKey []byte, join ...string) *Cluster {
+	c, err := NewCluster("127.0.0.1", 0, name, join, secretKey)
+	require.NoError(t, err)
+	return c
+}
+
+// waitForRing waits until exactly one of the servers owns each name.
+func waitForRing(t *testing.T, a, b *Cluster) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		converged := true
+		for i := 0; i < 100; i++ {
+			name := "metric." + strconv.Itoa(i)
+			converged = converged && a.Owns(name) != b.Owns(name)
+		}
+		if converged {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("servers did not join")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClusterShare(t *testing.T) {
+	t.Parallel()
+	testClusterShare(t, nil)
+}
+
+func TestClusterShareEncrypted(t *testing.T) {
+	t.Parallel()
+	key, err := ParseSecretKey("c2VjcmV0IGtleSBvZiAzMiBieXRlcyBvZiBsZW5ndGg=")
+	require.NoError(t, err)
+	testClusterShare(t, key)
+}
+
+func testClusterShare(t *testing.T, secretKey []byte) {
+	a := newTestCluster(t, "a", secretKey)
+	b := newTestCluster(t, "b", secretKey, "127.0.0.1:"+strconv.Itoa(a.Port()))
+	waitForRing(t, a, b)
+
+	// Names owned by each server
+	var ownedByA, ownedByB string
+	for i := 0; ownedByA == "" || ownedByB == ""; i++ {
+		name := "metric." + strconv.Itoa(i)
+		if a.Owns(name) {
+			ownedByA = name
+		} else {
+			ownedByB = name
+		}
+		assert.NotEqual(t, a.Owns(name), b.Owns(name))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx) // #nosec
+	go b.Run(ctx) // #nosec
+
+	assert.Zero(t, a.Share(ctx, &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{
+			ownedByB: {"": gostatsd.Counter{Value: 5, Tags: gostatsd.Tags{"a:b"}}},
+		},
+		Sets: gostatsd.Sets{
+			ownedByA: {"": gostatsd.Set{Values: map[string]struct{}{"joe": {}}}},
+		},
+	}))
+	assert.Zero(t, b.Share(ctx, &gostatsd.MetricMap{}))
+
+	// Each server waits for the other one
+	received := make(map[string]bool)
+	for _, m := range append(a.Gather(ctx, 5*time.Second), b.Gather(ctx, 5*time.Second)...) {
+		m.Counters.Each(func(key, tagsKey string, c gostatsd.Counter) {
+			assert.Equal(t, ownedByB, key)
+			assert.EqualValues(t, 5, c.Value)
+			assert.Equal(t, gostatsd.Tags{"a:b"}, c.Tags)
+			received[key] = true
+		})
+		m.Sets.Each(func(key, tagsKey string, s gostatsd.Set) {
+			// Merged by the server itself
+			assert.Equal(t, ownedByA, key)
+			received[key] = true
+		})
+	}
+	assert.Len(t, received, 2)
+}
+
+func TestClusterGatherTimeout(t *testing.T) {
+	t.Parallel()
+	a := newTestCluster(t, "a", nil)
+	b := newTestCluster(t, "b", nil, "127.0.0.1:"+strconv.Itoa(a.Port()))
+	waitForRing(t, a, b)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx) // #nosec
+	go b.Run(ctx) // #nosec
+
+	// b has not shared its metrics
+	start := time.Now()
+	assert.Empty(t, a.Gather(ctx, 100*time.Millisecond))
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+
+	// Not waiting
+	start = time.Now()
+	assert.Empty(t, a.Gather(ctx, 0))
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+}
+
+func TestParseSecretKey(t *testing.T) {
+	t.Parallel()
+	key, err := ParseSecretKey("")
+	require.NoError(t, err)
+	assert.Nil(t, key)
+	key, err = ParseSecretKey("MDEyMzQ1Njc4OWFiY2RlZg==")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("0123456789abcdef"), key)
+	_, err = ParseSecretKey("not base64")
+	assert.Error(t, err)
+	_, err = ParseSecretKey("c2hvcnQ=") // Too short
+	assert.Error(t, err)
+}
+
+func TestMessageEncoding(t *testing.T) {
+	t.Parallel()
+	from, data, err := decodeMessage(encodeMessage("server", []byte("data")))
+	require.NoError(t, err)
+	assert.Equal(t, "server", from)
+	assert.Equal(t, []byte("data"), data)
+	_, _, err = decodeMessage([]byte{10, 's'})
+	assert.Error(t, err)
+	_, _, err = decodeMessage(nil)
+	assert.Error(t, err)
+}
+
+func TestNewClusterRequiresBindAddr(t *testing.T) {
+	t.Parallel()
+	_, err := NewCluster("", DefaultBindPort, "", nil, nil)
+	assert.Error(t, err)
+}
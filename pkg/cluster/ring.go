@@ -0,0 +1,72 @@
+package cluster
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// virtualNodes is the number of points of each node on the ring, so that names are spread evenly between nodes
+// and only about 1/n of the names move to another node when a node joins or leaves.
+const virtualNodes = 128
+
+// ring is a consistent hash ring of node names. A name is owned by the node of the first point clockwise from
+// the hash of the name.
+type ring struct {
+	points []ringPoint // Sorted by hash
+}
+
+type ringPoint struct {
+	hash uint32
+	node string
+}
+
+// newRing initialises a ring of the nodes.
+func newRing(nodes []string) *ring {
+	r := &ring{points: make([]ringPoint, 0, len(nodes)*virtualNodes)}
+	for _, node := range nodes {
+		for i := 0; i < virtualNodes; i++ {
+			r.points = append(r.points, ringPoint{hash: hashName(node + "#" + strconv.Itoa(i)), node: node})
+		}
+	}
+	sort.Sort(ringPoints(r.points))
+	return r
+}
+
+// owner returns the node owning the name, empty if the ring has no nodes.
+func (r *ring) owner(name string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hashName(name)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
+
+func hashName(name string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(name)) // #nosec
+	return h.Sum32()
+}
+
+type ringPoints []ringPoint
+
+func (p ringPoints) Len() int {
+	return len(p)
+}
+
+func (p ringPoints) Less(i, j int) bool {
+	if p[i].hash == p[j].hash {
+		return p[i].node < p[j].node // Same owner on every node
+	}
+	return p[i].hash < p[j].hash
+}
+
+func (p ringPoints) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+}
@@ -0,0 +1,42 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingEmpty(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "", newRing(nil).owner("foo"))
+}
+
+func TestRingSpreadsNames(t *testing.T) {
+	t.Parallel()
+	r := newRing([]string{"a", "b", "c"})
+	counts := make(map[string]int)
+	for i := 0; i < 30000; i++ {
+		counts[r.owner("metric."+strconv.Itoa(i))]++
+	}
+	assert.Len(t, counts, 3)
+	for node, count := range counts {
+		assert.InDelta(t, 10000, count, 2500, node)
+	}
+}
+
+func TestRingMovesFewNames(t *testing.T) {
+	t.Parallel()
+	before := newRing([]string{"a", "b", "c"})
+	// The order of nodes does not matter
+	after := newRing([]string{"d", "c", "b", "a"})
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		name := "metric." + strconv.Itoa(i)
+		if owner := after.owner(name); owner != before.owner(name) {
+			assert.Equal(t, "d", owner, name)
+			moved++
+		}
+	}
+	assert.InDelta(t, 2500, moved, 1000)
+}
@@ -0,0 +1,116 @@
+package gostatsdtest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDispatcher(t *testing.T) {
+	t.Parallel()
+	a1, a2 := &Aggregator{}, &Aggregator{}
+	d := &Dispatcher{Aggregators: []statsd.Aggregator{a1, a2}}
+	m := &gostatsd.Metric{Name: "c", Value: 1, Type: gostatsd.COUNTER}
+	require.NoError(t, d.DispatchMetric(context.Background(), m))
+	m.Value = 2 // The copy is recorded
+
+	d.Process(context.Background(), func(workerID uint16, a statsd.Aggregator) {
+		a.Flush(time.Second)
+	}).Wait()
+	assert.Equal(t, []gostatsd.Metric{{Name: "c", Value: 1, Type: gostatsd.COUNTER}}, d.RecordedMetrics())
+	assert.Equal(t, 1, d.ProcessCount())
+	assert.Equal(t, 1, a1.FlushCount())
+	assert.Equal(t, []time.Duration{time.Second}, a2.FlushIntervals())
+
+	d.Err = errors.New("full")
+	assert.Equal(t, d.Err, d.DispatchMetric(context.Background(), m))
+}
+
+func TestAggregator(t *testing.T) {
+	t.Parallel()
+	a := &Aggregator{}
+	a.Receive(&gostatsd.Metric{Name: "g", Value: 3, Type: gostatsd.GAUGE}, time.Now())
+	a.Process(func(m *gostatsd.MetricMap) {
+		assert.NotNil(t, m.Counters)
+	})
+	a.Reset()
+	assert.Equal(t, []gostatsd.Metric{{Name: "g", Value: 3, Type: gostatsd.GAUGE}}, a.RecordedMetrics())
+	assert.Equal(t, 1, a.ProcessCount())
+	assert.Equal(t, 1, a.ResetCount())
+	assert.Zero(t, a.FlushCount())
+}
+
+func TestReceiver(t *testing.T) {
+	t.Parallel()
+	r := &Receiver{Stats: statsd.ReceiverStats{PacketsReceived: 5}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	conn := &net.UDPConn{}
+	assert.Equal(t, context.Canceled, r.Receive(ctx, conn))
+	assert.Equal(t, []net.PacketConn{conn}, r.RecordedConns())
+	assert.EqualValues(t, 5, r.GetStats().PacketsReceived)
+}
+
+func TestFlusher(t *testing.T) {
+	t.Parallel()
+	f := &Flusher{Result: statsd.FlushResult{NumStats: 2}}
+	result, err := f.ForceFlush(context.Background())
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, result.NumStats)
+	assert.Equal(t, 1, f.FlushCount())
+}
+
+func TestBackend(t *testing.T) {
+	t.Parallel()
+	b := &Backend{}
+	assert.Equal(t, "gostatsdtest", b.Name())
+	m := &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{"c": map[string]gostatsd.Counter{"": {Value: 4}}},
+	}
+	var errs []error
+	b.SendMetricsAsync(context.Background(), m, func(e []error) {
+		errs = e
+	})
+	assert.Empty(t, errs)
+	require.NoError(t, b.SendEvent(context.Background(), &gostatsd.Event{Title: "deploy"}))
+
+	assert.Equal(t, 1, b.FlushCount())
+	m.Counters["c"][""] = gostatsd.Counter{Value: 5} // The copy is recorded
+	require.Len(t, b.RecordedMetricMaps(), 1)
+	assert.Equal(t, map[string][]gostatsd.Counter{"c": {{Value: 4}}}, b.RecordedCounters())
+	assert.Equal(t, []gostatsd.Event{{Title: "deploy"}}, b.RecordedEvents())
+
+	b.Err = errors.New("down")
+	b.SendMetricsAsync(context.Background(), m, func(e []error) {
+		errs = e
+	})
+	assert.Equal(t, []error{b.Err}, errs)
+}
+
+func TestNewTestServer(t *testing.T) {
+	t.Parallel()
+	s, stop := NewTestServer()
+	defer stop()
+	conn, err := net.Dial("udp", s.Addr.String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("test.counter:3|c"))
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		if counters := s.Backend.RecordedCounters()["test.counter"]; len(counters) > 0 {
+			assert.EqualValues(t, 3, counters[0].Value)
+			return
+		}
+		time.Sleep(TestFlushInterval / 2)
+	}
+	t.Fatal("counter was not flushed to the backend")
+}
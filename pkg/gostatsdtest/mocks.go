@@ -0,0 +1,337 @@
+// Package gostatsdtest provides mock implementations of the interfaces of the server pipeline and a test server
+// for testing code that uses gostatsd. Mocks record their calls, which can be inspected by their methods.
+// All mocks are safe for concurrent use.
+package gostatsdtest
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statsd"
+)
+
+// Receiver is a mock statsd.Receiver.
+type Receiver struct {
+	// Stats are returned by GetStats.
+	Stats statsd.ReceiverStats
+
+	mu    sync.Mutex
+	conns []net.PacketConn
+}
+
+// Receive records the connection and blocks until the context is done.
+func (r *Receiver) Receive(ctx context.Context, c net.PacketConn) error {
+	r.mu.Lock()
+	r.conns = append(r.conns, c)
+	r.mu.Unlock()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// GetStats returns Stats.
+func (r *Receiver) GetStats() statsd.ReceiverStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Stats
+}
+
+// RecordedConns returns the connections passed to Receive.
+func (r *Receiver) RecordedConns() []net.PacketConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]net.PacketConn(nil), r.conns...)
+}
+
+// Dispatcher is a mock statsd.Dispatcher.
+type Dispatcher struct {
+	// Err is returned by DispatchMetric.
+	Err error
+	// Aggregators are passed to the functions of Process, with their index as the worker id.
+	Aggregators []statsd.Aggregator
+
+	mu           sync.Mutex
+	metrics      []gostatsd.Metric
+	processCount int
+}
+
+// DispatchMetric records a copy of the metric and returns Err.
+func (d *Dispatcher) DispatchMetric(ctx context.Context, m *gostatsd.Metric) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.metrics = append(d.metrics, *m)
+	return d.Err
+}
+
+// Process executes the function concurrently for each of Aggregators.
+func (d *Dispatcher) Process(ctx context.Context, f statsd.DispatcherProcessFunc) *sync.WaitGroup {
+	d.mu.Lock()
+	d.processCount++
+	d.mu.Unlock()
+	wg := &sync.WaitGroup{}
+	wg.Add(len(d.Aggregators))
+	for i, a := range d.Aggregators {
+		go func(workerID uint16, a statsd.Aggregator) {
+			defer wg.Done()
+			f(workerID, a)
+		}(uint16(i), a)
+	}
+	return wg
+}
+
+// RecordedMetrics returns the metrics passed to DispatchMetric.
+func (d *Dispatcher) RecordedMetrics() []gostatsd.Metric {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]gostatsd.Metric(nil), d.metrics...)
+}
+
+// ProcessCount returns the number of calls to Process.
+func (d *Dispatcher) ProcessCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.processCount
+}
+
+// Aggregator is a mock statsd.Aggregator.
+type Aggregator struct {
+	// MetricMap is passed to the functions of Process, an empty MetricMap if nil.
+	MetricMap *gostatsd.MetricMap
+
+	mu             sync.Mutex
+	metrics        []gostatsd.Metric
+	flushIntervals []time.Duration
+	processCount   int
+	resetCount     int
+}
+
+// Receive records a copy of the metric.
+func (a *Aggregator) Receive(m *gostatsd.Metric, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.metrics = append(a.metrics, *m)
+}
+
+// Flush records the flush interval.
+func (a *Aggregator) Flush(interval time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.flushIntervals = append(a.flushIntervals, interval)
+}
+
+// Process executes the function with MetricMap.
+func (a *Aggregator) Process(f statsd.ProcessFunc) {
+	a.mu.Lock()
+	a.processCount++
+	m := a.MetricMap
+	a.mu.Unlock()
+	if m == nil {
+		m = &gostatsd.MetricMap{
+			Counters: gostatsd.Counters{},
+			Timers:   gostatsd.Timers{},
+			Gauges:   gostatsd.Gauges{},
+			Sets:     gostatsd.Sets{},
+		}
+	}
+	f(m)
+}
+
+// Reset records the reset.
+func (a *Aggregator) Reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.resetCount++
+}
+
+// RecordedMetrics returns the metrics passed to Receive.
+func (a *Aggregator) RecordedMetrics() []gostatsd.Metric {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]gostatsd.Metric(nil), a.metrics...)
+}
+
+// FlushIntervals returns the intervals passed to Flush.
+func (a *Aggregator) FlushIntervals() []time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]time.Duration(nil), a.flushIntervals...)
+}
+
+// FlushCount returns the number of calls to Flush.
+func (a *Aggregator) FlushCount() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.flushIntervals)
+}
+
+// ProcessCount returns the number of calls to Process.
+func (a *Aggregator) ProcessCount() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.processCount
+}
+
+// ResetCount returns the number of calls to Reset.
+func (a *Aggregator) ResetCount() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.resetCount
+}
+
+// Flusher is a mock statsd.Flusher and statsd.ForceFlusher.
+type Flusher struct {
+	// Stats are returned by GetStats.
+	Stats statsd.FlusherStats
+	// Result and Err are returned by ForceFlush.
+	Result statsd.FlushResult
+	Err    error
+
+	mu         sync.Mutex
+	flushCount int
+}
+
+// GetStats returns Stats.
+func (f *Flusher) GetStats() statsd.FlusherStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.Stats
+}
+
+// ForceFlush records the flush and returns Result and Err.
+func (f *Flusher) ForceFlush(ctx context.Context) (statsd.FlushResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.flushCount++
+	return f.Result, f.Err
+}
+
+// FlushCount returns the number of calls to ForceFlush.
+func (f *Flusher) FlushCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.flushCount
+}
+
+// Backend is a mock gostatsd.Backend keeping sent metrics and events in memory.
+type Backend struct {
+	// BackendName is returned by Name, "gostatsdtest" if empty.
+	BackendName string
+	// Err is passed to the callbacks of SendMetricsAsync and returned by SendEvent.
+	Err error
+
+	mu     sync.Mutex
+	maps   []*gostatsd.MetricMap
+	events []gostatsd.Event
+}
+
+// Name returns BackendName.
+func (b *Backend) Name() string {
+	if b.BackendName == "" {
+		return "gostatsdtest"
+	}
+	return b.BackendName
+}
+
+// SendMetricsAsync records a copy of the metrics and calls the callback with Err.
+func (b *Backend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	m = copyMetricMap(m) // The MetricMap is reused after the send
+	b.mu.Lock()
+	b.maps = append(b.maps, m)
+	b.mu.Unlock()
+	if b.Err != nil {
+		callback([]error{b.Err})
+	} else {
+		callback(nil)
+	}
+}
+
+// SendEvent records a copy of the event and returns Err.
+func (b *Backend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.events = append(b.events, *e)
+	return b.Err
+}
+
+// RecordedMetricMaps returns the metrics passed to SendMetricsAsync, one MetricMap per flush.
+func (b *Backend) RecordedMetricMaps() []*gostatsd.MetricMap {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*gostatsd.MetricMap(nil), b.maps...)
+}
+
+// RecordedCounters returns the counters of all flushes keyed by name.
+func (b *Backend) RecordedCounters() map[string][]gostatsd.Counter {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	result := map[string][]gostatsd.Counter{}
+	for _, m := range b.maps {
+		m.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+			result[key] = append(result[key], counter)
+		})
+	}
+	return result
+}
+
+// RecordedEvents returns the events passed to SendEvent.
+func (b *Backend) RecordedEvents() []gostatsd.Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]gostatsd.Event(nil), b.events...)
+}
+
+// FlushCount returns the number of calls to SendMetricsAsync.
+func (b *Backend) FlushCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.maps)
+}
+
+// copyMetricMap returns a deep copy of the MetricMap.
+func copyMetricMap(m *gostatsd.MetricMap) *gostatsd.MetricMap {
+	result := &gostatsd.MetricMap{
+		MetricStats: m.MetricStats,
+		Counters:    gostatsd.Counters{},
+		Timers:      gostatsd.Timers{},
+		Gauges:      gostatsd.Gauges{},
+		Sets:        gostatsd.Sets{},
+	}
+	m.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		counter.Tags = append(gostatsd.Tags(nil), counter.Tags...)
+		if result.Counters[key] == nil {
+			result.Counters[key] = map[string]gostatsd.Counter{}
+		}
+		result.Counters[key][tagsKey] = counter
+	})
+	m.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		timer.Tags = append(gostatsd.Tags(nil), timer.Tags...)
+		timer.Values = append([]float64(nil), timer.Values...)
+		timer.Percentiles = append(gostatsd.Percentiles(nil), timer.Percentiles...)
+		if result.Timers[key] == nil {
+			result.Timers[key] = map[string]gostatsd.Timer{}
+		}
+		result.Timers[key][tagsKey] = timer
+	})
+	m.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		gauge.Tags = append(gostatsd.Tags(nil), gauge.Tags...)
+		if result.Gauges[key] == nil {
+			result.Gauges[key] = map[string]gostatsd.Gauge{}
+		}
+		result.Gauges[key][tagsKey] = gauge
+	})
+	m.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+		set.Tags = append(gostatsd.Tags(nil), set.Tags...)
+		values := make(map[string]struct{}, len(set.Values))
+		for value := range set.Values {
+			values[value] = struct{}{}
+		}
+		set.Values = values
+		if result.Sets[key] == nil {
+			result.Sets[key] = map[string]gostatsd.Set{}
+		}
+		result.Sets[key][tagsKey] = set
+	})
+	return result
+}
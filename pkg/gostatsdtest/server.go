@@ -0,0 +1,54 @@
+package gostatsdtest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statsd"
+)
+
+// TestFlushInterval is the flush interval of the test server.
+const TestFlushInterval = 100 * time.Millisecond
+
+// Server is a running test server.
+type Server struct {
+	*statsd.Server
+	// Addr is the UDP address the server receives metrics on.
+	Addr net.Addr
+	// Backend receives the flushed metrics and events of the server.
+	Backend *Backend
+}
+
+// NewTestServer starts a server receiving metrics on a random UDP port of the loopback interface, flushing them
+// every TestFlushInterval to an in-memory Backend. The consoles are disabled. The returned function stops the
+// server and waits for it to shut down, it panics if the server failed.
+func NewTestServer() (*Server, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("failed to listen for metrics: %v", err))
+	}
+	backend := &Backend{}
+	s := statsd.NewServer()
+	s.Backends = []gostatsd.Backend{backend}
+	s.ConsoleAddr = ""
+	s.WebConsoleAddr = ""
+	s.FlushInterval = TestFlushInterval
+	s.MetricsAddr = conn.LocalAddr().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.RunWithCustomSocket(ctx, func() (net.PacketConn, error) {
+			return conn, nil
+		})
+	}()
+	return &Server{Server: s, Addr: conn.LocalAddr(), Backend: backend}, func() {
+		cancel()
+		if err := <-done; err != nil && err != context.Canceled {
+			panic(fmt.Sprintf("test server failed: %v", err))
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Package ha elects the leader of gostatsd servers aggregating the same metrics, e.g. replicas behind a load
+// balancer or servers recovering from a split brain, so that metrics are flushed to backends by only one of them.
+//
+// The leader holds a key in Redis set with SET NX EX to its ID and renews the expiry of the key while it runs.
+// Other servers take over once the key expires, i.e. at most the TTL after the leader stopped renewing it.
+package ha
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// DefaultKey is the default Redis key holding the ID of the leader.
+	DefaultKey = "gostatsd:leader"
+	// DefaultTTL is the default time after which the leadership of a server that stopped renewing it expires.
+	DefaultTTL = 10 * time.Second
+	// ParamRedisAddr is the name of parameter with the address of the Redis server used for leader election.
+	ParamRedisAddr = "leader-redis-addr"
+	// ParamKey is the name of parameter with the Redis key holding the ID of the leader.
+	ParamKey = "leader-key"
+	// ParamTTL is the name of parameter with the time to live of the leadership.
+	ParamTTL = "leader-ttl"
+)
+
+// renewScript extends the expiry of the key if it holds the ID, and returns 1 if it does.
+var renewScript = goredis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// resignScript deletes the key if it holds the ID.
+var resignScript = goredis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// AddFlags adds flags to the specified FlagSet.
+func AddFlags(fs *pflag.FlagSet) {
+	fs.String(ParamRedisAddr, "", "If set, address of the Redis server used to elect the only server flushing metrics among servers aggregating the same metrics")
+	fs.String(ParamKey, DefaultKey, "Redis key holding the ID of the leader")
+	fs.Duration(ParamTTL, DefaultTTL, "Time after which another server takes over from a leader that stopped renewing its leadership")
+}
+
+// LeaderElector elects the leader of the servers with the same key in Redis. The leadership is renewed every
+// third of the TTL. If Redis cannot be reached, the leader keeps the leadership until its key would have expired.
+type LeaderElector struct {
+	client goredis.UniversalClient
+	key    string
+	id     string
+	ttl    time.Duration
+	now    func() time.Time
+
+	// LeaderChangeCh receives whether the server is the leader each time it changes. A change not received yet
+	// is replaced by the next one, so that the latest value is received.
+	LeaderChangeCh chan bool
+
+	mu        sync.Mutex // Protects fields below
+	leader    bool
+	renewedAt time.Time // Last time the key was set or renewed
+}
+
+// NewLeaderElector initialises a new elector of the server with the ID, which must be unique among the servers
+// with the key, e.g. the hostname and the process ID.
+func NewLeaderElector(client goredis.UniversalClient, key, id string, ttl time.Duration) (*LeaderElector, error) {
+	if key == "" {
+		return nil, errors.New("leader key must not be empty")
+	}
+	if id == "" {
+		return nil, errors.New("leader ID must not be empty")
+	}
+	if ttl < time.Millisecond {
+		return nil, errors.New("leader TTL must be at least 1ms")
+	}
+	return &LeaderElector{
+		client:         client,
+		key:            key,
+		id:             id,
+		ttl:            ttl,
+		now:            time.Now,
+		LeaderChangeCh: make(chan bool, 1),
+	}, nil
+}
+
+// NewRedisLeaderElector initialises a new elector using the Redis server at the address.
+func NewRedisLeaderElector(addr, key, id string, ttl time.Duration) (*LeaderElector, error) {
+	return NewLeaderElector(goredis.NewClient(&goredis.Options{Addr: addr}), key, id, ttl)
+}
+
+// IsLeader returns whether the server is the leader.
+func (le *LeaderElector) IsLeader() bool {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	return le.leader
+}
+
+// Run tries to become or stay the leader every third of the TTL until the context is done. The leadership is
+// given up on return so that another server takes over without waiting for the key to expire.
+func (le *LeaderElector) Run(ctx context.Context) error {
+	ticker := time.NewTicker(le.ttl / 3)
+	defer ticker.Stop()
+	for {
+		le.elect(ctx)
+		select {
+		case <-ctx.Done():
+			le.resign()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// elect sets the key to the ID if it is not set, or renews it if it holds the ID.
+func (le *LeaderElector) elect(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, le.ttl/3)
+	defer cancel()
+	now := le.now()
+	acquired, err := le.client.SetNX(ctx, le.key, le.id, le.ttl).Result()
+	if err == nil && !acquired {
+		var renewed int64
+		renewed, err = renewScript.Run(ctx, le.client, []string{le.key}, le.id, int64(le.ttl/time.Millisecond)).Int64()
+		acquired = renewed == 1
+	}
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	if err != nil {
+		log.Warnf("Failed to renew leadership: %v", err)
+		// Another server cannot take over before the key expires
+		le.setLeader(le.leader && now.Before(le.renewedAt.Add(le.ttl)))
+		return
+	}
+	if acquired {
+		le.renewedAt = now
+	}
+	le.setLeader(acquired)
+}
+
+// resign deletes the key if the server is the leader.
+func (le *LeaderElector) resign() {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	if !le.leader {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), le.ttl/3)
+	defer cancel()
+	if err := resignScript.Run(ctx, le.client, []string{le.key}, le.id).Err(); err != nil {
+		log.Warnf("Failed to give up leadership: %v", err)
+	}
+	le.setLeader(false)
+}
+
+// setLeader sets whether the server is the leader and notifies LeaderChangeCh if it changed. Must be called with
+// mu held.
+func (le *LeaderElector) setLeader(leader bool) {
+	if leader == le.leader {
+		return
+	}
+	le.leader = leader
+	if leader {
+		log.Infof("Became the leader with ID %s, flushing metrics to backends", le.id)
+	} else {
+		log.Infof("No longer the leader with ID %s, not flushing metrics to backends", le.id)
+	}
+	select {
+	case <-le.LeaderChangeCh: // Replaced by the latest change
+	default:
+	}
+	le.LeaderChangeCh <- leader
+}
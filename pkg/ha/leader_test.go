@@ -0,0 +1,131 @@
+package ha
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestElector(t *testing.T, s *miniredis.Miniredis, id string) *LeaderElector {
+	le, err := NewLeaderElector(goredis.NewClient(&goredis.Options{Addr: s.Addr()}), DefaultKey, id, DefaultTTL)
+	require.NoError(t, err)
+	return le
+}
+
+// assertLeaderChange asserts that the latest change received from the elector is leader.
+func assertLeaderChange(t *testing.T, le *LeaderElector, leader bool) {
+	select {
+	case l := <-le.LeaderChangeCh:
+		assert.Equal(t, leader, l)
+	default:
+		t.Errorf("no leader change of %s", le.id)
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	t.Parallel()
+	s := miniredis.RunT(t)
+	ctx := context.Background()
+	a := newTestElector(t, s, "a")
+	b := newTestElector(t, s, "b")
+
+	a.elect(ctx)
+	b.elect(ctx)
+	assert.True(t, a.IsLeader())
+	assert.False(t, b.IsLeader())
+	assertLeaderChange(t, a, true)
+	assert.Empty(t, b.LeaderChangeCh)
+	assert.Equal(t, "a", mustGet(t, s, DefaultKey))
+	assert.Equal(t, DefaultTTL, s.TTL(DefaultKey))
+
+	// The leader renews its leadership
+	s.FastForward(DefaultTTL / 2)
+	a.elect(ctx)
+	b.elect(ctx)
+	assert.True(t, a.IsLeader())
+	assert.False(t, b.IsLeader())
+	assert.Equal(t, DefaultTTL, s.TTL(DefaultKey))
+	assert.Empty(t, a.LeaderChangeCh)
+
+	// Another server takes over once the leadership expired, e.g. after a split brain
+	s.FastForward(DefaultTTL)
+	b.elect(ctx)
+	a.elect(ctx)
+	assert.False(t, a.IsLeader())
+	assert.True(t, b.IsLeader())
+	assertLeaderChange(t, a, false)
+	assertLeaderChange(t, b, true)
+	assert.Equal(t, "b", mustGet(t, s, DefaultKey))
+}
+
+func mustGet(t *testing.T, s *miniredis.Miniredis, key string) string {
+	value, err := s.Get(key)
+	require.NoError(t, err)
+	return value
+}
+
+func TestLeaderElectionRedisDown(t *testing.T) {
+	t.Parallel()
+	s := miniredis.RunT(t)
+	ctx := context.Background()
+	now := time.Unix(1000, 0)
+	le := newTestElector(t, s, "a")
+	le.now = func() time.Time {
+		return now
+	}
+	le.elect(ctx)
+	require.True(t, le.IsLeader())
+
+	// The leader keeps the leadership until its key would have expired
+	s.Close()
+	now = now.Add(DefaultTTL / 2)
+	le.elect(ctx)
+	assert.True(t, le.IsLeader())
+	now = now.Add(DefaultTTL / 2)
+	le.elect(ctx)
+	assert.False(t, le.IsLeader())
+}
+
+func TestLeaderElectionResign(t *testing.T) {
+	t.Parallel()
+	s := miniredis.RunT(t)
+	a := newTestElector(t, s, "a")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- a.Run(ctx)
+	}()
+	select {
+	case leader := <-a.LeaderChangeCh:
+		assert.True(t, leader)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the leadership")
+	}
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	assert.False(t, a.IsLeader())
+	assert.False(t, s.Exists(DefaultKey))
+
+	// Keys of other servers are not deleted
+	b := newTestElector(t, s, "b")
+	b.elect(context.Background())
+	a.leader = true
+	a.resign()
+	assert.Equal(t, "b", mustGet(t, s, DefaultKey))
+}
+
+func TestNewLeaderElectorErrors(t *testing.T) {
+	t.Parallel()
+	client := goredis.NewClient(&goredis.Options{})
+	_, err := NewLeaderElector(client, "", "a", DefaultTTL)
+	assert.EqualError(t, err, "leader key must not be empty")
+	_, err = NewLeaderElector(client, DefaultKey, "", DefaultTTL)
+	assert.EqualError(t, err, "leader ID must not be empty")
+	_, err = NewLeaderElector(client, DefaultKey, "a", 0)
+	assert.EqualError(t, err, "leader TTL must be at least 1ms")
+}
@@ -0,0 +1,258 @@
+// Package pb contains the Protocol Buffers representation of metrics used for inter-process communication,
+// e.g. to hand off aggregated metrics on warm restarts. Run make protobuf to regenerate gostatsd.pb.go.
+package pb
+
+import (
+	"time"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// MetricToProto returns the protobuf representation of the metric.
+func MetricToProto(m *gostatsd.Metric) *Metric {
+	return &Metric{
+		Name:        m.Name,
+		Value:       m.Value,
+		Tags:        m.Tags,
+		StringValue: m.StringValue,
+		Unit:        m.Unit,
+		Hostname:    m.Hostname,
+		SourceIp:    string(m.SourceIP),
+		Type:        MetricType(m.Type), // Values are the same as gostatsd.MetricType
+		GaugeDelta:  m.GaugeDelta,
+	}
+}
+
+// MetricFromProto returns the metric of the protobuf representation.
+func MetricFromProto(m *Metric) *gostatsd.Metric {
+	return &gostatsd.Metric{
+		Name:        m.GetName(),
+		Value:       m.GetValue(),
+		Tags:        m.GetTags(),
+		StringValue: m.GetStringValue(),
+		Unit:        m.GetUnit(),
+		Hostname:    m.GetHostname(),
+		SourceIP:    gostatsd.IP(m.GetSourceIp()),
+		Type:        gostatsd.MetricType(m.GetType()),
+		GaugeDelta:  m.GetGaugeDelta(),
+	}
+}
+
+// MetricMapToProto returns the protobuf representation of the MetricMap.
+func MetricMapToProto(m *gostatsd.MetricMap) *MetricMap {
+	result := &MetricMap{
+		Stats: &MetricStats{
+			ProcessingTimeNs: int64(m.ProcessingTime),
+			NumStats:         m.NumStats,
+			DroppedCounters:  m.DroppedCounters,
+			Keys:             keyCountsToProto(m.Keys),
+			NewKeys:          keyCountsToProto(m.NewKeys),
+			ExpiredKeys:      keyCountsToProto(m.ExpiredKeys),
+		},
+		FlushIntervalNs: int64(m.FlushInterval),
+	}
+	m.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		result.Counters = append(result.Counters, &Counter{
+			Name:      key,
+			TagsKey:   tagsKey,
+			Tags:      counter.Tags,
+			Hostname:  counter.Hostname,
+			Unit:      counter.Unit,
+			Timestamp: int64(counter.Timestamp),
+			Value:     counter.Value,
+			PerSecond: counter.PerSecond,
+		})
+	})
+	m.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		percentiles := make([]*Percentile, 0, len(timer.Percentiles))
+		for _, p := range timer.Percentiles {
+			percentiles = append(percentiles, &Percentile{Name: p.Str, Value: p.Float})
+		}
+		result.Timers = append(result.Timers, &Timer{
+			Name:        key,
+			TagsKey:     tagsKey,
+			Tags:        timer.Tags,
+			Hostname:    timer.Hostname,
+			Unit:        timer.Unit,
+			Timestamp:   int64(timer.Timestamp),
+			Count:       int64(timer.Count),
+			PerSecond:   timer.PerSecond,
+			Mean:        timer.Mean,
+			Median:      timer.Median,
+			Min:         timer.Min,
+			Max:         timer.Max,
+			StdDev:      timer.StdDev,
+			Sum:         timer.Sum,
+			SumSquares:  timer.SumSquares,
+			Values:      timer.Values,
+			Percentiles: percentiles,
+			Digest:      tdigestToProto(timer.Digest),
+		})
+	})
+	m.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		result.Gauges = append(result.Gauges, &Gauge{
+			Name:      key,
+			TagsKey:   tagsKey,
+			Tags:      gauge.Tags,
+			Hostname:  gauge.Hostname,
+			Unit:      gauge.Unit,
+			Timestamp: int64(gauge.Timestamp),
+			Value:     gauge.Value,
+		})
+	})
+	m.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+		values := make([]string, 0, len(set.Values))
+		for value := range set.Values {
+			values = append(values, value)
+		}
+		result.Sets = append(result.Sets, &Set{
+			Name:      key,
+			TagsKey:   tagsKey,
+			Tags:      set.Tags,
+			Hostname:  set.Hostname,
+			Unit:      set.Unit,
+			Timestamp: int64(set.Timestamp),
+			Values:    values,
+		})
+	})
+	return result
+}
+
+// MetricMapFromProto returns the MetricMap of the protobuf representation.
+// Empty repeated fields are nil, except values of sets which are never nil.
+func MetricMapFromProto(m *MetricMap) *gostatsd.MetricMap {
+	stats := m.GetStats()
+	result := &gostatsd.MetricMap{
+		MetricStats: gostatsd.MetricStats{
+			ProcessingTime:  time.Duration(stats.GetProcessingTimeNs()),
+			NumStats:        stats.GetNumStats(),
+			DroppedCounters: stats.GetDroppedCounters(),
+			Keys:            keyCountsFromProto(stats.GetKeys()),
+			NewKeys:         keyCountsFromProto(stats.GetNewKeys()),
+			ExpiredKeys:     keyCountsFromProto(stats.GetExpiredKeys()),
+		},
+		FlushInterval: time.Duration(m.GetFlushIntervalNs()),
+		Counters:      gostatsd.Counters{},
+		Timers:        gostatsd.Timers{},
+		Gauges:        gostatsd.Gauges{},
+		Sets:          gostatsd.Sets{},
+	}
+	for _, c := range m.GetCounters() {
+		if result.Counters[c.GetName()] == nil {
+			result.Counters[c.GetName()] = map[string]gostatsd.Counter{}
+		}
+		result.Counters[c.GetName()][c.GetTagsKey()] = gostatsd.Counter{
+			PerSecond: c.GetPerSecond(),
+			Value:     c.GetValue(),
+			Timestamp: gostatsd.Nanotime(c.GetTimestamp()),
+			Hostname:  c.GetHostname(),
+			Tags:      c.GetTags(),
+			Unit:      c.GetUnit(),
+		}
+	}
+	for _, t := range m.GetTimers() {
+		var percentiles gostatsd.Percentiles
+		for _, p := range t.GetPercentiles() {
+			percentiles = append(percentiles, gostatsd.Percentile{Float: p.GetValue(), Str: p.GetName()})
+		}
+		if result.Timers[t.GetName()] == nil {
+			result.Timers[t.GetName()] = map[string]gostatsd.Timer{}
+		}
+		result.Timers[t.GetName()][t.GetTagsKey()] = gostatsd.Timer{
+			Count:       int(t.GetCount()),
+			PerSecond:   t.GetPerSecond(),
+			Mean:        t.GetMean(),
+			Median:      t.GetMedian(),
+			Min:         t.GetMin(),
+			Max:         t.GetMax(),
+			StdDev:      t.GetStdDev(),
+			Sum:         t.GetSum(),
+			SumSquares:  t.GetSumSquares(),
+			Values:      t.GetValues(),
+			Percentiles: percentiles,
+			Digest:      tdigestFromProto(t.GetDigest()),
+			Timestamp:   gostatsd.Nanotime(t.GetTimestamp()),
+			Hostname:    t.GetHostname(),
+			Tags:        t.GetTags(),
+			Unit:        t.GetUnit(),
+		}
+	}
+	for _, g := range m.GetGauges() {
+		if result.Gauges[g.GetName()] == nil {
+			result.Gauges[g.GetName()] = map[string]gostatsd.Gauge{}
+		}
+		result.Gauges[g.GetName()][g.GetTagsKey()] = gostatsd.Gauge{
+			Value:     g.GetValue(),
+			Timestamp: gostatsd.Nanotime(g.GetTimestamp()),
+			Hostname:  g.GetHostname(),
+			Tags:      g.GetTags(),
+			Unit:      g.GetUnit(),
+		}
+	}
+	for _, s := range m.GetSets() {
+		values := make(map[string]struct{}, len(s.GetValues())) // Aggregators add values to the map
+		for _, value := range s.GetValues() {
+			values[value] = struct{}{}
+		}
+		if result.Sets[s.GetName()] == nil {
+			result.Sets[s.GetName()] = map[string]gostatsd.Set{}
+		}
+		result.Sets[s.GetName()][s.GetTagsKey()] = gostatsd.Set{
+			Values:    values,
+			Timestamp: gostatsd.Nanotime(s.GetTimestamp()),
+			Hostname:  s.GetHostname(),
+			Tags:      s.GetTags(),
+			Unit:      s.GetUnit(),
+		}
+	}
+	return result
+}
+
+func keyCountsToProto(k gostatsd.KeyCounts) *KeyCounts {
+	return &KeyCounts{
+		Counters: k.Counters,
+		Timers:   k.Timers,
+		Gauges:   k.Gauges,
+		Sets:     k.Sets,
+	}
+}
+
+func keyCountsFromProto(k *KeyCounts) gostatsd.KeyCounts {
+	return gostatsd.KeyCounts{
+		Counters: k.GetCounters(),
+		Timers:   k.GetTimers(),
+		Gauges:   k.GetGauges(),
+		Sets:     k.GetSets(),
+	}
+}
+
+// tdigestToProto returns the protobuf representation of the digest, nil if nil.
+func tdigestToProto(d *gostatsd.TDigest) *TDigest {
+	if d == nil {
+		return nil
+	}
+	result := &TDigest{
+		Compression: d.Compression(),
+		Sum:         d.Sum(),
+		SumSquares:  d.SumSquares(),
+	}
+	if d.Count() > 0 {
+		result.Min, result.Max = d.Min(), d.Max()
+	}
+	for _, c := range d.Centroids() {
+		result.Centroids = append(result.Centroids, &Centroid{Mean: c.Mean, Weight: c.Weight})
+	}
+	return result
+}
+
+// tdigestFromProto returns the digest of the protobuf representation, nil if nil.
+func tdigestFromProto(d *TDigest) *gostatsd.TDigest {
+	if d == nil {
+		return nil
+	}
+	centroids := make([]gostatsd.TDigestCentroid, 0, len(d.GetCentroids()))
+	for _, c := range d.GetCentroids() {
+		centroids = append(centroids, gostatsd.TDigestCentroid{Mean: c.GetMean(), Weight: c.GetWeight()})
+	}
+	return gostatsd.RestoreTDigest(d.GetCompression(), centroids, d.GetMin(), d.GetMax(), d.GetSum(), d.GetSumSquares())
+}
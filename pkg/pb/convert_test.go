@@ -0,0 +1,110 @@
+package pb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMetricRoundTrip(t *testing.T) {
+	t.Parallel()
+	m := &gostatsd.Metric{
+		Name:        "g",
+		Value:       -2,
+		Tags:        gostatsd.Tags{"b", "a:1"},
+		StringValue: "-2",
+		Unit:        "bytes",
+		Hostname:    "h",
+		SourceIP:    "1.2.3.4",
+		Type:        gostatsd.GAUGE,
+		GaugeDelta:  true,
+	}
+	data, err := proto.Marshal(MetricToProto(m))
+	require.NoError(t, err)
+	var decoded Metric
+	require.NoError(t, proto.Unmarshal(data, &decoded))
+	assert.Equal(t, MetricType_GAUGE, decoded.GetType())
+	assert.Equal(t, m, MetricFromProto(&decoded))
+}
+
+func TestMetricMapRoundTrip(t *testing.T) {
+	t.Parallel()
+	m := &gostatsd.MetricMap{
+		MetricStats: gostatsd.MetricStats{
+			ProcessingTime:  time.Millisecond,
+			NumStats:        4,
+			DroppedCounters: 1,
+			Keys:            gostatsd.KeyCounts{Counters: 1, Timers: 1, Gauges: 1, Sets: 1},
+			NewKeys:         gostatsd.KeyCounts{Gauges: 1},
+			ExpiredKeys:     gostatsd.KeyCounts{Sets: 2},
+		},
+		FlushInterval: 10 * time.Second,
+		Counters: gostatsd.Counters{
+			"c": {"z:1,a:2,s:h": {Value: 3, PerSecond: 0.3, Timestamp: 10, Hostname: "h", Tags: gostatsd.Tags{"z:1", "a:2"}, Unit: "bytes"}},
+		},
+		Timers: gostatsd.Timers{
+			"t": {"": {
+				Count:       2,
+				PerSecond:   0.2,
+				Mean:        1.5,
+				Median:      1.5,
+				Min:         1,
+				Max:         2,
+				StdDev:      0.5,
+				Sum:         3,
+				SumSquares:  5,
+				Values:      []float64{2, 1},
+				Percentiles: gostatsd.Percentiles{{Float: 2, Str: "upper_90"}},
+				Timestamp:   11,
+			}},
+		},
+		Gauges: gostatsd.Gauges{
+			"g": {"b": {Value: 1.5, Timestamp: 12, Tags: gostatsd.Tags{"b"}}},
+		},
+		Sets: gostatsd.Sets{
+			"s": {"": {Values: map[string]struct{}{"joe": {}, "bob": {}}, Timestamp: 13}},
+		},
+	}
+	data, err := proto.Marshal(MetricMapToProto(m))
+	require.NoError(t, err)
+	var decoded MetricMap
+	require.NoError(t, proto.Unmarshal(data, &decoded))
+	assert.Equal(t, m, MetricMapFromProto(&decoded))
+}
+
+func TestMetricMapRoundTripDigest(t *testing.T) {
+	t.Parallel()
+	d := gostatsd.NewTDigest(50)
+	for i := 1; i <= 1000; i++ {
+		d.Add(float64(i))
+	}
+	m := &gostatsd.MetricMap{
+		Timers: gostatsd.Timers{"t": {"": {Count: 1000, Digest: d}}},
+	}
+	data, err := proto.Marshal(MetricMapToProto(m))
+	require.NoError(t, err)
+	var decoded MetricMap
+	require.NoError(t, proto.Unmarshal(data, &decoded))
+	timer := MetricMapFromProto(&decoded).Timers["t"][""]
+	require.NotNil(t, timer.Digest)
+	assert.EqualValues(t, 50, timer.Digest.Compression())
+	assert.Equal(t, d.Centroids(), timer.Digest.Centroids())
+	assert.Equal(t, 1000, timer.NumValues())
+	assert.Equal(t, 1.0, timer.Digest.Min())
+	assert.Equal(t, 1000.0, timer.Digest.Max())
+	assert.Equal(t, d.SumSquares(), timer.Digest.SumSquares())
+}
+
+func TestMetricMapFromProtoEmpty(t *testing.T) {
+	t.Parallel()
+	m := MetricMapFromProto(&MetricMap{Sets: []*Set{{Name: "s"}}})
+	assert.Equal(t, gostatsd.Counters{}, m.Counters)
+	assert.Equal(t, gostatsd.Timers{}, m.Timers)
+	assert.Equal(t, gostatsd.Gauges{}, m.Gauges)
+	assert.NotNil(t, m.Sets["s"][""].Values) // Aggregators add values to the map
+}
@@ -0,0 +1,1261 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        v5.29.3
+// source: pkg/pb/gostatsd.proto
+
+package pb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type MetricType int32
+
+const (
+	MetricType_UNKNOWN MetricType = 0
+	MetricType_COUNTER MetricType = 1
+	MetricType_TIMER   MetricType = 2
+	MetricType_GAUGE   MetricType = 3
+	MetricType_SET     MetricType = 4
+)
+
+// Enum value maps for MetricType.
+var (
+	MetricType_name = map[int32]string{
+		0: "UNKNOWN",
+		1: "COUNTER",
+		2: "TIMER",
+		3: "GAUGE",
+		4: "SET",
+	}
+	MetricType_value = map[string]int32{
+		"UNKNOWN": 0,
+		"COUNTER": 1,
+		"TIMER":   2,
+		"GAUGE":   3,
+		"SET":     4,
+	}
+)
+
+func (x MetricType) Enum() *MetricType {
+	p := new(MetricType)
+	*p = x
+	return p
+}
+
+func (x MetricType) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (MetricType) Descriptor() protoreflect.EnumDescriptor {
+	return file_pkg_pb_gostatsd_proto_enumTypes[0].Descriptor()
+}
+
+func (MetricType) Type() protoreflect.EnumType {
+	return &file_pkg_pb_gostatsd_proto_enumTypes[0]
+}
+
+func (x MetricType) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use MetricType.Descriptor instead.
+func (MetricType) EnumDescriptor() ([]byte, []int) {
+	return file_pkg_pb_gostatsd_proto_rawDescGZIP(), []int{0}
+}
+
+// Metric is a received metric, see gostatsd.Metric.
+type Metric struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Value         float64                `protobuf:"fixed64,2,opt,name=value,proto3" json:"value,omitempty"`
+	Tags          []string               `protobuf:"bytes,3,rep,name=tags,proto3" json:"tags,omitempty"`
+	StringValue   string                 `protobuf:"bytes,4,opt,name=string_value,json=stringValue,proto3" json:"string_value,omitempty"`
+	Unit          string                 `protobuf:"bytes,5,opt,name=unit,proto3" json:"unit,omitempty"`
+	Hostname      string                 `protobuf:"bytes,6,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	SourceIp      string                 `protobuf:"bytes,7,opt,name=source_ip,json=sourceIp,proto3" json:"source_ip,omitempty"`
+	Type          MetricType             `protobuf:"varint,8,opt,name=type,proto3,enum=gostatsd.pb.MetricType" json:"type,omitempty"`
+	GaugeDelta    bool                   `protobuf:"varint,9,opt,name=gauge_delta,json=gaugeDelta,proto3" json:"gauge_delta,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Metric) Reset() {
+	*x = Metric{}
+	mi := &file_pkg_pb_gostatsd_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Metric) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Metric) ProtoMessage() {}
+
+func (x *Metric) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_pb_gostatsd_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Metric.ProtoReflect.Descriptor instead.
+func (*Metric) Descriptor() ([]byte, []int) {
+	return file_pkg_pb_gostatsd_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Metric) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Metric) GetValue() float64 {
+	if x != nil {
+		return x.Value
+	}
+	return 0
+}
+
+func (x *Metric) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *Metric) GetStringValue() string {
+	if x != nil {
+		return x.StringValue
+	}
+	return ""
+}
+
+func (x *Metric) GetUnit() string {
+	if x != nil {
+		return x.Unit
+	}
+	return ""
+}
+
+func (x *Metric) GetHostname() string {
+	if x != nil {
+		return x.Hostname
+	}
+	return ""
+}
+
+func (x *Metric) GetSourceIp() string {
+	if x != nil {
+		return x.SourceIp
+	}
+	return ""
+}
+
+func (x *Metric) GetType() MetricType {
+	if x != nil {
+		return x.Type
+	}
+	return MetricType_UNKNOWN
+}
+
+func (x *Metric) GetGaugeDelta() bool {
+	if x != nil {
+		return x.GaugeDelta
+	}
+	return false
+}
+
+// MetricMap holds aggregated metrics, see gostatsd.MetricMap.
+// Metrics are keyed by name and tags key in gostatsd.MetricMap, both are fields of each metric.
+type MetricMap struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	Stats           *MetricStats           `protobuf:"bytes,1,opt,name=stats,proto3" json:"stats,omitempty"`
+	FlushIntervalNs int64                  `protobuf:"varint,2,opt,name=flush_interval_ns,json=flushIntervalNs,proto3" json:"flush_interval_ns,omitempty"`
+	Counters        []*Counter             `protobuf:"bytes,3,rep,name=counters,proto3" json:"counters,omitempty"`
+	Timers          []*Timer               `protobuf:"bytes,4,rep,name=timers,proto3" json:"timers,omitempty"`
+	Gauges          []*Gauge               `protobuf:"bytes,5,rep,name=gauges,proto3" json:"gauges,omitempty"`
+	Sets            []*Set                 `protobuf:"bytes,6,rep,name=sets,proto3" json:"sets,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *MetricMap) Reset() {
+	*x = MetricMap{}
+	mi := &file_pkg_pb_gostatsd_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MetricMap) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MetricMap) ProtoMessage() {}
+
+func (x *MetricMap) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_pb_gostatsd_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MetricMap.ProtoReflect.Descriptor instead.
+func (*MetricMap) Descriptor() ([]byte, []int) {
+	return file_pkg_pb_gostatsd_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *MetricMap) GetStats() *MetricStats {
+	if x != nil {
+		return x.Stats
+	}
+	return nil
+}
+
+func (x *MetricMap) GetFlushIntervalNs() int64 {
+	if x != nil {
+		return x.FlushIntervalNs
+	}
+	return 0
+}
+
+func (x *MetricMap) GetCounters() []*Counter {
+	if x != nil {
+		return x.Counters
+	}
+	return nil
+}
+
+func (x *MetricMap) GetTimers() []*Timer {
+	if x != nil {
+		return x.Timers
+	}
+	return nil
+}
+
+func (x *MetricMap) GetGauges() []*Gauge {
+	if x != nil {
+		return x.Gauges
+	}
+	return nil
+}
+
+func (x *MetricMap) GetSets() []*Set {
+	if x != nil {
+		return x.Sets
+	}
+	return nil
+}
+
+type MetricStats struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	ProcessingTimeNs int64                  `protobuf:"varint,1,opt,name=processing_time_ns,json=processingTimeNs,proto3" json:"processing_time_ns,omitempty"`
+	NumStats         uint32                 `protobuf:"varint,2,opt,name=num_stats,json=numStats,proto3" json:"num_stats,omitempty"`
+	DroppedCounters  uint32                 `protobuf:"varint,3,opt,name=dropped_counters,json=droppedCounters,proto3" json:"dropped_counters,omitempty"`
+	Keys             *KeyCounts             `protobuf:"bytes,4,opt,name=keys,proto3" json:"keys,omitempty"`
+	NewKeys          *KeyCounts             `protobuf:"bytes,5,opt,name=new_keys,json=newKeys,proto3" json:"new_keys,omitempty"`
+	ExpiredKeys      *KeyCounts             `protobuf:"bytes,6,opt,name=expired_keys,json=expiredKeys,proto3" json:"expired_keys,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *MetricStats) Reset() {
+	*x = MetricStats{}
+	mi := &file_pkg_pb_gostatsd_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MetricStats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MetricStats) ProtoMessage() {}
+
+func (x *MetricStats) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_pb_gostatsd_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MetricStats.ProtoReflect.Descriptor instead.
+func (*MetricStats) Descriptor() ([]byte, []int) {
+	return file_pkg_pb_gostatsd_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *MetricStats) GetProcessingTimeNs() int64 {
+	if x != nil {
+		return x.ProcessingTimeNs
+	}
+	return 0
+}
+
+func (x *MetricStats) GetNumStats() uint32 {
+	if x != nil {
+		return x.NumStats
+	}
+	return 0
+}
+
+func (x *MetricStats) GetDroppedCounters() uint32 {
+	if x != nil {
+		return x.DroppedCounters
+	}
+	return 0
+}
+
+func (x *MetricStats) GetKeys() *KeyCounts {
+	if x != nil {
+		return x.Keys
+	}
+	return nil
+}
+
+func (x *MetricStats) GetNewKeys() *KeyCounts {
+	if x != nil {
+		return x.NewKeys
+	}
+	return nil
+}
+
+func (x *MetricStats) GetExpiredKeys() *KeyCounts {
+	if x != nil {
+		return x.ExpiredKeys
+	}
+	return nil
+}
+
+type KeyCounts struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Counters      uint32                 `protobuf:"varint,1,opt,name=counters,proto3" json:"counters,omitempty"`
+	Timers        uint32                 `protobuf:"varint,2,opt,name=timers,proto3" json:"timers,omitempty"`
+	Gauges        uint32                 `protobuf:"varint,3,opt,name=gauges,proto3" json:"gauges,omitempty"`
+	Sets          uint32                 `protobuf:"varint,4,opt,name=sets,proto3" json:"sets,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *KeyCounts) Reset() {
+	*x = KeyCounts{}
+	mi := &file_pkg_pb_gostatsd_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *KeyCounts) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*KeyCounts) ProtoMessage() {}
+
+func (x *KeyCounts) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_pb_gostatsd_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use KeyCounts.ProtoReflect.Descriptor instead.
+func (*KeyCounts) Descriptor() ([]byte, []int) {
+	return file_pkg_pb_gostatsd_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *KeyCounts) GetCounters() uint32 {
+	if x != nil {
+		return x.Counters
+	}
+	return 0
+}
+
+func (x *KeyCounts) GetTimers() uint32 {
+	if x != nil {
+		return x.Timers
+	}
+	return 0
+}
+
+func (x *KeyCounts) GetGauges() uint32 {
+	if x != nil {
+		return x.Gauges
+	}
+	return 0
+}
+
+func (x *KeyCounts) GetSets() uint32 {
+	if x != nil {
+		return x.Sets
+	}
+	return 0
+}
+
+type Counter struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Name     string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	TagsKey  string                 `protobuf:"bytes,2,opt,name=tags_key,json=tagsKey,proto3" json:"tags_key,omitempty"`
+	Tags     []string               `protobuf:"bytes,3,rep,name=tags,proto3" json:"tags,omitempty"`
+	Hostname string                 `protobuf:"bytes,4,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	Unit     string                 `protobuf:"bytes,5,opt,name=unit,proto3" json:"unit,omitempty"`
+	// Nanoseconds since the Unix epoch.
+	Timestamp     int64   `protobuf:"varint,6,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Value         int64   `protobuf:"varint,7,opt,name=value,proto3" json:"value,omitempty"`
+	PerSecond     float64 `protobuf:"fixed64,8,opt,name=per_second,json=perSecond,proto3" json:"per_second,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Counter) Reset() {
+	*x = Counter{}
+	mi := &file_pkg_pb_gostatsd_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Counter) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Counter) ProtoMessage() {}
+
+func (x *Counter) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_pb_gostatsd_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Counter.ProtoReflect.Descriptor instead.
+func (*Counter) Descriptor() ([]byte, []int) {
+	return file_pkg_pb_gostatsd_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *Counter) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Counter) GetTagsKey() string {
+	if x != nil {
+		return x.TagsKey
+	}
+	return ""
+}
+
+func (x *Counter) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *Counter) GetHostname() string {
+	if x != nil {
+		return x.Hostname
+	}
+	return ""
+}
+
+func (x *Counter) GetUnit() string {
+	if x != nil {
+		return x.Unit
+	}
+	return ""
+}
+
+func (x *Counter) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *Counter) GetValue() int64 {
+	if x != nil {
+		return x.Value
+	}
+	return 0
+}
+
+func (x *Counter) GetPerSecond() float64 {
+	if x != nil {
+		return x.PerSecond
+	}
+	return 0
+}
+
+type Timer struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Name     string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	TagsKey  string                 `protobuf:"bytes,2,opt,name=tags_key,json=tagsKey,proto3" json:"tags_key,omitempty"`
+	Tags     []string               `protobuf:"bytes,3,rep,name=tags,proto3" json:"tags,omitempty"`
+	Hostname string                 `protobuf:"bytes,4,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	Unit     string                 `protobuf:"bytes,5,opt,name=unit,proto3" json:"unit,omitempty"`
+	// Nanoseconds since the Unix epoch.
+	Timestamp   int64         `protobuf:"varint,6,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Count       int64         `protobuf:"varint,7,opt,name=count,proto3" json:"count,omitempty"`
+	PerSecond   float64       `protobuf:"fixed64,8,opt,name=per_second,json=perSecond,proto3" json:"per_second,omitempty"`
+	Mean        float64       `protobuf:"fixed64,9,opt,name=mean,proto3" json:"mean,omitempty"`
+	Median      float64       `protobuf:"fixed64,10,opt,name=median,proto3" json:"median,omitempty"`
+	Min         float64       `protobuf:"fixed64,11,opt,name=min,proto3" json:"min,omitempty"`
+	Max         float64       `protobuf:"fixed64,12,opt,name=max,proto3" json:"max,omitempty"`
+	StdDev      float64       `protobuf:"fixed64,13,opt,name=std_dev,json=stdDev,proto3" json:"std_dev,omitempty"`
+	Sum         float64       `protobuf:"fixed64,14,opt,name=sum,proto3" json:"sum,omitempty"`
+	SumSquares  float64       `protobuf:"fixed64,15,opt,name=sum_squares,json=sumSquares,proto3" json:"sum_squares,omitempty"`
+	Values      []float64     `protobuf:"fixed64,16,rep,packed,name=values,proto3" json:"values,omitempty"`
+	Percentiles []*Percentile `protobuf:"bytes,17,rep,name=percentiles,proto3" json:"percentiles,omitempty"`
+	// Digest of the values of a digested timer, which has no values.
+	Digest        *TDigest `protobuf:"bytes,18,opt,name=digest,proto3" json:"digest,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Timer) Reset() {
+	*x = Timer{}
+	mi := &file_pkg_pb_gostatsd_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Timer) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Timer) ProtoMessage() {}
+
+func (x *Timer) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_pb_gostatsd_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Timer.ProtoReflect.Descriptor instead.
+func (*Timer) Descriptor() ([]byte, []int) {
+	return file_pkg_pb_gostatsd_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *Timer) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Timer) GetTagsKey() string {
+	if x != nil {
+		return x.TagsKey
+	}
+	return ""
+}
+
+func (x *Timer) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *Timer) GetHostname() string {
+	if x != nil {
+		return x.Hostname
+	}
+	return ""
+}
+
+func (x *Timer) GetUnit() string {
+	if x != nil {
+		return x.Unit
+	}
+	return ""
+}
+
+func (x *Timer) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *Timer) GetCount() int64 {
+	if x != nil {
+		return x.Count
+	}
+	return 0
+}
+
+func (x *Timer) GetPerSecond() float64 {
+	if x != nil {
+		return x.PerSecond
+	}
+	return 0
+}
+
+func (x *Timer) GetMean() float64 {
+	if x != nil {
+		return x.Mean
+	}
+	return 0
+}
+
+func (x *Timer) GetMedian() float64 {
+	if x != nil {
+		return x.Median
+	}
+	return 0
+}
+
+func (x *Timer) GetMin() float64 {
+	if x != nil {
+		return x.Min
+	}
+	return 0
+}
+
+func (x *Timer) GetMax() float64 {
+	if x != nil {
+		return x.Max
+	}
+	return 0
+}
+
+func (x *Timer) GetStdDev() float64 {
+	if x != nil {
+		return x.StdDev
+	}
+	return 0
+}
+
+func (x *Timer) GetSum() float64 {
+	if x != nil {
+		return x.Sum
+	}
+	return 0
+}
+
+func (x *Timer) GetSumSquares() float64 {
+	if x != nil {
+		return x.SumSquares
+	}
+	return 0
+}
+
+func (x *Timer) GetValues() []float64 {
+	if x != nil {
+		return x.Values
+	}
+	return nil
+}
+
+func (x *Timer) GetPercentiles() []*Percentile {
+	if x != nil {
+		return x.Percentiles
+	}
+	return nil
+}
+
+func (x *Timer) GetDigest() *TDigest {
+	if x != nil {
+		return x.Digest
+	}
+	return nil
+}
+
+type Percentile struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Value         float64                `protobuf:"fixed64,2,opt,name=value,proto3" json:"value,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Percentile) Reset() {
+	*x = Percentile{}
+	mi := &file_pkg_pb_gostatsd_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Percentile) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Percentile) ProtoMessage() {}
+
+func (x *Percentile) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_pb_gostatsd_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Percentile.ProtoReflect.Descriptor instead.
+func (*Percentile) Descriptor() ([]byte, []int) {
+	return file_pkg_pb_gostatsd_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *Percentile) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Percentile) GetValue() float64 {
+	if x != nil {
+		return x.Value
+	}
+	return 0
+}
+
+// TDigest is the state of a digest, see gostatsd.TDigest.
+type TDigest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Compression   float64                `protobuf:"fixed64,1,opt,name=compression,proto3" json:"compression,omitempty"`
+	Min           float64                `protobuf:"fixed64,2,opt,name=min,proto3" json:"min,omitempty"`
+	Max           float64                `protobuf:"fixed64,3,opt,name=max,proto3" json:"max,omitempty"`
+	Sum           float64                `protobuf:"fixed64,4,opt,name=sum,proto3" json:"sum,omitempty"`
+	SumSquares    float64                `protobuf:"fixed64,5,opt,name=sum_squares,json=sumSquares,proto3" json:"sum_squares,omitempty"`
+	Centroids     []*Centroid            `protobuf:"bytes,6,rep,name=centroids,proto3" json:"centroids,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TDigest) Reset() {
+	*x = TDigest{}
+	mi := &file_pkg_pb_gostatsd_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TDigest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TDigest) ProtoMessage() {}
+
+func (x *TDigest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_pb_gostatsd_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TDigest.ProtoReflect.Descriptor instead.
+func (*TDigest) Descriptor() ([]byte, []int) {
+	return file_pkg_pb_gostatsd_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *TDigest) GetCompression() float64 {
+	if x != nil {
+		return x.Compression
+	}
+	return 0
+}
+
+func (x *TDigest) GetMin() float64 {
+	if x != nil {
+		return x.Min
+	}
+	return 0
+}
+
+func (x *TDigest) GetMax() float64 {
+	if x != nil {
+		return x.Max
+	}
+	return 0
+}
+
+func (x *TDigest) GetSum() float64 {
+	if x != nil {
+		return x.Sum
+	}
+	return 0
+}
+
+func (x *TDigest) GetSumSquares() float64 {
+	if x != nil {
+		return x.SumSquares
+	}
+	return 0
+}
+
+func (x *TDigest) GetCentroids() []*Centroid {
+	if x != nil {
+		return x.Centroids
+	}
+	return nil
+}
+
+type Centroid struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Mean          float64                `protobuf:"fixed64,1,opt,name=mean,proto3" json:"mean,omitempty"`
+	Weight        float64                `protobuf:"fixed64,2,opt,name=weight,proto3" json:"weight,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Centroid) Reset() {
+	*x = Centroid{}
+	mi := &file_pkg_pb_gostatsd_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Centroid) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Centroid) ProtoMessage() {}
+
+func (x *Centroid) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_pb_gostatsd_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Centroid.ProtoReflect.Descriptor instead.
+func (*Centroid) Descriptor() ([]byte, []int) {
+	return file_pkg_pb_gostatsd_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *Centroid) GetMean() float64 {
+	if x != nil {
+		return x.Mean
+	}
+	return 0
+}
+
+func (x *Centroid) GetWeight() float64 {
+	if x != nil {
+		return x.Weight
+	}
+	return 0
+}
+
+type Gauge struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Name     string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	TagsKey  string                 `protobuf:"bytes,2,opt,name=tags_key,json=tagsKey,proto3" json:"tags_key,omitempty"`
+	Tags     []string               `protobuf:"bytes,3,rep,name=tags,proto3" json:"tags,omitempty"`
+	Hostname string                 `protobuf:"bytes,4,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	Unit     string                 `protobuf:"bytes,5,opt,name=unit,proto3" json:"unit,omitempty"`
+	// Nanoseconds since the Unix epoch.
+	Timestamp     int64   `protobuf:"varint,6,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Value         float64 `protobuf:"fixed64,7,opt,name=value,proto3" json:"value,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Gauge) Reset() {
+	*x = Gauge{}
+	mi := &file_pkg_pb_gostatsd_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Gauge) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Gauge) ProtoMessage() {}
+
+func (x *Gauge) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_pb_gostatsd_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Gauge.ProtoReflect.Descriptor instead.
+func (*Gauge) Descriptor() ([]byte, []int) {
+	return file_pkg_pb_gostatsd_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *Gauge) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Gauge) GetTagsKey() string {
+	if x != nil {
+		return x.TagsKey
+	}
+	return ""
+}
+
+func (x *Gauge) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *Gauge) GetHostname() string {
+	if x != nil {
+		return x.Hostname
+	}
+	return ""
+}
+
+func (x *Gauge) GetUnit() string {
+	if x != nil {
+		return x.Unit
+	}
+	return ""
+}
+
+func (x *Gauge) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *Gauge) GetValue() float64 {
+	if x != nil {
+		return x.Value
+	}
+	return 0
+}
+
+type Set struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Name     string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	TagsKey  string                 `protobuf:"bytes,2,opt,name=tags_key,json=tagsKey,proto3" json:"tags_key,omitempty"`
+	Tags     []string               `protobuf:"bytes,3,rep,name=tags,proto3" json:"tags,omitempty"`
+	Hostname string                 `protobuf:"bytes,4,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	Unit     string                 `protobuf:"bytes,5,opt,name=unit,proto3" json:"unit,omitempty"`
+	// Nanoseconds since the Unix epoch.
+	Timestamp     int64    `protobuf:"varint,6,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Values        []string `protobuf:"bytes,7,rep,name=values,proto3" json:"values,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Set) Reset() {
+	*x = Set{}
+	mi := &file_pkg_pb_gostatsd_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Set) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Set) ProtoMessage() {}
+
+func (x *Set) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_pb_gostatsd_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Set.ProtoReflect.Descriptor instead.
+func (*Set) Descriptor() ([]byte, []int) {
+	return file_pkg_pb_gostatsd_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *Set) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Set) GetTagsKey() string {
+	if x != nil {
+		return x.TagsKey
+	}
+	return ""
+}
+
+func (x *Set) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *Set) GetHostname() string {
+	if x != nil {
+		return x.Hostname
+	}
+	return ""
+}
+
+func (x *Set) GetUnit() string {
+	if x != nil {
+		return x.Unit
+	}
+	return ""
+}
+
+func (x *Set) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *Set) GetValues() []string {
+	if x != nil {
+		return x.Values
+	}
+	return nil
+}
+
+var File_pkg_pb_gostatsd_proto protoreflect.FileDescriptor
+
+const file_pkg_pb_gostatsd_proto_rawDesc = "" +
+	"\n" +
+	"\x15pkg/pb/gostatsd.proto\x12\vgostatsd.pb\"\x84\x02\n" +
+	"\x06Metric\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x01R\x05value\x12\x12\n" +
+	"\x04tags\x18\x03 \x03(\tR\x04tags\x12!\n" +
+	"\fstring_value\x18\x04 \x01(\tR\vstringValue\x12\x12\n" +
+	"\x04unit\x18\x05 \x01(\tR\x04unit\x12\x1a\n" +
+	"\bhostname\x18\x06 \x01(\tR\bhostname\x12\x1b\n" +
+	"\tsource_ip\x18\a \x01(\tR\bsourceIp\x12+\n" +
+	"\x04type\x18\b \x01(\x0e2\x17.gostatsd.pb.MetricTypeR\x04type\x12\x1f\n" +
+	"\vgauge_delta\x18\t \x01(\bR\n" +
+	"gaugeDelta\"\x97\x02\n" +
+	"\tMetricMap\x12.\n" +
+	"\x05stats\x18\x01 \x01(\v2\x18.gostatsd.pb.MetricStatsR\x05stats\x12*\n" +
+	"\x11flush_interval_ns\x18\x02 \x01(\x03R\x0fflushIntervalNs\x120\n" +
+	"\bcounters\x18\x03 \x03(\v2\x14.gostatsd.pb.CounterR\bcounters\x12*\n" +
+	"\x06timers\x18\x04 \x03(\v2\x12.gostatsd.pb.TimerR\x06timers\x12*\n" +
+	"\x06gauges\x18\x05 \x03(\v2\x12.gostatsd.pb.GaugeR\x06gauges\x12$\n" +
+	"\x04sets\x18\x06 \x03(\v2\x10.gostatsd.pb.SetR\x04sets\"\x9d\x02\n" +
+	"\vMetricStats\x12,\n" +
+	"\x12processing_time_ns\x18\x01 \x01(\x03R\x10processingTimeNs\x12\x1b\n" +
+	"\tnum_stats\x18\x02 \x01(\rR\bnumStats\x12)\n" +
+	"\x10dropped_counters\x18\x03 \x01(\rR\x0fdroppedCounters\x12*\n" +
+	"\x04keys\x18\x04 \x01(\v2\x16.gostatsd.pb.KeyCountsR\x04keys\x121\n" +
+	"\bnew_keys\x18\x05 \x01(\v2\x16.gostatsd.pb.KeyCountsR\anewKeys\x129\n" +
+	"\fexpired_keys\x18\x06 \x01(\v2\x16.gostatsd.pb.KeyCountsR\vexpiredKeys\"k\n" +
+	"\tKeyCounts\x12\x1a\n" +
+	"\bcounters\x18\x01 \x01(\rR\bcounters\x12\x16\n" +
+	"\x06timers\x18\x02 \x01(\rR\x06timers\x12\x16\n" +
+	"\x06gauges\x18\x03 \x01(\rR\x06gauges\x12\x12\n" +
+	"\x04sets\x18\x04 \x01(\rR\x04sets\"\xcf\x01\n" +
+	"\aCounter\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x19\n" +
+	"\btags_key\x18\x02 \x01(\tR\atagsKey\x12\x12\n" +
+	"\x04tags\x18\x03 \x03(\tR\x04tags\x12\x1a\n" +
+	"\bhostname\x18\x04 \x01(\tR\bhostname\x12\x12\n" +
+	"\x04unit\x18\x05 \x01(\tR\x04unit\x12\x1c\n" +
+	"\ttimestamp\x18\x06 \x01(\x03R\ttimestamp\x12\x14\n" +
+	"\x05value\x18\a \x01(\x03R\x05value\x12\x1d\n" +
+	"\n" +
+	"per_second\x18\b \x01(\x01R\tperSecond\"\xea\x03\n" +
+	"\x05Timer\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x19\n" +
+	"\btags_key\x18\x02 \x01(\tR\atagsKey\x12\x12\n" +
+	"\x04tags\x18\x03 \x03(\tR\x04tags\x12\x1a\n" +
+	"\bhostname\x18\x04 \x01(\tR\bhostname\x12\x12\n" +
+	"\x04unit\x18\x05 \x01(\tR\x04unit\x12\x1c\n" +
+	"\ttimestamp\x18\x06 \x01(\x03R\ttimestamp\x12\x14\n" +
+	"\x05count\x18\a \x01(\x03R\x05count\x12\x1d\n" +
+	"\n" +
+	"per_second\x18\b \x01(\x01R\tperSecond\x12\x12\n" +
+	"\x04mean\x18\t \x01(\x01R\x04mean\x12\x16\n" +
+	"\x06median\x18\n" +
+	" \x01(\x01R\x06median\x12\x10\n" +
+	"\x03min\x18\v \x01(\x01R\x03min\x12\x10\n" +
+	"\x03max\x18\f \x01(\x01R\x03max\x12\x17\n" +
+	"\astd_dev\x18\r \x01(\x01R\x06stdDev\x12\x10\n" +
+	"\x03sum\x18\x0e \x01(\x01R\x03sum\x12\x1f\n" +
+	"\vsum_squares\x18\x0f \x01(\x01R\n" +
+	"sumSquares\x12\x16\n" +
+	"\x06values\x18\x10 \x03(\x01R\x06values\x129\n" +
+	"\vpercentiles\x18\x11 \x03(\v2\x17.gostatsd.pb.PercentileR\vpercentiles\x12,\n" +
+	"\x06digest\x18\x12 \x01(\v2\x14.gostatsd.pb.TDigestR\x06digest\"6\n" +
+	"\n" +
+	"Percentile\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x01R\x05value\"\xb7\x01\n" +
+	"\aTDigest\x12 \n" +
+	"\vcompression\x18\x01 \x01(\x01R\vcompression\x12\x10\n" +
+	"\x03min\x18\x02 \x01(\x01R\x03min\x12\x10\n" +
+	"\x03max\x18\x03 \x01(\x01R\x03max\x12\x10\n" +
+	"\x03sum\x18\x04 \x01(\x01R\x03sum\x12\x1f\n" +
+	"\vsum_squares\x18\x05 \x01(\x01R\n" +
+	"sumSquares\x123\n" +
+	"\tcentroids\x18\x06 \x03(\v2\x15.gostatsd.pb.CentroidR\tcentroids\"6\n" +
+	"\bCentroid\x12\x12\n" +
+	"\x04mean\x18\x01 \x01(\x01R\x04mean\x12\x16\n" +
+	"\x06weight\x18\x02 \x01(\x01R\x06weight\"\xae\x01\n" +
+	"\x05Gauge\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x19\n" +
+	"\btags_key\x18\x02 \x01(\tR\atagsKey\x12\x12\n" +
+	"\x04tags\x18\x03 \x03(\tR\x04tags\x12\x1a\n" +
+	"\bhostname\x18\x04 \x01(\tR\bhostname\x12\x12\n" +
+	"\x04unit\x18\x05 \x01(\tR\x04unit\x12\x1c\n" +
+	"\ttimestamp\x18\x06 \x01(\x03R\ttimestamp\x12\x14\n" +
+	"\x05value\x18\a \x01(\x01R\x05value\"\xae\x01\n" +
+	"\x03Set\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x19\n" +
+	"\btags_key\x18\x02 \x01(\tR\atagsKey\x12\x12\n" +
+	"\x04tags\x18\x03 \x03(\tR\x04tags\x12\x1a\n" +
+	"\bhostname\x18\x04 \x01(\tR\bhostname\x12\x12\n" +
+	"\x04unit\x18\x05 \x01(\tR\x04unit\x12\x1c\n" +
+	"\ttimestamp\x18\x06 \x01(\x03R\ttimestamp\x12\x16\n" +
+	"\x06values\x18\a \x03(\tR\x06values*E\n" +
+	"\n" +
+	"MetricType\x12\v\n" +
+	"\aUNKNOWN\x10\x00\x12\v\n" +
+	"\aCOUNTER\x10\x01\x12\t\n" +
+	"\x05TIMER\x10\x02\x12\t\n" +
+	"\x05GAUGE\x10\x03\x12\a\n" +
+	"\x03SET\x10\x04B&Z$github.com/atlassian/gostatsd/pkg/pbb\x06proto3"
+
+var (
+	file_pkg_pb_gostatsd_proto_rawDescOnce sync.Once
+	file_pkg_pb_gostatsd_proto_rawDescData []byte
+)
+
+func file_pkg_pb_gostatsd_proto_rawDescGZIP() []byte {
+	file_pkg_pb_gostatsd_proto_rawDescOnce.Do(func() {
+		file_pkg_pb_gostatsd_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_pkg_pb_gostatsd_proto_rawDesc), len(file_pkg_pb_gostatsd_proto_rawDesc)))
+	})
+	return file_pkg_pb_gostatsd_proto_rawDescData
+}
+
+var file_pkg_pb_gostatsd_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_pkg_pb_gostatsd_proto_msgTypes = make([]protoimpl.MessageInfo, 11)
+var file_pkg_pb_gostatsd_proto_goTypes = []any{
+	(MetricType)(0),     // 0: gostatsd.pb.MetricType
+	(*Metric)(nil),      // 1: gostatsd.pb.Metric
+	(*MetricMap)(nil),   // 2: gostatsd.pb.MetricMap
+	(*MetricStats)(nil), // 3: gostatsd.pb.MetricStats
+	(*KeyCounts)(nil),   // 4: gostatsd.pb.KeyCounts
+	(*Counter)(nil),     // 5: gostatsd.pb.Counter
+	(*Timer)(nil),       // 6: gostatsd.pb.Timer
+	(*Percentile)(nil),  // 7: gostatsd.pb.Percentile
+	(*TDigest)(nil),     // 8: gostatsd.pb.TDigest
+	(*Centroid)(nil),    // 9: gostatsd.pb.Centroid
+	(*Gauge)(nil),       // 10: gostatsd.pb.Gauge
+	(*Set)(nil),         // 11: gostatsd.pb.Set
+}
+var file_pkg_pb_gostatsd_proto_depIdxs = []int32{
+	0,  // 0: gostatsd.pb.Metric.type:type_name -> gostatsd.pb.MetricType
+	3,  // 1: gostatsd.pb.MetricMap.stats:type_name -> gostatsd.pb.MetricStats
+	5,  // 2: gostatsd.pb.MetricMap.counters:type_name -> gostatsd.pb.Counter
+	6,  // 3: gostatsd.pb.MetricMap.timers:type_name -> gostatsd.pb.Timer
+	10, // 4: gostatsd.pb.MetricMap.gauges:type_name -> gostatsd.pb.Gauge
+	11, // 5: gostatsd.pb.MetricMap.sets:type_name -> gostatsd.pb.Set
+	4,  // 6: gostatsd.pb.MetricStats.keys:type_name -> gostatsd.pb.KeyCounts
+	4,  // 7: gostatsd.pb.MetricStats.new_keys:type_name -> gostatsd.pb.KeyCounts
+	4,  // 8: gostatsd.pb.MetricStats.expired_keys:type_name -> gostatsd.pb.KeyCounts
+	7,  // 9: gostatsd.pb.Timer.percentiles:type_name -> gostatsd.pb.Percentile
+	8,  // 10: gostatsd.pb.Timer.digest:type_name -> gostatsd.pb.TDigest
+	9,  // 11: gostatsd.pb.TDigest.centroids:type_name -> gostatsd.pb.Centroid
+	12, // [12:12] is the sub-list for method output_type
+	12, // [12:12] is the sub-list for method input_type
+	12, // [12:12] is the sub-list for extension type_name
+	12, // [12:12] is the sub-list for extension extendee
+	0,  // [0:12] is the sub-list for field type_name
+}
+
+func init() { file_pkg_pb_gostatsd_proto_init() }
+func file_pkg_pb_gostatsd_proto_init() {
+	if File_pkg_pb_gostatsd_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_pkg_pb_gostatsd_proto_rawDesc), len(file_pkg_pb_gostatsd_proto_rawDesc)),
+			NumEnums:      1,
+			NumMessages:   11,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_pkg_pb_gostatsd_proto_goTypes,
+		DependencyIndexes: file_pkg_pb_gostatsd_proto_depIdxs,
+		EnumInfos:         file_pkg_pb_gostatsd_proto_enumTypes,
+		MessageInfos:      file_pkg_pb_gostatsd_proto_msgTypes,
+	}.Build()
+	File_pkg_pb_gostatsd_proto = out.File
+	file_pkg_pb_gostatsd_proto_goTypes = nil
+	file_pkg_pb_gostatsd_proto_depIdxs = nil
+}
@@ -0,0 +1,227 @@
+// Package bolt persists snapshots of aggregated metrics to BoltDB files for crash recovery.
+package bolt
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// SnapshotVersion is the version of the snapshot format written by WriteSnapshot.
+const SnapshotVersion = 1
+
+var (
+	metaBucket     = []byte("meta")
+	countersBucket = []byte("counters")
+	timersBucket   = []byte("timers")
+	gaugesBucket   = []byte("gauges")
+	setsBucket     = []byte("sets")
+
+	versionKey = []byte("version")
+	timeKey    = []byte("time")
+)
+
+// keySeparator separates the name and the tags key of a metric in bucket keys. Names cannot contain it.
+const keySeparator = "\x00"
+
+// openTimeout is how long to wait for the lock of a snapshot file held by another process.
+const openTimeout = time.Second
+
+// WriteSnapshot atomically replaces the snapshot at the path with the MetricMap taken at the time.
+// The snapshot is written to a temporary file in the same directory which is then renamed to the path.
+func WriteSnapshot(path string, m *gostatsd.MetricMap, taken time.Time) error {
+	tmpPath := path + ".tmp"
+	if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	db, err := bolt.Open(tmpPath, 0600, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return writeMetricMap(tx, m, taken)
+	})
+	if errClose := db.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// ReadSnapshot reads the snapshot at the path and returns its metrics and the time it was taken.
+// If the snapshot does not exist, the returned error satisfies os.IsNotExist.
+func ReadSnapshot(path string) (*gostatsd.MetricMap, time.Time, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, time.Time{}, err // Open would create the file
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: openTimeout, ReadOnly: true})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer db.Close() // #nosec
+	m := &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{},
+		Timers:   gostatsd.Timers{},
+		Gauges:   gostatsd.Gauges{},
+		Sets:     gostatsd.Sets{},
+	}
+	var taken time.Time
+	err = db.View(func(tx *bolt.Tx) error {
+		var errRead error
+		taken, errRead = readMeta(tx)
+		if errRead != nil {
+			return errRead
+		}
+		return readMetricMap(tx, m)
+	})
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to read snapshot: %v", err)
+	}
+	return m, taken, nil
+}
+
+func writeMetricMap(tx *bolt.Tx, m *gostatsd.MetricMap, taken time.Time) error {
+	meta, err := tx.CreateBucket(metaBucket)
+	if err != nil {
+		return err
+	}
+	if err = meta.Put(versionKey, []byte(strconv.Itoa(SnapshotVersion))); err != nil {
+		return err
+	}
+	if err = meta.Put(timeKey, []byte(strconv.FormatInt(taken.UnixNano(), 10))); err != nil {
+		return err
+	}
+	buckets := make(map[string]*bolt.Bucket, 4)
+	for _, name := range [][]byte{countersBucket, timersBucket, gaugesBucket, setsBucket} {
+		b, errCreate := tx.CreateBucket(name)
+		if errCreate != nil {
+			return errCreate
+		}
+		buckets[string(name)] = b
+	}
+	put := func(bucket []byte, key, tagsKey string, value interface{}) {
+		if err != nil {
+			return
+		}
+		var data []byte
+		if data, err = json.Marshal(value); err == nil {
+			err = buckets[string(bucket)].Put([]byte(key+keySeparator+tagsKey), data)
+		}
+	}
+	m.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		put(countersBucket, key, tagsKey, counter)
+	})
+	m.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		put(timersBucket, key, tagsKey, timer)
+	})
+	m.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		put(gaugesBucket, key, tagsKey, gauge)
+	})
+	m.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+		put(setsBucket, key, tagsKey, set)
+	})
+	return err
+}
+
+func readMeta(tx *bolt.Tx) (time.Time, error) {
+	meta := tx.Bucket(metaBucket)
+	if meta == nil {
+		return time.Time{}, fmt.Errorf("missing %s bucket", metaBucket)
+	}
+	version, err := strconv.Atoi(string(meta.Get(versionKey)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid snapshot version: %v", err)
+	}
+	if version != SnapshotVersion {
+		return time.Time{}, fmt.Errorf("unsupported snapshot version %d, expected %d", version, SnapshotVersion)
+	}
+	nanos, err := strconv.ParseInt(string(meta.Get(timeKey)), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid snapshot time: %v", err)
+	}
+	return time.Unix(0, nanos), nil
+}
+
+func readMetricMap(tx *bolt.Tx, m *gostatsd.MetricMap) error {
+	err := forEach(tx, countersBucket, func(key, tagsKey string, data []byte) error {
+		var counter gostatsd.Counter
+		if err := json.Unmarshal(data, &counter); err != nil {
+			return err
+		}
+		if _, ok := m.Counters[key]; !ok {
+			m.Counters[key] = make(map[string]gostatsd.Counter)
+		}
+		m.Counters[key][tagsKey] = counter
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = forEach(tx, timersBucket, func(key, tagsKey string, data []byte) error {
+		var timer gostatsd.Timer
+		if err := json.Unmarshal(data, &timer); err != nil {
+			return err
+		}
+		if _, ok := m.Timers[key]; !ok {
+			m.Timers[key] = make(map[string]gostatsd.Timer)
+		}
+		m.Timers[key][tagsKey] = timer
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = forEach(tx, gaugesBucket, func(key, tagsKey string, data []byte) error {
+		var gauge gostatsd.Gauge
+		if err := json.Unmarshal(data, &gauge); err != nil {
+			return err
+		}
+		if _, ok := m.Gauges[key]; !ok {
+			m.Gauges[key] = make(map[string]gostatsd.Gauge)
+		}
+		m.Gauges[key][tagsKey] = gauge
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return forEach(tx, setsBucket, func(key, tagsKey string, data []byte) error {
+		var set gostatsd.Set
+		if err := json.Unmarshal(data, &set); err != nil {
+			return err
+		}
+		if set.Values == nil {
+			set.Values = make(map[string]struct{})
+		}
+		if _, ok := m.Sets[key]; !ok {
+			m.Sets[key] = make(map[string]gostatsd.Set)
+		}
+		m.Sets[key][tagsKey] = set
+		return nil
+	})
+}
+
+// forEach calls f with the name, the tags key and the value of each metric in the bucket.
+func forEach(tx *bolt.Tx, bucket []byte, f func(key, tagsKey string, data []byte) error) error {
+	b := tx.Bucket(bucket)
+	if b == nil {
+		return fmt.Errorf("missing %s bucket", bucket)
+	}
+	return b.ForEach(func(k, v []byte) error {
+		parts := strings.SplitN(string(k), keySeparator, 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid key %q in %s bucket", k, bucket)
+		}
+		return f(parts[0], parts[1], v)
+	})
+}
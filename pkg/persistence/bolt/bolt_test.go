@@ -0,0 +1,111 @@
+package bolt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMetricMap() *gostatsd.MetricMap {
+	return &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{},
+		Timers:   gostatsd.Timers{},
+		Gauges:   gostatsd.Gauges{},
+		Sets:     gostatsd.Sets{},
+	}
+}
+
+func tempSnapshotPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "gostatsd")
+	require.NoError(t, err)
+	return filepath.Join(dir, "snapshot.db"), func() {
+		os.RemoveAll(dir) // #nosec
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	t.Parallel()
+	path, cleanup := tempSnapshotPath(t)
+	defer cleanup()
+	m := newMetricMap()
+	m.Counters["c"] = map[string]gostatsd.Counter{
+		"a:b":     gostatsd.NewCounter(10, 5, "h", gostatsd.Tags{"a:b"}),
+		"a:b,c:d": gostatsd.NewCounter(10, -1, "", gostatsd.Tags{"a:b", "c:d"}),
+	}
+	m.Timers["t"] = map[string]gostatsd.Timer{"": gostatsd.NewTimer(10, []float64{1, 2}, "", nil)}
+	m.Gauges["g"] = map[string]gostatsd.Gauge{"": gostatsd.NewGauge(10, 1.5, "", nil)}
+	m.Sets["s"] = map[string]gostatsd.Set{"": gostatsd.NewSet(10, map[string]struct{}{"x": {}}, "", nil)}
+	taken := time.Unix(1500000000, 123)
+
+	require.NoError(t, WriteSnapshot(path, m, taken))
+	read, readTaken, err := ReadSnapshot(path)
+	require.NoError(t, err)
+	assert.Equal(t, m, read)
+	assert.True(t, taken.Equal(readTaken))
+}
+
+func TestSnapshotRoundTripDigest(t *testing.T) {
+	t.Parallel()
+	path, cleanup := tempSnapshotPath(t)
+	defer cleanup()
+	d := gostatsd.NewTDigest(gostatsd.DefaultTDigestCompression)
+	for i := 1; i <= 1000; i++ {
+		d.Add(float64(i))
+	}
+	m := newMetricMap()
+	m.Timers["t"] = map[string]gostatsd.Timer{"": {Count: 1000, Digest: d, Timestamp: 10}}
+
+	require.NoError(t, WriteSnapshot(path, m, time.Now()))
+	read, _, err := ReadSnapshot(path)
+	require.NoError(t, err)
+	timer := read.Timers["t"][""]
+	require.NotNil(t, timer.Digest)
+	assert.Equal(t, 1000, timer.NumValues())
+	assert.Equal(t, d.Centroids(), timer.Digest.Centroids())
+	assert.Equal(t, d.Quantile(0.99), timer.Digest.Quantile(0.99))
+}
+
+func TestSnapshotReplaced(t *testing.T) {
+	t.Parallel()
+	path, cleanup := tempSnapshotPath(t)
+	defer cleanup()
+	first := newMetricMap()
+	first.Gauges["g"] = map[string]gostatsd.Gauge{"": gostatsd.NewGauge(10, 1, "", nil)}
+	second := newMetricMap()
+	second.Counters["c"] = map[string]gostatsd.Counter{"": gostatsd.NewCounter(20, 2, "", nil)}
+
+	require.NoError(t, WriteSnapshot(path, first, time.Unix(1, 0)))
+	require.NoError(t, WriteSnapshot(path, second, time.Unix(2, 0)))
+	read, taken, err := ReadSnapshot(path)
+	require.NoError(t, err)
+	assert.Equal(t, second, read)
+	assert.Equal(t, int64(2), taken.Unix())
+	_, err = os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err), "temporary file must be renamed")
+}
+
+func TestReadSnapshotMissing(t *testing.T) {
+	t.Parallel()
+	path, cleanup := tempSnapshotPath(t)
+	defer cleanup()
+	_, _, err := ReadSnapshot(path)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "reading must not create the snapshot")
+}
+
+func TestReadSnapshotInvalid(t *testing.T) {
+	t.Parallel()
+	path, cleanup := tempSnapshotPath(t)
+	defer cleanup()
+	require.NoError(t, ioutil.WriteFile(path, []byte("not a database"), 0600))
+	_, _, err := ReadSnapshot(path)
+	assert.Error(t, err)
+}
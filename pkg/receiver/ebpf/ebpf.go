@@ -0,0 +1,60 @@
+// Package ebpf provides a receiver of statsd metrics sent over UDP that takes datagrams before they reach the
+// network stack, with an XDP program attached to a network interface.
+//
+// The XDP program checks UDP datagrams over IPv4 sent to the port. Datagrams with a single line of the simple
+// name:value|type form, at most MaxPayloadSize bytes long, are copied to a BPF ring buffer and dropped, and lines
+// are read from the ring buffer and handled like lines received by the UDP socket. Other datagrams, e.g. with
+// tags, sample rates, several lines or events, and all IPv6 datagrams, are passed to the network stack and
+// received by the UDP socket, which must still listen on the same port.
+//
+// The receiver requires Linux 5.8 or later for BPF ring buffers, and the CAP_BPF and CAP_NET_ADMIN capabilities
+// (or CAP_SYS_ADMIN before Linux 5.8) to load and attach the program.
+package ebpf
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/pflag"
+
+	"github.com/atlassian/gostatsd/pkg/statsd"
+)
+
+const (
+	// DefaultPort is the default UDP port of datagrams taken by the XDP program, the port of the statsd receiver.
+	DefaultPort = 8125
+	// MaxPayloadSize is the maximum size of datagrams taken by the XDP program, larger ones are passed to the
+	// network stack.
+	MaxPayloadSize = 256
+	// ParamInterface is the name of parameter with the network interface the XDP program is attached to.
+	ParamInterface = "ebpf-interface"
+	// ParamPort is the name of parameter with the UDP port of datagrams taken by the XDP program.
+	ParamPort = "ebpf-port"
+)
+
+// AddFlags adds flags to the specified FlagSet.
+func AddFlags(fs *pflag.FlagSet) {
+	fs.String(ParamInterface, "", "If set, network interface to attach the eBPF receiver of simple metric lines to (Linux 5.8+)")
+	fs.Int(ParamPort, DefaultPort, "UDP port of datagrams taken by the eBPF receiver, must be the port of the metrics address")
+}
+
+// Service returns a statsd.Service that runs the eBPF receiver configured by s.
+// The receiver of the statsd server must be a statsd.LineReceiver.
+func Service(s Server) statsd.Service {
+	return func(ctx context.Context, receiver statsd.Receiver, dispatcher statsd.Dispatcher, flusher statsd.Flusher) error {
+		lines, ok := receiver.(statsd.LineReceiver)
+		if !ok {
+			return fmt.Errorf("receiver %T does not handle lines", receiver)
+		}
+		s.Receiver = lines
+		return s.ListenAndServe(ctx)
+	}
+}
+
+// Server attaches the XDP program to the network Interface and passes lines of datagrams sent to Port to the
+// Receiver.
+type Server struct {
+	Interface string
+	Port      int
+	Receiver  statsd.LineReceiver
+}
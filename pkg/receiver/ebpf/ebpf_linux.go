@@ -0,0 +1,267 @@
+//go:build linux
+// +build linux
+
+package ebpf
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/ringbuf"
+	"github.com/cilium/ebpf/rlimit"
+)
+
+const (
+	programName = "xdp_statsd"
+	eventsName  = "events"
+
+	ethHeaderLen = 14
+	ethTypeIPv4  = 0x0800
+	ipHeaderLen  = 20 // Without options
+	ipProtoUDP   = 17
+	udpHeaderLen = 8
+	// eventHeaderLen is the length of the header of events in the ring buffer: the source address and port in
+	// network byte order, and the length of the payload in host byte order.
+	eventHeaderLen = 8
+	// ringBufferSize is the size of the ring buffer, about 4000 events.
+	ringBufferSize = 1 << 20
+
+	xdpDrop = 1
+	xdpPass = 2
+)
+
+// Parts of a name:value|type line the XDP program is in. Keeping only the part, rather than the positions of the
+// separators, keeps the number of states the verifier explores in the loop small.
+const (
+	stateStart = iota
+	stateName
+	stateColon
+	stateValue
+	statePipe
+	stateType
+	stateEnd // After the trailing newline
+)
+
+// ListenAndServe attaches the XDP program to the interface and handles lines it takes until the context is done.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	iface, err := net.InterfaceByName(s.Interface)
+	if err != nil {
+		return err
+	}
+	port := s.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	// Only needed before Linux 5.11, which accounts memory of BPF objects to cgroups instead
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return fmt.Errorf("failed to remove the limit of locked memory: %v", err)
+	}
+	coll, err := ebpf.NewCollection(collectionSpec(port))
+	if err != nil {
+		return fmt.Errorf("failed to load XDP program: %v", err)
+	}
+	defer coll.Close()
+	l, err := link.AttachXDP(link.XDPOptions{
+		Program:   coll.Programs[programName],
+		Interface: iface.Index,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to attach XDP program to %s: %v", iface.Name, err)
+	}
+	defer l.Close()
+	events, err := ringbuf.NewReader(coll.Maps[eventsName])
+	if err != nil {
+		return err
+	}
+	defer events.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			events.Close() // #nosec Makes ReadInto return
+		case <-done:
+		}
+	}()
+	log.Infof("eBPF receiver attached to %s for UDP port %d", iface.Name, port)
+
+	var record ringbuf.Record
+	for {
+		if err := events.ReadInto(&record); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		addr, line, err := decodeEvent(record.RawSample)
+		if err != nil {
+			log.Warnf("Failed to decode event of the XDP program: %v", err)
+			continue
+		}
+		if _, _, err := s.Receiver.HandleLines(ctx, addr, line); err != nil {
+			if err == context.Canceled || err == context.DeadlineExceeded {
+				return err
+			}
+			log.Warnf("Failed to handle metric from %s: %v", addr, err)
+		}
+	}
+}
+
+// decodeEvent returns the source address and the payload of the datagram of an event of the ring buffer.
+func decodeEvent(b []byte) (*net.UDPAddr, []byte, error) {
+	if len(b) < eventHeaderLen {
+		return nil, nil, errors.New("event too short")
+	}
+	n := int(binary.NativeEndian.Uint16(b[6:8]))
+	if n > len(b)-eventHeaderLen {
+		return nil, nil, fmt.Errorf("payload length %d larger than event", n)
+	}
+	addr := &net.UDPAddr{
+		IP:   net.IPv4(b[0], b[1], b[2], b[3]),
+		Port: int(binary.BigEndian.Uint16(b[4:6])),
+	}
+	return addr, b[eventHeaderLen : eventHeaderLen+n], nil
+}
+
+// collectionSpec returns the XDP program taking simple lines sent to the port and its ring buffer.
+func collectionSpec(port int) *ebpf.CollectionSpec {
+	return &ebpf.CollectionSpec{
+		Maps: map[string]*ebpf.MapSpec{
+			eventsName: {
+				Name:       eventsName,
+				Type:       ebpf.RingBuf,
+				MaxEntries: ringBufferSize,
+			},
+		},
+		Programs: map[string]*ebpf.ProgramSpec{
+			programName: {
+				Name:         programName,
+				Type:         ebpf.XDP,
+				License:      "Apache-2.0",
+				Instructions: program(port),
+			},
+		},
+	}
+}
+
+// program returns the instructions of the XDP program. Registers r6 to r9, which are kept by calls of helpers,
+// hold the start of the payload, the end of the packet, the length of the payload and the reserved event.
+func program(port int) asm.Instructions {
+	return asm.Instructions{
+		asm.LoadMem(asm.R2, asm.R1, 0, asm.Word), // Start of the packet
+		asm.LoadMem(asm.R7, asm.R1, 4, asm.Word),
+
+		// Ethernet header
+		asm.Mov.Reg(asm.R0, asm.R2),
+		asm.Add.Imm(asm.R0, ethHeaderLen+ipHeaderLen),
+		asm.JGT.Reg(asm.R0, asm.R7, "pass"),
+		asm.LoadMem(asm.R0, asm.R2, 12, asm.Half),
+		asm.HostTo(asm.BE, asm.R0, asm.Half),
+		asm.JNE.Imm(asm.R0, ethTypeIPv4, "pass"),
+
+		// IPv4 header of an unfragmented UDP datagram
+		asm.Mov.Reg(asm.R4, asm.R2),
+		asm.Add.Imm(asm.R4, ethHeaderLen),
+		asm.LoadMem(asm.R0, asm.R4, 9, asm.Byte),
+		asm.JNE.Imm(asm.R0, ipProtoUDP, "pass"),
+		asm.LoadMem(asm.R0, asm.R4, 6, asm.Half),
+		asm.HostTo(asm.BE, asm.R0, asm.Half),
+		asm.And.Imm(asm.R0, 0x3fff), // More fragments flag and fragment offset
+		asm.JNE.Imm(asm.R0, 0, "pass"),
+		asm.LoadMem(asm.R0, asm.R4, 12, asm.Word), // Source address
+		asm.StoreMem(asm.RFP, -8, asm.R0, asm.Word),
+		asm.LoadMem(asm.R0, asm.R4, 0, asm.Byte),
+		asm.And.Imm(asm.R0, 0x0f),
+		asm.LSh.Imm(asm.R0, 2), // Header length with options
+		asm.JLT.Imm(asm.R0, ipHeaderLen, "pass"),
+		asm.Add.Reg(asm.R4, asm.R0),
+
+		// UDP header
+		asm.Mov.Reg(asm.R0, asm.R4),
+		asm.Add.Imm(asm.R0, udpHeaderLen),
+		asm.JGT.Reg(asm.R0, asm.R7, "pass"),
+		asm.LoadMem(asm.R0, asm.R4, 2, asm.Half),
+		asm.HostTo(asm.BE, asm.R0, asm.Half),
+		asm.JNE.Imm(asm.R0, int32(port), "pass"),
+		asm.LoadMem(asm.R0, asm.R4, 0, asm.Half), // Source port
+		asm.StoreMem(asm.RFP, -4, asm.R0, asm.Half),
+		asm.LoadMem(asm.R8, asm.R4, 4, asm.Half),
+		asm.HostTo(asm.BE, asm.R8, asm.Half),
+		asm.JLE.Imm(asm.R8, udpHeaderLen, "pass"),
+		asm.Sub.Imm(asm.R8, udpHeaderLen),
+		asm.JGT.Imm(asm.R8, MaxPayloadSize, "pass"),
+		asm.Mov.Reg(asm.R6, asm.R4),
+		asm.Add.Imm(asm.R6, udpHeaderLen),
+
+		// Event with the source address and port, and the length of the payload
+		asm.LoadMapPtr(asm.R1, 0).WithReference(eventsName),
+		asm.Mov.Imm(asm.R2, eventHeaderLen+MaxPayloadSize),
+		asm.Mov.Imm(asm.R3, 0),
+		asm.FnRingbufReserve.Call(),
+		asm.JEq.Imm(asm.R0, 0, "pass"), // Ring buffer is full
+		asm.Mov.Reg(asm.R9, asm.R0),
+		asm.LoadMem(asm.R0, asm.RFP, -8, asm.Word),
+		asm.StoreMem(asm.R9, 0, asm.R0, asm.Word),
+		asm.LoadMem(asm.R0, asm.RFP, -4, asm.Half),
+		asm.StoreMem(asm.R9, 4, asm.R0, asm.Half),
+		asm.StoreMem(asm.R9, 6, asm.R8, asm.Half),
+
+		// Copy the payload while checking that it is a single name:value|type line. r1 is the number of bytes
+		// copied, r2 is the part of the line of the last byte, see stateStart.
+		asm.Mov.Imm(asm.R1, 0),
+		asm.Mov.Imm(asm.R2, stateStart),
+		asm.JGE.Reg(asm.R1, asm.R8, "copied").WithSymbol("loop"),
+		asm.JGE.Imm(asm.R1, MaxPayloadSize, "discard"), // Bounds the loop for the verifier
+		asm.Mov.Reg(asm.R5, asm.R6),
+		asm.Add.Reg(asm.R5, asm.R1),
+		asm.Mov.Reg(asm.R0, asm.R5),
+		asm.Add.Imm(asm.R0, 1),
+		asm.JGT.Reg(asm.R0, asm.R7, "discard"),
+		asm.LoadMem(asm.R4, asm.R5, 0, asm.Byte),
+		asm.Mov.Reg(asm.R0, asm.R9),
+		asm.Add.Reg(asm.R0, asm.R1),
+		asm.StoreMem(asm.R0, eventHeaderLen, asm.R4, asm.Byte),
+		asm.Add.Imm(asm.R1, 1),
+		asm.JEq.Imm(asm.R2, stateEnd, "discard"), // Several lines
+		asm.JEq.Imm(asm.R4, '#', "discard"),      // Tags
+		asm.JEq.Imm(asm.R4, '@', "discard"),      // Sample rate
+		asm.JEq.Imm(asm.R4, '{', "discard"),      // Event
+		asm.JEq.Imm(asm.R4, '\n', "newline"),
+		asm.JEq.Imm(asm.R4, ':', "colon"),
+		asm.JEq.Imm(asm.R4, '|', "pipe"),
+		asm.JEq.Imm(asm.R2, stateStart, "first"),
+		asm.JEq.Imm(asm.R2, stateColon, "first"),
+		asm.JEq.Imm(asm.R2, statePipe, "first"),
+		asm.Ja.Label("loop"),
+		asm.Add.Imm(asm.R2, 1).WithSymbol("first"), // From a separator to the following part
+		asm.Ja.Label("loop"),
+		asm.JNE.Imm(asm.R2, stateType, "discard").WithSymbol("newline"),
+		asm.Mov.Imm(asm.R2, stateEnd),
+		asm.Ja.Label("loop"),
+		asm.JNE.Imm(asm.R2, stateName, "discard").WithSymbol("colon"),
+		asm.Mov.Imm(asm.R2, stateColon),
+		asm.Ja.Label("loop"),
+		asm.JNE.Imm(asm.R2, stateValue, "discard").WithSymbol("pipe"),
+		asm.Mov.Imm(asm.R2, statePipe),
+		asm.Ja.Label("loop"),
+		asm.JLT.Imm(asm.R2, stateType, "discard").WithSymbol("copied"),
+		asm.Mov.Reg(asm.R1, asm.R9),
+		asm.Mov.Imm(asm.R2, 0),
+		asm.FnRingbufSubmit.Call(),
+		asm.Mov.Imm(asm.R0, xdpDrop),
+		asm.Return(),
+
+		asm.Mov.Reg(asm.R1, asm.R9).WithSymbol("discard"),
+		asm.Mov.Imm(asm.R2, 0),
+		asm.FnRingbufDiscard.Call(),
+		asm.Mov.Imm(asm.R0, xdpPass).WithSymbol("pass"),
+		asm.Return(),
+	}
+}
@@ -0,0 +1,234 @@
+//go:build linux
+// +build linux
+
+package ebpf
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd/pkg/statsd"
+)
+
+// lineRecorder records handled lines.
+type lineRecorder struct {
+	mu    sync.Mutex
+	lines []string
+	addrs []net.Addr
+}
+
+func (lr *lineRecorder) Receive(ctx context.Context, c net.PacketConn) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (lr *lineRecorder) GetStats() statsd.ReceiverStats {
+	return statsd.ReceiverStats{}
+}
+
+func (lr *lineRecorder) HandleLines(ctx context.Context, addr net.Addr, lines []byte) (uint32, uint32, error) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	lr.lines = append(lr.lines, string(lines))
+	lr.addrs = append(lr.addrs, addr)
+	return 1, 0, nil
+}
+
+func (lr *lineRecorder) received() []string {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	return append([]string(nil), lr.lines...)
+}
+
+func TestDecodeEvent(t *testing.T) {
+	t.Parallel()
+	b := []byte{10, 0, 0, 1, 0x1f, 0xbd, 0, 0, 'a', ':', '1', '|', 'c', 0, 0}
+	binary.NativeEndian.PutUint16(b[6:8], 5)
+	addr, line, err := decodeEvent(b)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:8125", addr.String())
+	assert.Equal(t, "a:1|c", string(line))
+
+	binary.NativeEndian.PutUint16(b[6:8], 8)
+	_, _, err = decodeEvent(b)
+	assert.Error(t, err)
+	_, _, err = decodeEvent(b[:4])
+	assert.Error(t, err)
+}
+
+// udpPacket returns an Ethernet frame of the UDP datagram over IPv4 with the IP options.
+func udpPacket(port int, options []byte, payload string) []byte {
+	ipLen := ipHeaderLen + len(options)
+	b := make([]byte, ethHeaderLen+ipLen+udpHeaderLen+len(payload))
+	binary.BigEndian.PutUint16(b[12:], ethTypeIPv4)
+	ip := b[ethHeaderLen:]
+	ip[0] = 0x40 | byte(ipLen/4)
+	binary.BigEndian.PutUint16(ip[2:], uint16(ipLen+udpHeaderLen+len(payload)))
+	ip[8] = 64
+	ip[9] = ipProtoUDP
+	copy(ip[12:], []byte{10, 0, 0, 1})
+	copy(ip[16:], []byte{10, 0, 0, 2})
+	copy(ip[ipHeaderLen:], options)
+	udp := ip[ipLen:]
+	binary.BigEndian.PutUint16(udp[0:], 5555)
+	binary.BigEndian.PutUint16(udp[2:], uint16(port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpHeaderLen+len(payload)))
+	copy(udp[udpHeaderLen:], payload)
+	return b
+}
+
+func TestXDPProgram(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("loading XDP programs requires root")
+	}
+	coll, err := ebpf.NewCollection(collectionSpec(DefaultPort))
+	require.NoError(t, err)
+	defer coll.Close()
+	prog := coll.Programs[programName]
+
+	fragment := udpPacket(DefaultPort, nil, "a:1|c")
+	fragment[ethHeaderLen+6] = 0x20 // More fragments
+	truncated := udpPacket(DefaultPort, nil, "a:1|c")
+	truncated = truncated[:len(truncated)-1]
+	ipv6 := udpPacket(DefaultPort, nil, "a:1|c")
+	binary.BigEndian.PutUint16(ipv6[12:], 0x86dd)
+	long := make([]byte, MaxPayloadSize)
+	for i := range long {
+		long[i] = 'a'
+	}
+	copy(long[len(long)-4:], ":1|c")
+
+	tests := map[string]struct {
+		packet []byte
+		ret    uint32
+	}{
+		"simple":      {udpPacket(DefaultPort, nil, "a:1|c"), xdpDrop},
+		"ip options":  {udpPacket(DefaultPort, []byte{1, 1, 1, 0}, "a:1|c"), xdpDrop},
+		"max length":  {udpPacket(DefaultPort, nil, string(long)), xdpDrop},
+		"too long":    {udpPacket(DefaultPort, nil, string(long)+"\n"), xdpPass},
+		"other port":  {udpPacket(DefaultPort+1, nil, "a:1|c"), xdpPass},
+		"fragment":    {fragment, xdpPass},
+		"truncated":   {truncated, xdpPass},
+		"ipv6":        {ipv6, xdpPass},
+		"empty":       {udpPacket(DefaultPort, nil, ""), xdpPass},
+		"no type":     {udpPacket(DefaultPort, nil, "a:1"), xdpPass},
+		"two values":  {udpPacket(DefaultPort, nil, "a:1:2|c"), xdpPass},
+		"after line":  {udpPacket(DefaultPort, nil, "a:1|c\nb"), xdpPass},
+		"two newline": {udpPacket(DefaultPort, nil, "a:1|c\n\n"), xdpPass},
+	}
+	for name, tc := range tests {
+		ret, err := prog.Run(&ebpf.RunOptions{Data: tc.packet})
+		require.NoError(t, err)
+		assert.Equal(t, tc.ret, ret, name)
+	}
+}
+
+func TestXDPReceiver(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("attaching XDP programs requires root")
+	}
+	// Datagrams not taken by the XDP program are received by the socket
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	passed := make(chan string, 100)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			passed <- string(buf[:n])
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	recorder := &lineRecorder{}
+	s := Server{Interface: "lo", Port: port, Receiver: recorder}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.ListenAndServe(ctx)
+	}()
+
+	client, err := net.Dial("udp4", conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	send := func(line string) {
+		_, err := client.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	// Wait until the program is attached
+	deadline := time.Now().Add(5 * time.Second)
+	for len(recorder.received()) == 0 {
+		select {
+		case err := <-errs:
+			require.NoError(t, err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("XDP program did not take metrics")
+		}
+		send("xdp.attached:1|c")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	taken := []string{"xdp.counter:1|c", "xdp.gauge:-1.5|g\n", "xdp.timer:10|ms"}
+	notTaken := []string{"xdp.tags:1|c|#a:b", "xdp.sampled:1|c|@0.5", "xdp.lines:1|c\nxdp.lines:2|c", "xdp.empty:|c",
+		":1|c", "xdp.type:1|", "xdp.name", "_e{1,1}:a|b"}
+	for _, line := range append(taken, notTaken...) {
+		send(line)
+	}
+	for _, line := range notTaken {
+		assert.Equal(t, line, nextPassed(t, passed))
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		var lines []string
+		for _, line := range recorder.received() {
+			if line != "xdp.attached:1|c" {
+				lines = append(lines, line)
+			}
+		}
+		if len(lines) == len(taken) {
+			assert.Equal(t, taken, lines)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("XDP program took %q", lines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	recorder.mu.Lock()
+	assert.Equal(t, client.LocalAddr().String(), recorder.addrs[len(recorder.addrs)-1].String())
+	recorder.mu.Unlock()
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+// nextPassed returns the next datagram passed to the socket, skipping those sent while attaching the program.
+func nextPassed(t *testing.T, passed chan string) string {
+	for {
+		select {
+		case p := <-passed:
+			if p != "xdp.attached:1|c" {
+				return p
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("datagram was not passed to the socket")
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package ebpf
+
+import (
+	"context"
+	"errors"
+)
+
+// ListenAndServe returns an error, XDP programs are only supported on Linux.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	return errors.New("the eBPF receiver is only supported on Linux")
+}
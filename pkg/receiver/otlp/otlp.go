@@ -0,0 +1,134 @@
+// Package otlp provides a receiver of metrics sent by OpenTelemetry SDKs and collectors with the OTLP/gRPC
+// protocol, the MetricsService of the OpenTelemetry Collector.
+//
+// Data points are translated to gostatsd metrics named after the OTLP metric:
+//
+//   - Gauges are gauges.
+//   - Monotonic sums are counters. Cumulative sums are sent as the difference with the previous data point of
+//     the same series, the first data point of a series is counted from its start time.
+//   - Non-monotonic cumulative sums are gauges, non-monotonic delta sums are counters.
+//   - Histograms are the counters <name>.count, <name>.sum and <name>.bucket tagged with the upper bound
+//     of each bucket as le:<bound>. Like Prometheus buckets, each bucket counts all values up to its bound.
+//     Cumulative histograms are sent as differences like sums.
+//
+// Exponential histograms and summaries are not supported, their data points are reported as rejected.
+// Attributes of resources and data points are added as key:value tags, the host.name resource attribute
+// is also the hostname of the metrics.
+package otlp
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statsd"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/pflag"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultAddr is the default address on which a Server will listen, the standard port of OTLP/gRPC.
+	DefaultAddr = ":4317"
+	// ParamAddr is the name of parameter with the address of the OTLP/gRPC receiver.
+	ParamAddr = "otlp-addr"
+)
+
+// AddFlags adds flags to the specified FlagSet.
+func AddFlags(fs *pflag.FlagSet) {
+	fs.String(ParamAddr, "", "If set, use as the address of the OTLP/gRPC metrics receiver")
+}
+
+// Service returns a statsd.Service that serves the OTLP receiver configured by s.
+// The receiver of the statsd server must be a statsd.ParsedReceiver.
+func Service(s Server) statsd.Service {
+	return func(ctx context.Context, receiver statsd.Receiver, dispatcher statsd.Dispatcher, flusher statsd.Flusher) error {
+		parsed, ok := receiver.(statsd.ParsedReceiver)
+		if !ok {
+			return fmt.Errorf("receiver %T does not handle parsed metrics", receiver)
+		}
+		s.Receiver = parsed
+		return s.ListenAndServe(ctx)
+	}
+}
+
+// Server is an object that listens for gRPC connections on a TCP address Addr and provides the OTLP
+// MetricsService. Translated metrics are handled by the Receiver.
+type Server struct {
+	Addr     string
+	Receiver statsd.ParsedReceiver
+}
+
+// ListenAndServe listens on the Server's TCP network address and then calls Serve.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	addr := s.Addr
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return s.Serve(ctx, l)
+}
+
+// Serve accepts incoming connections on the listener and serves the MetricsService until the context is done.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	srv := grpc.NewServer()
+	colmetricspb.RegisterMetricsServiceServer(srv, &metricsServer{receiver: s.Receiver, sums: newCumulativeSums()})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			srv.Stop()
+		case <-done:
+		}
+	}()
+	err := srv.Serve(l)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// metricsServer implements colmetricspb.MetricsServiceServer.
+type metricsServer struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+	receiver statsd.ParsedReceiver
+	sums     *cumulativeSums
+}
+
+func (ms *metricsServer) Export(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	ip := gostatsd.UnknownIP
+	if p, ok := peer.FromContext(ctx); ok {
+		if addr, ok := p.Addr.(*net.TCPAddr); ok {
+			ip = gostatsd.IP(addr.IP.String())
+		}
+	}
+	metrics, rejected := translate(req.ResourceMetrics, ms.sums)
+	for i := range metrics {
+		m := &metrics[i]
+		m.SourceIP = ip
+		if err := ms.receiver.HandleMetric(ctx, m); err != nil {
+			if err == context.Canceled || err == context.DeadlineExceeded {
+				return nil, status.FromContextError(err).Err()
+			}
+			log.Warnf("Error dispatching OTLP metric %s from %s: %v", m.Name, ip, err)
+		}
+	}
+	resp := &colmetricspb.ExportMetricsServiceResponse{}
+	if rejected > 0 {
+		resp.PartialSuccess = &colmetricspb.ExportMetricsPartialSuccess{
+			RejectedDataPoints: rejected,
+			ErrorMessage:       "exponential histograms and summaries are not supported",
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,150 @@
+package otlp
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// capturingReceiver captures handled metrics.
+type capturingReceiver struct {
+	mu      sync.Mutex
+	metrics []gostatsd.Metric
+}
+
+func (cr *capturingReceiver) Receive(ctx context.Context, c net.PacketConn) error {
+	return nil
+}
+
+func (cr *capturingReceiver) GetStats() statsd.ReceiverStats {
+	return statsd.ReceiverStats{}
+}
+
+func (cr *capturingReceiver) HandleMetric(ctx context.Context, m *gostatsd.Metric) error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.metrics = append(cr.metrics, *m)
+	return nil
+}
+
+// take returns the captured metrics sorted by name and tags and forgets them.
+func (cr *capturingReceiver) take() []gostatsd.Metric {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	result := cr.metrics
+	cr.metrics = nil
+	sort.Sort(bySeries(result))
+	return result
+}
+
+// bySeries sorts metrics by their series keys.
+type bySeries []gostatsd.Metric
+
+func (b bySeries) Len() int {
+	return len(b)
+}
+
+func (b bySeries) Less(i, j int) bool {
+	return seriesKey(&b[i]) < seriesKey(&b[j])
+}
+
+func (b bySeries) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+func TestExportWithOpenTelemetrySDK(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	cr := &capturingReceiver{}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := make(chan error, 1)
+	go func() {
+		done <- (&Server{Receiver: cr}).Serve(ctx, l)
+	}()
+
+	exporter, err := otlpmetricgrpc.New(ctx, otlpmetricgrpc.WithEndpoint(l.Addr().String()), otlpmetricgrpc.WithInsecure())
+	require.NoError(t, err)
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithInterval(time.Hour))),
+		sdkmetric.WithResource(resource.NewSchemaless(attribute.String("service.name", "checkout"), attribute.String("host.name", "web-1"))),
+	)
+	meter := provider.Meter("test")
+	requests, err := meter.Int64Counter("requests", metric.WithUnit("1"))
+	require.NoError(t, err)
+	inFlight, err := meter.Int64UpDownCounter("in_flight")
+	require.NoError(t, err)
+	temperature, err := meter.Float64Gauge("temperature")
+	require.NoError(t, err)
+	latency, err := meter.Float64Histogram("latency", metric.WithExplicitBucketBoundaries(10, 100))
+	require.NoError(t, err)
+
+	get := metric.WithAttributes(attribute.String("method", "GET"))
+	requests.Add(ctx, 3, get)
+	inFlight.Add(ctx, 5)
+	temperature.Record(ctx, 21.5)
+	latency.Record(ctx, 5)
+	latency.Record(ctx, 50)
+	require.NoError(t, provider.ForceFlush(ctx))
+
+	resourceTags := gostatsd.Tags{"host.name:web-1", "service.name:checkout"}
+	metrics := cr.take()
+	for i := range metrics {
+		assert.Equal(t, "web-1", metrics[i].Hostname)
+		assert.Equal(t, gostatsd.IP("127.0.0.1"), metrics[i].SourceIP)
+		sort.Strings(metrics[i].Tags)
+		metrics[i].Hostname = ""
+		metrics[i].SourceIP = ""
+	}
+	assert.Equal(t, []gostatsd.Metric{
+		{Name: "in_flight", Value: 5, Tags: resourceTags, Type: gostatsd.GAUGE},
+		{Name: "latency.bucket", Value: 2, Tags: gostatsd.Tags{"host.name:web-1", "le:+Inf", "service.name:checkout"}, Type: gostatsd.COUNTER},
+		{Name: "latency.bucket", Value: 1, Tags: gostatsd.Tags{"host.name:web-1", "le:10", "service.name:checkout"}, Type: gostatsd.COUNTER},
+		{Name: "latency.bucket", Value: 2, Tags: gostatsd.Tags{"host.name:web-1", "le:100", "service.name:checkout"}, Type: gostatsd.COUNTER},
+		{Name: "latency.count", Value: 2, Tags: resourceTags, Type: gostatsd.COUNTER},
+		{Name: "latency.sum", Value: 55, Tags: resourceTags, Type: gostatsd.COUNTER},
+		{Name: "requests", Value: 3, Tags: gostatsd.Tags{"host.name:web-1", "method:GET", "service.name:checkout"}, Unit: "1", Type: gostatsd.COUNTER},
+		{Name: "temperature", Value: 21.5, Tags: resourceTags, Type: gostatsd.GAUGE},
+	}, metrics)
+
+	// Cumulative sums are sent as differences
+	requests.Add(ctx, 2, get)
+	require.NoError(t, provider.ForceFlush(ctx))
+	var values []float64
+	for _, m := range cr.take() {
+		if m.Name == "requests" || m.Name == "latency.count" {
+			values = append(values, m.Value)
+		}
+	}
+	assert.Equal(t, []float64{0, 2}, values)
+
+	require.NoError(t, provider.Shutdown(ctx))
+	cancelFunc()
+	select {
+	case err = <-done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+}
+
+func TestServiceRequiresParsedReceiver(t *testing.T) {
+	t.Parallel()
+	err := Service(Server{Addr: "127.0.0.1:0"})(context.Background(), nil, nil, nil)
+	assert.Error(t, err)
+}
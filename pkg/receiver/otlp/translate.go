@@ -0,0 +1,220 @@
+package otlp
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+// hostNameAttribute is the resource attribute with the hostname of the source of metrics.
+const hostNameAttribute = "host.name"
+
+// cumulativeExpiry is how long the last data point of a cumulative series is kept after it was last seen.
+const cumulativeExpiry = 10 * time.Minute
+
+// translate returns the gostatsd metrics of the data points of the resources and the number of rejected
+// data points. Differences of cumulative data points are calculated with the sums.
+func translate(resources []*metricspb.ResourceMetrics, sums *cumulativeSums) ([]gostatsd.Metric, int64) {
+	var result []gostatsd.Metric
+	var rejected int64
+	for _, rm := range resources {
+		resourceTags := attributeTags(nil, rm.GetResource().GetAttributes())
+		var hostname string
+		for _, kv := range rm.GetResource().GetAttributes() {
+			if kv.Key == hostNameAttribute {
+				hostname = attributeValue(kv.Value)
+			}
+		}
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				t := translator{name: m.Name, unit: m.Unit, hostname: hostname, resourceTags: resourceTags, sums: sums}
+				switch data := m.Data.(type) {
+				case *metricspb.Metric_Gauge:
+					for _, dp := range data.Gauge.DataPoints {
+						result = append(result, t.metric(t.name, gostatsd.GAUGE, numberValue(dp), dp.Attributes))
+					}
+				case *metricspb.Metric_Sum:
+					result = t.sum(result, data.Sum)
+				case *metricspb.Metric_Histogram:
+					result = t.histogram(result, data.Histogram)
+				case *metricspb.Metric_ExponentialHistogram:
+					rejected += int64(len(data.ExponentialHistogram.DataPoints))
+				case *metricspb.Metric_Summary:
+					rejected += int64(len(data.Summary.DataPoints))
+				}
+			}
+		}
+	}
+	return result, rejected
+}
+
+// translator translates data points of a metric.
+type translator struct {
+	name         string
+	unit         string
+	hostname     string
+	resourceTags gostatsd.Tags
+	sums         *cumulativeSums
+}
+
+func (t *translator) metric(name string, metricType gostatsd.MetricType, value float64, attributes []*commonpb.KeyValue) gostatsd.Metric {
+	return gostatsd.Metric{
+		Name:     name,
+		Value:    value,
+		Tags:     attributeTags(t.resourceTags, attributes),
+		Unit:     t.unit,
+		Hostname: t.hostname,
+		Type:     metricType,
+	}
+}
+
+func (t *translator) sum(result []gostatsd.Metric, sum *metricspb.Sum) []gostatsd.Metric {
+	cumulative := sum.AggregationTemporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+	for _, dp := range sum.DataPoints {
+		switch {
+		case !sum.IsMonotonic && cumulative:
+			result = append(result, t.metric(t.name, gostatsd.GAUGE, numberValue(dp), dp.Attributes))
+		case cumulative:
+			m := t.metric(t.name, gostatsd.COUNTER, 0, dp.Attributes)
+			m.Value = t.sums.delta(seriesKey(&m), dp.StartTimeUnixNano, numberValue(dp))
+			result = append(result, m)
+		default:
+			result = append(result, t.metric(t.name, gostatsd.COUNTER, numberValue(dp), dp.Attributes))
+		}
+	}
+	return result
+}
+
+func (t *translator) histogram(result []gostatsd.Metric, histogram *metricspb.Histogram) []gostatsd.Metric {
+	cumulative := histogram.AggregationTemporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+	for _, dp := range histogram.DataPoints {
+		counter := func(name string, value float64, bucketTag string) gostatsd.Metric {
+			m := t.metric(name, gostatsd.COUNTER, value, dp.Attributes)
+			if bucketTag != "" {
+				m.Tags = append(m.Tags, bucketTag)
+			}
+			if cumulative {
+				m.Value = t.sums.delta(seriesKey(&m), dp.StartTimeUnixNano, value)
+			}
+			return m
+		}
+		result = append(result, counter(t.name+".count", float64(dp.Count), ""))
+		if dp.Sum != nil {
+			result = append(result, counter(t.name+".sum", *dp.Sum, ""))
+		}
+		var total uint64
+		for i, count := range dp.BucketCounts {
+			total += count // Buckets count values up to their bound like Prometheus buckets
+			bound := "+Inf"
+			if i < len(dp.ExplicitBounds) {
+				bound = strconv.FormatFloat(dp.ExplicitBounds[i], 'g', -1, 64)
+			}
+			result = append(result, counter(t.name+".bucket", float64(total), "le:"+bound))
+		}
+	}
+	return result
+}
+
+// seriesKey returns the key of the series of the metric.
+func seriesKey(m *gostatsd.Metric) string {
+	tags := make([]string, len(m.Tags))
+	copy(tags, m.Tags)
+	sort.Strings(tags)
+	return m.Name + "|" + m.Hostname + "|" + strings.Join(tags, ",")
+}
+
+// numberValue returns the value of the data point as a float.
+func numberValue(dp *metricspb.NumberDataPoint) float64 {
+	switch v := dp.Value.(type) {
+	case *metricspb.NumberDataPoint_AsDouble:
+		return v.AsDouble
+	case *metricspb.NumberDataPoint_AsInt:
+		return float64(v.AsInt)
+	}
+	return 0
+}
+
+// attributeTags returns a copy of the tags with the attributes appended as key:value tags.
+func attributeTags(tags gostatsd.Tags, attributes []*commonpb.KeyValue) gostatsd.Tags {
+	result := make(gostatsd.Tags, 0, len(tags)+len(attributes))
+	result = append(result, tags...)
+	for _, kv := range attributes {
+		result = append(result, kv.Key+":"+attributeValue(kv.Value))
+	}
+	return result
+}
+
+// attributeValue returns the value of an attribute as a string.
+func attributeValue(v *commonpb.AnyValue) string {
+	switch value := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return value.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(value.BoolValue)
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(value.IntValue, 10)
+	case *commonpb.AnyValue_DoubleValue:
+		return strconv.FormatFloat(value.DoubleValue, 'g', -1, 64)
+	case *commonpb.AnyValue_ArrayValue:
+		values := make([]string, 0, len(value.ArrayValue.Values))
+		for _, element := range value.ArrayValue.Values {
+			values = append(values, attributeValue(element))
+		}
+		return strings.Join(values, ",")
+	}
+	return ""
+}
+
+// cumulativeSums keeps the last values of cumulative series to calculate differences between data points.
+// Series that are not seen for cumulativeExpiry are forgotten. Safe for concurrent use.
+type cumulativeSums struct {
+	now func() time.Time // Returns current time. Useful for testing.
+
+	mu         sync.Mutex
+	series     map[string]cumulativeSum
+	lastExpiry time.Time
+}
+
+// cumulativeSum is the last data point of a cumulative series.
+type cumulativeSum struct {
+	start uint64 // Start time of the series. Unix timestamp in nsec.
+	value float64
+	seen  time.Time
+}
+
+func newCumulativeSums() *cumulativeSums {
+	return &cumulativeSums{
+		now:    time.Now,
+		series: make(map[string]cumulativeSum),
+	}
+}
+
+// delta records the value of the series and returns the difference with the previous value. The whole value
+// is returned for the first data point of a series and if the series was reset, i.e. its start time changed
+// or its value decreased.
+func (c *cumulativeSums) delta(key string, start uint64, value float64) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if now.Sub(c.lastExpiry) >= cumulativeExpiry {
+		for k, s := range c.series {
+			if now.Sub(s.seen) >= cumulativeExpiry {
+				delete(c.series, k)
+			}
+		}
+		c.lastExpiry = now
+	}
+	prev, ok := c.series[key]
+	c.series[key] = cumulativeSum{start: start, value: value, seen: now}
+	if !ok || prev.start != start || value < prev.value {
+		return value
+	}
+	return value - prev.value
+}
@@ -0,0 +1,113 @@
+package otlp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+)
+
+func stringAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+func resourceMetrics(metrics ...*metricspb.Metric) []*metricspb.ResourceMetrics {
+	return []*metricspb.ResourceMetrics{{
+		Resource:     &resourcepb.Resource{Attributes: []*commonpb.KeyValue{stringAttribute("service.name", "svc")}},
+		ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: metrics}},
+	}}
+}
+
+func sumMetric(name string, temporality metricspb.AggregationTemporality, monotonic bool, start uint64, value int64) *metricspb.Metric {
+	return &metricspb.Metric{
+		Name: name,
+		Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+			AggregationTemporality: temporality,
+			IsMonotonic:            monotonic,
+			DataPoints: []*metricspb.NumberDataPoint{{
+				StartTimeUnixNano: start,
+				Value:             &metricspb.NumberDataPoint_AsInt{AsInt: value},
+			}},
+		}},
+	}
+}
+
+func TestTranslateSums(t *testing.T) {
+	t.Parallel()
+	const cumulative = metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+	const delta = metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+	sums := newCumulativeSums()
+	values := func(metrics ...*metricspb.Metric) []float64 {
+		result, rejected := translate(resourceMetrics(metrics...), sums)
+		assert.Zero(t, rejected)
+		var v []float64
+		for _, m := range result {
+			v = append(v, m.Value)
+		}
+		return v
+	}
+
+	assert.Equal(t, []float64{10}, values(sumMetric("c", cumulative, true, 1, 10)))
+	assert.Equal(t, []float64{5}, values(sumMetric("c", cumulative, true, 1, 15)))
+	assert.Equal(t, []float64{3}, values(sumMetric("c", cumulative, true, 1, 3)), "decreased value is a reset")
+	assert.Equal(t, []float64{4}, values(sumMetric("c", cumulative, true, 2, 4)), "changed start time is a reset")
+	assert.Equal(t, []float64{7, 7}, values(sumMetric("d", delta, true, 1, 7), sumMetric("d", delta, true, 1, 7)))
+	assert.Equal(t, []float64{-2}, values(sumMetric("u", delta, false, 1, -2)))
+
+	result, _ := translate(resourceMetrics(sumMetric("g", cumulative, false, 1, -2)), sums)
+	assert.Equal(t, []gostatsd.Metric{{Name: "g", Value: -2, Tags: gostatsd.Tags{"service.name:svc"}, Type: gostatsd.GAUGE}}, result)
+}
+
+func TestTranslateRejected(t *testing.T) {
+	t.Parallel()
+	result, rejected := translate(resourceMetrics(
+		&metricspb.Metric{Name: "e", Data: &metricspb.Metric_ExponentialHistogram{ExponentialHistogram: &metricspb.ExponentialHistogram{
+			DataPoints: []*metricspb.ExponentialHistogramDataPoint{{}, {}},
+		}}},
+		&metricspb.Metric{Name: "s", Data: &metricspb.Metric_Summary{Summary: &metricspb.Summary{
+			DataPoints: []*metricspb.SummaryDataPoint{{}},
+		}}},
+		&metricspb.Metric{Name: "g", Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{
+			DataPoints: []*metricspb.NumberDataPoint{{Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: 1.5}}},
+		}}},
+	), newCumulativeSums())
+	assert.EqualValues(t, 3, rejected)
+	assert.Len(t, result, 1)
+}
+
+func TestAttributeValue(t *testing.T) {
+	t.Parallel()
+	for expected, value := range map[string]*commonpb.AnyValue{
+		"s":    {Value: &commonpb.AnyValue_StringValue{StringValue: "s"}},
+		"true": {Value: &commonpb.AnyValue_BoolValue{BoolValue: true}},
+		"-3":   {Value: &commonpb.AnyValue_IntValue{IntValue: -3}},
+		"1.5":  {Value: &commonpb.AnyValue_DoubleValue{DoubleValue: 1.5}},
+		"a,1": {Value: &commonpb.AnyValue_ArrayValue{ArrayValue: &commonpb.ArrayValue{Values: []*commonpb.AnyValue{
+			{Value: &commonpb.AnyValue_StringValue{StringValue: "a"}},
+			{Value: &commonpb.AnyValue_IntValue{IntValue: 1}},
+		}}}},
+		"": nil,
+	} {
+		assert.Equal(t, expected, attributeValue(value))
+	}
+}
+
+func TestCumulativeSumsExpiry(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1000, 0)
+	sums := newCumulativeSums()
+	sums.now = func() time.Time { return now }
+	assert.Equal(t, 10.0, sums.delta("a", 1, 10))
+	assert.Equal(t, 10.0, sums.delta("b", 1, 10))
+	now = now.Add(cumulativeExpiry / 2)
+	assert.Equal(t, 5.0, sums.delta("b", 1, 15))
+	now = now.Add(cumulativeExpiry / 2)
+	assert.Equal(t, 5.0, sums.delta("b", 1, 20))
+	assert.Len(t, sums.series, 1, "a expired")
+	assert.Equal(t, 12.0, sums.delta("a", 1, 12))
+}
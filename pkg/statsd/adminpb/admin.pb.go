@@ -0,0 +1,754 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        v5.29.3
+// source: pkg/statsd/adminpb/admin.proto
+
+package adminpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type MetricType int32
+
+const (
+	// All metric types. Not allowed in DeleteMetricsRequest.
+	MetricType_ALL     MetricType = 0
+	MetricType_COUNTER MetricType = 1
+	MetricType_TIMER   MetricType = 2
+	MetricType_GAUGE   MetricType = 3
+	MetricType_SET     MetricType = 4
+)
+
+// Enum value maps for MetricType.
+var (
+	MetricType_name = map[int32]string{
+		0: "ALL",
+		1: "COUNTER",
+		2: "TIMER",
+		3: "GAUGE",
+		4: "SET",
+	}
+	MetricType_value = map[string]int32{
+		"ALL":     0,
+		"COUNTER": 1,
+		"TIMER":   2,
+		"GAUGE":   3,
+		"SET":     4,
+	}
+)
+
+func (x MetricType) Enum() *MetricType {
+	p := new(MetricType)
+	*p = x
+	return p
+}
+
+func (x MetricType) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (MetricType) Descriptor() protoreflect.EnumDescriptor {
+	return file_pkg_statsd_adminpb_admin_proto_enumTypes[0].Descriptor()
+}
+
+func (MetricType) Type() protoreflect.EnumType {
+	return &file_pkg_statsd_adminpb_admin_proto_enumTypes[0]
+}
+
+func (x MetricType) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use MetricType.Descriptor instead.
+func (MetricType) EnumDescriptor() ([]byte, []int) {
+	return file_pkg_statsd_adminpb_admin_proto_rawDescGZIP(), []int{0}
+}
+
+type GetStatsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetStatsRequest) Reset() {
+	*x = GetStatsRequest{}
+	mi := &file_pkg_statsd_adminpb_admin_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetStatsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetStatsRequest) ProtoMessage() {}
+
+func (x *GetStatsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_statsd_adminpb_admin_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetStatsRequest.ProtoReflect.Descriptor instead.
+func (*GetStatsRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_statsd_adminpb_admin_proto_rawDescGZIP(), []int{0}
+}
+
+type Stats struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	BadLines        uint64                 `protobuf:"varint,1,opt,name=bad_lines,json=badLines,proto3" json:"bad_lines,omitempty"`
+	MetricsReceived uint64                 `protobuf:"varint,2,opt,name=metrics_received,json=metricsReceived,proto3" json:"metrics_received,omitempty"`
+	PacketsReceived uint64                 `protobuf:"varint,3,opt,name=packets_received,json=packetsReceived,proto3" json:"packets_received,omitempty"`
+	EventsReceived  uint64                 `protobuf:"varint,4,opt,name=events_received,json=eventsReceived,proto3" json:"events_received,omitempty"`
+	LastPacket      *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=last_packet,json=lastPacket,proto3" json:"last_packet,omitempty"`
+	LastFlush       *timestamppb.Timestamp `protobuf:"bytes,6,opt,name=last_flush,json=lastFlush,proto3" json:"last_flush,omitempty"`
+	LastFlushError  *timestamppb.Timestamp `protobuf:"bytes,7,opt,name=last_flush_error,json=lastFlushError,proto3" json:"last_flush_error,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *Stats) Reset() {
+	*x = Stats{}
+	mi := &file_pkg_statsd_adminpb_admin_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Stats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Stats) ProtoMessage() {}
+
+func (x *Stats) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_statsd_adminpb_admin_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Stats.ProtoReflect.Descriptor instead.
+func (*Stats) Descriptor() ([]byte, []int) {
+	return file_pkg_statsd_adminpb_admin_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Stats) GetBadLines() uint64 {
+	if x != nil {
+		return x.BadLines
+	}
+	return 0
+}
+
+func (x *Stats) GetMetricsReceived() uint64 {
+	if x != nil {
+		return x.MetricsReceived
+	}
+	return 0
+}
+
+func (x *Stats) GetPacketsReceived() uint64 {
+	if x != nil {
+		return x.PacketsReceived
+	}
+	return 0
+}
+
+func (x *Stats) GetEventsReceived() uint64 {
+	if x != nil {
+		return x.EventsReceived
+	}
+	return 0
+}
+
+func (x *Stats) GetLastPacket() *timestamppb.Timestamp {
+	if x != nil {
+		return x.LastPacket
+	}
+	return nil
+}
+
+func (x *Stats) GetLastFlush() *timestamppb.Timestamp {
+	if x != nil {
+		return x.LastFlush
+	}
+	return nil
+}
+
+func (x *Stats) GetLastFlushError() *timestamppb.Timestamp {
+	if x != nil {
+		return x.LastFlushError
+	}
+	return nil
+}
+
+type Metric struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Name  string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Type  MetricType             `protobuf:"varint,2,opt,name=type,proto3,enum=gostatsd.admin.MetricType" json:"type,omitempty"`
+	// Key the metric is aggregated by, derived from tags and hostname.
+	TagsKey  string   `protobuf:"bytes,3,opt,name=tags_key,json=tagsKey,proto3" json:"tags_key,omitempty"`
+	Tags     []string `protobuf:"bytes,4,rep,name=tags,proto3" json:"tags,omitempty"`
+	Hostname string   `protobuf:"bytes,5,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	// Value of a counter or a gauge.
+	Value float64 `protobuf:"fixed64,6,opt,name=value,proto3" json:"value,omitempty"`
+	// Values of a timer.
+	TimerValues []float64 `protobuf:"fixed64,7,rep,packed,name=timer_values,json=timerValues,proto3" json:"timer_values,omitempty"`
+	// Values of a set.
+	SetValues     []string `protobuf:"bytes,8,rep,name=set_values,json=setValues,proto3" json:"set_values,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Metric) Reset() {
+	*x = Metric{}
+	mi := &file_pkg_statsd_adminpb_admin_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Metric) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Metric) ProtoMessage() {}
+
+func (x *Metric) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_statsd_adminpb_admin_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Metric.ProtoReflect.Descriptor instead.
+func (*Metric) Descriptor() ([]byte, []int) {
+	return file_pkg_statsd_adminpb_admin_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Metric) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Metric) GetType() MetricType {
+	if x != nil {
+		return x.Type
+	}
+	return MetricType_ALL
+}
+
+func (x *Metric) GetTagsKey() string {
+	if x != nil {
+		return x.TagsKey
+	}
+	return ""
+}
+
+func (x *Metric) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *Metric) GetHostname() string {
+	if x != nil {
+		return x.Hostname
+	}
+	return ""
+}
+
+func (x *Metric) GetValue() float64 {
+	if x != nil {
+		return x.Value
+	}
+	return 0
+}
+
+func (x *Metric) GetTimerValues() []float64 {
+	if x != nil {
+		return x.TimerValues
+	}
+	return nil
+}
+
+func (x *Metric) GetSetValues() []string {
+	if x != nil {
+		return x.SetValues
+	}
+	return nil
+}
+
+type ListMetricsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Type          MetricType             `protobuf:"varint,1,opt,name=type,proto3,enum=gostatsd.admin.MetricType" json:"type,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListMetricsRequest) Reset() {
+	*x = ListMetricsRequest{}
+	mi := &file_pkg_statsd_adminpb_admin_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListMetricsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListMetricsRequest) ProtoMessage() {}
+
+func (x *ListMetricsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_statsd_adminpb_admin_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListMetricsRequest.ProtoReflect.Descriptor instead.
+func (*ListMetricsRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_statsd_adminpb_admin_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ListMetricsRequest) GetType() MetricType {
+	if x != nil {
+		return x.Type
+	}
+	return MetricType_ALL
+}
+
+type ListMetricsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Metrics       []*Metric              `protobuf:"bytes,1,rep,name=metrics,proto3" json:"metrics,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListMetricsResponse) Reset() {
+	*x = ListMetricsResponse{}
+	mi := &file_pkg_statsd_adminpb_admin_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListMetricsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListMetricsResponse) ProtoMessage() {}
+
+func (x *ListMetricsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_statsd_adminpb_admin_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListMetricsResponse.ProtoReflect.Descriptor instead.
+func (*ListMetricsResponse) Descriptor() ([]byte, []int) {
+	return file_pkg_statsd_adminpb_admin_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ListMetricsResponse) GetMetrics() []*Metric {
+	if x != nil {
+		return x.Metrics
+	}
+	return nil
+}
+
+type DeleteMetricsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Type          MetricType             `protobuf:"varint,1,opt,name=type,proto3,enum=gostatsd.admin.MetricType" json:"type,omitempty"`
+	Names         []string               `protobuf:"bytes,2,rep,name=names,proto3" json:"names,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteMetricsRequest) Reset() {
+	*x = DeleteMetricsRequest{}
+	mi := &file_pkg_statsd_adminpb_admin_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteMetricsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteMetricsRequest) ProtoMessage() {}
+
+func (x *DeleteMetricsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_statsd_adminpb_admin_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteMetricsRequest.ProtoReflect.Descriptor instead.
+func (*DeleteMetricsRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_statsd_adminpb_admin_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *DeleteMetricsRequest) GetType() MetricType {
+	if x != nil {
+		return x.Type
+	}
+	return MetricType_ALL
+}
+
+func (x *DeleteMetricsRequest) GetNames() []string {
+	if x != nil {
+		return x.Names
+	}
+	return nil
+}
+
+type DeleteMetricsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Deleted       uint32                 `protobuf:"varint,1,opt,name=deleted,proto3" json:"deleted,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteMetricsResponse) Reset() {
+	*x = DeleteMetricsResponse{}
+	mi := &file_pkg_statsd_adminpb_admin_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteMetricsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteMetricsResponse) ProtoMessage() {}
+
+func (x *DeleteMetricsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_statsd_adminpb_admin_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteMetricsResponse.ProtoReflect.Descriptor instead.
+func (*DeleteMetricsResponse) Descriptor() ([]byte, []int) {
+	return file_pkg_statsd_adminpb_admin_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *DeleteMetricsResponse) GetDeleted() uint32 {
+	if x != nil {
+		return x.Deleted
+	}
+	return 0
+}
+
+type ForceFlushRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ForceFlushRequest) Reset() {
+	*x = ForceFlushRequest{}
+	mi := &file_pkg_statsd_adminpb_admin_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ForceFlushRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ForceFlushRequest) ProtoMessage() {}
+
+func (x *ForceFlushRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_statsd_adminpb_admin_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ForceFlushRequest.ProtoReflect.Descriptor instead.
+func (*ForceFlushRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_statsd_adminpb_admin_proto_rawDescGZIP(), []int{7}
+}
+
+type ForceFlushResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ForceFlushResponse) Reset() {
+	*x = ForceFlushResponse{}
+	mi := &file_pkg_statsd_adminpb_admin_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ForceFlushResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ForceFlushResponse) ProtoMessage() {}
+
+func (x *ForceFlushResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_statsd_adminpb_admin_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ForceFlushResponse.ProtoReflect.Descriptor instead.
+func (*ForceFlushResponse) Descriptor() ([]byte, []int) {
+	return file_pkg_statsd_adminpb_admin_proto_rawDescGZIP(), []int{8}
+}
+
+type SearchMetricsRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Type  MetricType             `protobuf:"varint,1,opt,name=type,proto3,enum=gostatsd.admin.MetricType" json:"type,omitempty"`
+	// Regular expression in RE2 syntax matched against metric names.
+	Pattern       string `protobuf:"bytes,2,opt,name=pattern,proto3" json:"pattern,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SearchMetricsRequest) Reset() {
+	*x = SearchMetricsRequest{}
+	mi := &file_pkg_statsd_adminpb_admin_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SearchMetricsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SearchMetricsRequest) ProtoMessage() {}
+
+func (x *SearchMetricsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_statsd_adminpb_admin_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SearchMetricsRequest.ProtoReflect.Descriptor instead.
+func (*SearchMetricsRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_statsd_adminpb_admin_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *SearchMetricsRequest) GetType() MetricType {
+	if x != nil {
+		return x.Type
+	}
+	return MetricType_ALL
+}
+
+func (x *SearchMetricsRequest) GetPattern() string {
+	if x != nil {
+		return x.Pattern
+	}
+	return ""
+}
+
+var File_pkg_statsd_adminpb_admin_proto protoreflect.FileDescriptor
+
+const file_pkg_statsd_adminpb_admin_proto_rawDesc = "" +
+	"\n" +
+	"\x1epkg/statsd/adminpb/admin.proto\x12\x0egostatsd.admin\x1a\x1fgoogle/protobuf/timestamp.proto\"\x11\n" +
+	"\x0fGetStatsRequest\"\xe1\x02\n" +
+	"\x05Stats\x12\x1b\n" +
+	"\tbad_lines\x18\x01 \x01(\x04R\bbadLines\x12)\n" +
+	"\x10metrics_received\x18\x02 \x01(\x04R\x0fmetricsReceived\x12)\n" +
+	"\x10packets_received\x18\x03 \x01(\x04R\x0fpacketsReceived\x12'\n" +
+	"\x0fevents_received\x18\x04 \x01(\x04R\x0eeventsReceived\x12;\n" +
+	"\vlast_packet\x18\x05 \x01(\v2\x1a.google.protobuf.TimestampR\n" +
+	"lastPacket\x129\n" +
+	"\n" +
+	"last_flush\x18\x06 \x01(\v2\x1a.google.protobuf.TimestampR\tlastFlush\x12D\n" +
+	"\x10last_flush_error\x18\a \x01(\v2\x1a.google.protobuf.TimestampR\x0elastFlushError\"\xef\x01\n" +
+	"\x06Metric\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12.\n" +
+	"\x04type\x18\x02 \x01(\x0e2\x1a.gostatsd.admin.MetricTypeR\x04type\x12\x19\n" +
+	"\btags_key\x18\x03 \x01(\tR\atagsKey\x12\x12\n" +
+	"\x04tags\x18\x04 \x03(\tR\x04tags\x12\x1a\n" +
+	"\bhostname\x18\x05 \x01(\tR\bhostname\x12\x14\n" +
+	"\x05value\x18\x06 \x01(\x01R\x05value\x12!\n" +
+	"\ftimer_values\x18\a \x03(\x01R\vtimerValues\x12\x1d\n" +
+	"\n" +
+	"set_values\x18\b \x03(\tR\tsetValues\"D\n" +
+	"\x12ListMetricsRequest\x12.\n" +
+	"\x04type\x18\x01 \x01(\x0e2\x1a.gostatsd.admin.MetricTypeR\x04type\"G\n" +
+	"\x13ListMetricsResponse\x120\n" +
+	"\ametrics\x18\x01 \x03(\v2\x16.gostatsd.admin.MetricR\ametrics\"\\\n" +
+	"\x14DeleteMetricsRequest\x12.\n" +
+	"\x04type\x18\x01 \x01(\x0e2\x1a.gostatsd.admin.MetricTypeR\x04type\x12\x14\n" +
+	"\x05names\x18\x02 \x03(\tR\x05names\"1\n" +
+	"\x15DeleteMetricsResponse\x12\x18\n" +
+	"\adeleted\x18\x01 \x01(\rR\adeleted\"\x13\n" +
+	"\x11ForceFlushRequest\"\x14\n" +
+	"\x12ForceFlushResponse\"`\n" +
+	"\x14SearchMetricsRequest\x12.\n" +
+	"\x04type\x18\x01 \x01(\x0e2\x1a.gostatsd.admin.MetricTypeR\x04type\x12\x18\n" +
+	"\apattern\x18\x02 \x01(\tR\apattern*A\n" +
+	"\n" +
+	"MetricType\x12\a\n" +
+	"\x03ALL\x10\x00\x12\v\n" +
+	"\aCOUNTER\x10\x01\x12\t\n" +
+	"\x05TIMER\x10\x02\x12\t\n" +
+	"\x05GAUGE\x10\x03\x12\a\n" +
+	"\x03SET\x10\x042\xb2\x03\n" +
+	"\x05Admin\x12B\n" +
+	"\bGetStats\x12\x1f.gostatsd.admin.GetStatsRequest\x1a\x15.gostatsd.admin.Stats\x12V\n" +
+	"\vListMetrics\x12\".gostatsd.admin.ListMetricsRequest\x1a#.gostatsd.admin.ListMetricsResponse\x12\\\n" +
+	"\rDeleteMetrics\x12$.gostatsd.admin.DeleteMetricsRequest\x1a%.gostatsd.admin.DeleteMetricsResponse\x12S\n" +
+	"\n" +
+	"ForceFlush\x12!.gostatsd.admin.ForceFlushRequest\x1a\".gostatsd.admin.ForceFlushResponse\x12Z\n" +
+	"\rSearchMetrics\x12$.gostatsd.admin.SearchMetricsRequest\x1a#.gostatsd.admin.ListMetricsResponseB2Z0github.com/atlassian/gostatsd/pkg/statsd/adminpbb\x06proto3"
+
+var (
+	file_pkg_statsd_adminpb_admin_proto_rawDescOnce sync.Once
+	file_pkg_statsd_adminpb_admin_proto_rawDescData []byte
+)
+
+func file_pkg_statsd_adminpb_admin_proto_rawDescGZIP() []byte {
+	file_pkg_statsd_adminpb_admin_proto_rawDescOnce.Do(func() {
+		file_pkg_statsd_adminpb_admin_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_pkg_statsd_adminpb_admin_proto_rawDesc), len(file_pkg_statsd_adminpb_admin_proto_rawDesc)))
+	})
+	return file_pkg_statsd_adminpb_admin_proto_rawDescData
+}
+
+var file_pkg_statsd_adminpb_admin_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_pkg_statsd_adminpb_admin_proto_msgTypes = make([]protoimpl.MessageInfo, 10)
+var file_pkg_statsd_adminpb_admin_proto_goTypes = []any{
+	(MetricType)(0),               // 0: gostatsd.admin.MetricType
+	(*GetStatsRequest)(nil),       // 1: gostatsd.admin.GetStatsRequest
+	(*Stats)(nil),                 // 2: gostatsd.admin.Stats
+	(*Metric)(nil),                // 3: gostatsd.admin.Metric
+	(*ListMetricsRequest)(nil),    // 4: gostatsd.admin.ListMetricsRequest
+	(*ListMetricsResponse)(nil),   // 5: gostatsd.admin.ListMetricsResponse
+	(*DeleteMetricsRequest)(nil),  // 6: gostatsd.admin.DeleteMetricsRequest
+	(*DeleteMetricsResponse)(nil), // 7: gostatsd.admin.DeleteMetricsResponse
+	(*ForceFlushRequest)(nil),     // 8: gostatsd.admin.ForceFlushRequest
+	(*ForceFlushResponse)(nil),    // 9: gostatsd.admin.ForceFlushResponse
+	(*SearchMetricsRequest)(nil),  // 10: gostatsd.admin.SearchMetricsRequest
+	(*timestamppb.Timestamp)(nil), // 11: google.protobuf.Timestamp
+}
+var file_pkg_statsd_adminpb_admin_proto_depIdxs = []int32{
+	11, // 0: gostatsd.admin.Stats.last_packet:type_name -> google.protobuf.Timestamp
+	11, // 1: gostatsd.admin.Stats.last_flush:type_name -> google.protobuf.Timestamp
+	11, // 2: gostatsd.admin.Stats.last_flush_error:type_name -> google.protobuf.Timestamp
+	0,  // 3: gostatsd.admin.Metric.type:type_name -> gostatsd.admin.MetricType
+	0,  // 4: gostatsd.admin.ListMetricsRequest.type:type_name -> gostatsd.admin.MetricType
+	3,  // 5: gostatsd.admin.ListMetricsResponse.metrics:type_name -> gostatsd.admin.Metric
+	0,  // 6: gostatsd.admin.DeleteMetricsRequest.type:type_name -> gostatsd.admin.MetricType
+	0,  // 7: gostatsd.admin.SearchMetricsRequest.type:type_name -> gostatsd.admin.MetricType
+	1,  // 8: gostatsd.admin.Admin.GetStats:input_type -> gostatsd.admin.GetStatsRequest
+	4,  // 9: gostatsd.admin.Admin.ListMetrics:input_type -> gostatsd.admin.ListMetricsRequest
+	6,  // 10: gostatsd.admin.Admin.DeleteMetrics:input_type -> gostatsd.admin.DeleteMetricsRequest
+	8,  // 11: gostatsd.admin.Admin.ForceFlush:input_type -> gostatsd.admin.ForceFlushRequest
+	10, // 12: gostatsd.admin.Admin.SearchMetrics:input_type -> gostatsd.admin.SearchMetricsRequest
+	2,  // 13: gostatsd.admin.Admin.GetStats:output_type -> gostatsd.admin.Stats
+	5,  // 14: gostatsd.admin.Admin.ListMetrics:output_type -> gostatsd.admin.ListMetricsResponse
+	7,  // 15: gostatsd.admin.Admin.DeleteMetrics:output_type -> gostatsd.admin.DeleteMetricsResponse
+	9,  // 16: gostatsd.admin.Admin.ForceFlush:output_type -> gostatsd.admin.ForceFlushResponse
+	5,  // 17: gostatsd.admin.Admin.SearchMetrics:output_type -> gostatsd.admin.ListMetricsResponse
+	13, // [13:18] is the sub-list for method output_type
+	8,  // [8:13] is the sub-list for method input_type
+	8,  // [8:8] is the sub-list for extension type_name
+	8,  // [8:8] is the sub-list for extension extendee
+	0,  // [0:8] is the sub-list for field type_name
+}
+
+func init() { file_pkg_statsd_adminpb_admin_proto_init() }
+func file_pkg_statsd_adminpb_admin_proto_init() {
+	if File_pkg_statsd_adminpb_admin_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_pkg_statsd_adminpb_admin_proto_rawDesc), len(file_pkg_statsd_adminpb_admin_proto_rawDesc)),
+			NumEnums:      1,
+			NumMessages:   10,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_pkg_statsd_adminpb_admin_proto_goTypes,
+		DependencyIndexes: file_pkg_statsd_adminpb_admin_proto_depIdxs,
+		EnumInfos:         file_pkg_statsd_adminpb_admin_proto_enumTypes,
+		MessageInfos:      file_pkg_statsd_adminpb_admin_proto_msgTypes,
+	}.Build()
+	File_pkg_statsd_adminpb_admin_proto = out.File
+	file_pkg_statsd_adminpb_admin_proto_goTypes = nil
+	file_pkg_statsd_adminpb_admin_proto_depIdxs = nil
+}
@@ -0,0 +1,58 @@
+package statsd
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// CPUPinner pins goroutines to CPUs in turn so that each receiver and dispatcher worker keeps its caches warm
+// on one CPU, e.g. on NUMA systems. A nil CPUPinner does not pin goroutines.
+type CPUPinner struct {
+	cpus []int
+	next uint32
+}
+
+// NewCPUPinner initialises a new CPUPinner pinning goroutines to the CPUs in turn. The CPUs the process is
+// allowed to run on are used if none are specified.
+func NewCPUPinner(cpus []int) (*CPUPinner, error) {
+	if len(cpus) == 0 {
+		available, err := availableCPUs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to detect available CPUs: %v", err)
+		}
+		cpus = available
+	}
+	for _, cpu := range cpus {
+		if cpu < 0 {
+			return nil, fmt.Errorf("CPU %d must not be negative", cpu)
+		}
+	}
+	return &CPUPinner{
+		cpus: cpus,
+	}, nil
+}
+
+// Pin locks the calling goroutine to its OS thread and pins the thread to the next CPU. The goroutine must
+// not unlock the thread, which is terminated when the goroutine exits so that no other goroutine runs on it.
+func (p *CPUPinner) Pin() error {
+	if p == nil {
+		return nil
+	}
+	cpu := p.cpus[(atomic.AddUint32(&p.next, 1)-1)%uint32(len(p.cpus))]
+	runtime.LockOSThread()
+	if err := setAffinity(cpu); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to pin to CPU %d: %v", cpu, err)
+	}
+	return nil
+}
+
+// pin pins the calling goroutine like Pin, logging failures.
+func (p *CPUPinner) pin(what string) {
+	if err := p.Pin(); err != nil {
+		log.Warnf("Failed to pin %s: %v", what, err)
+	}
+}
@@ -0,0 +1,39 @@
+//go:build linux
+// +build linux
+
+package statsd
+
+import (
+	"fmt"
+	"math/bits"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxCPUs is the number of CPUs of a unix.CPUSet, 1024 like cpu_set_t of glibc.
+const maxCPUs = len(unix.CPUSet{}) * bits.UintSize
+
+// setAffinity pins the calling thread to the CPU.
+func setAffinity(cpu int) error {
+	if cpu >= maxCPUs {
+		return fmt.Errorf("CPU %d must be less than %d", cpu, maxCPUs)
+	}
+	var set unix.CPUSet
+	set.Set(cpu)
+	return unix.SchedSetaffinity(0, &set)
+}
+
+// availableCPUs returns the CPUs the calling thread is allowed to run on.
+func availableCPUs() ([]int, error) {
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		return nil, err
+	}
+	var cpus []int
+	for cpu := 0; cpu < maxCPUs; cpu++ {
+		if set.IsSet(cpu) {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
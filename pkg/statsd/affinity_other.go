@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package statsd
+
+import "errors"
+
+var errAffinityUnsupported = errors.New("pinning to CPUs is only supported on Linux")
+
+// setAffinity pins the calling thread to the CPU.
+func setAffinity(cpu int) error {
+	return errAffinityUnsupported
+}
+
+// availableCPUs returns the CPUs the calling thread is allowed to run on.
+func availableCPUs() ([]int, error) {
+	return nil, errAffinityUnsupported
+}
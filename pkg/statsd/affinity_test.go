@@ -0,0 +1,90 @@
+package statsd
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCPUPinner(t *testing.T) {
+	t.Parallel()
+	cpus, err := availableCPUs()
+	if err != nil {
+		t.Skipf("Pinning to CPUs is not supported: %v", err)
+	}
+	require.NotEmpty(t, cpus)
+	p, err := NewCPUPinner(nil)
+	require.NoError(t, err)
+	assert.Equal(t, cpus, p.cpus)
+
+	// Goroutines are pinned to the CPUs in turn
+	for i := 0; i < 2*len(cpus); i++ {
+		pinned := make(chan []int, 1)
+		go func() {
+			assert.NoError(t, p.Pin())
+			current, err := availableCPUs()
+			assert.NoError(t, err)
+			pinned <- current
+		}()
+		assert.Equal(t, []int{cpus[i%len(cpus)]}, <-pinned)
+	}
+
+	_, err = NewCPUPinner([]int{0, -1})
+	assert.EqualError(t, err, "CPU -1 must not be negative")
+	var none *CPUPinner
+	assert.NoError(t, none.Pin())
+}
+
+// BenchmarkDispatcherPinned measures the throughput of metrics dispatched to workers pinned to CPUs and not.
+// Pinning is expected to help on multi-socket systems, where workers otherwise move between NUMA nodes.
+func BenchmarkDispatcherPinned(b *testing.B) {
+	for _, pin := range []bool{false, true} {
+		name := "unpinned"
+		if pin {
+			name = "pinned"
+		}
+		b.Run(name, func(b *testing.B) {
+			d := NewMetricDispatcher(DefaultMaxWorkers, DefaultMaxQueueSize, &agrFactory{})
+			if pin {
+				pinner, err := NewCPUPinner(nil)
+				if err != nil {
+					b.Skipf("Pinning to CPUs is not supported: %v", err)
+				}
+				d.SetCPUPinner(pinner)
+			}
+			ctx, cancelFunc := context.WithCancel(context.Background())
+			defer cancelFunc()
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_ = d.Run(ctx)
+			}()
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				names := []string{"foo.bar", "foo.baz", "bar.baz", "baz.foo", "abc.def", "def.ghi", "ghi.jkl", "jkl.mno"}
+				i := 0
+				for pb.Next() {
+					m := getMetric()
+					m.Name = names[i%len(names)]
+					m.Type = gostatsd.COUNTER
+					m.Value = 1
+					i++
+					if err := d.DispatchMetric(ctx, m); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.StopTimer()
+			cancelFunc()
+			wg.Wait()
+		})
+	}
+}
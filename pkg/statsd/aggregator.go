@@ -1,12 +1,15 @@
 package statsd
 
 import (
+	"fmt"
 	"math"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statsd/cardinality"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -21,12 +24,206 @@ type percentStruct struct {
 	lower      string
 }
 
+// NegativeCounterPolicy is the handling of counters with a negative value at the end of a flush interval.
+type NegativeCounterPolicy int
+
+const (
+	// NegativeCountersAllow flushes negative counters unchanged.
+	NegativeCountersAllow NegativeCounterPolicy = iota
+	// NegativeCountersClamp flushes negative counters as zero.
+	NegativeCountersClamp
+	// NegativeCountersDrop does not flush negative counters and counts them in MetricStats.DroppedCounters.
+	NegativeCountersDrop
+)
+
+var negativeCounterPolicyNames = map[NegativeCounterPolicy]string{
+	NegativeCountersAllow: "allow",
+	NegativeCountersClamp: "clamp",
+	NegativeCountersDrop:  "drop",
+}
+
+func (p NegativeCounterPolicy) String() string {
+	if name, ok := negativeCounterPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("NegativeCounterPolicy(%d)", int(p))
+}
+
+// ParseNegativeCounterPolicy returns the policy with the name.
+func ParseNegativeCounterPolicy(name string) (NegativeCounterPolicy, error) {
+	for policy, policyName := range negativeCounterPolicyNames {
+		if policyName == name {
+			return policy, nil
+		}
+	}
+	return NegativeCountersAllow, fmt.Errorf("unknown negative counter policy %q, must be one of allow, clamp, drop", name)
+}
+
+// apply returns the value of the counter according to the policy, or false if the counter is dropped.
+func (p NegativeCounterPolicy) apply(value int64) (int64, bool) {
+	if value >= 0 {
+		return value, true
+	}
+	switch p {
+	case NegativeCountersClamp:
+		return 0, true
+	case NegativeCountersDrop:
+		return 0, false
+	}
+	return value, true
+}
+
+// SetMode is how sets store their values.
+type SetMode int
+
+const (
+	// SetsExact stores the values of sets and flushes the exact number of distinct values.
+	SetsExact SetMode = iota
+	// SetsSketch adds the values of sets to a gostatsd.HyperLogLog sketch and flushes the estimated number of
+	// distinct values. Memory per set is bounded but the values are not available to backends.
+	SetsSketch
+)
+
+var setModeNames = map[SetMode]string{
+	SetsExact:  "exact",
+	SetsSketch: "sketch",
+}
+
+func (m SetMode) String() string {
+	if name, ok := setModeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("SetMode(%d)", int(m))
+}
+
+// ParseSetMode returns the mode with the name.
+func ParseSetMode(name string) (SetMode, error) {
+	for mode, modeName := range setModeNames {
+		if modeName == name {
+			return mode, nil
+		}
+	}
+	return SetsExact, fmt.Errorf("unknown set mode %q, must be one of exact, sketch", name)
+}
+
+// ParseExpiryIntervals returns the expiry intervals of metric types from type=interval pairs, e.g. gauge=1h.
+func ParseExpiryIntervals(pairs []string) (map[gostatsd.MetricType]time.Duration, error) {
+	intervals := make(map[gostatsd.MetricType]time.Duration, len(pairs))
+	for _, pair := range pairs {
+		i := strings.IndexByte(pair, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid expiry interval %q, must be type=interval", pair)
+		}
+		var metricType gostatsd.MetricType
+		switch pair[:i] {
+		case gostatsd.COUNTER.String():
+			metricType = gostatsd.COUNTER
+		case gostatsd.TIMER.String():
+			metricType = gostatsd.TIMER
+		case gostatsd.GAUGE.String():
+			metricType = gostatsd.GAUGE
+		case gostatsd.SET.String():
+			metricType = gostatsd.SET
+		default:
+			return nil, fmt.Errorf("unknown metric type %q of expiry interval, must be one of counter, timer, gauge, set", pair[:i])
+		}
+		d, err := time.ParseDuration(pair[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiry interval of %s: %v", pair[:i], err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("expiry interval %v of %s must not be negative", d, pair[:i])
+		}
+		intervals[metricType] = d
+	}
+	return intervals, nil
+}
+
+// TimerMode is how timers store their values.
+type TimerMode int
+
+const (
+	// TimersExact stores the values of timers and flushes exact summaries and percentiles.
+	TimersExact TimerMode = iota
+	// TimersDigest adds the values of timers to a gostatsd.TDigest and flushes estimated percentiles and median.
+	// Memory per timer is bounded but the values are not available to backends.
+	TimersDigest
+)
+
+var timerModeNames = map[TimerMode]string{
+	TimersExact:  "exact",
+	TimersDigest: "digest",
+}
+
+func (m TimerMode) String() string {
+	if name, ok := timerModeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("TimerMode(%d)", int(m))
+}
+
+// ParseTimerMode returns the mode with the name.
+func ParseTimerMode(name string) (TimerMode, error) {
+	for mode, modeName := range timerModeNames {
+		if modeName == name {
+			return mode, nil
+		}
+	}
+	return TimersExact, fmt.Errorf("unknown timer mode %q, must be one of exact, digest", name)
+}
+
+// PercentileTemplate is the template of the names of upper percentiles of timers. The placeholder {pct} is
+// replaced by the percentile, e.g. 99.9 for the 99.9th percentile, and {pct_int} by its integer part.
+// Dots in names are replaced by underscores, e.g. p{pct} names the 99.9th percentile p99_9.
+type PercentileTemplate string
+
+// DefaultPercentileTemplate is the default template of the names of upper percentiles, e.g. upper_90.
+const DefaultPercentileTemplate PercentileTemplate = "upper_{pct_int}"
+
+// ParsePercentileTemplate returns the template, an error if it does not contain a placeholder.
+func ParsePercentileTemplate(template string) (PercentileTemplate, error) {
+	if !strings.Contains(template, "{pct}") && !strings.Contains(template, "{pct_int}") {
+		return "", fmt.Errorf("percentile template %q must contain {pct} or {pct_int}", template)
+	}
+	return PercentileTemplate(template), nil
+}
+
+// name returns the name of the percentile.
+func (t PercentileTemplate) name(pct float64) string {
+	return strings.NewReplacer(
+		"{pct}", strconv.FormatFloat(pct, 'f', -1, 64),
+		"{pct_int}", strconv.Itoa(int(pct)),
+	).Replace(string(t))
+}
+
 // MetricAggregator aggregates metrics.
 type MetricAggregator struct {
 	expiryInterval    time.Duration // How often to expire metrics
 	percentThresholds map[float64]percentStruct
-	now               func() time.Time // Returns current time. Useful for testing.
+	now               func() time.Time   // Returns current time. Useful for testing.
+	broadcaster       *MetricBroadcaster // Receives updates of metrics, nil if disabled
 	gostatsd.MetricMap
+	negativeCounters        NegativeCounterPolicy // Applied to counters on flush
+	setMode                 SetMode
+	exactSets               map[string]bool // Names of the sets stored exactly regardless of setMode
+	disableZeroFillCounters bool            // Whether counters not updated in the flush interval are skipped instead of flushed as 0
+	disableZeroFillGauges   bool            // Whether gauges not updated in the flush interval are skipped instead of flushed with their last value
+	lastReset               gostatsd.Nanotime
+	timerMode               TimerMode
+	timerCompression        float64 // Compression of the digests of timers, gostatsd.DefaultTDigestCompression if 0
+	// Counters and gauges not updated in the flush interval are kept here from Flush to Reset when they are not
+	// zero filled, so that they are not flushed but still expire.
+	idleCounters gostatsd.Counters
+	idleGauges   gostatsd.Gauges
+
+	// Override expiryInterval for metrics of the types
+	typeExpiryIntervals map[gostatsd.MetricType]time.Duration
+	// Caps the keys of each source, nil if disabled. sourceKeys are the keys of each source reported to it.
+	keyLimiter *SourceKeyLimiter
+	sourceKeys map[string]int
+	// Counts and caps the keys of each type, nil if disabled. cardinalityKeys are the keys reported to it.
+	cardinality     *cardinality.CardinalityTracker
+	cardinalityKeys gostatsd.KeyCounts
 }
 
 // NewMetricAggregator creates a new MetricAggregator object.
@@ -35,6 +232,8 @@ func NewMetricAggregator(percentThresholds []float64, expiryInterval time.Durati
 		expiryInterval:    expiryInterval,
 		percentThresholds: make(map[float64]percentStruct, len(percentThresholds)),
 		now:               time.Now,
+		idleCounters:      gostatsd.Counters{},
+		idleGauges:        gostatsd.Gauges{},
 		MetricMap: gostatsd.MetricMap{
 			Counters: gostatsd.Counters{},
 			Timers:   gostatsd.Timers{},
@@ -49,13 +248,24 @@ func NewMetricAggregator(percentThresholds []float64, expiryInterval time.Durati
 			mean:       "mean_" + sPct,
 			sum:        "sum_" + sPct,
 			sumSquares: "sum_squares_" + sPct,
-			upper:      "upper_" + sPct,
+			upper:      DefaultPercentileTemplate.name(pct),
 			lower:      "lower_" + sPct,
 		}
 	}
 	return &a
 }
 
+// SetPercentileTemplate sets the template of the names of upper percentiles, DefaultPercentileTemplate if empty.
+func (a *MetricAggregator) SetPercentileTemplate(template PercentileTemplate) {
+	if template == "" {
+		template = DefaultPercentileTemplate
+	}
+	for pct, pctStruct := range a.percentThresholds {
+		pctStruct.upper = template.name(pct)
+		a.percentThresholds[pct] = pctStruct
+	}
+}
+
 // round rounds a number to its nearest integer value.
 // poor man's math.Round(x) = math.Floor(x + 0.5).
 func round(v float64) float64 {
@@ -67,14 +277,25 @@ func (a *MetricAggregator) Flush(flushInterval time.Duration) {
 	startTime := a.now()
 	a.FlushInterval = flushInterval
 	flushInSeconds := float64(flushInterval) / float64(time.Second)
+	a.setAsideIdle()
 
 	a.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		value, ok := a.negativeCounters.apply(counter.Value)
+		if !ok {
+			a.DroppedCounters++
+			deleteMetric(key, tagsKey, a.Counters)
+			return
+		}
+		counter.Value = value
 		counter.PerSecond = float64(counter.Value) / flushInSeconds
 		a.Counters[key][tagsKey] = counter
 	})
 
 	a.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
-		if count := len(timer.Values); count > 0 {
+		if timer.Digest != nil && timer.Digest.Count() > 0 {
+			a.flushDigest(&timer, flushInSeconds)
+			a.Timers[key][tagsKey] = timer
+		} else if count := len(timer.Values); count > 0 {
 			sort.Float64s(timer.Values)
 			timer.Min = timer.Values[0]
 			timer.Max = timer.Values[count-1]
@@ -154,15 +375,173 @@ func (a *MetricAggregator) Flush(flushInterval time.Duration) {
 		}
 	})
 
+	a.Keys = countKeys(&a.MetricMap)
 	a.ProcessingTime = a.now().Sub(startTime)
 }
 
+// flushDigest calculates the summaries and percentiles of a digested timer. Percentiles are estimated from the
+// digest, the sums of the values within percentiles from the means of its centroids.
+func (a *MetricAggregator) flushDigest(timer *gostatsd.Timer, flushInSeconds float64) {
+	summarizeTimer(timer)
+	d := timer.Digest
+	count := float64(timer.Count)
+	for pct, pctStruct := range a.percentThresholds {
+		numInThreshold := timer.Count
+		mean, sum, sumSquares := timer.Min, timer.Min, timer.Min*timer.Min
+		thresholdBoundary := timer.Max
+		if timer.Count > 1 {
+			numInThreshold = int(round(math.Abs(pct) / 100 * count))
+			if numInThreshold == 0 {
+				continue
+			}
+			n := float64(numInThreshold)
+			// The i-th smallest value is at the middle of its weight, i.e. at quantile (i-0.5)/count
+			if pct > 0 {
+				thresholdBoundary = d.Quantile((n - 0.5) / count)
+				_, sum, sumSquares = d.CumulativeSum(n / count)
+			} else {
+				thresholdBoundary = d.Quantile((count - n + 0.5) / count)
+				_, lowSum, lowSumSquares := d.CumulativeSum((count - n) / count)
+				sum, sumSquares = timer.Sum-lowSum, timer.SumSquares-lowSumSquares
+			}
+			mean = sum / n
+		}
+
+		timer.Percentiles.Set(pctStruct.count, float64(numInThreshold))
+		timer.Percentiles.Set(pctStruct.mean, mean)
+		timer.Percentiles.Set(pctStruct.sum, sum)
+		timer.Percentiles.Set(pctStruct.sumSquares, sumSquares)
+		if pct > 0 {
+			timer.Percentiles.Set(pctStruct.upper, thresholdBoundary)
+		} else {
+			timer.Percentiles.Set(pctStruct.lower, thresholdBoundary)
+		}
+	}
+	timer.PerSecond = count / flushInSeconds
+}
+
+// setAsideIdle moves counters and gauges not updated since the last Reset into the idle maps if they are not
+// zero filled.
+func (a *MetricAggregator) setAsideIdle() {
+	if a.disableZeroFillCounters {
+		a.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+			if counter.Timestamp < a.lastReset {
+				if a.idleCounters[key] == nil {
+					a.idleCounters[key] = make(map[string]gostatsd.Counter)
+				}
+				a.idleCounters[key][tagsKey] = counter
+				deleteMetric(key, tagsKey, a.Counters)
+			}
+		})
+	}
+	if a.disableZeroFillGauges {
+		a.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+			if gauge.Timestamp < a.lastReset {
+				if a.idleGauges[key] == nil {
+					a.idleGauges[key] = make(map[string]gostatsd.Gauge)
+				}
+				a.idleGauges[key][tagsKey] = gauge
+				deleteMetric(key, tagsKey, a.Gauges)
+			}
+		})
+	}
+}
+
+// restoreIdle moves counters and gauges set aside by setAsideIdle back so that they are tracked until they expire.
+func (a *MetricAggregator) restoreIdle() {
+	a.idleCounters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		if a.Counters[key] == nil {
+			a.Counters[key] = make(map[string]gostatsd.Counter)
+		}
+		a.Counters[key][tagsKey] = counter
+	})
+	a.idleGauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		if a.Gauges[key] == nil {
+			a.Gauges[key] = make(map[string]gostatsd.Gauge)
+		}
+		a.Gauges[key][tagsKey] = gauge
+	})
+	a.idleCounters = gostatsd.Counters{}
+	a.idleGauges = gostatsd.Gauges{}
+}
+
+// countKeys returns the number of distinct keys per type of the MetricMap.
+func countKeys(m *gostatsd.MetricMap) gostatsd.KeyCounts {
+	var k gostatsd.KeyCounts
+	for _, v := range m.Counters {
+		k.Counters += uint32(len(v))
+	}
+	for _, v := range m.Timers {
+		k.Timers += uint32(len(v))
+	}
+	for _, v := range m.Gauges {
+		k.Gauges += uint32(len(v))
+	}
+	for _, v := range m.Sets {
+		k.Sets += uint32(len(v))
+	}
+	return k
+}
+
 func (a *MetricAggregator) Process(f ProcessFunc) {
 	f(&a.MetricMap)
 }
 
-func (a *MetricAggregator) isExpired(now, ts gostatsd.Nanotime) bool {
-	return a.expiryInterval != 0 && time.Duration(now-ts) > a.expiryInterval
+// SetExpiryIntervals sets the expiry intervals of metrics of the types, overriding the expiry interval of the
+// aggregator. Metrics of a type with a 0 interval do not expire.
+func (a *MetricAggregator) SetExpiryIntervals(intervals map[gostatsd.MetricType]time.Duration) {
+	a.typeExpiryIntervals = intervals
+}
+
+// SetSourceKeyLimiter caps the number of keys of each source with the limiter shared by all aggregators.
+// Metrics with new keys from sources with too many keys are dropped.
+func (a *MetricAggregator) SetSourceKeyLimiter(l *SourceKeyLimiter) {
+	a.keyLimiter = l
+	a.sourceKeys = make(map[string]int)
+}
+
+// SetCardinalityTracker counts the keys of each type with the tracker shared by all aggregators. Metrics with new
+// keys are dropped once there are as many keys as the limit of the tracker.
+func (a *MetricAggregator) SetCardinalityTracker(t *cardinality.CardinalityTracker) {
+	a.cardinality = t
+}
+
+// reportSourceKeys reports the changes of the numbers of keys of each source to the key limiter.
+func (a *MetricAggregator) reportSourceKeys() {
+	keys := make(map[string]int, len(a.sourceKeys))
+	a.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		keys[counter.Hostname]++
+	})
+	a.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		keys[timer.Hostname]++
+	})
+	a.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		keys[gauge.Hostname]++
+	})
+	a.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+		keys[set.Hostname]++
+	})
+	deltas := make(map[string]int)
+	for source, n := range keys {
+		if delta := n - a.sourceKeys[source]; delta != 0 {
+			deltas[source] = delta
+		}
+	}
+	for source, n := range a.sourceKeys {
+		if _, ok := keys[source]; !ok {
+			deltas[source] = -n
+		}
+	}
+	a.keyLimiter.update(deltas)
+	a.sourceKeys = keys
+}
+
+func (a *MetricAggregator) isExpired(now, ts gostatsd.Nanotime, metricType gostatsd.MetricType) bool {
+	interval, ok := a.typeExpiryIntervals[metricType]
+	if !ok {
+		interval = a.expiryInterval
+	}
+	return interval != 0 && time.Duration(now-ts) > interval
 }
 
 func deleteMetric(key, tagsKey string, metrics gostatsd.AggregatedMetrics) {
@@ -172,54 +551,76 @@ func deleteMetric(key, tagsKey string, metrics gostatsd.AggregatedMetrics) {
 	}
 }
 
-// Reset clears the contents of an MetricAggregator.
+// Reset clears the contents of an MetricAggregator. Expired keys are counted in ExpiredKeys until the next Reset.
 func (a *MetricAggregator) Reset() {
 	a.NumStats = 0
+	a.DroppedCounters = 0
+	a.Keys = gostatsd.KeyCounts{}
+	a.NewKeys = gostatsd.KeyCounts{}
+	a.ExpiredKeys = gostatsd.KeyCounts{}
 	nowNano := gostatsd.Nanotime(a.now().UnixNano())
+	a.lastReset = nowNano
+	a.restoreIdle()
 
 	a.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
-		if a.isExpired(nowNano, counter.Timestamp) {
+		if a.isExpired(nowNano, counter.Timestamp, gostatsd.COUNTER) {
 			deleteMetric(key, tagsKey, a.Counters)
+			a.ExpiredKeys.Counters++
 		} else {
 			a.Counters[key][tagsKey] = gostatsd.Counter{
 				Timestamp: counter.Timestamp,
 				Hostname:  counter.Hostname,
 				Tags:      counter.Tags,
+				Unit:      counter.Unit,
 			}
 		}
 	})
 
 	a.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
-		if a.isExpired(nowNano, timer.Timestamp) {
+		if a.isExpired(nowNano, timer.Timestamp, gostatsd.TIMER) {
 			deleteMetric(key, tagsKey, a.Timers)
+			a.ExpiredKeys.Timers++
 		} else {
 			a.Timers[key][tagsKey] = gostatsd.Timer{
 				Timestamp: timer.Timestamp,
 				Hostname:  timer.Hostname,
 				Tags:      timer.Tags,
+				Unit:      timer.Unit,
 			}
 		}
 	})
 
 	a.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
-		if a.isExpired(nowNano, gauge.Timestamp) {
+		if a.isExpired(nowNano, gauge.Timestamp, gostatsd.GAUGE) {
 			deleteMetric(key, tagsKey, a.Gauges)
+			a.ExpiredKeys.Gauges++
 		}
 		// No reset for gauges, they keep the last value until expiration
 	})
 
 	a.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
-		if a.isExpired(nowNano, set.Timestamp) {
+		if a.isExpired(nowNano, set.Timestamp, gostatsd.SET) {
 			deleteMetric(key, tagsKey, a.Sets)
+			a.ExpiredKeys.Sets++
 		} else {
 			a.Sets[key][tagsKey] = gostatsd.Set{
 				Values:    make(map[string]struct{}),
 				Timestamp: set.Timestamp,
 				Hostname:  set.Hostname,
 				Tags:      set.Tags,
+				Unit:      set.Unit,
 			}
 		}
 	})
+
+	if a.keyLimiter != nil {
+		a.reportSourceKeys()
+	}
+	if a.cardinality != nil {
+		keys := countKeys(&a.MetricMap)
+		a.cardinality.Update(a.cardinalityKeys, keys)
+		a.cardinalityKeys = keys
+	}
 }
 
 func (a *MetricAggregator) receiveCounter(m *gostatsd.Metric, tagsKey string, now gostatsd.Nanotime) {
@@ -232,30 +633,43 @@ func (a *MetricAggregator) receiveCounter(m *gostatsd.Metric, tagsKey string, no
 			c.Timestamp = now
 		} else {
 			c = gostatsd.NewCounter(now, value, m.Hostname, m.Tags)
+			a.NewKeys.Counters++
 		}
+		c.Unit = receivedUnit(m, c.Unit)
 		v[tagsKey] = c
 	} else {
+		c := gostatsd.NewCounter(now, value, m.Hostname, m.Tags)
+		a.NewKeys.Counters++
+		c.Unit = m.Unit
 		a.Counters[m.Name] = map[string]gostatsd.Counter{
-			tagsKey: gostatsd.NewCounter(now, value, m.Hostname, m.Tags),
+			tagsKey: c,
 		}
 	}
 }
 
 func (a *MetricAggregator) receiveGauge(m *gostatsd.Metric, tagsKey string, now gostatsd.Nanotime) {
-	// TODO: handle +/-
 	v, ok := a.Gauges[m.Name]
 	if ok {
 		g, ok := v[tagsKey]
 		if ok {
-			g.Value = m.Value
+			if m.GaugeDelta {
+				g.Value += m.Value
+			} else {
+				g.Value = m.Value
+			}
 			g.Timestamp = now
 		} else {
 			g = gostatsd.NewGauge(now, m.Value, m.Hostname, m.Tags)
+			a.NewKeys.Gauges++
 		}
+		g.Unit = receivedUnit(m, g.Unit)
 		v[tagsKey] = g
 	} else {
+		g := gostatsd.NewGauge(now, m.Value, m.Hostname, m.Tags)
+		a.NewKeys.Gauges++
+		g.Unit = m.Unit
 		a.Gauges[m.Name] = map[string]gostatsd.Gauge{
-			tagsKey: gostatsd.NewGauge(now, m.Value, m.Hostname, m.Tags),
+			tagsKey: g,
 		}
 	}
 }
@@ -265,17 +679,53 @@ func (a *MetricAggregator) receiveTimer(m *gostatsd.Metric, tagsKey string, now
 	if ok {
 		t, ok := v[tagsKey]
 		if ok {
-			t.Values = append(t.Values, m.Value)
 			t.Timestamp = now
 		} else {
-			t = gostatsd.NewTimer(now, []float64{m.Value}, m.Hostname, m.Tags)
+			t = gostatsd.NewTimer(now, nil, m.Hostname, m.Tags)
+			a.NewKeys.Timers++
+		}
+		a.addTimerValue(&t, m)
+		t.Unit = receivedUnit(m, t.Unit)
+		if m.Buckets != nil {
+			t.Buckets = t.Buckets.Merge(m.Buckets)
 		}
 		v[tagsKey] = t
 	} else {
+		t := gostatsd.NewTimer(now, nil, m.Hostname, m.Tags)
+		a.NewKeys.Timers++
+		a.addTimerValue(&t, m)
+		t.Unit = m.Unit
+		t.Buckets = m.Buckets.Merge(nil)
 		a.Timers[m.Name] = map[string]gostatsd.Timer{
-			tagsKey: gostatsd.NewTimer(now, []float64{m.Value}, m.Hostname, m.Tags),
+			tagsKey: t,
+		}
+	}
+}
+
+// addTimerValue adds the value of the metric to the values or the digest of the timer according to the timer mode.
+// The digest of the metric is merged instead of the value if it has one. Its values are estimated by the means of
+// its centroids if timers are not digested, e.g. after the timer mode was changed.
+func (a *MetricAggregator) addTimerValue(t *gostatsd.Timer, m *gostatsd.Metric) {
+	if a.timerMode != TimersDigest {
+		if m.Digest == nil {
+			t.Values = append(t.Values, m.Value)
+			return
+		}
+		for _, c := range m.Digest.Centroids() {
+			for i := 0.0; i < c.Weight; i++ {
+				t.Values = append(t.Values, c.Mean)
+			}
 		}
+		return
 	}
+	if t.Digest == nil {
+		t.Digest = gostatsd.NewTDigest(a.timerCompression)
+	}
+	if m.Digest != nil {
+		t.Digest.Merge(m.Digest)
+		return
+	}
+	t.Digest.Add(m.Value)
 }
 
 func (a *MetricAggregator) receiveSet(m *gostatsd.Metric, tagsKey string, now gostatsd.Nanotime) {
@@ -283,24 +733,53 @@ func (a *MetricAggregator) receiveSet(m *gostatsd.Metric, tagsKey string, now go
 	if ok {
 		s, ok := v[tagsKey]
 		if ok {
-			s.Values[m.StringValue] = struct{}{}
 			s.Timestamp = now
 		} else {
-			s = gostatsd.NewSet(now, map[string]struct{}{m.StringValue: {}}, m.Hostname, m.Tags)
+			s = gostatsd.NewSet(now, make(map[string]struct{}), m.Hostname, m.Tags)
+			a.NewKeys.Sets++
 		}
+		a.addSetValue(&s, m)
+		s.Unit = receivedUnit(m, s.Unit)
 		v[tagsKey] = s
 	} else {
+		s := gostatsd.NewSet(now, make(map[string]struct{}), m.Hostname, m.Tags)
+		a.NewKeys.Sets++
+		a.addSetValue(&s, m)
+		s.Unit = m.Unit
 		a.Sets[m.Name] = map[string]gostatsd.Set{
-			tagsKey: gostatsd.NewSet(now, map[string]struct{}{m.StringValue: {}}, m.Hostname, m.Tags),
+			tagsKey: s,
 		}
 	}
 }
 
+// addSetValue adds the value of the metric to the values or the sketch of the set according to the set mode.
+func (a *MetricAggregator) addSetValue(s *gostatsd.Set, m *gostatsd.Metric) {
+	if a.setMode != SetsSketch || a.exactSets[m.Name] {
+		s.Values[m.StringValue] = struct{}{}
+		return
+	}
+	if s.Sketch == nil {
+		s.Sketch = gostatsd.NewHyperLogLog()
+	}
+	s.Sketch.Add(m.StringValue)
+}
+
+// receivedUnit returns the unit of the received metric, or the unit of the aggregated metric if the received one has none.
+func receivedUnit(m *gostatsd.Metric, unit string) string {
+	if m.Unit != "" {
+		return m.Unit
+	}
+	return unit
+}
+
 // Receive aggregates an incoming metric.
 func (a *MetricAggregator) Receive(m *gostatsd.Metric, now time.Time) {
 	a.NumStats++
 	tagsKey := formatTagsKey(m.Tags, m.Hostname)
 	nowNano := gostatsd.Nanotime(now.UnixNano())
+	if (a.keyLimiter != nil || a.limitsCardinality()) && !a.hasKey(m, tagsKey) && !a.allowKey(m) {
+		return
+	}
 
 	switch m.Type {
 	case gostatsd.COUNTER:
@@ -313,7 +792,79 @@ func (a *MetricAggregator) Receive(m *gostatsd.Metric, now time.Time) {
 		a.receiveSet(m, tagsKey, nowNano)
 	default:
 		log.Errorf("Unknow metric type %s for %s", m.Type, m.Name)
+		return
+	}
+	if a.broadcaster != nil && a.broadcaster.hasSubscribers() {
+		a.broadcaster.Publish(a.metricUpdate(m, tagsKey))
+	}
+}
+
+// limitsCardinality returns whether new keys are counted by the cardinality tracker as they are created, so
+// that they are capped.
+func (a *MetricAggregator) limitsCardinality() bool {
+	return a.cardinality != nil && a.cardinality.Limit() > 0
+}
+
+// allowKey returns whether the metric may create a new key, which is counted by the cardinality tracker and the
+// source key limiter if so.
+func (a *MetricAggregator) allowKey(m *gostatsd.Metric) bool {
+	limited := a.limitsCardinality()
+	if limited && !a.cardinality.Allow(m.Type, m.Name) {
+		return false
+	}
+	if a.keyLimiter != nil {
+		if !a.keyLimiter.allow(m.Hostname) {
+			if limited {
+				a.cardinality.Release(m.Type)
+			}
+			return false
+		}
+		a.sourceKeys[m.Hostname]++
+	}
+	if limited {
+		a.cardinalityKeys.Inc(m.Type)
+	}
+	return true
+}
+
+// hasKey returns whether the metric updates an existing key. Metrics of unknown types create no keys.
+func (a *MetricAggregator) hasKey(m *gostatsd.Metric, tagsKey string) bool {
+	var ok bool
+	switch m.Type {
+	case gostatsd.COUNTER:
+		_, ok = a.Counters[m.Name][tagsKey]
+	case gostatsd.GAUGE:
+		_, ok = a.Gauges[m.Name][tagsKey]
+	case gostatsd.TIMER:
+		_, ok = a.Timers[m.Name][tagsKey]
+	case gostatsd.SET:
+		_, ok = a.Sets[m.Name][tagsKey]
+	default:
+		ok = true
+	}
+	return ok
+}
+
+// metricUpdate returns the aggregated value of the received metric.
+func (a *MetricAggregator) metricUpdate(m *gostatsd.Metric, tagsKey string) MetricUpdate {
+	u := MetricUpdate{
+		Name:     m.Name,
+		Type:     m.Type,
+		TagsKey:  tagsKey,
+		Tags:     m.Tags,
+		Hostname: m.Hostname,
+	}
+	switch m.Type {
+	case gostatsd.COUNTER:
+		u.Value = float64(a.Counters[m.Name][tagsKey].Value)
+	case gostatsd.GAUGE:
+		u.Value = a.Gauges[m.Name][tagsKey].Value
+	case gostatsd.TIMER:
+		u.Value = float64(a.Timers[m.Name][tagsKey].NumValues())
+	case gostatsd.SET:
+		u.Value = float64(a.Sets[m.Name][tagsKey].Cardinality())
 	}
+	return u
 }
 
 func formatTagsKey(tags gostatsd.Tags, hostname string) string {
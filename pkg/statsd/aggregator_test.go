@@ -1,12 +1,19 @@
 package statsd
 
 import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statsd/cardinality"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func newFakeAggregator() *MetricAggregator {
@@ -103,6 +110,44 @@ func TestFlush(t *testing.T) {
 	assert.Equal(expected.Sets, ma.Sets)
 }
 
+func TestFlushPercentileTemplate(t *testing.T) {
+	t.Parallel()
+	values := make([]float64, 0, 1000)
+	for i := 1; i <= 1000; i++ {
+		values = append(values, float64(i))
+	}
+	tests := []struct {
+		template PercentileTemplate
+		expected map[string]float64
+	}{
+		{"", map[string]float64{"upper_95": 950, "upper_99": 999}},
+		{"p{pct}", map[string]float64{"p95": 950, "p99_9": 999}},
+		{"{pct_int}percentile", map[string]float64{"95percentile": 950, "99percentile": 999}},
+	}
+	for _, test := range tests {
+		ma := NewMetricAggregator([]float64{95, 99.9}, 0)
+		ma.SetPercentileTemplate(test.template)
+		ma.Timers["t"] = map[string]gostatsd.Timer{"": {Values: append([]float64(nil), values...)}}
+		ma.Flush(time.Second)
+		upper := map[string]float64{}
+		for _, pct := range ma.Timers["t"][""].Percentiles {
+			if !strings.HasPrefix(pct.Str, "count_") && !strings.HasPrefix(pct.Str, "mean_") && !strings.HasPrefix(pct.Str, "sum_") {
+				upper[pct.Str] = pct.Float
+			}
+		}
+		assert.Equal(t, test.expected, upper, "template %q", test.template)
+	}
+}
+
+func TestParsePercentileTemplate(t *testing.T) {
+	t.Parallel()
+	template, err := ParsePercentileTemplate("{pct}percentile")
+	require.NoError(t, err)
+	assert.Equal(t, "99.9percentile", template.name(99.9))
+	_, err = ParsePercentileTemplate("p95")
+	assert.EqualError(t, err, `percentile template "p95" must contain {pct} or {pct_int}`)
+}
+
 func BenchmarkFlush(b *testing.B) {
 	ma := newFakeAggregator()
 	ma.Counters["some"] = make(map[string]gostatsd.Counter)
@@ -263,6 +308,285 @@ func TestReset(t *testing.T) {
 	assert.Equal(expected.Sets, actual.Sets)
 }
 
+func TestCounterFlushedAsZeroUntilExpiry(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	ma := newFakeAggregator()
+	ma.expiryInterval = 10 * time.Second
+	ma.now = func() time.Time {
+		return now
+	}
+	ma.Receive(&gostatsd.Metric{Name: "c", Value: 3, Type: gostatsd.COUNTER}, now)
+	ma.Flush(time.Second)
+	assert.EqualValues(t, 3, ma.Counters["c"][""].Value)
+	ma.Reset()
+
+	// The counter is flushed as 0 for the following quiet intervals until it expires
+	for i := 1; i <= 10; i++ {
+		now = now.Add(time.Second)
+		ma.Flush(time.Second)
+		counter, ok := ma.Counters["c"][""]
+		require.True(t, ok, "interval %d", i)
+		assert.EqualValues(t, 0, counter.Value)
+		assert.EqualValues(t, 0, counter.PerSecond)
+		ma.Reset()
+	}
+	now = now.Add(time.Second)
+	ma.Flush(time.Second)
+	ma.Reset()
+	assert.Empty(t, ma.Counters)
+	assert.EqualValues(t, 1, ma.ExpiredKeys.Counters)
+}
+
+func TestZeroFillDisabled(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	ma := newFakeAggregator()
+	ma.expiryInterval = 10 * time.Second
+	ma.disableZeroFillCounters = true
+	ma.disableZeroFillGauges = true
+	ma.now = func() time.Time {
+		return now
+	}
+	ma.Receive(&gostatsd.Metric{Name: "c", Value: 3, Type: gostatsd.COUNTER}, now)
+	ma.Receive(&gostatsd.Metric{Name: "g", Value: 7, Type: gostatsd.GAUGE}, now)
+	now = now.Add(time.Second)
+	ma.Flush(time.Second)
+	assert.EqualValues(t, 3, ma.Counters["c"][""].Value)
+	assert.EqualValues(t, 7, ma.Gauges["g"][""].Value)
+	ma.Reset()
+
+	// Metrics not updated in the interval are not flushed
+	now = now.Add(time.Second)
+	ma.Flush(time.Second)
+	assert.Empty(t, ma.Counters)
+	assert.Empty(t, ma.Gauges)
+	ma.Reset()
+
+	// But they are still tracked until they expire
+	ma.Receive(&gostatsd.Metric{Name: "c", Value: 1, Type: gostatsd.COUNTER}, now.Add(time.Millisecond))
+	now = now.Add(time.Second)
+	ma.Flush(time.Second)
+	assert.EqualValues(t, 1, ma.Counters["c"][""].Value)
+	assert.Empty(t, ma.Gauges)
+	assert.Zero(t, ma.NewKeys.Counters)
+	ma.Reset()
+	now = now.Add(9 * time.Second)
+	ma.Flush(time.Second)
+	ma.Reset()
+	assert.EqualValues(t, 1, ma.ExpiredKeys.Gauges)
+	assert.Zero(t, ma.ExpiredKeys.Counters)
+	now = now.Add(2 * time.Second)
+	ma.Flush(time.Second)
+	ma.Reset()
+	assert.EqualValues(t, 1, ma.ExpiredKeys.Counters)
+	assert.Empty(t, ma.Counters)
+	assert.Empty(t, ma.Gauges)
+}
+
+func TestReceiveSetSketch(t *testing.T) {
+	t.Parallel()
+	ma := newFakeAggregator()
+	ma.setMode = SetsSketch
+	ma.exactSets = map[string]bool{"exact": true}
+	now := time.Now()
+	cardinality := 50000
+	for i := 0; i < cardinality; i++ {
+		value := strconv.Itoa(i)
+		ma.Receive(&gostatsd.Metric{Name: "users", StringValue: value, Type: gostatsd.SET}, now)
+		ma.Receive(&gostatsd.Metric{Name: "users", StringValue: value, Type: gostatsd.SET}, now)
+	}
+	ma.Receive(&gostatsd.Metric{Name: "exact", StringValue: "a", Type: gostatsd.SET}, now)
+	ma.Receive(&gostatsd.Metric{Name: "exact", StringValue: "b", Type: gostatsd.SET}, now)
+
+	set := ma.Sets["users"][""]
+	require.NotNil(t, set.Sketch)
+	assert.Empty(t, set.Values)
+	// Within three standard errors of HyperLogLog
+	assert.InEpsilon(t, cardinality, set.Cardinality(), 3*1.04/math.Sqrt(1<<gostatsd.HyperLogLogPrecision))
+	exact := ma.Sets["exact"][""]
+	assert.Nil(t, exact.Sketch)
+	assert.Equal(t, map[string]struct{}{"a": {}, "b": {}}, exact.Values)
+
+	ma.Reset()
+	assert.Equal(t, 0, ma.Sets["users"][""].Cardinality())
+}
+
+func TestParseExpiryIntervals(t *testing.T) {
+	t.Parallel()
+	intervals, err := ParseExpiryIntervals([]string{"counter=1m", "gauge=1h", "set=0s"})
+	require.NoError(t, err)
+	assert.Equal(t, map[gostatsd.MetricType]time.Duration{
+		gostatsd.COUNTER: time.Minute,
+		gostatsd.GAUGE:   time.Hour,
+		gostatsd.SET:     0,
+	}, intervals)
+
+	for _, pairs := range [][]string{{"counter"}, {"histogram=1m"}, {"timer=1"}, {"gauge=-1m"}} {
+		_, err := ParseExpiryIntervals(pairs)
+		assert.Error(t, err, "%v", pairs)
+	}
+}
+
+func TestParseSetMode(t *testing.T) {
+	t.Parallel()
+	for _, mode := range []SetMode{SetsExact, SetsSketch} {
+		parsed, err := ParseSetMode(mode.String())
+		require.NoError(t, err)
+		assert.Equal(t, mode, parsed)
+	}
+	_, err := ParseSetMode("sample")
+	assert.Error(t, err)
+}
+
+func TestParseTimerMode(t *testing.T) {
+	t.Parallel()
+	for _, mode := range []TimerMode{TimersExact, TimersDigest} {
+		parsed, err := ParseTimerMode(mode.String())
+		require.NoError(t, err)
+		assert.Equal(t, mode, parsed)
+	}
+	_, err := ParseTimerMode("histogram")
+	assert.Error(t, err)
+}
+
+// percentileValue returns the value of the percentile with the name.
+func percentileValue(percentiles gostatsd.Percentiles, name string) (float64, bool) {
+	for _, pct := range percentiles {
+		if pct.Str == name {
+			return pct.Float, true
+		}
+	}
+	return 0, false
+}
+
+func TestFlushTimerDigestSmall(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	exact := NewMetricAggregator([]float64{50, 90, -10}, 5*time.Minute)
+	digest := NewMetricAggregator([]float64{50, 90, -10}, 5*time.Minute)
+	digest.timerMode = TimersDigest
+	for _, value := range []float64{12, 2, 4, 7} {
+		for _, ma := range []*MetricAggregator{exact, digest} {
+			ma.Receive(&gostatsd.Metric{Name: "t", Value: value, Type: gostatsd.TIMER}, now)
+		}
+	}
+	digest.Receive(&gostatsd.Metric{Name: "single", Value: 3, Type: gostatsd.TIMER}, now)
+	exact.Receive(&gostatsd.Metric{Name: "single", Value: 3, Type: gostatsd.TIMER}, now)
+	exact.Flush(10 * time.Second)
+	digest.Flush(10 * time.Second)
+
+	// Few values are not compressed, so the estimates are exact
+	for _, name := range []string{"t", "single"} {
+		expected, actual := exact.Timers[name][""], digest.Timers[name][""]
+		require.NotNil(t, actual.Digest)
+		assert.Empty(t, actual.Values)
+		assert.Equal(t, expected.Count, actual.Count, name)
+		assert.Equal(t, expected.Min, actual.Min, name)
+		assert.Equal(t, expected.Max, actual.Max, name)
+		assert.Equal(t, expected.Median, actual.Median, name)
+		assert.Equal(t, expected.PerSecond, actual.PerSecond, name)
+		assert.InDelta(t, expected.Mean, actual.Mean, 1e-9, name)
+		assert.InDelta(t, expected.StdDev, actual.StdDev, 1e-9, name)
+		require.Len(t, actual.Percentiles, len(expected.Percentiles), name)
+		for _, pct := range expected.Percentiles {
+			value, ok := percentileValue(actual.Percentiles, pct.Str)
+			require.True(t, ok, "%s: %s", name, pct.Str)
+			assert.InDelta(t, pct.Float, value, 1e-9, "%s: %s", name, pct.Str)
+		}
+	}
+
+	digest.Reset()
+	assert.Nil(t, digest.Timers["t"][""].Digest)
+	assert.Zero(t, digest.Timers["t"][""].NumValues())
+}
+
+func TestFlushTimerDigestAccuracy(t *testing.T) {
+	t.Parallel()
+	distributions := map[string]func(r *rand.Rand) float64{
+		"uniform":     func(r *rand.Rand) float64 { return r.Float64() * 1000 },
+		"normal":      func(r *rand.Rand) float64 { return r.NormFloat64()*50 + 200 },
+		"exponential": func(r *rand.Rand) float64 { return r.ExpFloat64() * 100 },
+		"lognormal":   func(r *rand.Rand) float64 { return math.Exp(r.NormFloat64() * 2) },
+	}
+	thresholds := []float64{50, 90, 99, -10}
+	now := time.Now()
+	for name, dist := range distributions {
+		r := rand.New(rand.NewSource(1))
+		exact := NewMetricAggregator(thresholds, 5*time.Minute)
+		// Values are digested by two aggregators and merged like for backends with longer flush intervals
+		parts := []*MetricAggregator{
+			NewMetricAggregator(thresholds, 5*time.Minute),
+			NewMetricAggregator(thresholds, 5*time.Minute),
+		}
+		for _, ma := range parts {
+			ma.timerMode = TimersDigest
+		}
+		values := make([]float64, 50000)
+		for i := range values {
+			values[i] = dist(r)
+			exact.Receive(&gostatsd.Metric{Name: "t", Value: values[i], Type: gostatsd.TIMER}, now)
+			parts[i%2].Receive(&gostatsd.Metric{Name: "t", Value: values[i], Type: gostatsd.TIMER}, now)
+		}
+		sort.Float64s(values)
+		merged := NewMetricAggregator(thresholds, 5*time.Minute)
+		for _, ma := range parts {
+			mergeMetricMap(&merged.MetricMap, &ma.MetricMap)
+		}
+		exact.Flush(10 * time.Second)
+		merged.Flush(10 * time.Second)
+
+		expected, actual := exact.Timers["t"][""], merged.Timers["t"][""]
+		assert.Equal(t, expected.Count, actual.Count, name)
+		assert.Equal(t, expected.Min, actual.Min, name)
+		assert.Equal(t, expected.Max, actual.Max, name)
+		assert.InEpsilon(t, expected.Sum, actual.Sum, 1e-9, name)
+		assert.InEpsilon(t, expected.Mean, actual.Mean, 1e-9, name)
+		assert.InEpsilon(t, expected.StdDev, actual.StdDev, 1e-6, name)
+		// Estimated values are compared by their rank among the exact values
+		rank := func(value float64) float64 {
+			return float64(sort.SearchFloat64s(values, value)) / float64(len(values))
+		}
+		assert.InDelta(t, 0.5, rank(actual.Median), 0.01, name)
+		for _, pct := range expected.Percentiles {
+			value, ok := percentileValue(actual.Percentiles, pct.Str)
+			require.True(t, ok, "%s: %s", name, pct.Str)
+			switch {
+			case strings.HasPrefix(pct.Str, "upper_") || strings.HasPrefix(pct.Str, "lower_"):
+				assert.InDelta(t, rank(pct.Float), rank(value), 0.01, "%s: %s", name, pct.Str)
+			case strings.HasPrefix(pct.Str, "count_"):
+				assert.Equal(t, pct.Float, value, "%s: %s", name, pct.Str)
+			default:
+				// Sums of squares of heavy tails are the least accurate
+				assert.InEpsilon(t, pct.Float, value, 0.05, "%s: %s", name, pct.Str)
+			}
+		}
+	}
+}
+
+func TestReceiveHistogramBuckets(t *testing.T) {
+	t.Parallel()
+	inf := math.Inf(1)
+	ma := newFakeAggregator()
+	now := time.Now()
+	ma.Receive(&gostatsd.Metric{Name: "h", Value: 100, Type: gostatsd.TIMER, Buckets: gostatsd.HistogramBuckets{
+		{Lower: 0, Upper: 10, Count: 5}, {Lower: 10, Upper: 100, Count: 20}, {Lower: 100, Upper: inf, Count: 3},
+	}}, now)
+	ma.Receive(&gostatsd.Metric{Name: "h", Value: 50, Type: gostatsd.TIMER, Buckets: gostatsd.HistogramBuckets{
+		{Lower: 0, Upper: 10, Count: 1}, {Lower: 100, Upper: inf, Count: 2},
+	}}, now)
+	ma.Receive(&gostatsd.Metric{Name: "h", Value: 10, Type: gostatsd.TIMER}, now)
+	ma.Flush(time.Second)
+
+	timer := ma.Timers["h"][""]
+	assert.Equal(t, gostatsd.HistogramBuckets{
+		{Lower: 0, Upper: 10, Count: 6}, {Lower: 10, Upper: 100, Count: 20}, {Lower: 100, Upper: inf, Count: 5},
+	}, timer.Buckets)
+	assert.Equal(t, 3, timer.Count) // Values are still aggregated as samples
+	ma.Reset()
+	assert.Nil(t, ma.Timers["h"][""].Buckets)
+}
+
 func TestIsExpired(t *testing.T) {
 	t.Parallel()
 	assert := assert.New(t)
@@ -270,15 +594,67 @@ func TestIsExpired(t *testing.T) {
 	now := gostatsd.Nanotime(time.Now().UnixNano())
 
 	ma := &MetricAggregator{expiryInterval: 0}
-	assert.Equal(false, ma.isExpired(now, now))
+	assert.Equal(false, ma.isExpired(now, now, gostatsd.COUNTER))
 
 	ma.expiryInterval = 10 * time.Second
 
 	ts := gostatsd.Nanotime(time.Now().Add(-30 * time.Second).UnixNano())
-	assert.Equal(true, ma.isExpired(now, ts))
+	assert.Equal(true, ma.isExpired(now, ts, gostatsd.COUNTER))
 
 	ts = gostatsd.Nanotime(time.Now().Add(-1 * time.Second).UnixNano())
-	assert.Equal(false, ma.isExpired(now, ts))
+	assert.Equal(false, ma.isExpired(now, ts, gostatsd.COUNTER))
+
+	// Intervals of types override the expiry interval
+	ma.SetExpiryIntervals(map[gostatsd.MetricType]time.Duration{gostatsd.GAUGE: time.Minute, gostatsd.SET: 0})
+	ts = gostatsd.Nanotime(time.Now().Add(-30 * time.Second).UnixNano())
+	assert.Equal(true, ma.isExpired(now, ts, gostatsd.COUNTER))
+	assert.Equal(false, ma.isExpired(now, ts, gostatsd.GAUGE))
+	assert.Equal(false, ma.isExpired(now, ts, gostatsd.SET))
+}
+
+func TestExpiryIntervalsPerType(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	ma := newFakeAggregator()
+	ma.expiryInterval = 10 * time.Second
+	ma.SetExpiryIntervals(map[gostatsd.MetricType]time.Duration{
+		gostatsd.COUNTER: 5 * time.Second,
+		gostatsd.GAUGE:   30 * time.Second,
+	})
+	ma.now = func() time.Time {
+		return now
+	}
+	for _, m := range []gostatsd.Metric{
+		{Name: "c", Value: 1, Type: gostatsd.COUNTER},
+		{Name: "g", Value: 1, Type: gostatsd.GAUGE},
+		{Name: "t", Value: 1, Type: gostatsd.TIMER},
+		{Name: "s", StringValue: "a", Type: gostatsd.SET},
+	} {
+		m := m
+		ma.Receive(&m, now)
+	}
+	var counters, timers, gauges, sets []int // Seconds after which each type expired
+	for i := 1; i <= 40; i++ {
+		now = now.Add(time.Second)
+		ma.Flush(time.Second)
+		ma.Reset()
+		if ma.ExpiredKeys.Counters > 0 {
+			counters = append(counters, i)
+		}
+		if ma.ExpiredKeys.Timers > 0 {
+			timers = append(timers, i)
+		}
+		if ma.ExpiredKeys.Gauges > 0 {
+			gauges = append(gauges, i)
+		}
+		if ma.ExpiredKeys.Sets > 0 {
+			sets = append(sets, i)
+		}
+	}
+	assert.Equal(t, []int{6}, counters)
+	assert.Equal(t, []int{11}, timers) // Timers and sets default to the expiry interval
+	assert.Equal(t, []int{11}, sets)
+	assert.Equal(t, []int{31}, gauges)
 }
 
 func metricsFixtures() []gostatsd.Metric {
@@ -398,3 +774,350 @@ func BenchmarkReceives(b *testing.B) {
 		}
 	}
 }
+
+func TestReceiveUnits(t *testing.T) {
+	t.Parallel()
+	ma := newFakeAggregator()
+	now := time.Now()
+	metrics := []gostatsd.Metric{
+		{Name: "c", Type: gostatsd.COUNTER, Value: 1, Unit: "byte"},
+		{Name: "c", Type: gostatsd.COUNTER, Value: 2}, // Unit is kept
+		{Name: "g", Type: gostatsd.GAUGE, Value: 1, Unit: "byte"},
+		{Name: "g", Type: gostatsd.GAUGE, Value: 2, Unit: "kibibyte"}, // Last unit wins
+		{Name: "t", Type: gostatsd.TIMER, Value: 1},
+		{Name: "t", Type: gostatsd.TIMER, Value: 2, Unit: "millisecond"},
+		{Name: "s", Type: gostatsd.SET, StringValue: "a", Unit: "user"},
+		{Name: "x", Type: gostatsd.COUNTER, Value: 1},
+	}
+	for i := range metrics {
+		ma.Receive(&metrics[i], now)
+	}
+	ma.Flush(time.Second)
+	assert.Equal(t, "byte", ma.Counters["c"][""].Unit)
+	assert.Equal(t, int64(3), ma.Counters["c"][""].Value)
+	assert.Equal(t, "kibibyte", ma.Gauges["g"][""].Unit)
+	assert.Equal(t, "millisecond", ma.Timers["t"][""].Unit)
+	assert.Equal(t, "user", ma.Sets["s"][""].Unit)
+	assert.Equal(t, "", ma.Counters["x"][""].Unit)
+
+	ma.Reset()
+	assert.Equal(t, "byte", ma.Counters["c"][""].Unit)
+	assert.Equal(t, "millisecond", ma.Timers["t"][""].Unit)
+	assert.Equal(t, "user", ma.Sets["s"][""].Unit)
+}
+
+func TestReceiveGaugeDeltas(t *testing.T) {
+	t.Parallel()
+	ma := newFakeAggregator()
+	now := time.Now()
+	metrics := []gostatsd.Metric{
+		{Name: "g", Type: gostatsd.GAUGE, Value: 5},
+		{Name: "g", Type: gostatsd.GAUGE, Value: 2, GaugeDelta: true},
+		{Name: "g", Type: gostatsd.GAUGE, Value: -10, GaugeDelta: true},
+		{Name: "d", Type: gostatsd.GAUGE, Value: -1, GaugeDelta: true}, // Delta from 0
+	}
+	for i := range metrics {
+		ma.Receive(&metrics[i], now)
+	}
+	assert.Equal(t, float64(-3), ma.Gauges["g"][""].Value)
+	assert.Equal(t, float64(-1), ma.Gauges["d"][""].Value)
+
+	ma.Receive(&gostatsd.Metric{Name: "g", Type: gostatsd.GAUGE, Value: 4}, now)
+	assert.Equal(t, float64(4), ma.Gauges["g"][""].Value)
+}
+
+func TestFlushNegativeCounters(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		policy   NegativeCounterPolicy
+		expected map[string]gostatsd.Counter
+		dropped  uint32
+	}{
+		{NegativeCountersAllow, map[string]gostatsd.Counter{"neg": {Value: -3, PerSecond: -3}, "pos": {Value: 4, PerSecond: 4}}, 0},
+		{NegativeCountersClamp, map[string]gostatsd.Counter{"neg": {Value: 0, PerSecond: 0}, "pos": {Value: 4, PerSecond: 4}}, 0},
+		{NegativeCountersDrop, map[string]gostatsd.Counter{"pos": {Value: 4, PerSecond: 4}}, 1},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.policy.String(), func(t *testing.T) {
+			t.Parallel()
+			ma := newFakeAggregator()
+			ma.negativeCounters = test.policy
+			now := time.Now()
+			metrics := []gostatsd.Metric{
+				{Name: "neg", Type: gostatsd.COUNTER, Value: 2},
+				{Name: "neg", Type: gostatsd.COUNTER, Value: -5},
+				{Name: "pos", Type: gostatsd.COUNTER, Value: -1},
+				{Name: "pos", Type: gostatsd.COUNTER, Value: 5},
+			}
+			for i := range metrics {
+				ma.Receive(&metrics[i], now)
+			}
+			ma.Flush(time.Second)
+			actual := make(map[string]gostatsd.Counter)
+			ma.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+				actual[key] = gostatsd.Counter{Value: counter.Value, PerSecond: counter.PerSecond}
+			})
+			assert.Equal(t, test.expected, actual)
+			assert.Equal(t, test.dropped, ma.DroppedCounters)
+
+			ma.Reset()
+			assert.Zero(t, ma.DroppedCounters)
+		})
+	}
+}
+
+func TestParseNegativeCounterPolicy(t *testing.T) {
+	t.Parallel()
+	for _, policy := range []NegativeCounterPolicy{NegativeCountersAllow, NegativeCountersClamp, NegativeCountersDrop} {
+		parsed, err := ParseNegativeCounterPolicy(policy.String())
+		require.NoError(t, err)
+		assert.Equal(t, policy, parsed)
+	}
+	_, err := ParseNegativeCounterPolicy("ignore")
+	assert.Error(t, err)
+}
+
+func TestFlushCardinality(t *testing.T) {
+	t.Parallel()
+	ma := newFakeAggregator()
+	ma.expiryInterval = 10 * time.Second
+	now := time.Now()
+	ma.now = func() time.Time { return now }
+	metrics := []gostatsd.Metric{
+		{Name: "c", Type: gostatsd.COUNTER, Value: 1},
+		{Name: "c", Type: gostatsd.COUNTER, Value: 1},
+		{Name: "c", Type: gostatsd.COUNTER, Value: 1, Tags: gostatsd.Tags{"a:b"}},
+		{Name: "t", Type: gostatsd.TIMER, Value: 1},
+		{Name: "g1", Type: gostatsd.GAUGE, Value: 1},
+		{Name: "g2", Type: gostatsd.GAUGE, Value: 1},
+		{Name: "s", Type: gostatsd.SET, StringValue: "x"},
+	}
+	for i := range metrics {
+		ma.Receive(&metrics[i], now)
+	}
+	ma.Flush(time.Second)
+	assert.Equal(t, gostatsd.KeyCounts{Counters: 2, Timers: 1, Gauges: 2, Sets: 1}, ma.Keys)
+	assert.Equal(t, gostatsd.KeyCounts{Counters: 2, Timers: 1, Gauges: 2, Sets: 1}, ma.NewKeys)
+	assert.Zero(t, ma.ExpiredKeys)
+
+	// Only g2 is updated before the others expire
+	now = now.Add(11 * time.Second)
+	ma.Receive(&gostatsd.Metric{Name: "g2", Type: gostatsd.GAUGE, Value: 2}, now)
+	ma.Reset()
+	ma.Receive(&gostatsd.Metric{Name: "g3", Type: gostatsd.GAUGE, Value: 3}, now)
+	ma.Flush(time.Second)
+	assert.Equal(t, gostatsd.KeyCounts{Gauges: 2}, ma.Keys)
+	assert.Equal(t, gostatsd.KeyCounts{Gauges: 1}, ma.NewKeys)
+	assert.Equal(t, gostatsd.KeyCounts{Counters: 2, Timers: 1, Gauges: 1, Sets: 1}, ma.ExpiredKeys)
+}
+
+// newDeterministicAggregator returns an aggregator with a fixed clock so that nothing depends on timing.
+func newDeterministicAggregator() (*MetricAggregator, time.Time) {
+	now := time.Unix(1500000000, 0)
+	ma := newFakeAggregator()
+	ma.now = func() time.Time {
+		return now
+	}
+	return ma, now
+}
+
+func TestAggregatorCardinalityLimit(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	ct := cardinality.NewCardinalityTracker(3)
+	// Keys are counted across the aggregators of all workers
+	aggregators := []*MetricAggregator{newFakeAggregator(), newFakeAggregator()}
+	for _, a := range aggregators {
+		a.expiryInterval = 10 * time.Second
+		a.SetCardinalityTracker(ct)
+		a.now = func() time.Time {
+			return now
+		}
+	}
+	receive := func(i int, m gostatsd.Metric) {
+		aggregators[i%len(aggregators)].Receive(&m, now)
+	}
+
+	receive(0, gostatsd.Metric{Name: "a", Value: 1, Type: gostatsd.COUNTER, Hostname: "one"})
+	receive(1, gostatsd.Metric{Name: "b", Value: 1, Type: gostatsd.GAUGE, Hostname: "one"})
+	receive(0, gostatsd.Metric{Name: "c", Value: 1, Type: gostatsd.TIMER, Hostname: "two"})
+	receive(1, gostatsd.Metric{Name: "d", Value: 1, Type: gostatsd.COUNTER, Hostname: "two"})
+	receive(0, gostatsd.Metric{Name: "a", Value: 1, Type: gostatsd.COUNTER, Hostname: "three"})
+	// Existing keys are still updated at the limit
+	receive(0, gostatsd.Metric{Name: "a", Value: 2, Type: gostatsd.COUNTER, Hostname: "one"})
+
+	keys, dropped := ct.Stats()
+	assert.Equal(t, gostatsd.KeyCounts{Counters: 1, Timers: 1, Gauges: 1}, keys)
+	assert.EqualValues(t, 2, dropped)
+	assert.EqualValues(t, 3, aggregators[0].Counters["a"][formatTagsKey(nil, "one")].Value)
+	assert.NotContains(t, aggregators[0].Counters["a"], formatTagsKey(nil, "three"))
+	assert.NotContains(t, aggregators[1].Counters, "d")
+
+	// Deleted keys are accounted for on Reset
+	aggregators[1].Gauges.Delete("b")
+	for _, a := range aggregators {
+		a.Reset()
+	}
+	keys, _ = ct.Stats()
+	assert.Equal(t, gostatsd.KeyCounts{Counters: 1, Timers: 1}, keys)
+
+	// Expired keys make room for new ones
+	now = now.Add(time.Minute)
+	for _, a := range aggregators {
+		a.Reset()
+	}
+	keys, _ = ct.Stats()
+	assert.Zero(t, keys.Total())
+	receive(1, gostatsd.Metric{Name: "d", Value: 1, Type: gostatsd.COUNTER, Hostname: "two"})
+	assert.Contains(t, aggregators[1].Counters, "d")
+}
+
+func TestAggregatorCardinalityLimitWithSourceKeyLimiter(t *testing.T) {
+	t.Parallel()
+	ct := cardinality.NewCardinalityTracker(2)
+	a := newFakeAggregator()
+	a.SetCardinalityTracker(ct)
+	a.SetSourceKeyLimiter(NewSourceKeyLimiter(1))
+	now := time.Now()
+	for _, name := range []string{"a", "b", "c"} {
+		a.Receive(&gostatsd.Metric{Name: name, Value: 1, Type: gostatsd.COUNTER, Hostname: "noisy"}, now)
+	}
+	// Keys dropped by the source key limiter are not counted
+	keys, dropped := ct.Stats()
+	assert.Equal(t, gostatsd.KeyCounts{Counters: 1}, keys)
+	assert.Zero(t, dropped)
+	a.Receive(&gostatsd.Metric{Name: "b", Value: 1, Type: gostatsd.COUNTER, Hostname: "quiet"}, now)
+	assert.Contains(t, a.Counters, "b")
+}
+
+func TestAggregateCountersAcrossFlushes(t *testing.T) {
+	t.Parallel()
+	ma, now := newDeterministicAggregator()
+	intervals := []struct {
+		increments []float64
+		expected   int64
+	}{
+		{[]float64{1, 2, 3, 4}, 10},
+		{[]float64{5}, 5},
+		{nil, 0}, // Flushed as 0 until it expires
+		{[]float64{-2, 7, 0}, 5},
+		{[]float64{2.9, 0.5}, 2}, // Increments are truncated to integers
+	}
+	for i, interval := range intervals {
+		for _, increment := range interval.increments {
+			ma.Receive(&gostatsd.Metric{Name: "c", Value: increment, Tags: gostatsd.Tags{"a:b"}, Type: gostatsd.COUNTER}, now)
+		}
+		ma.Flush(2 * time.Second)
+		counter := ma.Counters["c"]["a:b"]
+		assert.Equal(t, interval.expected, counter.Value, "interval %d", i)
+		assert.Equal(t, float64(interval.expected)/2, counter.PerSecond, "interval %d", i)
+		assert.Equal(t, gostatsd.Tags{"a:b"}, counter.Tags, "interval %d", i)
+		assert.Len(t, ma.Counters, 1, "interval %d", i)
+		ma.Reset()
+	}
+}
+
+func TestAggregateGaugeDeltaSignChanges(t *testing.T) {
+	t.Parallel()
+	ma, now := newDeterministicAggregator()
+	steps := []struct {
+		value    float64
+		delta    bool
+		expected float64
+	}{
+		{10, false, 10},
+		{5, true, 15},
+		{-20, true, -5}, // Delta crosses 0
+		{8, true, 3},    // And back
+		{-3, true, 0},
+		{-0.5, true, -0.5},
+		{-7, false, -7}, // A negative value that is not a delta sets the gauge
+		{7, true, 0},
+		{42, false, 42},
+	}
+	for i, step := range steps {
+		ma.Receive(&gostatsd.Metric{Name: "g", Value: step.value, GaugeDelta: step.delta, Type: gostatsd.GAUGE}, now)
+		assert.Equal(t, step.expected, ma.Gauges["g"][""].Value, "step %d", i)
+	}
+
+	// Deltas apply to the value kept across flushes
+	ma.Flush(time.Second)
+	assert.Equal(t, 42.0, ma.Gauges["g"][""].Value)
+	ma.Reset()
+	ma.Receive(&gostatsd.Metric{Name: "g", Value: -50, GaugeDelta: true, Type: gostatsd.GAUGE}, now)
+	ma.Flush(time.Second)
+	assert.Equal(t, -8.0, ma.Gauges["g"][""].Value)
+}
+
+func TestAggregateTimerMedian(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		values   []float64
+		median   float64
+		min, max float64
+		mean     float64
+	}{
+		{"single", []float64{7}, 7, 7, 7, 7},
+		{"odd", []float64{9, 1, 5}, 5, 1, 9, 5},
+		{"even", []float64{4, 1, 3, 10}, 3.5, 1, 10, 4.5},
+		{"duplicates", []float64{2, 2, 2, 8}, 2, 2, 8, 3.5},
+		{"negative", []float64{-3, -1, -2}, -2, -3, -1, -2},
+		{"fractions", []float64{0.25, 0.75, 0.5, 1}, 0.625, 0.25, 1, 0.625},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			ma, now := newDeterministicAggregator()
+			for _, value := range test.values {
+				ma.Receive(&gostatsd.Metric{Name: "t", Value: value, Type: gostatsd.TIMER}, now)
+			}
+			ma.Flush(time.Second)
+			timer := ma.Timers["t"][""]
+			assert.Equal(t, test.median, timer.Median)
+			assert.Equal(t, test.min, timer.Min)
+			assert.Equal(t, test.max, timer.Max)
+			assert.Equal(t, test.mean, timer.Mean)
+			assert.Equal(t, len(test.values), timer.Count)
+			assert.True(t, sort.Float64sAreSorted(timer.Values))
+
+			// Values do not carry over to the next flush
+			ma.Reset()
+			ma.Receive(&gostatsd.Metric{Name: "t", Value: 100, Type: gostatsd.TIMER}, now)
+			ma.Flush(time.Second)
+			assert.Equal(t, 100.0, ma.Timers["t"][""].Median)
+		})
+	}
+}
+
+func TestAggregateSetCardinality(t *testing.T) {
+	t.Parallel()
+	ma, now := newDeterministicAggregator()
+	values := []struct {
+		value string
+		tags  gostatsd.Tags
+	}{
+		{"joe", nil},
+		{"bob", nil},
+		{"joe", nil},
+		{"JOE", nil}, // Values are case sensitive
+		{"", nil},
+		{"joe", gostatsd.Tags{"a:b"}},
+		{"joe", gostatsd.Tags{"a:b"}},
+	}
+	for _, v := range values {
+		ma.Receive(&gostatsd.Metric{Name: "s", StringValue: v.value, Tags: v.tags, Type: gostatsd.SET}, now)
+	}
+	ma.Flush(time.Second)
+	require.Len(t, ma.Sets["s"], 2)
+	assert.EqualValues(t, 4, ma.Sets["s"][""].Cardinality())
+	assert.EqualValues(t, 1, ma.Sets["s"]["a:b"].Cardinality())
+
+	// Values are counted again in the next flush
+	ma.Reset()
+	ma.Receive(&gostatsd.Metric{Name: "s", StringValue: "joe", Type: gostatsd.SET}, now)
+	ma.Flush(time.Second)
+	assert.EqualValues(t, 1, ma.Sets["s"][""].Cardinality())
+}
@@ -0,0 +1,362 @@
+// Package api provides an HTTP REST API to inspect and manipulate aggregated metrics of a statsd server.
+//
+// All responses are JSON objects with the same envelope:
+//
+//	{"data": ..., "error": null}
+//
+// Data is null and error is a message if the request failed.
+//
+// Updates of metrics are streamed as JSON messages to WebSocket clients connected to /ws/metrics.
+//
+// Newline-delimited metrics POSTed to /ingest are handled like datagrams received by the server. Requests
+// to /ingest are rate limited per user or API key. The API is served over HTTP/2 with TLS if a certificate
+// is configured, and over HTTP/1.1 or HTTP/2 cleartext (h2c) otherwise.
+//
+// If credentials or API keys are configured, users authenticate with HTTP Basic Auth or with an API key
+// in the "Authorization: Bearer <key>" header. Deleting and flushing metrics requires the admin role,
+// everything else requires the readonly role, including ingestion.
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statsd"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-chi/chi"
+	"github.com/spf13/cast"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	// DefaultAddr is the default address on which a Server will listen.
+	DefaultAddr = ":8128"
+	// ParamAddr is the name of parameter with the address of the REST API.
+	ParamAddr = "api-addr"
+	// ParamMinUpdateInterval is the name of parameter with the minimum interval between streamed updates
+	// of the same metric.
+	ParamMinUpdateInterval = "api-min-update-interval"
+	// ParamTLSCertFile is the name of parameter with the path of the TLS certificate of the REST API.
+	ParamTLSCertFile = "api-tls-cert-file"
+	// ParamTLSKeyFile is the name of parameter with the path of the TLS key of the REST API.
+	ParamTLSKeyFile = "api-tls-key-file"
+	// ParamIngestRate is the name of parameter with the rate of requests to /ingest allowed per client.
+	ParamIngestRate = "api-ingest-rate"
+	// ParamIngestBurst is the name of parameter with the burst of requests to /ingest allowed per client.
+	ParamIngestBurst = "api-ingest-burst"
+	// DefaultIngestRate is the default number of requests per second to /ingest allowed per client.
+	DefaultIngestRate = 100
+	// DefaultIngestBurst is the default number of requests to /ingest a client is allowed in a burst.
+	DefaultIngestBurst = 100
+)
+
+// AddFlags adds flags to the specified FlagSet.
+func AddFlags(fs *pflag.FlagSet) {
+	fs.String(ParamAddr, "", "If set, use as the address of the REST API")
+	fs.Duration(ParamMinUpdateInterval, statsd.DefaultMinUpdateInterval, "Minimum interval between updates of the same metric streamed by /ws/metrics (0 to stream all updates)")
+	fs.String(ParamTLSCertFile, "", "If set with the key, serve the REST API over TLS with the certificate")
+	fs.String(ParamTLSKeyFile, "", "Path of the TLS key of the REST API")
+	fs.Float64(ParamIngestRate, DefaultIngestRate, "Maximum number of requests per second to /ingest per client (0 to disable limiting)")
+	fs.Int(ParamIngestBurst, DefaultIngestBurst, "Maximum number of requests to /ingest per client in a burst")
+}
+
+// NewAPIKeysFromViper returns the API keys and their expiry configured in the api_keys section:
+//
+//	[[api_keys]]
+//	key = "..."
+//	role = "readonly"
+//	expires = 2018-01-01T00:00:00Z # Optional
+func NewAPIKeysFromViper(v *viper.Viper) (map[string]string, map[string]time.Time, error) {
+	keys := make(map[string]string)
+	expiry := make(map[string]time.Time)
+	for i, entry := range cast.ToSlice(v.Get("api_keys")) {
+		e := cast.ToStringMap(entry)
+		key := cast.ToString(e["key"])
+		if key == "" {
+			return nil, nil, fmt.Errorf("API key %d: key is required", i)
+		}
+		role := cast.ToString(e["role"])
+		if _, err := statsd.ParseRole(role); err != nil {
+			return nil, nil, fmt.Errorf("API key %d: %v", i, err)
+		}
+		keys[key] = role
+		if expires, ok := e["expires"]; ok {
+			t, err := cast.ToTimeE(expires)
+			if err != nil {
+				return nil, nil, fmt.Errorf("API key %d: invalid expiry: %v", i, err)
+			}
+			expiry[key] = t
+		}
+	}
+	return keys, expiry, nil
+}
+
+// Service returns a statsd.Service that serves the REST API configured by s.
+// The components of the statsd server are set when the service is started.
+func Service(s Server) statsd.Service {
+	return func(ctx context.Context, receiver statsd.Receiver, dispatcher statsd.Dispatcher, flusher statsd.Flusher) error {
+		s.Receiver = receiver
+		s.Dispatcher = dispatcher
+		s.Flusher = flusher
+		return s.ListenAndServe(ctx)
+	}
+}
+
+// Server is an object that listens for HTTP connections on a TCP address Addr
+// and provides a REST API to manage statsd server.
+type Server struct {
+	Addr       string
+	Receiver   statsd.Receiver
+	Dispatcher statsd.Dispatcher
+	Flusher    statsd.Flusher
+	Updates    *statsd.MetricBroadcaster // Updates streamed by /ws/metrics, streaming is disabled if nil
+	// Credentials of the users allowed to use the API with HTTP Basic Auth.
+	Credentials statsd.Credentials
+	// APIKeys maps API keys accepted as bearer tokens to the names of their roles, see statsd.ParseRole.
+	APIKeys map[string]string
+	// APIKeyExpiry maps API keys to the time they expire at. Keys without expiry never expire.
+	APIKeyExpiry map[string]time.Time
+	// AuditLogWriter receives a statsd.AuditEvent for each state-mutating request, disabled if nil.
+	AuditLogWriter io.Writer
+	// TLSConfig is the configuration of TLS the API is served over, cleartext HTTP/1.1 and h2c are served if nil.
+	TLSConfig *tls.Config
+	// IngestRate is the number of requests per second to /ingest allowed per client, 0 disables limiting.
+	IngestRate float64
+	// IngestBurst is the number of requests to /ingest a client is allowed in a burst.
+	IngestBurst int
+}
+
+// ListenAndServe listens on the Server's TCP network address and then calls Serve.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	addr := s.Addr
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return s.Serve(ctx, l)
+}
+
+// Serve accepts incoming connections on the listener and serves the REST API until the context is done.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	srv := &http.Server{Handler: s.Handler()}
+	if s.TLSConfig == nil {
+		srv.Handler = h2c.NewHandler(srv.Handler, &http2.Server{})
+	} else {
+		srv.TLSConfig = s.TLSConfig.Clone()
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close() // #nosec Makes Serve return
+		case <-done:
+		}
+	}()
+	var err error
+	if s.TLSConfig == nil {
+		err = srv.Serve(l)
+	} else {
+		err = srv.ServeTLS(l, "", "")
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Handler returns the http.Handler of the REST API.
+func (s *Server) Handler() http.Handler {
+	r := chi.NewRouter()
+	r.Use(requestID, logRequests, recoverPanics, s.authenticate)
+	r.Route("/v1", func(r chi.Router) {
+		r.Get("/metrics", s.listMetrics)
+		r.With(s.requireAdmin).Delete("/metrics/{type}/{name}", s.deleteMetric)
+		r.Get("/stats", s.getStats)
+		r.With(s.requireAdmin).Post("/flush", s.flush)
+	})
+	r.Get("/ws/metrics", s.streamMetrics)
+	r.With(s.rateLimit(newClientLimiters(s.IngestRate, s.IngestBurst))).Post("/ingest", s.ingest)
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "not found")
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	})
+	return r
+}
+
+// envelope is the JSON object all responses are wrapped into.
+type envelope struct {
+	Data  interface{} `json:"data"`
+	Error *string     `json:"error"`
+}
+
+// metric is the JSON representation of an aggregated metric.
+type metric struct {
+	Name        string        `json:"name"`
+	Type        string        `json:"type"`
+	TagsKey     string        `json:"tags_key"`
+	Tags        gostatsd.Tags `json:"tags"`
+	Hostname    string        `json:"hostname"`
+	Value       *float64      `json:"value,omitempty"`
+	TimerValues []float64     `json:"timer_values,omitempty"`
+	SetValues   []string      `json:"set_values,omitempty"`
+	LastUpdated time.Time     `json:"last_updated"`
+}
+
+// stats is the JSON representation of the statistics of the server.
+type stats struct {
+	BadLines        uint64    `json:"bad_lines"`
+	MetricsReceived uint64    `json:"metrics_received"`
+	PacketsReceived uint64    `json:"packets_received"`
+	EventsReceived  uint64    `json:"events_received"`
+	UnknownFields   uint64    `json:"unknown_fields"`
+	LastPacket      time.Time `json:"last_packet"`
+	LastFlush       time.Time `json:"last_flush"`
+	LastFlushError  time.Time `json:"last_flush_error"`
+}
+
+var metricTypes = map[string]gostatsd.MetricType{
+	"counter": gostatsd.COUNTER,
+	"timer":   gostatsd.TIMER,
+	"gauge":   gostatsd.GAUGE,
+	"set":     gostatsd.SET,
+}
+
+// listMetrics lists metrics of the optional type with names matching the optional regular expression.
+func (s *Server) listMetrics(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var metricType gostatsd.MetricType
+	if t := query.Get("type"); t != "" {
+		var ok bool
+		if metricType, ok = metricTypes[t]; !ok {
+			writeError(w, http.StatusBadRequest, "invalid metric type "+t)
+			return
+		}
+	}
+	var re *regexp.Regexp
+	if q := query.Get("q"); q != "" {
+		var err error
+		if re, err = regexp.Compile(q); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid pattern: "+err.Error())
+			return
+		}
+	}
+	metrics, err := statsd.ListMetrics(r.Context(), s.Dispatcher, func(t gostatsd.MetricType, name string) bool {
+		return (metricType == 0 || t == metricType) && (re == nil || re.MatchString(name))
+	})
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	result := make([]metric, 0, len(metrics))
+	for _, m := range metrics {
+		rm := metric{
+			Name:        m.Name,
+			Type:        m.Type.String(),
+			TagsKey:     m.TagsKey,
+			Tags:        m.Tags,
+			Hostname:    m.Hostname,
+			TimerValues: m.TimerValues,
+			SetValues:   m.SetValues,
+			LastUpdated: m.LastUpdated,
+		}
+		if m.Type == gostatsd.COUNTER || m.Type == gostatsd.GAUGE {
+			value := m.Value
+			rm.Value = &value
+		}
+		result = append(result, rm)
+	}
+	writeData(w, http.StatusOK, result)
+}
+
+// deleteMetric deletes metrics of the type with the name.
+func (s *Server) deleteMetric(w http.ResponseWriter, r *http.Request) {
+	t := chi.URLParam(r, "type")
+	metricType, ok := metricTypes[t]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid metric type "+t)
+		return
+	}
+	name := chi.URLParam(r, "name")
+	args := []string{t, name}
+	deleted, err := statsd.DeleteMetrics(r.Context(), s.Dispatcher, metricType, []string{name})
+	if err != nil {
+		s.audit(r, args, 0, err)
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if deleted == 0 {
+		message := t + " " + name + " not found"
+		s.audit(r, args, 0, errors.New(message))
+		writeError(w, http.StatusNotFound, message)
+		return
+	}
+	s.audit(r, args, deleted, nil)
+	writeData(w, http.StatusOK, map[string]uint32{"deleted": deleted})
+}
+
+func (s *Server) getStats(w http.ResponseWriter, r *http.Request) {
+	receiverStats := s.Receiver.GetStats()
+	flusherStats := s.Flusher.GetStats()
+	writeData(w, http.StatusOK, stats{
+		BadLines:        receiverStats.BadLines,
+		MetricsReceived: receiverStats.MetricsReceived,
+		PacketsReceived: receiverStats.PacketsReceived,
+		EventsReceived:  receiverStats.EventsReceived,
+		UnknownFields:   receiverStats.UnknownFields,
+		LastPacket:      receiverStats.LastPacket,
+		LastFlush:       flusherStats.LastFlush,
+		LastFlushError:  flusherStats.LastFlushError,
+	})
+}
+
+// flush flushes metrics to backends and waits for the flush to finish.
+func (s *Server) flush(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := s.Flusher.(statsd.ForceFlusher)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, "flush is not supported by the flusher")
+		return
+	}
+	_, err := flusher.ForceFlush(r.Context())
+	s.audit(r, nil, 0, err)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeData(w, http.StatusOK, map[string]bool{"flushed": true})
+}
+
+func writeData(w http.ResponseWriter, status int, data interface{}) {
+	writeEnvelope(w, status, envelope{Data: data})
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeEnvelope(w, status, envelope{Error: &message})
+}
+
+func writeEnvelope(w http.ResponseWriter, status int, e envelope) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(e); err != nil {
+		log.Debugf("Failed to write API response: %v", err)
+	}
+}
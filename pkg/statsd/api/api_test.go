@@ -0,0 +1,407 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statsd"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type response struct {
+	Data  json.RawMessage `json:"data"`
+	Error *string         `json:"error"`
+}
+
+func do(t *testing.T, method, url string) (*http.Response, response) {
+	req, err := http.NewRequest(method, url, nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var r response
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&r))
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.NotEmpty(t, resp.Header.Get(RequestIDHeader))
+	return resp, r
+}
+
+func newDispatcher(ctx context.Context, wg *sync.WaitGroup) *statsd.MetricDispatcher {
+	d := statsd.NewMetricDispatcher(2, 10, statsd.AggregatorFactoryFunc(func() statsd.Aggregator {
+		return statsd.NewMetricAggregator(nil, 0)
+	}))
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		d.Run(ctx) // #nosec
+	}()
+	return d
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	var wg sync.WaitGroup
+	d := newDispatcher(ctx, &wg)
+	srv := httptest.NewServer((&Server{Dispatcher: d}).Handler())
+	defer srv.Close()
+
+	metrics := []gostatsd.Metric{
+		{Name: "foo.bar", Type: gostatsd.COUNTER, Value: 12, Tags: gostatsd.Tags{"a:b"}},
+		{Name: "foo.baz", Type: gostatsd.GAUGE, Value: 0},
+		{Name: "qux", Type: gostatsd.TIMER, Value: 5},
+	}
+	before := time.Now()
+	for i := range metrics {
+		require.NoError(t, d.DispatchMetric(ctx, &metrics[i]))
+	}
+	var result []metric
+	for i := 0; i < 100; i++ {
+		resp, r := do(t, "GET", srv.URL+"/v1/metrics")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Nil(t, r.Error)
+		require.NoError(t, json.Unmarshal(r.Data, &result))
+		if len(result) == len(metrics) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Len(t, result, len(metrics))
+	assert.Equal(t, "foo.bar", result[0].Name)
+	assert.Equal(t, "counter", result[0].Type)
+	assert.Equal(t, gostatsd.Tags{"a:b"}, result[0].Tags)
+	require.NotNil(t, result[0].Value)
+	assert.Equal(t, float64(12), *result[0].Value)
+	require.NotNil(t, result[1].Value) // Zero gauge value is present
+	assert.Equal(t, []float64{5}, result[2].TimerValues)
+	for _, m := range result {
+		assert.False(t, m.LastUpdated.Before(before), m.Name)
+		assert.False(t, m.LastUpdated.After(time.Now()), m.Name)
+	}
+
+	resp, r := do(t, "GET", srv.URL+"/v1/metrics?type=counter&q=^foo%5C.")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.Unmarshal(r.Data, &result))
+	require.Len(t, result, 1)
+	assert.Equal(t, "foo.bar", result[0].Name)
+
+	resp, r = do(t, "GET", srv.URL+"/v1/metrics?type=histogram")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "null", string(r.Data))
+	require.NotNil(t, r.Error)
+	assert.Equal(t, "invalid metric type histogram", *r.Error)
+
+	resp, _ = do(t, "GET", srv.URL+"/v1/metrics?q=(")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, r = do(t, "DELETE", srv.URL+"/v1/metrics/counter/foo.bar")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"deleted": 1}`, string(r.Data))
+	resp, _ = do(t, "DELETE", srv.URL+"/v1/metrics/counter/foo.bar")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = do(t, "DELETE", srv.URL+"/v1/metrics/histogram/foo.bar")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, _ = do(t, "GET", srv.URL+"/v1/unknown")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = do(t, "PUT", srv.URL+"/v1/stats")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	cancelFunc()
+	wg.Wait()
+}
+
+type fakeReceiver struct {
+	statsd.Receiver
+}
+
+func (fakeReceiver) GetStats() statsd.ReceiverStats {
+	return statsd.ReceiverStats{BadLines: 1, MetricsReceived: 2, PacketsReceived: 3}
+}
+
+type fakeFlusher struct {
+	flushes int
+}
+
+func (ff *fakeFlusher) GetStats() statsd.FlusherStats {
+	return statsd.FlusherStats{LastFlush: time.Unix(1500000000, 0).UTC()}
+}
+
+func (ff *fakeFlusher) ForceFlush(ctx context.Context) (statsd.FlushResult, error) {
+	ff.flushes++
+	return statsd.FlushResult{}, nil
+}
+
+func TestStatsAndFlush(t *testing.T) {
+	t.Parallel()
+	ff := &fakeFlusher{}
+	srv := httptest.NewServer((&Server{Receiver: fakeReceiver{}, Flusher: ff}).Handler())
+	defer srv.Close()
+
+	resp, r := do(t, "GET", srv.URL+"/v1/stats")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var s stats
+	require.NoError(t, json.Unmarshal(r.Data, &s))
+	assert.Equal(t, uint64(1), s.BadLines)
+	assert.Equal(t, uint64(2), s.MetricsReceived)
+	assert.Equal(t, uint64(3), s.PacketsReceived)
+	assert.Equal(t, time.Unix(1500000000, 0).UTC(), s.LastFlush)
+
+	resp, _ = do(t, "GET", srv.URL+"/v1/flush")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	resp, r = do(t, "POST", srv.URL+"/v1/flush")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"flushed": true}`, string(r.Data))
+	assert.Equal(t, 1, ff.flushes)
+}
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+	s := &Server{} // Nil components make handlers panic
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL+"/v1/stats", nil)
+	require.NoError(t, err)
+	req.Header.Set(RequestIDHeader, "abc")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(t, "abc", resp.Header.Get(RequestIDHeader))
+	var r response
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&r))
+	require.NotNil(t, r.Error)
+	assert.Equal(t, "internal server error", *r.Error)
+}
+
+func TestAuthentication(t *testing.T) {
+	t.Parallel()
+	credentials := make(statsd.Credentials)
+	for username, role := range map[string]statsd.Role{"alice": statsd.RoleAdmin, "bob": statsd.RoleReadOnly} {
+		hash, err := bcrypt.GenerateFromPassword([]byte(username+"-secret"), bcrypt.MinCost)
+		require.NoError(t, err)
+		credentials[username] = statsd.User{Role: role, PasswordHash: hash}
+	}
+	ff := &fakeFlusher{}
+	srv := httptest.NewServer((&Server{Receiver: fakeReceiver{}, Flusher: ff, Credentials: credentials}).Handler())
+	defer srv.Close()
+
+	doAs := func(method, path, username, password string) (*http.Response, response) {
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		require.NoError(t, err)
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var r response
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&r))
+		return resp, r
+	}
+
+	resp, r := doAs("GET", "/v1/stats", "", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, `Basic realm="gostatsd"`, resp.Header.Get("WWW-Authenticate"))
+	require.NotNil(t, r.Error)
+	resp, _ = doAs("GET", "/v1/stats", "bob", "alice-secret")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, _ = doAs("GET", "/v1/stats", "bob", "bob-secret")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, r = doAs("POST", "/v1/flush", "bob", "bob-secret")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.NotNil(t, r.Error)
+	assert.Equal(t, "forbidden: admin role required", *r.Error)
+	assert.Equal(t, 0, ff.flushes)
+
+	resp, _ = doAs("POST", "/v1/flush", "alice", "alice-secret")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1, ff.flushes)
+}
+
+func TestAPIKeys(t *testing.T) {
+	t.Parallel()
+	ff := &fakeFlusher{}
+	srv := httptest.NewServer((&Server{
+		Receiver: fakeReceiver{},
+		Flusher:  ff,
+		APIKeys: map[string]string{
+			"admin-key":    "admin",
+			"readonly-key": "readonly",
+			"expired-key":  "admin",
+			"future-key":   "admin",
+		},
+		APIKeyExpiry: map[string]time.Time{
+			"expired-key": time.Now().Add(-time.Minute),
+			"future-key":  time.Now().Add(time.Hour),
+		},
+	}).Handler())
+	defer srv.Close()
+
+	doWithKey := func(method, path, authorization string) (*http.Response, response) {
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		require.NoError(t, err)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var r response
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&r))
+		return resp, r
+	}
+
+	for _, authorization := range []string{"", "Bearer", "Bearer unknown-key", "Bearer expired-key", "admin-key"} {
+		resp, r := doWithKey("GET", "/v1/stats", authorization)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, authorization)
+		assert.Equal(t, `Bearer realm="gostatsd"`, resp.Header.Get("WWW-Authenticate"), authorization)
+		require.NotNil(t, r.Error, authorization)
+		assert.Equal(t, "unauthorized", *r.Error, authorization)
+	}
+	resp, _ := doWithKey("POST", "/v1/flush", "Bearer expired-key")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, _ = doWithKey("GET", "/v1/stats", "Bearer readonly-key")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = doWithKey("POST", "/v1/flush", "Bearer readonly-key")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, 0, ff.flushes)
+
+	resp, _ = doWithKey("POST", "/v1/flush", "Bearer admin-key")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = doWithKey("POST", "/v1/flush", "Bearer future-key")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, ff.flushes)
+}
+
+func TestNewAPIKeysFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(bytes.NewBufferString(`
+[[api_keys]]
+key = "Key-1"
+role = "admin"
+expires = 2018-01-01T00:00:00Z
+
+[[api_keys]]
+key = "Key-2"
+role = "readonly"
+`)))
+	keys, expiry, err := NewAPIKeysFromViper(v)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"Key-1": "admin", "Key-2": "readonly"}, keys)
+	assert.Equal(t, map[string]time.Time{"Key-1": time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)}, expiry)
+
+	v = viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(bytes.NewBufferString(`
+[[api_keys]]
+key = "Key-1"
+role = "root"
+`)))
+	_, _, err = NewAPIKeysFromViper(v)
+	assert.Error(t, err)
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.Write(p)
+}
+
+func TestAuditLog(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	var wg sync.WaitGroup
+	d := newDispatcher(ctx, &wg)
+	auditLog := &syncBuffer{}
+	srv := httptest.NewServer((&Server{
+		Receiver:       fakeReceiver{},
+		Dispatcher:     d,
+		Flusher:        &fakeFlusher{},
+		APIKeys:        map[string]string{"admin-key": "admin", "readonly-key": "readonly"},
+		AuditLogWriter: auditLog,
+	}).Handler())
+	defer srv.Close()
+
+	require.NoError(t, d.DispatchMetric(ctx, &gostatsd.Metric{Name: "foo", Type: gostatsd.COUNTER, Value: 1}))
+	for i := 0; i < 100; i++ {
+		snapshot, err := d.Snapshot(ctx)
+		require.NoError(t, err)
+		if snapshot.NumStats == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, request := range []struct {
+		method, path, key string
+		status            int
+	}{
+		{"GET", "/v1/stats", "admin-key", http.StatusOK},
+		{"DELETE", "/v1/metrics/counter/foo", "admin-key", http.StatusOK},
+		{"DELETE", "/v1/metrics/counter/foo", "admin-key", http.StatusNotFound},
+		{"POST", "/v1/flush", "readonly-key", http.StatusForbidden},
+		{"POST", "/v1/flush", "admin-key", http.StatusOK},
+	} {
+		req, err := http.NewRequest(request.method, srv.URL+request.path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+request.key)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, request.status, resp.StatusCode, request.path)
+	}
+
+	auditLog.mu.Lock()
+	defer auditLog.mu.Unlock()
+	var events []statsd.AuditEvent
+	dec := json.NewDecoder(&auditLog.buf)
+	for dec.More() {
+		var e statsd.AuditEvent
+		require.NoError(t, dec.Decode(&e))
+		events = append(events, e)
+	}
+	require.Len(t, events, 4) // Only state-mutating requests
+	for _, e := range events {
+		assert.Equal(t, "api", e.Source)
+		assert.Equal(t, "127.0.0.1", e.ClientIP)
+		assert.Contains(t, e.User, "api-key:")
+		assert.NotContains(t, e.User, "admin-key")
+	}
+	assert.Equal(t, "DELETE /v1/metrics/counter/foo", events[0].Command)
+	assert.Equal(t, []string{"counter", "foo"}, events[0].Args)
+	assert.Equal(t, statsd.AuditResultSuccess, events[0].Result)
+	assert.Equal(t, uint32(1), events[0].Count)
+	assert.Equal(t, statsd.AuditResultFailure, events[1].Result)
+	assert.Equal(t, "counter foo not found", events[1].Error)
+	assert.Equal(t, "POST /v1/flush", events[2].Command)
+	assert.Equal(t, statsd.AuditResultFailure, events[2].Result)
+	assert.NotEqual(t, events[2].User, events[3].User)
+	assert.Equal(t, statsd.AuditResultSuccess, events[3].Result)
+
+	cancelFunc()
+	wg.Wait()
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/atlassian/gostatsd/pkg/statsd"
+
+	"golang.org/x/time/rate"
+)
+
+// MaxIngestBodySize is the maximum size in bytes of the body of requests to /ingest.
+const MaxIngestBodySize = 1 << 20
+
+// clientLimiters limits the rate of requests of each client. Safe for concurrent use.
+type clientLimiters struct {
+	limit rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func newClientLimiters(limit float64, burst int) *clientLimiters {
+	return &clientLimiters{
+		limit:    rate.Limit(limit),
+		burst:    burst,
+		limiters: make(map[string]*rate.Limiter),
+	}
+}
+
+// allow returns true if the client is allowed a request now.
+func (cl *clientLimiters) allow(client string) bool {
+	cl.mu.Lock()
+	limiter, ok := cl.limiters[client]
+	if !ok {
+		limiter = rate.NewLimiter(cl.limit, cl.burst)
+		cl.limiters[client] = limiter
+	}
+	cl.mu.Unlock()
+	return limiter.Allow()
+}
+
+// rateLimit responds with too many requests if the client exceeds its rate. Clients are the authenticated
+// users, which includes API keys, or their addresses if authentication is disabled. Limiting is disabled if
+// the rate is not positive.
+func (s *Server) rateLimit(limiters *clientLimiters) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if limiters.limit > 0 {
+				client, _ := r.Context().Value(userKey).(string)
+				if client == "" {
+					client, _, _ = net.SplitHostPort(r.RemoteAddr)
+				}
+				if !limiters.allow(client) {
+					w.Header().Set("Retry-After", strconv.Itoa(int(1/float64(limiters.limit))+1))
+					writeError(w, http.StatusTooManyRequests, "rate limit exceeded")
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ingest handles newline-delimited metrics and events in the body of the request like datagrams received by
+// the server.
+func (s *Server) ingest(w http.ResponseWriter, r *http.Request) {
+	receiver, ok := s.Receiver.(statsd.LineReceiver)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, "ingestion is not supported by the receiver")
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxIngestBodySize))
+	if err != nil {
+		if len(body) == MaxIngestBodySize {
+			writeError(w, http.StatusRequestEntityTooLarge, "body must not be larger than "+strconv.Itoa(MaxIngestBodySize)+" bytes")
+		} else {
+			writeError(w, http.StatusBadRequest, "failed to read body: "+err.Error())
+		}
+		return
+	}
+	metrics, events, err := receiver.HandleLines(r.Context(), remoteAddr(r), body)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeData(w, http.StatusOK, map[string]uint32{"metrics": metrics, "events": events})
+}
+
+// remoteAddr returns the address of the client of the request.
+func remoteAddr(r *http.Request) net.Addr {
+	addr := &net.TCPAddr{}
+	if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		addr.IP = net.ParseIP(host)
+		addr.Port, _ = strconv.Atoi(port)
+	}
+	return addr
+}
@@ -0,0 +1,191 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+// testTLSConfig returns a TLS configuration with a self-signed certificate.
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// serve serves the API on a random port until the context is done and returns its address.
+func serve(t *testing.T, ctx context.Context, s *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(ctx, l) // #nosec
+	return l.Addr().String()
+}
+
+func post(t *testing.T, client *http.Client, url, apiKey, body string) (*http.Response, response) {
+	req, err := http.NewRequest("POST", url, bytes.NewBufferString(body))
+	require.NoError(t, err)
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var r response
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&r))
+	return resp, r
+}
+
+// waitForMetrics waits until the dispatcher has aggregated the number of metrics.
+func waitForMetrics(t *testing.T, ctx context.Context, d statsd.Dispatcher, n int) {
+	for i := 0; i < 100; i++ {
+		metrics, err := statsd.ListMetrics(ctx, d, func(gostatsd.MetricType, string) bool { return true })
+		require.NoError(t, err)
+		if len(metrics) == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("dispatcher did not aggregate %d metrics", n)
+}
+
+func TestIngestH2C(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	var wg sync.WaitGroup
+	d := newDispatcher(ctx, &wg)
+	receiver := statsd.NewMetricReceiver("", statsd.NewDispatchingHandler(d, nil, nil, 1))
+	addr := serve(t, ctx, &Server{Receiver: receiver, Dispatcher: d})
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	resp, r := post(t, client, "http://"+addr+"/ingest", "", "a:1|c\nb:2|g\r\n\nbad\nc:3|ms")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.JSONEq(t, `{"metrics": 3, "events": 0}`, string(r.Data))
+	waitForMetrics(t, ctx, d, 3)
+	assert.EqualValues(t, 1, receiver.GetStats().BadLines)
+
+	// HTTP/1.1 is still served
+	resp, _ = post(t, http.DefaultClient, "http://"+addr+"/ingest", "", "d:1|c")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1, resp.ProtoMajor)
+	waitForMetrics(t, ctx, d, 4)
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestIngestTLS(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	var wg sync.WaitGroup
+	d := newDispatcher(ctx, &wg)
+	receiver := statsd.NewMetricReceiver("", statsd.NewDispatchingHandler(d, nil, nil, 1))
+	addr := serve(t, ctx, &Server{Receiver: receiver, Dispatcher: d, TLSConfig: testTLSConfig(t)})
+
+	client := &http.Client{Transport: &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}} // #nosec
+	resp, r := post(t, client, "https://"+addr+"/ingest", "", "a:1|c")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.JSONEq(t, `{"metrics": 1, "events": 0}`, string(r.Data))
+	waitForMetrics(t, ctx, d, 1)
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestIngestRateLimit(t *testing.T) {
+	t.Parallel()
+	receiver := statsd.NewMetricReceiver("", &nopHandler{})
+	srv := httptest.NewServer((&Server{
+		Receiver:    receiver,
+		APIKeys:     map[string]string{"key1": "readonly", "key2": "admin"},
+		IngestRate:  0.001,
+		IngestBurst: 2,
+	}).Handler())
+	defer srv.Close()
+
+	resp, _ := post(t, http.DefaultClient, srv.URL+"/ingest", "", "a:1|c")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp, _ = post(t, http.DefaultClient, srv.URL+"/ingest", "unknown", "a:1|c")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	for i := 0; i < 2; i++ {
+		resp, _ = post(t, http.DefaultClient, srv.URL+"/ingest", "key1", "a:1|c")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	resp, r := post(t, http.DefaultClient, srv.URL+"/ingest", "key1", "a:1|c")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+	require.NotNil(t, r.Error)
+	assert.Equal(t, "rate limit exceeded", *r.Error)
+
+	// Keys are limited independently
+	resp, _ = post(t, http.DefaultClient, srv.URL+"/ingest", "key2", "a:1|c")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.EqualValues(t, 3, receiver.GetStats().MetricsReceived)
+}
+
+func TestIngestErrors(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer((&Server{Receiver: fakeReceiver{}}).Handler())
+	defer srv.Close()
+	resp, _ := post(t, http.DefaultClient, srv.URL+"/ingest", "", "a:1|c")
+	assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+
+	srv = httptest.NewServer((&Server{Receiver: statsd.NewMetricReceiver("", &nopHandler{})}).Handler())
+	defer srv.Close()
+	resp, _ = post(t, http.DefaultClient, srv.URL+"/ingest", "", string(bytes.Repeat([]byte("a:1|c\n"), MaxIngestBodySize/6+1)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	resp, _ = do(t, "GET", srv.URL+"/ingest")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+// nopHandler discards metrics and events.
+type nopHandler struct{}
+
+func (nopHandler) DispatchMetric(ctx context.Context, m *gostatsd.Metric) error {
+	return nil
+}
+
+func (nopHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func (nopHandler) WaitForEvents() {
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/atlassian/gostatsd/pkg/statsd"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// RequestIDHeader is the header with the ID of the request.
+// The ID is taken from the request if present, otherwise it is generated. It is returned in the response.
+const RequestIDHeader = "X-Request-Id"
+
+const bearerPrefix = "Bearer "
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	roleKey
+	userKey
+)
+
+// RequestID returns the ID of the request from the context.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// requestID adds the ID of the request to the context and the response.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// statusRecorder records the status code written to the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Hijack lets the WebSocket handler take over the connection.
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking is not supported")
+	}
+	sr.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// logRequests logs each request with its status code and duration.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sr, r)
+		log.Infof("API request %s %s from %s: %d in %s [%s]", r.Method, r.URL.RequestURI(), r.RemoteAddr, sr.status, time.Since(start), RequestID(r.Context()))
+	})
+}
+
+// recoverPanics recovers panics of handlers, logs them and responds with an internal server error.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				log.Errorf("API request %s %s panicked [%s]: %v", r.Method, r.URL.RequestURI(), RequestID(r.Context()), p)
+				writeError(w, http.StatusInternalServerError, "internal server error")
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticate authenticates users with HTTP Basic Auth or API keys and adds their role to the context.
+// Authentication is disabled and all requests are allowed the admin role if there are no credentials
+// and no API keys.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var user string
+		role := statsd.RoleAdmin
+		if s.Credentials.Enabled() || len(s.APIKeys) > 0 {
+			user, role = s.authenticateRequest(r)
+			if role == statsd.RoleNone {
+				if s.Credentials.Enabled() {
+					w.Header().Add("WWW-Authenticate", `Basic realm="gostatsd"`)
+				}
+				if len(s.APIKeys) > 0 {
+					w.Header().Add("WWW-Authenticate", `Bearer realm="gostatsd"`)
+				}
+				writeError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+		}
+		ctx := context.WithValue(r.Context(), roleKey, role)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, userKey, user)))
+	})
+}
+
+// authenticateRequest returns the name and the role of the user authenticated by the request,
+// RoleNone if authentication failed. Users of API keys are named by the fingerprint of the key.
+func (s *Server) authenticateRequest(r *http.Request) (string, statsd.Role) {
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, bearerPrefix) {
+		key := strings.TrimPrefix(authorization, bearerPrefix)
+		return apiKeyUser(key), s.authenticateAPIKey(key)
+	}
+	if username, password, ok := r.BasicAuth(); ok {
+		return username, s.Credentials.Authenticate(username, password)
+	}
+	return "", statsd.RoleNone
+}
+
+// apiKeyUser returns the name of the user of the API key that does not reveal the key.
+func apiKeyUser(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "api-key:" + hex.EncodeToString(sum[:4])
+}
+
+// authenticateAPIKey returns the role of the API key, RoleNone if the key is unknown or expired.
+// Keys are compared in constant time to not leak them through timing.
+func (s *Server) authenticateAPIKey(key string) statsd.Role {
+	for k, roleName := range s.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) != 1 {
+			continue
+		}
+		if expiry, ok := s.APIKeyExpiry[k]; ok && !time.Now().Before(expiry) {
+			return statsd.RoleNone
+		}
+		role, err := statsd.ParseRole(roleName)
+		if err != nil {
+			log.Warnf("Invalid role of API key: %v", err)
+			return statsd.RoleNone
+		}
+		return role
+	}
+	return statsd.RoleNone
+}
+
+// requireAdmin responds with forbidden unless the user has the admin role.
+// Only state-mutating endpoints require the admin role, so denied requests are written to the audit log.
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role, _ := r.Context().Value(roleKey).(statsd.Role)
+		if !role.Allows(statsd.RoleAdmin) {
+			message := "forbidden: " + statsd.RoleAdmin.String() + " role required"
+			s.audit(r, nil, 0, errors.New(message))
+			writeError(w, http.StatusForbidden, message)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// audit writes the request to the audit log.
+func (s *Server) audit(r *http.Request, args []string, count uint32, err error) {
+	user, _ := r.Context().Value(userKey).(string)
+	statsd.WriteAuditEvent(s.AuditLogWriter, statsd.NewAuditEvent("api", r.RemoteAddr, user, r.Method+" "+r.URL.Path, args, count, err))
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsWriteTimeout is the maximum time to write a message to a WebSocket client.
+	wsWriteTimeout = 10 * time.Second
+	// wsBufferSize is the number of updates buffered for a WebSocket client before updates are dropped.
+	wsBufferSize = 1000
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// metricUpdate is the JSON representation of a metric update.
+type metricUpdate struct {
+	Name     string        `json:"name"`
+	Type     string        `json:"type"`
+	TagsKey  string        `json:"tags_key"`
+	Tags     gostatsd.Tags `json:"tags"`
+	Hostname string        `json:"hostname"`
+	Value    float64       `json:"value"`
+}
+
+// streamMetrics streams updates of metrics with the optional type and names matching the optional regular
+// expression to a WebSocket client. Each update is a JSON message. Updates are dropped if the client does
+// not keep up.
+func (s *Server) streamMetrics(w http.ResponseWriter, r *http.Request) {
+	if s.Updates == nil {
+		writeError(w, http.StatusNotImplemented, "metric updates are not enabled")
+		return
+	}
+	query := r.URL.Query()
+	var metricType gostatsd.MetricType
+	if t := query.Get("type"); t != "" {
+		var ok bool
+		if metricType, ok = metricTypes[t]; !ok {
+			writeError(w, http.StatusBadRequest, "invalid metric type "+t)
+			return
+		}
+	}
+	var re *regexp.Regexp
+	if q := query.Get("q"); q != "" {
+		var err error
+		if re, err = regexp.Compile(q); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid pattern: "+err.Error())
+			return
+		}
+	}
+	// Headers of the ResponseWriter are not sent by Upgrade
+	conn, err := upgrader.Upgrade(w, r, http.Header{RequestIDHeader: {RequestID(r.Context())}})
+	if err != nil {
+		return // Upgrade responds with an error
+	}
+	defer conn.Close()
+
+	sub := s.Updates.Subscribe(wsBufferSize)
+	defer s.Updates.Unsubscribe(sub)
+
+	closed := make(chan struct{})
+	go func() {
+		// Read messages to process control frames and notice when the client goes away
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	ctx := r.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-closed:
+			return
+		case u := <-sub.C:
+			if metricType != 0 && u.Type != metricType || re != nil && !re.MatchString(u.Name) {
+				continue
+			}
+			if err := conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+			err := conn.WriteJSON(metricUpdate{
+				Name:     u.Name,
+				Type:     u.Type.String(),
+				TagsKey:  u.TagsKey,
+				Tags:     u.Tags,
+				Hostname: u.Hostname,
+				Value:    u.Value,
+			})
+			if err != nil {
+				log.Debugf("Failed to write metric update to %s: %v", r.RemoteAddr, err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statsd"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamMetrics(t *testing.T) {
+	t.Parallel()
+	b := statsd.NewMetricBroadcaster(0)
+	srv := httptest.NewServer((&Server{Updates: b}).Handler())
+	defer srv.Close()
+
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws/metrics?type=gauge&q=^foo", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.NotEmpty(t, resp.Header.Get(RequestIDHeader))
+
+	// The subscription is created after the handshake, keep publishing until the client receives an update
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			b.Publish(statsd.MetricUpdate{Name: "foo.bar", Type: gostatsd.COUNTER, Value: 1})
+			b.Publish(statsd.MetricUpdate{Name: "bar", Type: gostatsd.GAUGE, Value: 2})
+			b.Publish(statsd.MetricUpdate{Name: "foo.bar", Type: gostatsd.GAUGE, Value: 3, Tags: gostatsd.Tags{"a:b"}, TagsKey: "a:b"})
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	var u metricUpdate
+	require.NoError(t, conn.ReadJSON(&u))
+	assert.Equal(t, metricUpdate{Name: "foo.bar", Type: "gauge", TagsKey: "a:b", Tags: gostatsd.Tags{"a:b"}, Value: 3}, u)
+}
+
+func TestStreamMetricsErrors(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer((&Server{}).Handler())
+	defer srv.Close()
+	resp, _ := do(t, "GET", srv.URL+"/ws/metrics")
+	assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+
+	srv = httptest.NewServer((&Server{Updates: statsd.NewMetricBroadcaster(0)}).Handler())
+	defer srv.Close()
+	resp, _ = do(t, "GET", srv.URL+"/ws/metrics?type=histogram")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws/metrics?q=(", nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
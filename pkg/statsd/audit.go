@@ -0,0 +1,78 @@
+package statsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// AuditResultSuccess is the result of a successful operation.
+	AuditResultSuccess = "success"
+	// AuditResultFailure is the result of a failed or denied operation.
+	AuditResultFailure = "failure"
+)
+
+// AuditEvent is an entry of the audit log recording a state-mutating operation.
+type AuditEvent struct {
+	Time     time.Time `json:"time"`
+	Source   string    `json:"source"` // Interface the operation was requested through, e.g. console
+	ClientIP string    `json:"client_ip"`
+	User     string    `json:"user,omitempty"` // Empty if authentication is disabled
+	Command  string    `json:"command"`
+	Args     []string  `json:"args,omitempty"`
+	Result   string    `json:"result"`
+	Count    uint32    `json:"count"`           // Number of affected metrics
+	Error    string    `json:"error,omitempty"` // Reason of the failure
+}
+
+// auditLock serializes writes to audit logs shared by several servers.
+var auditLock sync.Mutex
+
+// WriteAuditEvent writes the event to the audit log as a single line of JSON.
+// Nothing is written if the audit log is nil. The time of the event is set if it is zero.
+func WriteAuditEvent(w io.Writer, e AuditEvent) {
+	if w == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(e); err != nil {
+		log.Errorf("Failed to encode audit event: %v", err)
+		return
+	}
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Errorf("Failed to write audit event: %v", err)
+	}
+}
+
+// NewAuditEvent returns an event of the command run by the user connected from the remote address.
+// The result is a failure with the error message if err is not nil.
+func NewAuditEvent(source, remoteAddr, user, command string, args []string, count uint32, err error) AuditEvent {
+	e := AuditEvent{
+		Source:   source,
+		ClientIP: remoteAddr,
+		User:     user,
+		Command:  command,
+		Args:     args,
+		Result:   AuditResultSuccess,
+		Count:    count,
+	}
+	if host, _, errSplit := net.SplitHostPort(remoteAddr); errSplit == nil {
+		e.ClientIP = host
+	}
+	if err != nil {
+		e.Result = AuditResultFailure
+		e.Error = err.Error()
+	}
+	return e
+}
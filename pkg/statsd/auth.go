@@ -0,0 +1,108 @@
+package statsd
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Role is a set of permissions granted to a user of the console and the HTTP admin interfaces.
+type Role int
+
+const (
+	// RoleNone grants no permissions.
+	RoleNone Role = iota
+	// RoleReadOnly allows inspecting the server and its metrics.
+	RoleReadOnly
+	// RoleAdmin allows everything RoleReadOnly does and also modifying metrics and flushing them.
+	RoleAdmin
+)
+
+var roleNames = map[Role]string{
+	RoleNone:     "none",
+	RoleReadOnly: "readonly",
+	RoleAdmin:    "admin",
+}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// Allows returns true if the role grants all permissions of the required role.
+func (r Role) Allows(required Role) bool {
+	return r >= required
+}
+
+// ParseRole returns the role with the name.
+func ParseRole(name string) (Role, error) {
+	for role, roleName := range roleNames {
+		if role != RoleNone && roleName == name {
+			return role, nil
+		}
+	}
+	return RoleNone, fmt.Errorf("unknown role %q, must be one of readonly, admin", name)
+}
+
+// User is a user of the console and the HTTP admin interfaces.
+type User struct {
+	Role         Role
+	PasswordHash []byte // bcrypt hash of the password
+}
+
+// Credentials maps names of users to users.
+// Authentication is disabled if there are no users.
+type Credentials map[string]User
+
+// Enabled returns true if users must authenticate.
+func (c Credentials) Enabled() bool {
+	return len(c) > 0
+}
+
+// Authenticate returns the role of the user if the password matches, RoleNone otherwise.
+func (c Credentials) Authenticate(username, password string) Role {
+	user, ok := c[username]
+	if !ok {
+		return RoleNone
+	}
+	if err := bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(password)); err != nil {
+		return RoleNone
+	}
+	return user.Role
+}
+
+// NewCredentialsFromViper returns the users configured in the users section:
+//
+//	[users.alice]
+//	role = "admin"
+//	password_hash = "$2a$10$..."
+//
+// Passwords are only accepted as bcrypt hashes.
+func NewCredentialsFromViper(v *viper.Viper) (Credentials, error) {
+	usernames := make([]string, 0)
+	for username := range v.GetStringMap("users") {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	c := make(Credentials, len(usernames))
+	for _, username := range usernames {
+		u := v.Sub("users." + username)
+		if u == nil {
+			return nil, fmt.Errorf("user %s: invalid configuration", username)
+		}
+		role, err := ParseRole(u.GetString("role"))
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %v", username, err)
+		}
+		hash := []byte(u.GetString("password_hash"))
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return nil, fmt.Errorf("user %s: password_hash must be a bcrypt hash: %v", username, err)
+		}
+		c[username] = User{Role: role, PasswordHash: hash}
+	}
+	return c, nil
+}
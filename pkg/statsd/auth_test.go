@@ -0,0 +1,79 @@
+package statsd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testCredentials returns credentials of the admin user "alice" and the readonly user "bob"
+// with passwords "alice-secret" and "bob-secret".
+func testCredentials(t *testing.T) Credentials {
+	c := make(Credentials)
+	for username, role := range map[string]Role{"alice": RoleAdmin, "bob": RoleReadOnly} {
+		hash, err := bcrypt.GenerateFromPassword([]byte(username+"-secret"), bcrypt.MinCost)
+		require.NoError(t, err)
+		c[username] = User{Role: role, PasswordHash: hash}
+	}
+	return c
+}
+
+func TestCredentialsAuthenticate(t *testing.T) {
+	t.Parallel()
+	c := testCredentials(t)
+	assert.True(t, c.Enabled())
+	assert.False(t, Credentials(nil).Enabled())
+	assert.Equal(t, RoleAdmin, c.Authenticate("alice", "alice-secret"))
+	assert.Equal(t, RoleReadOnly, c.Authenticate("bob", "bob-secret"))
+	assert.Equal(t, RoleNone, c.Authenticate("bob", "alice-secret"))
+	assert.Equal(t, RoleNone, c.Authenticate("carol", "carol-secret"))
+
+	assert.True(t, RoleAdmin.Allows(RoleReadOnly))
+	assert.False(t, RoleReadOnly.Allows(RoleAdmin))
+	assert.False(t, RoleNone.Allows(RoleReadOnly))
+}
+
+func TestNewCredentialsFromViper(t *testing.T) {
+	t.Parallel()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(bytes.NewBufferString(`
+[users.alice]
+role = "admin"
+password_hash = "`+string(hash)+`"
+
+[users.bob]
+role = "readonly"
+password_hash = "`+string(hash)+`"
+`)))
+	c, err := NewCredentialsFromViper(v)
+	require.NoError(t, err)
+	require.Len(t, c, 2)
+	assert.Equal(t, RoleAdmin, c.Authenticate("alice", "secret"))
+	assert.Equal(t, RoleReadOnly, c.Authenticate("bob", "secret"))
+
+	c, err = NewCredentialsFromViper(viper.New())
+	require.NoError(t, err)
+	assert.False(t, c.Enabled())
+
+	for _, config := range []string{
+		`[users.alice]
+role = "admin"
+password_hash = "secret"`, // Plaintext
+		`[users.alice]
+role = "root"
+password_hash = "` + string(hash) + `"`,
+	} {
+		v := viper.New()
+		v.SetConfigType("toml")
+		require.NoError(t, v.ReadConfig(bytes.NewBufferString(config)))
+		_, err := NewCredentialsFromViper(v)
+		assert.Error(t, err, config)
+	}
+}
@@ -0,0 +1,155 @@
+package statsd
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+)
+
+const (
+	// DefaultMinUpdateInterval is the default minimum interval between updates of the same metric
+	// sent by a MetricBroadcaster.
+	DefaultMinUpdateInterval = 100 * time.Millisecond
+	// DefaultSubscriptionBufferSize is the default number of updates buffered for a subscriber.
+	DefaultSubscriptionBufferSize = 1000
+)
+
+// MetricUpdate is a copy of an aggregated metric after it has been updated by a received metric.
+// Value is the value of a counter or a gauge and the number of values of a timer or a set.
+type MetricUpdate struct {
+	Name     string
+	Type     gostatsd.MetricType
+	TagsKey  string
+	Tags     gostatsd.Tags
+	Hostname string
+	Value    float64
+}
+
+// MetricBroadcaster sends updates of aggregated metrics to all subscribers.
+// Updates of the same metric are sent at most once per MinUpdateInterval, other updates are dropped.
+// Updates are dropped for subscribers that do not keep up so that aggregation is never blocked.
+// Safe for concurrent use.
+type MetricBroadcaster struct {
+	minUpdateInterval time.Duration
+	now               func() time.Time // Returns current time. Useful for testing.
+
+	subscribers atomic.Value // []*MetricSubscription, copy-on-write
+	subLock     sync.Mutex   // Serializes subscribers writers
+
+	mu         sync.Mutex
+	lastUpdate map[metricUpdateKey]time.Time
+	lastPrune  time.Time
+}
+
+type metricUpdateKey struct {
+	name       string
+	metricType gostatsd.MetricType
+	tagsKey    string
+}
+
+// MetricSubscription receives updates from a MetricBroadcaster on C.
+type MetricSubscription struct {
+	dropped uint64 // Accessed atomically, must be the first field for alignment
+	updates chan MetricUpdate
+	// C is the channel updates are delivered on. It is not closed on Unsubscribe.
+	C <-chan MetricUpdate
+}
+
+// Dropped returns the number of updates dropped because the subscriber did not keep up.
+func (s *MetricSubscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// NewMetricBroadcaster creates a new MetricBroadcaster. Updates of the same metric are sent at most once
+// per minUpdateInterval, 0 sends all updates.
+func NewMetricBroadcaster(minUpdateInterval time.Duration) *MetricBroadcaster {
+	return &MetricBroadcaster{
+		minUpdateInterval: minUpdateInterval,
+		now:               time.Now,
+		lastUpdate:        make(map[metricUpdateKey]time.Time),
+	}
+}
+
+// Subscribe creates a new subscription buffering up to bufferSize updates.
+// If bufferSize is not positive DefaultSubscriptionBufferSize is used.
+func (b *MetricBroadcaster) Subscribe(bufferSize int) *MetricSubscription {
+	if bufferSize <= 0 {
+		bufferSize = DefaultSubscriptionBufferSize
+	}
+	updates := make(chan MetricUpdate, bufferSize)
+	sub := &MetricSubscription{updates: updates, C: updates}
+	b.subLock.Lock()
+	defer b.subLock.Unlock()
+	current := b.get()
+	list := make([]*MetricSubscription, len(current), len(current)+1)
+	copy(list, current)
+	b.subscribers.Store(append(list, sub))
+	return sub
+}
+
+// Unsubscribe stops sending updates to the subscription.
+func (b *MetricBroadcaster) Unsubscribe(sub *MetricSubscription) {
+	b.subLock.Lock()
+	defer b.subLock.Unlock()
+	current := b.get()
+	list := make([]*MetricSubscription, 0, len(current))
+	for _, s := range current {
+		if s != sub {
+			list = append(list, s)
+		}
+	}
+	b.subscribers.Store(list)
+}
+
+func (b *MetricBroadcaster) get() []*MetricSubscription {
+	list, _ := b.subscribers.Load().([]*MetricSubscription)
+	return list
+}
+
+// hasSubscribers is a cheap check to avoid building updates when nobody is listening.
+func (b *MetricBroadcaster) hasSubscribers() bool {
+	return len(b.get()) > 0
+}
+
+// Publish sends the update to all subscribers unless the metric has been updated during MinUpdateInterval.
+// Tags of the update are copied.
+func (b *MetricBroadcaster) Publish(u MetricUpdate) {
+	subscribers := b.get()
+	if len(subscribers) == 0 {
+		return
+	}
+	if b.minUpdateInterval > 0 && !b.allow(metricUpdateKey{name: u.Name, metricType: u.Type, tagsKey: u.TagsKey}) {
+		return
+	}
+	u.Tags = copyTags(u.Tags)
+	for _, sub := range subscribers {
+		select {
+		case sub.updates <- u:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+// allow returns true if the metric has not been updated during MinUpdateInterval and records the update.
+func (b *MetricBroadcaster) allow(key metricUpdateKey) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if now.Sub(b.lastPrune) >= b.minUpdateInterval {
+		// Forget metrics that are not throttled anymore to keep the map small
+		for k, t := range b.lastUpdate {
+			if now.Sub(t) >= b.minUpdateInterval {
+				delete(b.lastUpdate, k)
+			}
+		}
+		b.lastPrune = now
+	}
+	if last, ok := b.lastUpdate[key]; ok && now.Sub(last) < b.minUpdateInterval {
+		return false
+	}
+	b.lastUpdate[key] = now
+	return true
+}
@@ -0,0 +1,83 @@
+package statsd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricBroadcasterThrottlesUpdates(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1000, 0)
+	b := NewMetricBroadcaster(time.Second)
+	b.now = func() time.Time {
+		return now
+	}
+	sub := b.Subscribe(10)
+
+	b.Publish(MetricUpdate{Name: "a", Type: gostatsd.COUNTER, Value: 1})
+	b.Publish(MetricUpdate{Name: "a", Type: gostatsd.COUNTER, Value: 2}) // Throttled
+	b.Publish(MetricUpdate{Name: "a", Type: gostatsd.GAUGE, Value: 3})   // Different metric
+	b.Publish(MetricUpdate{Name: "a", Type: gostatsd.COUNTER, TagsKey: "x", Value: 4})
+	now = now.Add(time.Second)
+	b.Publish(MetricUpdate{Name: "a", Type: gostatsd.COUNTER, Value: 5})
+
+	var values []float64
+	for len(sub.C) > 0 {
+		values = append(values, (<-sub.C).Value)
+	}
+	assert.Equal(t, []float64{1, 3, 4, 5}, values)
+	assert.Equal(t, uint64(0), sub.Dropped())
+}
+
+func TestMetricBroadcasterDropsUpdatesForSlowSubscribers(t *testing.T) {
+	t.Parallel()
+	b := NewMetricBroadcaster(0)
+	slow := b.Subscribe(1)
+	fast := b.Subscribe(10)
+
+	for i := 0; i < 3; i++ {
+		b.Publish(MetricUpdate{Name: "a", Type: gostatsd.COUNTER, Value: float64(i)})
+	}
+	assert.Len(t, slow.C, 1)
+	assert.Equal(t, uint64(2), slow.Dropped())
+	assert.Len(t, fast.C, 3)
+	assert.Equal(t, uint64(0), fast.Dropped())
+
+	b.Unsubscribe(fast)
+	b.Publish(MetricUpdate{Name: "a", Type: gostatsd.COUNTER})
+	assert.Len(t, fast.C, 3)
+}
+
+func TestMetricAggregatorPublishesUpdates(t *testing.T) {
+	t.Parallel()
+	b := NewMetricBroadcaster(0)
+	a := NewMetricAggregator(nil, 0)
+	a.broadcaster = b
+	now := time.Now()
+
+	a.Receive(&gostatsd.Metric{Name: "c", Type: gostatsd.COUNTER, Value: 1}, now) // No subscribers
+	sub := b.Subscribe(10)
+	tags := gostatsd.Tags{"b", "a"}
+	a.Receive(&gostatsd.Metric{Name: "c", Type: gostatsd.COUNTER, Value: 2, Tags: tags}, now)
+	a.Receive(&gostatsd.Metric{Name: "c", Type: gostatsd.COUNTER, Value: 3}, now)
+	a.Receive(&gostatsd.Metric{Name: "g", Type: gostatsd.GAUGE, Value: 7}, now)
+	a.Receive(&gostatsd.Metric{Name: "t", Type: gostatsd.TIMER, Value: 7}, now)
+	a.Receive(&gostatsd.Metric{Name: "t", Type: gostatsd.TIMER, Value: 8}, now)
+	a.Receive(&gostatsd.Metric{Name: "s", Type: gostatsd.SET, StringValue: "x"}, now)
+
+	require.Len(t, sub.C, 6)
+	u := <-sub.C
+	assert.Equal(t, MetricUpdate{Name: "c", Type: gostatsd.COUNTER, TagsKey: "a,b", Tags: gostatsd.Tags{"a", "b"}, Value: 2}, u)
+	tags[0] = "modified"
+	assert.Equal(t, gostatsd.Tags{"a", "b"}, u.Tags) // Tags are copied
+	assert.Equal(t, float64(4), (<-sub.C).Value)
+	assert.Equal(t, float64(7), (<-sub.C).Value)
+	assert.Equal(t, float64(1), (<-sub.C).Value)
+	assert.Equal(t, float64(2), (<-sub.C).Value)
+	assert.Equal(t, float64(1), (<-sub.C).Value)
+}
@@ -0,0 +1,106 @@
+// Package cardinality tracks the number of distinct metric keys, i.e. combinations of name and tags, of each
+// metric type, and caps their total number.
+package cardinality
+
+import (
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// maxLoggedNames is the maximum number of distinct names of dropped metrics logged between two reports, the
+// metrics dropped with other names are only counted in a summary.
+const maxLoggedNames = 10
+
+// CardinalityTracker counts the distinct keys of each metric type across the aggregators of all workers. The total
+// number of keys can be capped: once the limit is reached, metrics with new keys are dropped and counted, while
+// existing keys are still updated. Each distinct name of a dropped metric is logged once between two reports, up to
+// maxLoggedNames names.
+//
+// Aggregators count the keys they create with Allow if there is a limit, and report the keys they own on every
+// Reset with Update, so that expired, deleted and imported keys are accounted for. Safe for concurrent use.
+type CardinalityTracker struct {
+	limit int // Maximum number of keys of all types, unlimited if 0
+
+	mu       sync.Mutex
+	keys     gostatsd.KeyCounts
+	dropped  uint64              // Number of metrics dropped because of the limit since the start
+	logged   map[string]struct{} // Names of dropped metrics logged since the last report
+	unlogged uint64              // Number of dropped metrics not logged since the last report
+}
+
+// NewCardinalityTracker initialises a new CardinalityTracker allowing up to limit distinct keys of all types,
+// unlimited if 0.
+func NewCardinalityTracker(limit int) *CardinalityTracker {
+	return &CardinalityTracker{
+		limit:  limit,
+		logged: make(map[string]struct{}),
+	}
+}
+
+// Limit returns the maximum number of distinct keys of all types, 0 if unlimited.
+func (t *CardinalityTracker) Limit() int {
+	return t.limit
+}
+
+// Allow returns whether a new key of the metric type may be created for the metric with the name, which is
+// counted if so. The dropped metric is counted and logged otherwise.
+func (t *CardinalityTracker) Allow(metricType gostatsd.MetricType, name string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.limit > 0 && int(t.keys.Total()) >= t.limit {
+		t.dropped++
+		if _, ok := t.logged[name]; ok {
+			return false
+		}
+		if len(t.logged) >= maxLoggedNames {
+			t.unlogged++
+			return false
+		}
+		t.logged[name] = struct{}{}
+		log.Warnf("Dropping metric %s with a new key, the maximum of %d keys is reached", name, t.limit)
+		return false
+	}
+	t.keys.Inc(metricType)
+	return true
+}
+
+// Release uncounts a key counted by Allow that was not created after all.
+func (t *CardinalityTracker) Release(metricType gostatsd.MetricType) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.keys.Dec(metricType)
+}
+
+// Update replaces the keys previously reported by an aggregator, including those counted by Allow since, with
+// the keys it currently owns.
+func (t *CardinalityTracker) Update(previous, current gostatsd.KeyCounts) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.keys.Counters += current.Counters - previous.Counters
+	t.keys.Timers += current.Timers - previous.Timers
+	t.keys.Gauges += current.Gauges - previous.Gauges
+	t.keys.Sets += current.Sets - previous.Sets
+}
+
+// Stats returns the number of keys of each type and the number of metrics dropped because of the limit.
+func (t *CardinalityTracker) Stats() (keys gostatsd.KeyCounts, dropped uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.keys, t.dropped
+}
+
+// Report returns the same as Stats, and logs the number of dropped metrics that were not logged since the
+// previous report. Names of dropped metrics are logged again after a report.
+func (t *CardinalityTracker) Report() (keys gostatsd.KeyCounts, dropped uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.unlogged > 0 {
+		log.Warnf("Dropped %d more metrics with new keys, the maximum of %d keys is reached", t.unlogged, t.limit)
+	}
+	t.logged = make(map[string]struct{})
+	t.unlogged = 0
+	return t.keys, t.dropped
+}
@@ -0,0 +1,71 @@
+package cardinality
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCardinalityTracker(t *testing.T) {
+	t.Parallel()
+	ct := NewCardinalityTracker(3)
+	assert.True(t, ct.Allow(gostatsd.COUNTER, "a"))
+	assert.True(t, ct.Allow(gostatsd.TIMER, "b"))
+	assert.True(t, ct.Allow(gostatsd.COUNTER, "c"))
+	assert.False(t, ct.Allow(gostatsd.GAUGE, "d"))
+	assert.False(t, ct.Allow(gostatsd.SET, "d"))
+	keys, dropped := ct.Stats()
+	assert.Equal(t, gostatsd.KeyCounts{Counters: 2, Timers: 1}, keys)
+	assert.EqualValues(t, 2, dropped)
+
+	// A released key makes room for a new one
+	ct.Release(gostatsd.COUNTER)
+	assert.True(t, ct.Allow(gostatsd.GAUGE, "d"))
+
+	// Keys reported by an aggregator replace the keys it previously reported and created since
+	ct.Update(gostatsd.KeyCounts{Counters: 1, Timers: 1, Gauges: 1}, gostatsd.KeyCounts{Sets: 1})
+	keys, _ = ct.Stats()
+	assert.Equal(t, gostatsd.KeyCounts{Sets: 1}, keys)
+	assert.True(t, ct.Allow(gostatsd.COUNTER, "e"))
+}
+
+func TestCardinalityTrackerUnlimited(t *testing.T) {
+	t.Parallel()
+	ct := NewCardinalityTracker(0)
+	ct.Update(gostatsd.KeyCounts{}, gostatsd.KeyCounts{Counters: 100, Gauges: 5})
+	assert.True(t, ct.Allow(gostatsd.COUNTER, "a"))
+	keys, dropped := ct.Stats()
+	assert.Equal(t, gostatsd.KeyCounts{Counters: 101, Gauges: 5}, keys)
+	assert.Zero(t, dropped)
+}
+
+func TestCardinalityTrackerLogsDistinctNames(t *testing.T) {
+	t.Parallel()
+	ct := NewCardinalityTracker(1)
+	assert.True(t, ct.Allow(gostatsd.COUNTER, "a"))
+	for i := 0; i < 3; i++ {
+		assert.False(t, ct.Allow(gostatsd.COUNTER, "b"))
+		assert.False(t, ct.Allow(gostatsd.COUNTER, "c"))
+	}
+	assert.Len(t, ct.logged, 2)
+	assert.Zero(t, ct.unlogged)
+
+	// Names over the maximum are only counted
+	for i := 0; i < maxLoggedNames+5; i++ {
+		assert.False(t, ct.Allow(gostatsd.COUNTER, fmt.Sprintf("n%d", i)))
+	}
+	assert.Len(t, ct.logged, maxLoggedNames)
+	assert.EqualValues(t, 7, ct.unlogged)
+
+	// Names are logged again after a report
+	keys, dropped := ct.Report()
+	assert.Equal(t, gostatsd.KeyCounts{Counters: 1}, keys)
+	assert.EqualValues(t, 6+maxLoggedNames+5, dropped)
+	assert.Empty(t, ct.logged)
+	assert.Zero(t, ct.unlogged)
+	assert.False(t, ct.Allow(gostatsd.COUNTER, "b"))
+	assert.Contains(t, ct.logged, "b")
+}
@@ -0,0 +1,14 @@
+package statsd
+
+import (
+	"context"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// MetricClient sends internal metrics of the server to a statsd server, e.g. the server itself, instead of
+// dispatching them directly to the handler. See package client/statsd.
+type MetricClient interface {
+	// SendMetrics sends the metrics, it must not keep them once it returns.
+	SendMetrics(ctx context.Context, metrics []gostatsd.Metric) error
+}
@@ -2,6 +2,7 @@ package statsd
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -24,6 +25,46 @@ const (
 	DefaultCacheNegativeTTL = 1 * time.Minute
 )
 
+// LookupPolicy is applied to cloud lookups of new IPs once the maximum number of concurrent lookups is reached.
+type LookupPolicy int
+
+const (
+	// LookupQueue queues the lookup until another lookup finishes.
+	LookupQueue LookupPolicy = iota
+	// LookupDrop drops the lookup, it is handled as a failed lookup.
+	LookupDrop
+)
+
+var lookupPolicyNames = map[LookupPolicy]string{
+	LookupQueue: "queue",
+	LookupDrop:  "drop",
+}
+
+func (p LookupPolicy) String() string {
+	if name, ok := lookupPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("LookupPolicy(%d)", int(p))
+}
+
+// ParseLookupPolicy returns the lookup policy with the name.
+func ParseLookupPolicy(name string) (LookupPolicy, error) {
+	for policy, policyName := range lookupPolicyNames {
+		if policyName == name {
+			return policy, nil
+		}
+	}
+	return LookupQueue, fmt.Errorf("unknown lookup policy %q, must be one of queue, drop", name)
+}
+
+// CloudLookupStats holds statistics of the lookups of a CloudHandler.
+type CloudLookupStats struct {
+	InFlight int64  `json:"in_flight"` // Number of lookups waiting for the cloud provider
+	Queued   int64  `json:"queued"`    // Number of lookups waiting to start
+	Dropped  uint64 `json:"dropped"`   // Number of lookups dropped because too many were in flight
+	Max      int    `json:"max"`       // Maximum number of lookups in flight, unbounded if 0
+}
+
 type lookupResult struct {
 	ip       gostatsd.IP
 	instance *gostatsd.Instance // Can be nil if lookup failed
@@ -53,6 +94,13 @@ type CacheOptions struct {
 
 // CloudHandler enriches metrics and events with additional information fetched from cloud provider.
 type CloudHandler struct {
+	// Counter fields below must be read/written only using atomic instructions.
+	// 64-bit fields must be the first fields in the struct to guarantee proper memory alignment.
+	// See https://golang.org/pkg/sync/atomic/#pkg-note-BUG
+	inFlight int64
+	queued   int64
+	dropped  uint64
+
 	cacheOpts    CacheOptions
 	cloud        gostatsd.CloudProvider // Cloud provider interface
 	next         Handler
@@ -60,6 +108,8 @@ type CloudHandler struct {
 	metricSource chan *gostatsd.Metric
 	eventSource  chan *gostatsd.Event
 	wg           sync.WaitGroup
+	maxLookups   int          // Maximum number of lookups in flight, unbounded if 0
+	lookupPolicy LookupPolicy // Applied to lookups once maxLookups are in flight
 
 	rw    sync.RWMutex // Protects cache
 	cache map[gostatsd.IP]*instanceHolder
@@ -87,6 +137,38 @@ func NewCloudHandler(cloud gostatsd.CloudProvider, next Handler, limiter *rate.L
 	}
 }
 
+// SetMaxConcurrentLookups bounds the number of lookups waiting for the cloud provider, so that a burst of new IPs
+// does not start a goroutine per IP and exceed the rate limits of the provider API. The policy is applied to
+// lookups once max lookups are in flight: queued lookups start when another lookup finishes, dropped lookups are
+// handled as failed lookups and retried after CacheNegativeTTL. Lookups are unbounded if max is 0. Must be called
+// before Run.
+func (ch *CloudHandler) SetMaxConcurrentLookups(max int, policy LookupPolicy) error {
+	if err := checkMaxConcurrentLookups(max); err != nil {
+		return err
+	}
+	ch.maxLookups = max
+	ch.lookupPolicy = policy
+	return nil
+}
+
+// checkMaxConcurrentLookups checks that the maximum number of concurrent cloud lookups is not negative.
+func checkMaxConcurrentLookups(max int) error {
+	if max < 0 {
+		return fmt.Errorf("maximum number of concurrent cloud lookups %d must not be negative", max)
+	}
+	return nil
+}
+
+// LookupStats returns statistics of the lookups.
+func (ch *CloudHandler) LookupStats() CloudLookupStats {
+	return CloudLookupStats{
+		InFlight: atomic.LoadInt64(&ch.inFlight),
+		Queued:   atomic.LoadInt64(&ch.queued),
+		Dropped:  atomic.LoadUint64(&ch.dropped),
+		Max:      ch.maxLookups,
+	}
+}
+
 func (ch *CloudHandler) DispatchMetric(ctx context.Context, m *gostatsd.Metric) error {
 	if ch.updateTagsAndHostname(m.SourceIP, &m.Tags, &m.Hostname) {
 		return ch.next.DispatchMetric(ctx, m)
@@ -163,10 +245,8 @@ func (ch *CloudHandler) doRefresh(ctx context.Context, toLookup chan<- gostatsd.
 			toDelete = append(toDelete, ip)
 		} else if t.After(holder.expires) {
 			// Entry needs a refresh.
-			select {
-			case <-ctx.Done():
+			if !ch.queueLookup(ctx, toLookup, ip) {
 				return
-			case toLookup <- ip:
 			}
 		}
 	}
@@ -224,10 +304,7 @@ func (ch *CloudHandler) handleMetric(ctx context.Context, toLookup chan<- gostat
 		awaitingMetrics[m.SourceIP] = append(queue, m)
 		if len(queue) == 0 {
 			// This is the first metric in the queue
-			select {
-			case <-ctx.Done():
-			case toLookup <- m.SourceIP:
-			}
+			ch.queueLookup(ctx, toLookup, m.SourceIP)
 		}
 	}
 }
@@ -256,10 +333,7 @@ func (ch *CloudHandler) handleEvent(ctx context.Context, toLookup chan<- gostats
 		awaitingEvents[e.SourceIP] = append(queue, e)
 		if len(queue) == 0 {
 			// This is the first event in the queue
-			select {
-			case <-ctx.Done():
-			case toLookup <- e.SourceIP:
-			}
+			ch.queueLookup(ctx, toLookup, e.SourceIP)
 		}
 	}
 }
@@ -281,6 +355,18 @@ func (ch *CloudHandler) updateAndDispatchEvents(ctx context.Context, instance *g
 	}
 }
 
+// queueLookup sends the IP to the lookup dispatcher, it returns false if the context is done.
+func (ch *CloudHandler) queueLookup(ctx context.Context, toLookup chan<- gostatsd.IP, ip gostatsd.IP) bool {
+	atomic.AddInt64(&ch.queued, 1)
+	select {
+	case <-ctx.Done():
+		atomic.AddInt64(&ch.queued, -1)
+		return false
+	case toLookup <- ip:
+		return true
+	}
+}
+
 func (ch *CloudHandler) lookupDispatcher(ctx context.Context, wg *sync.WaitGroup, toLookup <-chan gostatsd.IP, lookupResults chan<- *lookupResult) {
 	defer wg.Done()
 	defer log.Info("Cloud lookup dispatcher stopped")
@@ -288,30 +374,64 @@ func (ch *CloudHandler) lookupDispatcher(ctx context.Context, wg *sync.WaitGroup
 	var wgLookups sync.WaitGroup
 	defer wgLookups.Wait() // Wait for all in-flight lookups to finish
 
+	var slots chan struct{} // Lookups in flight, unbounded if nil
+	if ch.maxLookups > 0 {
+		slots = make(chan struct{}, ch.maxLookups)
+	}
 	for ip := range toLookup {
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			default:
+				if ch.lookupPolicy == LookupDrop {
+					atomic.AddInt64(&ch.queued, -1)
+					atomic.AddUint64(&ch.dropped, 1)
+					log.Debugf("Dropped cloud lookup of %s: %d lookups in flight", ip, ch.maxLookups)
+					// Sent from another goroutine because Run may be blocked sending to toLookup
+					wgLookups.Add(1)
+					go ch.sendLookupResult(ctx, &wgLookups, &lookupResult{ip: ip}, lookupResults)
+					continue
+				}
+				select {
+				case <-ctx.Done():
+					atomic.AddInt64(&ch.queued, -1)
+					return
+				case slots <- struct{}{}:
+				}
+			}
+		}
 		if err := ch.limiter.Wait(ctx); err != nil {
+			atomic.AddInt64(&ch.queued, -1)
 			if err != context.Canceled && err != context.DeadlineExceeded {
 				// This could be an error caused by context signaling done. Or something nasty but it is very unlikely.
 				log.Warnf("Error from limiter: %v", err)
 			}
 			return
 		}
+		atomic.AddInt64(&ch.queued, -1)
+		atomic.AddInt64(&ch.inFlight, 1)
 		wgLookups.Add(1)
-		go ch.doLookup(ctx, &wgLookups, ip, lookupResults)
+		go ch.doLookup(ctx, &wgLookups, ip, lookupResults, slots)
 	}
 }
 
-func (ch *CloudHandler) doLookup(ctx context.Context, wg *sync.WaitGroup, ip gostatsd.IP, lookupResults chan<- *lookupResult) {
-	defer wg.Done()
-
+func (ch *CloudHandler) doLookup(ctx context.Context, wg *sync.WaitGroup, ip gostatsd.IP, lookupResults chan<- *lookupResult, slots <-chan struct{}) {
 	instance, err := ch.cloud.Instance(ctx, ip)
+	atomic.AddInt64(&ch.inFlight, -1)
+	if slots != nil {
+		<-slots // Freed before the result is sent because Run may be blocked sending to toLookup
+	}
 	if err != nil {
 		log.Debugf("Error retrieving instance details from cloud provider for %s: %v", ip, err)
 	}
-	res := &lookupResult{
+	ch.sendLookupResult(ctx, wg, &lookupResult{
 		ip:       ip,
 		instance: instance,
-	}
+	}, lookupResults)
+}
+
+func (ch *CloudHandler) sendLookupResult(ctx context.Context, wg *sync.WaitGroup, res *lookupResult, lookupResults chan<- *lookupResult) {
+	defer wg.Done()
 	select {
 	case <-ctx.Done():
 	case lookupResults <- res:
@@ -343,9 +463,13 @@ func (ch *CloudHandler) getInstance(ip gostatsd.IP) (*gostatsd.Instance, bool) {
 func updateInplace(tags *gostatsd.Tags, hostname *string, instance *gostatsd.Instance) {
 	if instance != nil { // It was a positive cache hit (successful lookup cache, not failed lookup cache)
 		// Update hostname inplace
-		*hostname = instance.ID
+		if instance.ID != "" {
+			*hostname = instance.ID
+		}
 		// Update tag list inplace
-		*tags = append(*tags, "region:"+instance.Region)
+		if instance.Region != "" {
+			*tags = append(*tags, "region:"+instance.Region)
+		}
 		*tags = append(*tags, instance.Tags...)
 	}
 }
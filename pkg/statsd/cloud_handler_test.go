@@ -4,13 +4,17 @@ import (
 	"context"
 	"errors"
 	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/cloudproviders"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/time/rate"
 )
 
@@ -111,6 +115,51 @@ func TestCloudHandlerDispatch(t *testing.T) {
 	doCheck(t, fp, counting, sm1(), se1(), sm2(), se2(), &fp.ips, expectedIps, expectedMetrics, expectedEvents)
 }
 
+func TestCloudHandlerTagsResolver(t *testing.T) {
+	t.Parallel()
+	fr := &fakeResolver{
+		ResolvedTags: gostatsd.Tags{"tag1", "tag2:234"},
+	}
+	counting := &countingHandler{}
+
+	expectedIps := []gostatsd.IP{"1.2.3.4", "4.3.2.1"}
+	expectedMetrics := []gostatsd.Metric{
+		{
+			Name:     "t1",
+			Value:    42.42,
+			Tags:     gostatsd.Tags{"a1", "tag1", "tag2:234"},
+			Hostname: "somehost",
+			SourceIP: "1.2.3.4",
+			Type:     gostatsd.COUNTER,
+		},
+		{
+			Name:     "t1",
+			Value:    45.45,
+			Tags:     gostatsd.Tags{"a4", "tag1", "tag2:234"},
+			Hostname: "somehost",
+			SourceIP: "1.2.3.4",
+			Type:     gostatsd.COUNTER,
+		},
+	}
+	expectedEvents := gostatsd.Events{
+		gostatsd.Event{
+			Title:    "t12",
+			Text:     "asrasdfasdr",
+			Tags:     gostatsd.Tags{"a2", "tag1", "tag2:234"},
+			Hostname: "some_random_host",
+			SourceIP: "4.3.2.1",
+		},
+		gostatsd.Event{
+			Title:    "t1asdas",
+			Text:     "asdr",
+			Tags:     gostatsd.Tags{"a2-35", "tag1", "tag2:234"},
+			Hostname: "some_random_host",
+			SourceIP: "4.3.2.1",
+		},
+	}
+	doCheck(t, cloudproviders.NewTagsResolverProvider(fr), counting, sm1(), se1(), sm2(), se2(), &fr.ips, expectedIps, expectedMetrics, expectedEvents)
+}
+
 func TestCloudHandlerInstanceNotFound(t *testing.T) {
 	t.Parallel()
 	fp := &fakeProviderNotFound{}
@@ -143,6 +192,110 @@ func TestCloudHandlerFailingProvider(t *testing.T) {
 	doCheck(t, fp, counting, sm1(), se1(), sm2(), se2(), &fp.ips, expectedIps, expectedMetrics, expectedEvents)
 }
 
+func TestCloudHandlerMaxConcurrentLookups(t *testing.T) {
+	t.Parallel()
+	for _, policy := range []LookupPolicy{LookupQueue, LookupDrop} {
+		policy := policy
+		t.Run(policy.String(), func(t *testing.T) {
+			t.Parallel()
+			testMaxConcurrentLookups(t, policy)
+		})
+	}
+}
+
+func testMaxConcurrentLookups(t *testing.T, policy LookupPolicy) {
+	const maxLookups, numIPs = 4, 100
+	fp := &fakeBlockingProvider{release: make(chan struct{})}
+	counting := &countingHandler{}
+	ch := NewCloudHandler(fp, counting, rate.NewLimiter(rate.Inf, 0), nil)
+	require.NoError(t, ch.SetMaxConcurrentLookups(maxLookups, policy))
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if handlerErr := ch.Run(ctx); handlerErr != nil && handlerErr != context.Canceled {
+			t.Errorf("Cloud handler quit unexpectedly: %v", handlerErr)
+		}
+	}()
+
+	// Many simultaneous unseen IPs
+	for i := 0; i < numIPs; i++ {
+		m := gostatsd.Metric{Name: "m", Value: 1, Type: gostatsd.COUNTER, SourceIP: gostatsd.IP("10.0.0." + strconv.Itoa(i))}
+		require.NoError(t, ch.DispatchMetric(ctx, &m))
+	}
+	waitFor(t, func() bool {
+		stats := ch.LookupStats()
+		if policy == LookupDrop {
+			return stats.InFlight == maxLookups && stats.Dropped == numIPs-maxLookups
+		}
+		return stats.InFlight == maxLookups && stats.Queued == numIPs-maxLookups
+	})
+	if policy == LookupDrop {
+		// Dropped lookups are handled as failed lookups
+		waitFor(t, func() bool {
+			return counting.numMetrics() == numIPs-maxLookups
+		})
+	}
+	close(fp.release)
+	waitFor(t, func() bool {
+		return counting.numMetrics() == numIPs
+	})
+	stats := ch.LookupStats()
+	assert.Zero(t, stats.InFlight)
+	assert.Zero(t, stats.Queued)
+	assert.EqualValues(t, maxLookups, atomic.LoadInt32(&fp.maxInFlight))
+	if policy == LookupDrop {
+		assert.EqualValues(t, maxLookups, atomic.LoadInt32(&fp.lookups))
+	} else {
+		assert.EqualValues(t, numIPs, atomic.LoadInt32(&fp.lookups))
+		assert.Zero(t, stats.Dropped)
+	}
+}
+
+func TestParseLookupPolicy(t *testing.T) {
+	t.Parallel()
+	for policy, name := range lookupPolicyNames {
+		p, err := ParseLookupPolicy(name)
+		require.NoError(t, err)
+		assert.Equal(t, policy, p)
+	}
+	_, err := ParseLookupPolicy("block")
+	assert.EqualError(t, err, `unknown lookup policy "block", must be one of queue, drop`)
+}
+
+// waitFor waits up to 5 seconds for the condition to be true.
+func waitFor(t *testing.T, condition func() bool) {
+	for i := 0; !condition(); i++ {
+		if i == 500 {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// metricSnapshotter is a MetricDispatcher or a Server.
+type metricSnapshotter interface {
+	Snapshot(ctx context.Context) (*gostatsd.MetricMap, error)
+}
+
+// waitForSnapshot waits until the condition holds for a snapshot of the aggregated metrics and returns the snapshot.
+// Snapshots failing to be taken, e.g. before a Server is started, are retried.
+func waitForSnapshot(t *testing.T, ctx context.Context, s metricSnapshotter, condition func(*gostatsd.MetricMap) bool) *gostatsd.MetricMap {
+	var snapshot *gostatsd.MetricMap
+	waitFor(t, func() bool {
+		m, err := s.Snapshot(ctx)
+		if err != nil {
+			return false
+		}
+		snapshot = m
+		return condition(m)
+	})
+	return snapshot
+}
+
 func doCheck(t *testing.T, cloud gostatsd.CloudProvider, counting *countingHandler, m1 gostatsd.Metric, e1 gostatsd.Event, m2 gostatsd.Metric, e2 gostatsd.Event, ips *[]gostatsd.IP, expectedIps []gostatsd.IP, expectedM []gostatsd.Metric, expectedE gostatsd.Events) {
 	ch := NewCloudHandler(cloud, counting, rate.NewLimiter(100, 120), nil)
 	var wg sync.WaitGroup
@@ -261,6 +414,12 @@ func (ch *countingHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event)
 func (ch *countingHandler) WaitForEvents() {
 }
 
+func (ch *countingHandler) numMetrics() int {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return len(ch.metrics)
+}
+
 type fakeCountingProvider struct {
 	mu  sync.Mutex
 	ips []gostatsd.IP
@@ -276,6 +435,20 @@ func (fp *fakeCountingProvider) SelfIP() (gostatsd.IP, error) {
 	return gostatsd.UnknownIP, nil
 }
 
+type fakeResolver struct {
+	fakeCountingProvider
+	ResolvedTags gostatsd.Tags
+}
+
+func (fr *fakeResolver) Name() string {
+	return "fakeResolver"
+}
+
+func (fr *fakeResolver) Tags(ctx context.Context, ip gostatsd.IP) (gostatsd.Tags, error) {
+	fr.count(ip)
+	return fr.ResolvedTags, nil
+}
+
 type fakeProviderIP struct {
 	fakeCountingProvider
 	Region string
@@ -320,3 +493,34 @@ func (fp *fakeFailingProvider) Instance(ctx context.Context, ip gostatsd.IP) (*g
 	fp.count(ip)
 	return nil, errors.New("clear skies, no clouds available")
 }
+
+// fakeBlockingProvider blocks lookups until release is closed and records the maximum number of lookups in flight.
+type fakeBlockingProvider struct {
+	fakeCountingProvider
+	release     chan struct{}
+	inFlight    int32
+	maxInFlight int32
+	lookups     int32
+}
+
+func (fp *fakeBlockingProvider) Name() string {
+	return "fakeBlockingProvider"
+}
+
+func (fp *fakeBlockingProvider) Instance(ctx context.Context, ip gostatsd.IP) (*gostatsd.Instance, error) {
+	atomic.AddInt32(&fp.lookups, 1)
+	n := atomic.AddInt32(&fp.inFlight, 1)
+	defer atomic.AddInt32(&fp.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(&fp.maxInFlight)
+		if n <= max || atomic.CompareAndSwapInt32(&fp.maxInFlight, max, n) {
+			break
+		}
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-fp.release:
+	}
+	return &gostatsd.Instance{ID: "i-" + string(ip)}, nil
+}
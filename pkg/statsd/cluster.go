@@ -0,0 +1,54 @@
+package statsd
+
+import (
+	"context"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// Cluster shards the aggregation of metrics between servers by name so that servers can be added to scale
+// horizontally. Each server aggregates the metrics it receives, then on each flush it shares the metrics of names
+// owned by other servers with them, and merges the metrics they shared before flushing. See package cluster.
+type Cluster interface {
+	// Owns returns whether metrics with the name are flushed by this server. Must be safe for concurrent use.
+	Owns(name string) bool
+	// Share sends the metrics, which are not summarized, to the servers owning their names, and lets the other
+	// servers know that this server has shared its metrics. It returns the number of metrics that were dropped.
+	Share(ctx context.Context, m *gostatsd.MetricMap) int
+	// Gather waits until all other servers have shared their metrics since the previous call, at most for the
+	// timeout, and returns the metrics shared with this server.
+	Gather(ctx context.Context, timeout time.Duration) []*gostatsd.MetricMap
+	// Run runs until the context is done.
+	Run(ctx context.Context) error
+}
+
+// extractShared removes the metrics with names not owned by this server from the MetricMap and returns them.
+func extractShared(m *gostatsd.MetricMap, c Cluster) *gostatsd.MetricMap {
+	shared := newMetricMap()
+	for name, v := range m.Counters {
+		if !c.Owns(name) {
+			shared.Counters[name] = v
+			delete(m.Counters, name)
+		}
+	}
+	for name, v := range m.Timers {
+		if !c.Owns(name) {
+			shared.Timers[name] = v
+			delete(m.Timers, name)
+		}
+	}
+	for name, v := range m.Gauges {
+		if !c.Owns(name) {
+			shared.Gauges[name] = v
+			delete(m.Gauges, name)
+		}
+	}
+	for name, v := range m.Sets {
+		if !c.Owns(name) {
+			shared.Sets[name] = v
+			delete(m.Sets, name)
+		}
+	}
+	return shared
+}
@@ -0,0 +1,200 @@
+package statsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// ReadConfigFiles reads the configuration files into the Viper instance. Sections of the files are merged in order,
+// values of later files override values of earlier ones, e.g. an environment overlay overrides the address of a
+// backend configured in a base file and keeps its other values. Lists are replaced, not merged. An error is returned
+// if a section of a file is a value in another file.
+func ReadConfigFiles(v *viper.Viper, paths []string) error {
+	if len(paths) == 1 {
+		v.SetConfigFile(paths[0])
+		return v.ReadInConfig()
+	}
+	merged := map[string]interface{}{}
+	for _, path := range paths {
+		fv := viper.New()
+		fv.SetConfigFile(path)
+		if err := fv.ReadInConfig(); err != nil {
+			return fmt.Errorf("failed to read config file %s: %v", path, err)
+		}
+		if err := mergeConfig(merged, fv.AllSettings(), ""); err != nil {
+			return fmt.Errorf("failed to merge config file %s: %v", path, err)
+		}
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return fmt.Errorf("failed to merge config files: %v", err)
+	}
+	v.SetConfigType("json")
+	return v.ReadConfig(bytes.NewReader(data))
+}
+
+// mergeConfig merges the settings of src into dst. Prefix is the key of the section being merged.
+func mergeConfig(dst, src map[string]interface{}, prefix string) error {
+	for key, value := range src {
+		name := prefix + key
+		existing, ok := dst[key]
+		if !ok {
+			dst[key] = value
+			continue
+		}
+		existingSection, existingIsSection := existing.(map[string]interface{})
+		section, isSection := value.(map[string]interface{})
+		switch {
+		case existingIsSection && isSection:
+			if err := mergeConfig(existingSection, section, name+"."); err != nil {
+				return err
+			}
+		case existingIsSection || isSection:
+			return fmt.Errorf("%s cannot be both a section and a value", name)
+		default:
+			dst[key] = value
+		}
+	}
+	return nil
+}
+
+// ConfigErrors are the problems found in the configuration of a Server by Validate.
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Validate checks the configuration of the server without opening any sockets, e.g. to check a configuration
+// before rolling it out. It returns ConfigErrors with all the problems found, nil if there are none. Run
+// validates the configuration before starting.
+func (s *Server) Validate() error {
+	var errs ConfigErrors
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if s.FlushInterval <= 0 {
+		check(fmt.Errorf("flush interval %v must be positive", s.FlushInterval))
+	}
+	if s.ExpiryInterval < 0 {
+		check(fmt.Errorf("expiry interval %v must not be negative", s.ExpiryInterval))
+	}
+	for metricType, interval := range s.ExpiryIntervals {
+		if interval < 0 {
+			check(fmt.Errorf("expiry interval %v of %s must not be negative", interval, metricType))
+		}
+	}
+	if s.SnapshotInterval < 0 {
+		check(fmt.Errorf("snapshot interval %v must not be negative", s.SnapshotInterval))
+	}
+	if s.MaxReaders <= 0 {
+		check(fmt.Errorf("number of readers %d must be positive", s.MaxReaders))
+	}
+	if s.MaxKeysPerSource < 0 {
+		check(fmt.Errorf("maximum number of keys per source %d must not be negative", s.MaxKeysPerSource))
+	}
+	if s.CardinalityLimit < 0 {
+		check(fmt.Errorf("cardinality limit %d must not be negative", s.CardinalityLimit))
+	}
+	if s.TimerCompression < 0 {
+		check(fmt.Errorf("timer compression %v must not be negative", s.TimerCompression))
+	}
+	if s.CardinalityReportEvery != 0 {
+		check(checkCardinalityReportEvery(s.CardinalityReportEvery))
+	}
+	for _, cpu := range s.PinCPUs {
+		if cpu < 0 {
+			check(fmt.Errorf("CPU %d to pin to must not be negative", cpu))
+		}
+	}
+	if s.MetricArenaSize < 0 {
+		check(fmt.Errorf("metric arena size %d must not be negative", s.MetricArenaSize))
+	}
+	if s.MaxWorkers <= 0 {
+		check(fmt.Errorf("number of workers %d must be positive", s.MaxWorkers))
+	}
+	for _, pct := range s.PercentThreshold {
+		if pct == 0 || math.IsNaN(pct) || math.Abs(pct) > 100 {
+			check(fmt.Errorf("percentile %v must be between -100 and 100 and not 0", pct))
+		}
+	}
+	consoleAddr := s.ConsoleAddr
+	if s.DisableConsole {
+		consoleAddr = ""
+	}
+	for _, a := range []struct {
+		name    string
+		network string
+		addr    string
+	}{
+		{"metrics", "udp", s.MetricsAddr},
+		{"QUIC", "udp", s.QUICAddr},
+		{"console", "tcp", consoleAddr},
+		{"health", "tcp", s.HealthAddr},
+		{"gRPC", "tcp", s.GRPCAddr},
+	} {
+		if a.addr != "" {
+			check(checkAddr(a.name, a.network, a.addr))
+		}
+	}
+	if s.QUICAddr != "" && (s.QUICTLSConfig == nil || s.QUICMaxStreams <= 0) {
+		check(errors.New("QUIC receiver requires a TLS configuration and a positive number of streams"))
+	}
+	backends := make(map[string]bool, len(s.Backends))
+	for _, backend := range s.Backends {
+		backends[backend.Name()] = true
+	}
+	check(checkBackendFlushIntervals(backends, s.FlushInterval, s.BackendFlushIntervals))
+	check(checkBackendTimeouts(backends, s.BackendTimeouts))
+	check(checkSkipEmptyFlushes(backends, s.SkipEmptyFlushBackends))
+	check(checkMaxConcurrentLookups(s.MaxCloudLookups))
+	if s.ValuePrecision != 0 {
+		check(checkValuePrecision(s.ValuePrecision))
+	}
+	if s.BackendQueueSize != 0 {
+		check(checkBackendQueues(s.BackendQueueSize, s.BackendQueuePolicy))
+	}
+	if s.TenantMode != TenantModeNone {
+		if s.TenantMode == TenantModeName && s.Namespace != "" {
+			check(errors.New("tenants cannot be taken from names of metrics prefixed with a namespace"))
+		}
+		_, err := newTenancy(s.Tenants, s.DefaultTenant)
+		check(err)
+		check(checkTenantBackends(backends, s.Tenants))
+	}
+	if len(s.PayloadBuckets) > 0 {
+		check(newPayloadHistograms().setBounds(s.PayloadBuckets))
+	}
+	if s.RuntimeMetrics && s.RuntimeMetricsInterval <= 0 {
+		check(fmt.Errorf("interval of runtime metrics must be positive: %v", s.RuntimeMetricsInterval))
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// checkAddr checks that the address is a host and a port of the network.
+func checkAddr(name, network, addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err == nil {
+		_, err = net.LookupPort(network, port)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s address %q: %v", name, addr, err)
+	}
+	return nil
+}
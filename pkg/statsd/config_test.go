@@ -0,0 +1,210 @@
+package statsd
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFiles(t *testing.T, files map[string]string) (string, func()) {
+	dir, err := ioutil.TempDir("", "gostatsd")
+	require.NoError(t, err)
+	for name, content := range files {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+	}
+	return dir, func() {
+		os.RemoveAll(dir) // #nosec
+	}
+}
+
+func TestReadConfigFilesMerges(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := writeConfigFiles(t, map[string]string{
+		"base.toml": `
+backends = "graphite"
+
+[graphite]
+address = "localhost:2003"
+global_prefix = "stats"
+protocol = "pickle"
+
+[datadog]
+api_key = "key"
+
+[[rename]]
+from = "a"
+to = "b"
+`,
+		"overlay.yaml": `
+graphite:
+  address: graphite.prod:2003
+  batch_size: 100
+rename:
+  - from: c
+    to: d
+`,
+	})
+	defer cleanup()
+
+	v := viper.New()
+	require.NoError(t, ReadConfigFiles(v, []string{filepath.Join(dir, "base.toml"), filepath.Join(dir, "overlay.yaml")}))
+	assert.Equal(t, "graphite", v.GetString("backends"))
+	assert.Equal(t, "graphite.prod:2003", v.GetString("graphite.address"))
+	assert.Equal(t, "stats", v.GetString("graphite.global_prefix"))
+	assert.Equal(t, "pickle", v.GetString("graphite.protocol"))
+	assert.Equal(t, 100, v.GetInt("graphite.batch_size"))
+	assert.Equal(t, "key", v.GetString("datadog.api_key"))
+
+	rules, err := NewRenameRulesFromViper(v)
+	require.NoError(t, err)
+	assert.Equal(t, RenameRules{{From: "c", To: "d"}}, rules) // Lists are replaced
+}
+
+func TestReadConfigFilesSingle(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := writeConfigFiles(t, map[string]string{
+		"config.toml": "[graphite]\naddress = \"localhost:2003\"\n",
+	})
+	defer cleanup()
+
+	v := viper.New()
+	require.NoError(t, ReadConfigFiles(v, []string{filepath.Join(dir, "config.toml")}))
+	assert.Equal(t, "localhost:2003", v.GetString("graphite.address"))
+}
+
+func TestReadConfigFilesConflict(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := writeConfigFiles(t, map[string]string{
+		"base.toml":    "[graphite]\naddress = \"localhost:2003\"\n",
+		"overlay.toml": "graphite = \"disabled\"\n",
+	})
+	defer cleanup()
+
+	overlay := filepath.Join(dir, "overlay.toml")
+	err := ReadConfigFiles(viper.New(), []string{filepath.Join(dir, "base.toml"), overlay})
+	assert.EqualError(t, err, "failed to merge config file "+overlay+": graphite cannot be both a section and a value")
+}
+
+func TestReadConfigFilesMissing(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := writeConfigFiles(t, map[string]string{
+		"base.toml": "[graphite]\naddress = \"localhost:2003\"\n",
+	})
+	defer cleanup()
+
+	err := ReadConfigFiles(viper.New(), []string{filepath.Join(dir, "base.toml"), filepath.Join(dir, "missing.toml")})
+	assert.Error(t, err)
+}
+
+func newValidServer() *Server {
+	s := NewServer()
+	s.Backends = []gostatsd.Backend{&recordingBackend{name: "graphite"}, &recordingBackend{name: "datadog"}}
+	s.BackendFlushIntervals = map[string]time.Duration{"datadog": 10 * DefaultFlushInterval}
+	s.BackendTimeouts = map[string]time.Duration{"graphite": time.Second}
+	s.Viper = viper.New()
+	return s
+}
+
+func TestServerValidate(t *testing.T) {
+	t.Parallel()
+	assert.NoError(t, newValidServer().Validate())
+
+	s := newValidServer()
+	s.DisableConsole = true
+	s.ConsoleAddr = "invalid"
+	assert.NoError(t, s.Validate(), "address of the disabled console is not checked")
+
+	tests := []struct {
+		name   string
+		modify func(*Server)
+		err    string
+	}{
+		{"flush interval", func(s *Server) { s.FlushInterval = 0 }, "flush interval 0s must be positive"},
+		{"workers", func(s *Server) { s.MaxWorkers = 0 }, "number of workers 0 must be positive"},
+		{"keys per source", func(s *Server) { s.MaxKeysPerSource = -1 }, "maximum number of keys per source -1 must not be negative"},
+		{"cardinality limit", func(s *Server) { s.CardinalityLimit = -1 }, "cardinality limit -1 must not be negative"},
+		{"timer compression", func(s *Server) { s.TimerCompression = -1 }, "timer compression -1 must not be negative"},
+		{"cardinality report every", func(s *Server) { s.CardinalityReportEvery = -1 }, "number of flushes between cardinality reports -1 must be positive"},
+		{"CPUs", func(s *Server) { s.PinCPUs = []int{0, -2} }, "CPU -2 to pin to must not be negative"},
+		{"expiry interval of type", func(s *Server) {
+			s.ExpiryIntervals = map[gostatsd.MetricType]time.Duration{gostatsd.GAUGE: -time.Minute}
+		}, "expiry interval -1m0s of gauge must not be negative"},
+		{"percentile", func(s *Server) { s.PercentThreshold = []float64{90, 101} }, "percentile 101 must be between -100 and 100 and not 0"},
+		{"metrics address", func(s *Server) { s.MetricsAddr = "8125" }, `invalid metrics address "8125"`},
+		{"console port", func(s *Server) { s.ConsoleAddr = ":nope" }, `invalid console address ":nope"`},
+		{"QUIC", func(s *Server) { s.QUICAddr = ":8443" }, "QUIC receiver requires a TLS configuration"},
+		{"flush interval of unknown backend", func(s *Server) {
+			s.BackendFlushIntervals = map[string]time.Duration{"stdout": 10 * time.Second}
+		}, "flush interval of unknown backend stdout"},
+		{"backend flush interval", func(s *Server) {
+			s.BackendFlushIntervals = map[string]time.Duration{"datadog": 1500 * time.Millisecond}
+		}, "flush interval 1.5s of backend datadog must be a multiple of the flush interval 1s"},
+		{"backend timeout", func(s *Server) {
+			s.BackendTimeouts = map[string]time.Duration{"graphite": -time.Second}
+		}, "timeout -1s of backend graphite must be positive"},
+		{"skip empty flushes of unknown backend", func(s *Server) {
+			s.SkipEmptyFlushBackends = []string{"stdout"}
+		}, "skipping empty flushes of unknown backend stdout"},
+		{"max cloud lookups", func(s *Server) { s.MaxCloudLookups = -1 }, "maximum number of concurrent cloud lookups -1 must not be negative"},
+		{"value precision", func(s *Server) { s.ValuePrecision = -2 }, "value precision -2 must be a positive number of significant digits"},
+		{"tenants", func(s *Server) {
+			s.TenantMode = TenantModeName
+			s.Namespace = "ns"
+		}, "tenants cannot be taken from names of metrics prefixed with a namespace"},
+		{"tenant backend", func(s *Server) {
+			s.TenantMode = TenantModeTag
+			s.Tenants = []Tenant{{Name: "team", Backends: []string{"stdout"}}}
+		}, "tenant team: unknown backend stdout"},
+		{"payload buckets", func(s *Server) { s.PayloadBuckets = []int{100, 10} }, "payload buckets must be positive and increasing"},
+		{"runtime metrics", func(s *Server) {
+			s.RuntimeMetrics = true
+			s.RuntimeMetricsInterval = 0
+		}, "interval of runtime metrics must be positive"},
+	}
+	for _, test := range tests {
+		s := newValidServer()
+		test.modify(s)
+		err := s.Validate()
+		if assert.Error(t, err, test.name) {
+			assert.Contains(t, err.Error(), test.err, test.name)
+		}
+	}
+}
+
+func TestServerValidateReportsAllProblems(t *testing.T) {
+	t.Parallel()
+	s := newValidServer()
+	s.MaxReaders = 0
+	s.HealthAddr = "localhost"
+	s.QUICAddr = ":8443"
+	s.QUICTLSConfig = &tls.Config{}
+	s.QUICMaxStreams = 1
+	err := s.Validate()
+	require.IsType(t, ConfigErrors{}, err)
+	errs := err.(ConfigErrors)
+	require.Len(t, errs, 2)
+	assert.Equal(t, "number of readers 0 must be positive", errs[0].Error())
+	assert.Contains(t, errs[1].Error(), `invalid health address "localhost"`)
+}
+
+func TestRunValidatesBeforeListening(t *testing.T) {
+	t.Parallel()
+	s := newValidServer()
+	s.FlushInterval = 0
+	err := s.RunWithCustomSocket(context.Background(), func() (net.PacketConn, error) {
+		t.Error("socket must not be opened")
+		return nil, context.Canceled
+	})
+	assert.EqualError(t, err, "flush interval 0s must be positive; flush interval 10s of backend datadog must be a multiple of the flush interval 0s")
+}
@@ -3,29 +3,112 @@ package statsd
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
-	"sync/atomic"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statsd/cardinality"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/kisielk/cmd"
 )
 
-// DefaultConsoleAddr is the default address on which a ConsoleServer will listen.
-const DefaultConsoleAddr = ":8126"
+const (
+	// DefaultConsoleAddr is the default address on which a ConsoleServer will listen.
+	DefaultConsoleAddr = ":8126"
+	// DefaultConsoleIdleTimeout is the default time after which a console connection without input is closed.
+	DefaultConsoleIdleTimeout = 10 * time.Minute
+	// DefaultPreviewDuration is the default duration of the preview console command.
+	DefaultPreviewDuration = 1 * time.Second
+	// maxPreviewDuration is the maximum duration of the preview console command.
+	maxPreviewDuration = 1 * time.Minute
+	// previewTopNames is the number of the most active metric names printed by the preview console command.
+	previewTopNames = 20
+	// watchInterval is how often the watch console command prints the value of the metric.
+	watchInterval = 1 * time.Second
+	// exportFormatFlag is the prefix of the argument of the export console command that selects the format.
+	exportFormatFlag = "--format="
+)
 
-var errClientQuit = errors.New("client quit")
+var (
+	errClientQuit           = errors.New("client quit")
+	errAuthenticationFailed = errors.New("authentication failed")
+	errIdleTimeout          = errors.New("idle timeout")
+)
 
 // ConsoleServer is an object that listens for telnet connection on a TCP address Addr
 // and provides a console interface to manage statsd server.
 type ConsoleServer struct {
-	Addr       string
-	Receiver   Receiver
-	Dispatcher Dispatcher
-	Flusher    Flusher
+	Addr        string
+	Receiver    Receiver
+	Dispatcher  Dispatcher
+	Flusher     Flusher
+	TapCapacity int // Capacity of the tap used by the preview command. DefaultTapCapacity is used if not positive.
+	// IdleTimeout is the time after which a connection without input is closed, no timeout if 0.
+	IdleTimeout time.Duration
+	// CommandInterval is the minimum time between runs of an expensive command, e.g. counters, by a connection.
+	// Commands are not limited if 0.
+	CommandInterval time.Duration
+	// Credentials of the users allowed to connect. Users are asked to log in at connection time
+	// unless there are no credentials.
+	Credentials Credentials
+	// AuditLogWriter receives an AuditEvent for each state-mutating command, disabled if nil.
+	AuditLogWriter io.Writer
+	// NegativeCounters is applied to counters printed by the counters command so that they are printed as flushed.
+	NegativeCounters NegativeCounterPolicy
+	// SourceKeys caps the keys of each source, printed by the sources command. Nil if keys are not capped.
+	SourceKeys *SourceKeyLimiter
+	// Cardinality counts the keys of each type, its limit and the metrics dropped because of it are printed by the
+	// cardinality command if keys are capped. May be nil.
+	Cardinality *cardinality.CardinalityTracker
+	// CloudLookups are the lookups of the cloud provider, printed by the stats command. Nil without cloud provider.
+	CloudLookups *CloudHandler
+	// StateDir is the directory of the files written by the export command and read by the import command, which
+	// are given by name only. Files are neither exported nor imported if empty.
+	StateDir string
+	// MetricSink is the pipeline of received metrics, the metrics dropped by its stages are printed by the
+	// stats json command. Nil if the receiver does not send metrics to a pipeline.
+	MetricSink MetricSink
+}
+
+// consoleClient is a user connected to the console.
+type consoleClient struct {
+	addr     string // Remote address of the connection
+	username string // Empty if authentication is disabled
+	role     Role
+}
+
+// consoleCommandRoles are the roles required to run console commands other than RoleReadOnly.
+var consoleCommandRoles = map[string]Role{
+	"delcounters": RoleAdmin,
+	"deltimers":   RoleAdmin,
+	"delgauges":   RoleAdmin,
+	"delsets":     RoleAdmin,
+	"export":      RoleAdmin,
+	"import":      RoleAdmin,
+	"flush":       RoleAdmin,
+}
+
+// auditedConsoleCommands are the console commands written to the audit log, those mutating the state and export,
+// which reads all metrics and writes files.
+var auditedConsoleCommands = map[string]bool{
+	"delcounters": true,
+	"deltimers":   true,
+	"delgauges":   true,
+	"delsets":     true,
+	"export":      true,
+	"import":      true,
+	"flush":       true,
 }
 
 // ListenAndServe listens on the ConsoleServer's TCP network address and then calls Serve.
@@ -45,29 +128,218 @@ func (s *ConsoleServer) ListenAndServe(ctx context.Context) error {
 // Serve accepts incoming connections on the listener and serves them a console interface to
 // the Dispatcher and Receiver.
 func (s *ConsoleServer) Serve(ctx context.Context, l net.Listener) error {
-	commands := map[string]cmd.CmdFn{
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConnection(ctx, c)
+	}
+}
+
+// serveConnection reads from the conn and responds to incoming requests.
+func (s *ConsoleServer) serveConnection(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	ctx, cancelFunc := context.WithCancel(ctx)
+	defer cancelFunc()
+	in, out := io.Pipe()
+	defer in.Close()
+	watch := &consoleWatch{}
+	defer func() {
+		cancelFunc()
+		_ = conn.Close() // Fails writes of the watch blocked by the client
+		watch.stop()
+	}()
+	var r io.Reader = conn
+	if s.IdleTimeout > 0 {
+		r = &idleReader{conn: conn, timeout: s.IdleTimeout, watch: watch}
+	}
+	idle := make(chan struct{}) // Closed if the connection timed out
+	go func() {
+		// Long running commands block the console loop. Connection is read in a separate goroutine
+		// to notice a disconnect and cancel the context of the command.
+		_, err := io.Copy(out, r)
+		if err == errIdleTimeout {
+			close(idle)
+		}
+		cancelFunc()
+		_ = out.CloseWithError(err)
+	}()
+
+	client := consoleClient{addr: conn.RemoteAddr().String(), role: RoleAdmin}
+	if s.Credentials.Enabled() {
+		var err error
+		if client.username, client.role, err = s.login(in, conn); err != nil {
+			if err == errIdleTimeout {
+				closeIdleConnection(conn, client)
+			} else if err != io.EOF && err != io.ErrClosedPipe {
+				log.Infof("Problem with console connection: %v", err)
+			}
+			return
+		}
+	}
+
+	session := newConsoleSession(s.CommandInterval)
+	commands := s.commands(ctx, conn, client, watch)
+	session.wrap(commands)
+	console := cmd.New(commands, in, conn)
+	console.Prompt = "console> "
+	console.Default = session.recall(console)
+	err := console.Loop()
+	select {
+	case <-idle:
+		// A command running when the connection timed out returns the error of its cancelled context
+		closeIdleConnection(conn, client)
+		return
+	default:
+	}
+	if err != nil && err != context.Canceled && err != context.DeadlineExceeded && err != errClientQuit {
+		log.Infof("Problem with console connection: %v", err)
+	}
+}
+
+// closeIdleConnection tells the client that the connection is closed because it timed out.
+func closeIdleConnection(conn net.Conn, client consoleClient) {
+	log.Debugf("Closing idle console connection from %s", client.addr)
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_, _ = io.WriteString(conn, "\nidle timeout, closing connection\n")
+}
+
+// idleReader reads from a connection and fails with errIdleTimeout if there is no input for the timeout.
+// The deadline of the connection is reset before each read, i.e. after each command. A connection running
+// a watch does not time out.
+type idleReader struct {
+	conn    net.Conn
+	timeout time.Duration
+	watch   *consoleWatch
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	for {
+		if err := r.conn.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+			return 0, err
+		}
+		n, err := r.conn.Read(p)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			if n == 0 && r.watch.running() {
+				continue
+			}
+			err = errIdleTimeout
+		}
+		return n, err
+	}
+}
+
+// login prompts for the credentials of the user in the username:password format and returns the name and
+// the role of the user.
+func (s *ConsoleServer) login(in io.Reader, out io.Writer) (string, Role, error) {
+	if _, err := io.WriteString(out, "login (username:password): "); err != nil {
+		return "", RoleNone, err
+	}
+	line, err := readLine(in)
+	if err != nil {
+		return "", RoleNone, err
+	}
+	var username string
+	var role Role
+	if parts := strings.SplitN(strings.TrimRight(line, "\r"), ":", 2); len(parts) == 2 {
+		username = parts[0]
+		role = s.Credentials.Authenticate(username, parts[1])
+	}
+	if role == RoleNone {
+		_, err = io.WriteString(out, "authentication failed\n")
+		if err == nil {
+			err = errAuthenticationFailed
+		}
+		return "", RoleNone, err
+	}
+	return username, role, nil
+}
+
+// audit writes the command run by the client to the audit log.
+func (s *ConsoleServer) audit(client consoleClient, command string, args []string, count uint32, err error) {
+	WriteAuditEvent(s.AuditLogWriter, NewAuditEvent("console", client.addr, client.username, command, args, count, err))
+}
+
+// commands returns console commands bound to the context, output and watch of a connection.
+// Commands the role of the client does not allow are replaced with an error message.
+func (s *ConsoleServer) commands(ctx context.Context, out io.Writer, client consoleClient, watch *consoleWatch) map[string]cmd.CmdFn {
+	commands := s.allCommands(ctx, out, client, watch)
+	for name := range commands {
+		required, ok := consoleCommandRoles[name]
+		if !ok {
+			required = RoleReadOnly
+		}
+		if !client.role.Allows(required) {
+			name := name
+			err := fmt.Errorf("permission denied: %s requires the %s role", name, required)
+			commands[name] = func(args []string) (string, error) {
+				if auditedConsoleCommands[name] {
+					s.audit(client, name, args, 0, err)
+				}
+				return err.Error() + "\n", nil
+			}
+		}
+	}
+	return commands
+}
+
+// allCommands returns all console commands bound to the context, output and watch of a connection.
+func (s *ConsoleServer) allCommands(ctx context.Context, out io.Writer, client consoleClient, watch *consoleWatch) map[string]cmd.CmdFn {
+	return map[string]cmd.CmdFn{
 		"help": func(args []string) (string, error) {
-			return "Commands: stats, counters, timers, gauges, delcounters, deltimers, delgauges, quit\n", nil
+			return "Commands: stats [json], counters, timers, gauges, delcounters, deltimers, delgauges, preview [duration], watch <name> <type>, q or stop, peek <name>, export [--format=json|csv] [filename], dump [type], import <filename>, flush, cardinality, payloads, sources, history, !! or !<n>, quit\n", nil
 		},
 		"stats": func(args []string) (string, error) {
+			if len(args) == 1 && args[0] == "json" {
+				return s.statsJSON()
+			}
+			if len(args) != 0 {
+				return "usage: stats [json]\n", nil
+			}
 			receiverStats := s.Receiver.GetStats()
 			flusherStats := s.Flusher.GetStats()
-			return fmt.Sprintf(
+			result := fmt.Sprintf(
 				"Invalid messages received: %d\n"+
 					"Metrics received: %d\n"+
 					"Packets received: %d\n"+
+					"Unknown fields skipped: %d\n"+
+					"Lines with empty names: %d\n"+
+					"Lines with empty values: %d\n"+
+					"Lines with empty types: %d\n"+
+					"Lines with non-numeric values: %d\n"+
+					"Lines with non-finite values: %d\n"+
+					"Lines with unknown types: %d\n"+
+					"Untyped lines accepted: %d\n"+
 					"Last packet received: %v\n"+
 					"Last flush to backends: %v\n"+
 					"Last error from backends: %v\n",
 				receiverStats.BadLines,
 				receiverStats.MetricsReceived,
 				receiverStats.PacketsReceived,
+				receiverStats.UnknownFields,
+				receiverStats.EmptyNames,
+				receiverStats.EmptyValues,
+				receiverStats.EmptyTypes,
+				receiverStats.NonNumericValues,
+				receiverStats.NonFiniteRejected,
+				receiverStats.UnknownTypes,
+				receiverStats.UntypedLines,
 				receiverStats.LastPacket,
 				flusherStats.LastFlush,
-				flusherStats.LastFlushError), nil
+				flusherStats.LastFlushError)
+			for _, q := range flusherStats.Queues {
+				result += fmt.Sprintf("Send queue of %s: %d/%d, dropped flushes: %d\n", q.Backend, q.Depth, q.Capacity, q.Dropped)
+			}
+			if s.CloudLookups != nil {
+				ls := s.CloudLookups.LookupStats()
+				result += fmt.Sprintf("Cloud lookups in flight: %d, queued: %d, dropped: %d\n", ls.InFlight, ls.Queued, ls.Dropped)
+			}
+			return result, nil
 		},
 		"counters": func(args []string) (string, error) {
-			return s.printMetrics(ctx, getCounters)
+			return s.printMetrics(ctx, s.flushedCounters)
 		},
 		"timers": func(args []string) (string, error) {
 			return s.printMetrics(ctx, getTimers)
@@ -80,60 +352,628 @@ func (s *ConsoleServer) Serve(ctx context.Context, l net.Listener) error {
 		},
 		"delcounters": func(args []string) (string, error) {
 			i := s.delete(ctx, args, getCounters)
+			s.audit(client, "delcounters", args, i, nil)
 			return fmt.Sprintf("deleted %d counters\n", i), nil
 		},
 		"deltimers": func(args []string) (string, error) {
 			i := s.delete(ctx, args, getTimers)
+			s.audit(client, "deltimers", args, i, nil)
 			return fmt.Sprintf("deleted %d timers\n", i), nil
 		},
 		"delgauges": func(args []string) (string, error) {
 			i := s.delete(ctx, args, getGauges)
+			s.audit(client, "delgauges", args, i, nil)
 			return fmt.Sprintf("deleted %d gauges\n", i), nil
 		},
 		"delsets": func(args []string) (string, error) {
 			i := s.delete(ctx, args, getSets)
+			s.audit(client, "delsets", args, i, nil)
 			return fmt.Sprintf("deleted %d sets\n", i), nil
 		},
+		"preview": func(args []string) (string, error) {
+			return s.preview(ctx, args)
+		},
+		"watch": func(args []string) (string, error) {
+			return s.startWatch(ctx, out, watch, args), nil
+		},
+		"q": func(args []string) (string, error) {
+			return stopWatch(watch), nil
+		},
+		"stop": func(args []string) (string, error) {
+			return stopWatch(watch), nil
+		},
+		"peek": func(args []string) (string, error) {
+			if len(args) != 1 {
+				return "usage: peek <name>\n", nil
+			}
+			return s.peek(ctx, args[0]), nil
+		},
+		"export": func(args []string) (string, error) {
+			return s.exportState(ctx, client, args)
+		},
+		"dump": func(args []string) (string, error) {
+			return s.dump(ctx, args)
+		},
+		"import": func(args []string) (string, error) {
+			return s.importState(ctx, client, args)
+		},
+		"flush": func(args []string) (string, error) {
+			return s.flush(ctx, client)
+		},
+		"cardinality": func(args []string) (string, error) {
+			return s.cardinality(ctx)
+		},
+		"payloads": func(args []string) (string, error) {
+			return s.payloads(), nil
+		},
+		"sources": func(args []string) (string, error) {
+			return s.sources(), nil
+		},
 		"quit": func(args []string) (string, error) {
 			return "goodbye\n", errClientQuit
 		},
 	}
+}
+
+// preview attaches a tap to the Receiver for the requested duration and prints the most active metric names.
+func (s *ConsoleServer) preview(ctx context.Context, args []string) (string, error) {
+	tapper, ok := s.Receiver.(Tapper)
+	if !ok {
+		return "preview is not supported by the receiver\n", nil
+	}
+	duration := DefaultPreviewDuration
+	if len(args) > 0 {
+		d, err := time.ParseDuration(args[0])
+		if err != nil || d <= 0 || d > maxPreviewDuration {
+			return fmt.Sprintf("invalid duration %q, must be positive and not longer than %s\n", args[0], maxPreviewDuration), nil
+		}
+		duration = d
+	}
+
+	tap := NewMetricTap(s.TapCapacity)
+	tapper.AttachTap(tap)
+	timer := time.NewTimer(duration)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+	case <-timer.C:
+	}
+	tapper.DetachTap(tap)
+
+	metrics, total := tap.Snapshot()
+	counts := make(map[string]int)
+	for _, m := range metrics {
+		counts[m.Name]++
+	}
+	sorted := make(nameCounts, 0, len(counts))
+	for name, count := range counts {
+		sorted = append(sorted, nameCount{name: name, count: count})
+	}
+	sort.Sort(sorted)
+	if len(sorted) > previewTopNames {
+		sorted = sorted[:previewTopNames]
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "Received %d metrics in %s, sampled %d, %d distinct names\n", total, duration, len(metrics), len(counts)) // #nosec
+	for _, nc := range sorted {
+		fmt.Fprintf(buf, "%s: %d\n", nc.name, nc.count) // #nosec
+	}
+	return buf.String(), nil
+}
+
+// watchValueFunc returns values of the named metric from the MetricMap by tags key.
+type watchValueFunc func(m *gostatsd.MetricMap, name string, values map[string]float64)
+
+var watchValueFuncs = map[string]watchValueFunc{
+	"counter": func(m *gostatsd.MetricMap, name string, values map[string]float64) {
+		for tagsKey, counter := range m.Counters[name] {
+			values[tagsKey] = float64(counter.Value)
+		}
+	},
+	"timer": func(m *gostatsd.MetricMap, name string, values map[string]float64) {
+		for tagsKey, timer := range m.Timers[name] {
+			values[tagsKey] = float64(timer.NumValues())
+		}
+	},
+	"gauge": func(m *gostatsd.MetricMap, name string, values map[string]float64) {
+		for tagsKey, gauge := range m.Gauges[name] {
+			values[tagsKey] = gauge.Value
+		}
+	},
+	"set": func(m *gostatsd.MetricMap, name string, values map[string]float64) {
+		for tagsKey, set := range m.Sets[name] {
+			values[tagsKey] = float64(set.Cardinality())
+		}
+	},
+}
+
+// startWatch starts watching the metric in the background of the connection, until the client runs the stop
+// command or disconnects. Only one metric is watched at a time by a connection.
+func (s *ConsoleServer) startWatch(ctx context.Context, out io.Writer, watch *consoleWatch, args []string) string {
+	if len(args) != 2 {
+		return "usage: watch <name> <counter|timer|gauge|set>\n"
+	}
+	name, metricType := args[0], args[1]
+	f, ok := watchValueFuncs[metricType]
+	if !ok {
+		return fmt.Sprintf("unknown metric type %q, must be one of counter, timer, gauge, set\n", metricType)
+	}
+	started := watch.start(ctx, func(ctx context.Context) {
+		if err := s.watch(ctx, out, name, metricType, f); err != nil && ctx.Err() == nil {
+			log.Infof("Problem with console watch: %v", err)
+		}
+	})
+	if !started {
+		return "a metric is already watched, type q to stop watching it\n"
+	}
+	return fmt.Sprintf("watching %s [%s], type q to stop\n", name, metricType)
+}
+
+// stopWatch stops the metric watched by the connection, if any.
+func stopWatch(watch *consoleWatch) string {
+	if !watch.stop() {
+		return "no watch is running\n"
+	}
+	return "stopped watching\n"
+}
+
+// watch prints the value of the metric every watchInterval until the context is done. Timers and sets are watched
+// by the number of values.
+func (s *ConsoleServer) watch(ctx context.Context, out io.Writer, name, metricType string, f watchValueFunc) error {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	var previous map[string]float64
 	for {
-		c, err := l.Accept()
-		if err != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		current := s.watchValues(ctx, name, f)
+		buf := new(bytes.Buffer)
+		if len(current) == 0 {
+			fmt.Fprintf(buf, "%s [%s]: not found\n", name, metricType) // #nosec
+		}
+		tagsKeys := make([]string, 0, len(current))
+		for tagsKey := range current {
+			tagsKeys = append(tagsKeys, tagsKey)
+		}
+		sort.Strings(tagsKeys)
+		for _, tagsKey := range tagsKeys {
+			metricName := name
+			if tagsKey != "" {
+				metricName += "{" + tagsKey + "}"
+			}
+			value := current[tagsKey]
+			fmt.Fprintf(buf, "%s [%s]: %s", metricName, metricType, strconv.FormatFloat(value, 'f', -1, 64)) // #nosec
+			if prev, ok := previous[tagsKey]; ok {
+				diff := strconv.FormatFloat(value-prev, 'f', -1, 64)
+				if value >= prev {
+					diff = "+" + diff
+				}
+				fmt.Fprintf(buf, " (%s from last)", diff) // #nosec
+			}
+			buf.WriteByte('\n')
+		}
+		if _, err := out.Write(buf.Bytes()); err != nil {
 			return err
 		}
-		go s.serveConnection(ctx, c, commands)
+		previous = current
 	}
 }
 
-// serveConnection reads from the conn and responds to incoming requests.
-func (s *ConsoleServer) serveConnection(ctx context.Context, conn net.Conn, commands map[string]cmd.CmdFn) {
-	defer conn.Close()
+func (s *ConsoleServer) watchValues(ctx context.Context, name string, f watchValueFunc) map[string]float64 {
+	var lock sync.Mutex
+	values := make(map[string]float64)
+	wg := s.Dispatcher.Process(ctx, func(workerId uint16, aggr Aggregator) {
+		aggr.Process(func(m *gostatsd.MetricMap) {
+			lock.Lock()
+			defer lock.Unlock()
+			f(m, name, values)
+		})
+	})
+	wg.Wait() // Wait for all workers to execute function
+	return values
+}
 
-	console := cmd.New(commands, conn, conn)
-	console.Prompt = "console> "
-	if err := console.Loop(); err != nil && err != context.Canceled && err != context.DeadlineExceeded && err != errClientQuit {
-		log.Infof("Problem with console connection: %v", err)
+// consoleWatch is the watch command running in the background of a console connection, if any.
+type consoleWatch struct {
+	mu         sync.Mutex
+	cancelFunc context.CancelFunc // Stops the running watch, nil if none is running
+	done       chan struct{}      // Closed when the running watch returned
+}
+
+// start runs the watch in a goroutine unless one is already running.
+func (w *consoleWatch) start(ctx context.Context, run func(ctx context.Context)) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cancelFunc != nil {
+		return false
 	}
+	ctx, cancelFunc := context.WithCancel(ctx)
+	done := make(chan struct{})
+	w.cancelFunc, w.done = cancelFunc, done
+	go func() {
+		defer close(done)
+		defer cancelFunc()
+		run(ctx)
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.done == done {
+			w.cancelFunc, w.done = nil, nil
+		}
+	}()
+	return true
 }
 
-func (s *ConsoleServer) delete(ctx context.Context, keys []string, f mapperFunc) uint32 {
-	var counter uint32
+// stop stops the running watch and waits for it to return. It returns false if no watch is running.
+func (w *consoleWatch) stop() bool {
+	w.mu.Lock()
+	cancelFunc, done := w.cancelFunc, w.done
+	w.cancelFunc, w.done = nil, nil
+	w.mu.Unlock()
+	if cancelFunc == nil {
+		return false
+	}
+	cancelFunc()
+	<-done
+	return true
+}
+
+// running returns true if a watch is running.
+func (w *consoleWatch) running() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.cancelFunc != nil
+}
+
+// peek prints the aggregated state of the metric of each type and tags with the exact name. Metrics of all
+// workers are merged, timers are summarized from their values.
+func (s *ConsoleServer) peek(ctx context.Context, name string) string {
+	var lock sync.Mutex
+	merged := newMetricMap()
 	wg := s.Dispatcher.Process(ctx, func(workerId uint16, aggr Aggregator) {
 		aggr.Process(func(m *gostatsd.MetricMap) {
-			metrics := f(m)
-			var i uint32
-			for _, k := range keys {
-				metrics.Delete(k)
-				i++
+			named := newMetricMap()
+			if v, ok := m.Counters[name]; ok {
+				named.Counters[name] = v
+			}
+			if v, ok := m.Timers[name]; ok {
+				named.Timers[name] = v
+			}
+			if v, ok := m.Gauges[name]; ok {
+				named.Gauges[name] = v
 			}
-			atomic.AddUint32(&counter, i)
+			if v, ok := m.Sets[name]; ok {
+				named.Sets[name] = v
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			mergeMetricMap(merged, named) // Copies the metrics, they must not be used after Process returns
+		})
+	})
+	wg.Wait() // Wait for all workers to execute function
+
+	formatFloat := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	counters := make(map[string]string)
+	merged.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		counters[tagsKey] = strconv.FormatInt(counter.Value, 10)
+	})
+	timers := make(map[string]string)
+	merged.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		summarizeTimer(&timer)
+		timers[tagsKey] = fmt.Sprintf("count=%d min=%s max=%s mean=%s median=%s",
+			timer.Count, formatFloat(timer.Min), formatFloat(timer.Max), formatFloat(timer.Mean), formatFloat(timer.Median))
+	})
+	gauges := make(map[string]string)
+	merged.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		gauges[tagsKey] = formatFloat(gauge.Value)
+	})
+	sets := make(map[string]string)
+	merged.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+		sets[tagsKey] = strconv.Itoa(set.Cardinality())
+	})
+	buf := new(bytes.Buffer)
+	writePeeked(buf, name, gostatsd.COUNTER, counters)
+	writePeeked(buf, name, gostatsd.TIMER, timers)
+	writePeeked(buf, name, gostatsd.GAUGE, gauges)
+	writePeeked(buf, name, gostatsd.SET, sets)
+	if buf.Len() == 0 {
+		return fmt.Sprintf("%s: not found\n", name)
+	}
+	return buf.String()
+}
+
+// writePeeked writes a line per tags key with the value of the metric of the type, sorted by tags key.
+func writePeeked(buf *bytes.Buffer, name string, metricType gostatsd.MetricType, values map[string]string) {
+	tagsKeys := make([]string, 0, len(values))
+	for tagsKey := range values {
+		tagsKeys = append(tagsKeys, tagsKey)
+	}
+	sort.Strings(tagsKeys)
+	for _, tagsKey := range tagsKeys {
+		metricName := name
+		if tagsKey != "" {
+			metricName += "{" + tagsKey + "}"
+		}
+		fmt.Fprintf(buf, "%s [%s]: %s\n", metricName, metricType, values[tagsKey]) // #nosec
+	}
+}
+
+// readLine reads a line from the reader one byte at a time to avoid consuming input after the line.
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if err != nil {
+			return string(line), err
+		}
+		if n == 0 {
+			continue
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+}
+
+// exportState writes the state of all aggregators to the file in StateDir or to the console if no file name is
+// provided.
+// The state is written as JSON that can be imported, or as CSV with --format=csv.
+func (s *ConsoleServer) exportState(ctx context.Context, client consoleClient, args []string) (string, error) {
+	auditArgs := args
+	write := WriteMetricState
+	if len(args) > 0 && strings.HasPrefix(args[0], exportFormatFlag) {
+		switch format := strings.TrimPrefix(args[0], exportFormatFlag); format {
+		case "json":
+		case "csv":
+			write = func(w io.Writer, m *gostatsd.MetricMap) error {
+				return m.MarshalCSV(w, nil)
+			}
+		default:
+			return fmt.Sprintf("unknown export format %q, must be one of json, csv\n", format), nil
+		}
+		args = args[1:]
+	}
+	m, err := Snapshot(ctx, s.Dispatcher)
+	if err != nil {
+		s.audit(client, "export", auditArgs, 0, err)
+		return "", err
+	}
+	if len(args) == 0 {
+		buf := new(bytes.Buffer)
+		err := write(buf, m)
+		s.audit(client, "export", auditArgs, m.NumStats, err)
+		if err != nil {
+			return fmt.Sprintf("failed to export metrics: %v\n", err), nil
+		}
+		return buf.String(), nil
+	}
+	path, err := s.statePath(args[0])
+	if err != nil {
+		s.audit(client, "export", auditArgs, 0, err)
+		return fmt.Sprintf("failed to export metrics: %v\n", err), nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		s.audit(client, "export", auditArgs, 0, err)
+		return fmt.Sprintf("failed to export metrics: %v\n", err), nil
+	}
+	err = write(f, m)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	s.audit(client, "export", auditArgs, m.NumStats, err)
+	if err != nil {
+		return fmt.Sprintf("failed to export metrics: %v\n", err), nil
+	}
+	return fmt.Sprintf("exported metrics to %s\n", args[0]), nil
+}
+
+// dumpTypes are the metric types the dump console command can be limited to.
+var dumpTypes = map[string]gostatsd.MetricType{
+	"counter": gostatsd.COUNTER,
+	"timer":   gostatsd.TIMER,
+	"gauge":   gostatsd.GAUGE,
+	"set":     gostatsd.SET,
+}
+
+// dump prints the current values of the metrics of the type, or of all types if none is given, as statsd lines
+// that can be sent to another server to migrate the state. See gostatsd.MetricMap.MarshalLines.
+func (s *ConsoleServer) dump(ctx context.Context, args []string) (string, error) {
+	if len(args) > 1 {
+		return "usage: dump [counter|timer|gauge|set]\n", nil
+	}
+	var types []gostatsd.MetricType
+	if len(args) == 1 {
+		t, ok := dumpTypes[args[0]]
+		if !ok {
+			return fmt.Sprintf("unknown metric type %q, must be one of counter, timer, gauge, set\n", args[0]), nil
+		}
+		types = []gostatsd.MetricType{t}
+	}
+	m, err := Snapshot(ctx, s.Dispatcher)
+	if err != nil {
+		return "", err
+	}
+	buf := new(bytes.Buffer)
+	if err := m.MarshalLines(buf, types); err != nil {
+		return fmt.Sprintf("failed to dump metrics: %v\n", err), nil
+	}
+	return buf.String(), nil
+}
+
+// statePath returns the path of the file with the name in StateDir. Names with path separators or .. are rejected
+// so that clients cannot read or write files outside of StateDir.
+func (s *ConsoleServer) statePath(name string) (string, error) {
+	if s.StateDir == "" {
+		return "", errors.New("files are not exported or imported without a console state directory")
+	}
+	if name == "" || name == "." || strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") {
+		return "", fmt.Errorf("invalid file name %q, must not contain path separators or ..", name)
+	}
+	return filepath.Join(s.StateDir, name), nil
+}
+
+// importState seeds aggregators with the state read from the file in StateDir.
+func (s *ConsoleServer) importState(ctx context.Context, client consoleClient, args []string) (string, error) {
+	if len(args) != 1 {
+		return "usage: import <filename>\n", nil
+	}
+	path, err := s.statePath(args[0])
+	if err != nil {
+		s.audit(client, "import", args, 0, err)
+		return fmt.Sprintf("failed to import metrics: %v\n", err), nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		s.audit(client, "import", args, 0, err)
+		return fmt.Sprintf("failed to import metrics: %v\n", err), nil
+	}
+	defer f.Close()
+	m, err := ReadMetricState(f)
+	if err != nil {
+		s.audit(client, "import", args, 0, err)
+		return fmt.Sprintf("failed to import metrics: %v\n", err), nil
+	}
+	n, err := SeedMetricState(ctx, s.Dispatcher, m)
+	s.audit(client, "import", args, uint32(n), err)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("imported %d metrics from %s\n", n, args[0]), nil
+}
+
+// flush flushes metrics to backends without waiting for the flush interval.
+func (s *ConsoleServer) flush(ctx context.Context, client consoleClient) (string, error) {
+	flusher, ok := s.Flusher.(ForceFlusher)
+	if !ok {
+		return "flush is not supported by the flusher\n", nil
+	}
+	result, err := flusher.ForceFlush(ctx)
+	if err != nil {
+		s.audit(client, "flush", nil, 0, err)
+		return "", err
+	}
+	s.audit(client, "flush", nil, result.NumStats, result.Err)
+	if result.Err != nil {
+		return fmt.Sprintf("flushed %d metrics, backend error: %v\n", result.NumStats, result.Err), nil
+	}
+	return fmt.Sprintf("flushed %d metrics\n", result.NumStats), nil
+}
+
+// cardinality prints the numbers of distinct keys per type aggregated since the last flush, including keys that
+// have not expired yet, followed by the limit and the number of metrics dropped because of it if keys are capped.
+func (s *ConsoleServer) cardinality(ctx context.Context) (string, error) {
+	var lock sync.Mutex
+	var keys gostatsd.KeyCounts
+	wg := s.Dispatcher.Process(ctx, func(workerId uint16, aggr Aggregator) {
+		aggr.Process(func(m *gostatsd.MetricMap) {
+			k := countKeys(m)
+			lock.Lock()
+			defer lock.Unlock()
+			keys.Add(k)
 		})
 	})
 	wg.Wait() // Wait for all workers to execute function
+	out := fmt.Sprintf(
+		"Counters: %d\n"+
+			"Timers: %d\n"+
+			"Gauges: %d\n"+
+			"Sets: %d\n"+
+			"Total: %d\n",
+		keys.Counters, keys.Timers, keys.Gauges, keys.Sets, keys.Total())
+	if s.Cardinality != nil && s.Cardinality.Limit() > 0 {
+		_, dropped := s.Cardinality.Stats()
+		out += fmt.Sprintf("Limit: %d\nDropped: %d\n", s.Cardinality.Limit(), dropped)
+	}
+	return out, nil
+}
 
-	return counter
+// consoleStats is the JSON object printed by the stats json command.
+type consoleStats struct {
+	Receiver ReceiverStats `json:"receiver"`
+	Pipeline SinkStats     `json:"pipeline"`
+	Flusher  FlusherStats  `json:"flusher"`
+}
+
+// statsJSON prints the statistics of the receiver, the pipeline of received metrics and the flusher as a JSON
+// object for tooling.
+func (s *ConsoleServer) statsJSON() (string, error) {
+	data, err := json.Marshal(consoleStats{
+		Receiver: s.Receiver.GetStats(),
+		Pipeline: PipelineStats(s.MetricSink),
+		Flusher:  s.Flusher.GetStats(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(data) + "\n", nil
+}
+
+// payloads prints histograms of sizes of payloads serialized by backends since the start.
+func (s *ConsoleServer) payloads() string {
+	stats := s.Flusher.GetStats().Payloads
+	if len(stats) == 0 {
+		return "no payloads recorded\n"
+	}
+	buf := new(bytes.Buffer)
+	for _, ps := range stats {
+		fmt.Fprintf(buf, "%s: payloads=%d min=%d max=%d mean=%.1f p99=%d\n", ps.Backend, ps.Count, ps.Min, ps.Max, ps.Mean(), ps.Percentile(99)) // #nosec
+		for i, count := range ps.Counts {
+			if i < len(ps.Bounds) {
+				fmt.Fprintf(buf, "  <= %d: %d\n", ps.Bounds[i], count) // #nosec
+			} else {
+				fmt.Fprintf(buf, "  > %d: %d\n", ps.Bounds[len(ps.Bounds)-1], count) // #nosec
+			}
+		}
+	}
+	return buf.String()
+}
+
+// sources prints the number of keys of each source and the number of metrics dropped because it has too many.
+func (s *ConsoleServer) sources() string {
+	if s.SourceKeys == nil {
+		return "keys of sources are not capped\n"
+	}
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "Maximum keys per source: %d\n", s.SourceKeys.MaxKeys()) // #nosec
+	for _, ss := range s.SourceKeys.Stats() {
+		fmt.Fprintf(buf, "%s: keys=%d dropped=%d\n", ss.Source, ss.Keys, ss.Dropped) // #nosec
+	}
+	return buf.String()
+}
+
+type nameCount struct {
+	name  string
+	count int
+}
+
+// nameCounts sorts by count in descending order, then by name.
+type nameCounts []nameCount
+
+func (n nameCounts) Len() int {
+	return len(n)
+}
+
+func (n nameCounts) Less(i, j int) bool {
+	if n[i].count == n[j].count {
+		return n[i].name < n[j].name
+	}
+	return n[i].count > n[j].count
+}
+
+func (n nameCounts) Swap(i, j int) {
+	n[i], n[j] = n[j], n[i]
+}
+
+func (s *ConsoleServer) delete(ctx context.Context, keys []string, f mapperFunc) uint32 {
+	return deleteNames(ctx, s.Dispatcher, f, keys)
 }
 
 type mapperFunc func(*gostatsd.MetricMap) gostatsd.AggregatedMetrics
@@ -162,6 +1002,28 @@ func (s *ConsoleServer) printMetrics(ctx context.Context, f mapperFunc) (string,
 	return buf.String(), nil
 }
 
+// flushedCounters returns counters with the negative counter policy applied.
+func (s *ConsoleServer) flushedCounters(m *gostatsd.MetricMap) gostatsd.AggregatedMetrics {
+	if s.NegativeCounters == NegativeCountersAllow {
+		return m.Counters
+	}
+	counters := make(gostatsd.Counters, len(m.Counters))
+	m.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		value, ok := s.NegativeCounters.apply(counter.Value)
+		if !ok {
+			return
+		}
+		counter.Value = value
+		v, ok := counters[key]
+		if !ok {
+			v = make(map[string]gostatsd.Counter)
+			counters[key] = v
+		}
+		v[tagsKey] = counter
+	})
+	return counters
+}
+
 func getCounters(m *gostatsd.MetricMap) gostatsd.AggregatedMetrics {
 	return m.Counters
 }
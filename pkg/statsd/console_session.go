@@ -0,0 +1,132 @@
+package statsd
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kisielk/cmd"
+)
+
+const (
+	// DefaultConsoleCommandInterval is the default minimum time between runs of an expensive console command
+	// by a connection.
+	DefaultConsoleCommandInterval = 1 * time.Second
+	// consoleHistorySize is the number of commands kept in the history of a console connection.
+	consoleHistorySize = 20
+)
+
+// expensiveConsoleCommands are the console commands that go through all aggregated metrics and are rate limited.
+var expensiveConsoleCommands = map[string]bool{
+	"counters":    true,
+	"timers":      true,
+	"gauges":      true,
+	"sets":        true,
+	"export":      true,
+	"cardinality": true,
+}
+
+// consoleSession is the state of a console connection: the history of its commands and when its expensive
+// commands were last run. Commands of a connection run sequentially so it is not safe for concurrent use.
+type consoleSession struct {
+	interval time.Duration        // Minimum time between runs of an expensive command, not limited if 0
+	history  []string             // Last consoleHistorySize commands, oldest first
+	count    int                  // Number of commands run, the number of the last command in the history
+	lastRun  map[string]time.Time // When each expensive command last ran
+	now      func() time.Time
+}
+
+func newConsoleSession(interval time.Duration) *consoleSession {
+	return &consoleSession{
+		interval: interval,
+		lastRun:  make(map[string]time.Time),
+		now:      time.Now,
+	}
+}
+
+// wrap records commands in the history and rate limits the expensive ones. It adds the history command.
+func (cs *consoleSession) wrap(commands map[string]cmd.CmdFn) {
+	commands["history"] = func(args []string) (string, error) {
+		return cs.printHistory(), nil
+	}
+	for name, fn := range commands {
+		name, fn := name, fn
+		commands[name] = func(args []string) (string, error) {
+			cs.record(strings.Join(append([]string{name}, args...), " "))
+			if !cs.allow(name) {
+				return fmt.Sprintf("%s was run less than %s ago, please try again later\n", name, cs.interval), nil
+			}
+			return fn(args)
+		}
+	}
+}
+
+// recall returns the Default function of the console which runs commands of the history: !! runs the last
+// command and !<n> the command with the number n printed by the history command.
+func (cs *consoleSession) recall(console *cmd.Cmd) func(line string) (string, error) {
+	return func(line string) (string, error) {
+		fields := strings.Fields(line)
+		if !strings.HasPrefix(fields[0], "!") {
+			return fmt.Sprintf("unrecognized command: %s\n", fields[0]), nil
+		}
+		command, ok := cs.lookup(fields[0][1:])
+		if !ok {
+			return fmt.Sprintf("%s: command not found in history\n", fields[0]), nil
+		}
+		tokens := strings.Fields(command)
+		fn := console.Commands[tokens[0]]
+		if fn == nil {
+			return fmt.Sprintf("unrecognized command: %s\n", tokens[0]), nil
+		}
+		console.LastLine = command
+		return fn(tokens[1:])
+	}
+}
+
+// lookup returns the command of the history referenced by !! (ref is "!") or !<n>.
+func (cs *consoleSession) lookup(ref string) (string, bool) {
+	n := cs.count
+	if ref != "!" {
+		var err error
+		if n, err = strconv.Atoi(ref); err != nil {
+			return "", false
+		}
+	}
+	i := len(cs.history) - 1 - (cs.count - n)
+	if i < 0 || i >= len(cs.history) {
+		return "", false
+	}
+	return cs.history[i], true
+}
+
+func (cs *consoleSession) record(command string) {
+	cs.count++
+	cs.history = append(cs.history, command)
+	if len(cs.history) > consoleHistorySize {
+		cs.history = cs.history[1:]
+	}
+}
+
+// allow returns whether the command can run now and records the run of an expensive command.
+func (cs *consoleSession) allow(name string) bool {
+	if cs.interval <= 0 || !expensiveConsoleCommands[name] {
+		return true
+	}
+	now := cs.now()
+	if last, ok := cs.lastRun[name]; ok && now.Sub(last) < cs.interval {
+		return false
+	}
+	cs.lastRun[name] = now
+	return true
+}
+
+func (cs *consoleSession) printHistory() string {
+	buf := new(bytes.Buffer)
+	first := cs.count - len(cs.history) + 1
+	for i, command := range cs.history {
+		fmt.Fprintf(buf, "%d: %s\n", first+i, command) // #nosec
+	}
+	return buf.String()
+}
@@ -0,0 +1,53 @@
+package statsd
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsoleSessionAllow(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1000, 0)
+	cs := newConsoleSession(time.Second)
+	cs.now = func() time.Time {
+		return now
+	}
+	assert.True(t, cs.allow("counters"))
+	assert.False(t, cs.allow("counters"))
+	assert.True(t, cs.allow("timers"))
+	assert.True(t, cs.allow("help"))
+	assert.True(t, cs.allow("help"))
+	now = now.Add(999 * time.Millisecond)
+	assert.False(t, cs.allow("counters"))
+	now = now.Add(time.Millisecond)
+	assert.True(t, cs.allow("counters"))
+
+	cs = newConsoleSession(0)
+	assert.True(t, cs.allow("counters"))
+	assert.True(t, cs.allow("counters"))
+}
+
+func TestConsoleSessionHistory(t *testing.T) {
+	t.Parallel()
+	cs := newConsoleSession(0)
+	for i := 1; i <= consoleHistorySize+5; i++ {
+		cs.record(fmt.Sprintf("command %d", i))
+	}
+	assert.Len(t, cs.history, consoleHistorySize)
+	_, ok := cs.lookup("5")
+	assert.False(t, ok) // Evicted
+	command, ok := cs.lookup("6")
+	assert.True(t, ok)
+	assert.Equal(t, "command 6", command)
+	command, ok = cs.lookup("!")
+	assert.True(t, ok)
+	assert.Equal(t, fmt.Sprintf("command %d", consoleHistorySize+5), command)
+	_, ok = cs.lookup(fmt.Sprintf("%d", consoleHistorySize+6))
+	assert.False(t, ok)
+	_, ok = cs.lookup("x")
+	assert.False(t, ok)
+	assert.Contains(t, cs.printHistory(), "6: command 6\n")
+}
@@ -0,0 +1,920 @@
+package statsd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/fakesocket"
+	"github.com/atlassian/gostatsd/pkg/statsd/cardinality"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+const consolePrompt = "console> "
+
+// startConsole starts the ConsoleServer on a random port and returns a connected client.
+func startConsole(t *testing.T, ctx context.Context, cs *ConsoleServer) (net.Conn, *bufio.Reader) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	go cs.Serve(ctx, l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	r := bufio.NewReader(conn)
+	readConsoleOutput(t, r) // Initial prompt
+	return conn, r
+}
+
+// readConsoleOutput reads the output of a command until the next prompt.
+func readConsoleOutput(t *testing.T, r *bufio.Reader) string {
+	var buf []byte
+	for !strings.HasSuffix(string(buf), consolePrompt) {
+		b, err := r.ReadByte()
+		require.NoError(t, err)
+		buf = append(buf, b)
+	}
+	return strings.TrimSuffix(string(buf), consolePrompt)
+}
+
+// readConsoleLine reads a line printed by the console outside of a command, e.g. by a watch.
+func readConsoleLine(t *testing.T, r *bufio.Reader) string {
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	return line
+}
+
+func consoleCommand(t *testing.T, conn net.Conn, r *bufio.Reader, line string) string {
+	_, err := fmt.Fprintln(conn, line)
+	require.NoError(t, err)
+	return readConsoleOutput(t, r)
+}
+
+// feedReceiver sends metrics with 25 names to the receiver until the context is done.
+// Metric metric.<i> is sent i+1 times per round.
+func feedReceiver(ctx context.Context, mr *MetricReceiver) {
+	for {
+		for i := 0; i < 25; i++ {
+			for j := 0; j <= i; j++ {
+				_ = mr.handlePacket(ctx, fakesocket.FakeAddr, []byte(fmt.Sprintf("metric.%d:1|c", i)))
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestConsolePreview(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	mr := NewMetricReceiver("", nopHandler{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		feedReceiver(ctx, mr)
+	}()
+	conn, r := startConsole(t, ctx, &ConsoleServer{Receiver: mr, TapCapacity: 100000})
+	defer conn.Close()
+
+	out := consoleCommand(t, conn, r, "preview")
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	assert.Contains(t, lines[0], " in 1s, ")
+	assert.Contains(t, lines[0], ", 25 distinct names")
+	require.Len(t, lines, previewTopNames+1)
+	assert.True(t, strings.HasPrefix(lines[1], "metric.24: "), lines[1])
+	assert.True(t, strings.HasPrefix(lines[previewTopNames], "metric.5: "), lines[previewTopNames])
+
+	out = consoleCommand(t, conn, r, "preview 10ms")
+	assert.Contains(t, out, " in 10ms, ")
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestConsolePreviewInvalidDuration(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	conn, r := startConsole(t, ctx, &ConsoleServer{Receiver: NewMetricReceiver("", nopHandler{})})
+	defer conn.Close()
+
+	for _, arg := range []string{"abc", "-1s", "0", "2m"} {
+		out := consoleCommand(t, conn, r, "preview "+arg)
+		assert.Equal(t, fmt.Sprintf("invalid duration %q, must be positive and not longer than 1m0s\n", arg), out)
+	}
+}
+
+func TestConsolePreviewClientDisconnect(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	mr := NewMetricReceiver("", nopHandler{})
+	conn, _ := startConsole(t, ctx, &ConsoleServer{Receiver: mr, TapCapacity: 100000})
+
+	_, err := fmt.Fprintln(conn, "preview 1m")
+	require.NoError(t, err)
+	for i := 0; i < 100 && len(mr.taps.get()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Len(t, mr.taps.get(), 1)
+	require.NoError(t, conn.Close())
+	for i := 0; i < 100 && len(mr.taps.get()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Empty(t, mr.taps.get())
+}
+
+func TestConsoleWatch(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	d := NewMetricDispatcher(2, 10, &agrFactory{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	conn, r := startConsole(t, ctx, &ConsoleServer{Dispatcher: d})
+	defer conn.Close()
+
+	assert.Equal(t, "usage: watch <name> <counter|timer|gauge|set>\n", consoleCommand(t, conn, r, "watch foo.bar"))
+	assert.Equal(t, "unknown metric type \"histogram\", must be one of counter, timer, gauge, set\n", consoleCommand(t, conn, r, "watch foo.bar histogram"))
+
+	require.NoError(t, d.DispatchMetric(ctx, &gostatsd.Metric{Name: "foo.bar", Type: gostatsd.COUNTER, Value: 1234}))
+	assert.Equal(t, "watching foo.bar [counter], type q to stop\n", consoleCommand(t, conn, r, "watch foo.bar counter"))
+	assert.Equal(t, "foo.bar [counter]: 1234\n", readConsoleLine(t, r))
+	// Commands are run while the metric is watched
+	assert.Equal(t, "a metric is already watched, type q to stop watching it\n", consoleCommand(t, conn, r, "watch foo.baz gauge"))
+	require.NoError(t, d.DispatchMetric(ctx, &gostatsd.Metric{Name: "foo.bar", Type: gostatsd.COUNTER, Value: 56}))
+	assert.Equal(t, "foo.bar [counter]: 1290 (+56 from last)\n", readConsoleLine(t, r))
+	assert.Equal(t, "stopped watching\n", consoleCommand(t, conn, r, "q"))
+	assert.Equal(t, "no watch is running\n", consoleCommand(t, conn, r, "q"))
+	// stop is an alias of q
+	assert.Equal(t, "watching foo.bar [counter], type q to stop\n", consoleCommand(t, conn, r, "watch foo.bar counter"))
+	assert.Equal(t, "foo.bar [counter]: 1290\n", readConsoleLine(t, r))
+	assert.Equal(t, "stopped watching\n", consoleCommand(t, conn, r, "stop"))
+	assert.Equal(t, "no watch is running\n", consoleCommand(t, conn, r, "stop"))
+	_, err := fmt.Fprintln(conn, "quit")
+	require.NoError(t, err)
+	assert.Equal(t, "goodbye\n", readConsoleLine(t, r))
+
+	cancelFunc()
+	wg.Wait()
+}
+
+// serveConsolePipe serves the console to a connection over a pipe and returns the client end of the pipe and
+// a channel closed when the connection is closed.
+func serveConsolePipe(t *testing.T, ctx context.Context, cs *ConsoleServer) (net.Conn, *bufio.Reader, chan struct{}) {
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cs.serveConnection(ctx, server)
+	}()
+	r := bufio.NewReader(client)
+	readConsoleOutput(t, r) // Initial prompt
+	return client, r, done
+}
+
+func TestConsoleWatchDisconnect(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	d := NewMetricDispatcher(1, 10, &agrFactory{})
+	go d.Run(ctx)
+	conn, r, done := serveConsolePipe(t, ctx, &ConsoleServer{Dispatcher: d})
+
+	assert.Equal(t, "watching foo.bar [counter], type q to stop\n", consoleCommand(t, conn, r, "watch foo.bar counter"))
+	require.NoError(t, conn.Close())
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch was not stopped by the disconnect")
+	}
+}
+
+func TestConsoleWatchIdleTimeout(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	d := NewMetricDispatcher(1, 10, &agrFactory{})
+	go d.Run(ctx)
+	cs := &ConsoleServer{Dispatcher: d, IdleTimeout: 50 * time.Millisecond}
+	conn, r, done := serveConsolePipe(t, ctx, cs)
+	defer conn.Close()
+
+	assert.Equal(t, "watching foo.bar [counter], type q to stop\n", consoleCommand(t, conn, r, "watch foo.bar counter"))
+	assert.Equal(t, "foo.bar [counter]: not found\n", readConsoleLine(t, r)) // Not closed while the metric is watched
+	assert.Equal(t, "stopped watching\n", consoleCommand(t, conn, r, "stop"))
+	out, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "\nidle timeout, closing connection\n", string(out))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed")
+	}
+}
+
+func TestConsolePeek(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	d := NewMetricDispatcher(2, 10, &agrFactory{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	conn, r := startConsole(t, ctx, &ConsoleServer{Dispatcher: d})
+	defer conn.Close()
+
+	assert.Equal(t, "usage: peek <name>\n", consoleCommand(t, conn, r, "peek"))
+	assert.Equal(t, "foo.bar: not found\n", consoleCommand(t, conn, r, "peek foo.bar"))
+
+	for _, m := range []*gostatsd.Metric{
+		{Name: "foo.bar", Type: gostatsd.COUNTER, Value: 3},
+		{Name: "foo.bar", Type: gostatsd.COUNTER, Value: 4},
+		{Name: "foo.bar", Type: gostatsd.COUNTER, Value: 5, Tags: gostatsd.Tags{"env:prod"}},
+		{Name: "foo.bar", Type: gostatsd.TIMER, Value: 1},
+		{Name: "foo.bar", Type: gostatsd.TIMER, Value: 4},
+		{Name: "foo.bar", Type: gostatsd.TIMER, Value: 10},
+		{Name: "foo.bar", Type: gostatsd.GAUGE, Value: 1.5},
+		{Name: "foo.bar", Type: gostatsd.SET, StringValue: "joe"},
+		{Name: "foo.bar", Type: gostatsd.SET, StringValue: "bob"},
+		{Name: "foo.baz", Type: gostatsd.COUNTER, Value: 1},
+	} {
+		require.NoError(t, d.DispatchMetric(ctx, m))
+	}
+	waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+		return len(snapshot.Sets["foo.bar"]) == 1 && len(snapshot.Sets["foo.bar"][""].Values) == 2 && len(snapshot.Counters["foo.baz"]) == 1
+	})
+
+	assert.Equal(t, "foo.bar [counter]: 7\n"+
+		"foo.bar{env:prod} [counter]: 5\n"+
+		"foo.bar [timer]: count=3 min=1 max=10 mean=5 median=4\n"+
+		"foo.bar [gauge]: 1.5\n"+
+		"foo.bar [set]: 2\n", consoleCommand(t, conn, r, "peek foo.bar"))
+	assert.Equal(t, "foo.baz [counter]: 1\n", consoleCommand(t, conn, r, "peek foo.baz"))
+	assert.Equal(t, "foo: not found\n", consoleCommand(t, conn, r, "peek foo"))
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestConsoleExportImport(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	d1 := NewMetricDispatcher(2, 10, &agrFactory{})
+	d2 := NewMetricDispatcher(3, 10, &agrFactory{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	for _, d := range []*MetricDispatcher{d1, d2} {
+		go func(d *MetricDispatcher) {
+			defer wg.Done()
+			assert.Equal(t, context.Canceled, d.Run(ctx))
+		}(d)
+	}
+	dir, err := ioutil.TempDir("", "gostatsd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	conn1, r1 := startConsole(t, ctx, &ConsoleServer{Dispatcher: d1, StateDir: dir})
+	defer conn1.Close()
+	conn2, r2 := startConsole(t, ctx, &ConsoleServer{Dispatcher: d2, StateDir: dir})
+	defer conn2.Close()
+
+	require.NoError(t, d1.DispatchMetric(ctx, &gostatsd.Metric{Name: "foo.bar", Type: gostatsd.COUNTER, Value: 12}))
+	waitForSnapshot(t, ctx, d1, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.NumStats == 1
+	})
+
+	assert.Contains(t, consoleCommand(t, conn1, r1, "export"), `"version": 1`)
+	assert.Equal(t, "exported metrics to state.json\n", consoleCommand(t, conn1, r1, "export state.json"))
+	assert.FileExists(t, filepath.Join(dir, "state.json"))
+	assert.Equal(t, "usage: import <filename>\n", consoleCommand(t, conn2, r2, "import"))
+	assert.Equal(t, "imported 1 metrics from state.json\n", consoleCommand(t, conn2, r2, "import state.json"))
+
+	snapshot := waitForSnapshot(t, ctx, d2, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.NumStats == 1
+	})
+	assert.Equal(t, int64(12), snapshot.Counters["foo.bar"][""].Value)
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestConsoleExportImportOutsideStateDir(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	d := NewMetricDispatcher(1, 10, &agrFactory{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	dir, err := ioutil.TempDir("", "gostatsd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	conn, r := startConsole(t, ctx, &ConsoleServer{Dispatcher: d, StateDir: filepath.Join(dir, "state")})
+	defer conn.Close()
+	connNoDir, rNoDir := startConsole(t, ctx, &ConsoleServer{Dispatcher: d})
+	defer connNoDir.Close()
+
+	for _, name := range []string{"../state.json", filepath.Join(dir, "state.json"), "a/b", `a\b`, "..", "."} {
+		assert.Equal(t, fmt.Sprintf("failed to export metrics: invalid file name %q, must not contain path separators or ..\n", name), consoleCommand(t, conn, r, "export "+name))
+		assert.Equal(t, fmt.Sprintf("failed to import metrics: invalid file name %q, must not contain path separators or ..\n", name), consoleCommand(t, conn, r, "import "+name))
+	}
+	assert.Equal(t, "failed to export metrics: files are not exported or imported without a console state directory\n", consoleCommand(t, connNoDir, rNoDir, "export state.json"))
+	assert.Equal(t, "failed to import metrics: files are not exported or imported without a console state directory\n", consoleCommand(t, connNoDir, rNoDir, "import state.json"))
+	assert.Equal(t, "failed to export metrics: files are not exported or imported without a console state directory\n", consoleCommand(t, connNoDir, rNoDir, "export --format=csv state.csv"))
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestConsoleExportCSV(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	d := NewMetricDispatcher(1, 10, &agrFactory{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	conn, r := startConsole(t, ctx, &ConsoleServer{Dispatcher: d})
+	defer conn.Close()
+
+	require.NoError(t, d.DispatchMetric(ctx, &gostatsd.Metric{Name: "foo.bar", Type: gostatsd.GAUGE, Value: 1.5, Tags: gostatsd.Tags{"a:b", "c"}}))
+	waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.NumStats == 1
+	})
+
+	records, err := csv.NewReader(strings.NewReader(consoleCommand(t, conn, r, "export --format=csv"))).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, []string{"name", "type", "value", "tags", "timestamp"}, records[0])
+	assert.Equal(t, []string{"foo.bar", "gauge", "1.5", "a:b,c"}, records[1][:4])
+	assert.Equal(t, "unknown export format \"xml\", must be one of json, csv\n", consoleCommand(t, conn, r, "export --format=xml"))
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestConsoleDump(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	d := NewMetricDispatcher(1, 10, &agrFactory{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	conn, r := startConsole(t, ctx, &ConsoleServer{Dispatcher: d})
+	defer conn.Close()
+
+	metrics := []gostatsd.Metric{
+		{Name: "foo.bar", Type: gostatsd.COUNTER, Value: 42},
+		{Name: "foo.bar", Type: gostatsd.TIMER, Value: 1.5, Tags: gostatsd.Tags{"a:b"}},
+		{Name: "foo.bar", Type: gostatsd.TIMER, Value: 3, Tags: gostatsd.Tags{"a:b"}},
+		{Name: "foo.gauge", Type: gostatsd.GAUGE, Value: -7},
+		{Name: "foo.set", Type: gostatsd.SET, StringValue: "joe"},
+	}
+	for _, m := range metrics {
+		m := m // Dispatched metrics are reused
+		require.NoError(t, d.DispatchMetric(ctx, &m))
+	}
+	waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.NumStats == uint32(len(metrics))
+	})
+
+	assert.Equal(t, "foo.bar:42|c\n", consoleCommand(t, conn, r, "dump counter"))
+	assert.Equal(t, "unknown metric type \"x\", must be one of counter, timer, gauge, set\n", consoleCommand(t, conn, r, "dump x"))
+	dumped := consoleCommand(t, conn, r, "dump")
+	assert.Equal(t, "foo.bar:42|c\nfoo.bar:1.5|ms|#a:b\nfoo.bar:3|ms|#a:b\nfoo.gauge:0|g\nfoo.gauge:-7|g\nfoo.set:joe|s\n", dumped)
+
+	// Dumped lines are parsed as the dumped metrics
+	mr := NewMetricReceiver("", nil)
+	for i, line := range strings.Split(strings.TrimSuffix(dumped, "\n"), "\n") {
+		m, _, err := mr.parseLine([]byte(line))
+		require.NoError(t, err, line)
+		if i == 3 {
+			assert.Zero(t, m.Value, line)
+			continue
+		}
+		j := i
+		if i > 3 {
+			j--
+		}
+		assert.Equal(t, metrics[j].Name, m.Name, line)
+		assert.Equal(t, metrics[j].Type, m.Type, line)
+		assert.Equal(t, metrics[j].Value, m.Value, line)
+		assert.Equal(t, metrics[j].StringValue, m.StringValue, line)
+		assert.Equal(t, metrics[j].Tags, m.Tags, line)
+	}
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestConsoleSetsSketch(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	d := NewMetricDispatcher(1, 10, &agrFactory{setMode: SetsSketch})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	conn, r := startConsole(t, ctx, &ConsoleServer{Dispatcher: d})
+	defer conn.Close()
+
+	for _, value := range []string{"a", "b", "a"} {
+		require.NoError(t, d.DispatchMetric(ctx, &gostatsd.Metric{Name: "users", Type: gostatsd.SET, StringValue: value}))
+	}
+	waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.NumStats == 3
+	})
+
+	// The estimated number of distinct values is printed instead of the values
+	assert.Contains(t, consoleCommand(t, conn, r, "sets"), "~2")
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestConsoleCommandRateLimit(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	d := NewMetricDispatcher(1, 10, &agrFactory{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	conn, r := startConsole(t, ctx, &ConsoleServer{Dispatcher: d, CommandInterval: time.Hour})
+	defer conn.Close()
+
+	throttled := "counters was run less than 1h0m0s ago, please try again later\n"
+	assert.NotEqual(t, throttled, consoleCommand(t, conn, r, "counters"))
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, throttled, consoleCommand(t, conn, r, "counters"))
+	}
+	assert.NotEqual(t, "gauges was run less than 1h0m0s ago, please try again later\n", consoleCommand(t, conn, r, "gauges"))
+	assert.Contains(t, consoleCommand(t, conn, r, "help"), "Commands: ") // Cheap commands are not limited
+	assert.Contains(t, consoleCommand(t, conn, r, "help"), "Commands: ")
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestConsoleHistory(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	conn, r := startConsole(t, ctx, &ConsoleServer{})
+	defer conn.Close()
+
+	help := consoleCommand(t, conn, r, "help")
+	assert.Equal(t, help, consoleCommand(t, conn, r, "help me"))
+	assert.Equal(t, "1: help\n2: help me\n3: history\n", consoleCommand(t, conn, r, "history"))
+	assert.Equal(t, help, consoleCommand(t, conn, r, "!2"))
+	assert.Equal(t, help, consoleCommand(t, conn, r, "!!"))
+	assert.Equal(t, "!9: command not found in history\n", consoleCommand(t, conn, r, "!9"))
+	assert.Equal(t, "unrecognized command: foo\n", consoleCommand(t, conn, r, "foo"))
+	assert.Equal(t, "1: help\n2: help me\n3: history\n4: help me\n5: help me\n6: history\n", consoleCommand(t, conn, r, "history"))
+}
+
+func TestConsoleLogin(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	d := NewMetricDispatcher(1, 10, &agrFactory{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	auditLog := &syncBuffer{}
+	cs := &ConsoleServer{
+		Receiver:       NewMetricReceiver("", nopHandler{}),
+		Dispatcher:     d,
+		Flusher:        NewMetricFlusher(0, nil, nil, nil, nil, gostatsd.UnknownIP, "host"),
+		Credentials:    testCredentials(t),
+		AuditLogWriter: auditLog,
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	go cs.Serve(ctx, l)
+	login := func(credentials string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		r := bufio.NewReader(conn)
+		prompt := "login (username:password): "
+		buf := make([]byte, len(prompt))
+		_, err = io.ReadFull(r, buf)
+		require.NoError(t, err)
+		assert.Equal(t, prompt, string(buf))
+		_, err = fmt.Fprintf(conn, "%s\r\n", credentials)
+		require.NoError(t, err)
+		return conn, r
+	}
+
+	conn, r := login("bob:alice-secret")
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "authentication failed\n", line)
+	_, err = r.ReadByte()
+	assert.Equal(t, io.EOF, err) // Connection is closed
+	conn.Close()
+
+	conn, r = login("bob:bob-secret")
+	readConsoleOutput(t, r)
+	assert.Contains(t, consoleCommand(t, conn, r, "stats"), "Metrics received: 0")
+	assert.Equal(t, "permission denied: delcounters requires the admin role\n", consoleCommand(t, conn, r, "delcounters foo"))
+	conn.Close()
+
+	processAll(t, ctx, d, func(m *gostatsd.MetricMap) {
+		m.Counters["foo"] = map[string]gostatsd.Counter{"": gostatsd.NewCounter(1, 1, "", nil)}
+	})
+	conn, r = login("alice:alice-secret")
+	readConsoleOutput(t, r)
+	assert.Equal(t, "deleted 1 counters\n", consoleCommand(t, conn, r, "delcounters foo"))
+	conn.Close()
+
+	events := auditLog.events(t)
+	require.Len(t, events, 2)
+	assert.Equal(t, "bob", events[0].User)
+	assert.Equal(t, AuditResultFailure, events[0].Result)
+	assert.Equal(t, "permission denied: delcounters requires the admin role", events[0].Error)
+	assert.Equal(t, "alice", events[1].User)
+	assert.Equal(t, AuditResultSuccess, events[1].Result)
+
+	cancelFunc()
+	wg.Wait()
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.Write(p)
+}
+
+// events returns the audit events written to the buffer.
+func (sb *syncBuffer) events(t *testing.T) []AuditEvent {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	var events []AuditEvent
+	dec := json.NewDecoder(bytes.NewReader(sb.buf.Bytes()))
+	for dec.More() {
+		var e AuditEvent
+		require.NoError(t, dec.Decode(&e))
+		events = append(events, e)
+	}
+	return events
+}
+
+// processAll calls the function with the metrics of each worker of the dispatcher and waits for the workers.
+func processAll(t *testing.T, ctx context.Context, d *MetricDispatcher, f func(*gostatsd.MetricMap)) {
+	wg := d.Process(ctx, func(workerId uint16, aggr Aggregator) {
+		aggr.Process(f)
+	})
+	wg.Wait()
+}
+
+func TestConsoleDeleteCountsDistinctKeys(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	d := NewMetricDispatcher(4, 10, &agrFactory{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	conn, r := startConsole(t, ctx, &ConsoleServer{Dispatcher: d})
+	defer conn.Close()
+	// The gauge is held by all workers, e.g. after resharding
+	processAll(t, ctx, d, func(m *gostatsd.MetricMap) {
+		m.Gauges["foo"] = map[string]gostatsd.Gauge{"": gostatsd.NewGauge(1, 1, "", nil)}
+	})
+
+	assert.Equal(t, "deleted 1 gauges\n", consoleCommand(t, conn, r, "delgauges foo foo bar"))
+	assert.Equal(t, "deleted 0 gauges\n", consoleCommand(t, conn, r, "delgauges foo"))
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestConsoleAuditLog(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	d := NewMetricDispatcher(1, 10, &agrFactory{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	auditLog := &syncBuffer{}
+	conn, r := startConsole(t, ctx, &ConsoleServer{Dispatcher: d, AuditLogWriter: auditLog})
+	defer conn.Close()
+	processAll(t, ctx, d, func(m *gostatsd.MetricMap) {
+		m.Counters["foo"] = map[string]gostatsd.Counter{"": gostatsd.NewCounter(1, 1, "", nil)}
+		m.Counters["bar"] = map[string]gostatsd.Counter{"": gostatsd.NewCounter(1, 1, "", nil)}
+	})
+
+	consoleCommand(t, conn, r, "counters")
+	consoleCommand(t, conn, r, "delcounters foo bar")
+	consoleCommand(t, conn, r, "export --format=csv")
+	consoleCommand(t, conn, r, "import /nonexistent")
+
+	events := auditLog.events(t)
+	require.Len(t, events, 3) // Only state-mutating commands and export
+	assert.Equal(t, "console", events[0].Source)
+	assert.Equal(t, "127.0.0.1", events[0].ClientIP)
+	assert.Equal(t, "delcounters", events[0].Command)
+	assert.Equal(t, []string{"foo", "bar"}, events[0].Args)
+	assert.Equal(t, AuditResultSuccess, events[0].Result)
+	assert.Equal(t, uint32(2), events[0].Count)
+	assert.False(t, events[0].Time.IsZero())
+	assert.Equal(t, "export", events[1].Command)
+	assert.Equal(t, []string{"--format=csv"}, events[1].Args)
+	assert.Equal(t, AuditResultSuccess, events[1].Result)
+	assert.Equal(t, "import", events[2].Command)
+	assert.Equal(t, AuditResultFailure, events[2].Result)
+	assert.NotEmpty(t, events[2].Error)
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestConsoleFlush(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	d := NewMetricDispatcher(2, 10, &agrFactory{})
+	backend := &unitsBackend{units: make(map[string]string)}
+	fl := NewMetricFlusher(time.Hour, d, NewMetricReceiver("", nopHandler{}), nopHandler{}, []gostatsd.Backend{backend}, gostatsd.UnknownIP, "host")
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, fl.Run(ctx))
+	}()
+	auditLog := &syncBuffer{}
+	conn, r := startConsole(t, ctx, &ConsoleServer{Dispatcher: d, Flusher: fl, AuditLogWriter: auditLog})
+	defer conn.Close()
+
+	require.NoError(t, d.DispatchMetric(ctx, &gostatsd.Metric{Name: "foo", Type: gostatsd.COUNTER, Value: 12}))
+	require.NoError(t, d.DispatchMetric(ctx, &gostatsd.Metric{Name: "bar", Type: gostatsd.COUNTER, Value: 1}))
+	waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.NumStats == 2
+	})
+
+	assert.Equal(t, "flushed 2 metrics\n", consoleCommand(t, conn, r, "flush"))
+	backend.mu.Lock()
+	assert.Equal(t, map[string]string{"foo=12": "", "bar=1": ""}, backend.units)
+	backend.mu.Unlock()
+	assert.Equal(t, "flushed 0 metrics\n", consoleCommand(t, conn, r, "flush")) // Aggregators are reset by the flush
+
+	events := auditLog.events(t)
+	require.Len(t, events, 2)
+	assert.Equal(t, "flush", events[0].Command)
+	assert.Equal(t, AuditResultSuccess, events[0].Result)
+	assert.Equal(t, uint32(2), events[0].Count)
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestConsoleCardinality(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	d := NewMetricDispatcher(2, 10, &agrFactory{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	conn, r := startConsole(t, ctx, &ConsoleServer{Dispatcher: d})
+	defer conn.Close()
+
+	metrics := []gostatsd.Metric{
+		{Name: "c1", Type: gostatsd.COUNTER, Value: 1},
+		{Name: "c1", Type: gostatsd.COUNTER, Value: 1, Tags: gostatsd.Tags{"a:b"}},
+		{Name: "c2", Type: gostatsd.COUNTER, Value: 1},
+		{Name: "t", Type: gostatsd.TIMER, Value: 1},
+		{Name: "t", Type: gostatsd.TIMER, Value: 2},
+		{Name: "s", Type: gostatsd.SET, StringValue: "x"},
+	}
+	for i := range metrics {
+		require.NoError(t, d.DispatchMetric(ctx, &metrics[i]))
+	}
+	waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.NumStats == uint32(len(metrics))
+	})
+
+	assert.Equal(t, "Counters: 3\nTimers: 1\nGauges: 0\nSets: 1\nTotal: 5\n", consoleCommand(t, conn, r, "cardinality"))
+
+	ct := cardinality.NewCardinalityTracker(1)
+	require.True(t, ct.Allow(gostatsd.COUNTER, "c1"))
+	require.False(t, ct.Allow(gostatsd.COUNTER, "c3"))
+	conn, r = startConsole(t, ctx, &ConsoleServer{Dispatcher: d, Cardinality: ct})
+	defer conn.Close()
+	assert.Equal(t, "Counters: 3\nTimers: 1\nGauges: 0\nSets: 1\nTotal: 5\nLimit: 1\nDropped: 1\n", consoleCommand(t, conn, r, "cardinality"))
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestConsolePayloads(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	backend := &payloadBackend{}
+	fl := NewMetricFlusher(time.Hour, nil, nil, nil, []gostatsd.Backend{backend}, gostatsd.UnknownIP, "host")
+	require.NoError(t, fl.SetPayloadBuckets([]int{100, 1000}))
+	conn, r := startConsole(t, ctx, &ConsoleServer{Flusher: fl})
+	defer conn.Close()
+
+	assert.Equal(t, "no payloads recorded\n", consoleCommand(t, conn, r, "payloads"))
+	for _, size := range []int{50, 150, 250} {
+		backend.observer(size)
+	}
+	assert.Equal(t, "payloadBackend: payloads=3 min=50 max=250 mean=150.0 p99=250\n"+
+		"  <= 100: 1\n"+
+		"  <= 1000: 2\n"+
+		"  > 1000: 0\n", consoleCommand(t, conn, r, "payloads"))
+}
+
+func TestConsoleNegativeCounters(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	d := NewMetricDispatcher(1, 10, &agrFactory{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	clamp, rClamp := startConsole(t, ctx, &ConsoleServer{Dispatcher: d, NegativeCounters: NegativeCountersClamp})
+	defer clamp.Close()
+	drop, rDrop := startConsole(t, ctx, &ConsoleServer{Dispatcher: d, NegativeCounters: NegativeCountersDrop})
+	defer drop.Close()
+
+	require.NoError(t, d.DispatchMetric(ctx, &gostatsd.Metric{Name: "neg", Type: gostatsd.COUNTER, Value: -42}))
+	require.NoError(t, d.DispatchMetric(ctx, &gostatsd.Metric{Name: "pos", Type: gostatsd.COUNTER, Value: 42}))
+	waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.NumStats == 2
+	})
+
+	output := consoleCommand(t, clamp, rClamp, "counters")
+	assert.Contains(t, output, "neg")
+	assert.NotContains(t, output, "-42")
+	assert.Contains(t, output, "42")
+	output = consoleCommand(t, drop, rDrop, "counters")
+	assert.NotContains(t, output, "neg")
+	assert.Contains(t, output, "pos")
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestConsoleStatsQueues(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	fl := NewMetricFlusher(time.Hour, nil, nil, nil, []gostatsd.Backend{&capturingBackend{}}, gostatsd.UnknownIP, "host")
+	require.NoError(t, fl.SetBackendQueues(5, QueueBlock))
+	conn, r := startConsole(t, ctx, &ConsoleServer{Receiver: NewMetricReceiver("", nopHandler{}), Flusher: fl})
+	defer conn.Close()
+
+	assert.Contains(t, consoleCommand(t, conn, r, "stats"), "Send queue of capturingBackend: 0/5, dropped flushes: 0\n")
+}
+
+func TestConsoleStatsJSON(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	fl := NewMetricFlusher(time.Hour, nil, nil, nil, []gostatsd.Backend{&capturingBackend{}}, gostatsd.UnknownIP, "host")
+	require.NoError(t, fl.SetBackendQueues(5, QueueBlock))
+	sink := NewFilterSink(DropPrefixes([]string{"drop."}), NewRateLimitSink(rate.NewLimiter(rate.Limit(1e-3), 1), &recordingSink{}))
+	for _, name := range []string{"drop.a", "a", "b", "c"} {
+		require.NoError(t, sink.Send(ctx, &gostatsd.Metric{Name: name}))
+	}
+	conn, r := startConsole(t, ctx, &ConsoleServer{Receiver: NewMetricReceiver("", nopHandler{}), Flusher: fl, MetricSink: sink})
+	defer conn.Close()
+
+	var stats map[string]map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(consoleCommand(t, conn, r, "stats json")), &stats))
+	for _, key := range []string{"last_packet", "bad_lines", "packets_received", "metrics_received", "unknown_fields", "empty_names", "unknown_types"} {
+		assert.Contains(t, stats["receiver"], key)
+	}
+	for _, key := range []string{"last_flush", "last_flush_error", "payloads", "queues"} {
+		assert.Contains(t, stats["flusher"], key)
+	}
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"backend": "capturingBackend", "depth": 0.0, "capacity": 5.0, "dropped": 0.0,
+	}}, stats["flusher"]["queues"])
+	assert.Equal(t, map[string]interface{}{"filtered": 1.0, "rate_limited": 2.0}, stats["pipeline"])
+	assert.Equal(t, "usage: stats [json]\n", consoleCommand(t, conn, r, "stats xml"))
+}
+
+func TestConsoleIdleTimeout(t *testing.T) {
+	t.Parallel()
+	input := []struct {
+		name  string
+		login bool
+		lines string // Sent by the client before it goes idle
+	}{
+		{name: "no input"},
+		{name: "login", login: true},
+		{name: "after command", lines: "help\n"},
+		{name: "running command", lines: "preview 1m\n"},
+	}
+	for _, in := range input {
+		cs := &ConsoleServer{Receiver: NewMetricReceiver("", nopHandler{}), TapCapacity: 10, IdleTimeout: 50 * time.Millisecond}
+		if in.login {
+			cs.Credentials = testCredentials(t)
+		}
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			cs.serveConnection(context.Background(), server)
+		}()
+		if in.lines != "" {
+			go func() {
+				_, _ = io.WriteString(client, in.lines)
+			}()
+		}
+		start := time.Now()
+		out, err := ioutil.ReadAll(client)
+		assert.NoError(t, err, in.name)
+		assert.True(t, strings.HasSuffix(string(out), "\nidle timeout, closing connection\n"), "%s: %q", in.name, out)
+		assert.True(t, time.Since(start) >= cs.IdleTimeout, in.name)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: connection was not closed", in.name)
+		}
+	}
+}
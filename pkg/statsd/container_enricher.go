@@ -0,0 +1,204 @@
+package statsd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// DefaultContainerLookupTimeout is the default maximum time a lookup of the tags of a container takes.
+	DefaultContainerLookupTimeout = 1 * time.Second
+	// maxContainerCacheSize is the maximum number of cached containers. Expired containers are evicted first once
+	// it is reached, then arbitrary containers.
+	maxContainerCacheSize = 10000
+)
+
+// ContainerResolver resolves the ID of a container to tags describing the container.
+type ContainerResolver interface {
+	Resolve(ctx context.Context, containerID string) (gostatsd.Tags, error)
+}
+
+type containerHolder struct {
+	expires time.Time
+	tags    gostatsd.Tags // Nil if the lookup failed
+}
+
+// ContainerEnricher adds tags of the container to metrics and events with the ContainerIDTagKey tag, e.g. the
+// name of the image and of the Kubernetes pod. Tags of containers are cached for DefaultCacheTTL, failed lookups
+// for DefaultCacheNegativeTTL, failed lookups pass metrics through without tags. At most maxContainerCacheSize
+// containers are cached.
+type ContainerEnricher struct {
+	resolver  ContainerResolver
+	next      Handler
+	timeout   time.Duration
+	now       func() time.Time
+	cacheSize int
+
+	rw    sync.RWMutex // Protects cache
+	cache map[string]*containerHolder
+}
+
+// NewContainerEnricher initialises a new container enricher.
+func NewContainerEnricher(resolver ContainerResolver, next Handler) *ContainerEnricher {
+	return &ContainerEnricher{
+		resolver:  resolver,
+		next:      next,
+		timeout:   DefaultContainerLookupTimeout,
+		now:       time.Now,
+		cacheSize: maxContainerCacheSize,
+		cache:     make(map[string]*containerHolder),
+	}
+}
+
+// DispatchMetric adds tags of the container of the metric and dispatches it to the next handler.
+func (ce *ContainerEnricher) DispatchMetric(ctx context.Context, m *gostatsd.Metric) error {
+	m.Tags = ce.enrich(ctx, m.Tags)
+	return ce.next.DispatchMetric(ctx, m)
+}
+
+// DispatchEvent adds tags of the container of the event and dispatches it to the next handler.
+func (ce *ContainerEnricher) DispatchEvent(ctx context.Context, e *gostatsd.Event) error {
+	e.Tags = ce.enrich(ctx, e.Tags)
+	return ce.next.DispatchEvent(ctx, e)
+}
+
+// WaitForEvents waits for all event-dispatching goroutines to finish.
+func (ce *ContainerEnricher) WaitForEvents() {
+	ce.next.WaitForEvents()
+}
+
+// enrich returns the tags with the tags of the container appended if there is a container ID tag.
+func (ce *ContainerEnricher) enrich(ctx context.Context, tags gostatsd.Tags) gostatsd.Tags {
+	prefix := ContainerIDTagKey + ":"
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, prefix) {
+			return append(tags, ce.lookup(ctx, tag[len(prefix):])...)
+		}
+	}
+	return tags
+}
+
+func (ce *ContainerEnricher) lookup(ctx context.Context, containerID string) gostatsd.Tags {
+	now := ce.now()
+	ce.rw.RLock()
+	holder, ok := ce.cache[containerID]
+	ce.rw.RUnlock()
+	if ok && now.Before(holder.expires) {
+		return holder.tags
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ce.timeout)
+	defer cancel()
+	tags, err := ce.resolver.Resolve(ctx, containerID)
+	holder = &containerHolder{expires: now.Add(DefaultCacheTTL), tags: tags}
+	if err != nil {
+		log.Debugf("Failed to look up container %s: %v", containerID, err)
+		holder = &containerHolder{expires: now.Add(DefaultCacheNegativeTTL)}
+	}
+
+	ce.rw.Lock()
+	defer ce.rw.Unlock()
+	if _, ok := ce.cache[containerID]; !ok && len(ce.cache) >= ce.cacheSize {
+		for id, h := range ce.cache {
+			if !now.Before(h.expires) {
+				delete(ce.cache, id)
+			}
+		}
+		for id := range ce.cache {
+			if len(ce.cache) < ce.cacheSize {
+				break
+			}
+			delete(ce.cache, id)
+		}
+	}
+	ce.cache[containerID] = holder
+	return holder.tags
+}
+
+// DockerResolver resolves IDs of containers with the Docker API. Tags are the name of the image (image_name) and
+// of the container (container_name), the Compose project (compose_project) if the container was started by Docker
+// Compose, and the name (pod_name) and namespace (kube_namespace) of the Kubernetes pod if the container has the
+// labels set by Kubernetes. Configured labels of the container are added as tags with the name of the label as key.
+type DockerResolver struct {
+	client *http.Client
+	labels []string // Labels of containers added as tags
+}
+
+// NewDockerResolver initialises a new resolver using the Docker API listening on the Unix socket. The labels of
+// containers are added as tags, other labels are not to limit the cardinality of metrics.
+func NewDockerResolver(socketPath string, labels []string) *DockerResolver {
+	var dialer net.Dialer
+	return &DockerResolver{
+		labels: labels,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// dockerContainer is the part of the response of the container inspect endpoint of the Docker API used for tags.
+type dockerContainer struct {
+	Name   string
+	Config struct {
+		Image  string
+		Labels map[string]string
+	}
+}
+
+// Resolve returns the tags of the container.
+func (dr *DockerResolver) Resolve(ctx context.Context, containerID string) (gostatsd.Tags, error) {
+	for _, c := range containerID {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return nil, fmt.Errorf("invalid container ID %q", containerID)
+		}
+	}
+	req, err := http.NewRequest("GET", "http://docker/containers/"+containerID+"/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := dr.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status of container %s: %s", containerID, resp.Status)
+	}
+	var container dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&container); err != nil {
+		return nil, fmt.Errorf("failed to decode container %s: %v", containerID, err)
+	}
+	tags := gostatsd.Tags{
+		"image_name:" + container.Config.Image,
+		"container_name:" + strings.TrimPrefix(container.Name, "/"),
+	}
+	if pod, ok := container.Config.Labels["io.kubernetes.pod.name"]; ok {
+		tags = append(tags, "pod_name:"+pod)
+	}
+	if namespace, ok := container.Config.Labels["io.kubernetes.pod.namespace"]; ok {
+		tags = append(tags, "kube_namespace:"+namespace)
+	}
+	if project, ok := container.Config.Labels["com.docker.compose.project"]; ok {
+		tags = append(tags, "compose_project:"+project)
+	}
+	for _, label := range dr.labels {
+		if value, ok := container.Config.Labels[label]; ok {
+			tags = append(tags, label+":"+value)
+		}
+	}
+	return tags, nil
+}
@@ -0,0 +1,151 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeContainerResolver resolves containers from a map and counts lookups.
+type fakeContainerResolver struct {
+	mu         sync.Mutex
+	containers map[string]gostatsd.Tags
+	lookups    int
+}
+
+func (fr *fakeContainerResolver) Resolve(ctx context.Context, containerID string) (gostatsd.Tags, error) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.lookups++
+	tags, ok := fr.containers[containerID]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return tags, nil
+}
+
+func TestContainerEnricher(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1000, 0)
+	resolver := &fakeContainerResolver{containers: map[string]gostatsd.Tags{
+		"abc": {"image_name:web", "pod_name:web-1"},
+	}}
+	ch := &countingHandler{}
+	ce := NewContainerEnricher(resolver, ch)
+	ce.now = func() time.Time {
+		return now
+	}
+	ctx := context.Background()
+
+	// Datagrams of DogStatsD 1.2 with origin detection
+	for _, line := range []string{"a:1|c|#env:prod|c:abc", "a:1|c|#env:prod|c:abc", "b:1|c|#env:prod", "c:1|g|c:unknown"} {
+		m, _, err := parseLine([]byte(line), "")
+		require.NoError(t, err)
+		require.NoError(t, ce.DispatchMetric(ctx, m))
+	}
+	_, e, err := parseLine([]byte("_e{1,1}:a|b|c:abc"), "")
+	require.NoError(t, err)
+	require.NoError(t, ce.DispatchEvent(ctx, e))
+
+	require.Len(t, ch.metrics, 4)
+	assert.Equal(t, gostatsd.Tags{"env:prod", "container_id:abc", "image_name:web", "pod_name:web-1"}, ch.metrics[0].Tags)
+	assert.Equal(t, gostatsd.Tags{"env:prod", "container_id:abc", "image_name:web", "pod_name:web-1"}, ch.metrics[1].Tags)
+	assert.Equal(t, gostatsd.Tags{"env:prod"}, ch.metrics[2].Tags)
+	assert.Equal(t, gostatsd.Tags{"container_id:unknown"}, ch.metrics[3].Tags)
+	require.Len(t, ch.events, 1)
+	assert.Equal(t, gostatsd.Tags{"container_id:abc", "image_name:web", "pod_name:web-1"}, ch.events[0].Tags)
+	assert.Equal(t, 2, resolver.lookups) // Lookups are cached
+
+	// Failed lookups are retried after the negative TTL, others after the TTL
+	now = now.Add(DefaultCacheNegativeTTL)
+	require.NoError(t, ce.DispatchMetric(ctx, &gostatsd.Metric{Name: "c", Tags: gostatsd.Tags{"container_id:unknown"}}))
+	require.NoError(t, ce.DispatchMetric(ctx, &gostatsd.Metric{Name: "a", Tags: gostatsd.Tags{"container_id:abc"}}))
+	assert.Equal(t, 3, resolver.lookups)
+	now = now.Add(DefaultCacheTTL)
+	require.NoError(t, ce.DispatchMetric(ctx, &gostatsd.Metric{Name: "a", Tags: gostatsd.Tags{"container_id:abc"}}))
+	assert.Equal(t, 4, resolver.lookups)
+}
+
+func TestContainerEnricherCacheSize(t *testing.T) {
+	t.Parallel()
+	resolver := &fakeContainerResolver{containers: map[string]gostatsd.Tags{}}
+	ce := NewContainerEnricher(resolver, &countingHandler{})
+	ce.cacheSize = 3
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		id := strconv.Itoa(i)
+		resolver.containers[id] = gostatsd.Tags{"container_name:" + id}
+		require.NoError(t, ce.DispatchMetric(ctx, &gostatsd.Metric{Name: "a", Tags: gostatsd.Tags{"container_id:" + id}}))
+		assert.True(t, len(ce.cache) <= 3, "%d cached containers", len(ce.cache))
+	}
+	// The last container is cached
+	require.NoError(t, ce.DispatchMetric(ctx, &gostatsd.Metric{Name: "a", Tags: gostatsd.Tags{"container_id:9"}}))
+	assert.Equal(t, 10, resolver.lookups)
+}
+
+func TestDockerResolver(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "gostatsd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer l.Close()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/83c1dbc6e0aa/json", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{
+			"Id": "83c1dbc6e0aa",
+			"Name": "/k8s_web_web-1_default_0",
+			"Config": {
+				"Image": "nginx:1.13",
+				"Labels": {"io.kubernetes.pod.name": "web-1", "io.kubernetes.pod.namespace": "default"}
+			}
+		}`))
+	})
+	mux.HandleFunc("/containers/2a5e0a4c1d3b/json", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"Id": "2a5e0a4c1d3b", "Name": "/redis", "Config": {"Image": "redis", "Labels": {}}}`))
+	})
+	mux.HandleFunc("/containers/5d1c3e2f4a6b/json", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{
+			"Id": "5d1c3e2f4a6b",
+			"Name": "/shop_db_1",
+			"Config": {
+				"Image": "postgres:10",
+				"Labels": {"com.docker.compose.project": "shop", "team": "payments", "version": "42"}
+			}
+		}`))
+	})
+	go func() {
+		_ = http.Serve(l, mux)
+	}()
+
+	dr := NewDockerResolver(socket, []string{"team", "owner"})
+	ctx := context.Background()
+	tags, err := dr.Resolve(ctx, "83c1dbc6e0aa")
+	require.NoError(t, err)
+	assert.Equal(t, gostatsd.Tags{"image_name:nginx:1.13", "container_name:k8s_web_web-1_default_0", "pod_name:web-1", "kube_namespace:default"}, tags)
+	tags, err = dr.Resolve(ctx, "2a5e0a4c1d3b")
+	require.NoError(t, err)
+	assert.Equal(t, gostatsd.Tags{"image_name:redis", "container_name:redis"}, tags)
+	tags, err = dr.Resolve(ctx, "5d1c3e2f4a6b")
+	require.NoError(t, err)
+	assert.Equal(t, gostatsd.Tags{"image_name:postgres:10", "container_name:shop_db_1", "compose_project:shop", "team:payments"}, tags)
+	_, err = dr.Resolve(ctx, "ffffffffffff")
+	assert.EqualError(t, err, "unexpected status of container ffffffffffff: 404 Not Found")
+	_, err = dr.Resolve(ctx, "../info")
+	assert.EqualError(t, err, `invalid container ID "../info"`)
+}
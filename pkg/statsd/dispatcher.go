@@ -2,15 +2,81 @@ package statsd
 
 import (
 	"context"
+	"fmt"
 	"hash/adler32"
+	"hash/fnv"
+	"hash/maphash"
 	"sync"
 	"time"
 
 	"github.com/atlassian/gostatsd"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/cespare/xxhash/v2"
 )
 
+// KeyHash is the hash function mapping names of metrics to the workers aggregating them.
+type KeyHash int
+
+const (
+	// KeyHashAdler32 hashes names with Adler-32.
+	KeyHashAdler32 KeyHash = iota
+	// KeyHashFNV hashes names with 64-bit FNV-1a.
+	KeyHashFNV
+	// KeyHashXXHash hashes names with 64-bit xxHash, about twice as fast as Adler-32 and FNV-1a.
+	KeyHashXXHash
+	// KeyHashMaphash hashes names with hash/maphash, seeded randomly once per dispatcher.
+	KeyHashMaphash
+)
+
+var keyHashNames = map[KeyHash]string{
+	KeyHashAdler32: "adler32",
+	KeyHashFNV:     "fnv",
+	KeyHashXXHash:  "xxhash",
+	KeyHashMaphash: "maphash",
+}
+
+func (h KeyHash) String() string {
+	if name, ok := keyHashNames[h]; ok {
+		return name
+	}
+	return fmt.Sprintf("KeyHash(%d)", int(h))
+}
+
+// ParseKeyHash returns the key hash with the name.
+func ParseKeyHash(name string) (KeyHash, error) {
+	for h, hashName := range keyHashNames {
+		if hashName == name {
+			return h, nil
+		}
+	}
+	return KeyHashAdler32, fmt.Errorf("unknown key hash %q, must be one of adler32, fnv, xxhash, maphash", name)
+}
+
+// hashFunc returns the function hashing names. Each function returned for KeyHashMaphash has its own seed, so
+// the same function must be used for all names for metrics of a name to be aggregated by the same worker.
+func (h KeyHash) hashFunc() func(string) uint64 {
+	switch h {
+	case KeyHashFNV:
+		return func(name string) uint64 {
+			f := fnv.New64a()
+			f.Write([]byte(name)) // #nosec
+			return f.Sum64()
+		}
+	case KeyHashXXHash:
+		return xxhash.Sum64String
+	case KeyHashMaphash:
+		seed := maphash.MakeSeed()
+		return func(name string) uint64 {
+			return maphash.String(seed, name)
+		}
+	default:
+		return func(name string) uint64 {
+			return uint64(adler32.Checksum([]byte(name)))
+		}
+	}
+}
+
 // AggregatorFactory creates Aggregator objects.
 type AggregatorFactory interface {
 	// Create creates Aggregator objects.
@@ -41,6 +107,8 @@ type worker struct {
 type MetricDispatcher struct {
 	numWorkers int
 	workers    map[uint16]worker
+	pinner     *CPUPinner          // Pins workers to CPUs, nil if disabled
+	hash       func(string) uint64 // Hashes names of metrics to select their worker
 }
 
 // NewMetricDispatcher creates a new NewMetricDispatcher with provided configuration.
@@ -60,16 +128,31 @@ func NewMetricDispatcher(numWorkers int, perWorkerBufferSize int, af AggregatorF
 	return &MetricDispatcher{
 		numWorkers: numWorkers,
 		workers:    workers,
+		hash:       KeyHashAdler32.hashFunc(),
 	}
 }
 
+// SetCPUPinner pins each worker to a CPU with the pinner, none are pinned if nil. Must be called before Run.
+func (d *MetricDispatcher) SetCPUPinner(pinner *CPUPinner) {
+	d.pinner = pinner
+}
+
+// SetKeyHash sets the hash function mapping names of metrics to workers, KeyHashAdler32 by default. Must be
+// called before Run.
+func (d *MetricDispatcher) SetKeyHash(h KeyHash) {
+	d.hash = h.hashFunc()
+}
+
 // Run runs the MetricDispatcher.
 func (d *MetricDispatcher) Run(ctx context.Context) error {
 	var wg sync.WaitGroup
 	wg.Add(d.numWorkers)
 	for _, worker := range d.workers {
 		w := worker // Make a copy of the loop variable! https://github.com/golang/go/wiki/CommonMistakes
-		go w.work(&wg)
+		go func() {
+			d.pinner.pin("dispatcher worker")
+			w.work(&wg)
+		}()
 	}
 	defer func() {
 		for _, worker := range d.workers {
@@ -83,10 +166,10 @@ func (d *MetricDispatcher) Run(ctx context.Context) error {
 	return ctx.Err()
 }
 
-// DispatchMetric dispatches metric to a corresponding Aggregator.
+// DispatchMetric dispatches metric to a corresponding Aggregator. The metric is returned to the metric pool once
+// it is aggregated, so it must not be used after it is dispatched.
 func (d *MetricDispatcher) DispatchMetric(ctx context.Context, m *gostatsd.Metric) error {
-	hash := adler32.Checksum([]byte(m.Name))
-	w := d.workers[uint16(hash%uint32(d.numWorkers))]
+	w := d.workers[uint16(d.hash(m.Name)%uint64(d.numWorkers))]
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
@@ -129,7 +212,17 @@ func (w *worker) work(wg *sync.WaitGroup) {
 				return
 			}
 			w.aggr.Receive(metric, time.Now())
+			putMetric(metric)
 		case cmd := <-w.processChan:
+			// Metrics dispatched before the command are aggregated first
+			for n := len(w.metricsQueue); n > 0; n-- {
+				metric, ok := <-w.metricsQueue
+				if !ok {
+					break
+				}
+				w.aggr.Receive(metric, time.Now())
+				putMetric(metric)
+			}
 			w.executeProcess(cmd)
 		}
 	}
@@ -3,6 +3,7 @@ package statsd
 import (
 	"context"
 	"fmt"
+	"hash/adler32"
 	"math/rand"
 	"runtime"
 	"sync"
@@ -11,7 +12,9 @@ import (
 
 	"github.com/atlassian/gostatsd"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type testAggregator struct {
@@ -148,6 +151,102 @@ func TestDispatchMetricShouldDistributeMetrics(t *testing.T) {
 	}
 }
 
+func TestProcessAfterDispatchedMetrics(t *testing.T) {
+	t.Parallel()
+	factory := newTestFactory()
+	d := NewMetricDispatcher(2, 100, factory)
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	var wgFinish sync.WaitGroup
+	wgFinish.Add(1)
+	go func() {
+		defer wgFinish.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	for i := 0; i < 100; i++ {
+		m := &gostatsd.Metric{Type: gostatsd.COUNTER, Name: fmt.Sprintf("counter.metric.%d", i), Value: 1}
+		require.NoError(t, d.DispatchMetric(ctx, m))
+	}
+	// Metrics dispatched before Process are aggregated when the function is executed
+	received := 0
+	d.Process(ctx, func(workerId uint16, aggr Aggregator) {
+		factory.Mutex.Lock()
+		defer factory.Mutex.Unlock()
+		received += factory.receiveInvocations[int(workerId)]
+	}).Wait()
+	assert.Equal(t, 100, received)
+	cancelFunc()
+	wgFinish.Wait()
+}
+
+func TestParseKeyHash(t *testing.T) {
+	t.Parallel()
+	for h, name := range keyHashNames {
+		parsed, err := ParseKeyHash(name)
+		require.NoError(t, err)
+		assert.Equal(t, h, parsed)
+	}
+	_, err := ParseKeyHash("md5")
+	assert.EqualError(t, err, `unknown key hash "md5", must be one of adler32, fnv, xxhash, maphash`)
+}
+
+// realisticKeys returns names of metrics like those of a fleet of services, sharing long prefixes and differing
+// by a few characters.
+func realisticKeys() []string {
+	var keys []string
+	for service := 0; service < 20; service++ {
+		for endpoint := 0; endpoint < 25; endpoint++ {
+			for _, suffix := range []string{"count", "errors", "latency", "latency.p99", "bytes_in", "bytes_out", "retries", "timeouts"} {
+				keys = append(keys, fmt.Sprintf("prod.service%d.http.endpoint_%d.%s", service, endpoint, suffix))
+			}
+		}
+	}
+	return keys
+}
+
+func TestKeyHashDistribution(t *testing.T) {
+	t.Parallel()
+	keys := realisticKeys()
+	// Adler-32 mixes short names poorly, one of 16 workers gets about 30% more of these names than the mean
+	for _, h := range []KeyHash{KeyHashFNV, KeyHashXXHash, KeyHashMaphash} {
+		for _, numWorkers := range []int{4, 8, 16} {
+			hash := h.hashFunc()
+			counts := make([]int, numWorkers)
+			for _, key := range keys {
+				w := hash(key) % uint64(numWorkers)
+				assert.Equal(t, w, hash(key)%uint64(numWorkers), "%s: same name mapped to different workers", h)
+				counts[w]++
+			}
+			mean := float64(len(keys)) / float64(numWorkers)
+			for w, count := range counts {
+				assert.InDelta(t, mean, count, mean*0.3, "%s: worker %d of %d has %d of %d keys", h, w, numWorkers, count, len(keys))
+			}
+		}
+	}
+}
+
+func TestDispatcherKeyHash(t *testing.T) {
+	t.Parallel()
+	d := NewMetricDispatcher(8, 1, newTestFactory())
+	name := "prod.service1.http.endpoint_2.latency"
+	assert.Equal(t, uint64(adler32.Checksum([]byte(name))), d.hash(name), "adler32 by default")
+	d.SetKeyHash(KeyHashXXHash)
+	assert.Equal(t, xxhash.Sum64String(name), d.hash(name))
+}
+
+func BenchmarkKeyHash(b *testing.B) {
+	keys := realisticKeys()
+	for h := KeyHashAdler32; h <= KeyHashMaphash; h++ {
+		hash := h.hashFunc()
+		b.Run(h.String(), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				hash(keys[i%len(keys)])
+			}
+		})
+	}
+}
+
 func getTotalInvocations(inv map[int]int) int {
 	var counter int
 	for _, i := range inv {
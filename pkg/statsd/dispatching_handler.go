@@ -12,7 +12,7 @@ import (
 // DispatchingHandler dispatches events to all configured backends and forwards metrics to a Dispatcher.
 type DispatchingHandler struct {
 	wg               sync.WaitGroup
-	dispatcher       Dispatcher
+	metrics          MetricSink // Pipeline of metrics ending with the Dispatcher
 	backends         []gostatsd.Backend
 	tags             gostatsd.Tags // Tags to add to all metrics and events
 	concurrentEvents chan struct{}
@@ -21,19 +21,21 @@ type DispatchingHandler struct {
 // NewDispatchingHandler initialises a new dispatching handler.
 func NewDispatchingHandler(dispatcher Dispatcher, backends []gostatsd.Backend, tags gostatsd.Tags, maxConcurrentEvents uint) *DispatchingHandler {
 	return &DispatchingHandler{
-		dispatcher:       dispatcher,
+		metrics:          NewEnrichSink(tags, NewDispatchSink(dispatcher)),
 		backends:         backends,
 		tags:             tags,
 		concurrentEvents: make(chan struct{}, maxConcurrentEvents),
 	}
 }
 
+// SetMetricSink sets the pipeline metrics are sent to instead of being enriched with the tags and dispatched.
+// The pipeline should end with an EnrichSink and a DispatchSink. Must be called before metrics are dispatched.
+func (dh *DispatchingHandler) SetMetricSink(sink MetricSink) {
+	dh.metrics = sink
+}
+
 func (dh *DispatchingHandler) DispatchMetric(ctx context.Context, m *gostatsd.Metric) error {
-	if m.Hostname == "" {
-		m.Hostname = string(m.SourceIP)
-	}
-	m.Tags = append(m.Tags, dh.tags...)
-	return dh.dispatcher.DispatchMetric(ctx, m)
+	return dh.metrics.Send(ctx, m)
 }
 
 func (dh *DispatchingHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) error {
@@ -0,0 +1,77 @@
+package statsd
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// errorThrottler logs the first occurrence of an error and suppresses identical errors from the same
+// backend for the interval. A summary with the number of suppressed errors is logged when the interval ends.
+// Safe for concurrent use.
+type errorThrottler struct {
+	interval time.Duration    // Interval to suppress identical errors for, 0 to log all errors
+	now      func() time.Time // Returns current time. Useful for testing.
+
+	mu     sync.Mutex
+	errors map[throttledErrorKey]*throttledError
+}
+
+type throttledErrorKey struct {
+	backend string
+	message string
+}
+
+type throttledError struct {
+	firstSeen  time.Time
+	suppressed int
+}
+
+func newErrorThrottler(interval time.Duration) *errorThrottler {
+	return &errorThrottler{
+		interval: interval,
+		now:      time.Now,
+		errors:   make(map[throttledErrorKey]*throttledError),
+	}
+}
+
+// logError logs the error unless an identical error from the backend has been logged during the interval.
+func (et *errorThrottler) logError(backend string, err error) {
+	if et.interval <= 0 {
+		log.Errorf("Sending metrics to backend %s failed: %v", backend, err)
+		return
+	}
+	key := throttledErrorKey{backend: backend, message: err.Error()}
+	et.mu.Lock()
+	defer et.mu.Unlock()
+	now := et.now()
+	if te, ok := et.errors[key]; ok {
+		if now.Sub(te.firstSeen) < et.interval {
+			te.suppressed++
+			return
+		}
+		et.logSummary(key, te)
+	}
+	et.errors[key] = &throttledError{firstSeen: now}
+	log.Errorf("Sending metrics to backend %s failed: %v", backend, err)
+}
+
+// logSummaries logs summaries of suppressed errors for intervals that have ended.
+func (et *errorThrottler) logSummaries() {
+	et.mu.Lock()
+	defer et.mu.Unlock()
+	now := et.now()
+	for key, te := range et.errors {
+		if now.Sub(te.firstSeen) >= et.interval {
+			et.logSummary(key, te)
+			delete(et.errors, key)
+		}
+	}
+}
+
+func (et *errorThrottler) logSummary(key throttledErrorKey, te *throttledError) {
+	if te.suppressed > 0 {
+		log.Errorf("Backend %s failed %d more times in the last %s: %s", key.backend, te.suppressed, et.interval, key.message)
+	}
+}
@@ -0,0 +1,51 @@
+package statsd
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorThrottlerSuppressesIdenticalErrors(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1000, 0)
+	et := newErrorThrottler(time.Minute)
+	et.now = func() time.Time {
+		return now
+	}
+	key := throttledErrorKey{backend: "graphite", message: "boom"}
+
+	et.logError("graphite", errors.New("boom"))
+	et.logError("graphite", errors.New("boom"))
+	et.logError("graphite", errors.New("boom"))
+	et.logError("graphite", errors.New("other"))
+	et.logError("datadog", errors.New("boom"))
+	assert.Len(t, et.errors, 3)
+	assert.Equal(t, 2, et.errors[key].suppressed)
+
+	now = now.Add(30 * time.Second)
+	et.logSummaries()
+	assert.Len(t, et.errors, 3) // Interval has not ended yet
+
+	now = now.Add(30 * time.Second)
+	et.logError("graphite", errors.New("boom")) // Interval ended, logged again and a new interval starts
+	assert.Equal(t, 0, et.errors[key].suppressed)
+	assert.Equal(t, now, et.errors[key].firstSeen)
+
+	now = now.Add(time.Second)
+	et.logSummaries()
+	assert.Len(t, et.errors, 1)
+	now = now.Add(time.Minute)
+	et.logSummaries()
+	assert.Empty(t, et.errors)
+}
+
+func TestErrorThrottlerDisabled(t *testing.T) {
+	t.Parallel()
+	et := newErrorThrottler(0)
+	et.logError("graphite", errors.New("boom"))
+	et.logError("graphite", errors.New("boom"))
+	assert.Empty(t, et.errors)
+}
@@ -0,0 +1,55 @@
+package statsd
+
+import (
+	"context"
+	"sync"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// FanOutDispatcher forwards every metric to two independent Dispatchers.
+// It is useful to feed the same metric stream into two separate aggregator+backend stacks.
+// FanOutDispatcher does not manage lifecycle of the wrapped Dispatchers, they must be run by the caller.
+type FanOutDispatcher struct {
+	primary   Dispatcher
+	secondary Dispatcher
+}
+
+// NewFanOutDispatcher creates a new FanOutDispatcher that wraps provided Dispatchers.
+func NewFanOutDispatcher(primary, secondary Dispatcher) *FanOutDispatcher {
+	return &FanOutDispatcher{
+		primary:   primary,
+		secondary: secondary,
+	}
+}
+
+// DispatchMetric dispatches metric to both wrapped Dispatchers.
+// The secondary Dispatcher is fed even if the primary one fails, the first error is returned.
+// The secondary Dispatcher gets a copy of the metric because Aggregators sort tags in place.
+// The copy is made before the metric is handed to the primary Dispatcher to avoid a data race.
+func (fd *FanOutDispatcher) DispatchMetric(ctx context.Context, m *gostatsd.Metric) error {
+	mCopy := *m
+	mCopy.Tags = copyTags(m.Tags)
+	errPrimary := fd.primary.DispatchMetric(ctx, m)
+	errSecondary := fd.secondary.DispatchMetric(ctx, &mCopy)
+	if errPrimary != nil {
+		return errPrimary
+	}
+	return errSecondary
+}
+
+// Process concurrently executes provided function in goroutines that own Aggregators of both wrapped Dispatchers.
+// Worker ids passed to the function are not unique across Dispatchers.
+// The returned WaitGroup is done when both Dispatchers have finished executing the function.
+func (fd *FanOutDispatcher) Process(ctx context.Context, f DispatcherProcessFunc) *sync.WaitGroup {
+	wgPrimary := fd.primary.Process(ctx, f)
+	wgSecondary := fd.secondary.Process(ctx, f)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		wgPrimary.Wait()
+		wgSecondary.Wait()
+	}()
+	return &wg
+}
@@ -0,0 +1,123 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFanOutDispatcherShouldSendMetricsToBothDispatchers(t *testing.T) {
+	t.Parallel()
+	factory1 := newTestFactory()
+	factory2 := newTestFactory()
+	d1 := NewMetricDispatcher(2, 10, factory1)
+	d2 := NewMetricDispatcher(3, 10, factory2)
+	fd := NewFanOutDispatcher(d1, d2)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	var wgFinish sync.WaitGroup
+	wgFinish.Add(2)
+	for _, d := range []*MetricDispatcher{d1, d2} {
+		go func(d *MetricDispatcher) {
+			defer wgFinish.Done()
+			assert.Equal(t, context.Canceled, d.Run(ctx))
+		}(d)
+	}
+
+	numMetrics := 100
+	for i := 0; i < numMetrics; i++ {
+		m := &gostatsd.Metric{
+			Type:  gostatsd.COUNTER,
+			Name:  fmt.Sprintf("counter.metric.%d", i),
+			Tags:  gostatsd.Tags{"foo:bar"},
+			Value: 1,
+		}
+		assert.NoError(t, fd.DispatchMetric(ctx, m))
+	}
+	cancelFunc()    // After all metrics have been dispatched, we signal dispatchers to shut down
+	wgFinish.Wait() // Wait for dispatchers to drain queues and shutdown
+
+	factory1.Lock()
+	defer factory1.Unlock()
+	factory2.Lock()
+	defer factory2.Unlock()
+	assert.Equal(t, numMetrics, getTotalInvocations(factory1.receiveInvocations))
+	assert.Equal(t, numMetrics, getTotalInvocations(factory2.receiveInvocations))
+}
+
+func TestFanOutDispatcherProcessShouldWaitForBothDispatchers(t *testing.T) {
+	t.Parallel()
+	factory1 := newTestFactory()
+	factory2 := newTestFactory()
+	d1 := NewMetricDispatcher(2, 1, factory1)
+	d2 := NewMetricDispatcher(3, 1, factory2)
+	fd := NewFanOutDispatcher(d1, d2)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	var wgFinish sync.WaitGroup
+	wgFinish.Add(2)
+	for _, d := range []*MetricDispatcher{d1, d2} {
+		go func(d *MetricDispatcher) {
+			defer wgFinish.Done()
+			assert.Equal(t, context.Canceled, d.Run(ctx))
+		}(d)
+	}
+
+	var lock sync.Mutex
+	invocations := 0
+	wg := fd.Process(ctx, func(workerId uint16, aggr Aggregator) {
+		lock.Lock()
+		defer lock.Unlock()
+		invocations++
+	})
+	wg.Wait()
+	cancelFunc()
+	wgFinish.Wait()
+
+	assert.Equal(t, 5, invocations)
+}
+
+type failingDispatcher struct{}
+
+func (fd failingDispatcher) DispatchMetric(ctx context.Context, m *gostatsd.Metric) error {
+	return errors.New("dispatch failed")
+}
+
+func (fd failingDispatcher) Process(ctx context.Context, f DispatcherProcessFunc) *sync.WaitGroup {
+	return &sync.WaitGroup{}
+}
+
+type collectingDispatcher struct {
+	failingDispatcher
+	metrics []*gostatsd.Metric
+}
+
+func (cd *collectingDispatcher) DispatchMetric(ctx context.Context, m *gostatsd.Metric) error {
+	cd.metrics = append(cd.metrics, m)
+	return nil
+}
+
+func TestFanOutDispatcherShouldFeedSecondaryIfPrimaryFails(t *testing.T) {
+	t.Parallel()
+	secondary := &collectingDispatcher{}
+	fd := NewFanOutDispatcher(failingDispatcher{}, secondary)
+
+	m := &gostatsd.Metric{
+		Type:  gostatsd.COUNTER,
+		Name:  "counter.metric",
+		Tags:  gostatsd.Tags{"foo:bar"},
+		Value: 1,
+	}
+	assert.EqualError(t, fd.DispatchMetric(context.Background(), m), "dispatch failed")
+	if assert.Len(t, secondary.metrics, 1) {
+		assert.Equal(t, m, secondary.metrics[0])
+	}
+}
@@ -3,11 +3,13 @@ package statsd
 import (
 	"context"
 	"fmt"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statsd/cardinality"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -19,9 +21,62 @@ const (
 	packetsReceived    = internalMetric + "packets_received"
 	numStats           = internalMetric + "numStats"
 	aggregatorNumStats = internalMetric + "aggregator_num_stats"
+	droppedCounters    = internalMetric + "negative_counters_dropped"
 	processingTime     = internalMetric + "processing_time"
+	cardinalityKeys    = internalMetric + "cardinality_keys"
+	cardinalityNew     = internalMetric + "cardinality_new_keys"
+	cardinalityExpired = internalMetric + "cardinality_expired_keys"
+	clusterDropped     = internalMetric + "cluster_dropped_metrics"
+
+	// Numbers of keys per type, reported every --cardinality-report-every flushes.
+	cardinalityCounters = "gostatsd.internal.cardinality.counters"
+	cardinalityTimers   = "gostatsd.internal.cardinality.timers"
+	cardinalityGauges   = "gostatsd.internal.cardinality.gauges"
+	cardinalitySets     = "gostatsd.internal.cardinality.sets"
+
+	// Numbers of keys per type counted by the cardinality tracker, and metrics dropped because of its limit.
+	trackedCounters = "gostatsd.cardinality.counters"
+	trackedTimers   = "gostatsd.cardinality.timers"
+	trackedGauges   = "gostatsd.cardinality.gauges"
+	trackedSets     = "gostatsd.cardinality.sets"
+	trackedDropped  = "gostatsd.cardinality.dropped"
+)
+
+// CardinalityReport is how the numbers of distinct keys per metric type are reported on each flush.
+type CardinalityReport int
+
+const (
+	// CardinalityReportNone does not report cardinality.
+	CardinalityReportNone CardinalityReport = iota
+	// CardinalityReportLog logs cardinality and churn at the info level.
+	CardinalityReportLog
+	// CardinalityReportMetrics reports cardinality and churn as internal metrics tagged with the metric type.
+	CardinalityReportMetrics
 )
 
+var cardinalityReportNames = map[CardinalityReport]string{
+	CardinalityReportNone:    "none",
+	CardinalityReportLog:     "log",
+	CardinalityReportMetrics: "metrics",
+}
+
+func (r CardinalityReport) String() string {
+	if name, ok := cardinalityReportNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("CardinalityReport(%d)", int(r))
+}
+
+// ParseCardinalityReport returns the cardinality report with the name.
+func ParseCardinalityReport(name string) (CardinalityReport, error) {
+	for report, reportName := range cardinalityReportNames {
+		if reportName == name {
+			return report, nil
+		}
+	}
+	return CardinalityReportNone, fmt.Errorf("unknown cardinality report %q, must be one of none, log, metrics", name)
+}
+
 // MetricFlusher periodically flushes metrics from all Aggregators to Senders.
 type MetricFlusher struct {
 	// Counter fields below must be read/written only using atomic instructions.
@@ -34,92 +89,806 @@ type MetricFlusher struct {
 	dispatcher    Dispatcher
 	receiver      Receiver
 	handler       Handler
-	backends      []gostatsd.Backend
+	backends      []gostatsd.Backend // Backends metrics are sent to on each flush
+	schedules     []*backendSchedule // Backends metrics are sent to less often, see SetBackendFlushIntervals
 	selfIP        gostatsd.IP
 	hostname      string
 
+	percentileTemplate PercentileTemplate // Template of names of upper percentiles of merged timers
+
+	observers       []FlushObserver
+	observerTimeout time.Duration
+	errorThrottler  *errorThrottler
+	hostTag         string                // Tag added to all flushed metrics, empty if disabled
+	heartbeat       *gostatsd.Metric      // Dispatched on start and on each flush, nil if disabled
+	runtimePrefix   string                // Prefix of the names of Go runtime metrics
+	runtimeInterval time.Duration         // How often Go runtime metrics are dispatched, 0 if disabled
+	cardinality     CardinalityReport     // How cardinality of flushed metrics is reported
+	reportEvery     int                   // Number of flushes between cardinality reports
+	afterFlush      func()                // Called after each flush, nil if not set
+	payloads        *payloadHistograms    // Sizes of payloads serialized by backends
+	queues          map[string]*sendQueue // Send queues of backends by name, backends are sent to directly if nil
+	tenancy         *tenancy              // Partitions flushed metrics by tenant, nil if tenants are disabled
+	tracer          Tracer                // Traces flushes and sends to backends
+	forceFlush      chan chan FlushResult // Requests to flush immediately, the result is sent when the flush is done
+	leader          Leader                // Metrics are only sent to backends by the leader, always sent if nil
+	cluster         Cluster               // Metrics of names owned by other servers are shared with them, nil if disabled
+	unshared        *gostatsd.MetricMap   // Metrics of names owned by other servers received after they were shared
+	clusterDropped  int                   // Number of metrics the cluster dropped since internal stats were sent
+	client          MetricClient          // Internal metrics are sent with the client if set, dispatched to the handler otherwise
+
+	statusLock      sync.Mutex
+	backendStatuses map[string]BackendStatus
+
+	// Keys counted by the tracker and metrics dropped because of its limit are reported on each flush if set.
+	tracker *cardinality.CardinalityTracker
+
+	// Cardinality churn of the flushes since the last cardinality report.
+	unreportedFlushes     int
+	unreportedNewKeys     gostatsd.KeyCounts
+	unreportedExpiredKeys gostatsd.KeyCounts
+
 	// Sent statistics for Receiver. Keep sent values to calculate diff.
 	sentBadLines        uint64
 	sentPacketsReceived uint64
 	sentMetricsReceived uint64
+	// Sent metrics dropped by the cardinality tracker.
+	sentTrackedDropped uint64
 }
 
 // NewMetricFlusher creates a new MetricFlusher with provided configuration.
 func NewMetricFlusher(flushInterval time.Duration, dispatcher Dispatcher, receiver Receiver, handler Handler, backends []gostatsd.Backend, selfIP gostatsd.IP, hostname string) *MetricFlusher {
+	statuses := make(map[string]BackendStatus, len(backends))
+	for _, backend := range backends {
+		statuses[backend.Name()] = BackendStatus{Name: backend.Name()}
+	}
+	payloads := newPayloadHistograms()
+	for _, backend := range backends {
+		if reporter, ok := backend.(gostatsd.PayloadReporter); ok {
+			reporter.SetPayloadObserver(payloads.observer(backend.Name()))
+		}
+	}
 	return &MetricFlusher{
-		flushInterval: flushInterval,
-		dispatcher:    dispatcher,
-		receiver:      receiver,
-		handler:       handler,
-		backends:      backends,
-		selfIP:        selfIP,
-		hostname:      hostname,
+		flushInterval:   flushInterval,
+		dispatcher:      dispatcher,
+		receiver:        receiver,
+		handler:         handler,
+		backends:        backends,
+		selfIP:          selfIP,
+		hostname:        hostname,
+		errorThrottler:  newErrorThrottler(DefaultBackendErrorLogInterval),
+		payloads:        payloads,
+		forceFlush:      make(chan chan FlushResult),
+		backendStatuses: statuses,
+		tracer:          nopTracer{},
+		reportEvery:     1,
+	}
+}
+
+// SetTracer sets the tracer of flushes. Must be called before Run.
+func (f *MetricFlusher) SetTracer(tracer Tracer) {
+	f.tracer = tracer
+}
+
+// SetFlushObservers sets the observers notified on each flush.
+// Each observer is executed with the timeout and its panics are recovered. Must be called before Run.
+func (f *MetricFlusher) SetFlushObservers(timeout time.Duration, observers ...FlushObserver) {
+	f.observerTimeout = timeout
+	f.observers = observers
+}
+
+// SetErrorLogInterval sets the interval identical backend errors are not logged for after the first occurrence.
+// A summary of suppressed errors is logged at the end of the interval. 0 disables throttling. Must be called before Run.
+func (f *MetricFlusher) SetErrorLogInterval(interval time.Duration) {
+	f.errorThrottler = newErrorThrottler(interval)
+}
+
+// SetHostTag sets the tag added to all flushed metrics. The tag is not added to aggregated metrics so it does not
+// change how metrics are merged. Empty tag disables it. Must be called before Run.
+func (f *MetricFlusher) SetHostTag(tag string) {
+	f.hostTag = tag
+}
+
+// SetHeartbeat enables a metric dispatched on start and on each flush so that it is flushed every flush interval even
+// if no metrics are received, e.g. to alert when the server stops flushing. Must be called before Run.
+func (f *MetricFlusher) SetHeartbeat(name string, metricType gostatsd.MetricType, value float64) {
+	f.heartbeat = &gostatsd.Metric{
+		Name:  name,
+		Value: value,
+		Type:  metricType,
+	}
+}
+
+// SetRuntimeMetrics enables gauges with statistics of the Go runtime of the server, such as the heap size, the last
+// GC pause, the number of GCs and the number of goroutines, named with the prefix. They are dispatched on start and
+// every interval and flushed like received gauges. Must be called before Run.
+func (f *MetricFlusher) SetRuntimeMetrics(prefix string, interval time.Duration) {
+	f.runtimePrefix = prefix
+	f.runtimeInterval = interval
+}
+
+// ParseHeartbeatType returns the type of the heartbeat metric with the name.
+func ParseHeartbeatType(name string) (gostatsd.MetricType, error) {
+	switch name {
+	case gostatsd.GAUGE.String():
+		return gostatsd.GAUGE, nil
+	case gostatsd.COUNTER.String():
+		return gostatsd.COUNTER, nil
+	}
+	return 0, fmt.Errorf("unknown heartbeat type %q, must be one of gauge, counter", name)
+}
+
+// SetPayloadBuckets sets the upper bounds in bytes of buckets of histograms of sizes of payloads serialized by
+// backends. Bounds must be positive and increasing. Must be called before Run.
+func (f *MetricFlusher) SetPayloadBuckets(bounds []int) error {
+	return f.payloads.setBounds(bounds)
+}
+
+// SetBackendQueues queues flushes sent to each backend so that slow backends do not delay flushes. Each backend
+// is sent one flush at a time, up to size flushes are queued and the policy is applied when its queue is full.
+// Flushes do not wait for queued sends, so their results do not include errors of queued sends.
+// Must be called before Run.
+func (f *MetricFlusher) SetBackendQueues(size int, policy QueuePolicy) error {
+	if err := checkBackendQueues(size, policy); err != nil {
+		return err
+	}
+	f.queues = make(map[string]*sendQueue)
+	for _, backend := range f.backends {
+		f.queues[backend.Name()] = newSendQueue(backend, size, policy)
+	}
+	for _, s := range f.schedules {
+		f.queues[s.backend.Name()] = newSendQueue(s.backend, size, policy)
+	}
+	return nil
+}
+
+// SetTenants partitions flushed metrics by the tenant tag set by a TenantHandler. Metrics of each tenant are
+// prefixed with the prefix of the tenant and only sent to its backends. Metrics without a known tenant belong
+// to the default tenant. Must be called before Run.
+func (f *MetricFlusher) SetTenants(tenants []Tenant, defaultTenant string) error {
+	if err := checkTenantBackends(f.backendNames(), tenants); err != nil {
+		return err
+	}
+	t, err := newTenancy(tenants, defaultTenant)
+	if err != nil {
+		return err
+	}
+	f.tenancy = t
+	return nil
+}
+
+// SetCardinalityReport sets how the numbers of distinct keys per type, new keys and expired keys are reported every
+// given number of flushes. The numbers of new and expired keys include all flushes since the previous report, keys
+// expired after a flush are reported on the next flush. Must be called before Run.
+func (f *MetricFlusher) SetCardinalityReport(report CardinalityReport, every int) error {
+	if err := checkCardinalityReportEvery(every); err != nil {
+		return err
+	}
+	f.cardinality = report
+	f.reportEvery = every
+	return nil
+}
+
+// SetCardinalityTracker reports the numbers of keys per type counted by the tracker and the number of metrics
+// dropped because of its limit as internal metrics on each flush. Must be called before Run.
+func (f *MetricFlusher) SetCardinalityTracker(t *cardinality.CardinalityTracker) {
+	f.tracker = t
+}
+
+// SetAfterFlush sets the function called after each flush once aggregators have been reset. Must be called before Run.
+func (f *MetricFlusher) SetAfterFlush(afterFlush func()) {
+	f.afterFlush = afterFlush
+}
+
+// SetLeader sets the leader election of servers aggregating the same metrics. Metrics are still aggregated and
+// reset on each flush, but they are only sent to backends while the server is the leader. Must be called before Run.
+func (f *MetricFlusher) SetLeader(leader Leader) {
+	f.leader = leader
+}
+
+// SetCluster sets the cluster of servers sharing the aggregation of metrics. On each flush, metrics of names owned
+// by other servers are removed from aggregators and shared with their owners, then metrics shared by other servers
+// are merged into aggregators before they are flushed. Must be called before Run.
+func (f *MetricFlusher) SetCluster(cluster Cluster) {
+	f.cluster = cluster
+	f.unshared = newMetricMap()
+}
+
+// SetMetricClient sets the client internal metrics are sent with, instead of dispatching them to the handler. Must be
+// called before Run.
+func (f *MetricFlusher) SetMetricClient(client MetricClient) {
+	f.client = client
+}
+
+// SetPercentileTemplate sets the template of the names of upper percentiles of timers merged for backends with longer
+// flush intervals, see SetBackendFlushIntervals. Must be called before Run.
+func (f *MetricFlusher) SetPercentileTemplate(template PercentileTemplate) {
+	f.percentileTemplate = template
+	for _, s := range f.schedules {
+		s.percentileTemplate = template
+		s.reset()
+	}
+}
+
+// SetBackendFlushIntervals sets flush intervals of backends by name. Metrics of the flushes in between are merged
+// and summarized using the percentiles when they are sent to the backend. Intervals must be multiples of the flush
+// interval, backends without an interval are sent metrics on each flush. Must be called before Run.
+func (f *MetricFlusher) SetBackendFlushIntervals(intervals map[string]time.Duration, percentThresholds []float64) error {
+	if err := checkBackendFlushIntervals(f.backendNames(), f.flushInterval, intervals); err != nil {
+		return err
+	}
+	var everyFlush []gostatsd.Backend
+	var schedules []*backendSchedule
+	for _, backend := range f.backends {
+		every := int(intervals[backend.Name()] / f.flushInterval)
+		if every <= 1 {
+			everyFlush = append(everyFlush, backend)
+			continue
+		}
+		s := &backendSchedule{backend: backend, every: every, percentThresholds: percentThresholds, percentileTemplate: f.percentileTemplate}
+		s.reset()
+		schedules = append(schedules, s)
+	}
+	f.backends = everyFlush
+	f.schedules = schedules
+	return nil
+}
+
+// SetBackendTimeouts bounds sends of metrics to backends by their timeouts, independently of the flush interval.
+// A send that does not finish within the timeout of its backend fails with a timeout error and the flush does not
+// wait for it. Must be called after SetBackendFlushIntervals and before SetBackendQueues and Run.
+func (f *MetricFlusher) SetBackendTimeouts(timeouts map[string]time.Duration) error {
+	if err := checkBackendTimeouts(f.backendNames(), timeouts); err != nil {
+		return err
+	}
+	for i, backend := range f.backends {
+		if timeout, ok := timeouts[backend.Name()]; ok {
+			f.backends[i] = &timeoutBackend{Backend: backend, timeout: timeout}
+		}
+	}
+	for _, s := range f.schedules {
+		if timeout, ok := timeouts[s.backend.Name()]; ok {
+			s.backend = &timeoutBackend{Backend: s.backend, timeout: timeout}
+		}
+	}
+	return nil
+}
+
+// SetSkipEmptyFlushes stops sending metric maps without metrics to the backends, which are otherwise sent the
+// metrics of each aggregator on each flush even if none were received, so that backends can tell the server is
+// alive. Must be called after SetBackendFlushIntervals and before SetBackendQueues and Run.
+func (f *MetricFlusher) SetSkipEmptyFlushes(backends []string) error {
+	if err := checkSkipEmptyFlushes(f.backendNames(), backends); err != nil {
+		return err
+	}
+	skip := make(map[string]bool, len(backends))
+	for _, name := range backends {
+		skip[name] = true
+	}
+	for i, backend := range f.backends {
+		if skip[backend.Name()] {
+			f.backends[i] = &skipEmptyBackend{Backend: backend}
+		}
+	}
+	for _, s := range f.schedules {
+		if skip[s.backend.Name()] {
+			s.backend = &skipEmptyBackend{Backend: s.backend}
+		}
+	}
+	return nil
+}
+
+// SetValuePrecision rounds the float values of metrics sent to all backends to the number of significant digits,
+// ties are rounded to even. Backends serializing values as text, see gostatsd.ValuePrecisionSetter, also format
+// them with that many digits. Must be called after SetBackendFlushIntervals and before SetBackendQueues and Run.
+func (f *MetricFlusher) SetValuePrecision(digits int) error {
+	if err := checkValuePrecision(digits); err != nil {
+		return err
+	}
+	for i, backend := range f.backends {
+		f.backends[i] = newPrecisionBackend(backend, digits)
+	}
+	for _, s := range f.schedules {
+		s.backend = newPrecisionBackend(s.backend, digits)
+	}
+	return nil
+}
+
+// backendNames returns the names of the backends, including backends flushed less often.
+func (f *MetricFlusher) backendNames() map[string]bool {
+	backends := make(map[string]bool, len(f.backends)+len(f.schedules))
+	for _, backend := range f.backends {
+		backends[backend.Name()] = true
+	}
+	for _, s := range f.schedules {
+		backends[s.backend.Name()] = true
+	}
+	return backends
+}
+
+// checkBackendFlushIntervals checks that the backends with flush intervals exist and that their intervals are
+// multiples of the flush interval.
+func checkBackendFlushIntervals(backends map[string]bool, flushInterval time.Duration, intervals map[string]time.Duration) error {
+	for name, interval := range intervals {
+		if !backends[name] {
+			return fmt.Errorf("flush interval of unknown backend %s", name)
+		}
+		if flushInterval <= 0 || interval <= 0 || interval%flushInterval != 0 {
+			return fmt.Errorf("flush interval %v of backend %s must be a multiple of the flush interval %v", interval, name, flushInterval)
+		}
+	}
+	return nil
+}
+
+// checkBackendTimeouts checks that the backends with timeouts exist and that their timeouts are positive.
+func checkBackendTimeouts(backends map[string]bool, timeouts map[string]time.Duration) error {
+	for name, timeout := range timeouts {
+		if !backends[name] {
+			return fmt.Errorf("timeout of unknown backend %s", name)
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("timeout %v of backend %s must be positive", timeout, name)
+		}
+	}
+	return nil
+}
+
+// checkSkipEmptyFlushes checks that the backends not sent empty flushes exist.
+func checkSkipEmptyFlushes(backends map[string]bool, names []string) error {
+	for _, name := range names {
+		if !backends[name] {
+			return fmt.Errorf("skipping empty flushes of unknown backend %s", name)
+		}
+	}
+	return nil
+}
+
+// checkCardinalityReportEvery checks that the number of flushes between cardinality reports is positive.
+func checkCardinalityReportEvery(every int) error {
+	if every <= 0 {
+		return fmt.Errorf("number of flushes between cardinality reports %d must be positive", every)
+	}
+	return nil
+}
+
+// checkValuePrecision checks that the number of significant digits of values is positive.
+func checkValuePrecision(digits int) error {
+	if digits <= 0 {
+		return fmt.Errorf("value precision %d must be a positive number of significant digits", digits)
 	}
+	return nil
+}
+
+// checkBackendQueues checks the size and the policy of backend send queues.
+func checkBackendQueues(size int, policy QueuePolicy) error {
+	if size <= 0 {
+		return fmt.Errorf("backend queue size %d must be positive", size)
+	}
+	if _, ok := queuePolicyNames[policy]; !ok {
+		return fmt.Errorf("unknown queue policy %v", policy)
+	}
+	return nil
+}
+
+// checkTenantBackends checks that the backends of the tenants exist.
+func checkTenantBackends(backends map[string]bool, tenants []Tenant) error {
+	for _, tenant := range tenants {
+		for _, name := range tenant.Backends {
+			if !backends[name] {
+				return fmt.Errorf("tenant %s: unknown backend %s", tenant.Name, name)
+			}
+		}
+	}
+	return nil
 }
 
 // Run runs the MetricFlusher.
 func (f *MetricFlusher) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	defer wg.Wait() // Wait for queues to stop sending
+	wg.Add(len(f.queues))
+	for _, q := range f.queues {
+		go func(q *sendQueue) {
+			defer wg.Done()
+			q.run(ctx)
+		}(q)
+	}
+	if f.heartbeat != nil {
+		f.dispatchMetrics(ctx, []gostatsd.Metric{*f.heartbeat}) // Flushed by the first flush
+	}
+	var runtimeTick <-chan time.Time // Never ticks if runtime metrics are disabled
+	if f.runtimeInterval > 0 {
+		f.dispatchMetrics(ctx, runtimeMetrics(f.runtimePrefix))
+		runtimeTicker := time.NewTicker(f.runtimeInterval)
+		defer runtimeTicker.Stop()
+		runtimeTick = runtimeTicker.C
+	}
 	flushTicker := time.NewTicker(f.flushInterval)
-	defer flushTicker.Stop()
+	defer func() {
+		flushTicker.Stop()
+	}()
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case <-flushTicker.C: // Time to flush to the backends
-			dispatcherStats := f.flushData(ctx)
-			f.dispatchInternalStats(ctx, dispatcherStats)
+			f.flush(ctx, false)
+		case done := <-f.forceFlush:
+			done <- f.flush(ctx, true)
+			// Restart the interval so that the regular flush does not follow the forced one immediately
+			flushTicker.Stop()
+			flushTicker = time.NewTicker(f.flushInterval)
+		case <-runtimeTick:
+			f.dispatchMetrics(ctx, runtimeMetrics(f.runtimePrefix))
+		}
+	}
+}
+
+// ForceFlush requests Run to flush metrics immediately and waits for the flush to finish.
+// Flushes are serialized with the regular flushes. Metrics merged for backends with longer flush intervals are sent too.
+func (f *MetricFlusher) ForceFlush(ctx context.Context) (FlushResult, error) {
+	done := make(chan FlushResult, 1) // Buffered so Run does not block if the context is done
+	select {
+	case <-ctx.Done():
+		return FlushResult{}, ctx.Err()
+	case f.forceFlush <- done:
+	}
+	select {
+	case <-ctx.Done():
+		return FlushResult{}, ctx.Err()
+	case result := <-done:
+		return result, nil
+	}
+}
+
+func (f *MetricFlusher) flush(ctx context.Context, forced bool) FlushResult {
+	dispatcherStats, result := f.flushData(ctx, forced)
+	if f.afterFlush != nil {
+		f.afterFlush()
+	}
+	f.dispatchInternalStats(ctx, dispatcherStats)
+	f.errorThrottler.logSummaries()
+	return result
+}
+
+// exchangeShared removes the metrics of names owned by other servers from aggregators and shares them with their
+// owners, then waits for the metrics shared by other servers and dispatches them so that they are flushed with the
+// metrics owned by this server. Forced flushes do not wait for other servers, they merge what was already shared.
+func (f *MetricFlusher) exchangeShared(ctx context.Context, forced bool) {
+	shared := f.unshared
+	f.unshared = newMetricMap()
+	var lock sync.Mutex
+	f.dispatcher.Process(ctx, func(workerId uint16, aggr Aggregator) {
+		aggr.Process(func(m *gostatsd.MetricMap) {
+			s := extractShared(m, f.cluster)
+			lock.Lock()
+			defer lock.Unlock()
+			mergeMetricMap(shared, s)
+		})
+	}).Wait()
+	f.clusterDropped += f.cluster.Share(ctx, shared)
+	timeout := f.flushInterval / 2
+	if forced {
+		timeout = 0
+	}
+	for _, m := range f.cluster.Gather(ctx, timeout) {
+		if _, err := SeedMetricState(ctx, f.dispatcher, m); unexpectedErr(err) {
+			log.Warnf("Failed to merge metrics shared by the cluster: %v", err)
 		}
 	}
 }
 
+// BackendStatuses returns statuses of all backends sorted by name.
+func (f *MetricFlusher) BackendStatuses() []BackendStatus {
+	f.statusLock.Lock()
+	defer f.statusLock.Unlock()
+	result := make(backendStatuses, 0, len(f.backendStatuses))
+	for _, status := range f.backendStatuses {
+		result = append(result, status)
+	}
+	sort.Sort(result)
+	return result
+}
+
 // GetStats returns MetricFlusher statistics.
 func (f *MetricFlusher) GetStats() FlusherStats {
+	var queues queueStats
+	for _, q := range f.queues {
+		queues = append(queues, q.stats())
+	}
+	sort.Sort(queues)
 	return FlusherStats{
-		time.Unix(0, atomic.LoadInt64(&f.lastFlush)),
-		time.Unix(0, atomic.LoadInt64(&f.lastFlushError)),
+		LastFlush:      time.Unix(0, atomic.LoadInt64(&f.lastFlush)),
+		LastFlushError: time.Unix(0, atomic.LoadInt64(&f.lastFlushError)),
+		Payloads:       f.payloads.snapshot(),
+		Queues:         queues,
 	}
 }
 
-func (f *MetricFlusher) flushData(ctx context.Context) map[uint16]gostatsd.MetricStats {
+// flushData sends metrics of all aggregators to backends. Backends with longer flush intervals are sent merged
+// metrics if their interval is over or if the flush is forced.
+func (f *MetricFlusher) flushData(ctx context.Context, forced bool) (map[uint16]gostatsd.MetricStats, FlushResult) {
+	ctx, end := f.tracer.Start(ctx, "flush")
 	var lock sync.Mutex
 	dispatcherStats := make(map[uint16]gostatsd.MetricStats)
+	var result FlushResult
+	defer func() {
+		end(result.Err)
+	}()
+	onError := func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		result.Err = err
+	}
+	var flushed *gostatsd.MetricMap
+	if len(f.observers) > 0 {
+		flushed = newMetricMap()
+	}
+	leader := f.leader == nil || f.leader.IsLeader()
+	if !leader {
+		log.Debug("Not the leader, metrics are not sent to backends")
+	}
+	if f.cluster != nil {
+		f.exchangeShared(ctx, forced)
+	}
 	var sendWg sync.WaitGroup
 	processWg := f.dispatcher.Process(ctx, func(workerId uint16, aggr Aggregator) {
+		if f.cluster != nil {
+			// Received since metrics were shared, shared with the next flush
+			aggr.Process(func(m *gostatsd.MetricMap) {
+				s := extractShared(m, f.cluster)
+				lock.Lock()
+				defer lock.Unlock()
+				mergeMetricMap(f.unshared, s)
+			})
+		}
 		aggr.Flush(f.flushInterval)
 		aggr.Process(func(m *gostatsd.MetricMap) {
-			f.sendMetricsAsync(ctx, &sendWg, m)
+			untagged := m
+			if f.hostTag != "" {
+				m = withTag(m, f.hostTag)
+			}
+			if leader {
+				f.sendMetricsAsync(ctx, &sendWg, f.backends, m, onError)
+			}
 			lock.Lock()
 			defer lock.Unlock()
 			dispatcherStats[workerId] = m.MetricStats
+			result.NumStats += m.NumStats
+			if flushed != nil {
+				mergeMetricMap(flushed, m) // Copy because aggregator is reset after this function
+			}
+			for _, s := range f.schedules {
+				mergeMetricMap(&s.pending.MetricMap, untagged)
+			}
 		})
 		aggr.Reset()
 	})
 	processWg.Wait() // Wait for all workers to execute function
-	sendWg.Wait()    // Wait for all backends to finish sending
 
-	return dispatcherStats
+	var sent []*backendSchedule
+	for _, s := range f.schedules {
+		s.flushes++
+		if s.flushes < s.every && !forced {
+			continue
+		}
+		if leader {
+			m := s.summarize(time.Duration(s.flushes) * f.flushInterval)
+			if f.hostTag != "" {
+				m = withTag(m, f.hostTag)
+			}
+			f.sendMetricsAsync(ctx, &sendWg, []gostatsd.Backend{s.backend}, m, onError)
+		}
+		sent = append(sent, s)
+	}
+	sendWg.Wait() // Wait for all backends to finish sending
+	for _, s := range sent {
+		s.reset()
+	}
+
+	if flushed != nil {
+		f.notifyObservers(ctx, flushed)
+	}
+
+	return dispatcherStats, result
 }
 
-func (f *MetricFlusher) sendMetricsAsync(ctx context.Context, wg *sync.WaitGroup, m *gostatsd.MetricMap) {
-	wg.Add(len(f.backends))
-	for _, backend := range f.backends {
+// backendSchedule merges metrics of several flushes for a backend with a longer flush interval.
+type backendSchedule struct {
+	backend            gostatsd.Backend
+	every              int               // Number of flushes between sends to the backend
+	flushes            int               // Number of flushes merged into pending
+	pending            *MetricAggregator // Metrics merged since the last send
+	percentThresholds  []float64
+	percentileTemplate PercentileTemplate
+}
+
+// summarize calculates summaries of the merged metrics over the interval.
+func (s *backendSchedule) summarize(interval time.Duration) *gostatsd.MetricMap {
+	s.pending.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		timer.Percentiles = nil // Recalculated from merged values by Flush
+		s.pending.Timers[key][tagsKey] = timer
+	})
+	s.pending.Flush(interval)
+	return &s.pending.MetricMap
+}
+
+// reset discards the merged metrics. Metrics that were not updated are still merged with zero values on the next
+// flush until they expire in the aggregators.
+func (s *backendSchedule) reset() {
+	s.pending = NewMetricAggregator(s.percentThresholds, 0)
+	s.pending.SetPercentileTemplate(s.percentileTemplate)
+	s.flushes = 0
+}
+
+// withTag returns a shallow copy of the MetricMap with the tag added to all metrics.
+// Tags of the original MetricMap are not modified.
+func withTag(m *gostatsd.MetricMap, tag string) *gostatsd.MetricMap {
+	result := &gostatsd.MetricMap{
+		MetricStats:   m.MetricStats,
+		FlushInterval: m.FlushInterval,
+		Counters:      make(gostatsd.Counters, len(m.Counters)),
+		Timers:        make(gostatsd.Timers, len(m.Timers)),
+		Gauges:        make(gostatsd.Gauges, len(m.Gauges)),
+		Sets:          make(gostatsd.Sets, len(m.Sets)),
+	}
+	addTag := func(tags gostatsd.Tags) gostatsd.Tags {
+		return append(tags[:len(tags):len(tags)], tag) // Force a copy
+	}
+	for key, value := range m.Counters {
+		v := make(map[string]gostatsd.Counter, len(value))
+		for tagsKey, counter := range value {
+			counter.Tags = addTag(counter.Tags)
+			v[tagsKey] = counter
+		}
+		result.Counters[key] = v
+	}
+	for key, value := range m.Timers {
+		v := make(map[string]gostatsd.Timer, len(value))
+		for tagsKey, timer := range value {
+			timer.Tags = addTag(timer.Tags)
+			v[tagsKey] = timer
+		}
+		result.Timers[key] = v
+	}
+	for key, value := range m.Gauges {
+		v := make(map[string]gostatsd.Gauge, len(value))
+		for tagsKey, gauge := range value {
+			gauge.Tags = addTag(gauge.Tags)
+			v[tagsKey] = gauge
+		}
+		result.Gauges[key] = v
+	}
+	for key, value := range m.Sets {
+		v := make(map[string]gostatsd.Set, len(value))
+		for tagsKey, set := range value {
+			set.Tags = addTag(set.Tags)
+			v[tagsKey] = set
+		}
+		result.Sets[key] = v
+	}
+	return result
+}
+
+// notifyObservers concurrently executes all observers and waits for them to finish or time out.
+func (f *MetricFlusher) notifyObservers(ctx context.Context, m *gostatsd.MetricMap) {
+	if f.observerTimeout > 0 {
+		var cancelFunc context.CancelFunc
+		ctx, cancelFunc = context.WithTimeout(ctx, f.observerTimeout)
+		defer cancelFunc()
+	}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(len(f.observers))
+	for _, observer := range f.observers {
+		go func(observer FlushObserver) {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("Flush observer panicked: %v", r)
+				}
+			}()
+			observer(ctx, m)
+		}(observer)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+		log.Warnf("Flush observers did not finish in time: %v", ctx.Err())
+	case <-done:
+	}
+}
+
+// sendMetricsAsync sends the metrics to the backends. onError is called with the last error of each failed send.
+// If tenants are enabled, metrics of each tenant are only sent to its backends.
+func (f *MetricFlusher) sendMetricsAsync(ctx context.Context, wg *sync.WaitGroup, backends []gostatsd.Backend, m *gostatsd.MetricMap, onError func(error)) {
+	if f.tenancy == nil {
+		f.sendToBackends(ctx, wg, backends, m, onError)
+		return
+	}
+	for _, tm := range f.tenancy.split(m) {
+		f.sendToBackends(ctx, wg, tm.route(backends), tm.m, onError)
+	}
+}
+
+// sendToBackends sends the metrics to the backends. Metrics are copied for and pushed to the queues of backends
+// that have one, the wait group does not wait for them.
+func (f *MetricFlusher) sendToBackends(ctx context.Context, wg *sync.WaitGroup, backends []gostatsd.Backend, m *gostatsd.MetricMap, onError func(error)) {
+	var queued *gostatsd.MetricMap
+	for _, backend := range backends {
 		log.Debugf("Sending %d metrics to backend %s", m.NumStats, backend.Name())
-		backend.SendMetricsAsync(ctx, m, func(errs []error) {
+		backendName := backend.Name()
+		if q := f.queues[backendName]; q != nil {
+			if queued == nil {
+				queued = newMetricMap()
+				mergeMetricMap(queued, m) // Copy because aggregators are reset before queued metrics are sent
+			}
+			_, end := f.tracer.Start(ctx, "send:"+backendName) // Not ended if the flush is not queued or dropped
+			err := q.push(ctx, queued, func(errs []error) {
+				end(f.handleSendResult(backendName, errs))
+			})
+			if err == errQueueFull {
+				f.errorThrottler.logError(backendName, err)
+			}
+			continue
+		}
+		wg.Add(1)
+		sctx, end := f.tracer.Start(ctx, "send:"+backendName)
+		backend.SendMetricsAsync(sctx, m, func(errs []error) {
 			defer wg.Done()
-			f.handleSendResult(errs)
+			err := f.handleSendResult(backendName, errs)
+			end(err)
+			if err != nil {
+				onError(err)
+			}
 		})
 	}
 }
 
-func (f *MetricFlusher) handleSendResult(flushResults []error) {
+// handleSendResult records the result of a send to the backend and returns its last error.
+func (f *MetricFlusher) handleSendResult(backendName string, flushResults []error) error {
 	timestampPointer := &f.lastFlush
+	var lastErr error
 	for _, err := range flushResults {
 		if err != nil {
 			timestampPointer = &f.lastFlushError
-			log.Errorf("Sending metrics to backend failed: %v", err)
+			lastErr = err
+			f.errorThrottler.logError(backendName, err)
 		}
 	}
-	atomic.StoreInt64(timestampPointer, time.Now().UnixNano())
+	now := time.Now()
+	atomic.StoreInt64(timestampPointer, now.UnixNano())
+
+	f.statusLock.Lock()
+	defer f.statusLock.Unlock()
+	status := f.backendStatuses[backendName]
+	status.Name = backendName
+	if lastErr != nil {
+		status.LastError = now
+		status.LastErrorMessage = lastErr.Error()
+	} else {
+		status.LastSuccess = now
+	}
+	f.backendStatuses[backendName] = status
+	return lastErr
+}
+
+// backendStatuses sorts by name.
+type backendStatuses []BackendStatus
+
+func (b backendStatuses) Len() int {
+	return len(b)
+}
+
+func (b backendStatuses) Less(i, j int) bool {
+	return b[i].Name < b[j].Name
+}
+
+func (b backendStatuses) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
 }
 
 func (f *MetricFlusher) dispatchInternalStats(ctx context.Context, dispatcherStats map[uint16]gostatsd.MetricStats) {
@@ -142,9 +911,14 @@ func (f *MetricFlusher) dispatchInternalStats(ctx context.Context, dispatcherSta
 			Value: float64(packetsReceivedValue),
 			Type:  gostatsd.COUNTER,
 		})
-	var totalStats uint32
+	var totalStats, totalDropped uint32
+	var keys, newKeys, expiredKeys gostatsd.KeyCounts
 	for workerID, stat := range dispatcherStats {
 		totalStats += stat.NumStats
+		totalDropped += stat.DroppedCounters
+		keys.Add(stat.Keys)
+		newKeys.Add(stat.NewKeys)
+		expiredKeys.Add(stat.ExpiredKeys)
 		tag := fmt.Sprintf("aggregator_id:%d", workerID)
 		metrics = append(metrics,
 			gostatsd.Metric{
@@ -165,12 +939,86 @@ func (f *MetricFlusher) dispatchInternalStats(ctx context.Context, dispatcherSta
 		Value: float64(totalStats),
 		Type:  gostatsd.COUNTER,
 	})
+	if totalDropped > 0 {
+		metrics = append(metrics, gostatsd.Metric{
+			Name:  droppedCounters,
+			Value: float64(totalDropped),
+			Type:  gostatsd.COUNTER,
+		})
+	}
+	if f.clusterDropped > 0 {
+		metrics = append(metrics, gostatsd.Metric{
+			Name:  clusterDropped,
+			Value: float64(f.clusterDropped),
+			Type:  gostatsd.COUNTER,
+		})
+		f.clusterDropped = 0
+	}
+	metrics = append(metrics, f.reportCardinality(keys, newKeys, expiredKeys)...)
+	if f.tracker != nil {
+		trackedKeys, dropped := f.tracker.Report()
+		metrics = append(metrics,
+			gostatsd.Metric{Name: trackedCounters, Value: float64(trackedKeys.Counters), Type: gostatsd.GAUGE},
+			gostatsd.Metric{Name: trackedTimers, Value: float64(trackedKeys.Timers), Type: gostatsd.GAUGE},
+			gostatsd.Metric{Name: trackedGauges, Value: float64(trackedKeys.Gauges), Type: gostatsd.GAUGE},
+			gostatsd.Metric{Name: trackedSets, Value: float64(trackedKeys.Sets), Type: gostatsd.GAUGE},
+			gostatsd.Metric{Name: trackedDropped, Value: float64(dropped - f.sentTrackedDropped), Type: gostatsd.COUNTER})
+		f.sentTrackedDropped = dropped
+	}
+	if f.heartbeat != nil {
+		metrics = append(metrics, *f.heartbeat)
+	}
 	log.Debugf("numStats: %d packetsReceived: %d", totalStats, packetsReceivedValue)
 
 	f.sentBadLines = receiverStats.BadLines
 	f.sentMetricsReceived = receiverStats.MetricsReceived
 	f.sentPacketsReceived = receiverStats.PacketsReceived
 
+	f.dispatchMetrics(ctx, metrics)
+}
+
+// reportCardinality accumulates the new and expired keys of a flush and, once every reportEvery flushes, returns
+// the counters of the current numbers of keys per type. The churn is reported with them as set by
+// SetCardinalityReport.
+func (f *MetricFlusher) reportCardinality(keys, newKeys, expiredKeys gostatsd.KeyCounts) []gostatsd.Metric {
+	f.unreportedFlushes++
+	f.unreportedNewKeys.Add(newKeys)
+	f.unreportedExpiredKeys.Add(expiredKeys)
+	if f.unreportedFlushes < f.reportEvery {
+		return nil
+	}
+	newKeys, expiredKeys = f.unreportedNewKeys, f.unreportedExpiredKeys
+	f.unreportedFlushes = 0
+	f.unreportedNewKeys = gostatsd.KeyCounts{}
+	f.unreportedExpiredKeys = gostatsd.KeyCounts{}
+	metrics := []gostatsd.Metric{
+		{Name: cardinalityCounters, Value: float64(keys.Counters), Type: gostatsd.COUNTER},
+		{Name: cardinalityTimers, Value: float64(keys.Timers), Type: gostatsd.COUNTER},
+		{Name: cardinalityGauges, Value: float64(keys.Gauges), Type: gostatsd.COUNTER},
+		{Name: cardinalitySets, Value: float64(keys.Sets), Type: gostatsd.COUNTER},
+	}
+	switch f.cardinality {
+	case CardinalityReportLog:
+		log.Infof("Cardinality: counters: %d (+%d -%d) timers: %d (+%d -%d) gauges: %d (+%d -%d) sets: %d (+%d -%d)",
+			keys.Counters, newKeys.Counters, expiredKeys.Counters,
+			keys.Timers, newKeys.Timers, expiredKeys.Timers,
+			keys.Gauges, newKeys.Gauges, expiredKeys.Gauges,
+			keys.Sets, newKeys.Sets, expiredKeys.Sets)
+	case CardinalityReportMetrics:
+		metrics = append(metrics, cardinalityMetrics(keys, newKeys, expiredKeys)...)
+	}
+	return metrics
+}
+
+// dispatchMetrics dispatches internal metrics with the IP and hostname of the server, or sends them with the client
+// if set.
+func (f *MetricFlusher) dispatchMetrics(ctx context.Context, metrics []gostatsd.Metric) {
+	if f.client != nil {
+		if err := f.client.SendMetrics(ctx, metrics); unexpectedErr(err) {
+			log.Warnf("Failed to send internal metrics: %v", err)
+		}
+		return
+	}
 	for _, metric := range metrics {
 		m := metric // Copy into a new variable
 		m.SourceIP = f.selfIP
@@ -183,3 +1031,24 @@ func (f *MetricFlusher) dispatchInternalStats(ctx context.Context, dispatcherSta
 		}
 	}
 }
+
+// cardinalityMetrics returns internal metrics with the numbers of keys, new keys and expired keys per type.
+func cardinalityMetrics(keys, newKeys, expiredKeys gostatsd.KeyCounts) []gostatsd.Metric {
+	metrics := make([]gostatsd.Metric, 0, 12)
+	for _, k := range []struct {
+		name       string
+		metricType gostatsd.MetricType
+		counts     gostatsd.KeyCounts
+	}{
+		{cardinalityKeys, gostatsd.GAUGE, keys},
+		{cardinalityNew, gostatsd.COUNTER, newKeys},
+		{cardinalityExpired, gostatsd.COUNTER, expiredKeys},
+	} {
+		metrics = append(metrics,
+			gostatsd.Metric{Name: k.name, Value: float64(k.counts.Counters), Tags: gostatsd.Tags{"type:counter"}, Type: k.metricType},
+			gostatsd.Metric{Name: k.name, Value: float64(k.counts.Timers), Tags: gostatsd.Tags{"type:timer"}, Type: k.metricType},
+			gostatsd.Metric{Name: k.name, Value: float64(k.counts.Gauges), Tags: gostatsd.Tags{"type:gauge"}, Type: k.metricType},
+			gostatsd.Metric{Name: k.name, Value: float64(k.counts.Sets), Tags: gostatsd.Tags{"type:set"}, Type: k.metricType})
+	}
+	return metrics
+}
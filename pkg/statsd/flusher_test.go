@@ -1,11 +1,29 @@
 package statsd
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/backends/datadog"
+	"github.com/atlassian/gostatsd/pkg/backends/graphite"
+	"github.com/atlassian/gostatsd/pkg/fakesocket"
+	"github.com/atlassian/gostatsd/pkg/statsd/cardinality"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestFlusherHandleSendResultNoErrors(t *testing.T) {
@@ -20,7 +38,7 @@ func TestFlusherHandleSendResultNoErrors(t *testing.T) {
 		t.Run(strconv.Itoa(pos), func(t *testing.T) {
 			t.Parallel()
 			fl := NewMetricFlusher(0, nil, nil, nil, nil, gostatsd.UnknownIP, "host")
-			fl.handleSendResult(errs)
+			fl.handleSendResult("backend", errs)
 
 			if fl.lastFlush == 0 || fl.lastFlushError != 0 {
 				t.Errorf("lastFlush = %d, lastFlushError = %d", fl.lastFlush, fl.lastFlushError)
@@ -42,7 +60,7 @@ func TestFlusherHandleSendResultError(t *testing.T) {
 		t.Run(strconv.Itoa(pos), func(t *testing.T) {
 			t.Parallel()
 			fl := NewMetricFlusher(0, nil, nil, nil, nil, gostatsd.UnknownIP, "host")
-			fl.handleSendResult(errs)
+			fl.handleSendResult("backend", errs)
 
 			if fl.lastFlushError == 0 || fl.lastFlush != 0 {
 				t.Errorf("lastFlush = %d, lastFlushError = %d", fl.lastFlush, fl.lastFlushError)
@@ -50,3 +68,1008 @@ func TestFlusherHandleSendResultError(t *testing.T) {
 		})
 	}
 }
+
+func TestFlusherNotifiesFlushObservers(t *testing.T) {
+	t.Parallel()
+	d := NewMetricDispatcher(2, 10, &agrFactory{percentThresholds: DefaultPercentThreshold})
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+
+	metrics := []gostatsd.Metric{
+		{Name: "c", Type: gostatsd.COUNTER, Value: 3},
+		{Name: "c", Type: gostatsd.COUNTER, Value: 4},
+		{Name: "t", Type: gostatsd.TIMER, Value: 10},
+		{Name: "t", Type: gostatsd.TIMER, Value: 20},
+	}
+	for i := range metrics {
+		require.NoError(t, d.DispatchMetric(ctx, &metrics[i]))
+	}
+	// Wait for metrics to be aggregated
+	waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.NumStats == uint32(len(metrics))
+	})
+
+	var lock sync.Mutex
+	var observed *gostatsd.MetricMap
+	fl := NewMetricFlusher(time.Second, d, nil, nil, nil, gostatsd.UnknownIP, "host")
+	fl.SetFlushObservers(100*time.Millisecond,
+		func(ctx context.Context, m *gostatsd.MetricMap) {
+			panic("bad observer")
+		},
+		func(ctx context.Context, m *gostatsd.MetricMap) {
+			<-ctx.Done() // Slow observer
+		},
+		func(ctx context.Context, m *gostatsd.MetricMap) {
+			lock.Lock()
+			defer lock.Unlock()
+			observed = m
+		})
+	fl.flushData(ctx, false)
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.NotNil(t, observed)
+	assert.Equal(t, uint32(len(metrics)), observed.NumStats)
+	counter := observed.Counters["c"][""]
+	assert.Equal(t, int64(7), counter.Value)
+	assert.Equal(t, float64(7), counter.PerSecond)
+	timer := observed.Timers["t"][""]
+	assert.Equal(t, 2, timer.Count)
+	assert.Equal(t, float64(15), timer.Mean)
+	assert.NotEmpty(t, timer.Percentiles)
+
+	cancelFunc()
+	wg.Wait()
+}
+
+type capturingBackend struct {
+	mu   sync.Mutex
+	maps []*gostatsd.MetricMap
+}
+
+func (cb *capturingBackend) Name() string {
+	return "capturingBackend"
+}
+
+func (cb *capturingBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	cb.mu.Lock()
+	cb.maps = append(cb.maps, m)
+	cb.mu.Unlock()
+	callback(nil)
+}
+
+func (cb *capturingBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+// counters returns all counters received by the backend.
+func (cb *capturingBackend) counters() []gostatsd.Counter {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	var result []gostatsd.Counter
+	for _, m := range cb.maps {
+		m.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+			result = append(result, counter)
+		})
+	}
+	cb.maps = nil
+	return result
+}
+
+func TestFlusherHostTag(t *testing.T) {
+	t.Parallel()
+	d := NewMetricDispatcher(1, 10, &agrFactory{})
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	backend := &capturingBackend{}
+	fl := NewMetricFlusher(time.Second, d, nil, nil, []gostatsd.Backend{backend}, gostatsd.UnknownIP, "host")
+	fl.SetHostTag("statsd_host:h1")
+
+	dispatchAndWait := func(metrics ...gostatsd.Metric) {
+		for i := range metrics {
+			require.NoError(t, d.DispatchMetric(ctx, &metrics[i]))
+		}
+		waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+			return snapshot.NumStats == uint32(len(metrics))
+		})
+	}
+	for i := 0; i < 2; i++ {
+		// Metrics are merged at ingest and the tag is not accumulated between flushes
+		dispatchAndWait(
+			gostatsd.Metric{Name: "c", Type: gostatsd.COUNTER, Value: 1, Tags: gostatsd.Tags{"a:b"}},
+			gostatsd.Metric{Name: "c", Type: gostatsd.COUNTER, Value: 2, Tags: gostatsd.Tags{"a:b"}},
+		)
+		fl.flushData(ctx, false)
+		counters := backend.counters()
+		require.Len(t, counters, 1)
+		assert.Equal(t, int64(3), counters[0].Value)
+		assert.Equal(t, gostatsd.Tags{"a:b", "statsd_host:h1"}, counters[0].Tags)
+	}
+
+	snapshot, err := d.Snapshot(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, gostatsd.Tags{"a:b"}, snapshot.Counters["c"]["a:b"].Tags)
+
+	cancelFunc()
+	wg.Wait()
+}
+
+// unitsBackend records units of received counters by name and value.
+// Units are recorded when metrics are sent because the flusher reuses the maps.
+type unitsBackend struct {
+	capturingBackend
+	mu    sync.Mutex
+	units map[string]string
+}
+
+func (ub *unitsBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	ub.mu.Lock()
+	m.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		ub.units[fmt.Sprintf("%s=%d", key, counter.Value)] = counter.Unit
+	})
+	ub.mu.Unlock()
+	callback(nil)
+}
+
+func TestFlusherUnits(t *testing.T) {
+	t.Parallel()
+	d := NewMetricDispatcher(2, 10, &agrFactory{})
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	receiver := NewMetricReceiver("", NewDispatchingHandler(d, nil, nil, 1))
+	require.NoError(t, receiver.handlePacket(ctx, fakesocket.FakeAddr, []byte("c:1|c|u:byte\nc:2|c\nother:1|c")))
+	waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.NumStats == 3
+	})
+
+	backend := &unitsBackend{units: make(map[string]string)}
+	fl := NewMetricFlusher(time.Second, d, nil, nil, []gostatsd.Backend{backend}, gostatsd.UnknownIP, "host")
+	fl.flushData(ctx, false)
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	assert.Equal(t, map[string]string{"c=3": "byte", "other=1": ""}, backend.units)
+
+	cancelFunc()
+	wg.Wait()
+}
+
+type failingBackend struct {
+	capturingBackend
+}
+
+func (fb *failingBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	callback([]error{errors.New("backend is down")})
+}
+
+func TestFlusherForceFlush(t *testing.T) {
+	t.Parallel()
+	d := NewMetricDispatcher(1, 10, &agrFactory{})
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	fl := NewMetricFlusher(time.Hour, d, NewMetricReceiver("", nopHandler{}), nopHandler{}, []gostatsd.Backend{&failingBackend{}}, gostatsd.UnknownIP, "host")
+	var afterFlush int32
+	fl.SetAfterFlush(func() {
+		atomic.AddInt32(&afterFlush, 1)
+	})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, fl.Run(ctx))
+	}()
+	require.NoError(t, d.DispatchMetric(ctx, &gostatsd.Metric{Name: "c", Type: gostatsd.COUNTER, Value: 1}))
+	waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.NumStats == 1
+	})
+
+	result, err := fl.ForceFlush(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), result.NumStats)
+	assert.EqualError(t, result.Err, "backend is down")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&afterFlush))
+
+	cancelFunc()
+	wg.Wait()
+	_, err = fl.ForceFlush(ctx)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestFlusherHeartbeat(t *testing.T) {
+	t.Parallel()
+	d := NewMetricDispatcher(1, 10, &agrFactory{})
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	backend := &recordingBackend{name: "recording"}
+	fl := NewMetricFlusher(time.Hour, d, NewMetricReceiver("", nopHandler{}), NewDispatchingHandler(d, nil, nil, 1), []gostatsd.Backend{backend}, gostatsd.UnknownIP, "host")
+	fl.SetHeartbeat("statsd.heartbeat", gostatsd.COUNTER, 1)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, fl.Run(ctx))
+	}()
+	tagsKey := formatTagsKey(nil, "host")
+	// No metrics are received, the heartbeat is flushed on each flush
+	for flush := 0; flush < 3; flush++ {
+		waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+			return snapshot.Counters["statsd.heartbeat"][tagsKey].Value == 1
+		})
+		_, err := fl.ForceFlush(ctx)
+		require.NoError(t, err)
+		maps := backend.received()
+		require.Len(t, maps, 1)
+		heartbeat, ok := maps[0].Counters["statsd.heartbeat"][tagsKey]
+		require.True(t, ok, "flush %d", flush)
+		assert.EqualValues(t, 1, heartbeat.Value)
+	}
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestFlusherRuntimeMetrics(t *testing.T) {
+	t.Parallel()
+	d := NewMetricDispatcher(1, 10, &agrFactory{})
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	backend := &recordingBackend{name: "recording"}
+	fl := NewMetricFlusher(time.Hour, d, NewMetricReceiver("", nopHandler{}), NewDispatchingHandler(d, nil, nil, 1), []gostatsd.Backend{backend}, gostatsd.UnknownIP, "host")
+	fl.SetRuntimeMetrics("runtime.", 10*time.Millisecond)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, fl.Run(ctx))
+	}()
+	tagsKey := formatTagsKey(nil, "host")
+	waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+		_, ok := snapshot.Gauges["runtime.goroutines"][tagsKey]
+		return ok
+	})
+	_, err := fl.ForceFlush(ctx)
+	require.NoError(t, err)
+	maps := backend.received()
+	require.Len(t, maps, 1)
+	for _, name := range []string{"runtime.heap_alloc_bytes", "runtime.gc_pause_ms", "runtime.num_gc", "runtime.goroutines"} {
+		_, ok := maps[0].Gauges[name][tagsKey]
+		assert.True(t, ok, name)
+	}
+	assert.True(t, maps[0].Gauges["runtime.heap_alloc_bytes"][tagsKey].Value > 0)
+	assert.True(t, maps[0].Gauges["runtime.goroutines"][tagsKey].Value > 0)
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestParseHeartbeatType(t *testing.T) {
+	t.Parallel()
+	for _, metricType := range []gostatsd.MetricType{gostatsd.GAUGE, gostatsd.COUNTER} {
+		parsed, err := ParseHeartbeatType(metricType.String())
+		require.NoError(t, err)
+		assert.Equal(t, metricType, parsed)
+	}
+	_, err := ParseHeartbeatType("timer")
+	assert.EqualError(t, err, `unknown heartbeat type "timer", must be one of gauge, counter`)
+}
+
+// recordingBackend records copies of received metrics because the flusher reuses the maps.
+type recordingBackend struct {
+	capturingBackend
+	name string
+}
+
+func (rb *recordingBackend) Name() string {
+	return rb.name
+}
+
+func (rb *recordingBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	c := newMetricMap()
+	mergeMetricMap(c, m)
+	rb.capturingBackend.SendMetricsAsync(ctx, c, callback)
+}
+
+// received returns the maps received by the backend since the last call.
+func (rb *recordingBackend) received() []*gostatsd.MetricMap {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	maps := rb.maps
+	rb.maps = nil
+	return maps
+}
+
+func TestFlusherBackendFlushIntervals(t *testing.T) {
+	t.Parallel()
+	d := NewMetricDispatcher(1, 10, &agrFactory{percentThresholds: []float64{90}})
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	fast := &recordingBackend{name: "fast"}
+	slow := &recordingBackend{name: "slow"}
+	fl := NewMetricFlusher(time.Second, d, nil, nil, []gostatsd.Backend{fast, slow}, gostatsd.UnknownIP, "host")
+	require.NoError(t, fl.SetBackendFlushIntervals(map[string]time.Duration{"slow": 3 * time.Second}, []float64{90}))
+
+	dispatchAndWait := func(metrics ...gostatsd.Metric) {
+		for i := range metrics {
+			require.NoError(t, d.DispatchMetric(ctx, &metrics[i]))
+		}
+		waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+			return snapshot.NumStats == uint32(len(metrics))
+		})
+	}
+	for i := 1; i <= 3; i++ {
+		dispatchAndWait(
+			gostatsd.Metric{Name: "c", Type: gostatsd.COUNTER, Value: float64(i)},
+			gostatsd.Metric{Name: "g", Type: gostatsd.GAUGE, Value: float64(i)},
+			gostatsd.Metric{Name: "t", Type: gostatsd.TIMER, Value: float64(i)},
+			gostatsd.Metric{Name: "s", Type: gostatsd.SET, StringValue: strconv.Itoa(i % 2)},
+		)
+		fl.flushData(ctx, false)
+		maps := fast.received()
+		require.Len(t, maps, 1)
+		assert.Equal(t, int64(i), maps[0].Counters["c"][""].Value)
+		assert.Equal(t, float64(i), maps[0].Gauges["g"][""].Value)
+		assert.Equal(t, time.Second, maps[0].FlushInterval)
+		if i < 3 {
+			assert.Empty(t, slow.received())
+		}
+	}
+	maps := slow.received()
+	require.Len(t, maps, 1)
+	m := maps[0]
+	assert.Equal(t, 3*time.Second, m.FlushInterval)
+	assert.Equal(t, uint32(12), m.NumStats)
+	counter := m.Counters["c"][""]
+	assert.Equal(t, int64(6), counter.Value) // Summed, not duplicated
+	assert.Equal(t, float64(2), counter.PerSecond)
+	assert.Equal(t, float64(3), m.Gauges["g"][""].Value) // Latest
+	timer := m.Timers["t"][""]
+	assert.Equal(t, []float64{1, 2, 3}, timer.Values)
+	assert.Equal(t, 3, timer.Count)
+	assert.Equal(t, float64(2), timer.Mean)
+	assert.Equal(t, float64(1), timer.PerSecond)
+	assert.Equal(t, gostatsd.Percentiles{
+		{Float: 3, Str: "count_90"},
+		{Float: 2, Str: "mean_90"},
+		{Float: 6, Str: "sum_90"},
+		{Float: 14, Str: "sum_squares_90"},
+		{Float: 3, Str: "upper_90"},
+	}, timer.Percentiles)
+	assert.Equal(t, map[string]struct{}{"0": {}, "1": {}}, m.Sets["s"][""].Values)
+
+	// Next interval starts from scratch, the forced flush sends the partial interval
+	dispatchAndWait(gostatsd.Metric{Name: "c", Type: gostatsd.COUNTER, Value: 10})
+	fl.flushData(ctx, true)
+	assert.Len(t, fast.received(), 1)
+	maps = slow.received()
+	require.Len(t, maps, 1)
+	assert.Equal(t, time.Second, maps[0].FlushInterval)
+	assert.Equal(t, int64(10), maps[0].Counters["c"][""].Value)
+
+	cancelFunc()
+	wg.Wait()
+}
+
+// stallingBackend ignores the context and only finishes sends once released.
+type stallingBackend struct {
+	release chan struct{}
+}
+
+func (sb *stallingBackend) Name() string {
+	return "stallingBackend"
+}
+
+func (sb *stallingBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	go func() {
+		<-sb.release
+		callback(nil)
+	}()
+}
+
+func (sb *stallingBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+// fakeLeader is the leader if leader is set.
+type fakeLeader struct {
+	leader int32
+}
+
+func (fl *fakeLeader) IsLeader() bool {
+	return atomic.LoadInt32(&fl.leader) == 1
+}
+
+func (fl *fakeLeader) Run(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestFlusherLeader(t *testing.T) {
+	t.Parallel()
+	d := NewMetricDispatcher(1, 10, &agrFactory{})
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	fast := &recordingBackend{name: "fast"}
+	slow := &recordingBackend{name: "slow"}
+	fl := NewMetricFlusher(time.Second, d, nil, nil, []gostatsd.Backend{fast, slow}, gostatsd.UnknownIP, "host")
+	require.NoError(t, fl.SetBackendFlushIntervals(map[string]time.Duration{"slow": 2 * time.Second}, nil))
+	leader := &fakeLeader{}
+	fl.SetLeader(leader)
+
+	dispatchAndWait := func(value float64) {
+		require.NoError(t, d.DispatchMetric(ctx, &gostatsd.Metric{Name: "c", Type: gostatsd.COUNTER, Value: value}))
+		waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+			return snapshot.NumStats == 1
+		})
+	}
+	// Metrics are aggregated and reset but not sent by other servers
+	dispatchAndWait(1)
+	_, result := fl.flushData(ctx, false)
+	assert.EqualValues(t, 1, result.NumStats)
+	dispatchAndWait(2)
+	fl.flushData(ctx, false)
+	assert.Empty(t, fast.received())
+	assert.Empty(t, slow.received())
+
+	// The leader sends metrics aggregated since the last flush
+	atomic.StoreInt32(&leader.leader, 1)
+	dispatchAndWait(3)
+	fl.flushData(ctx, false)
+	maps := fast.received()
+	require.Len(t, maps, 1)
+	assert.Equal(t, int64(3), maps[0].Counters["c"][""].Value)
+	assert.Empty(t, slow.received())
+	dispatchAndWait(4)
+	fl.flushData(ctx, false)
+	require.Len(t, fast.received(), 1)
+	maps = slow.received()
+	require.Len(t, maps, 1)
+	assert.Equal(t, int64(7), maps[0].Counters["c"][""].Value)
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestFlusherBackendTimeouts(t *testing.T) {
+	t.Parallel()
+	d := NewMetricDispatcher(1, 10, &agrFactory{})
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	stalling := &stallingBackend{release: make(chan struct{})}
+	capturing := &capturingBackend{}
+	fl := NewMetricFlusher(time.Hour, d, NewMetricReceiver("", nopHandler{}), nopHandler{}, []gostatsd.Backend{stalling, capturing}, gostatsd.UnknownIP, "host")
+	require.NoError(t, fl.SetBackendTimeouts(map[string]time.Duration{"stallingBackend": 50 * time.Millisecond}))
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, fl.Run(ctx))
+	}()
+	require.NoError(t, d.DispatchMetric(ctx, &gostatsd.Metric{Name: "c", Type: gostatsd.COUNTER, Value: 1}))
+	waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.NumStats == 1
+	})
+
+	// The flush completes although the stalling backend has not returned
+	result, err := fl.ForceFlush(ctx)
+	require.NoError(t, err)
+	assert.EqualError(t, result.Err, "sending metrics to backend stallingBackend timed out after 50ms")
+	assert.Len(t, capturing.counters(), 1)
+	statuses := fl.BackendStatuses()
+	require.Len(t, statuses, 2)
+	assert.Equal(t, "stallingBackend", statuses[1].Name)
+	assert.False(t, statuses[1].Healthy())
+	assert.True(t, statuses[0].Healthy())
+	close(stalling.release) // The late callback is ignored
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestFlusherBackendTimeoutsInvalid(t *testing.T) {
+	t.Parallel()
+	fl := NewMetricFlusher(time.Second, nil, nil, nil, []gostatsd.Backend{&recordingBackend{name: "b"}}, gostatsd.UnknownIP, "host")
+	assert.Error(t, fl.SetBackendTimeouts(map[string]time.Duration{"unknown": time.Second}))
+	assert.Error(t, fl.SetBackendTimeouts(map[string]time.Duration{"b": 0}))
+	assert.NoError(t, fl.SetBackendTimeouts(map[string]time.Duration{"b": time.Second}))
+}
+
+func TestFlusherValuePrecision(t *testing.T) {
+	t.Parallel()
+	d := NewMetricDispatcher(1, 10, &agrFactory{})
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	require.NoError(t, d.DispatchMetric(ctx, &gostatsd.Metric{Name: "g", Type: gostatsd.GAUGE, Value: 123.456789012345}))
+	waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.NumStats == 1
+	})
+
+	backend := &capturingBackend{}
+	fl := NewMetricFlusher(time.Second, d, nil, nil, []gostatsd.Backend{backend}, gostatsd.UnknownIP, "host")
+	require.NoError(t, fl.SetValuePrecision(6))
+	fl.flushData(ctx, false)
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	require.Len(t, backend.maps, 1)
+	assert.Equal(t, 123.457, backend.maps[0].Gauges["g"][""].Value)
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestFlusherValuePrecisionBackends(t *testing.T) {
+	t.Parallel()
+	d := NewMetricDispatcher(1, 10, &agrFactory{})
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	require.NoError(t, d.DispatchMetric(ctx, &gostatsd.Metric{Name: "g", Type: gostatsd.GAUGE, Value: 0.00000123456}))
+	waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.NumStats == 1
+	})
+
+	// Graphite serializes values as text
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	addr := l.Addr().String()
+	graphiteBackend, err := graphite.NewClient(&graphite.Config{Address: &addr})
+	require.NoError(t, err)
+	graphitePayloads := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := ioutil.ReadAll(io.LimitReader(conn, 1024))
+		graphitePayloads <- string(data)
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		graphiteBackend.Run(ctx) // #nosec Returns when the context is done
+	}()
+
+	// Datadog serializes values as JSON
+	datadogPayloads := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		datadogPayloads <- string(data)
+	}))
+	defer ts.Close()
+	datadogBackend, err := datadog.NewClient(ts.URL, "key", 1000, time.Second, time.Second)
+	require.NoError(t, err)
+
+	fl := NewMetricFlusher(time.Second, d, nil, nil, []gostatsd.Backend{graphiteBackend, datadogBackend}, gostatsd.UnknownIP, "host")
+	require.NoError(t, fl.SetValuePrecision(3))
+	fl.flushData(ctx, false)
+
+	assert.Regexp(t, `"metric":"g","points":\[\[\d+,0\.00000123\]\]`, <-datadogPayloads)
+	cancelFunc() // Closes the connection of the graphite backend
+	assert.Regexp(t, `^stats\.gauges\.g 0\.00000123 \d+\n$`, <-graphitePayloads)
+	wg.Wait()
+}
+
+func TestFlusherValuePrecisionInvalid(t *testing.T) {
+	t.Parallel()
+	fl := NewMetricFlusher(time.Second, nil, nil, nil, []gostatsd.Backend{&recordingBackend{name: "b"}}, gostatsd.UnknownIP, "host")
+	assert.Error(t, fl.SetValuePrecision(0))
+	assert.Error(t, fl.SetValuePrecision(-1))
+	assert.NoError(t, fl.SetValuePrecision(3))
+}
+
+func TestFlusherEmptyFlushes(t *testing.T) {
+	t.Parallel()
+	d := NewMetricDispatcher(2, 10, &agrFactory{})
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	all := &recordingBackend{name: "all"}
+	skip := &recordingBackend{name: "skip"}
+	fl := NewMetricFlusher(time.Second, d, nil, nil, []gostatsd.Backend{all, skip}, gostatsd.UnknownIP, "host")
+	require.NoError(t, fl.SetSkipEmptyFlushes([]string{"skip"}))
+
+	// Backends are sent the metrics of each aggregator without any metrics ingested
+	_, result := fl.flushData(ctx, false)
+	require.NoError(t, result.Err)
+	maps := all.received()
+	require.Len(t, maps, 2)
+	for _, m := range maps {
+		assert.Empty(t, m.Counters)
+		assert.Empty(t, m.Timers)
+		assert.Empty(t, m.Gauges)
+		assert.Empty(t, m.Sets)
+	}
+	assert.Empty(t, skip.received())
+	assert.NotZero(t, fl.lastFlush)
+
+	// Only aggregators with metrics are sent to backends skipping empty flushes
+	require.NoError(t, d.DispatchMetric(ctx, &gostatsd.Metric{Name: "c", Type: gostatsd.COUNTER, Value: 1}))
+	waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.NumStats == 1
+	})
+	fl.flushData(ctx, false)
+	assert.Len(t, all.received(), 2)
+	maps = skip.received()
+	require.Len(t, maps, 1)
+	assert.EqualValues(t, 1, maps[0].Counters["c"][""].Value)
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestFlusherSkipEmptyFlushesUnknownBackend(t *testing.T) {
+	t.Parallel()
+	fl := NewMetricFlusher(time.Second, nil, nil, nil, []gostatsd.Backend{&recordingBackend{name: "b"}}, gostatsd.UnknownIP, "host")
+	assert.EqualError(t, fl.SetSkipEmptyFlushes([]string{"c"}), "skipping empty flushes of unknown backend c")
+	assert.NoError(t, fl.SetSkipEmptyFlushes([]string{"b"}))
+}
+
+func TestFlusherBackendFlushIntervalsInvalid(t *testing.T) {
+	t.Parallel()
+	fl := NewMetricFlusher(time.Second, nil, nil, nil, []gostatsd.Backend{&recordingBackend{name: "b"}}, gostatsd.UnknownIP, "host")
+	assert.Error(t, fl.SetBackendFlushIntervals(map[string]time.Duration{"unknown": time.Minute}, nil))
+	assert.Error(t, fl.SetBackendFlushIntervals(map[string]time.Duration{"b": 1500 * time.Millisecond}, nil))
+	assert.Error(t, fl.SetBackendFlushIntervals(map[string]time.Duration{"b": -time.Second}, nil))
+	assert.NoError(t, fl.SetBackendFlushIntervals(map[string]time.Duration{"b": time.Minute}, nil))
+}
+
+// collectingHandler collects dispatched metrics.
+type collectingHandler struct {
+	nopHandler
+	metrics []gostatsd.Metric
+}
+
+func (ch *collectingHandler) DispatchMetric(ctx context.Context, m *gostatsd.Metric) error {
+	ch.metrics = append(ch.metrics, *m)
+	return nil
+}
+
+func TestFlusherCardinalityMetrics(t *testing.T) {
+	t.Parallel()
+	handler := &collectingHandler{}
+	fl := NewMetricFlusher(time.Second, nil, NewMetricReceiver("", nopHandler{}), handler, nil, gostatsd.UnknownIP, "host")
+	require.NoError(t, fl.SetCardinalityReport(CardinalityReportMetrics, 1))
+	fl.dispatchInternalStats(context.Background(), map[uint16]gostatsd.MetricStats{
+		0: {Keys: gostatsd.KeyCounts{Counters: 3, Sets: 1}, NewKeys: gostatsd.KeyCounts{Counters: 1}},
+		1: {Keys: gostatsd.KeyCounts{Counters: 2, Timers: 4}, ExpiredKeys: gostatsd.KeyCounts{Gauges: 5}},
+	})
+	actual := make(map[string]float64)
+	for _, m := range handler.metrics {
+		if len(m.Tags) == 1 && strings.HasPrefix(m.Name, internalMetric+"cardinality") {
+			actual[m.Name+"{"+m.Tags[0]+"}"] = m.Value
+		}
+	}
+	assert.Equal(t, map[string]float64{
+		cardinalityKeys + "{type:counter}":    5,
+		cardinalityKeys + "{type:timer}":      4,
+		cardinalityKeys + "{type:gauge}":      0,
+		cardinalityKeys + "{type:set}":        1,
+		cardinalityNew + "{type:counter}":     1,
+		cardinalityNew + "{type:timer}":       0,
+		cardinalityNew + "{type:gauge}":       0,
+		cardinalityNew + "{type:set}":         0,
+		cardinalityExpired + "{type:counter}": 0,
+		cardinalityExpired + "{type:timer}":   0,
+		cardinalityExpired + "{type:gauge}":   5,
+		cardinalityExpired + "{type:set}":     0,
+	}, actual)
+
+	handler.metrics = nil
+	require.NoError(t, fl.SetCardinalityReport(CardinalityReportNone, 1))
+	fl.dispatchInternalStats(context.Background(), map[uint16]gostatsd.MetricStats{0: {Keys: gostatsd.KeyCounts{Counters: 3}}})
+	for _, m := range handler.metrics {
+		assert.False(t, strings.HasPrefix(m.Name, internalMetric+"cardinality"), m.Name)
+	}
+}
+
+func TestFlusherCardinalityCounters(t *testing.T) {
+	t.Parallel()
+	handler := &collectingHandler{}
+	fl := NewMetricFlusher(time.Second, nil, NewMetricReceiver("", nopHandler{}), handler, nil, gostatsd.UnknownIP, "host")
+	require.NoError(t, fl.SetCardinalityReport(CardinalityReportNone, 2))
+	reported := func() map[string]float64 {
+		actual := make(map[string]float64)
+		for _, m := range handler.metrics {
+			if strings.HasPrefix(m.Name, "gostatsd.internal.cardinality.") {
+				assert.Equal(t, gostatsd.COUNTER, m.Type)
+				actual[m.Name] = m.Value
+			}
+		}
+		handler.metrics = nil
+		return actual
+	}
+	stats := map[uint16]gostatsd.MetricStats{
+		0: {Keys: gostatsd.KeyCounts{Counters: 3, Sets: 1}},
+		1: {Keys: gostatsd.KeyCounts{Counters: 2, Timers: 4}},
+	}
+	fl.dispatchInternalStats(context.Background(), stats)
+	assert.Empty(t, reported())
+	fl.dispatchInternalStats(context.Background(), stats)
+	assert.Equal(t, map[string]float64{
+		cardinalityCounters: 5,
+		cardinalityTimers:   4,
+		cardinalityGauges:   0,
+		cardinalitySets:     1,
+	}, reported())
+}
+
+func TestFlusherCardinalityTracker(t *testing.T) {
+	t.Parallel()
+	handler := &collectingHandler{}
+	fl := NewMetricFlusher(time.Second, nil, NewMetricReceiver("", nopHandler{}), handler, nil, gostatsd.UnknownIP, "host")
+	ct := cardinality.NewCardinalityTracker(2)
+	fl.SetCardinalityTracker(ct)
+	reported := func() map[string]float64 {
+		actual := make(map[string]float64)
+		for _, m := range handler.metrics {
+			if strings.HasPrefix(m.Name, "gostatsd.cardinality.") {
+				actual[m.Name] = m.Value
+			}
+		}
+		handler.metrics = nil
+		return actual
+	}
+	require.True(t, ct.Allow(gostatsd.COUNTER, "a"))
+	require.True(t, ct.Allow(gostatsd.SET, "b"))
+	require.False(t, ct.Allow(gostatsd.COUNTER, "c"))
+	fl.dispatchInternalStats(context.Background(), nil)
+	assert.Equal(t, map[string]float64{
+		trackedCounters: 1,
+		trackedTimers:   0,
+		trackedGauges:   0,
+		trackedSets:     1,
+		trackedDropped:  1,
+	}, reported())
+	// Dropped metrics are counted since the previous flush
+	require.False(t, ct.Allow(gostatsd.COUNTER, "c"))
+	require.False(t, ct.Allow(gostatsd.COUNTER, "d"))
+	fl.dispatchInternalStats(context.Background(), nil)
+	assert.Equal(t, 2.0, reported()[trackedDropped])
+}
+
+func TestFlusherCardinalityMetricsEvery(t *testing.T) {
+	t.Parallel()
+	handler := &collectingHandler{}
+	fl := NewMetricFlusher(time.Second, nil, NewMetricReceiver("", nopHandler{}), handler, nil, gostatsd.UnknownIP, "host")
+	require.NoError(t, fl.SetCardinalityReport(CardinalityReportMetrics, 3))
+	reported := func() map[string]float64 {
+		actual := make(map[string]float64)
+		for _, m := range handler.metrics {
+			if m.Name != cardinalityKeys && m.Name != cardinalityNew && m.Name != cardinalityExpired {
+				continue
+			}
+			if m.Tags[0] == "type:counter" {
+				actual[m.Name] = m.Value
+			}
+		}
+		handler.metrics = nil
+		return actual
+	}
+	stats := []gostatsd.MetricStats{
+		{Keys: gostatsd.KeyCounts{Counters: 3}, NewKeys: gostatsd.KeyCounts{Counters: 3}},
+		{Keys: gostatsd.KeyCounts{Counters: 5}, NewKeys: gostatsd.KeyCounts{Counters: 2}},
+		{Keys: gostatsd.KeyCounts{Counters: 4}, NewKeys: gostatsd.KeyCounts{Counters: 1}, ExpiredKeys: gostatsd.KeyCounts{Counters: 2}},
+		{Keys: gostatsd.KeyCounts{Counters: 4}, ExpiredKeys: gostatsd.KeyCounts{Counters: 1}},
+	}
+	for _, stat := range stats[:2] {
+		fl.dispatchInternalStats(context.Background(), map[uint16]gostatsd.MetricStats{0: stat})
+		assert.Empty(t, reported())
+	}
+	// Churn of all flushes since the previous report is reported with the current number of keys
+	fl.dispatchInternalStats(context.Background(), map[uint16]gostatsd.MetricStats{0: stats[2]})
+	assert.Equal(t, map[string]float64{
+		cardinalityKeys:    4,
+		cardinalityNew:     6,
+		cardinalityExpired: 2,
+	}, reported())
+	fl.dispatchInternalStats(context.Background(), map[uint16]gostatsd.MetricStats{0: stats[3]})
+	assert.Empty(t, reported())
+}
+
+func TestParseCardinalityReport(t *testing.T) {
+	t.Parallel()
+	for _, report := range []CardinalityReport{CardinalityReportNone, CardinalityReportLog, CardinalityReportMetrics} {
+		parsed, err := ParseCardinalityReport(report.String())
+		require.NoError(t, err)
+		assert.Equal(t, report, parsed)
+	}
+	_, err := ParseCardinalityReport("stdout")
+	assert.Error(t, err)
+}
+
+// fakeCluster owns names with the prefix, records shared metrics and returns the gathered metrics.
+type fakeCluster struct {
+	prefix   string
+	gathered []*gostatsd.MetricMap
+
+	mu     sync.Mutex
+	shared []*gostatsd.MetricMap
+}
+
+func (fc *fakeCluster) Owns(name string) bool {
+	return strings.HasPrefix(name, fc.prefix)
+}
+
+func (fc *fakeCluster) Share(ctx context.Context, m *gostatsd.MetricMap) int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.shared = append(fc.shared, m)
+	return 0
+}
+
+func (fc *fakeCluster) Gather(ctx context.Context, timeout time.Duration) []*gostatsd.MetricMap {
+	gathered := fc.gathered
+	fc.gathered = nil
+	return gathered
+}
+
+func (fc *fakeCluster) Run(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestFlusherCluster(t *testing.T) {
+	t.Parallel()
+	d := NewMetricDispatcher(2, 10, &agrFactory{})
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	backend := &recordingBackend{name: "backend"}
+	fl := NewMetricFlusher(time.Second, d, nil, nil, []gostatsd.Backend{backend}, gostatsd.UnknownIP, "host")
+	cluster := &fakeCluster{
+		prefix: "local.",
+		gathered: []*gostatsd.MetricMap{{
+			Counters: gostatsd.Counters{"local.c": {"": gostatsd.Counter{Value: 10}}},
+			Gauges:   gostatsd.Gauges{"local.g": {"": gostatsd.Gauge{Value: 6}}},
+		}},
+	}
+	fl.SetCluster(cluster)
+
+	metrics := []gostatsd.Metric{
+		{Name: "local.c", Type: gostatsd.COUNTER, Value: 1},
+		{Name: "remote.c", Type: gostatsd.COUNTER, Value: 2},
+		{Name: "remote.t", Type: gostatsd.TIMER, Value: 3},
+		{Name: "remote.t", Type: gostatsd.TIMER, Value: 4},
+		{Name: "remote.g", Type: gostatsd.GAUGE, Value: 5},
+		{Name: "remote.s", Type: gostatsd.SET, StringValue: "joe"},
+	}
+	for _, m := range metrics {
+		m := m
+		require.NoError(t, d.DispatchMetric(ctx, &m))
+	}
+	waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.NumStats == uint32(len(metrics))
+	})
+	fl.flushData(ctx, false)
+
+	// Only owned metrics are sent to backends, merged with metrics shared by other servers
+	maps := backend.received()
+	counters := gostatsd.Counters{}
+	gauges := gostatsd.Gauges{}
+	for _, m := range maps {
+		assert.Empty(t, m.Timers)
+		assert.Empty(t, m.Sets)
+		for name, v := range m.Counters {
+			counters[name] = v
+		}
+		for name, v := range m.Gauges {
+			gauges[name] = v
+		}
+	}
+	assert.Len(t, counters, 1)
+	assert.EqualValues(t, 11, counters["local.c"][""].Value)
+	assert.Len(t, gauges, 1)
+	assert.Equal(t, 6.0, gauges["local.g"][""].Value)
+
+	// Other metrics are shared once merged from all aggregators, without being summarized
+	require.Len(t, cluster.shared, 1)
+	shared := cluster.shared[0]
+	assert.Empty(t, shared.Counters["local.c"])
+	assert.EqualValues(t, 2, shared.Counters["remote.c"][""].Value)
+	assert.Zero(t, shared.Counters["remote.c"][""].PerSecond)
+	assert.ElementsMatch(t, []float64{3, 4}, shared.Timers["remote.t"][""].Values)
+	assert.Equal(t, 5.0, shared.Gauges["remote.g"][""].Value)
+	assert.Contains(t, shared.Sets["remote.s"][""].Values, "joe")
+
+	cancelFunc()
+	wg.Wait()
+}
+
+// fakeMetricClient records the metrics it is sent.
+type fakeMetricClient struct {
+	mu      sync.Mutex
+	metrics []gostatsd.Metric
+}
+
+func (fc *fakeMetricClient) SendMetrics(ctx context.Context, metrics []gostatsd.Metric) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.metrics = append(fc.metrics, metrics...)
+	return nil
+}
+
+func TestFlusherMetricClient(t *testing.T) {
+	t.Parallel()
+	handler := &collectingHandler{}
+	client := &fakeMetricClient{}
+	fl := NewMetricFlusher(time.Second, nil, NewMetricReceiver("", nopHandler{}), handler, nil, gostatsd.UnknownIP, "host")
+	fl.SetMetricClient(client)
+	fl.dispatchInternalStats(context.Background(), map[uint16]gostatsd.MetricStats{0: {NumStats: 3}})
+
+	// Internal metrics are sent with the client instead of being dispatched
+	assert.Empty(t, handler.metrics)
+	names := make(map[string]float64)
+	for _, m := range client.metrics {
+		names[m.Name] = m.Value
+	}
+	assert.Equal(t, 3.0, names[numStats])
+	assert.Contains(t, names, packetsReceived)
+}
@@ -0,0 +1,246 @@
+package statsd
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statsd/adminpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DefaultGRPCAddr is the default address on which a GRPCServer will listen.
+const DefaultGRPCAddr = ":8127"
+
+// GRPCServer is an object that listens for gRPC connections on a TCP address Addr
+// and provides the Admin service to manage statsd server.
+// The service is registered with server reflection so that tools like grpcurl can be used without the proto file.
+type GRPCServer struct {
+	Addr       string
+	Receiver   Receiver
+	Dispatcher Dispatcher
+	Flusher    Flusher
+	// Credentials of the users allowed to call the service with HTTP Basic Auth in the authorization metadata,
+	// authentication is disabled if empty.
+	Credentials Credentials
+	// AuditLogWriter receives an AuditEvent for each state-mutating call, disabled if nil.
+	AuditLogWriter io.Writer
+}
+
+// grpcMethodRoles are the roles required to call methods of the Admin service other than RoleReadOnly.
+// Only state-mutating methods require the admin role, and calls of them are written to the audit log.
+var grpcMethodRoles = map[string]Role{
+	adminpb.Admin_DeleteMetrics_FullMethodName: RoleAdmin,
+	adminpb.Admin_ForceFlush_FullMethodName:    RoleAdmin,
+}
+
+// ListenAndServe listens on the GRPCServer's TCP network address and then calls Serve.
+func (s *GRPCServer) ListenAndServe(ctx context.Context) error {
+	addr := s.Addr
+	if addr == "" {
+		addr = DefaultGRPCAddr
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return s.Serve(ctx, l)
+}
+
+// Serve accepts incoming connections on the listener and serves the Admin service until the context is done.
+func (s *GRPCServer) Serve(ctx context.Context, l net.Listener) error {
+	srv := grpc.NewServer(grpc.UnaryInterceptor(s.authorize))
+	adminpb.RegisterAdminServer(srv, &adminServer{s: s})
+	reflection.Register(srv)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			srv.Stop()
+		case <-done:
+		}
+	}()
+	err := srv.Serve(l)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// authorize is a unary interceptor that authenticates the caller, checks the role required by the method,
+// and writes calls of state-mutating methods to the audit log.
+func (s *GRPCServer) authorize(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	user, role := s.authenticate(ctx)
+	if role == RoleNone {
+		return nil, status.Error(codes.Unauthenticated, "unauthenticated")
+	}
+	required, ok := grpcMethodRoles[info.FullMethod]
+	if !ok {
+		required = RoleReadOnly
+	}
+	method := path.Base(info.FullMethod)
+	if !role.Allows(required) {
+		err := status.Errorf(codes.PermissionDenied, "permission denied: %s requires the %s role", method, required)
+		if required == RoleAdmin {
+			s.audit(ctx, user, method, auditArgs(req), 0, err)
+		}
+		return nil, err
+	}
+	resp, err := handler(ctx, req)
+	if required == RoleAdmin {
+		var count uint32
+		if deleted, ok := resp.(*adminpb.DeleteMetricsResponse); ok && deleted != nil {
+			count = deleted.Deleted
+		}
+		s.audit(ctx, user, method, auditArgs(req), count, err)
+	}
+	return resp, err
+}
+
+// authenticate returns the name and the role of the user authenticated by HTTP Basic Auth in the authorization
+// metadata, RoleNone if authentication failed. All calls are allowed the admin role if there are no credentials.
+func (s *GRPCServer) authenticate(ctx context.Context) (string, Role) {
+	if !s.Credentials.Enabled() {
+		return "", RoleAdmin
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, authorization := range md.Get("authorization") {
+		if !strings.HasPrefix(authorization, "Basic ") {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(authorization, "Basic "))
+		if err != nil {
+			continue
+		}
+		if username, password, ok := strings.Cut(string(decoded), ":"); ok {
+			return username, s.Credentials.Authenticate(username, password)
+		}
+	}
+	return "", RoleNone
+}
+
+// audit writes the call to the audit log, with the message of the status of the error.
+func (s *GRPCServer) audit(ctx context.Context, user, method string, args []string, count uint32, err error) {
+	var remoteAddr string
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		remoteAddr = p.Addr.String()
+	}
+	if err != nil {
+		err = errors.New(status.Convert(err).Message())
+	}
+	WriteAuditEvent(s.AuditLogWriter, NewAuditEvent("grpc", remoteAddr, user, method, args, count, err))
+}
+
+// auditArgs returns the arguments of the request recorded in the audit log.
+func auditArgs(req interface{}) []string {
+	if r, ok := req.(*adminpb.DeleteMetricsRequest); ok {
+		return append([]string{r.Type.String()}, r.Names...)
+	}
+	return nil
+}
+
+// adminServer implements adminpb.AdminServer.
+type adminServer struct {
+	adminpb.UnimplementedAdminServer
+	s *GRPCServer
+}
+
+func (a *adminServer) GetStats(ctx context.Context, req *adminpb.GetStatsRequest) (*adminpb.Stats, error) {
+	receiverStats := a.s.Receiver.GetStats()
+	flusherStats := a.s.Flusher.GetStats()
+	return &adminpb.Stats{
+		BadLines:        receiverStats.BadLines,
+		MetricsReceived: receiverStats.MetricsReceived,
+		PacketsReceived: receiverStats.PacketsReceived,
+		EventsReceived:  receiverStats.EventsReceived,
+		LastPacket:      timestamppb.New(receiverStats.LastPacket),
+		LastFlush:       timestamppb.New(flusherStats.LastFlush),
+		LastFlushError:  timestamppb.New(flusherStats.LastFlushError),
+	}, nil
+}
+
+func (a *adminServer) ListMetrics(ctx context.Context, req *adminpb.ListMetricsRequest) (*adminpb.ListMetricsResponse, error) {
+	return a.listMetrics(ctx, req.Type, nil)
+}
+
+func (a *adminServer) SearchMetrics(ctx context.Context, req *adminpb.SearchMetricsRequest) (*adminpb.ListMetricsResponse, error) {
+	re, err := regexp.Compile(req.Pattern)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid pattern %q: %v", req.Pattern, err)
+	}
+	return a.listMetrics(ctx, req.Type, re)
+}
+
+func (a *adminServer) DeleteMetrics(ctx context.Context, req *adminpb.DeleteMetricsRequest) (*adminpb.DeleteMetricsResponse, error) {
+	metricType, ok := adminMetricTypes[req.Type]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid metric type %s", req.Type)
+	}
+	deleted, err := DeleteMetrics(ctx, a.s.Dispatcher, metricType, req.Names)
+	if err != nil {
+		return nil, status.FromContextError(err).Err()
+	}
+	return &adminpb.DeleteMetricsResponse{Deleted: deleted}, nil
+}
+
+func (a *adminServer) ForceFlush(ctx context.Context, req *adminpb.ForceFlushRequest) (*adminpb.ForceFlushResponse, error) {
+	flusher, ok := a.s.Flusher.(ForceFlusher)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "force flush is not supported by the flusher")
+	}
+	if _, err := flusher.ForceFlush(ctx); err != nil {
+		return nil, status.FromContextError(err).Err()
+	}
+	return &adminpb.ForceFlushResponse{}, nil
+}
+
+var adminMetricTypes = map[adminpb.MetricType]gostatsd.MetricType{
+	adminpb.MetricType_COUNTER: gostatsd.COUNTER,
+	adminpb.MetricType_TIMER:   gostatsd.TIMER,
+	adminpb.MetricType_GAUGE:   gostatsd.GAUGE,
+	adminpb.MetricType_SET:     gostatsd.SET,
+}
+
+// listMetrics returns metrics of the type, or of all types if the type is ALL, with names matching the regular
+// expression. All names match if the regular expression is nil.
+func (a *adminServer) listMetrics(ctx context.Context, metricType adminpb.MetricType, re *regexp.Regexp) (*adminpb.ListMetricsResponse, error) {
+	t, ok := adminMetricTypes[metricType]
+	if !ok && metricType != adminpb.MetricType_ALL {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid metric type %s", metricType)
+	}
+	metrics, err := ListMetrics(ctx, a.s.Dispatcher, func(mt gostatsd.MetricType, name string) bool {
+		return (!ok || mt == t) && (re == nil || re.MatchString(name))
+	})
+	if err != nil {
+		return nil, status.FromContextError(err).Err()
+	}
+	result := make([]*adminpb.Metric, 0, len(metrics))
+	for _, m := range metrics {
+		result = append(result, &adminpb.Metric{
+			Name:        m.Name,
+			Type:        adminpb.MetricType(m.Type), // Values of adminpb.MetricType match gostatsd.MetricType
+			TagsKey:     m.TagsKey,
+			Tags:        m.Tags,
+			Hostname:    m.Hostname,
+			Value:       m.Value,
+			TimerValues: m.TimerValues,
+			SetValues:   m.SetValues,
+		})
+	}
+	return &adminpb.ListMetricsResponse{Metrics: result}, nil
+}
@@ -0,0 +1,209 @@
+package statsd
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/fakesocket"
+	"github.com/atlassian/gostatsd/pkg/statsd/adminpb"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// startGRPC starts the GRPCServer on a random port and returns a connected client.
+func startGRPC(t *testing.T, ctx context.Context, gs *GRPCServer) adminpb.AdminClient {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go gs.Serve(ctx, l)
+	conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	return adminpb.NewAdminClient(conn)
+}
+
+func TestGRPCServerMetrics(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	d := NewMetricDispatcher(2, 10, &agrFactory{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	client := startGRPC(t, ctx, &GRPCServer{Dispatcher: d})
+
+	metrics := []gostatsd.Metric{
+		{Name: "foo.bar", Type: gostatsd.COUNTER, Value: 12, Tags: gostatsd.Tags{"a:b"}},
+		{Name: "foo.baz", Type: gostatsd.COUNTER, Value: 3},
+		{Name: "foo.bar", Type: gostatsd.GAUGE, Value: 7},
+		{Name: "qux", Type: gostatsd.SET, StringValue: "v"},
+		{Name: "qux", Type: gostatsd.TIMER, Value: 5},
+	}
+	for i := range metrics {
+		require.NoError(t, d.DispatchMetric(ctx, &metrics[i]))
+	}
+	var resp *adminpb.ListMetricsResponse
+	var err error
+	for i := 0; i < 100; i++ {
+		resp, err = client.ListMetrics(ctx, &adminpb.ListMetricsRequest{})
+		require.NoError(t, err)
+		if len(resp.Metrics) == len(metrics) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Len(t, resp.Metrics, len(metrics))
+	assert.Equal(t, "foo.bar", resp.Metrics[0].Name)
+	assert.Equal(t, adminpb.MetricType_COUNTER, resp.Metrics[0].Type)
+	assert.Equal(t, "a:b", resp.Metrics[0].TagsKey)
+	assert.Equal(t, []string{"a:b"}, resp.Metrics[0].Tags)
+	assert.Equal(t, float64(12), resp.Metrics[0].Value)
+	assert.Equal(t, adminpb.MetricType_GAUGE, resp.Metrics[1].Type)
+	assert.Equal(t, []float64{5}, resp.Metrics[3].TimerValues)
+	assert.Equal(t, []string{"v"}, resp.Metrics[4].SetValues)
+
+	resp, err = client.ListMetrics(ctx, &adminpb.ListMetricsRequest{Type: adminpb.MetricType_GAUGE})
+	require.NoError(t, err)
+	require.Len(t, resp.Metrics, 1)
+	assert.Equal(t, float64(7), resp.Metrics[0].Value)
+
+	resp, err = client.SearchMetrics(ctx, &adminpb.SearchMetricsRequest{Type: adminpb.MetricType_COUNTER, Pattern: `^foo\.`})
+	require.NoError(t, err)
+	require.Len(t, resp.Metrics, 2)
+	assert.Equal(t, "foo.bar", resp.Metrics[0].Name)
+	assert.Equal(t, "foo.baz", resp.Metrics[1].Name)
+
+	_, err = client.SearchMetrics(ctx, &adminpb.SearchMetricsRequest{Pattern: `(`})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	deleted, err := client.DeleteMetrics(ctx, &adminpb.DeleteMetricsRequest{Type: adminpb.MetricType_COUNTER, Names: []string{"foo.bar", "missing"}})
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), deleted.Deleted)
+	_, err = client.DeleteMetrics(ctx, &adminpb.DeleteMetricsRequest{Names: []string{"qux"}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	resp, err = client.SearchMetrics(ctx, &adminpb.SearchMetricsRequest{Pattern: `^foo\.bar$`})
+	require.NoError(t, err)
+	require.Len(t, resp.Metrics, 1)
+	assert.Equal(t, adminpb.MetricType_GAUGE, resp.Metrics[0].Type)
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestGRPCServerStatsAndForceFlush(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	d := NewMetricDispatcher(2, 10, &agrFactory{})
+	mr := NewMetricReceiver("", NewDispatchingHandler(d, nil, nil, 1))
+	fl := NewMetricFlusher(time.Hour, d, mr, nopHandler{}, nil, gostatsd.UnknownIP, "host")
+	var flushed []*gostatsd.MetricMap
+	fl.SetFlushObservers(time.Second, func(ctx context.Context, m *gostatsd.MetricMap) {
+		flushed = append(flushed, m)
+	})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, fl.Run(ctx))
+	}()
+	client := startGRPC(t, ctx, &GRPCServer{Receiver: mr, Dispatcher: d, Flusher: fl})
+
+	require.NoError(t, mr.handlePacket(ctx, fakesocket.FakeAddr, []byte("foo.bar:12|c\nfoo.bar")))
+	stats, err := client.GetStats(ctx, &adminpb.GetStatsRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), stats.MetricsReceived)
+	assert.Equal(t, uint64(1), stats.BadLines)
+
+	waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.NumStats == 1
+	})
+	_, err = client.ForceFlush(ctx, &adminpb.ForceFlushRequest{})
+	require.NoError(t, err)
+	require.Len(t, flushed, 1) // ForceFlush returns after the flush is done
+	assert.Equal(t, int64(12), flushed[0].Counters["foo.bar"][formatTagsKey(nil, "127.0.0.1")].Value)
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestGRPCServerAuthorization(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	d := NewMetricDispatcher(2, 10, &agrFactory{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	auditLog := &syncBuffer{}
+	client := startGRPC(t, ctx, &GRPCServer{Dispatcher: d, Credentials: testCredentials(t), AuditLogWriter: auditLog})
+	require.NoError(t, d.DispatchMetric(ctx, &gostatsd.Metric{Name: "foo", Type: gostatsd.COUNTER, Value: 1}))
+	basicAuth := func(userPassword string) context.Context {
+		return metadata.AppendToOutgoingContext(ctx, "authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(userPassword)))
+	}
+	del := &adminpb.DeleteMetricsRequest{Type: adminpb.MetricType_COUNTER, Names: []string{"foo"}}
+
+	_, err := client.ListMetrics(ctx, &adminpb.ListMetricsRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.ListMetrics(basicAuth("bob:wrong"), &adminpb.ListMetricsRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.ListMetrics(basicAuth("bob:bob-secret"), &adminpb.ListMetricsRequest{})
+	assert.NoError(t, err)
+	_, err = client.DeleteMetrics(basicAuth("bob:bob-secret"), del)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.ForceFlush(basicAuth("bob:bob-secret"), &adminpb.ForceFlushRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	var resp *adminpb.DeleteMetricsResponse
+	for i := 0; i < 100; i++ {
+		resp, err = client.DeleteMetrics(basicAuth("alice:alice-secret"), del)
+		require.NoError(t, err)
+		if resp.Deleted == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, uint32(1), resp.Deleted)
+
+	events := auditLog.events(t)
+	require.GreaterOrEqual(t, len(events), 3)
+	assert.Equal(t, "grpc", events[0].Source)
+	assert.Equal(t, "127.0.0.1", events[0].ClientIP)
+	assert.Equal(t, "bob", events[0].User)
+	assert.Equal(t, "DeleteMetrics", events[0].Command)
+	assert.Equal(t, []string{"COUNTER", "foo"}, events[0].Args)
+	assert.Equal(t, AuditResultFailure, events[0].Result)
+	assert.Equal(t, "permission denied: DeleteMetrics requires the admin role", events[0].Error)
+	assert.Equal(t, "ForceFlush", events[1].Command)
+	assert.Equal(t, AuditResultFailure, events[1].Result)
+	last := events[len(events)-1]
+	assert.Equal(t, "alice", last.User)
+	assert.Equal(t, AuditResultSuccess, last.Result)
+	assert.Equal(t, uint32(1), last.Count)
+
+	cancelFunc()
+	wg.Wait()
+}
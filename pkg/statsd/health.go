@@ -0,0 +1,148 @@
+package statsd
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// HealthServer is an object that listens for HTTP connections on a TCP address Addr
+// and reports health of the statsd server for load balancers.
+//
+// Both /health and /ready respond with 200 if the receiver is listening and at least one backend is healthy,
+// 503 otherwise. /ready also responds with 503 once the server is shutting down so that load balancers
+// stop sending metrics to it. Statuses of backends are reported if the Flusher implements BackendStatusReporter.
+type HealthServer struct {
+	Addr     string
+	Receiver Receiver
+	Flusher  Flusher
+
+	listening    int32 // Accessed atomically
+	shuttingDown int32 // Accessed atomically
+}
+
+// SetListening sets whether the receiver is listening on its socket. Safe for concurrent use.
+func (s *HealthServer) SetListening(listening bool) {
+	var v int32
+	if listening {
+		v = 1
+	}
+	atomic.StoreInt32(&s.listening, v)
+}
+
+// SetShuttingDown marks the server as shutting down. Safe for concurrent use.
+func (s *HealthServer) SetShuttingDown() {
+	atomic.StoreInt32(&s.shuttingDown, 1)
+}
+
+// ListenAndServe listens on the HealthServer's TCP network address and then calls Serve.
+func (s *HealthServer) ListenAndServe(ctx context.Context) error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return s.Serve(ctx, l)
+}
+
+// Serve accepts incoming connections on the listener and serves health checks until the context is done.
+func (s *HealthServer) Serve(ctx context.Context, l net.Listener) error {
+	srv := &http.Server{Handler: s.Handler()}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close() // #nosec Makes Serve return
+		case <-done:
+		}
+	}()
+	err := srv.Serve(l)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Handler returns the http.Handler of the health checks.
+func (s *HealthServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		s.writeStatus(w, false)
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		s.writeStatus(w, true)
+	})
+	return mux
+}
+
+type healthStatus struct {
+	Healthy      bool                  `json:"healthy"`
+	ShuttingDown bool                  `json:"shutting_down"`
+	Receiver     receiverHealthStatus  `json:"receiver"`
+	Backends     []backendHealthStatus `json:"backends"`
+}
+
+type receiverHealthStatus struct {
+	Listening       bool      `json:"listening"`
+	PacketsReceived uint64    `json:"packets_received"`
+	MetricsReceived uint64    `json:"metrics_received"`
+	BadLines        uint64    `json:"bad_lines"`
+	LastPacket      time.Time `json:"last_packet"`
+}
+
+type backendHealthStatus struct {
+	Name             string    `json:"name"`
+	Healthy          bool      `json:"healthy"`
+	LastSuccess      time.Time `json:"last_success"`
+	LastError        time.Time `json:"last_error"`
+	LastErrorMessage string    `json:"last_error_message,omitempty"`
+}
+
+// writeStatus responds with the health status. The status is unhealthy during shutdown if ready is true.
+func (s *HealthServer) writeStatus(w http.ResponseWriter, ready bool) {
+	receiverStats := s.Receiver.GetStats()
+	status := healthStatus{
+		ShuttingDown: atomic.LoadInt32(&s.shuttingDown) != 0,
+		Receiver: receiverHealthStatus{
+			Listening:       atomic.LoadInt32(&s.listening) != 0,
+			PacketsReceived: receiverStats.PacketsReceived,
+			MetricsReceived: receiverStats.MetricsReceived,
+			BadLines:        receiverStats.BadLines,
+			LastPacket:      receiverStats.LastPacket,
+		},
+		Backends: []backendHealthStatus{},
+	}
+	var healthyBackends int
+	if reporter, ok := s.Flusher.(BackendStatusReporter); ok {
+		for _, bs := range reporter.BackendStatuses() {
+			healthy := bs.Healthy()
+			if healthy {
+				healthyBackends++
+			}
+			status.Backends = append(status.Backends, backendHealthStatus{
+				Name:             bs.Name,
+				Healthy:          healthy,
+				LastSuccess:      bs.LastSuccess,
+				LastError:        bs.LastError,
+				LastErrorMessage: bs.LastErrorMessage,
+			})
+		}
+	}
+	status.Healthy = status.Receiver.Listening && healthyBackends > 0 && !(ready && status.ShuttingDown)
+
+	code := http.StatusOK
+	if !status.Healthy {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Debugf("Failed to write health status: %v", err)
+	}
+}
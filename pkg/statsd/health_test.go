@@ -0,0 +1,90 @@
+package statsd
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type namedBackend struct {
+	capturingBackend
+	name string
+}
+
+func (nb *namedBackend) Name() string {
+	return nb.name
+}
+
+func checkHealth(t *testing.T, h http.Handler, path string) (int, healthStatus) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	var status healthStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	return w.Code, status
+}
+
+func TestHealthServer(t *testing.T) {
+	t.Parallel()
+	backends := []gostatsd.Backend{&namedBackend{name: "b"}, &namedBackend{name: "a"}}
+	fl := NewMetricFlusher(0, nil, nil, nil, backends, gostatsd.UnknownIP, "host")
+	hs := &HealthServer{Receiver: NewMetricReceiver("", nopHandler{}), Flusher: fl}
+	h := hs.Handler()
+
+	code, status := checkHealth(t, h, "/health")
+	assert.Equal(t, http.StatusServiceUnavailable, code) // Not listening
+	assert.False(t, status.Healthy)
+	assert.False(t, status.Receiver.Listening)
+
+	hs.SetListening(true)
+	for _, path := range []string{"/health", "/ready"} {
+		code, status = checkHealth(t, h, path)
+		assert.Equal(t, http.StatusOK, code, path) // Backends are healthy until they fail
+		assert.True(t, status.Healthy)
+		require.Len(t, status.Backends, 2)
+		assert.Equal(t, "a", status.Backends[0].Name)
+		assert.Equal(t, "b", status.Backends[1].Name)
+	}
+
+	fl.handleSendResult("a", []error{errors.New("boom")})
+	code, status = checkHealth(t, h, "/ready")
+	assert.Equal(t, http.StatusOK, code) // One backend is still healthy
+	assert.False(t, status.Backends[0].Healthy)
+	assert.Equal(t, "boom", status.Backends[0].LastErrorMessage)
+	assert.True(t, status.Backends[1].Healthy)
+
+	fl.handleSendResult("b", []error{errors.New("boom")})
+	code, _ = checkHealth(t, h, "/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	fl.handleSendResult("a", nil)
+	code, status = checkHealth(t, h, "/ready")
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, status.Backends[0].Healthy)
+
+	hs.SetShuttingDown()
+	code, status = checkHealth(t, h, "/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.True(t, status.ShuttingDown)
+	code, _ = checkHealth(t, h, "/health")
+	assert.Equal(t, http.StatusOK, code) // Still alive while draining
+}
+
+func TestHealthServerNoBackends(t *testing.T) {
+	t.Parallel()
+	hs := &HealthServer{
+		Receiver: NewMetricReceiver("", nopHandler{}),
+		Flusher:  NewMetricFlusher(0, nil, nil, nil, nil, gostatsd.UnknownIP, "host"),
+	}
+	hs.SetListening(true)
+	code, status := checkHealth(t, hs.Handler(), "/health")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Empty(t, status.Backends)
+}
@@ -0,0 +1,170 @@
+package statsd
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// MetricInfo is a copy of an aggregated metric returned by ListMetrics.
+type MetricInfo struct {
+	Name        string
+	Type        gostatsd.MetricType
+	TagsKey     string // Key the metric is aggregated by, derived from tags and hostname
+	Tags        gostatsd.Tags
+	Hostname    string
+	Value       float64   // Value of a counter or a gauge
+	TimerValues []float64 // Values of a timer
+	SetValues   []string  // Sorted values of a set
+	// LastUpdated is when a value of the metric was last received, metrics expire after not being updated for
+	// the expiry interval of their type.
+	LastUpdated time.Time
+}
+
+// MetricFilter returns true if metrics of the type with the name should be included.
+type MetricFilter func(metricType gostatsd.MetricType, name string) bool
+
+// ListMetrics returns copies of aggregated metrics of all Aggregators of the Dispatcher accepted by the filter.
+// Metrics are sorted by name, then by type, then by tags key.
+func ListMetrics(ctx context.Context, d Dispatcher, filter MetricFilter) ([]MetricInfo, error) {
+	var lock sync.Mutex
+	var metrics metricInfos
+	wg := d.Process(ctx, func(workerId uint16, aggr Aggregator) {
+		aggr.Process(func(m *gostatsd.MetricMap) {
+			var result metricInfos
+			m.Counters.Each(func(name, tagsKey string, counter gostatsd.Counter) {
+				if filter(gostatsd.COUNTER, name) {
+					result = append(result, MetricInfo{
+						Name:        name,
+						Type:        gostatsd.COUNTER,
+						TagsKey:     tagsKey,
+						Tags:        copyTags(counter.Tags),
+						Hostname:    counter.Hostname,
+						LastUpdated: time.Unix(0, int64(counter.Timestamp)),
+						Value:       float64(counter.Value),
+					})
+				}
+			})
+			m.Timers.Each(func(name, tagsKey string, timer gostatsd.Timer) {
+				if filter(gostatsd.TIMER, name) {
+					result = append(result, MetricInfo{
+						Name:        name,
+						Type:        gostatsd.TIMER,
+						TagsKey:     tagsKey,
+						Tags:        copyTags(timer.Tags),
+						Hostname:    timer.Hostname,
+						LastUpdated: time.Unix(0, int64(timer.Timestamp)),
+						TimerValues: copyFloats(timer.Values),
+					})
+				}
+			})
+			m.Gauges.Each(func(name, tagsKey string, gauge gostatsd.Gauge) {
+				if filter(gostatsd.GAUGE, name) {
+					result = append(result, MetricInfo{
+						Name:        name,
+						Type:        gostatsd.GAUGE,
+						TagsKey:     tagsKey,
+						Tags:        copyTags(gauge.Tags),
+						Hostname:    gauge.Hostname,
+						LastUpdated: time.Unix(0, int64(gauge.Timestamp)),
+						Value:       gauge.Value,
+					})
+				}
+			})
+			m.Sets.Each(func(name, tagsKey string, set gostatsd.Set) {
+				if filter(gostatsd.SET, name) {
+					values := make([]string, 0, len(set.Values))
+					for value := range set.Values {
+						values = append(values, value)
+					}
+					sort.Strings(values)
+					result = append(result, MetricInfo{
+						Name:        name,
+						Type:        gostatsd.SET,
+						TagsKey:     tagsKey,
+						Tags:        copyTags(set.Tags),
+						Hostname:    set.Hostname,
+						LastUpdated: time.Unix(0, int64(set.Timestamp)),
+						SetValues:   values,
+					})
+				}
+			})
+			lock.Lock()
+			defer lock.Unlock()
+			metrics = append(metrics, result...)
+		})
+	})
+	wg.Wait() // Wait for all workers to execute function
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sort.Sort(metrics)
+	return metrics, nil
+}
+
+// DeleteMetrics deletes aggregated metrics of the type with the names from all Aggregators of the Dispatcher.
+// Returns the number of distinct metric names deleted, a name held by several Aggregators is counted once.
+func DeleteMetrics(ctx context.Context, d Dispatcher, metricType gostatsd.MetricType, names []string) (uint32, error) {
+	f, ok := metricTypeMappers[metricType]
+	if !ok {
+		return 0, errInvalidType
+	}
+	deleted := deleteNames(ctx, d, f, names)
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// deleteNames deletes the metrics with the names from all Aggregators of the Dispatcher and returns the number of
+// distinct names deleted. A name held by several Aggregators, e.g. after resharding, is counted once.
+func deleteNames(ctx context.Context, d Dispatcher, f mapperFunc, names []string) uint32 {
+	var mu sync.Mutex
+	deleted := make(map[string]bool, len(names))
+	wg := d.Process(ctx, func(workerId uint16, aggr Aggregator) {
+		aggr.Process(func(m *gostatsd.MetricMap) {
+			metrics := f(m)
+			for _, name := range names {
+				if metrics.HasChildren(name) {
+					metrics.Delete(name)
+					mu.Lock()
+					deleted[name] = true
+					mu.Unlock()
+				}
+			}
+		})
+	})
+	wg.Wait() // Wait for all workers to execute function
+	return uint32(len(deleted))
+}
+
+var metricTypeMappers = map[gostatsd.MetricType]mapperFunc{
+	gostatsd.COUNTER: getCounters,
+	gostatsd.TIMER:   getTimers,
+	gostatsd.GAUGE:   getGauges,
+	gostatsd.SET:     getSets,
+}
+
+// metricInfos sorts by name, then by type, then by tags key.
+type metricInfos []MetricInfo
+
+func (m metricInfos) Len() int {
+	return len(m)
+}
+
+func (m metricInfos) Less(i, j int) bool {
+	if m[i].Name != m[j].Name {
+		return m[i].Name < m[j].Name
+	}
+	if m[i].Type != m[j].Type {
+		return m[i].Type < m[j].Type
+	}
+	return m[i].TagsKey < m[j].TagsKey
+}
+
+func (m metricInfos) Swap(i, j int) {
+	m[i], m[j] = m[j], m[i]
+}
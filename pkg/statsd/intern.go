@@ -0,0 +1,79 @@
+package statsd
+
+import (
+	"container/list"
+	"sync"
+)
+
+// internShards is the number of shards of an internTable, each locked separately to reduce contention between
+// receivers.
+const internShards = 16
+
+// internTable deduplicates strings parsed from packets, such as metric names and tags, which repeat across
+// packets, so that a string is allocated once rather than for each line. The table holds a bounded number of
+// strings, the least recently used string of a shard is evicted when it is full. Safe for concurrent use.
+type internTable struct {
+	shards [internShards]internShard
+}
+
+type internShard struct {
+	mu      sync.Mutex
+	size    int                      // Maximum number of strings
+	entries map[string]*list.Element // Entries of lru by string
+	lru     *list.List               // Strings from the most to the least recently used
+}
+
+// newInternTable initialises a new internTable holding up to size strings, size must be positive.
+func newInternTable(size int) *internTable {
+	shardSize := (size + internShards - 1) / internShards
+	t := &internTable{}
+	for i := range t.shards {
+		t.shards[i] = internShard{
+			size:    shardSize,
+			entries: make(map[string]*list.Element),
+			lru:     list.New(),
+		}
+	}
+	return t
+}
+
+// intern returns a string equal to the bytes, allocating it only if the table does not hold it yet.
+func (t *internTable) intern(b []byte) string {
+	shard := &t.shards[internHash(b)%internShards]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if e, ok := shard.entries[string(b)]; ok { // The conversion does not allocate
+		shard.lru.MoveToFront(e)
+		return e.Value.(string)
+	}
+	s := string(b)
+	if shard.lru.Len() >= shard.size {
+		oldest := shard.lru.Back()
+		shard.lru.Remove(oldest)
+		delete(shard.entries, oldest.Value.(string))
+	}
+	shard.entries[s] = shard.lru.PushFront(s)
+	return s
+}
+
+// len returns the number of strings held by the table.
+func (t *internTable) len() int {
+	n := 0
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.mu.Lock()
+		n += shard.lru.Len()
+		shard.mu.Unlock()
+	}
+	return n
+}
+
+// internHash returns the FNV-1a hash of the bytes, computed inline so that it does not allocate.
+func internHash(b []byte) uint32 {
+	hash := uint32(2166136261)
+	for _, c := range b {
+		hash ^= uint32(c)
+		hash *= 16777619
+	}
+	return hash
+}
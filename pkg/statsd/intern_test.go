@@ -0,0 +1,92 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/fakesocket"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInternTable(t *testing.T) {
+	// Not parallel because AllocsPerRun does not support it
+	it := newInternTable(100)
+	b := []byte("foo.bar")
+	assert.Equal(t, "foo.bar", it.intern(b))
+	b[0] = 'g' // The interned string does not share the bytes
+	assert.Equal(t, "goo.bar", it.intern(b))
+	assert.Equal(t, "foo.bar", it.intern([]byte("foo.bar")))
+	assert.Equal(t, 2, it.len())
+
+	allocs := testing.AllocsPerRun(100, func() {
+		it.intern(b)
+	})
+	assert.Zero(t, allocs)
+}
+
+func TestInternTableEvictsLeastRecentlyUsed(t *testing.T) {
+	t.Parallel()
+	it := newInternTable(2 * internShards) // 2 strings per shard
+	// Find strings of the same shard
+	var same []string
+	for i := 0; len(same) < 3; i++ {
+		s := fmt.Sprintf("metric.%d", i)
+		if internHash([]byte(s))%internShards == internHash([]byte("metric.0"))%internShards {
+			same = append(same, s)
+		}
+	}
+	shard := &it.shards[internHash([]byte(same[0]))%internShards]
+	it.intern([]byte(same[0]))
+	it.intern([]byte(same[1]))
+	it.intern([]byte(same[0])) // same[1] is now the least recently used
+	it.intern([]byte(same[2]))
+	require.Equal(t, 2, shard.lru.Len())
+	assert.Contains(t, shard.entries, same[0])
+	assert.NotContains(t, shard.entries, same[1])
+	assert.Contains(t, shard.entries, same[2])
+
+	for i := 0; i < 1000; i++ {
+		it.intern([]byte(fmt.Sprintf("other.%d", i)))
+	}
+	assert.Equal(t, 2*internShards, it.len())
+}
+
+func TestReceiveInterned(t *testing.T) {
+	t.Parallel()
+	ch := &countingHandler{}
+	mr := NewMetricReceiver("", ch)
+	mr.SetInternSize(10)
+	require.NoError(t, mr.handlePacket(context.Background(), fakesocket.FakeAddr, []byte("a.b:1|c|#x:y,z\na.b:2|c|#x:y")))
+	require.Len(t, ch.metrics, 2)
+	assert.Equal(t, "a.b", ch.metrics[1].Name)
+	assert.Equal(t, gostatsd.Tags{"x:y"}, ch.metrics[1].Tags)
+	assert.Equal(t, 3, mr.interns.len())
+}
+
+// BenchmarkInternNames measures allocations of parsing lines of 10k distinct metrics with and without the intern
+// table.
+func BenchmarkInternNames(b *testing.B) {
+	lines := make([][]byte, 10000)
+	for i := range lines {
+		lines[i] = []byte(fmt.Sprintf("service.requests.endpoint_%d:1|c|#env:prod,region:us-east-1,host:web-%d", i, i%100))
+	}
+	for _, size := range []int{0, DefaultInternSize} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			mr := NewMetricReceiver("", nopHandler{})
+			mr.SetInternSize(size)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				m, _, err := mr.parseLine(lines[n%len(lines)])
+				if err != nil {
+					b.Fatal(err)
+				}
+				putMetric(m)
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package statsd
+
+// keyBytes are the bytes kept as is in keys of metrics: letters, digits, '.', '-' and '_'.
+var keyBytes = func() (kb [256]bool) {
+	for b := 'a'; b <= 'z'; b++ {
+		kb[b] = true
+	}
+	for b := 'A'; b <= 'Z'; b++ {
+		kb[b] = true
+	}
+	for b := '0'; b <= '9'; b++ {
+		kb[b] = true
+	}
+	kb['.'], kb['-'], kb['_'] = true, true, true
+	return kb
+}()
+
+// keyPrefixLenGeneric returns the length of the longest prefix of the bytes made of keyBytes.
+func keyPrefixLenGeneric(b []byte) int {
+	for i, c := range b {
+		if !keyBytes[c] {
+			return i
+		}
+	}
+	return len(b)
+}
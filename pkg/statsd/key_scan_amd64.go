@@ -0,0 +1,27 @@
+//go:build amd64
+// +build amd64
+
+package statsd
+
+// hasSSE42 is whether the CPU supports the SSE4.2 string instructions used by keyPrefixLenSSE42.
+var hasSSE42 = cpuHasSSE42()
+
+// keyPrefixLen returns the length of the longest prefix of the bytes made of keyBytes. Blocks of 16 bytes are
+// scanned with SSE4.2 if the CPU supports it, which is faster than checking each byte for typical keys.
+func keyPrefixLen(b []byte) int {
+	if !hasSSE42 || len(b) < 16 {
+		return keyPrefixLenGeneric(b)
+	}
+	n := keyPrefixLenSSE42(b)
+	return n + keyPrefixLenGeneric(b[n:])
+}
+
+// keyPrefixLenSSE42 returns the length of the longest prefix of the bytes made of keyBytes, or the length of the
+// blocks of 16 bytes scanned if all of them are made of keyBytes. The remaining bytes are not scanned so that
+// bytes past the end of the slice are never read. Implemented in key_scan_amd64.s.
+//
+//go:noescape
+func keyPrefixLenSSE42(b []byte) int
+
+// cpuHasSSE42 returns whether the CPU supports SSE4.2. Implemented in key_scan_amd64.s.
+func cpuHasSSE42() bool
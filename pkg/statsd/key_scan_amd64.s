@@ -0,0 +1,51 @@
+//go:build amd64
+// +build amd64
+
+#include "textflag.h"
+
+// Ranges of keyBytes for PCMPESTRI: a-z, A-Z, 0-9, '-' to '.' and '_'.
+DATA keyRanges<>+0(SB)/8, $"azAZ09-."
+DATA keyRanges<>+8(SB)/2, $"__"
+GLOBL keyRanges<>(SB), RODATA|NOPTR, $16
+
+// func keyPrefixLenSSE42(b []byte) int
+TEXT ·keyPrefixLenSSE42(SB), NOSPLIT, $0-32
+	MOVQ  b_base+0(FP), SI
+	MOVQ  b_len+8(FP), BX
+	MOVOU keyRanges<>(SB), X0
+	XORQ  DI, DI // Offset of the next block
+
+loop:
+	MOVQ BX, R8
+	SUBQ DI, R8
+	CMPQ R8, $16
+	JB   done // Less than a block is left
+
+	MOVOU (SI)(DI*1), X1
+	MOVQ  $10, AX // Length of the ranges
+	MOVQ  $16, DX // Length of the block
+
+	// Unsigned bytes, ranges, negative polarity: CX is the index of the first byte of the block
+	// out of the ranges, 16 if there is none.
+	PCMPESTRI $0x14, X1, X0
+	CMPQ      CX, $16
+	JB        found
+	ADDQ      $16, DI
+	JMP       loop
+
+found:
+	ADDQ CX, DI
+
+done:
+	MOVQ DI, ret+24(FP)
+	RET
+
+// func cpuHasSSE42() bool
+TEXT ·cpuHasSSE42(SB), NOSPLIT, $0-1
+	MOVL  $1, AX
+	XORL  CX, CX
+	CPUID
+	SHRL  $20, CX // SSE4.2 is bit 20 of ECX
+	ANDL  $1, CX
+	MOVB  CX, ret+0(FP)
+	RET
@@ -0,0 +1,9 @@
+//go:build !amd64
+// +build !amd64
+
+package statsd
+
+// keyPrefixLen returns the length of the longest prefix of the bytes made of keyBytes.
+func keyPrefixLen(b []byte) int {
+	return keyPrefixLenGeneric(b)
+}
@@ -0,0 +1,78 @@
+package statsd
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyPrefixLen(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		key      string
+		expected int
+	}{
+		{"", 0},
+		{"abc", 3},
+		{":1|c", 0},
+		{"abc.def-ghi_JKL.0123456789:1|c", 26},
+		{"service.requests.endpoint.latency:1|ms", 33},
+		{"service.requests.endpoint.latency", 33},
+		{"service.requests/endpoint", 16},
+		{"service requests", 7},
+		{"0123456789abcde\x00f", 15},
+		{strings.Repeat("a", 47) + "é", 47},
+		{strings.Repeat("z", 64), 64},
+	} {
+		assert.Equal(t, test.expected, keyPrefixLen([]byte(test.key)), test.key)
+		assert.Equal(t, test.expected, keyPrefixLenGeneric([]byte(test.key)), test.key)
+	}
+}
+
+func TestKeyPrefixLenMatchesGeneric(t *testing.T) {
+	t.Parallel()
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		b := make([]byte, r.Intn(80))
+		for j := range b {
+			if r.Intn(20) == 0 {
+				b[j] = byte(r.Intn(256))
+			} else {
+				b[j] = "abcXYZ019.-_"[r.Intn(12)]
+			}
+		}
+		// Bytes past the end of the slice are not scanned
+		for _, n := range []int{len(b), len(b) / 2} {
+			if !assert.Equal(t, keyPrefixLenGeneric(b[:n]), keyPrefixLen(b[:n]), "%q", b[:n]) {
+				return
+			}
+		}
+	}
+}
+
+// BenchmarkKeyPrefixLen compares scanning keys of typical lengths with the implementation of the architecture,
+// e.g. SSE4.2, and the pure Go implementation.
+func BenchmarkKeyPrefixLen(b *testing.B) {
+	for _, length := range []int{8, 16, 32, 64, 128} {
+		key := []byte(strings.Repeat("service.", length/8) + ":1|c")
+		for _, impl := range []struct {
+			name string
+			f    func([]byte) int
+		}{
+			{"arch", keyPrefixLen},
+			{"generic", keyPrefixLenGeneric},
+		} {
+			b.Run(fmt.Sprintf("%s/len=%d", impl.name, length), func(b *testing.B) {
+				b.SetBytes(int64(length))
+				for n := 0; n < b.N; n++ {
+					if impl.f(key) != length {
+						b.Fatal("wrong length")
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package statsd
+
+import (
+	"context"
+)
+
+// Leader elects the only server flushing metrics to backends among servers aggregating the same metrics, e.g.
+// after a split brain. See package ha.
+type Leader interface {
+	// IsLeader returns whether the server flushes metrics to backends. Must be safe for concurrent use.
+	IsLeader() bool
+	// Run keeps the leadership up to date until the context is done.
+	Run(ctx context.Context) error
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"math"
 	"strconv"
+	"strings"
 
 	"github.com/atlassian/gostatsd"
 )
@@ -20,24 +21,44 @@ type lexer struct {
 	e             *gostatsd.Event
 	tags          gostatsd.Tags
 	namespace     string
+	renames       RenameRules
 	err           error
 	sampling      float64
+	unknownFields uint32 // Number of skipped fields with unknown markers
+	buckets       bool   // Whether tags of timers can be histogram buckets, see extractBuckets
+	// Deduplicates names and tags, nil if disabled
+	interns *internTable
+	// Allocates the metric, nil if metrics are taken from the pool
+	arena *gostatsd.MetricArena
+	// Type of metric lines without a type, which are rejected if 0
+	untypedType gostatsd.MetricType
+	// Whether the line had no type and untypedType was assumed
+	untyped bool
 }
 
+// ContainerIDTagKey is the key of the tag with the ID of the container that sent the metric or event, taken from
+// the c: field of DogStatsD 1.2 origin detection.
+const ContainerIDTagKey = "container_id"
+
 // assumes we don't have \x00 bytes in input.
 const eof byte = 0
 
 var (
 	errMissingKeySep         = errors.New("missing key separator")
 	errEmptyKey              = errors.New("key zero len")
+	errEmptyValue            = errors.New("empty value")
+	errEmptyType             = errors.New("empty type")
+	errNonNumericValue       = errors.New("non-numeric value")
+	errNonFiniteValue        = errors.New("non-finite value")
 	errMissingValueSep       = errors.New("missing value separator")
 	errInvalidType           = errors.New("invalid type")
+	errUnknownType           = errors.New("unknown type")
 	errInvalidFormat         = errors.New("invalid format")
 	errInvalidSamplingOrTags = errors.New("invalid sampling or tags")
 	errInvalidAttributes     = errors.New("invalid event attributes")
 	errOverflow              = errors.New("overflow")
 	errNotEnoughData         = errors.New("not enough data")
-	errNaN                   = errors.New("invalid value NaN")
+	errInvalidBuckets        = errors.New("invalid histogram buckets")
 )
 
 var escapedNewline = []byte("\\n")
@@ -70,30 +91,58 @@ func (l *lexer) run(input []byte, namespace string) (*gostatsd.Metric, *gostatsd
 		state = state(l)
 	}
 	if l.err != nil {
+		l.release()
 		return nil, nil, l.err
 	}
 	if l.m != nil {
 		if l.m.Type != gostatsd.SET {
+			// NaN and infinite values would poison aggregates. Values out of range are parsed as infinite.
 			v, err := strconv.ParseFloat(l.m.StringValue, 64)
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				l.release()
+				return nil, nil, errNonFiniteValue
+			}
 			if err != nil {
-				return nil, nil, err
+				l.release()
+				return nil, nil, errNonNumericValue
 			}
-			if math.IsNaN(v) {
-				return nil, nil, errNaN
+			// A signed gauge value is a delta, as in StatsD
+			if l.m.Type == gostatsd.GAUGE && (l.m.StringValue[0] == '+' || l.m.StringValue[0] == '-') {
+				l.m.GaugeDelta = true
 			}
 			l.m.Value = v
 			l.m.StringValue = ""
 		}
 		if l.m.Type == gostatsd.COUNTER {
 			l.m.Value = l.m.Value / l.sampling
+			// A sample rate of 0 or NaN makes the value non-finite too
+			if math.IsNaN(l.m.Value) || math.IsInf(l.m.Value, 0) {
+				l.release()
+				return nil, nil, errNonFiniteValue
+			}
 		}
 		l.m.Tags = l.tags
+		if l.buckets && l.m.Type == gostatsd.TIMER {
+			var err error
+			if l.m.Tags, l.m.Buckets, err = extractBuckets(l.tags); err != nil {
+				l.release()
+				return nil, nil, err
+			}
+		}
 	} else {
 		l.e.Tags = l.tags
 	}
 	return l.m, l.e, nil
 }
 
+// release returns the metric of a line that failed to parse to its arena or the pool.
+func (l *lexer) release() {
+	if l.m != nil {
+		putMetric(l.m)
+		l.m = nil
+	}
+}
+
 type stateFn func(*lexer) stateFn
 
 // check the first byte for special Datadog type.
@@ -106,7 +155,12 @@ func lexSpecial(l *lexer) stateFn {
 		return nil
 	default:
 		l.pos--
-		l.m = new(gostatsd.Metric)
+		if l.arena != nil {
+			l.m = l.arena.Alloc()
+		}
+		if l.m == nil {
+			l.m = getMetric()
+		}
 		return lexKeySep
 	}
 }
@@ -114,6 +168,8 @@ func lexSpecial(l *lexer) stateFn {
 // lex until we find the colon separator between key and value.
 func lexKeySep(l *lexer) stateFn {
 	for {
+		// Letters, digits, '.', '-' and '_' are kept as is
+		l.pos += uint32(keyPrefixLen(l.input[l.pos:l.len]))
 		switch b := l.next(); b {
 		case '/':
 			l.input[l.pos-1] = '-'
@@ -124,13 +180,7 @@ func lexKeySep(l *lexer) stateFn {
 		case eof:
 			l.err = errMissingKeySep
 			return nil
-		case '.', '-', '_':
-			continue
 		default:
-			r := rune(b)
-			if (97 <= r && 122 >= r) || (65 <= r && 90 >= r) || (48 <= r && 57 >= r) {
-				continue
-			}
 			l.input = append(l.input[0:l.pos-1], l.input[l.pos:]...)
 			l.len--
 			l.pos--
@@ -237,8 +287,10 @@ func lexEventAttribute(l *lexer) stateFn {
 			}
 			return lexEventAttributes
 		}))
+	case 'c':
+		return lexAssert(':', lexUntil('|', lexContainerID(lexEventAttributes)))
 	case '#':
-		return lexTags
+		return lexTags(lexEventAttributes)
 	case eof:
 	default:
 		l.err = errInvalidAttributes
@@ -315,13 +367,26 @@ func lexUntil(stop byte, handler func(*lexer, []byte) stateFn) stateFn {
 	}
 }
 
+// intern returns a string equal to the bytes, deduplicated by the intern table if it is enabled.
+func (l *lexer) intern(b []byte) string {
+	if l.interns == nil {
+		return string(b)
+	}
+	return l.interns.intern(b)
+}
+
 // lex the key.
 func lexKey(l *lexer) stateFn {
 	if l.start == l.pos-1 {
 		l.err = errEmptyKey
 		return nil
 	}
-	l.m.Name = string(l.input[l.start : l.pos-1])
+	l.m.Name = l.renames.Rename(l.intern(l.input[l.start : l.pos-1]))
+	if l.m.Name == "" {
+		// Renamed to an empty name
+		l.err = errEmptyKey
+		return nil
+	}
 	if l.namespace != "" {
 		l.m.Name = l.namespace + "." + l.m.Name
 	}
@@ -329,7 +394,8 @@ func lexKey(l *lexer) stateFn {
 	return lexValueSep
 }
 
-// lex until we find the pipe separator between value and modifier.
+// lex until we find the pipe separator between value and modifier. Lines without it have no type and are
+// rejected unless untypedType is set.
 func lexValueSep(l *lexer) stateFn {
 	for {
 		// cheap check here. ParseFloat will do it.
@@ -337,111 +403,233 @@ func lexValueSep(l *lexer) stateFn {
 		case '|':
 			return lexValue
 		case eof:
-			l.err = errMissingValueSep
-			return nil
+			if l.untypedType == 0 {
+				l.err = errMissingValueSep
+				return nil
+			}
+			return lexUntypedValue
 		}
 	}
 }
 
+// lex the value of a line without a type, which is the rest of the line.
+func lexUntypedValue(l *lexer) stateFn {
+	if l.start == l.pos {
+		l.err = errEmptyValue
+		return nil
+	}
+	l.m.StringValue = string(l.input[l.start:l.pos])
+	l.m.Type = l.untypedType
+	l.untyped = true
+	return nil
+}
+
 // lex the value.
 func lexValue(l *lexer) stateFn {
+	if l.start == l.pos-1 {
+		l.err = errEmptyValue
+		return nil
+	}
 	l.m.StringValue = string(l.input[l.start : l.pos-1])
 	l.start = l.pos
 	return lexType
 }
 
-// lex the type.
+// lex the type. Histograms and distributions of DogStatsD are aggregated as timers.
 func lexType(l *lexer) stateFn {
-	b := l.next()
-	switch b {
-	case 'c':
-		l.m.Type = gostatsd.COUNTER
-		l.start = l.pos
-		return lexTypeSep
-	case 'g':
-		l.m.Type = gostatsd.GAUGE
-		l.start = l.pos
-		return lexTypeSep
-	case 'm':
-		if b := l.next(); b != 's' {
-			l.err = errInvalidType
+	return lexUntil('|', func(l *lexer, data []byte) stateFn {
+		switch string(data) {
+		case "c":
+			l.m.Type = gostatsd.COUNTER
+		case "g":
+			l.m.Type = gostatsd.GAUGE
+		case "ms", "h", "d", "t":
+			l.m.Type = gostatsd.TIMER
+		case "s":
+			l.m.Type = gostatsd.SET
+		case "":
+			l.err = errEmptyType
+			return nil
+		default:
+			// Types of letters are likely supported by other clients, others are malformed
+			l.err = errUnknownType
+			for _, b := range data {
+				if b < 'a' || b > 'z' {
+					l.err = errInvalidType
+					break
+				}
+			}
 			return nil
 		}
-		l.start = l.pos
-		l.m.Type = gostatsd.TIMER
-		return lexTypeSep
-	case 's':
-		l.m.Type = gostatsd.SET
-		l.start = l.pos
-		return lexTypeSep
-	default:
-		l.err = errInvalidType
-		return nil
-
-	}
+		return lexFieldSep
+	})(l)
 }
 
-// lex the possible separator between type and sampling rate.
-func lexTypeSep(l *lexer) stateFn {
-	b := l.next()
-	switch b {
+// lex an optional field. Fields can be in any order: sample rate (@), tags (#), unit (u:), container ID (c:).
+// Tags of repeated tag fields are merged. Fields with unknown markers are skipped and counted.
+func lexField(l *lexer) stateFn {
+	switch b := l.next(); b {
+	case '@':
+		return lexUntil('|', lexSampleRate)
+	case '#':
+		return lexTags(lexFieldSep)
+	case 'u':
+		if l.pos < l.len && l.input[l.pos] == ':' {
+			l.pos++
+			return lexUntil('|', lexUnit)
+		}
+		l.pos--
+		return lexUnknownField
+	case 'c':
+		if l.pos < l.len && l.input[l.pos] == ':' {
+			l.pos++
+			return lexUntil('|', lexContainerID(lexFieldSep))
+		}
+		l.pos--
+		return lexUnknownField
 	case eof:
+		l.err = errInvalidSamplingOrTags
 		return nil
-	case '|':
-		l.start = l.pos
-		return lexSampleRateOrTags
+	default:
+		l.pos--
+		return lexUnknownField
 	}
-	l.err = errInvalidType
-	return nil
 }
 
-// lex the sample rate or the tags.
-func lexSampleRateOrTags(l *lexer) stateFn {
-	b := l.next()
-	switch b {
-	case '@':
-		l.start = l.pos
-		for {
-			switch b := l.next(); b {
-			case '|':
-				return lexSampleRate
-			case eof:
-				l.pos++
-				return lexSampleRate
-			}
-		}
-	case '#':
-		return lexTags
+// lex a field with an unknown marker.
+func lexUnknownField(l *lexer) stateFn {
+	return lexUntil('|', func(l *lexer, data []byte) stateFn {
+		l.unknownFields++
+		return lexFieldSep
+	})(l)
+}
+
+// lex the possible separator between optional fields.
+func lexFieldSep(l *lexer) stateFn {
+	switch b := l.next(); b {
+	case eof:
+		return nil
+	case '|':
+		return lexField
 	default:
-		l.err = errInvalidSamplingOrTags
+		// Should never happen because fields are lexed until the separator.
+		l.err = errInvalidFormat
 		return nil
 	}
 }
 
 // lex the sample rate.
-func lexSampleRate(l *lexer) stateFn {
-	v, err := strconv.ParseFloat(string(l.input[l.start:l.pos-1]), 64)
+func lexSampleRate(l *lexer, data []byte) stateFn {
+	v, err := strconv.ParseFloat(string(data), 64)
 	if err != nil {
 		l.err = err
 		return nil
 	}
 	l.sampling = v
-	if l.pos >= l.len {
-		return nil
+	return lexFieldSep
+}
+
+// lex the unit. The last unit wins if there are several unit fields.
+func lexUnit(l *lexer, data []byte) stateFn {
+	l.m.Unit = string(data)
+	return lexFieldSep
+}
+
+// bucketsTagPrefix is the prefix of the tag with the first histogram bucket computed by the client of a timer.
+const bucketsTagPrefix = "buckets:"
+
+// extractBuckets returns the tags without the histogram buckets and the buckets, e.g. the tags of
+// #buckets:0-10:5,10-100:20,100+:3 are buckets [0, 10) with 5 samples, [10, 100) with 20 and [100, +Inf) with 3.
+// Buckets are the buckets: tag and the following tags that are buckets.
+func extractBuckets(tags gostatsd.Tags) (gostatsd.Tags, gostatsd.HistogramBuckets, error) {
+	var buckets gostatsd.HistogramBuckets
+	var result gostatsd.Tags
+	inBuckets := false
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, bucketsTagPrefix) {
+			b, ok := parseBucket(tag[len(bucketsTagPrefix):])
+			if !ok {
+				return nil, nil, errInvalidBuckets
+			}
+			buckets = append(buckets, b)
+			inBuckets = true
+			continue
+		}
+		if inBuckets {
+			if b, ok := parseBucket(tag); ok {
+				buckets = append(buckets, b)
+				continue
+			}
+			inBuckets = false
+		}
+		result = append(result, tag)
+	}
+	// Merging sorts buckets and adds counts of repeated buckets
+	return result, buckets.Merge(nil), nil
+}
+
+// parseBucket parses a bucket with bounds and a count, <lower>-<upper>:<count>, or without an upper bound,
+// <lower>+:<count>.
+func parseBucket(s string) (gostatsd.HistogramBucket, bool) {
+	p := strings.LastIndexByte(s, ':')
+	if p == -1 {
+		return gostatsd.HistogramBucket{}, false
+	}
+	count, err := strconv.ParseUint(s[p+1:], 10, 64)
+	if err != nil {
+		return gostatsd.HistogramBucket{}, false
+	}
+	bounds := s[:p]
+	if bounds == "" {
+		return gostatsd.HistogramBucket{}, false
+	}
+	var lower, upper string
+	if strings.HasSuffix(bounds, "+") {
+		lower = bounds[:len(bounds)-1]
+	} else {
+		sep := strings.IndexByte(bounds[1:], '-') + 1 // The lower bound can be negative
+		if sep == 0 {
+			return gostatsd.HistogramBucket{}, false
+		}
+		lower, upper = bounds[:sep], bounds[sep+1:]
+	}
+	b := gostatsd.HistogramBucket{Upper: math.Inf(1), Count: count}
+	if b.Lower, err = strconv.ParseFloat(lower, 64); err != nil || math.IsInf(b.Lower, 0) || math.IsNaN(b.Lower) {
+		return gostatsd.HistogramBucket{}, false
+	}
+	if upper != "" {
+		if b.Upper, err = strconv.ParseFloat(upper, 64); err != nil || math.IsNaN(b.Upper) || b.Upper <= b.Lower {
+			return gostatsd.HistogramBucket{}, false
+		}
 	}
-	return lexAssert('#', lexTags)
+	return b, true
 }
 
-// lex the tags.
-func lexTags(l *lexer) stateFn {
-	return lexUntil(',', func(l *lexer, data []byte) stateFn {
+// lexContainerID returns a function that adds the container ID as the ContainerIDTagKey tag and returns next.
+// An empty container ID is ignored.
+func lexContainerID(next stateFn) func(*lexer, []byte) stateFn {
+	return func(l *lexer, data []byte) stateFn {
 		if len(data) > 0 {
-			l.tags = append(l.tags, string(data))
+			l.tags = append(l.tags, ContainerIDTagKey+":"+string(data))
 		}
-		if l.pos == l.len { // eof
-			return nil
+		return next
+	}
+}
+
+// lexTags returns a function that lexes comma separated tags up to the field separator and returns next.
+func lexTags(next stateFn) stateFn {
+	return lexUntil('|', func(l *lexer, data []byte) stateFn {
+		for len(data) > 0 {
+			var tag []byte
+			if p := bytes.IndexByte(data, ','); p == -1 {
+				tag, data = data, nil
+			} else {
+				tag, data = data[:p], data[p+1:]
+			}
+			if len(tag) > 0 {
+				l.tags = append(l.tags, l.intern(tag))
+			}
 		}
-		l.pos++ // consume comma
-		return lexTags
+		return next
 	})
 }
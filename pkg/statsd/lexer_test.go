@@ -1,9 +1,13 @@
 package statsd
 
 import (
+	"bytes"
+	"context"
+	"math"
 	"testing"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/fakesocket"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -63,6 +67,269 @@ func TestInvalidMetricsLexer(t *testing.T) {
 	compareMetric(t, tests, "stats")
 }
 
+func TestMetricsLexerFieldOrder(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		metric        gostatsd.Metric
+		unknownFields uint32
+	}{
+		"a:5|c|@0.5|#x:y":            {metric: gostatsd.Metric{Name: "a", Value: 10, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"x:y"}}},
+		"a:5|c|#x:y|@0.5":            {metric: gostatsd.Metric{Name: "a", Value: 10, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"x:y"}}},
+		"a:5|c|#x:y|#z":              {metric: gostatsd.Metric{Name: "a", Value: 5, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"x:y", "z"}}},
+		"a:5|c|#x:y|@0.5|#z,w":       {metric: gostatsd.Metric{Name: "a", Value: 10, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"x:y", "z", "w"}}},
+		"a:5|c|@0.5|#x:y|#z":         {metric: gostatsd.Metric{Name: "a", Value: 10, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"x:y", "z"}}},
+		"a:5|c|#x:y,|#,z":            {metric: gostatsd.Metric{Name: "a", Value: 5, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"x:y", "z"}}},
+		"a:5|c|#|@0.5":               {metric: gostatsd.Metric{Name: "a", Value: 10, Type: gostatsd.COUNTER}},
+		"a:5|ms|#x:y|@0.5":           {metric: gostatsd.Metric{Name: "a", Value: 5, Type: gostatsd.TIMER, Tags: gostatsd.Tags{"x:y"}}},
+		"a:5|c|T1500000000":          {metric: gostatsd.Metric{Name: "a", Value: 5, Type: gostatsd.COUNTER}, unknownFields: 1},
+		"a:5|c|T1500000000|#x:y":     {metric: gostatsd.Metric{Name: "a", Value: 5, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"x:y"}}, unknownFields: 1},
+		"a:5|c|#x:y|c:abc|@0.5":      {metric: gostatsd.Metric{Name: "a", Value: 10, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"x:y", "container_id:abc"}}},
+		"a:5|c|@0.5|T1|c:abc|#x:y":   {metric: gostatsd.Metric{Name: "a", Value: 10, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"container_id:abc", "x:y"}}, unknownFields: 1},
+		"a:5|c|c:|ca:b":              {metric: gostatsd.Metric{Name: "a", Value: 5, Type: gostatsd.COUNTER}, unknownFields: 1},
+		"a:5|c||#x:y":                {metric: gostatsd.Metric{Name: "a", Value: 5, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"x:y"}}, unknownFields: 1},
+		"un1qu3:john|s|#x:y|@0.5|#z": {metric: gostatsd.Metric{Name: "un1qu3", StringValue: "john", Type: gostatsd.SET, Tags: gostatsd.Tags{"x:y", "z"}}},
+		"a:5|c|u:bytes":              {metric: gostatsd.Metric{Name: "a", Value: 5, Type: gostatsd.COUNTER, Unit: "bytes"}},
+		"a:5|ms|#x:y|u:s|@0.5":       {metric: gostatsd.Metric{Name: "a", Value: 5, Type: gostatsd.TIMER, Tags: gostatsd.Tags{"x:y"}, Unit: "s"}},
+		"a:5|g|u:|#x:y":              {metric: gostatsd.Metric{Name: "a", Value: 5, Type: gostatsd.GAUGE, Tags: gostatsd.Tags{"x:y"}}},
+		"a:5|g|u:a|u:b":              {metric: gostatsd.Metric{Name: "a", Value: 5, Type: gostatsd.GAUGE, Unit: "b"}},
+		"a:5|c|unit|u":               {metric: gostatsd.Metric{Name: "a", Value: 5, Type: gostatsd.COUNTER}, unknownFields: 2},
+	}
+	for input, expected := range tests {
+		input := input
+		expected := expected
+		t.Run(input, func(t *testing.T) {
+			t.Parallel()
+			l := lexer{}
+			result, _, err := l.run([]byte(input), "")
+			require.NoError(t, err)
+			assert.Equal(t, &expected.metric, result)
+			assert.Equal(t, expected.unknownFields, l.unknownFields)
+		})
+	}
+}
+
+func TestDogStatsDContainerIDLexer(t *testing.T) {
+	t.Parallel()
+	// Datagrams sent by DogStatsD 1.2 clients with origin detection
+	tests := map[string]gostatsd.Metric{
+		"page.views:1|c|#env:prod,service:web|c:83c1dbc6e0aa3b6f7a24f0aa2c7fd3be3adf7b3e1b66bb5c9bd0b1a4b69ba9c8": {
+			Name:  "page.views",
+			Value: 1,
+			Type:  gostatsd.COUNTER,
+			Tags:  gostatsd.Tags{"env:prod", "service:web", "container_id:83c1dbc6e0aa3b6f7a24f0aa2c7fd3be3adf7b3e1b66bb5c9bd0b1a4b69ba9c8"},
+		},
+		"request.latency:12.5|ms|@0.5|#route:/api|c:2a5e0a4c1d3b": {
+			Name:  "request.latency",
+			Value: 12.5,
+			Type:  gostatsd.TIMER,
+			Tags:  gostatsd.Tags{"route:/api", "container_id:2a5e0a4c1d3b"},
+		},
+		"queue.size:42|g|c:ci-0123456789abcdef": {
+			Name:  "queue.size",
+			Value: 42,
+			Type:  gostatsd.GAUGE,
+			Tags:  gostatsd.Tags{"container_id:ci-0123456789abcdef"},
+		},
+	}
+	compareMetric(t, tests, "")
+
+	_, e, err := parseLine([]byte("_e{5,4}:title|text|#env:prod|c:2a5e0a4c1d3b"), "")
+	require.NoError(t, err)
+	assert.Equal(t, gostatsd.Tags{"env:prod", "container_id:2a5e0a4c1d3b"}, e.Tags)
+}
+
+func TestHistogramBucketsLexer(t *testing.T) {
+	t.Parallel()
+	inf := math.Inf(1)
+	tests := map[string]gostatsd.Metric{
+		"metric.histogram:100|ms|#buckets:0-10:5,10-100:20,100+:3": {
+			Name:    "metric.histogram",
+			Value:   100,
+			Type:    gostatsd.TIMER,
+			Buckets: gostatsd.HistogramBuckets{{Lower: 0, Upper: 10, Count: 5}, {Lower: 10, Upper: 100, Count: 20}, {Lower: 100, Upper: inf, Count: 3}},
+		},
+		"a:1|ms|#env:prod,buckets:-5-0.5:2,0.5+:1,x:y": {
+			Name:    "a",
+			Value:   1,
+			Type:    gostatsd.TIMER,
+			Tags:    gostatsd.Tags{"env:prod", "x:y"},
+			Buckets: gostatsd.HistogramBuckets{{Lower: -5, Upper: 0.5, Count: 2}, {Lower: 0.5, Upper: inf, Count: 1}},
+		},
+		"a:1|ms|#buckets:10+:1|#buckets:0-10:2,0-10:3": {
+			Name:    "a",
+			Value:   1,
+			Type:    gostatsd.TIMER,
+			Buckets: gostatsd.HistogramBuckets{{Lower: 0, Upper: 10, Count: 5}, {Lower: 10, Upper: inf, Count: 1}},
+		},
+		"a:1|ms|#x:y":           {Name: "a", Value: 1, Type: gostatsd.TIMER, Tags: gostatsd.Tags{"x:y"}},
+		"a:1|c|#buckets:0-10:5": {Name: "a", Value: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"buckets:0-10:5"}},
+	}
+	for input, expected := range tests {
+		input := input
+		expected := expected
+		t.Run(input, func(t *testing.T) {
+			t.Parallel()
+			l := lexer{buckets: true}
+			result, _, err := l.run([]byte(input), "")
+			require.NoError(t, err)
+			assert.Equal(t, &expected, result)
+		})
+	}
+	for _, input := range []string{"a:1|ms|#buckets:", "a:1|ms|#buckets:0-10", "a:1|ms|#buckets:10-0:1", "a:1|ms|#buckets:x+:1", "a:1|ms|#buckets::1", "a:1|ms|#buckets:0-10:-1"} {
+		l := lexer{buckets: true}
+		_, _, err := l.run([]byte(input), "")
+		assert.Equal(t, errInvalidBuckets, err, input)
+	}
+	// Buckets are tags if the parser mode is disabled
+	m, _, err := parseLine([]byte("a:1|ms|#buckets:0-10:5"), "")
+	require.NoError(t, err)
+	assert.Equal(t, gostatsd.Tags{"buckets:0-10:5"}, m.Tags)
+	assert.Nil(t, m.Buckets)
+}
+
+func TestInvalidMetricFieldsLexer(t *testing.T) {
+	t.Parallel()
+	failing := map[string]error{
+		"a:5|c|":      errInvalidSamplingOrTags,
+		"a:5|c|#x:y|": errInvalidSamplingOrTags,
+		"a:5|c|@0.5|": errInvalidSamplingOrTags,
+	}
+	for input, expectedErr := range failing {
+		input := input
+		expectedErr := expectedErr
+		t.Run(input, func(t *testing.T) {
+			t.Parallel()
+			m, e, err := parseLine([]byte(input), "")
+			assert.Equal(t, expectedErr, err)
+			assert.Nil(t, m)
+			assert.Nil(t, e)
+		})
+	}
+	for _, input := range []string{"a:5|c|@", "a:5|c|@x|#x:y", "a:5|c|#x:y|@x"} {
+		_, _, err := parseLine([]byte(input), "")
+		assert.Error(t, err, input)
+	}
+}
+
+func TestRejectedMetricsLexer(t *testing.T) {
+	t.Parallel()
+	failing := map[string]error{
+		":1|c":      errEmptyKey,
+		"$%:1|c":    errEmptyKey,
+		"a:|c":      errEmptyValue,
+		"a:|s":      errEmptyValue,
+		"a:1|":      errEmptyType,
+		"a:1|#x:y":  errInvalidType,
+		"a:abc|c":   errNonNumericValue,
+		"a:1x|g":    errNonNumericValue,
+		"a:NaN|ms":  errNonFiniteValue,
+		"a:+Inf|g":  errNonFiniteValue,
+		"a:1e400|c": errNonFiniteValue,
+	}
+	for input, expectedErr := range failing {
+		input := input
+		expectedErr := expectedErr
+		t.Run(input, func(t *testing.T) {
+			t.Parallel()
+			m, e, err := parseLine([]byte(input), "")
+			assert.Equal(t, expectedErr, err)
+			assert.Nil(t, m)
+			assert.Nil(t, e)
+		})
+	}
+
+	l := lexer{renames: RenameRules{{From: "a", To: ""}}}
+	_, _, err := l.run([]byte("a:1|c"), "")
+	assert.Equal(t, errEmptyKey, err, "renamed to an empty name")
+}
+
+func TestNonFiniteValuesLexer(t *testing.T) {
+	t.Parallel()
+	for _, statsdType := range []string{"c", "g", "ms", "h", "d"} {
+		for _, value := range []string{"Inf", "+Inf", "-Inf", "NaN", "-1e400"} {
+			input := "a:" + value + "|" + statsdType
+			m, _, err := parseLine([]byte(input), "")
+			assert.Equal(t, errNonFiniteValue, err, input)
+			assert.Nil(t, m, input)
+		}
+	}
+	// Sampling a counter by 0 would make it infinite
+	_, _, err := parseLine([]byte("a:1|c|@0"), "")
+	assert.Equal(t, errNonFiniteValue, err)
+	// Set values are strings
+	m, _, err := parseLine([]byte("a:NaN|s"), "")
+	require.NoError(t, err)
+	assert.Equal(t, "NaN", m.StringValue)
+}
+
+func TestUntypedMetricsLexer(t *testing.T) {
+	t.Parallel()
+	// Rejected by default
+	l := lexer{}
+	_, _, err := l.run([]byte("a:1"), "")
+	assert.Equal(t, errMissingValueSep, err)
+	assert.False(t, l.untyped)
+
+	tests := map[string]struct {
+		untypedType gostatsd.MetricType
+		expected    gostatsd.Metric
+		untyped     bool
+	}{
+		"a:1":     {gostatsd.COUNTER, gostatsd.Metric{Name: "a", Value: 1, Type: gostatsd.COUNTER}, true},
+		"a:-2.5":  {gostatsd.GAUGE, gostatsd.Metric{Name: "a", Value: -2.5, Type: gostatsd.GAUGE, GaugeDelta: true}, true},
+		"a:10":    {gostatsd.TIMER, gostatsd.Metric{Name: "a", Value: 10, Type: gostatsd.TIMER}, true},
+		"a:joe":   {gostatsd.SET, gostatsd.Metric{Name: "a", StringValue: "joe", Type: gostatsd.SET}, true},
+		"a:3|g":   {gostatsd.COUNTER, gostatsd.Metric{Name: "a", Value: 3, Type: gostatsd.GAUGE}, false},
+		"a:3|c|#": {gostatsd.TIMER, gostatsd.Metric{Name: "a", Value: 3, Type: gostatsd.COUNTER}, false},
+	}
+	for input, test := range tests {
+		l := lexer{untypedType: test.untypedType}
+		m, _, err := l.run([]byte(input), "")
+		require.NoError(t, err, input)
+		assert.Equal(t, test.expected, *m, input)
+		assert.Equal(t, test.untyped, l.untyped, input)
+	}
+
+	for input, expectedErr := range map[string]error{"a:": errEmptyValue, "a:x": errNonNumericValue, "a": errMissingKeySep} {
+		l := lexer{untypedType: gostatsd.COUNTER}
+		_, _, err := l.run([]byte(input), "")
+		assert.Equal(t, expectedErr, err, input)
+	}
+}
+
+func TestMetricTypesLexer(t *testing.T) {
+	t.Parallel()
+	tests := map[string]gostatsd.Metric{
+		"a:1|c":      {Name: "a", Value: 1, Type: gostatsd.COUNTER},
+		"a:1|g":      {Name: "a", Value: 1, Type: gostatsd.GAUGE},
+		"a:+1|g":     {Name: "a", Value: 1, Type: gostatsd.GAUGE, GaugeDelta: true},
+		"a:-1.5|g":   {Name: "a", Value: -1.5, Type: gostatsd.GAUGE, GaugeDelta: true},
+		"a:1|ms":     {Name: "a", Value: 1, Type: gostatsd.TIMER},
+		"a:1|h":      {Name: "a", Value: 1, Type: gostatsd.TIMER},
+		"a:1|d":      {Name: "a", Value: 1, Type: gostatsd.TIMER},
+		"a:1|t":      {Name: "a", Value: 1, Type: gostatsd.TIMER},
+		"a:1|h|#x:y": {Name: "a", Value: 1, Type: gostatsd.TIMER, Tags: gostatsd.Tags{"x:y"}},
+		"a:-1|c":     {Name: "a", Value: -1, Type: gostatsd.COUNTER},
+		"a:x|s":      {Name: "a", StringValue: "x", Type: gostatsd.SET},
+		"a:-x|s":     {Name: "a", StringValue: "-x", Type: gostatsd.SET},
+	}
+
+	compareMetric(t, tests, "")
+
+	failing := map[string]error{
+		"a:1|q":      errUnknownType,
+		"a:1|m":      errUnknownType,
+		"a:1|cc":     errUnknownType,
+		"a:1|msx|@1": errUnknownType,
+		"a:1|c1":     errInvalidType,
+		"a:1|C":      errInvalidType,
+	}
+	for input, expectedErr := range failing {
+		_, _, err := parseLine([]byte(input), "")
+		assert.Equal(t, expectedErr, err, input)
+	}
+}
+
 func TestEventsLexer(t *testing.T) {
 	t.Parallel()
 	//_e{title.length,text.length}:title|text|d:date_happened|h:hostname|p:priority|t:alert_type|#tag1,tag2
@@ -78,10 +345,11 @@ func TestEventsLexer(t *testing.T) {
 		"_e{1,1}:a|b|p:low|t:warning|d:123123|h:hoost|#tag1,t:tag2": {Title: "a", Text: "b", DateHappened: 123123, Hostname: "hoost", Priority: gostatsd.PriLow, AlertType: gostatsd.AlertWarning, Tags: []string{"tag1", "t:tag2"}},
 		"_e{1,1}:a|b|h:hoost|p:low|t:warning|d:123123|#tag1,t:tag2": {Title: "a", Text: "b", DateHappened: 123123, Hostname: "hoost", Priority: gostatsd.PriLow, AlertType: gostatsd.AlertWarning, Tags: []string{"tag1", "t:tag2"}},
 
-		"_e{1,1}:a|b|h:hoost":      {Title: "a", Text: "b", Hostname: "hoost"},
-		"_e{1,1}:a|b|p:low":        {Title: "a", Text: "b", Priority: gostatsd.PriLow},
-		"_e{1,1}:a|b|t:warning":    {Title: "a", Text: "b", AlertType: gostatsd.AlertWarning},
-		"_e{1,1}:a|b|#tag1,t:tag2": {Title: "a", Text: "b", Tags: []string{"tag1", "t:tag2"}},
+		"_e{1,1}:a|b|h:hoost":             {Title: "a", Text: "b", Hostname: "hoost"},
+		"_e{1,1}:a|b|p:low":               {Title: "a", Text: "b", Priority: gostatsd.PriLow},
+		"_e{1,1}:a|b|t:warning":           {Title: "a", Text: "b", AlertType: gostatsd.AlertWarning},
+		"_e{1,1}:a|b|#tag1,t:tag2":        {Title: "a", Text: "b", Tags: []string{"tag1", "t:tag2"}},
+		"_e{1,1}:a|b|#tag1|p:low|#t:tag2": {Title: "a", Text: "b", Priority: gostatsd.PriLow, Tags: []string{"tag1", "t:tag2"}},
 		"_e{20,34}:Deployment completed|Deployment completed in 7 minutes.|d:1463746133|h:9c00cf070c14|s:Micros Server|t:success|#topic:service.deploy,message_env:pdev,service_id:node-refapp-ci-internal,deployment_id:72e95b0f-37b0-4cf9-8e92-3e47d006b63f": {
 			Title:          "Deployment completed",
 			Text:           "Deployment completed in 7 minutes.",
@@ -108,20 +376,20 @@ func TestEventsLexer(t *testing.T) {
 func TestInvalidEventsLexer(t *testing.T) {
 	t.Parallel()
 	failing := map[string]error{
-		"_x{1,1}:a|b": errInvalidType,
-		"_e{2,1}:a|b": errNotEnoughData,
-		"_e{1,2}:a|b": errNotEnoughData,
-		"_e{2,2}:a|b": errNotEnoughData,
-		"_e{1,1}:ab":  errNotEnoughData,
-		"_e{1,1}ab":   errInvalidFormat,
-		"_e{1,1}a:b":  errInvalidFormat,
-		"_e{1,1}:a:b": errInvalidFormat,
-		"_e{,1}:a|b":  errInvalidFormat,
-		"_e{1,}:a|b":  errInvalidFormat,
-		"_e{1}:a|b":   errInvalidFormat,
-		"_e{}:a|b":    errInvalidFormat,
-		"_e1,2}:a|b":  errInvalidFormat,
-		"_e:a|b":      errInvalidFormat,
+		"_x{1,1}:a|b":                        errInvalidType,
+		"_e{2,1}:a|b":                        errNotEnoughData,
+		"_e{1,2}:a|b":                        errNotEnoughData,
+		"_e{2,2}:a|b":                        errNotEnoughData,
+		"_e{1,1}:ab":                         errNotEnoughData,
+		"_e{1,1}ab":                          errInvalidFormat,
+		"_e{1,1}a:b":                         errInvalidFormat,
+		"_e{1,1}:a:b":                        errInvalidFormat,
+		"_e{,1}:a|b":                         errInvalidFormat,
+		"_e{1,}:a|b":                         errInvalidFormat,
+		"_e{1}:a|b":                          errInvalidFormat,
+		"_e{}:a|b":                           errInvalidFormat,
+		"_e1,2}:a|b":                         errInvalidFormat,
+		"_e:a|b":                             errInvalidFormat,
 		"_e{999999999999999999999999,1}:a|b": errOverflow,
 		"_e{1,999999999999999999999999}:a|b": errOverflow,
 	}
@@ -138,6 +406,35 @@ func TestInvalidEventsLexer(t *testing.T) {
 	}
 }
 
+// FuzzParser parses packets of lines like the receiver does, the seed corpus is in testdata/fuzz/FuzzParser.
+// Run it with make fuzz. Lines parsed without error are either a metric or an event.
+func FuzzParser(f *testing.F) {
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		for _, line := range bytes.Split(packet, newline) {
+			m, e, err := parseLine(line, "")
+			if err != nil {
+				if m != nil || e != nil {
+					t.Fatalf("%q: both a result and error %v", line, err)
+				}
+				continue
+			}
+			if m != nil && e != nil {
+				t.Fatalf("%q: both a metric and an event", line)
+			}
+			if m == nil && e == nil {
+				t.Fatalf("%q: neither a metric nor an event", line)
+			}
+			if m != nil && m.Name == "" {
+				t.Fatalf("%q: metric with an empty name", line)
+			}
+		}
+		mr := NewMetricReceiver("", &countingHandler{})
+		if err := mr.handlePacket(context.Background(), fakesocket.FakeAddr, packet); err != nil {
+			t.Fatalf("%q: %v", packet, err)
+		}
+	})
+}
+
 func parseLine(input []byte, namespace string) (*gostatsd.Metric, *gostatsd.Event, error) {
 	l := lexer{}
 	return l.run(input, namespace)
@@ -0,0 +1,53 @@
+package statsd
+
+import (
+	"sync"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// metricPool holds metrics released by the MetricDispatcher once they are aggregated, so that parsing a line does
+// not allocate a metric. Tags are not pooled because aggregated metrics and metric updates keep the tags of
+// received metrics.
+var metricPool = sync.Pool{
+	New: func() interface{} {
+		return new(gostatsd.Metric)
+	},
+}
+
+// getMetric returns an empty metric from the pool.
+func getMetric() *gostatsd.Metric {
+	return metricPool.Get().(*gostatsd.Metric)
+}
+
+// putMetric clears the metric and returns it to its arena or the pool. The metric must not be used afterwards.
+func putMetric(m *gostatsd.Metric) {
+	if m.Release() {
+		return
+	}
+	*m = gostatsd.Metric{}
+	metricPool.Put(m)
+}
+
+// metricArenas pools arenas of the same size. An arena is returned to the pool once it is reset, i.e. all its
+// metrics are released by putMetric.
+type metricArenas struct {
+	pool sync.Pool
+}
+
+func newMetricArenas(size int) *metricArenas {
+	ma := &metricArenas{}
+	ma.pool.New = func() interface{} {
+		return gostatsd.NewMetricArena(size, ma.put)
+	}
+	return ma
+}
+
+// get returns an empty arena.
+func (ma *metricArenas) get() *gostatsd.MetricArena {
+	return ma.pool.Get().(*gostatsd.MetricArena)
+}
+
+func (ma *metricArenas) put(a *gostatsd.MetricArena) {
+	ma.pool.Put(a)
+}
@@ -0,0 +1,104 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/fakesocket"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricPool(t *testing.T) {
+	t.Parallel()
+	m := getMetric()
+	m.Name = "a"
+	m.Tags = gostatsd.Tags{"b:c"}
+	tags := m.Tags
+	putMetric(m)
+	assert.Equal(t, gostatsd.Metric{}, *m)
+	assert.Equal(t, gostatsd.Tags{"b:c"}, tags) // Tags are not reused
+	assert.Equal(t, gostatsd.Metric{}, *getMetric())
+}
+
+func TestLexerReleasesMetricOfBadLine(t *testing.T) {
+	t.Parallel()
+	l := lexer{}
+	m, _, err := l.run([]byte("a:x|c"), "")
+	assert.Equal(t, errNonNumericValue, err)
+	assert.Nil(t, m)
+	assert.Nil(t, l.m)
+}
+
+func TestReceiveMetricArena(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	d := NewMetricDispatcher(2, 10, &agrFactory{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	mr := NewMetricReceiver("", NewDispatchingHandler(d, nil, nil, 1))
+	mr.SetMetricArenaSize(2)
+	for i := 0; i < 10; i++ {
+		// More lines than the arena holds and a bad line
+		require.NoError(t, mr.handlePacket(ctx, fakesocket.FakeAddr, []byte("a:1|c\nb:x|c\nc:2|c\nd:3|g")))
+	}
+
+	tagsKey := formatTagsKey(nil, "127.0.0.1") // Hostname is the IP of the fake address
+	snapshot := waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.Gauges["d"][tagsKey].Value == 3
+	})
+	assert.EqualValues(t, 10, snapshot.Counters["a"][tagsKey].Value)
+	assert.EqualValues(t, 20, snapshot.Counters["c"][tagsKey].Value)
+	assert.EqualValues(t, 10, mr.GetStats().BadLines)
+
+	cancelFunc()
+	wg.Wait()
+}
+
+// BenchmarkReceiveMetricArena measures allocations and GC pauses of metrics parsed, dispatched and aggregated
+// with metrics allocated from arenas or taken from the metric pool.
+func BenchmarkReceiveMetricArena(b *testing.B) {
+	packet := []byte(strings.Repeat("foo.bar.baz:2|c\nabc.def.g:3|g\ndef.g:10|ms\n", 20))
+	for _, size := range []int{0, 64} {
+		b.Run(fmt.Sprintf("arena=%d", size), func(b *testing.B) {
+			ctx, cancelFunc := context.WithCancel(context.Background())
+			defer cancelFunc()
+			d := NewMetricDispatcher(4, 100, &agrFactory{})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_ = d.Run(ctx)
+			}()
+			mr := NewMetricReceiver("", NewDispatchingHandler(d, nil, nil, 1))
+			mr.SetMetricArenaSize(size)
+			runtime.GC()
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				if err := mr.handlePacket(ctx, fakesocket.FakeAddr, packet); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			runtime.ReadMemStats(&after)
+			b.Logf("%d GCs, %v total GC pause", after.NumGC-before.NumGC, time.Duration(after.PauseTotalNs-before.PauseTotalNs))
+			cancelFunc()
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package statsd
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// DefaultPayloadBuckets is the default list of upper bounds in bytes of buckets of payload size histograms.
+var DefaultPayloadBuckets = []int{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20}
+
+// PayloadStats holds the histogram of sizes of payloads serialized by a backend since the start.
+type PayloadStats struct {
+	Backend string `json:"backend"`
+	Count   uint64 `json:"count"` // Number of payloads
+	Min     int    `json:"min"`   // Size of the smallest payload in bytes
+	Max     int    `json:"max"`   // Size of the largest payload in bytes
+	Sum     uint64 `json:"sum"`   // Total size of payloads in bytes
+	// Bounds are the upper bounds of buckets in bytes. Counts[i] is the number of payloads not larger than Bounds[i]
+	// and larger than the previous bound, the last count is the number of payloads larger than all bounds.
+	Bounds []int    `json:"bounds"`
+	Counts []uint64 `json:"counts"`
+}
+
+// Mean returns the mean size of payloads in bytes.
+func (ps PayloadStats) Mean() float64 {
+	if ps.Count == 0 {
+		return 0
+	}
+	return float64(ps.Sum) / float64(ps.Count)
+}
+
+// Percentile returns the estimated size in bytes the percentile of payloads are not larger than. The estimate is
+// the upper bound of the bucket the percentile falls into, limited to the sizes of the smallest and largest payloads.
+func (ps PayloadStats) Percentile(pct float64) int {
+	if ps.Count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(pct / 100 * float64(ps.Count)))
+	var seen uint64
+	for i, count := range ps.Counts {
+		seen += count
+		if seen >= rank && i < len(ps.Bounds) {
+			if ps.Bounds[i] < ps.Min {
+				return ps.Min
+			}
+			if ps.Bounds[i] > ps.Max {
+				return ps.Max
+			}
+			return ps.Bounds[i]
+		}
+	}
+	return ps.Max
+}
+
+// payloadHistograms records histograms of payload sizes of backends. Safe for concurrent use.
+type payloadHistograms struct {
+	mu     sync.Mutex
+	bounds []int
+	stats  map[string]*PayloadStats
+}
+
+func newPayloadHistograms() *payloadHistograms {
+	return &payloadHistograms{
+		bounds: DefaultPayloadBuckets,
+		stats:  make(map[string]*PayloadStats),
+	}
+}
+
+// setBounds sets the upper bounds of buckets and clears the recorded histograms.
+func (h *payloadHistograms) setBounds(bounds []int) error {
+	if len(bounds) == 0 {
+		return fmt.Errorf("at least one payload bucket is required")
+	}
+	for i, bound := range bounds {
+		if bound <= 0 || (i > 0 && bound <= bounds[i-1]) {
+			return fmt.Errorf("payload buckets must be positive and increasing, got %v", bounds)
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.bounds = bounds
+	h.stats = make(map[string]*PayloadStats)
+	return nil
+}
+
+// observer returns the observer recording sizes of payloads of the backend.
+func (h *payloadHistograms) observer(backend string) gostatsd.PayloadObserver {
+	return func(size int) {
+		h.observe(backend, size)
+	}
+}
+
+func (h *payloadHistograms) observe(backend string, size int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ps, ok := h.stats[backend]
+	if !ok {
+		ps = &PayloadStats{
+			Backend: backend,
+			Min:     size,
+			Bounds:  h.bounds,
+			Counts:  make([]uint64, len(h.bounds)+1),
+		}
+		h.stats[backend] = ps
+	}
+	ps.Count++
+	ps.Sum += uint64(size)
+	if size < ps.Min {
+		ps.Min = size
+	}
+	if size > ps.Max {
+		ps.Max = size
+	}
+	ps.Counts[sort.SearchInts(h.bounds, size)]++
+}
+
+// snapshot returns copies of the histograms sorted by backend name.
+func (h *payloadHistograms) snapshot() []PayloadStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := make([]PayloadStats, 0, len(h.stats))
+	for _, ps := range h.stats {
+		s := *ps
+		s.Counts = append([]uint64(nil), ps.Counts...)
+		stats = append(stats, s)
+	}
+	sort.Sort(payloadStatsByBackend(stats))
+	return stats
+}
+
+type payloadStatsByBackend []PayloadStats
+
+func (p payloadStatsByBackend) Len() int           { return len(p) }
+func (p payloadStatsByBackend) Less(i, j int) bool { return p[i].Backend < p[j].Backend }
+func (p payloadStatsByBackend) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
@@ -0,0 +1,97 @@
+package statsd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPayloadHistograms(t *testing.T) {
+	t.Parallel()
+	h := newPayloadHistograms()
+	require.NoError(t, h.setBounds([]int{100, 1000}))
+	observe := h.observer("b")
+	for _, size := range []int{10, 100, 101, 500, 5000} {
+		observe(size)
+	}
+	h.observer("a")(50)
+
+	stats := h.snapshot()
+	require.Len(t, stats, 2)
+	assert.Equal(t, "a", stats[0].Backend)
+	assert.Equal(t, PayloadStats{
+		Backend: "b",
+		Count:   5,
+		Min:     10,
+		Max:     5000,
+		Sum:     5711,
+		Bounds:  []int{100, 1000},
+		Counts:  []uint64{2, 2, 1},
+	}, stats[1])
+	assert.InDelta(t, 1142.2, stats[1].Mean(), 0.01)
+
+	// Snapshots are copies
+	stats[1].Counts[0] = 100
+	assert.Equal(t, uint64(2), h.snapshot()[1].Counts[0])
+}
+
+func TestPayloadStatsPercentile(t *testing.T) {
+	t.Parallel()
+	ps := PayloadStats{Count: 100, Min: 20, Max: 700, Bounds: []int{10, 100, 1000, 10000}, Counts: []uint64{0, 98, 2, 0, 0}}
+	assert.Equal(t, 100, ps.Percentile(50))
+	assert.Equal(t, 100, ps.Percentile(98))
+	assert.Equal(t, 700, ps.Percentile(99)) // Bound of the bucket is limited to the largest payload
+	assert.Equal(t, 20, ps.Percentile(0))   // Bound of the first non-empty bucket is limited to the smallest payload
+
+	ps = PayloadStats{Count: 2, Min: 20, Max: 50000, Bounds: []int{100}, Counts: []uint64{1, 1}}
+	assert.Equal(t, 50000, ps.Percentile(99)) // Larger than all bounds
+
+	assert.Zero(t, PayloadStats{}.Percentile(99))
+	assert.Zero(t, PayloadStats{}.Mean())
+}
+
+func TestPayloadHistogramsInvalidBounds(t *testing.T) {
+	t.Parallel()
+	h := newPayloadHistograms()
+	for _, bounds := range [][]int{nil, {0}, {100, 100}, {100, 10}} {
+		assert.Error(t, h.setBounds(bounds), "%v", bounds)
+	}
+}
+
+type payloadBackend struct {
+	capturingBackend
+	observer gostatsd.PayloadObserver
+}
+
+func (pb *payloadBackend) Name() string {
+	return "payloadBackend"
+}
+
+func (pb *payloadBackend) SetPayloadObserver(observer gostatsd.PayloadObserver) {
+	pb.observer = observer
+}
+
+func (pb *payloadBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	pb.observer.Observe(int(m.NumStats) * 10)
+	pb.capturingBackend.SendMetricsAsync(ctx, m, callback)
+}
+
+func TestFlusherPayloadStats(t *testing.T) {
+	t.Parallel()
+	backend := &payloadBackend{}
+	fl := NewMetricFlusher(time.Second, nil, nil, nil, []gostatsd.Backend{backend, &capturingBackend{}}, gostatsd.UnknownIP, "host")
+	require.NoError(t, fl.SetPayloadBuckets([]int{100}))
+	assert.Empty(t, fl.GetStats().Payloads)
+
+	backend.SendMetricsAsync(context.Background(), &gostatsd.MetricMap{MetricStats: gostatsd.MetricStats{NumStats: 3}}, func(errs []error) {})
+	stats := fl.GetStats().Payloads
+	require.Len(t, stats, 1)
+	assert.Equal(t, "payloadBackend", stats[0].Backend)
+	assert.Equal(t, uint64(1), stats[0].Count)
+	assert.Equal(t, 30, stats[0].Max)
+}
@@ -0,0 +1,98 @@
+package statsd
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/atlassian/gostatsd/pkg/persistence/bolt"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// snapshotTimeout is the maximum time to take and write the last snapshot on shutdown.
+const snapshotTimeout = 5 * time.Second
+
+// restoreSnapshot seeds the dispatcher with the snapshot at SnapshotPath if it was taken within the last flush
+// interval. Errors are logged because the server can still start without the state.
+func (s *Server) restoreSnapshot(ctx context.Context, dispatcher Dispatcher) {
+	m, taken, err := bolt.ReadSnapshot(s.SnapshotPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("Failed to read snapshot %s: %v", s.SnapshotPath, err)
+		}
+		return
+	}
+	if age := time.Since(taken); age > s.FlushInterval {
+		log.Infof("Ignoring snapshot %s taken %v ago, before the last flush interval", s.SnapshotPath, age)
+		return
+	}
+	n, err := SeedMetricState(ctx, dispatcher, m)
+	if err != nil {
+		log.Warnf("Failed to import snapshot %s: %v", s.SnapshotPath, err)
+		return
+	}
+	log.Infof("Imported %d metrics from snapshot %s", n, s.SnapshotPath)
+}
+
+// snapshotter periodically writes snapshots of metrics aggregated by the dispatcher to a BoltDB file.
+type snapshotter struct {
+	path       string
+	interval   time.Duration // 0 writes snapshots only after flushes
+	dispatcher Dispatcher
+	flushedCh  chan struct{} // Signalled after each flush
+}
+
+func newSnapshotter(path string, interval time.Duration, dispatcher Dispatcher) *snapshotter {
+	return &snapshotter{
+		path:       path,
+		interval:   interval,
+		dispatcher: dispatcher,
+		flushedCh:  make(chan struct{}, 1),
+	}
+}
+
+// flushed requests a snapshot without the flushed metrics, so that they are not restored and flushed again.
+func (sn *snapshotter) flushed() {
+	select {
+	case sn.flushedCh <- struct{}{}:
+	default: // A snapshot is already requested
+	}
+}
+
+// Run writes snapshots every interval and after each flush until the context is done.
+// The last snapshot is written on shutdown.
+func (sn *snapshotter) Run(ctx context.Context) error {
+	var tick <-chan time.Time
+	if sn.interval > 0 {
+		ticker := time.NewTicker(sn.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			ctxLast, cancelFunc := context.WithTimeout(context.Background(), snapshotTimeout)
+			defer cancelFunc()
+			sn.snapshot(ctxLast)
+			return ctx.Err()
+		case <-tick:
+		case <-sn.flushedCh:
+		}
+		sn.snapshot(ctx)
+	}
+}
+
+func (sn *snapshotter) snapshot(ctx context.Context) {
+	taken := time.Now()
+	m, err := Snapshot(ctx, sn.dispatcher)
+	if err != nil {
+		if err != context.Canceled && err != context.DeadlineExceeded {
+			log.Warnf("Failed to take snapshot: %v", err)
+		}
+		return
+	}
+	if err := bolt.WriteSnapshot(sn.path, m, taken); err != nil {
+		log.Warnf("Failed to write snapshot %s: %v", sn.path, err)
+	}
+}
@@ -0,0 +1,109 @@
+package statsd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/persistence/bolt"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreSnapshot(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "gostatsd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	recent := filepath.Join(dir, "recent.db")
+	stale := filepath.Join(dir, "stale.db")
+	m := newMetricMap()
+	m.Counters["c"] = map[string]gostatsd.Counter{"": gostatsd.NewCounter(10, 5, "", nil)}
+	require.NoError(t, bolt.WriteSnapshot(recent, m, time.Now()))
+	require.NoError(t, bolt.WriteSnapshot(stale, m, time.Now().Add(-time.Minute)))
+
+	tests := []struct {
+		path     string
+		expected uint32
+	}{
+		{recent, 1},
+		{stale, 0},
+		{filepath.Join(dir, "missing.db"), 0},
+	}
+	for _, test := range tests {
+		ctx, cancelFunc := context.WithCancel(context.Background())
+		d := NewMetricDispatcher(1, 10, &agrFactory{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, context.Canceled, d.Run(ctx))
+		}()
+		s := &Server{SnapshotPath: test.path, FlushInterval: 10 * time.Second}
+		s.restoreSnapshot(ctx, d)
+		waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+			return snapshot.NumStats == test.expected
+		})
+		cancelFunc()
+		wg.Wait()
+	}
+}
+
+func TestSnapshotterRun(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "gostatsd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.db")
+	ctxDisp, cancelDisp := context.WithCancel(context.Background())
+	defer cancelDisp()
+	d := NewMetricDispatcher(1, 10, &agrFactory{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctxDisp))
+	}()
+
+	ctx, cancelFunc := context.WithCancel(ctxDisp)
+	sn := newSnapshotter(path, 0, d)
+	done := make(chan error, 1)
+	go func() {
+		done <- sn.Run(ctx)
+	}()
+	require.NoError(t, d.DispatchMetric(ctx, &gostatsd.Metric{Name: "c", Type: gostatsd.COUNTER, Value: 7}))
+	waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.NumStats == 1
+	})
+	sn.flushed()
+	var m *gostatsd.MetricMap
+	for i := 0; i < 100; i++ {
+		m, _, err = bolt.ReadSnapshot(path)
+		if err == nil && len(m.Counters) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), m.Counters["c"][""].Value)
+
+	// The last snapshot is written on shutdown
+	require.NoError(t, d.DispatchMetric(ctx, &gostatsd.Metric{Name: "g", Type: gostatsd.GAUGE, Value: 1}))
+	waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.NumStats == 2
+	})
+	cancelFunc()
+	assert.Equal(t, context.Canceled, <-done)
+	m, _, err = bolt.ReadSnapshot(path)
+	require.NoError(t, err)
+	assert.Len(t, m.Gauges, 1)
+
+	cancelDisp()
+	wg.Wait()
+}
@@ -0,0 +1,29 @@
+package statsd
+
+import (
+	"context"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// precisionBackend rounds the float values of metrics to a number of significant digits before they are sent to
+// the backend, so that they are serialized with the same precision by every backend. Other methods are delegated
+// to the backend.
+type precisionBackend struct {
+	gostatsd.Backend
+	digits int
+}
+
+// newPrecisionBackend returns a precisionBackend rounding values sent to the backend. The number of digits is
+// set on backends serializing values as text.
+func newPrecisionBackend(backend gostatsd.Backend, digits int) *precisionBackend {
+	if setter, ok := backend.(gostatsd.ValuePrecisionSetter); ok {
+		setter.SetValuePrecision(digits)
+	}
+	return &precisionBackend{Backend: backend, digits: digits}
+}
+
+// SendMetricsAsync sends a rounded copy of the metrics to the backend.
+func (pb *precisionBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	pb.Backend.SendMetricsAsync(ctx, m.Round(pb.digits), cb)
+}
@@ -0,0 +1,167 @@
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/quic-go/quic-go"
+)
+
+// QUICProtocol is the ALPN protocol negotiated by QUIC clients sending metrics.
+const QUICProtocol = "statsd"
+
+// quicStreamErrorCode is sent to the peer when reading a stream fails.
+const quicStreamErrorCode quic.StreamErrorCode = 1
+
+// QUICReceiver receives newline-delimited metrics and events over QUIC streams and handles them with the
+// MetricReceiver. Each bidirectional or unidirectional stream opened by a client is read independently,
+// an error reading a stream only closes that stream.
+type QUICReceiver struct {
+	receiver   *MetricReceiver
+	tlsConfig  *tls.Config
+	maxStreams int // Maximum number of concurrent streams of each direction per connection
+}
+
+// NewQUICReceiver initialises a new QUICReceiver. The QUICProtocol is negotiated if the TLS configuration
+// does not set NextProtos. maxStreams limits concurrent streams per connection, 0 for the quic-go default.
+func NewQUICReceiver(receiver *MetricReceiver, tlsConfig *tls.Config, maxStreams int) *QUICReceiver {
+	tlsConfig = tlsConfig.Clone()
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = []string{QUICProtocol}
+	}
+	return &QUICReceiver{
+		receiver:   receiver,
+		tlsConfig:  tlsConfig,
+		maxStreams: maxStreams,
+	}
+}
+
+// ListenAndServe listens on the UDP address and accepts QUIC connections until the context is done.
+func (qr *QUICReceiver) ListenAndServe(ctx context.Context, addr string) error {
+	l, err := quic.ListenAddr(addr, qr.tlsConfig, qr.config())
+	if err != nil {
+		return err
+	}
+	return qr.Serve(ctx, l)
+}
+
+// Serve accepts QUIC connections on the listener until the context is done. The listener is closed on return.
+func (qr *QUICReceiver) Serve(ctx context.Context, l *quic.Listener) error {
+	defer l.Close() // #nosec
+	var wg sync.WaitGroup
+	defer wg.Wait() // Wait for all connections to close
+	for {
+		conn, err := l.Accept(ctx)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+				return err
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			qr.serveConnection(ctx, conn)
+		}()
+	}
+}
+
+func (qr *QUICReceiver) config() *quic.Config {
+	return &quic.Config{
+		MaxIncomingStreams:    int64(qr.maxStreams),
+		MaxIncomingUniStreams: int64(qr.maxStreams),
+		KeepAlivePeriod:       15 * time.Second,
+	}
+}
+
+// serveConnection reads streams of the connection until it is closed or the context is done.
+func (qr *QUICReceiver) serveConnection(ctx context.Context, conn quic.Connection) {
+	var wg sync.WaitGroup
+	defer wg.Wait() // Wait for all streams to finish
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // Closes the connection
+	go func() {
+		<-ctx.Done()
+		conn.CloseWithError(0, "") // #nosec
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer cancel() // The connection is closed if it can no longer accept streams
+		for {
+			stream, err := conn.AcceptUniStream(ctx)
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				qr.serveStream(ctx, conn.RemoteAddr(), stream)
+			}()
+		}
+	}()
+	for {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Debugf("QUIC connection from %s closed: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream.Close() // #nosec Nothing is sent to the client
+			qr.serveStream(ctx, conn.RemoteAddr(), stream)
+		}()
+	}
+}
+
+// serveStream handles lines read from the stream until it ends. Lines longer than the maximum size of a
+// datagram are counted as bad lines.
+func (qr *QUICReceiver) serveStream(ctx context.Context, addr net.Addr, stream quic.ReceiveStream) {
+	r := bufio.NewReaderSize(stream, packetSizeUDP)
+	for {
+		line, err := r.ReadSlice('\n')
+		switch {
+		case err == bufio.ErrBufferFull:
+			log.Debugf("Line from %s is longer than %d bytes", addr, packetSizeUDP)
+			atomic.AddUint64(&qr.receiver.badLines, 1)
+			err = skipLine(r)
+		case len(line) > 0:
+			if _, _, e := qr.receiver.HandleLines(ctx, addr, line); e != nil {
+				if e == context.Canceled || e == context.DeadlineExceeded {
+					stream.CancelRead(quicStreamErrorCode)
+					return
+				}
+				log.Warnf("Failed to handle QUIC stream data: %v", e)
+			}
+		}
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				log.Debugf("Error reading QUIC stream from %s: %v", addr, err)
+				stream.CancelRead(quicStreamErrorCode)
+			}
+			return
+		}
+	}
+}
+
+// skipLine discards the rest of the current line.
+func skipLine(r *bufio.Reader) error {
+	for {
+		_, err := r.ReadSlice('\n')
+		if err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+}
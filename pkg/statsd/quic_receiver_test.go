@@ -0,0 +1,161 @@
+package statsd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTLSConfig returns a TLS configuration with a self-signed certificate.
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// startQUICReceiver serves the receiver on a random port and returns a connection to it.
+func startQUICReceiver(t *testing.T, ctx context.Context, mr *MetricReceiver, maxStreams int) quic.Connection {
+	qr := NewQUICReceiver(mr, testTLSConfig(t), maxStreams)
+	l, err := quic.ListenAddr("127.0.0.1:0", qr.tlsConfig, qr.config())
+	require.NoError(t, err)
+	go qr.Serve(ctx, l)
+	conn, err := quic.DialAddr(ctx, l.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{QUICProtocol}}, nil) // #nosec
+	require.NoError(t, err)
+	return conn
+}
+
+// waitForMetricNames waits until the handler has received the number of metrics and returns their sorted names.
+func waitForMetricNames(t *testing.T, ch *countingHandler, n int) []string {
+	for i := 0; i < 200; i++ {
+		ch.mu.Lock()
+		if len(ch.metrics) >= n {
+			names := make([]string, 0, len(ch.metrics))
+			for _, m := range ch.metrics {
+				names = append(names, m.Name)
+			}
+			ch.mu.Unlock()
+			sort.Strings(names)
+			return names
+		}
+		ch.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("handler did not receive %d metrics", n)
+	return nil
+}
+
+func TestQUICReceiverStreams(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	ch := &countingHandler{}
+	mr := NewMetricReceiver("", ch)
+	conn := startQUICReceiver(t, ctx, mr, 10)
+
+	bidi, err := conn.OpenStream()
+	require.NoError(t, err)
+	uni, err := conn.OpenUniStream()
+	require.NoError(t, err)
+	// Lines can be split across writes
+	_, err = bidi.Write([]byte("a:1|c\nb:"))
+	require.NoError(t, err)
+	_, err = uni.Write([]byte("c:1|g\n"))
+	require.NoError(t, err)
+	_, err = bidi.Write([]byte("2|c\nd:3|ms"))
+	require.NoError(t, err)
+	require.NoError(t, bidi.Close())
+	require.NoError(t, uni.Close())
+
+	assert.Equal(t, []string{"a", "b", "c", "d"}, waitForMetricNames(t, ch, 4))
+	assert.EqualValues(t, 4, mr.GetStats().MetricsReceived)
+	assert.Equal(t, "127.0.0.1", string(ch.metrics[0].SourceIP))
+}
+
+func TestQUICReceiverStreamError(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	ch := &countingHandler{}
+	mr := NewMetricReceiver("", ch)
+	conn := startQUICReceiver(t, ctx, mr, 10)
+
+	failing, err := conn.OpenUniStream()
+	require.NoError(t, err)
+	_, err = failing.Write([]byte("a:1|c\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, waitForMetricNames(t, ch, 1))
+	failing.CancelWrite(42) // Resets the stream
+
+	// A long line is skipped without affecting the next lines
+	stream, err := conn.OpenUniStream()
+	require.NoError(t, err)
+	_, err = stream.Write([]byte(strings.Repeat("x", 2*packetSizeUDP) + "\nb:1|c\n"))
+	require.NoError(t, err)
+	require.NoError(t, stream.Close())
+
+	assert.Equal(t, []string{"a", "b"}, waitForMetricNames(t, ch, 2))
+	assert.EqualValues(t, 1, mr.GetStats().BadLines)
+	select {
+	case <-conn.Context().Done():
+		t.Fatal("connection must not be closed by a stream error")
+	default:
+	}
+}
+
+func TestQUICReceiverMaxStreams(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	conn := startQUICReceiver(t, ctx, NewMetricReceiver("", &countingHandler{}), 1)
+
+	_, err := conn.OpenStream()
+	require.NoError(t, err)
+	_, err = conn.OpenStream()
+	assert.Error(t, err, "second concurrent stream must be refused")
+}
+
+func TestQUICReceiverShutdown(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	qr := NewQUICReceiver(NewMetricReceiver("", &countingHandler{}), testTLSConfig(t), 10)
+	l, err := quic.ListenAddr("127.0.0.1:0", qr.tlsConfig, qr.config())
+	require.NoError(t, err)
+	done := make(chan error, 1)
+	go func() {
+		done <- qr.Serve(ctx, l)
+	}()
+	conn, err := quic.DialAddr(ctx, l.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{QUICProtocol}}, nil) // #nosec
+	require.NoError(t, err)
+	_, err = conn.OpenUniStream()
+	require.NoError(t, err)
+
+	cancelFunc()
+	select {
+	case err = <-done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("receiver did not stop")
+	}
+}
@@ -23,13 +23,33 @@ type MetricReceiver struct {
 	// Counter fields below must be read/written only using atomic instructions.
 	// 64-bit fields must be the first fields in the struct to guarantee proper memory alignment.
 	// See https://golang.org/pkg/sync/atomic/#pkg-note-BUG
-	lastPacket      int64 // When last packet was received. Unix timestamp in nsec.
-	badLines        uint64
-	packetsReceived uint64
-	metricsReceived uint64
-	eventsReceived  uint64
-	handler         Handler // handler to invoke
-	namespace       string  // Namespace to prefix all metrics
+	lastPacket       int64 // When last packet was received. Unix timestamp in nsec.
+	badLines         uint64
+	packetsReceived  uint64
+	metricsReceived  uint64
+	eventsReceived   uint64
+	unknownFields    uint64
+	emptyNames       uint64
+	emptyValues      uint64
+	emptyTypes       uint64
+	nonNumericValues uint64
+	nonFiniteValues  uint64
+	unknownTypes     uint64
+	untypedLines     uint64
+	handler          Handler     // handler to invoke
+	namespace        string      // Namespace to prefix all metrics
+	renames          RenameRules // Rules renaming metrics before the namespace is prefixed
+	buckets          bool        // Whether tags of timers can be histogram buckets computed by clients
+	taps             taps        // Taps observing received metrics
+	tracer           Tracer      // Traces receiving packets and parsing and dispatching lines
+	// Deduplicates parsed names and tags, nil if disabled
+	interns *internTable
+	// Arenas metrics of each packet are allocated from, nil if disabled
+	arenas *metricArenas
+	// Type of metric lines without a type, which are rejected if 0
+	untypedType gostatsd.MetricType
+	// Whether parsed metrics are logged at debug level
+	debugMetrics bool
 }
 
 // NewMetricReceiver initialises a new MetricReceiver.
@@ -37,20 +57,90 @@ func NewMetricReceiver(ns string, handler Handler) *MetricReceiver {
 	return &MetricReceiver{
 		handler:   handler,
 		namespace: ns,
+		tracer:    nopTracer{},
 	}
 }
 
+// SetRenameRules sets the rules renaming received metrics. Must be called before Receive.
+func (mr *MetricReceiver) SetRenameRules(rules RenameRules) {
+	mr.renames = rules
+}
+
+// SetHistogramBuckets sets whether tags of timers are parsed as histogram buckets computed by clients, e.g.
+// #buckets:0-10:5,10-100:20,100+:3. Must be called before Receive.
+func (mr *MetricReceiver) SetHistogramBuckets(enabled bool) {
+	mr.buckets = enabled
+}
+
+// SetUntypedType sets the type of metric lines without a type, e.g. counters for legacy clients sending name:1.
+// Such lines are counted in ReceiverStats.UntypedLines. They are rejected if the type is 0, the default.
+// Must be called before Receive.
+func (mr *MetricReceiver) SetUntypedType(metricType gostatsd.MetricType) {
+	mr.untypedType = metricType
+}
+
+// SetDebugMetrics sets whether every parsed metric is logged at debug level, to debug clients sending unexpected
+// metrics. Metrics are only logged if the log level is debug. Must be called before Receive.
+func (mr *MetricReceiver) SetDebugMetrics(enabled bool) {
+	mr.debugMetrics = enabled
+}
+
+// SetInternSize enables deduplicating the strings of names and tags of received metrics, which repeat across
+// packets, holding up to size distinct strings. The least recently used strings are evicted once it is reached.
+// Disabled if size is 0. Must be called before Receive.
+func (mr *MetricReceiver) SetInternSize(size int) {
+	if size > 0 {
+		mr.interns = newInternTable(size)
+	} else {
+		mr.interns = nil
+	}
+}
+
+// SetMetricArenaSize enables allocating the metrics of each packet from an arena of up to size metrics, which is
+// reused once all its metrics are aggregated, rather than allocating each metric. Metrics of packets with more
+// lines are allocated separately. Disabled if size is 0. Must be called before Receive.
+func (mr *MetricReceiver) SetMetricArenaSize(size int) {
+	if size > 0 {
+		mr.arenas = newMetricArenas(size)
+	} else {
+		mr.arenas = nil
+	}
+}
+
+// SetTracer sets the tracer of received packets and lines. Must be called before Receive.
+func (mr *MetricReceiver) SetTracer(tracer Tracer) {
+	mr.tracer = tracer
+}
+
 // GetStats returns current MetricReceiver stats. Safe for concurrent use.
 func (mr *MetricReceiver) GetStats() ReceiverStats {
 	return ReceiverStats{
-		LastPacket:      time.Unix(0, atomic.LoadInt64(&mr.lastPacket)),
-		BadLines:        atomic.LoadUint64(&mr.badLines),
-		PacketsReceived: atomic.LoadUint64(&mr.packetsReceived),
-		MetricsReceived: atomic.LoadUint64(&mr.metricsReceived),
-		EventsReceived:  atomic.LoadUint64(&mr.eventsReceived),
+		LastPacket:        time.Unix(0, atomic.LoadInt64(&mr.lastPacket)),
+		BadLines:          atomic.LoadUint64(&mr.badLines),
+		PacketsReceived:   atomic.LoadUint64(&mr.packetsReceived),
+		MetricsReceived:   atomic.LoadUint64(&mr.metricsReceived),
+		EventsReceived:    atomic.LoadUint64(&mr.eventsReceived),
+		UnknownFields:     atomic.LoadUint64(&mr.unknownFields),
+		EmptyNames:        atomic.LoadUint64(&mr.emptyNames),
+		EmptyValues:       atomic.LoadUint64(&mr.emptyValues),
+		EmptyTypes:        atomic.LoadUint64(&mr.emptyTypes),
+		NonNumericValues:  atomic.LoadUint64(&mr.nonNumericValues),
+		NonFiniteRejected: atomic.LoadUint64(&mr.nonFiniteValues),
+		UnknownTypes:      atomic.LoadUint64(&mr.unknownTypes),
+		UntypedLines:      atomic.LoadUint64(&mr.untypedLines),
 	}
 }
 
+// AttachTap starts copying received metrics into the tap. Safe for concurrent use.
+func (mr *MetricReceiver) AttachTap(t *MetricTap) {
+	mr.taps.attach(t)
+}
+
+// DetachTap stops copying received metrics into the tap. Safe for concurrent use.
+func (mr *MetricReceiver) DetachTap(t *MetricTap) {
+	mr.taps.detach(t)
+}
+
 // Receive accepts incoming datagrams on c, parses them and calls Handler.DispatchMetric() for each metric
 // and Handler.DispatchEvent() for each event.
 func (mr *MetricReceiver) Receive(ctx context.Context, c net.PacketConn) error {
@@ -70,10 +160,8 @@ func (mr *MetricReceiver) Receive(ctx context.Context, c net.PacketConn) error {
 			log.Warnf("Error reading from socket: %v", err)
 			continue
 		}
-		// TODO consider updating counter for every N-th iteration to reduce contention
-		atomic.AddUint64(&mr.packetsReceived, 1)
-		atomic.StoreInt64(&mr.lastPacket, time.Now().UnixNano())
-		if err := mr.handlePacket(ctx, addr, buf[:nbytes]); err != nil {
+		err = mr.receivePacket(ctx, addr, buf[:nbytes])
+		if err != nil {
 			if err == context.Canceled || err == context.DeadlineExceeded {
 				return err
 			}
@@ -82,12 +170,59 @@ func (mr *MetricReceiver) Receive(ctx context.Context, c net.PacketConn) error {
 	}
 }
 
+// receivePacket counts and traces the datagram and handles its contents.
+func (mr *MetricReceiver) receivePacket(ctx context.Context, addr net.Addr, msg []byte) error {
+	// TODO consider updating counter for every N-th iteration to reduce contention
+	atomic.AddUint64(&mr.packetsReceived, 1)
+	atomic.StoreInt64(&mr.lastPacket, time.Now().UnixNano())
+	ctx, end := mr.tracer.Start(ctx, "packet")
+	err := mr.handlePacket(ctx, addr, msg)
+	end(err)
+	return err
+}
+
+// HandleLines handles newline-delimited metrics and events received from addr by other transports than the
+// PacketConn, e.g. HTTP. It returns the numbers of dispatched metrics and events. Safe for concurrent use.
+func (mr *MetricReceiver) HandleLines(ctx context.Context, addr net.Addr, lines []byte) (uint32, uint32, error) {
+	atomic.StoreInt64(&mr.lastPacket, time.Now().UnixNano())
+	ctx, end := mr.tracer.Start(ctx, "lines")
+	numMetrics, numEvents, err := mr.handleLines(ctx, addr, lines)
+	end(err)
+	return numMetrics, numEvents, err
+}
+
+// HandleMetric handles a metric already parsed by other transports than the PacketConn, e.g. OTLP.
+// The metric is renamed and prefixed with the namespace like parsed lines. Safe for concurrent use.
+func (mr *MetricReceiver) HandleMetric(ctx context.Context, m *gostatsd.Metric) error {
+	atomic.StoreInt64(&mr.lastPacket, time.Now().UnixNano())
+	m.Name = mr.renames.Rename(m.Name)
+	if mr.namespace != "" {
+		m.Name = mr.namespace + "." + m.Name
+	}
+	atomic.AddUint64(&mr.metricsReceived, 1)
+	for _, tap := range mr.taps.get() {
+		tap.Observe(m)
+	}
+	return mr.handler.DispatchMetric(ctx, m)
+}
+
 // handlePacket handles the contents of a datagram and calls Handler.DispatchMetric()
 // for each line that successfully parses into a types.Metric and Handler.DispatchEvent() for each event.
 func (mr *MetricReceiver) handlePacket(ctx context.Context, addr net.Addr, msg []byte) error {
-	var numMetrics, numEvents uint16
+	_, _, err := mr.handleLines(ctx, addr, msg)
+	return err
+}
+
+// handleLines handles the lines and returns the numbers of dispatched metrics and events.
+func (mr *MetricReceiver) handleLines(ctx context.Context, addr net.Addr, msg []byte) (uint32, uint32, error) {
+	var numMetrics, numEvents uint32
 	var exitError error
 	ip := getIP(addr)
+	var arena *gostatsd.MetricArena
+	if mr.arenas != nil {
+		arena = mr.arenas.get()
+		defer arena.Done()
+	}
 	for {
 		idx := bytes.IndexByte(msg, '\n')
 		var line []byte
@@ -102,29 +237,43 @@ func (mr *MetricReceiver) handlePacket(ctx context.Context, addr net.Addr, msg [
 			line = msg[:idx]
 			msg = msg[idx+1:]
 		}
-		metric, event, err := mr.parseLine(line)
+		// tolerate \r\n line endings and empty lines, they are not malformed metrics
+		if n := len(line); n > 0 && line[n-1] == '\r' {
+			line = line[:n-1]
+		}
+		if len(line) == 0 {
+			continue
+		}
+		_, endParse := mr.tracer.Start(ctx, "parse")
+		metric, event, err := mr.parseLineInArena(line, arena)
+		endParse(err)
 		if err != nil {
 			// logging as debug to avoid spamming logs when a bad actor sends
 			// badly formatted messages
 			log.Debugf("Error parsing line %q from %s: %v", line, ip, err)
-			atomic.AddUint64(&mr.badLines, 1)
+			mr.countBadLine(err)
 			continue
 		}
+		dctx, endDispatch := mr.tracer.Start(ctx, "dispatch")
 		if metric != nil {
 			numMetrics++
 			metric.SourceIP = ip
-			err = mr.handler.DispatchMetric(ctx, metric)
+			for _, tap := range mr.taps.get() {
+				tap.Observe(metric)
+			}
+			err = mr.handler.DispatchMetric(dctx, metric)
 		} else if event != nil {
 			numEvents++
 			event.SourceIP = ip
 			if event.DateHappened == 0 {
 				event.DateHappened = time.Now().Unix()
 			}
-			err = mr.handler.DispatchEvent(ctx, event)
+			err = mr.handler.DispatchEvent(dctx, event)
 		} else {
 			// Should never happen.
 			log.Panic("Both event and metric are nil")
 		}
+		endDispatch(err)
 		if err != nil {
 			if err == context.Canceled || err == context.DeadlineExceeded {
 				exitError = err
@@ -135,18 +284,92 @@ func (mr *MetricReceiver) handlePacket(ctx context.Context, addr net.Addr, msg [
 	}
 	atomic.AddUint64(&mr.metricsReceived, uint64(numMetrics))
 	atomic.AddUint64(&mr.eventsReceived, uint64(numEvents))
-	return exitError
+	return numMetrics, numEvents, exitError
 }
 
 // parseLine with lexer impl.
 func (mr *MetricReceiver) parseLine(line []byte) (*gostatsd.Metric, *gostatsd.Event, error) {
-	l := lexer{}
-	return l.run(line, mr.namespace)
+	return mr.parseLineInArena(line, nil)
+}
+
+// parseLineInArena parses the line, the metric is allocated from the arena unless it is nil or full.
+func (mr *MetricReceiver) parseLineInArena(line []byte, arena *gostatsd.MetricArena) (*gostatsd.Metric, *gostatsd.Event, error) {
+	l := lexer{renames: mr.renames, buckets: mr.buckets, interns: mr.interns, arena: arena, untypedType: mr.untypedType}
+	metric, event, err := l.run(line, mr.namespace)
+	if err == nil && l.unknownFields > 0 {
+		// logging as debug to avoid spamming logs when clients send fields we do not support
+		log.Debugf("Skipped %d fields with unknown markers in line %q", l.unknownFields, line)
+		atomic.AddUint64(&mr.unknownFields, uint64(l.unknownFields))
+	}
+	if err == nil && l.untyped {
+		atomic.AddUint64(&mr.untypedLines, 1)
+	}
+	if metric != nil {
+		mr.logMetric(metric, l.sampling)
+	}
+	return metric, event, err
+}
+
+// logMetric logs the parsed metric with the sample rate of its line if debugging of metrics is enabled.
+// Nothing is allocated unless the log level is debug.
+func (mr *MetricReceiver) logMetric(m *gostatsd.Metric, sampling float64) {
+	if !mr.debugMetrics || log.GetLevel() < log.DebugLevel {
+		return
+	}
+	fields := log.Fields{
+		"name":        m.Name,
+		"type":        m.Type.String(),
+		"sample_rate": sampling,
+		"tags":        m.Tags,
+	}
+	if m.Type == gostatsd.SET {
+		fields["value"] = m.StringValue
+	} else {
+		fields["value"] = m.Value
+	}
+	log.WithFields(fields).Debug("Parsed metric")
+}
+
+// ParseUntypedType returns the type of metric lines without a type with the name, 0 to reject them if empty.
+func ParseUntypedType(name string) (gostatsd.MetricType, error) {
+	if name == "" {
+		return 0, nil
+	}
+	for _, metricType := range []gostatsd.MetricType{gostatsd.COUNTER, gostatsd.GAUGE, gostatsd.TIMER, gostatsd.SET} {
+		if metricType.String() == name {
+			return metricType, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown type of untyped metrics %q, must be one of counter, gauge, timer, set or empty", name)
+}
+
+// countBadLine counts a line rejected by the parser with the error.
+func (mr *MetricReceiver) countBadLine(err error) {
+	atomic.AddUint64(&mr.badLines, 1)
+	switch err {
+	case errEmptyKey:
+		atomic.AddUint64(&mr.emptyNames, 1)
+	case errEmptyValue:
+		atomic.AddUint64(&mr.emptyValues, 1)
+	case errEmptyType:
+		atomic.AddUint64(&mr.emptyTypes, 1)
+	case errNonNumericValue:
+		atomic.AddUint64(&mr.nonNumericValues, 1)
+	case errNonFiniteValue:
+		atomic.AddUint64(&mr.nonFiniteValues, 1)
+	case errUnknownType:
+		atomic.AddUint64(&mr.unknownTypes, 1)
+	}
 }
 
 func getIP(addr net.Addr) gostatsd.IP {
-	if a, ok := addr.(*net.UDPAddr); ok {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return gostatsd.IP(a.IP.String())
+	case *net.TCPAddr:
 		return gostatsd.IP(a.IP.String())
+	case *net.UnixAddr:
+		return gostatsd.UnknownIP // Unix sockets have no IP, usually not even a path for unnamed clients
 	}
 	log.Errorf("Cannot get source address %q of type %T", addr, addr)
 	return gostatsd.UnknownIP
@@ -2,12 +2,17 @@ package statsd
 
 import (
 	"context"
+	"net"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/fakesocket"
 
+	log "github.com/Sirupsen/logrus"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -25,6 +30,7 @@ func TestReceiveEmptyPacket(t *testing.T) {
 		{},
 		{'\n'},
 		{'\n', '\n'},
+		{'\r', '\n'},
 	}
 	for pos, inp := range input {
 		inp := inp
@@ -37,6 +43,7 @@ func TestReceiveEmptyPacket(t *testing.T) {
 			require.NoError(t, err)
 			assert.Zero(t, len(ch.events), ch.events)
 			assert.Zero(t, len(ch.metrics), ch.metrics)
+			assert.Zero(t, mr.GetStats().BadLines)
 		})
 	}
 }
@@ -97,6 +104,165 @@ func TestReceivePacket(t *testing.T) {
 	}
 }
 
+func TestReceivePacketCountsUnknownFields(t *testing.T) {
+	t.Parallel()
+	ch := &countingHandler{}
+	mr := NewMetricReceiver("", ch)
+
+	err := mr.handlePacket(context.Background(), fakesocket.FakeAddr, []byte("f:2|c|T123|#a\nx:3|c|e:abc|q\ny:1|c"))
+	require.NoError(t, err)
+	assert.Len(t, ch.metrics, 3)
+	stats := mr.GetStats()
+	assert.Equal(t, uint64(3), stats.UnknownFields)
+	assert.Equal(t, uint64(0), stats.BadLines)
+}
+
+func TestReceivePacketWithBadLines(t *testing.T) {
+	t.Parallel()
+	input := map[string]struct {
+		metrics  []string
+		badLines uint64
+	}{
+		"f:2|c\nbad\nx:3|c\n":         {[]string{"f", "x"}, 1},
+		"f:2|c\nbad\nx:3|c":           {[]string{"f", "x"}, 1},
+		"bad\nf:2|c\nx:\ny:1|g\nz:1|": {[]string{"f", "y"}, 3},
+		"f:2|c\n\nx:3|c\n\n":          {[]string{"f", "x"}, 0},
+		"f:2|c\r\nbad\r\nx:3|c\r\n":   {[]string{"f", "x"}, 1},
+	}
+	for packet, expected := range input {
+		packet := packet
+		expected := expected
+		t.Run(packet, func(t *testing.T) {
+			t.Parallel()
+			ch := &countingHandler{}
+			mr := NewMetricReceiver("", ch)
+
+			err := mr.handlePacket(context.Background(), fakesocket.FakeAddr, []byte(packet))
+			require.NoError(t, err)
+			var names []string
+			for _, m := range ch.metrics {
+				names = append(names, m.Name)
+			}
+			assert.Equal(t, expected.metrics, names)
+			stats := mr.GetStats()
+			assert.Equal(t, expected.badLines, stats.BadLines)
+			assert.Equal(t, uint64(len(expected.metrics)), stats.MetricsReceived)
+		})
+	}
+}
+
+func TestReceivePacketCountsRejectionReasons(t *testing.T) {
+	t.Parallel()
+	ch := &countingHandler{}
+	mr := NewMetricReceiver("", ch)
+
+	err := mr.handlePacket(context.Background(), fakesocket.FakeAddr, []byte(":1|c\na:|c\nb:|s\nc:1|\nd:x|g\ne:NaN|ms\nf:2|c\nbad"))
+	require.NoError(t, err)
+	assert.Len(t, ch.metrics, 1)
+	stats := mr.GetStats()
+	assert.Equal(t, uint64(7), stats.BadLines)
+	assert.Equal(t, uint64(1), stats.EmptyNames)
+	assert.Equal(t, uint64(2), stats.EmptyValues)
+	assert.Equal(t, uint64(1), stats.EmptyTypes)
+	assert.Equal(t, uint64(1), stats.NonNumericValues)
+	assert.Equal(t, uint64(1), stats.NonFiniteRejected)
+	assert.Zero(t, stats.UnknownTypes)
+
+	require.NoError(t, mr.handlePacket(context.Background(), fakesocket.FakeAddr, []byte("a:1|q\nb:1|c\nc:1|#")))
+	stats = mr.GetStats()
+	assert.Equal(t, uint64(9), stats.BadLines)
+	assert.Equal(t, uint64(1), stats.UnknownTypes)
+}
+
+func TestReceivePacketRejectsNonFiniteValues(t *testing.T) {
+	t.Parallel()
+	ch := &countingHandler{}
+	mr := NewMetricReceiver("", ch)
+
+	var lines []string
+	for _, statsdType := range []string{"c", "g", "ms", "h", "d"} {
+		for _, value := range []string{"Inf", "+Inf", "-Inf", "NaN"} {
+			lines = append(lines, "a:"+value+"|"+statsdType)
+		}
+	}
+	lines = append(lines, "b:1|c|@0", "c:Inf|s")
+	require.NoError(t, mr.handlePacket(context.Background(), fakesocket.FakeAddr, []byte(strings.Join(lines, "\n"))))
+	require.Len(t, ch.metrics, 1, "set values are not numeric")
+	assert.Equal(t, "Inf", ch.metrics[0].StringValue)
+	stats := mr.GetStats()
+	assert.Equal(t, uint64(21), stats.NonFiniteRejected)
+	assert.Equal(t, uint64(21), stats.BadLines)
+	assert.Zero(t, stats.NonNumericValues)
+}
+
+func TestReceivePacketContainerID(t *testing.T) {
+	t.Parallel()
+	ch := &countingHandler{}
+	mr := NewMetricReceiver("", ch)
+
+	require.NoError(t, mr.handlePacket(context.Background(), fakesocket.FakeAddr, []byte("a:1|c|#x:y|c:2a5e0a4c1d3b\nb:2|g\nc:3|ms|c:2a5e0a4c1d3b|@0.5")))
+	require.Len(t, ch.metrics, 3)
+	assert.Equal(t, gostatsd.Tags{"x:y", "container_id:2a5e0a4c1d3b"}, ch.metrics[0].Tags)
+	assert.Empty(t, ch.metrics[1].Tags)
+	assert.Equal(t, gostatsd.Tags{"container_id:2a5e0a4c1d3b"}, ch.metrics[2].Tags)
+	stats := mr.GetStats()
+	assert.Zero(t, stats.BadLines)
+	assert.Zero(t, stats.UnknownFields)
+}
+
+func TestReceivePacketUntypedLines(t *testing.T) {
+	t.Parallel()
+	ch := &countingHandler{}
+	mr := NewMetricReceiver("", ch)
+
+	require.NoError(t, mr.handlePacket(context.Background(), fakesocket.FakeAddr, []byte("a:1|c\nb:2")))
+	assert.Len(t, ch.metrics, 1)
+	stats := mr.GetStats()
+	assert.Equal(t, uint64(1), stats.BadLines)
+	assert.Zero(t, stats.UntypedLines)
+
+	mr.SetUntypedType(gostatsd.COUNTER)
+	require.NoError(t, mr.handlePacket(context.Background(), fakesocket.FakeAddr, []byte("a:1|c\nb:2\nc:x")))
+	require.Len(t, ch.metrics, 3)
+	assert.Equal(t, "b", ch.metrics[2].Name)
+	assert.Equal(t, gostatsd.COUNTER, ch.metrics[2].Type)
+	assert.Equal(t, 2.0, ch.metrics[2].Value)
+	stats = mr.GetStats()
+	assert.Equal(t, uint64(2), stats.BadLines)
+	assert.Equal(t, uint64(1), stats.UntypedLines)
+}
+
+func TestGetIP(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, gostatsd.IP("127.0.0.1"), getIP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8125}))
+	assert.Equal(t, gostatsd.IP("::1"), getIP(&net.TCPAddr{IP: net.IPv6loopback, Port: 8125}))
+	assert.Equal(t, gostatsd.UnknownIP, getIP(&net.UnixAddr{Name: "/tmp/statsd.sock", Net: "unixgram"}))
+}
+
+func TestLogMetricDoesNotAllocateUnlessDebug(t *testing.T) {
+	require.True(t, log.GetLevel() < log.DebugLevel)
+	m := &gostatsd.Metric{Name: "a", Value: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"x:y"}}
+	for _, enabled := range []bool{false, true} {
+		mr := NewMetricReceiver("", nopHandler{})
+		mr.SetDebugMetrics(enabled)
+		allocs := testing.AllocsPerRun(100, func() {
+			mr.logMetric(m, 0.5)
+		})
+		assert.Zero(t, allocs, "debug metrics enabled: %t", enabled)
+	}
+}
+
+func TestParseUntypedType(t *testing.T) {
+	t.Parallel()
+	for name, expected := range map[string]gostatsd.MetricType{"": 0, "counter": gostatsd.COUNTER, "gauge": gostatsd.GAUGE, "timer": gostatsd.TIMER, "set": gostatsd.SET} {
+		metricType, err := ParseUntypedType(name)
+		require.NoError(t, err)
+		assert.Equal(t, expected, metricType)
+	}
+	_, err := ParseUntypedType("histogram")
+	assert.Error(t, err)
+}
+
 func BenchmarkReceive(b *testing.B) {
 	mr := &MetricReceiver{
 		handler: nopHandler{},
@@ -112,6 +278,32 @@ func BenchmarkReceive(b *testing.B) {
 	receiveBlackhole = r
 }
 
+// BenchmarkReceiveAndAggregate measures allocations of metrics parsed, dispatched and aggregated, which are
+// recycled by the metric pool.
+func BenchmarkReceiveAndAggregate(b *testing.B) {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	d := NewMetricDispatcher(1, 100, &agrFactory{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_ = d.Run(ctx)
+	}()
+	mr := NewMetricReceiver("", NewDispatchingHandler(d, nil, nil, 1))
+	packet := []byte("foo.bar.baz:2|c|#foo:bar,baz\nabc.def.g:3|g\ndef.g:10|ms\nuniq.usr:joe|s")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := mr.handlePacket(ctx, fakesocket.FakeAddr, packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	cancelFunc()
+	wg.Wait()
+}
+
 type nopHandler struct{}
 
 func (h nopHandler) DispatchMetric(ctx context.Context, m *gostatsd.Metric) error {
@@ -124,3 +316,32 @@ func (h nopHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) error
 
 func (h nopHandler) WaitForEvents() {
 }
+
+func TestHandleLines(t *testing.T) {
+	t.Parallel()
+	ch := &countingHandler{}
+	mr := NewMetricReceiver("", ch)
+
+	addr := &net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 1234}
+	metrics, events, err := mr.HandleLines(context.Background(), addr, []byte("f:2|c\nbad\n_e{1,1}:a|b\nx:3|g"))
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, metrics)
+	assert.EqualValues(t, 1, events)
+	require.Len(t, ch.metrics, 2)
+	assert.Equal(t, gostatsd.IP("10.1.2.3"), ch.metrics[0].SourceIP)
+	stats := mr.GetStats()
+	assert.Equal(t, uint64(1), stats.BadLines)
+	assert.False(t, stats.LastPacket.IsZero())
+}
+
+func TestHandleMetric(t *testing.T) {
+	t.Parallel()
+	ch := &countingHandler{}
+	mr := NewMetricReceiver("ns", ch)
+	mr.SetRenameRules(RenameRules{{From: "old.", To: "new.", Prefix: true}})
+
+	require.NoError(t, mr.HandleMetric(context.Background(), &gostatsd.Metric{Name: "old.x", Value: 1, Type: gostatsd.COUNTER}))
+	require.Len(t, ch.metrics, 1)
+	assert.Equal(t, "ns.new.x", ch.metrics[0].Name)
+	assert.Equal(t, uint64(1), mr.GetStats().MetricsReceived)
+}
@@ -0,0 +1,58 @@
+package statsd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// RenameRule renames metrics with the name From, or with names starting with From if Prefix is set.
+type RenameRule struct {
+	From   string
+	To     string
+	Prefix bool // Whether From is a prefix replaced by To rather than the whole name
+}
+
+// RenameRules are applied to names of received metrics before they are aggregated.
+// Rules are evaluated in order, only the first matching rule is applied.
+type RenameRules []RenameRule
+
+// Rename returns the name renamed by the first matching rule, or the name if no rule matches.
+func (r RenameRules) Rename(name string) string {
+	for _, rule := range r {
+		if rule.Prefix {
+			if strings.HasPrefix(name, rule.From) {
+				return rule.To + name[len(rule.From):]
+			}
+		} else if name == rule.From {
+			return rule.To
+		}
+	}
+	return name
+}
+
+// NewRenameRulesFromViper returns the rename rules configured in the rename section, in order:
+//
+//	[[rename]]
+//	from = "old.name."
+//	to = "new.name."
+//	prefix = true # Optional, the whole name must match if false
+func NewRenameRulesFromViper(v *viper.Viper) (RenameRules, error) {
+	entries := cast.ToSlice(v.Get("rename"))
+	rules := make(RenameRules, 0, len(entries))
+	for i, entry := range entries {
+		e := cast.ToStringMap(entry)
+		rule := RenameRule{
+			From:   cast.ToString(e["from"]),
+			To:     cast.ToString(e["to"]),
+			Prefix: cast.ToBool(e["prefix"]),
+		}
+		if rule.From == "" || rule.To == "" {
+			return nil, fmt.Errorf("rename rule %d: from and to are required", i)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
@@ -0,0 +1,116 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/fakesocket"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenameRules(t *testing.T) {
+	t.Parallel()
+	rules := RenameRules{
+		{From: "old.exact", To: "new.exact"},
+		{From: "old.", To: "new.", Prefix: true},
+		{From: "old.name.", To: "shadowed.", Prefix: true},
+	}
+	tests := map[string]string{
+		"old.exact":       "new.exact",
+		"old.exact.x":     "new.exact.x", // Not an exact match, renamed by the prefix rule
+		"old.name.x":      "new.name.x",  // First matching rule wins
+		"old.":            "new.",
+		"other.old.name":  "other.old.name",
+		"old":             "old",
+		"unrelated.name":  "unrelated.name",
+		"new.name.x":      "new.name.x",
+		"old.exactsuffix": "new.exactsuffix",
+	}
+	for name, expected := range tests {
+		assert.Equal(t, expected, rules.Rename(name), name)
+	}
+	assert.Equal(t, "old.name", RenameRules(nil).Rename("old.name"))
+}
+
+func TestReceiveRenamed(t *testing.T) {
+	t.Parallel()
+	ch := &countingHandler{}
+	mr := NewMetricReceiver("ns", ch)
+	mr.SetRenameRules(RenameRules{{From: "old.", To: "new.", Prefix: true}})
+	require.NoError(t, mr.handlePacket(context.Background(), fakesocket.FakeAddr, []byte("old.x:1|c\nother:2|g\n_e{4,1}:old.|t")))
+	require.Len(t, ch.metrics, 2)
+	assert.Equal(t, "ns.new.x", ch.metrics[0].Name)
+	assert.Equal(t, "ns.other", ch.metrics[1].Name)
+	require.Len(t, ch.events, 1)
+	assert.Equal(t, "old.", ch.events[0].Title) // Events are not renamed
+}
+
+func TestRenamedMetricsAggregated(t *testing.T) {
+	t.Parallel()
+	d := NewMetricDispatcher(2, 10, &agrFactory{})
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	receiver := NewMetricReceiver("", NewDispatchingHandler(d, nil, nil, 1))
+	receiver.SetRenameRules(RenameRules{{From: "old.name.x", To: "new.name.x"}})
+	require.NoError(t, receiver.handlePacket(ctx, fakesocket.FakeAddr, []byte("old.name.x:1|c\nnew.name.x:2|c\nold.name.y:4|c")))
+	snapshot := waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.NumStats == 3
+	})
+	values := make(map[string]int64)
+	snapshot.Counters.Each(func(name, tagsKey string, counter gostatsd.Counter) {
+		values[name] += counter.Value
+	})
+	assert.Equal(t, map[string]int64{"new.name.x": 3, "old.name.y": 4}, values)
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestNewRenameRulesFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(bytes.NewBufferString(`
+[[rename]]
+from = "old.name.x"
+to = "new.name.x"
+
+[[rename]]
+from = "old."
+to = "new."
+prefix = true
+`)))
+	rules, err := NewRenameRulesFromViper(v)
+	require.NoError(t, err)
+	assert.Equal(t, RenameRules{
+		{From: "old.name.x", To: "new.name.x"},
+		{From: "old.", To: "new.", Prefix: true},
+	}, rules)
+
+	rules, err = NewRenameRulesFromViper(viper.New())
+	require.NoError(t, err)
+	assert.Empty(t, rules)
+
+	for _, config := range []string{
+		"[[rename]]\nto = \"new\"",
+		"[[rename]]\nfrom = \"old\"",
+	} {
+		v := viper.New()
+		v.SetConfigType("toml")
+		require.NoError(t, v.ReadConfig(bytes.NewBufferString(config)))
+		_, err := NewRenameRulesFromViper(v)
+		assert.Error(t, err, config)
+	}
+}
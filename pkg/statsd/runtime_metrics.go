@@ -0,0 +1,39 @@
+package statsd
+
+import (
+	"runtime"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// runtimeMetrics returns gauges with statistics of the Go runtime of the server, named with the prefix.
+func runtimeMetrics(prefix string) []gostatsd.Metric {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	var lastPause uint64
+	if memStats.NumGC > 0 {
+		lastPause = memStats.PauseNs[(memStats.NumGC+255)%256]
+	}
+	return []gostatsd.Metric{
+		{
+			Name:  prefix + "heap_alloc_bytes",
+			Value: float64(memStats.HeapAlloc),
+			Type:  gostatsd.GAUGE,
+		},
+		{
+			Name:  prefix + "gc_pause_ms",
+			Value: float64(lastPause) / 1e6,
+			Type:  gostatsd.GAUGE,
+		},
+		{
+			Name:  prefix + "num_gc",
+			Value: float64(memStats.NumGC),
+			Type:  gostatsd.GAUGE,
+		},
+		{
+			Name:  prefix + "goroutines",
+			Value: float64(runtime.NumGoroutine()),
+			Type:  gostatsd.GAUGE,
+		},
+	}
+}
@@ -0,0 +1,158 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// QueuePolicy is the handling of flushes sent to a backend whose send queue is full.
+type QueuePolicy int
+
+const (
+	// QueueDropOldest drops the oldest queued flush to make room for the new one.
+	QueueDropOldest QueuePolicy = iota
+	// QueueDropNewest drops the new flush.
+	QueueDropNewest
+	// QueueBlock blocks the flush until there is room in the queue.
+	QueueBlock
+)
+
+var queuePolicyNames = map[QueuePolicy]string{
+	QueueDropOldest: "drop-oldest",
+	QueueDropNewest: "drop-newest",
+	QueueBlock:      "block",
+}
+
+func (p QueuePolicy) String() string {
+	if name, ok := queuePolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("QueuePolicy(%d)", int(p))
+}
+
+// ParseQueuePolicy returns the queue policy with the name.
+func ParseQueuePolicy(name string) (QueuePolicy, error) {
+	for policy, policyName := range queuePolicyNames {
+		if policyName == name {
+			return policy, nil
+		}
+	}
+	return QueueDropOldest, fmt.Errorf("unknown queue policy %q, must be one of drop-oldest, drop-newest, block", name)
+}
+
+// errQueueFull is logged when a flush is dropped because the send queue of a backend is full.
+var errQueueFull = errors.New("send queue is full, flush dropped")
+
+// queuedSend is a flush waiting in a send queue.
+type queuedSend struct {
+	m        *gostatsd.MetricMap
+	callback gostatsd.SendCallback
+}
+
+// sendQueue sends flushes to a backend one at a time so that a slow backend does not delay the flush loop.
+// Safe for concurrent use.
+type sendQueue struct {
+	dropped uint64 // Number of dropped flushes. Must be read/written only using atomic instructions.
+
+	backend gostatsd.Backend
+	policy  QueuePolicy
+	sends   chan queuedSend
+}
+
+func newSendQueue(backend gostatsd.Backend, capacity int, policy QueuePolicy) *sendQueue {
+	return &sendQueue{
+		backend: backend,
+		policy:  policy,
+		sends:   make(chan queuedSend, capacity),
+	}
+}
+
+// push queues the metrics to be sent to the backend, the callback is called once they are sent.
+// errQueueFull is returned if a flush was dropped according to the policy, the callback of a dropped flush
+// is not called. The metrics must not be modified once they are queued.
+func (q *sendQueue) push(ctx context.Context, m *gostatsd.MetricMap, callback gostatsd.SendCallback) error {
+	s := queuedSend{m: m, callback: callback}
+	switch q.policy {
+	case QueueBlock:
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case q.sends <- s:
+			return nil
+		}
+	case QueueDropNewest:
+		select {
+		case q.sends <- s:
+			return nil
+		default:
+			atomic.AddUint64(&q.dropped, 1)
+			return errQueueFull
+		}
+	default:
+		var err error
+		for {
+			select {
+			case q.sends <- s:
+				return err
+			default:
+			}
+			select {
+			case <-q.sends:
+				atomic.AddUint64(&q.dropped, 1)
+				err = errQueueFull
+			default: // Emptied by run in the meantime
+			}
+		}
+	}
+}
+
+// run sends queued flushes to the backend until the context is done. Each send finishes before the next one
+// starts. Flushes still queued when the context is done are discarded.
+func (q *sendQueue) run(ctx context.Context) {
+	done := make(chan struct{}, 1)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case s := <-q.sends:
+			q.backend.SendMetricsAsync(ctx, s.m, func(errs []error) {
+				s.callback(errs)
+				done <- struct{}{}
+			})
+			select {
+			case <-ctx.Done():
+				return
+			case <-done:
+			}
+		}
+	}
+}
+
+// stats returns statistics of the queue.
+func (q *sendQueue) stats() QueueStats {
+	return QueueStats{
+		Backend:  q.backend.Name(),
+		Depth:    len(q.sends),
+		Capacity: cap(q.sends),
+		Dropped:  atomic.LoadUint64(&q.dropped),
+	}
+}
+
+// queueStats sorts by backend name.
+type queueStats []QueueStats
+
+func (s queueStats) Len() int {
+	return len(s)
+}
+
+func (s queueStats) Less(i, j int) bool {
+	return s[i].Backend < s[j].Backend
+}
+
+func (s queueStats) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
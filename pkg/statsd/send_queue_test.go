@@ -0,0 +1,205 @@
+package statsd
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stalledBackend does not finish sending until it is released.
+type stalledBackend struct {
+	started chan uint32   // Receives NumStats of each send when it starts
+	release chan struct{} // Each send finishes once a value is received
+
+	mu   sync.Mutex
+	sent []uint32
+}
+
+func newStalledBackend() *stalledBackend {
+	return &stalledBackend{
+		started: make(chan uint32, 10),
+		release: make(chan struct{}),
+	}
+}
+
+func (sb *stalledBackend) Name() string {
+	return "stalledBackend"
+}
+
+func (sb *stalledBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	sb.started <- m.NumStats
+	go func() {
+		<-sb.release
+		sb.mu.Lock()
+		sb.sent = append(sb.sent, m.NumStats)
+		sb.mu.Unlock()
+		callback(nil)
+	}()
+}
+
+func (sb *stalledBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+// waitStarted waits for a send to start and returns its NumStats.
+func (sb *stalledBackend) waitStarted(t *testing.T) uint32 {
+	select {
+	case n := <-sb.started:
+		return n
+	case <-time.After(5 * time.Second):
+		t.Fatal("send did not start")
+		return 0
+	}
+}
+
+// releaseAll releases the number of sends and returns NumStats of all finished sends.
+func (sb *stalledBackend) releaseAll(t *testing.T, n int) []uint32 {
+	for i := 0; i < n; i++ {
+		select {
+		case sb.release <- struct{}{}:
+		case <-time.After(5 * time.Second):
+			t.Fatal("send was not released")
+		}
+	}
+	for i := 0; i < 100; i++ {
+		sb.mu.Lock()
+		sent := sb.sent
+		sb.mu.Unlock()
+		if len(sent) >= n {
+			return sent
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%d sends did not finish", n)
+	return nil
+}
+
+func metricMapWithStats(numStats uint32) *gostatsd.MetricMap {
+	return &gostatsd.MetricMap{MetricStats: gostatsd.MetricStats{NumStats: numStats}}
+}
+
+// startStalledQueue runs a queue of the stalled backend with the first send in flight.
+func startStalledQueue(t *testing.T, ctx context.Context, capacity int, policy QueuePolicy) (*sendQueue, *stalledBackend) {
+	sb := newStalledBackend()
+	q := newSendQueue(sb, capacity, policy)
+	go q.run(ctx)
+	require.NoError(t, q.push(ctx, metricMapWithStats(1), func([]error) {}))
+	require.EqualValues(t, 1, sb.waitStarted(t))
+	return q, sb
+}
+
+func TestSendQueueDropOldest(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	q, sb := startStalledQueue(t, ctx, 2, QueueDropOldest)
+
+	require.NoError(t, q.push(ctx, metricMapWithStats(2), func([]error) {}))
+	require.NoError(t, q.push(ctx, metricMapWithStats(3), func([]error) {}))
+	assert.Equal(t, errQueueFull, q.push(ctx, metricMapWithStats(4), func([]error) {}))
+	assert.Equal(t, QueueStats{Backend: "stalledBackend", Depth: 2, Capacity: 2, Dropped: 1}, q.stats())
+
+	assert.Equal(t, []uint32{1, 3, 4}, sb.releaseAll(t, 3))
+	assert.Zero(t, q.stats().Depth)
+}
+
+func TestSendQueueDropNewest(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	q, sb := startStalledQueue(t, ctx, 2, QueueDropNewest)
+
+	require.NoError(t, q.push(ctx, metricMapWithStats(2), func([]error) {}))
+	require.NoError(t, q.push(ctx, metricMapWithStats(3), func([]error) {}))
+	assert.Equal(t, errQueueFull, q.push(ctx, metricMapWithStats(4), func([]error) {}))
+	assert.Equal(t, errQueueFull, q.push(ctx, metricMapWithStats(5), func([]error) {}))
+	assert.Equal(t, QueueStats{Backend: "stalledBackend", Depth: 2, Capacity: 2, Dropped: 2}, q.stats())
+
+	assert.Equal(t, []uint32{1, 2, 3}, sb.releaseAll(t, 3))
+}
+
+func TestSendQueueBlock(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	q, sb := startStalledQueue(t, ctx, 1, QueueBlock)
+
+	require.NoError(t, q.push(ctx, metricMapWithStats(2), func([]error) {}))
+	pushed := make(chan error, 1)
+	go func() {
+		pushed <- q.push(ctx, metricMapWithStats(3), func([]error) {})
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push to a full queue must block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Equal(t, []uint32{1}, sb.releaseAll(t, 1))
+	select {
+	case err := <-pushed:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("push was not unblocked")
+	}
+	assert.Equal(t, []uint32{1, 2, 3}, sb.releaseAll(t, 2))
+	assert.Zero(t, q.stats().Dropped)
+	assert.EqualValues(t, 2, sb.waitStarted(t))
+	assert.EqualValues(t, 3, sb.waitStarted(t))
+
+	// A blocked push returns once the context is done
+	require.NoError(t, q.push(ctx, metricMapWithStats(4), func([]error) {}))
+	require.EqualValues(t, 4, sb.waitStarted(t))
+	require.NoError(t, q.push(ctx, metricMapWithStats(5), func([]error) {}))
+	pushCtx, pushCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer pushCancel()
+	assert.Equal(t, context.DeadlineExceeded, q.push(pushCtx, metricMapWithStats(6), func([]error) {}))
+}
+
+func TestParseQueuePolicy(t *testing.T) {
+	t.Parallel()
+	for _, policy := range []QueuePolicy{QueueDropOldest, QueueDropNewest, QueueBlock} {
+		parsed, err := ParseQueuePolicy(policy.String())
+		require.NoError(t, err)
+		assert.Equal(t, policy, parsed)
+	}
+	_, err := ParseQueuePolicy("drop")
+	assert.Error(t, err)
+}
+
+func TestFlusherBackendQueues(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	sb := newStalledBackend()
+	fl := NewMetricFlusher(time.Hour, nil, nil, nil, []gostatsd.Backend{sb}, gostatsd.UnknownIP, "host")
+	assert.Error(t, fl.SetBackendQueues(0, QueueDropOldest))
+	assert.Error(t, fl.SetBackendQueues(1, QueuePolicy(10)))
+	require.NoError(t, fl.SetBackendQueues(1, QueueDropNewest))
+	go fl.Run(ctx) // #nosec
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		m := metricMapWithStats(uint32(i + 1))
+		fl.sendMetricsAsync(ctx, &wg, fl.backends, m, func(error) {})
+		m.NumStats = 100 // Queued metrics are copies
+		if i == 0 {
+			require.EqualValues(t, 1, sb.waitStarted(t))
+		}
+	}
+	wg.Wait() // Does not wait for the stalled backend
+
+	assert.Equal(t, []QueueStats{{Backend: "stalledBackend", Depth: 1, Capacity: 1, Dropped: 1}}, fl.GetStats().Queues)
+	assert.True(t, fl.BackendStatuses()[0].LastSuccess.IsZero())
+	assert.Equal(t, []uint32{1, 2}, sb.releaseAll(t, 2))
+	for i := 0; i < 100 && fl.BackendStatuses()[0].LastSuccess.IsZero(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.False(t, fl.BackendStatuses()[0].LastSuccess.IsZero())
+}
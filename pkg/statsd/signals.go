@@ -0,0 +1,77 @@
+//go:build !windows
+// +build !windows
+
+package statsd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// notifySignals forces a flush on SIGUSR1 and logs stats on SIGUSR2 until the context is done.
+// Signals are subscribed to before it returns so that they are not handled by the default action.
+func notifySignals(ctx context.Context, receiver Receiver, flusher Flusher) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		defer signal.Stop(c)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-c:
+				if sig == syscall.SIGUSR1 {
+					flushOnSignal(ctx, flusher)
+				} else {
+					logStats(receiver, flusher)
+				}
+			}
+		}
+	}()
+}
+
+// flushOnSignal flushes metrics to backends without waiting for the flush interval, like the flush console command.
+func flushOnSignal(ctx context.Context, flusher Flusher) {
+	ff, ok := flusher.(ForceFlusher)
+	if !ok {
+		log.Warn("Flush on signal is not supported by the flusher")
+		return
+	}
+	result, err := ff.ForceFlush(ctx)
+	if err != nil {
+		log.Warnf("Flush on signal failed: %v", err)
+		return
+	}
+	if result.Err != nil {
+		log.Warnf("Flushed %d metrics on signal, backend error: %v", result.NumStats, result.Err)
+		return
+	}
+	log.Infof("Flushed %d metrics on signal", result.NumStats)
+}
+
+// logStats logs the stats of the receiver and the flusher, like the stats console command.
+func logStats(receiver Receiver, flusher Flusher) {
+	receiverStats := receiver.GetStats()
+	flusherStats := flusher.GetStats()
+	log.WithFields(log.Fields{
+		"bad_lines":           receiverStats.BadLines,
+		"metrics_received":    receiverStats.MetricsReceived,
+		"packets_received":    receiverStats.PacketsReceived,
+		"events_received":     receiverStats.EventsReceived,
+		"unknown_fields":      receiverStats.UnknownFields,
+		"last_packet":         receiverStats.LastPacket,
+		"last_flush":          flusherStats.LastFlush,
+		"last_flush_error":    flusherStats.LastFlushError,
+		"empty_names":         receiverStats.EmptyNames,
+		"empty_values":        receiverStats.EmptyValues,
+		"empty_types":         receiverStats.EmptyTypes,
+		"non_numeric_values":  receiverStats.NonNumericValues,
+		"non_finite_rejected": receiverStats.NonFiniteRejected,
+		"unknown_types":       receiverStats.UnknownTypes,
+		"untyped_lines":       receiverStats.UntypedLines,
+	}).Info("Stats")
+}
@@ -0,0 +1,74 @@
+//go:build !windows
+// +build !windows
+
+package statsd
+
+import (
+	"context"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// statsFlusher reports calls to GetStats.
+type statsFlusher struct {
+	*MetricFlusher
+	stats chan struct{}
+}
+
+func (sf *statsFlusher) GetStats() FlusherStats {
+	sf.stats <- struct{}{}
+	return sf.MetricFlusher.GetStats()
+}
+
+func TestNotifySignals(t *testing.T) {
+	// Not parallel, signals are received by the whole process
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	d := NewMetricDispatcher(1, 10, &agrFactory{})
+	cb := &capturingBackend{}
+	mr := NewMetricReceiver("", nopHandler{})
+	fl := NewMetricFlusher(time.Hour, d, mr, nopHandler{}, []gostatsd.Backend{cb}, gostatsd.UnknownIP, "host")
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancelFunc()
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, fl.Run(ctx))
+	}()
+	sf := &statsFlusher{MetricFlusher: fl, stats: make(chan struct{})}
+	notifySignals(ctx, mr, sf)
+
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGUSR1))
+	for i := 0; i < 100; i++ {
+		cb.mu.Lock()
+		n := len(cb.maps)
+		cb.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	cb.mu.Lock()
+	assert.Len(t, cb.maps, 1, "metrics were not flushed on SIGUSR1")
+	cb.mu.Unlock()
+
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGUSR2))
+	select {
+	case <-sf.stats:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stats were not logged on SIGUSR2")
+	}
+}
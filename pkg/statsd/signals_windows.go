@@ -0,0 +1,11 @@
+package statsd
+
+import (
+	"context"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func notifySignals(ctx context.Context, receiver Receiver, flusher Flusher) {
+	log.Warn("Flush and stats signals are not supported on Windows")
+}
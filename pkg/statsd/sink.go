@@ -0,0 +1,156 @@
+package statsd
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+
+	"github.com/atlassian/gostatsd"
+
+	"golang.org/x/time/rate"
+)
+
+// MetricSink is a stage of the pipeline of received metrics. Stages are composed by passing a sink to the
+// constructor of the previous stage, e.g. NewFilterSink(filter, NewEnrichSink(tags, NewDispatchSink(d))).
+type MetricSink interface {
+	// Send sends the metric to the stage. Must be safe for concurrent use.
+	Send(ctx context.Context, m *gostatsd.Metric) error
+}
+
+// FilterSink sends the metrics accepted by its filter to the next sink and drops the others.
+type FilterSink struct {
+	dropped uint64 // Accessed atomically
+	filter  MetricFilter
+	next    MetricSink
+}
+
+// NewFilterSink returns a FilterSink sending the metrics accepted by the filter to the next sink.
+func NewFilterSink(filter MetricFilter, next MetricSink) *FilterSink {
+	return &FilterSink{
+		filter: filter,
+		next:   next,
+	}
+}
+
+// Send sends the metric to the next sink if the filter accepts it.
+func (fs *FilterSink) Send(ctx context.Context, m *gostatsd.Metric) error {
+	if !fs.filter(m.Type, m.Name) {
+		atomic.AddUint64(&fs.dropped, 1)
+		return nil
+	}
+	return fs.next.Send(ctx, m)
+}
+
+// Dropped returns the number of metrics rejected by the filter. Safe for concurrent use.
+func (fs *FilterSink) Dropped() uint64 {
+	return atomic.LoadUint64(&fs.dropped)
+}
+
+// DropPrefixes returns a MetricFilter rejecting metrics with names starting with any of the prefixes.
+func DropPrefixes(prefixes []string) MetricFilter {
+	return func(metricType gostatsd.MetricType, name string) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(name, prefix) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// EnrichSink adds tags to metrics and sends them to the next sink. Metrics without a hostname get their source
+// IP as the hostname.
+type EnrichSink struct {
+	tags gostatsd.Tags
+	next MetricSink
+}
+
+// NewEnrichSink returns an EnrichSink adding the tags to metrics sent to the next sink.
+func NewEnrichSink(tags gostatsd.Tags, next MetricSink) *EnrichSink {
+	return &EnrichSink{
+		tags: tags,
+		next: next,
+	}
+}
+
+// Send enriches the metric and sends it to the next sink.
+func (es *EnrichSink) Send(ctx context.Context, m *gostatsd.Metric) error {
+	if m.Hostname == "" {
+		m.Hostname = string(m.SourceIP)
+	}
+	m.Tags = append(m.Tags, es.tags...)
+	return es.next.Send(ctx, m)
+}
+
+// RateLimitSink sends metrics to the next sink at the rate of its limiter and drops metrics exceeding it.
+type RateLimitSink struct {
+	dropped uint64 // Accessed atomically
+	limiter *rate.Limiter
+	next    MetricSink
+}
+
+// NewRateLimitSink returns a RateLimitSink sending metrics to the next sink at the rate of the limiter.
+func NewRateLimitSink(limiter *rate.Limiter, next MetricSink) *RateLimitSink {
+	return &RateLimitSink{
+		limiter: limiter,
+		next:    next,
+	}
+}
+
+// Send sends the metric to the next sink unless the rate is exceeded.
+func (rs *RateLimitSink) Send(ctx context.Context, m *gostatsd.Metric) error {
+	if !rs.limiter.Allow() {
+		atomic.AddUint64(&rs.dropped, 1)
+		return nil
+	}
+	return rs.next.Send(ctx, m)
+}
+
+// Dropped returns the number of metrics exceeding the rate. Safe for concurrent use.
+func (rs *RateLimitSink) Dropped() uint64 {
+	return atomic.LoadUint64(&rs.dropped)
+}
+
+// SinkStats holds the numbers of metrics dropped by stages of a pipeline of received metrics.
+type SinkStats struct {
+	Filtered    uint64 `json:"filtered"`     // Number of metrics rejected by FilterSinks
+	RateLimited uint64 `json:"rate_limited"` // Number of metrics exceeding the rate of RateLimitSinks
+}
+
+// PipelineStats returns the numbers of metrics dropped by the stages of the pipeline starting with the sink.
+// Safe for concurrent use.
+func PipelineStats(sink MetricSink) SinkStats {
+	var stats SinkStats
+	for sink != nil {
+		switch s := sink.(type) {
+		case *FilterSink:
+			stats.Filtered += s.Dropped()
+			sink = s.next
+		case *RateLimitSink:
+			stats.RateLimited += s.Dropped()
+			sink = s.next
+		case *EnrichSink:
+			sink = s.next
+		default:
+			sink = nil
+		}
+	}
+	return stats
+}
+
+// DispatchSink is the last stage of the pipeline, it dispatches metrics to the Aggregators of a Dispatcher.
+type DispatchSink struct {
+	dispatcher Dispatcher
+}
+
+// NewDispatchSink returns a DispatchSink dispatching metrics with the dispatcher.
+func NewDispatchSink(dispatcher Dispatcher) *DispatchSink {
+	return &DispatchSink{
+		dispatcher: dispatcher,
+	}
+}
+
+// Send dispatches the metric.
+func (ds *DispatchSink) Send(ctx context.Context, m *gostatsd.Metric) error {
+	return ds.dispatcher.DispatchMetric(ctx, m)
+}
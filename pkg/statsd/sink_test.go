@@ -0,0 +1,82 @@
+package statsd
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+// recordingSink records metrics sent to it.
+type recordingSink struct {
+	metrics []gostatsd.Metric
+}
+
+func (rs *recordingSink) Send(ctx context.Context, m *gostatsd.Metric) error {
+	rs.metrics = append(rs.metrics, *m)
+	return nil
+}
+
+func TestFilterSink(t *testing.T) {
+	t.Parallel()
+	next := &recordingSink{}
+	fs := NewFilterSink(DropPrefixes([]string{"debug.", "tmp"}), next)
+	for _, name := range []string{"debug.x", "app.debug.x", "tmp", "tmpfs.used", "a"} {
+		require.NoError(t, fs.Send(context.Background(), &gostatsd.Metric{Name: name}))
+	}
+	assert.Equal(t, []gostatsd.Metric{{Name: "app.debug.x"}, {Name: "a"}}, next.metrics)
+	assert.EqualValues(t, 3, fs.Dropped())
+}
+
+func TestEnrichSink(t *testing.T) {
+	t.Parallel()
+	next := &recordingSink{}
+	es := NewEnrichSink(gostatsd.Tags{"env:prod"}, next)
+	require.NoError(t, es.Send(context.Background(), &gostatsd.Metric{Name: "a", Tags: gostatsd.Tags{"x:y"}, SourceIP: "1.2.3.4"}))
+	require.NoError(t, es.Send(context.Background(), &gostatsd.Metric{Name: "b", Hostname: "h", SourceIP: "1.2.3.4"}))
+	assert.Equal(t, []gostatsd.Metric{
+		{Name: "a", Tags: gostatsd.Tags{"x:y", "env:prod"}, Hostname: "1.2.3.4", SourceIP: "1.2.3.4"},
+		{Name: "b", Tags: gostatsd.Tags{"env:prod"}, Hostname: "h", SourceIP: "1.2.3.4"},
+	}, next.metrics)
+}
+
+func TestRateLimitSink(t *testing.T) {
+	t.Parallel()
+	next := &recordingSink{}
+	rs := NewRateLimitSink(rate.NewLimiter(rate.Limit(1e-3), 2), next)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, rs.Send(context.Background(), &gostatsd.Metric{Name: "a"}))
+	}
+	assert.Len(t, next.metrics, 2)
+	assert.EqualValues(t, 3, rs.Dropped())
+}
+
+// countingDispatcher records dispatched metrics.
+type countingDispatcher struct {
+	countingHandler
+}
+
+func (cd *countingDispatcher) Process(ctx context.Context, f DispatcherProcessFunc) *sync.WaitGroup {
+	return &sync.WaitGroup{}
+}
+
+func TestServerMetricSink(t *testing.T) {
+	t.Parallel()
+	ch := &countingDispatcher{}
+	s := &Server{DropPrefixes: []string{"drop."}, MaxMetricsPerSecond: 2}
+	sink := s.metricSink(ch, gostatsd.Tags{"env:prod"})
+	for _, name := range []string{"drop.a", "a", "b", "c"} {
+		require.NoError(t, sink.Send(context.Background(), &gostatsd.Metric{Name: name}))
+	}
+	require.Len(t, ch.metrics, 2)
+	assert.Equal(t, "a", ch.metrics[0].Name)
+	assert.Equal(t, gostatsd.Tags{"env:prod"}, ch.metrics[0].Tags)
+	assert.Equal(t, "b", ch.metrics[1].Name)
+	assert.Equal(t, SinkStats{Filtered: 1, RateLimited: 1}, PipelineStats(sink))
+	assert.Equal(t, SinkStats{}, PipelineStats(nil))
+}
@@ -0,0 +1,23 @@
+package statsd
+
+import (
+	"context"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// skipEmptyBackend does not send metric maps without metrics to the backend, for backends that reject empty
+// payloads. Other methods are delegated to the backend.
+type skipEmptyBackend struct {
+	gostatsd.Backend
+}
+
+// SendMetricsAsync sends the metrics to the backend unless there are none, the callback is called without errors
+// if they are not sent.
+func (sb *skipEmptyBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	if len(m.Counters) == 0 && len(m.Timers) == 0 && len(m.Gauges) == 0 && len(m.Sets) == 0 {
+		cb(nil)
+		return
+	}
+	sb.Backend.SendMetricsAsync(ctx, m, cb)
+}
@@ -0,0 +1,239 @@
+package statsd
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// Snapshot returns a merged copy of MetricMaps of all Aggregators of the Dispatcher.
+// The returned MetricMap is a point-in-time deep copy, it is safe to read and modify it
+// and it is not updated when new metrics are received.
+// The snapshot reflects all metrics aggregated since the last flush. Timer summaries (count, min, max,
+// mean, median, standard deviation, sum, sum of squares) are calculated from the values in the snapshot.
+// Per second rates and timer percentiles depend on the flush interval and are not calculated.
+func Snapshot(ctx context.Context, d Dispatcher) (*gostatsd.MetricMap, error) {
+	var lock sync.Mutex
+	result := newMetricMap()
+	wg := d.Process(ctx, func(workerId uint16, aggr Aggregator) {
+		aggr.Process(func(m *gostatsd.MetricMap) {
+			lock.Lock()
+			defer lock.Unlock()
+			mergeMetricMap(result, m)
+		})
+	})
+	wg.Wait() // Wait for all workers to execute function
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	result.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		summarizeTimer(&timer)
+		result.Timers[key][tagsKey] = timer
+	})
+	return result, nil
+}
+
+// Snapshot returns a merged copy of MetricMaps of all Aggregators of the MetricDispatcher.
+// See Snapshot function for details.
+func (d *MetricDispatcher) Snapshot(ctx context.Context) (*gostatsd.MetricMap, error) {
+	return Snapshot(ctx, d)
+}
+
+func newMetricMap() *gostatsd.MetricMap {
+	return &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{},
+		Timers:   gostatsd.Timers{},
+		Gauges:   gostatsd.Gauges{},
+		Sets:     gostatsd.Sets{},
+	}
+}
+
+// mergeMetricMap deep copies all metrics from src into dst.
+// Metrics with the same name and tags are merged according to their type semantics.
+// Summaries of timers that exist in both maps are recalculated from merged values without percentiles.
+func mergeMetricMap(dst, src *gostatsd.MetricMap) {
+	dst.NumStats += src.NumStats
+	dst.DroppedCounters += src.DroppedCounters
+	dst.Keys.Add(src.Keys)
+	dst.NewKeys.Add(src.NewKeys)
+	dst.ExpiredKeys.Add(src.ExpiredKeys)
+	if src.ProcessingTime > dst.ProcessingTime {
+		dst.ProcessingTime = src.ProcessingTime
+	}
+	if dst.FlushInterval == 0 {
+		dst.FlushInterval = src.FlushInterval
+	}
+	src.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		counter.Tags = copyTags(counter.Tags)
+		v, ok := dst.Counters[key]
+		if !ok {
+			v = make(map[string]gostatsd.Counter)
+			dst.Counters[key] = v
+		}
+		if existing, ok := v[tagsKey]; ok {
+			counter.Value += existing.Value
+			counter.PerSecond += existing.PerSecond
+			if existing.Timestamp > counter.Timestamp {
+				counter.Timestamp = existing.Timestamp
+			}
+		}
+		v[tagsKey] = counter
+	})
+	src.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		v, ok := dst.Timers[key]
+		if !ok {
+			v = make(map[string]gostatsd.Timer)
+			dst.Timers[key] = v
+		}
+		existing, ok := v[tagsKey]
+		if !ok {
+			timer.Tags = copyTags(timer.Tags)
+			timer.Values = copyFloats(timer.Values)
+			timer.Percentiles = copyPercentiles(timer.Percentiles)
+			timer.Buckets = timer.Buckets.Merge(nil)
+			if timer.Digest != nil {
+				timer.Digest = timer.Digest.Clone()
+			}
+			v[tagsKey] = timer
+			return
+		}
+		existing.Values = append(existing.Values, timer.Values...)
+		if timer.Digest != nil {
+			if existing.Digest == nil {
+				existing.Digest = gostatsd.NewTDigest(timer.Digest.Compression())
+			}
+			existing.Digest.Merge(timer.Digest)
+		}
+		existing.Buckets = existing.Buckets.Merge(timer.Buckets)
+		existing.PerSecond += timer.PerSecond
+		if timer.Timestamp > existing.Timestamp {
+			existing.Timestamp = timer.Timestamp
+		}
+		// Summaries are recalculated from merged values, percentiles cannot be merged
+		summarizeTimer(&existing)
+		existing.Percentiles = nil
+		v[tagsKey] = existing
+	})
+	src.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		gauge.Tags = copyTags(gauge.Tags)
+		v, ok := dst.Gauges[key]
+		if !ok {
+			v = make(map[string]gostatsd.Gauge)
+			dst.Gauges[key] = v
+		}
+		if existing, ok := v[tagsKey]; ok && existing.Timestamp > gauge.Timestamp {
+			return // Keep the most recent value
+		}
+		v[tagsKey] = gauge
+	})
+	src.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+		set.Tags = copyTags(set.Tags)
+		v, ok := dst.Sets[key]
+		if !ok {
+			v = make(map[string]gostatsd.Set)
+			dst.Sets[key] = v
+		}
+		existing, ok := v[tagsKey]
+		if !ok {
+			existing = gostatsd.NewSet(set.Timestamp, make(map[string]struct{}, len(set.Values)), set.Hostname, set.Tags)
+			existing.Unit = set.Unit
+		} else if set.Timestamp > existing.Timestamp {
+			existing.Timestamp = set.Timestamp
+		}
+		for value := range set.Values {
+			existing.Values[value] = struct{}{}
+		}
+		if set.Sketch != nil {
+			if existing.Sketch == nil {
+				existing.Sketch = gostatsd.NewHyperLogLog()
+			}
+			existing.Sketch.Merge(set.Sketch)
+		}
+		v[tagsKey] = existing
+	})
+}
+
+// summarizeTimer calculates summaries of the timer from its values, or from its digest if it is digested.
+// Values are sorted in place.
+func summarizeTimer(timer *gostatsd.Timer) {
+	if timer.Digest != nil {
+		summarizeDigest(timer)
+		return
+	}
+	timer.Count = len(timer.Values)
+	if timer.Count == 0 {
+		return
+	}
+	sort.Float64s(timer.Values)
+	count := float64(timer.Count)
+	timer.Min = timer.Values[0]
+	timer.Max = timer.Values[timer.Count-1]
+	timer.Sum = 0
+	timer.SumSquares = 0
+	for _, value := range timer.Values {
+		timer.Sum += value
+		timer.SumSquares += value * value
+	}
+	timer.Mean = timer.Sum / count
+	var sumOfDiffs float64
+	for _, value := range timer.Values {
+		sumOfDiffs += (value - timer.Mean) * (value - timer.Mean)
+	}
+	timer.StdDev = math.Sqrt(sumOfDiffs / count)
+	mid := timer.Count / 2
+	if timer.Count%2 == 0 {
+		timer.Median = (timer.Values[mid-1] + timer.Values[mid]) / 2
+	} else {
+		timer.Median = timer.Values[mid]
+	}
+}
+
+// summarizeDigest calculates summaries of a digested timer. The median is estimated, the other summaries are exact.
+func summarizeDigest(timer *gostatsd.Timer) {
+	d := timer.Digest
+	timer.Count = int(d.Count())
+	if timer.Count == 0 {
+		return
+	}
+	count := d.Count()
+	timer.Min = d.Min()
+	timer.Max = d.Max()
+	timer.Sum = d.Sum()
+	timer.SumSquares = d.SumSquares()
+	timer.Mean = timer.Sum / count
+	// Rounding errors can make the variance slightly negative when all values are equal
+	timer.StdDev = math.Sqrt(math.Max(timer.SumSquares/count-timer.Mean*timer.Mean, 0))
+	timer.Median = d.Quantile(0.5)
+}
+
+func copyTags(tags gostatsd.Tags) gostatsd.Tags {
+	if tags == nil {
+		return nil
+	}
+	result := make(gostatsd.Tags, len(tags))
+	copy(result, tags)
+	return result
+}
+
+func copyFloats(values []float64) []float64 {
+	if values == nil {
+		return nil
+	}
+	result := make([]float64, len(values))
+	copy(result, values)
+	return result
+}
+
+func copyPercentiles(percentiles gostatsd.Percentiles) gostatsd.Percentiles {
+	if percentiles == nil {
+		return nil
+	}
+	result := make(gostatsd.Percentiles, len(percentiles))
+	copy(result, percentiles)
+	return result
+}
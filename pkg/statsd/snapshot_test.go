@@ -0,0 +1,126 @@
+package statsd
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotReflectsReceivedMetrics(t *testing.T) {
+	t.Parallel()
+	d := NewMetricDispatcher(3, 10, &agrFactory{
+		percentThresholds: DefaultPercentThreshold,
+		expiryInterval:    DefaultExpiryInterval,
+	})
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+
+	metrics := metricsFixtures()
+	for i := range metrics {
+		require.NoError(t, d.DispatchMetric(ctx, &metrics[i]))
+	}
+	// Process commands and metrics are handled by workers in random order, wait until all metrics are received
+	snapshot := waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.NumStats == uint32(len(metrics))
+	})
+
+	assert.Equal(t, int64(2), snapshot.Counters["foo.bar.baz"][""].Value)
+	assert.Equal(t, int64(55), snapshot.Counters["smp.rte"]["baz,foo:bar"].Value)
+	assert.Equal(t, float64(8), snapshot.Gauges["abc.def.g"]["baz,foo:bar"].Value)
+	timer := snapshot.Timers["def.g"][""]
+	assert.Equal(t, []float64{10}, timer.Values)
+	assert.Equal(t, 1, timer.Count)
+	assert.Equal(t, float64(10), timer.Mean)
+	assert.Len(t, snapshot.Sets["uniq.usr"][""].Values, 3)
+
+	// Modifying the snapshot must not affect the aggregators
+	snapshot.Counters["foo.bar.baz"][""] = gostatsd.Counter{Value: 100}
+	snapshot.Sets["uniq.usr"][""].Values["alice"] = struct{}{}
+	again, err := d.Snapshot(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), again.Counters["foo.bar.baz"][""].Value)
+	assert.Len(t, again.Sets["uniq.usr"][""].Values, 3)
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestMergeMetricMapMergesTimers(t *testing.T) {
+	t.Parallel()
+	src1 := newMetricMap()
+	src1.Timers["t"] = map[string]gostatsd.Timer{
+		"": gostatsd.NewTimer(10, []float64{4, 1}, "h", nil),
+	}
+	src2 := newMetricMap()
+	src2.Timers["t"] = map[string]gostatsd.Timer{
+		"": gostatsd.NewTimer(20, []float64{3, 2}, "h", nil),
+	}
+	dst := newMetricMap()
+	mergeMetricMap(dst, src1)
+	mergeMetricMap(dst, src2)
+	timer := dst.Timers["t"][""]
+	summarizeTimer(&timer)
+
+	assert.Equal(t, []float64{1, 2, 3, 4}, timer.Values)
+	assert.Equal(t, 4, timer.Count)
+	assert.Equal(t, float64(1), timer.Min)
+	assert.Equal(t, float64(4), timer.Max)
+	assert.Equal(t, float64(10), timer.Sum)
+	assert.Equal(t, float64(30), timer.SumSquares)
+	assert.Equal(t, 2.5, timer.Mean)
+	assert.Equal(t, 2.5, timer.Median)
+	assert.Equal(t, gostatsd.Nanotime(20), timer.Timestamp)
+	assert.Equal(t, "h", timer.Hostname)
+	assert.Equal(t, []float64{4, 1}, src1.Timers["t"][""].Values) // Sources must not be modified
+}
+
+func TestMergeMetricMapMergesSketches(t *testing.T) {
+	t.Parallel()
+	src1 := newMetricMap()
+	set1 := gostatsd.NewSet(10, map[string]struct{}{}, "h", nil)
+	set1.Sketch = gostatsd.NewHyperLogLog()
+	set1.Sketch.Add("a")
+	set1.Sketch.Add("b")
+	src1.Sets["s"] = map[string]gostatsd.Set{"": set1}
+	src2 := newMetricMap()
+	set2 := gostatsd.NewSet(20, map[string]struct{}{}, "h", nil)
+	set2.Sketch = gostatsd.NewHyperLogLog()
+	set2.Sketch.Add("b")
+	set2.Sketch.Add("c")
+	src2.Sets["s"] = map[string]gostatsd.Set{"": set2}
+	dst := newMetricMap()
+	mergeMetricMap(dst, src1)
+	mergeMetricMap(dst, src2)
+
+	assert.Equal(t, 3, dst.Sets["s"][""].Cardinality())
+	assert.Equal(t, 2, src1.Sets["s"][""].Cardinality()) // Sources must not be modified
+}
+
+func TestServerSnapshotNotRunning(t *testing.T) {
+	t.Parallel()
+	s := NewServer()
+	_, err := s.Snapshot(context.Background())
+	assert.Equal(t, errServerNotRunning, err)
+}
+
+func TestServerSnapshotShuttingDown(t *testing.T) {
+	t.Parallel()
+	s := NewServer()
+	dispCtx, cancelFunc := context.WithCancel(context.Background())
+	cancelFunc()
+	// Dispatcher is not running so Snapshot would block forever if it was not tied to the server lifetime
+	s.setDispatcher(dispCtx, NewMetricDispatcher(1, 1, newTestFactory()))
+	_, err := s.Snapshot(context.Background())
+	assert.Equal(t, errServerNotRunning, err)
+}
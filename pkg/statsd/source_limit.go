@@ -0,0 +1,108 @@
+package statsd
+
+import (
+	"sort"
+	"sync"
+)
+
+// SourceKeyLimiter caps the number of distinct metric keys of each source, so that a single client cannot grow
+// the cardinality of the server unbounded. Sources are identified by the hostname of their metrics, which is
+// their IP address unless a cloud provider or the client sets it. Once a source has the maximum number of keys,
+// metrics with new keys from it are dropped and counted, while its existing keys are still updated.
+//
+// Keys are counted across the aggregators of all workers. Each aggregator reports the keys it owns by source on
+// every Reset, so that expired, deleted and imported keys are accounted for.
+type SourceKeyLimiter struct {
+	maxKeys int
+	mu      sync.Mutex
+	sources map[string]*sourceKeys
+}
+
+type sourceKeys struct {
+	keys    int
+	dropped uint64
+}
+
+// SourceKeyStats are the number of keys of a source and the number of metrics dropped because it has too many.
+type SourceKeyStats struct {
+	Source  string
+	Keys    int
+	Dropped uint64
+}
+
+// NewSourceKeyLimiter initialises a new SourceKeyLimiter allowing up to maxKeys distinct keys per source.
+func NewSourceKeyLimiter(maxKeys int) *SourceKeyLimiter {
+	return &SourceKeyLimiter{
+		maxKeys: maxKeys,
+		sources: make(map[string]*sourceKeys),
+	}
+}
+
+// MaxKeys returns the maximum number of distinct keys of each source.
+func (l *SourceKeyLimiter) MaxKeys() int {
+	return l.maxKeys
+}
+
+// allow returns whether the source may create a new key, which is counted if so. The dropped metric is
+// counted otherwise.
+func (l *SourceKeyLimiter) allow(source string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sk := l.sources[source]
+	if sk == nil {
+		sk = &sourceKeys{}
+		l.sources[source] = sk
+	}
+	if sk.keys >= l.maxKeys {
+		sk.dropped++
+		return false
+	}
+	sk.keys++
+	return true
+}
+
+// update adds the changes of the numbers of keys of the sources.
+func (l *SourceKeyLimiter) update(deltas map[string]int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for source, delta := range deltas {
+		sk := l.sources[source]
+		if sk == nil {
+			sk = &sourceKeys{}
+			l.sources[source] = sk
+		}
+		sk.keys += delta
+		if sk.keys <= 0 && sk.dropped == 0 {
+			delete(l.sources, source)
+		}
+	}
+}
+
+// Stats returns the numbers of keys of the sources, sources with the most keys first.
+func (l *SourceKeyLimiter) Stats() []SourceKeyStats {
+	l.mu.Lock()
+	stats := make(sourceKeyStats, 0, len(l.sources))
+	for source, sk := range l.sources {
+		stats = append(stats, SourceKeyStats{Source: source, Keys: sk.keys, Dropped: sk.dropped})
+	}
+	l.mu.Unlock()
+	sort.Sort(stats)
+	return stats
+}
+
+type sourceKeyStats []SourceKeyStats
+
+func (s sourceKeyStats) Len() int {
+	return len(s)
+}
+
+func (s sourceKeyStats) Less(i, j int) bool {
+	if s[i].Keys != s[j].Keys {
+		return s[i].Keys > s[j].Keys
+	}
+	return s[i].Source < s[j].Source
+}
+
+func (s sourceKeyStats) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
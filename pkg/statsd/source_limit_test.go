@@ -0,0 +1,90 @@
+package statsd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceKeyLimiter(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	l := NewSourceKeyLimiter(3)
+	// Keys of a source are counted across the aggregators of all workers
+	aggregators := []*MetricAggregator{newFakeAggregator(), newFakeAggregator()}
+	for _, a := range aggregators {
+		a.expiryInterval = 10 * time.Second
+		a.SetSourceKeyLimiter(l)
+		a.now = func() time.Time {
+			return now
+		}
+	}
+	receive := func(i int, m gostatsd.Metric) {
+		aggregators[i%len(aggregators)].Receive(&m, now)
+	}
+
+	names := []string{"a", "b", "c", "d", "e"}
+	for i, name := range names {
+		receive(i, gostatsd.Metric{Name: name, Value: 1, Type: gostatsd.COUNTER, Hostname: "noisy"})
+	}
+	receive(0, gostatsd.Metric{Name: "a", Value: 1, Type: gostatsd.GAUGE, Hostname: "quiet"})
+	receive(1, gostatsd.Metric{Name: "b", Value: 1, Type: gostatsd.TIMER, Hostname: "quiet"})
+	// Existing keys of the source over its limit are still updated
+	receive(0, gostatsd.Metric{Name: "a", Value: 2, Type: gostatsd.COUNTER, Hostname: "noisy"})
+	receive(1, gostatsd.Metric{Name: "e", Value: 1, Type: gostatsd.COUNTER, Hostname: "noisy"})
+
+	assert.Equal(t, []SourceKeyStats{
+		{Source: "noisy", Keys: 3, Dropped: 3},
+		{Source: "quiet", Keys: 2},
+	}, l.Stats())
+	assert.EqualValues(t, 3, aggregators[0].Counters["a"][formatTagsKey(nil, "noisy")].Value)
+	assert.EqualValues(t, 1, aggregators[1].Counters["b"][formatTagsKey(nil, "noisy")].Value)
+	assert.NotContains(t, aggregators[1].Counters, "d")
+	assert.NotContains(t, aggregators[1].Counters, "e")
+	assert.Contains(t, aggregators[1].Timers, "b")
+
+	// Deleted keys are accounted for on Reset
+	aggregators[1].Counters.Delete("b")
+	for _, a := range aggregators {
+		a.Reset()
+	}
+	assert.Equal(t, []SourceKeyStats{
+		{Source: "noisy", Keys: 2, Dropped: 3},
+		{Source: "quiet", Keys: 2},
+	}, l.Stats())
+	receive(1, gostatsd.Metric{Name: "d", Value: 1, Type: gostatsd.COUNTER, Hostname: "noisy"})
+	assert.Contains(t, aggregators[1].Counters, "d")
+
+	// Expired keys make room for new ones
+	now = now.Add(time.Minute)
+	for _, a := range aggregators {
+		a.Reset()
+	}
+	assert.Equal(t, []SourceKeyStats{{Source: "noisy", Keys: 0, Dropped: 3}}, l.Stats())
+	receive(1, gostatsd.Metric{Name: "e", Value: 1, Type: gostatsd.COUNTER, Hostname: "noisy"})
+	assert.Contains(t, aggregators[1].Counters, "e")
+}
+
+func TestConsoleSources(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	conn, r := startConsole(t, ctx, &ConsoleServer{})
+	defer conn.Close()
+	assert.Equal(t, "keys of sources are not capped\n", consoleCommand(t, conn, r, "sources"))
+
+	l := NewSourceKeyLimiter(1)
+	require.True(t, l.allow("10.0.0.1"))
+	require.False(t, l.allow("10.0.0.1"))
+	require.True(t, l.allow("10.0.0.2"))
+	conn, r = startConsole(t, ctx, &ConsoleServer{SourceKeys: l})
+	defer conn.Close()
+	assert.Equal(t, "Maximum keys per source: 1\n"+
+		"10.0.0.1: keys=1 dropped=1\n"+
+		"10.0.0.2: keys=1 dropped=0\n", consoleCommand(t, conn, r, "sources"))
+}
@@ -0,0 +1,113 @@
+package statsd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// MetricStateVersion is the version of the metric state format written by WriteMetricState.
+const MetricStateVersion = 1
+
+// metricState is the serialized form of aggregated metrics.
+type metricState struct {
+	Version int                 `json:"version"`
+	Metrics *gostatsd.MetricMap `json:"metrics"`
+}
+
+// WriteMetricState writes the MetricMap to the writer as versioned JSON.
+func WriteMetricState(w io.Writer, m *gostatsd.MetricMap) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(metricState{
+		Version: MetricStateVersion,
+		Metrics: m,
+	})
+}
+
+// ReadMetricState reads a MetricMap written by WriteMetricState from the reader.
+// An error is returned if the version of the state is not supported.
+func ReadMetricState(r io.Reader) (*gostatsd.MetricMap, error) {
+	var state metricState
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return nil, fmt.Errorf("failed to decode metric state: %v", err)
+	}
+	if state.Version != MetricStateVersion {
+		return nil, fmt.Errorf("unsupported metric state version %d, expected %d", state.Version, MetricStateVersion)
+	}
+	if state.Metrics == nil {
+		return newMetricMap(), nil
+	}
+	return state.Metrics, nil
+}
+
+// SeedMetricState dispatches values of the MetricMap to the Dispatcher as metrics so that aggregators
+// continue from the state. Digested timers are dispatched as a metric with their digest. Returns the number of
+// dispatched metrics.
+func SeedMetricState(ctx context.Context, d Dispatcher, m *gostatsd.MetricMap) (int, error) {
+	var metrics []gostatsd.Metric
+	m.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		metrics = append(metrics, gostatsd.Metric{
+			Name:     key,
+			Value:    float64(counter.Value),
+			Tags:     counter.Tags,
+			Hostname: counter.Hostname,
+			Unit:     counter.Unit,
+			Type:     gostatsd.COUNTER,
+		})
+	})
+	m.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		if timer.Digest != nil && timer.Digest.Count() > 0 {
+			metrics = append(metrics, gostatsd.Metric{
+				Name:     key,
+				Digest:   timer.Digest.Clone(), // Merged by the aggregator
+				Tags:     timer.Tags,
+				Hostname: timer.Hostname,
+				Unit:     timer.Unit,
+				Type:     gostatsd.TIMER,
+			})
+		}
+		for _, value := range timer.Values {
+			metrics = append(metrics, gostatsd.Metric{
+				Name:     key,
+				Value:    value,
+				Tags:     timer.Tags,
+				Hostname: timer.Hostname,
+				Unit:     timer.Unit,
+				Type:     gostatsd.TIMER,
+			})
+		}
+	})
+	m.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		metrics = append(metrics, gostatsd.Metric{
+			Name:     key,
+			Value:    gauge.Value,
+			Tags:     gauge.Tags,
+			Hostname: gauge.Hostname,
+			Unit:     gauge.Unit,
+			Type:     gostatsd.GAUGE,
+		})
+	})
+	m.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+		for value := range set.Values {
+			metrics = append(metrics, gostatsd.Metric{
+				Name:        key,
+				StringValue: value,
+				Tags:        set.Tags,
+				Hostname:    set.Hostname,
+				Unit:        set.Unit,
+				Type:        gostatsd.SET,
+			})
+		}
+	})
+	for i := range metrics {
+		metrics[i].Tags = copyTags(metrics[i].Tags) // Aggregators own tags of received metrics
+		if err := d.DispatchMetric(ctx, &metrics[i]); err != nil {
+			return i, err
+		}
+	}
+	return len(metrics), nil
+}
@@ -0,0 +1,127 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricStateRoundTrip(t *testing.T) {
+	t.Parallel()
+	m := newMetricMap()
+	m.Counters["c"] = map[string]gostatsd.Counter{"a:b": gostatsd.NewCounter(10, 5, "h", gostatsd.Tags{"a:b"})}
+	m.Timers["t"] = map[string]gostatsd.Timer{"": gostatsd.NewTimer(10, []float64{1, 2}, "", nil)}
+	m.Gauges["g"] = map[string]gostatsd.Gauge{"": gostatsd.NewGauge(10, 1.5, "", nil)}
+	m.Sets["s"] = map[string]gostatsd.Set{"": gostatsd.NewSet(10, map[string]struct{}{"x": {}}, "", nil)}
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, WriteMetricState(buf, m))
+	read, err := ReadMetricState(buf)
+	require.NoError(t, err)
+	assert.Equal(t, m, read)
+}
+
+func TestReadMetricStateUnsupportedVersion(t *testing.T) {
+	t.Parallel()
+	_, err := ReadMetricState(strings.NewReader(`{"version": 2, "metrics": {}}`))
+	assert.EqualError(t, err, "unsupported metric state version 2, expected 1")
+	_, err = ReadMetricState(strings.NewReader(`not json`))
+	assert.Error(t, err)
+}
+
+func TestSeedMetricState(t *testing.T) {
+	t.Parallel()
+	d := NewMetricDispatcher(3, 10, &agrFactory{})
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+
+	m := newMetricMap()
+	m.Counters["c"] = map[string]gostatsd.Counter{"a:b,s:h": gostatsd.NewCounter(10, 5, "h", gostatsd.Tags{"a:b"})}
+	m.Timers["t"] = map[string]gostatsd.Timer{"": gostatsd.NewTimer(10, []float64{1, 2}, "", nil)}
+	m.Gauges["g"] = map[string]gostatsd.Gauge{"": gostatsd.NewGauge(10, 1.5, "", nil)}
+	m.Sets["s"] = map[string]gostatsd.Set{"": gostatsd.NewSet(10, map[string]struct{}{"x": {}, "y": {}}, "", nil)}
+	n, err := SeedMetricState(ctx, d, m)
+	require.NoError(t, err)
+	assert.Equal(t, 6, n)
+
+	snapshot := waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.NumStats == uint32(n)
+	})
+	assert.Equal(t, int64(5), snapshot.Counters["c"]["a:b,s:h"].Value)
+	assert.Equal(t, "h", snapshot.Counters["c"]["a:b,s:h"].Hostname)
+	assert.Equal(t, []float64{1, 2}, snapshot.Timers["t"][""].Values)
+	assert.Equal(t, 1.5, snapshot.Gauges["g"][""].Value)
+	assert.Len(t, snapshot.Sets["s"][""].Values, 2)
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestSeedMetricStateDigestedTimers(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	var wg sync.WaitGroup
+	newDispatcher := func(timerMode TimerMode) *MetricDispatcher {
+		d := NewMetricDispatcher(2, 10, &agrFactory{timerMode: timerMode})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, context.Canceled, d.Run(ctx))
+		}()
+		return d
+	}
+	src := newDispatcher(TimersDigest)
+	for i := 1; i <= 1000; i++ {
+		require.NoError(t, src.DispatchMetric(ctx, &gostatsd.Metric{Name: "t", Value: float64(i), Type: gostatsd.TIMER}))
+	}
+	m := waitForSnapshot(t, ctx, src, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.Timers["t"][""].NumValues() == 1000
+	})
+
+	// The state is exported, e.g. to the next process, then seeded twice to check that digests are merged
+	buf := new(bytes.Buffer)
+	require.NoError(t, WriteMetricState(buf, m))
+	read, err := ReadMetricState(buf)
+	require.NoError(t, err)
+	dst := newDispatcher(TimersDigest)
+	for i := 0; i < 2; i++ {
+		n, err := SeedMetricState(ctx, dst, read)
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+	}
+	snapshot := waitForSnapshot(t, ctx, dst, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.Timers["t"][""].NumValues() == 2000
+	})
+	timer := snapshot.Timers["t"][""]
+	require.NotNil(t, timer.Digest)
+	assert.Equal(t, 1.0, timer.Digest.Min())
+	assert.Equal(t, 1000.0, timer.Digest.Max())
+	assert.InDelta(t, 500, timer.Digest.Quantile(0.5), 10)
+
+	// Values are estimated by the centroids if timers are no longer digested
+	exact := newDispatcher(TimersExact)
+	_, err = SeedMetricState(ctx, exact, read)
+	require.NoError(t, err)
+	snapshot = waitForSnapshot(t, ctx, exact, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.Timers["t"][""].NumValues() == 1000
+	})
+	assert.Len(t, snapshot.Timers["t"][""].Values, 1000)
+	assert.Nil(t, snapshot.Timers["t"][""].Digest)
+
+	cancelFunc()
+	wg.Wait()
+}
@@ -2,6 +2,10 @@ package statsd
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"os"
 	"runtime"
@@ -11,6 +15,7 @@ import (
 	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statsd/cardinality"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/spf13/pflag"
@@ -33,6 +38,9 @@ var DefaultPercentThreshold = []float64{90}
 // DefaultTags is the default list of additional tags.
 var DefaultTags = gostatsd.Tags{}
 
+// DefaultHeartbeatType is the default type of the heartbeat metric.
+var DefaultHeartbeatType = gostatsd.GAUGE
+
 const (
 	// DefaultMaxCloudRequests is the maximum number of cloud provider requests per second.
 	DefaultMaxCloudRequests = 40
@@ -44,10 +52,30 @@ const (
 	DefaultFlushInterval = 1 * time.Second
 	// DefaultMetricsAddr is the default address on which to listen for metrics.
 	DefaultMetricsAddr = ":8125"
+	// DefaultQUICMaxStreams is the default maximum number of concurrent streams per QUIC connection.
+	DefaultQUICMaxStreams = 100
 	// DefaultMaxQueueSize is the default maximum number of buffered metrics per worker.
 	DefaultMaxQueueSize = 10000 // arbitrary
 	// DefaultMaxConcurrentEvents is the default maximum number of events sent concurrently.
 	DefaultMaxConcurrentEvents = 1024 // arbitrary
+	// DefaultFlushObserverTimeout is the default maximum time flush observers are allowed to run on each flush.
+	DefaultFlushObserverTimeout = 1 * time.Second
+	// DefaultBackendErrorLogInterval is the default interval identical backend errors are not logged for.
+	DefaultBackendErrorLogInterval = 1 * time.Minute
+	// DefaultHeartbeatValue is the default value of the heartbeat metric.
+	DefaultHeartbeatValue = 1
+	// DefaultHostTagKey is the default key of the tag with the hostname of the server added to flushed metrics.
+	DefaultHostTagKey = "statsd_host"
+	// DefaultTenant is the default tenant of metrics without a known tenant.
+	DefaultTenant = "default"
+	// DefaultRuntimeMetricsPrefix is the default prefix of the names of Go runtime metrics.
+	DefaultRuntimeMetricsPrefix = internalMetric + "runtime."
+	// DefaultRuntimeMetricsInterval is the default interval Go runtime metrics are collected at.
+	DefaultRuntimeMetricsInterval = 10 * time.Second
+	// DefaultInternSize is the default maximum number of distinct names and tags of received metrics deduplicated.
+	DefaultInternSize = 100000
+	// DefaultSnapshotInterval is the default interval of snapshots of aggregated metrics written for crash recovery.
+	DefaultSnapshotInterval = 1 * time.Second
 )
 
 const (
@@ -55,97 +83,469 @@ const (
 	ParamBackends = "backends"
 	// ParamConsoleAddr is the name of parameter with console address.
 	ParamConsoleAddr = "console-addr"
+	// ParamDisableConsole is the name of parameter that disables the console.
+	ParamDisableConsole = "disable-console"
+	// ParamConsoleIdleTimeout is the name of parameter with the time after which idle console connections are closed.
+	ParamConsoleIdleTimeout = "console-idle-timeout"
+	// ParamConsoleCommandInterval is the name of parameter with the minimum time between runs of an expensive
+	// console command by a connection.
+	ParamConsoleCommandInterval = "console-command-interval"
+	// ParamConsoleStateDir is the name of parameter with the directory of files exported and imported by the console.
+	ParamConsoleStateDir = "console-state-dir"
+	// ParamGRPCAddr is the name of parameter with the address of the gRPC admin service.
+	ParamGRPCAddr = "grpc-addr"
+	// ParamHealthAddr is the name of parameter with the address of the health check endpoints.
+	ParamHealthAddr = "health-addr"
 	// ParamCloudProvider is the name of parameter with the name of cloud provider.
 	ParamCloudProvider = "cloud-provider"
 	// ParamMaxCloudRequests is the name of parameter with maximum number of cloud provider requests per second.
 	ParamMaxCloudRequests = "max-cloud-requests"
 	// ParamBurstCloudRequests is the name of parameter with burst number of cloud provider requests per second.
 	ParamBurstCloudRequests = "burst-cloud-requests"
+	// ParamMaxConcurrentCloudLookups is the name of parameter with the maximum number of cloud lookups in flight.
+	ParamMaxConcurrentCloudLookups = "max-concurrent-cloud-lookups"
+	// ParamCloudLookupPolicy is the name of parameter with the policy for cloud lookups once too many are in flight.
+	ParamCloudLookupPolicy = "cloud-lookup-policy"
 	// ParamDefaultTags is the name of parameter with the list of additional tags.
 	ParamDefaultTags = "default-tags"
+	// ParamDefaultTagsEnv is the name of parameter with the list of environment variables to add as tags.
+	ParamDefaultTagsEnv = "default-tags-env"
 	// ParamExpiryInterval is the name of parameter with expiry interval for metrics.
 	ParamExpiryInterval = "expiry-interval"
+	// ParamExpiryIntervals is the name of parameter with expiry intervals of metric types.
+	ParamExpiryIntervals = "expiry-intervals"
 	// ParamFlushInterval is the name of parameter with metrics flush interval.
 	ParamFlushInterval = "flush-interval"
+	// ParamNegativeCounters is the name of parameter with the policy for counters that are negative on flush.
+	ParamNegativeCounters = "negative-counters"
+	// ParamZeroFillCounters is the name of parameter with whether counters not updated in a flush interval are flushed as 0.
+	ParamZeroFillCounters = "zero-fill-counters"
+	// ParamZeroFillGauges is the name of parameter with whether gauges not updated in a flush interval are flushed.
+	ParamZeroFillGauges = "zero-fill-gauges"
+	// ParamSetMode is the name of parameter with how sets store their values.
+	ParamSetMode = "set-mode"
+	// ParamExactSets is the name of parameter with the list of sets stored exactly regardless of the set mode.
+	ParamExactSets = "exact-sets"
+	// ParamTimerMode is the name of parameter with how timers store their values.
+	ParamTimerMode = "timer-mode"
+	// ParamTimerCompression is the name of parameter with the compression of the digests of timers.
+	ParamTimerCompression = "timer-compression"
+	// ParamCardinalityReport is the name of parameter with how cardinality of metrics is reported on flush.
+	ParamCardinalityReport = "cardinality-report"
+	// ParamCardinalityReportEvery is the name of parameter with the number of flushes between cardinality reports.
+	ParamCardinalityReportEvery = "cardinality-report-every"
+	// ParamPayloadBuckets is the name of parameter with bucket bounds of histograms of backend payload sizes.
+	ParamPayloadBuckets = "payload-buckets"
+	// ParamBackendFlushIntervals is the name of parameter with flush intervals of backends.
+	ParamBackendFlushIntervals = "backend-flush-intervals"
+	// ParamBackendTimeouts is the name of parameter with timeouts of sends to backends.
+	ParamBackendTimeouts = "backend-timeouts"
+	// ParamBackendQueueSize is the name of parameter with the number of flushes queued per backend.
+	ParamBackendQueueSize = "backend-queue-size"
+	// ParamSkipEmptyFlushBackends is the name of parameter with backends that are not sent flushes without metrics.
+	ParamSkipEmptyFlushBackends = "skip-empty-flush-backends"
+	// ParamValuePrecision is the name of parameter with the number of significant digits of values sent to backends.
+	ParamValuePrecision = "value-precision"
+	// ParamBackendQueuePolicy is the name of parameter with the policy for flushes sent to a full backend queue.
+	ParamBackendQueuePolicy = "backend-queue-policy"
+	// ParamTenantMode is the name of parameter with how the tenant of received metrics is determined.
+	ParamTenantMode = "tenant-mode"
+	// ParamDefaultTenant is the name of parameter with the tenant of metrics without a known tenant.
+	ParamDefaultTenant = "default-tenant"
 	// ParamMaxReaders is the name of parameter with number of socket readers.
 	ParamMaxReaders = "max-readers"
 	// ParamMaxWorkers is the name of parameter with number of goroutines that aggregate metrics.
 	ParamMaxWorkers = "max-workers"
 	// ParamMaxQueueSize is the name of parameter with maximum number of buffered metrics per worker.
 	ParamMaxQueueSize = "max-queue-size"
+	// ParamDispatchKeyHash is the name of parameter with the hash function mapping metric names to workers.
+	ParamDispatchKeyHash = "dispatch-key-hash"
 	// ParamMaxConcurrentEvents is the name of parameter with maximum number of events sent concurrently.
 	ParamMaxConcurrentEvents = "max-concurrent-events"
 	// ParamMetricsAddr is the name of parameter with address on which to listen for metrics.
 	ParamMetricsAddr = "metrics-addr"
+	// ParamMetricsSocket is the name of parameter with the path of the Unix socket on which to listen for metrics.
+	ParamMetricsSocket = "metrics-socket"
+	// ParamMetricsSocketFramed is the name of parameter with whether the Unix socket receives length-prefixed frames.
+	ParamMetricsSocketFramed = "metrics-socket-framed"
+	// ParamQUICAddr is the name of parameter with the UDP address on which to listen for metrics over QUIC.
+	ParamQUICAddr = "quic-addr"
+	// ParamQUICCertFile is the name of parameter with the path of the TLS certificate of the QUIC receiver.
+	ParamQUICCertFile = "quic-cert-file"
+	// ParamQUICKeyFile is the name of parameter with the path of the TLS key of the QUIC receiver.
+	ParamQUICKeyFile = "quic-key-file"
+	// ParamQUICMaxStreams is the name of parameter with the maximum number of concurrent streams per QUIC connection.
+	ParamQUICMaxStreams = "quic-max-streams"
 	// ParamNamespace is the name of parameter with namespace for all metrics.
 	ParamNamespace = "namespace"
 	// ParamPercentThreshold is the name of parameter with list of applied percentiles.
 	ParamPercentThreshold = "percent-threshold"
+	// ParamPercentileTemplate is the name of parameter with the template of names of upper percentiles of timers.
+	ParamPercentileTemplate = "percentile-template"
 	// ParamWebAddr is the name of parameter with the address of the web-based console.
 	ParamWebAddr = "web-addr"
+	// ParamTapCapacity is the name of parameter with the capacity of the tap used by the console preview command.
+	ParamTapCapacity = "tap-capacity"
+	// ParamBackendErrorLogInterval is the name of parameter with the interval identical backend errors are not logged for.
+	ParamBackendErrorLogInterval = "backend-error-log-interval"
+	// ParamDockerSocket is the name of parameter with the path of the socket of the Docker API used to add tags of
+	// containers.
+	ParamDockerSocket = "docker-socket"
+	// ParamDockerLabels is the name of parameter with the list of labels of containers added as tags.
+	ParamDockerLabels = "docker-labels"
+	// ParamHeartbeatName is the name of parameter with the name of the heartbeat metric.
+	ParamHeartbeatName = "heartbeat-name"
+	// ParamHeartbeatType is the name of parameter with the type of the heartbeat metric.
+	ParamHeartbeatType = "heartbeat-type"
+	// ParamHeartbeatValue is the name of parameter with the value of the heartbeat metric.
+	ParamHeartbeatValue = "heartbeat-value"
+	// ParamRuntimeMetrics is the name of parameter that enables Go runtime metrics of the server.
+	ParamRuntimeMetrics = "runtime-metrics"
+	// ParamRuntimeMetricsPrefix is the name of parameter with the prefix of the names of Go runtime metrics.
+	ParamRuntimeMetricsPrefix = "runtime-metrics-prefix"
+	// ParamRuntimeMetricsInterval is the name of parameter with the interval Go runtime metrics are collected at.
+	ParamRuntimeMetricsInterval = "runtime-metrics-interval"
+	// ParamInternSize is the name of parameter with the maximum number of distinct names and tags of received metrics
+	// deduplicated.
+	ParamInternSize = "intern-size"
+	// ParamMetricArenaSize is the name of parameter with the number of metrics of each packet allocated from an arena.
+	ParamMetricArenaSize = "metric-arena-size"
+	// ParamPinToCPU is the name of parameter with whether receivers and dispatcher workers are pinned to CPUs.
+	ParamPinToCPU = "pin-to-cpu"
+	// ParamMaxKeysPerSource is the name of parameter with the maximum number of distinct metric keys of each source.
+	ParamMaxKeysPerSource = "max-keys-per-source"
+	// ParamCardinalityLimit is the name of parameter with the maximum number of distinct metric keys.
+	ParamCardinalityLimit = "cardinality-limit"
+	// ParamPinCPUs is the name of parameter with the list of CPUs receivers and dispatcher workers are pinned to.
+	ParamPinCPUs = "pin-cpus"
+	// ParamHistogramBuckets is the name of parameter that enables parsing histogram buckets computed by clients.
+	ParamHistogramBuckets = "histogram-buckets"
+	// ParamDebugMetrics is the name of parameter that enables logging every parsed metric at debug level.
+	ParamDebugMetrics = "debug-metrics"
+	// ParamUntypedMetricType is the name of parameter with the type of metric lines without a type.
+	ParamUntypedMetricType = "untyped-metric-type"
+	// ParamHostTag is the name of parameter that enables adding the hostname of the server tag to flushed metrics.
+	ParamHostTag = "host-tag"
+	// ParamHostTagKey is the name of parameter with the key of the hostname of the server tag.
+	ParamHostTagKey = "host-tag-key"
+	// ParamHostTagValue is the name of parameter with the value of the hostname of the server tag.
+	ParamHostTagValue = "host-tag-value"
+	// ParamAuditLog is the name of parameter with the path of the audit log file.
+	ParamAuditLog = "audit-log"
+	// ParamWarmRestartSocket is the name of parameter with the path of the Unix socket used for warm restarts.
+	ParamWarmRestartSocket = "warm-restart-socket"
+	// ParamSnapshotPath is the name of parameter with the path of the BoltDB file snapshots are written to.
+	ParamSnapshotPath = "snapshot-path"
+	// ParamSnapshotInterval is the name of parameter with the interval of snapshots.
+	ParamSnapshotInterval = "snapshot-interval"
+	// ParamDropPrefixes is the name of parameter with the list of name prefixes of received metrics that are dropped.
+	ParamDropPrefixes = "drop-prefixes"
+	// ParamMaxMetricsPerSecond is the name of parameter with the maximum number of received metrics per second.
+	ParamMaxMetricsPerSecond = "max-metrics-per-second"
+	// ParamSignals is the name of parameter that enables flushing on SIGUSR1 and logging stats on SIGUSR2.
+	ParamSignals = "signals"
 )
 
 // Server encapsulates all of the parameters necessary for starting up
 // the statsd server. These can either be set via command line or directly.
 type Server struct {
-	Backends            []gostatsd.Backend
-	ConsoleAddr         string
-	CloudProvider       gostatsd.CloudProvider
-	Limiter             *rate.Limiter
-	DefaultTags         gostatsd.Tags
-	ExpiryInterval      time.Duration
-	FlushInterval       time.Duration
-	MaxReaders          int
-	MaxWorkers          int
-	MaxQueueSize        int
-	MaxConcurrentEvents int
-	MaxEventQueueSize   int
-	MetricsAddr         string
-	Namespace           string
-	PercentThreshold    []float64
-	WebConsoleAddr      string
-	Viper               *viper.Viper
+	Backends                []gostatsd.Backend
+	ConsoleAddr             string        // Address of the console, disabled if empty
+	DisableConsole          bool          // Whether to disable the console regardless of ConsoleAddr
+	ConsoleIdleTimeout      time.Duration // Time after which console connections without input are closed, none if 0
+	ConsoleCommandInterval  time.Duration // Minimum time between runs of an expensive console command, none if 0
+	ConsoleStateDir         string        // Directory of files exported and imported by the console, none if empty
+	GRPCAddr                string        // Address of the gRPC admin service, disabled if empty
+	HealthAddr              string        // Address of the health check endpoints, disabled if empty
+	CloudProvider           gostatsd.CloudProvider
+	Limiter                 *rate.Limiter
+	MaxCloudLookups         int          // Maximum number of cloud lookups in flight, unbounded if 0
+	CloudLookupPolicy       LookupPolicy // Applied to cloud lookups once MaxCloudLookups are in flight
+	DefaultTags             gostatsd.Tags
+	DefaultTagsEnv          []string // Names of environment variables added as tags, see EnvTags
+	ExpiryInterval          time.Duration
+	FlushInterval           time.Duration
+	MaxReaders              int
+	MaxWorkers              int
+	MaxQueueSize            int
+	DispatchKeyHash         KeyHash // Hash function mapping metric names to workers
+	MaxConcurrentEvents     int
+	MaxEventQueueSize       int
+	MetricsAddr             string
+	Namespace               string
+	PercentThreshold        []float64
+	PercentileTemplate      PercentileTemplate // Template of names of upper percentiles, DefaultPercentileTemplate if empty
+	WebConsoleAddr          string
+	TapCapacity             int
+	BackendErrorLogInterval time.Duration
+	HostTag                 bool   // Whether to add the hostname of the server tag to flushed metrics
+	HostTagKey              string // Key of the hostname of the server tag
+	HostTagValue            string // Value of the hostname of the server tag, os.Hostname() is used if empty
+	WarmRestartSocket       string // Path of the Unix socket used to hand off the state to the next process
+	Viper                   *viper.Viper
+	// NegativeCounters is the policy for counters with a negative value at the end of a flush interval.
+	NegativeCounters NegativeCounterPolicy
+	// ZeroFillCounters flushes counters not updated in a flush interval as 0 until they expire so that their
+	// series stay continuous. Otherwise they are only flushed in intervals in which they are updated.
+	ZeroFillCounters bool
+	// ZeroFillGauges flushes gauges not updated in a flush interval with their last value until they expire.
+	ZeroFillGauges bool
+	// SetMode is how sets store their values, SetsSketch estimates the number of distinct values with bounded memory.
+	SetMode SetMode
+	// ExactSets are the names of the sets stored exactly when SetMode is SetsSketch.
+	ExactSets []string
+	// TimerMode is how timers store their values, TimersDigest estimates percentiles with bounded memory.
+	TimerMode TimerMode
+	// TimerCompression is the compression of the digests of timers when TimerMode is TimersDigest,
+	// gostatsd.DefaultTDigestCompression if 0. Higher compression is more accurate and uses more memory.
+	TimerCompression float64
+	// ExpiryIntervals override ExpiryInterval for metrics of the types, e.g. to keep gauges longer than counters.
+	ExpiryIntervals map[gostatsd.MetricType]time.Duration
+	// DockerSocket is the path of the socket of the Docker API used to add tags of the containers of metrics and
+	// events with the ContainerIDTagKey tag, disabled if empty. See ContainerEnricher.
+	DockerSocket string
+	// DockerLabels are the labels of containers added as tags by the Docker API, see DockerResolver.
+	DockerLabels []string
+	// HistogramBuckets enables parsing tags of timers as histogram buckets computed by clients, e.g.
+	// #buckets:0-10:5,10-100:20,100+:3. Buckets are merged across samples. See gostatsd.HistogramBuckets.
+	HistogramBuckets bool
+	// UntypedMetricType is the type of metric lines without a type such as name:1, which are rejected if 0.
+	// See MetricReceiver.SetUntypedType.
+	UntypedMetricType gostatsd.MetricType
+	// DebugMetrics enables logging every parsed metric with its sample rate and tags if the log level is debug.
+	// See MetricReceiver.SetDebugMetrics.
+	DebugMetrics bool
+	// InternSize is the maximum number of distinct names and tags of received metrics deduplicated so that they are
+	// not allocated for each line, deduplication is disabled if 0. See MetricReceiver.SetInternSize.
+	InternSize int
+	// MetricArenaSize is the maximum number of metrics of each received packet allocated from a single arena, which
+	// is reused once they are aggregated, to reduce GC pressure at high throughput. Disabled if 0.
+	// See MetricReceiver.SetMetricArenaSize.
+	MetricArenaSize int
+	// MaxKeysPerSource is the maximum number of distinct metric keys of each source, unlimited if 0. Metrics with
+	// new keys from sources with too many keys are dropped. See SourceKeyLimiter.
+	MaxKeysPerSource int
+	// CardinalityLimit is the maximum number of distinct metric keys of all types and sources, unlimited if 0.
+	// Metrics with new keys are dropped once there are too many keys, existing keys are still updated. See
+	// cardinality.CardinalityTracker.
+	CardinalityLimit int
+	// PinToCPU locks each socket reader and dispatcher worker to an OS thread pinned to one of PinCPUs in turn,
+	// for cache locality on NUMA systems. Only supported on Linux. See CPUPinner.
+	PinToCPU bool
+	// PinCPUs are the CPUs goroutines are pinned to when PinToCPU is set, the CPUs available to the process if empty.
+	PinCPUs []int
+	// HeartbeatName is the name of a metric flushed every flush interval even if no metrics are received,
+	// disabled if empty. HeartbeatType is GAUGE or COUNTER, DefaultHeartbeatType if not set.
+	HeartbeatName  string
+	HeartbeatType  gostatsd.MetricType
+	HeartbeatValue float64
+	// RuntimeMetrics enables gauges with statistics of the Go runtime of the server named with
+	// RuntimeMetricsPrefix, collected every RuntimeMetricsInterval and flushed like received gauges.
+	RuntimeMetrics         bool
+	RuntimeMetricsPrefix   string
+	RuntimeMetricsInterval time.Duration
+	// CardinalityReport is how the numbers of distinct keys per metric type are reported every
+	// CardinalityReportEvery flushes, or on each flush if it is 0.
+	CardinalityReport      CardinalityReport
+	CardinalityReportEvery int
+	// PayloadBuckets are the upper bounds in bytes of buckets of histograms of sizes of payloads serialized by
+	// backends, DefaultPayloadBuckets if empty.
+	PayloadBuckets []int
+	// RenameRules rename received metrics before they are aggregated, the first matching rule is applied.
+	RenameRules RenameRules
+	// BackendFlushIntervals maps names of backends to their flush intervals, which must be multiples of
+	// FlushInterval. Backends without an interval are flushed every FlushInterval.
+	BackendFlushIntervals map[string]time.Duration
+	// BackendTimeouts maps names of backends to the maximum duration of a send of metrics, independent of the flush
+	// interval. Sends without a timeout are bounded by the context of the flush only.
+	BackendTimeouts map[string]time.Duration
+	// SkipEmptyFlushBackends are the names of backends that are not sent flushes without metrics. Other backends are
+	// sent the metrics of each aggregator on each flush, even if no metrics were received.
+	SkipEmptyFlushBackends []string
+	// BackendQueueSize is the number of flushes queued per backend so that slow backends do not delay flushes,
+	// queues are disabled if 0. BackendQueuePolicy is applied to flushes sent to a full queue.
+	BackendQueueSize   int
+	BackendQueuePolicy QueuePolicy
+	// ValuePrecision is the number of significant digits float values of metrics are rounded to, ties to even,
+	// before they are sent to backends. Values are sent with full precision if 0.
+	ValuePrecision int
+	// TenantMode is how the tenant of received metrics is determined, tenants are disabled if TenantModeNone.
+	// Metrics of each tenant are aggregated separately and flushed to the backends of the tenant, see Tenant.
+	// Metrics without a known tenant belong to DefaultTenant.
+	TenantMode    TenantMode
+	Tenants       []Tenant
+	DefaultTenant string
+	// FlushObservers are notified with flushed metrics on each flush. See FlushObserver.
+	FlushObservers       []FlushObserver
+	FlushObserverTimeout time.Duration
+	// MetricUpdates receives updates of aggregated metrics if set. See MetricBroadcaster.
+	MetricUpdates *MetricBroadcaster
+	// Credentials of the users allowed to use the console and the gRPC admin service, authentication is disabled if empty.
+	Credentials Credentials
+	// AuditLogWriter receives an AuditEvent for each state-mutating console command and gRPC call, disabled if nil.
+	AuditLogWriter io.Writer
+	// SnapshotPath is the path of the BoltDB file aggregated metrics are periodically written to, disabled if empty.
+	// A snapshot taken within the last flush interval is loaded on start. See package persistence/bolt.
+	SnapshotPath string
+	// SnapshotInterval is how often snapshots are written, 0 to disable. A snapshot is also written after each flush.
+	SnapshotInterval time.Duration
+	// MetricsSocket is the path of the Unix socket on which to listen for metrics, disabled if empty.
+	MetricsSocket string
+	// MetricsSocketFramed selects a stream socket receiving datagrams prefixed with their length like DogStatsD
+	// clients send them instead of a datagram socket. See FramedUnixReceiver.
+	MetricsSocketFramed bool
+	// QUICAddr is the UDP address on which to listen for metrics over QUIC, disabled if empty. See QUICReceiver.
+	QUICAddr string
+	// QUICTLSConfig is the TLS configuration of the QUIC receiver, it must contain a certificate.
+	QUICTLSConfig *tls.Config
+	// QUICMaxStreams is the maximum number of concurrent streams of each direction per QUIC connection.
+	QUICMaxStreams int
+	// Services are started with the components of the server once it is running. See Service.
+	Services []Service
+	// Tracer traces received packets and flushes if set. See package tracing/xray.
+	Tracer Tracer
+	// Leader elects the only server flushing metrics to backends among servers aggregating the same metrics if
+	// set, other servers aggregate metrics without flushing them. See package ha.
+	Leader Leader
+	// InternalMetricsClient sends internal metrics if set, e.g. to the server itself so that they are received like
+	// other metrics. Internal metrics are dispatched directly to the handler otherwise. See package client/statsd.
+	InternalMetricsClient MetricClient
+	// Cluster shards the aggregation of metrics between servers by name if set. See package cluster.
+	Cluster Cluster
+	// DropPrefixes are name prefixes of received metrics that are dropped before they are aggregated.
+	DropPrefixes []string
+	// MaxMetricsPerSecond is the maximum number of received metrics aggregated per second, unlimited if 0.
+	// Metrics exceeding it are dropped.
+	MaxMetricsPerSecond int
+	// Signals enables forcing a flush on SIGUSR1 and logging stats on SIGUSR2, e.g. for integration tests.
+	// Not supported on Windows.
+	Signals bool
+
+	mu         sync.RWMutex    // Protects dispatcher and dispCtx
+	dispatcher Dispatcher      // Dispatcher of the running server, nil if the server is not running
+	dispCtx    context.Context // Done when the dispatcher is about to be shut down
 }
 
+var errServerNotRunning = errors.New("server is not running")
+
 // NewServer will create a new Server with the default configuration.
 func NewServer() *Server {
 	return &Server{
-		ConsoleAddr:         DefaultConsoleAddr,
-		Limiter:             rate.NewLimiter(DefaultMaxCloudRequests, DefaultBurstCloudRequests),
-		DefaultTags:         DefaultTags,
-		ExpiryInterval:      DefaultExpiryInterval,
-		FlushInterval:       DefaultFlushInterval,
-		MaxReaders:          DefaultMaxReaders,
-		MaxWorkers:          DefaultMaxWorkers,
-		MaxQueueSize:        DefaultMaxQueueSize,
-		MaxConcurrentEvents: DefaultMaxConcurrentEvents,
-		MetricsAddr:         DefaultMetricsAddr,
-		PercentThreshold:    DefaultPercentThreshold,
-		WebConsoleAddr:      DefaultWebConsoleAddr,
-		Viper:               viper.New(),
+		ConsoleAddr:             DefaultConsoleAddr,
+		ConsoleIdleTimeout:      DefaultConsoleIdleTimeout,
+		ConsoleCommandInterval:  DefaultConsoleCommandInterval,
+		Limiter:                 rate.NewLimiter(DefaultMaxCloudRequests, DefaultBurstCloudRequests),
+		DefaultTags:             DefaultTags,
+		ExpiryInterval:          DefaultExpiryInterval,
+		ZeroFillCounters:        true,
+		ZeroFillGauges:          true,
+		InternSize:              DefaultInternSize,
+		RuntimeMetricsPrefix:    DefaultRuntimeMetricsPrefix,
+		RuntimeMetricsInterval:  DefaultRuntimeMetricsInterval,
+		FlushInterval:           DefaultFlushInterval,
+		MaxReaders:              DefaultMaxReaders,
+		MaxWorkers:              DefaultMaxWorkers,
+		MaxQueueSize:            DefaultMaxQueueSize,
+		MaxConcurrentEvents:     DefaultMaxConcurrentEvents,
+		MetricsAddr:             DefaultMetricsAddr,
+		QUICMaxStreams:          DefaultQUICMaxStreams,
+		PercentThreshold:        DefaultPercentThreshold,
+		PayloadBuckets:          DefaultPayloadBuckets,
+		WebConsoleAddr:          DefaultWebConsoleAddr,
+		TapCapacity:             DefaultTapCapacity,
+		BackendErrorLogInterval: DefaultBackendErrorLogInterval,
+		HostTagKey:              DefaultHostTagKey,
+		DefaultTenant:           DefaultTenant,
+		Viper:                   viper.New(),
+		FlushObserverTimeout:    DefaultFlushObserverTimeout,
 	}
 }
 
 // AddFlags adds flags to the specified FlagSet.
 func AddFlags(fs *pflag.FlagSet) {
 	fs.String(ParamConsoleAddr, DefaultConsoleAddr, "If set, use as the address of the telnet-based console")
+	fs.Bool(ParamDisableConsole, false, "Disable the telnet-based console")
+	fs.Duration(ParamConsoleIdleTimeout, DefaultConsoleIdleTimeout, "How long a console connection without input is kept open (0 to disable)")
+	fs.Duration(ParamConsoleCommandInterval, DefaultConsoleCommandInterval, "Minimum time between runs of an expensive console command, e.g. counters, by a connection (0 to disable)")
+	fs.String(ParamConsoleStateDir, "", "If set, directory of the files the export and import console commands write and read, files are neither exported nor imported if empty")
+	fs.String(ParamGRPCAddr, "", "If set, use as the address of the gRPC admin service")
+	fs.String(ParamHealthAddr, "", "If set, use as the address of the /health and /ready endpoints for load balancers")
 	fs.String(ParamCloudProvider, "", "If set, use the cloud provider to retrieve metadata about the sender")
 	fs.Duration(ParamExpiryInterval, DefaultExpiryInterval, "After how long do we expire metrics (0 to disable)")
+	fs.String(ParamExpiryIntervals, "", "Comma-separated list of type=interval pairs overriding the expiry interval of metric types, e.g. gauge=1h")
 	fs.Duration(ParamFlushInterval, DefaultFlushInterval, "How often to flush metrics to the backends")
+	fs.String(ParamNegativeCounters, NegativeCountersAllow.String(), "Policy for counters that are negative on flush: allow, clamp to zero or drop")
+	fs.Bool(ParamZeroFillCounters, true, "Whether counters not updated in a flush interval are flushed as 0 until they expire")
+	fs.Bool(ParamZeroFillGauges, true, "Whether gauges not updated in a flush interval are flushed with their last value until they expire")
+	fs.String(ParamSetMode, SetsExact.String(), "How sets store their values: exact, or sketch to estimate the number of distinct values with bounded memory")
+	fs.String(ParamExactSets, "", "Comma-separated list of names of sets stored exactly when the set mode is sketch")
+	fs.String(ParamTimerMode, TimersExact.String(), "How timers store their values: exact, or digest to estimate percentiles with bounded memory")
+	fs.Float64(ParamTimerCompression, gostatsd.DefaultTDigestCompression, "Compression of the digests of timers when the timer mode is digest, higher is more accurate and uses more memory")
+	fs.String(ParamCardinalityReport, CardinalityReportNone.String(), "How to report numbers of distinct, new and expired metric keys per type on flush: none, log or metrics")
+	fs.Int(ParamCardinalityReportEvery, 1, "Number of flushes between cardinality reports")
+	fs.String(ParamPayloadBuckets, strings.Join(intsToStringSlice(DefaultPayloadBuckets), ","), "Comma-separated list of upper bounds in bytes of buckets of histograms of backend payload sizes")
+	fs.String(ParamBackendFlushIntervals, "", "Comma-separated list of backend=interval pairs of backends flushed less often, intervals must be multiples of the flush interval")
+	fs.String(ParamBackendTimeouts, "", "Comma-separated list of backend=timeout pairs bounding sends of metrics to backends, e.g. graphite=5s")
+	fs.Int(ParamBackendQueueSize, 0, "Number of flushes queued per backend so that slow backends do not delay flushes, 0 to send directly")
+	fs.String(ParamBackendQueuePolicy, QueueDropOldest.String(), "Policy for flushes sent to a full backend queue: drop-oldest, drop-newest or block")
+	fs.String(ParamSkipEmptyFlushBackends, "", "Comma-separated list of backends that are not sent flushes without metrics")
+	fs.Int(ParamValuePrecision, 0, "Number of significant digits float values are rounded to before they are sent to backends, 0 for full precision")
+	fs.String(ParamTenantMode, TenantModeNone.String(), "How the tenant of received metrics is determined: none, name for the leading token of the name, or tag for the tenant tag")
+	fs.String(ParamDefaultTenant, DefaultTenant, "Tenant of metrics without a tenant configured in the tenants section")
 	fs.Int(ParamMaxReaders, DefaultMaxReaders, "Maximum number of socket readers")
 	fs.Int(ParamMaxWorkers, DefaultMaxWorkers, "Maximum number of workers to process metrics")
 	fs.Int(ParamMaxQueueSize, DefaultMaxQueueSize, "Maximum number of buffered metrics per worker")
+	fs.String(ParamDispatchKeyHash, KeyHashAdler32.String(), "Hash function mapping metric names to workers: adler32, fnv, xxhash or maphash")
 	fs.Int(ParamMaxConcurrentEvents, DefaultMaxConcurrentEvents, "Maximum number of events sent concurrently")
 	fs.String(ParamMetricsAddr, DefaultMetricsAddr, "Address on which to listen for metrics")
+	fs.String(ParamMetricsSocket, "", "If set, path of the Unix socket on which to listen for metrics, e.g. /var/run/gostatsd.sock")
+	fs.Bool(ParamMetricsSocketFramed, false, "Whether the Unix socket is a stream socket receiving datagrams prefixed with their length, like DogStatsD clients send them")
+	fs.String(ParamQUICAddr, "", "If set, use as the UDP address on which to listen for metrics over QUIC")
+	fs.String(ParamQUICCertFile, "", "Path of the TLS certificate of the QUIC receiver")
+	fs.String(ParamQUICKeyFile, "", "Path of the TLS key of the QUIC receiver")
+	fs.Int(ParamQUICMaxStreams, DefaultQUICMaxStreams, "Maximum number of concurrent streams per QUIC connection")
 	fs.String(ParamNamespace, "", "Namespace all metrics")
 	fs.String(ParamWebAddr, DefaultWebConsoleAddr, "If set, use as the address of the web-based console")
+	fs.Int(ParamTapCapacity, DefaultTapCapacity, "Maximum number of metrics sampled by the console preview command")
+	fs.String(ParamDockerSocket, "", "If set, path of the Docker API socket used to add tags of containers of metrics with a container ID, e.g. /var/run/docker.sock")
+	fs.String(ParamDockerLabels, "", "Comma-separated list of labels of containers added as tags by the Docker API")
+	fs.String(ParamHeartbeatName, "", "If set, name of a metric flushed every flush interval even if no metrics are received")
+	fs.String(ParamHeartbeatType, DefaultHeartbeatType.String(), "Type of the heartbeat metric: gauge or counter")
+	fs.Float64(ParamHeartbeatValue, DefaultHeartbeatValue, "Value of the heartbeat metric")
+	fs.Bool(ParamRuntimeMetrics, false, "Flush gauges with statistics of the Go runtime of the server, such as heap size and GC pauses")
+	fs.String(ParamRuntimeMetricsPrefix, DefaultRuntimeMetricsPrefix, "Prefix of the names of Go runtime metrics")
+	fs.Duration(ParamRuntimeMetricsInterval, DefaultRuntimeMetricsInterval, "How often Go runtime metrics are collected")
+	fs.Int(ParamInternSize, DefaultInternSize, "Maximum number of distinct names and tags of received metrics deduplicated to save memory (0 to disable)")
+	fs.Int(ParamMetricArenaSize, 0, "Number of metrics of each received packet allocated from a single reused buffer to reduce GC pressure (0 to disable)")
+	fs.Int(ParamMaxKeysPerSource, 0, "Maximum number of distinct metric keys of each source, new keys from sources with more are dropped (0 for unlimited)")
+	fs.Int(ParamCardinalityLimit, 0, "Maximum number of distinct metric keys, new keys are dropped once there are more (0 for unlimited)")
+	fs.Bool(ParamPinToCPU, false, "Pin socket readers and dispatcher workers to CPUs in turn (Linux only)")
+	fs.String(ParamPinCPUs, "", "Comma-separated list of CPUs readers and workers are pinned to, all available CPUs if empty")
+	fs.Bool(ParamHistogramBuckets, false, "Parse tags of timers such as buckets:0-10:5,10-100:20,100+:3 as histogram buckets computed by clients")
+	fs.Bool(ParamDebugMetrics, false, "Log every parsed metric at debug level, i.e. if verbose")
+	fs.String(ParamUntypedMetricType, "", "Type of metric lines without a type: counter, gauge, timer or set, rejected if empty")
+	fs.Bool(ParamHostTag, false, "Add a tag with the hostname of the server to all flushed metrics")
+	fs.String(ParamHostTagKey, DefaultHostTagKey, "Key of the tag with the hostname of the server")
+	fs.String(ParamHostTagValue, "", "Value of the tag with the hostname of the server. Hostname is used if not set")
+	fs.String(ParamAuditLog, "", "If set, path of the file state-mutating console, API and gRPC operations are logged to")
+	fs.String(ParamWarmRestartSocket, "", "If set, path of the Unix socket used to receive metrics state from the previous process and hand it off to the next one")
+	fs.String(ParamSnapshotPath, "", "If set, path of the BoltDB file metrics are periodically written to and recovered from after a crash")
+	fs.Duration(ParamSnapshotInterval, DefaultSnapshotInterval, "How often to write snapshots of metrics to the snapshot path in addition to after each flush (0 to disable)")
+	fs.String(ParamDropPrefixes, "", "Comma-separated list of name prefixes of received metrics that are dropped")
+	fs.Int(ParamMaxMetricsPerSecond, 0, "Maximum number of received metrics aggregated per second, metrics exceeding it are dropped (0 to disable)")
+	fs.Bool(ParamSignals, false, "Force a flush on SIGUSR1 and log stats on SIGUSR2")
+	fs.Duration(ParamBackendErrorLogInterval, DefaultBackendErrorLogInterval, "How long to suppress identical backend errors in logs for (0 to log all errors)")
 	//TODO Remove workaround when https://github.com/spf13/viper/issues/112 is fixed
 	// https://github.com/spf13/viper/issues/200
 	fs.String(ParamBackends, strings.Join(DefaultBackends, ","), "Comma-separated list of backends")
 	fs.Int(ParamMaxCloudRequests, DefaultMaxCloudRequests, "Maximum number of cloud provider requests per second")
 	fs.Int(ParamBurstCloudRequests, DefaultBurstCloudRequests, "Burst number of cloud provider requests per second")
+	fs.Int(ParamMaxConcurrentCloudLookups, 0, "Maximum number of cloud provider lookups in flight, unbounded if 0")
+	fs.String(ParamCloudLookupPolicy, LookupQueue.String(), "Policy for cloud provider lookups once the maximum number is in flight: queue or drop")
 	fs.String(ParamDefaultTags, strings.Join(DefaultTags, ","), "Comma-separated list of tags to add to all metrics")
+	fs.String(ParamDefaultTagsEnv, "", "Comma-separated list of environment variables to add as tags to all metrics")
 	fs.String(ParamPercentThreshold, strings.Join(toStringSlice(DefaultPercentThreshold), ","), "Comma-separated list of percentiles")
+	fs.String(ParamPercentileTemplate, string(DefaultPercentileTemplate), "Template of names of upper percentiles of timers, {pct} is replaced by the percentile and {pct_int} by its integer part")
 }
 
 // Run runs the server until context signals done.
@@ -161,6 +561,9 @@ type SocketFactory func() (net.PacketConn, error)
 // RunWithCustomSocket runs the server until context signals done.
 // Listening socket is created using sf.
 func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
 	// 0. Start runnable backends
 	var wgBackends sync.WaitGroup
 	defer wgBackends.Wait()                                         // Wait for backends to shutdown
@@ -179,11 +582,37 @@ func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) erro
 	}
 
 	// 1. Start the Dispatcher
+	var keyLimiter *SourceKeyLimiter
+	if s.MaxKeysPerSource > 0 {
+		keyLimiter = NewSourceKeyLimiter(s.MaxKeysPerSource)
+	}
+	cardinalityTracker := cardinality.NewCardinalityTracker(s.CardinalityLimit)
 	factory := agrFactory{
-		percentThresholds: s.PercentThreshold,
-		expiryInterval:    s.ExpiryInterval,
+		percentThresholds:       s.PercentThreshold,
+		percentileTemplate:      s.PercentileTemplate,
+		expiryInterval:          s.ExpiryInterval,
+		expiryIntervals:         s.ExpiryIntervals,
+		negativeCounters:        s.NegativeCounters,
+		disableZeroFillCounters: !s.ZeroFillCounters,
+		disableZeroFillGauges:   !s.ZeroFillGauges,
+		setMode:                 s.SetMode,
+		exactSets:               s.ExactSets,
+		timerMode:               s.TimerMode,
+		timerCompression:        s.TimerCompression,
+		broadcaster:             s.MetricUpdates,
+		keyLimiter:              keyLimiter,
+		cardinalityTracker:      cardinalityTracker,
 	}
 	dispatcher := NewMetricDispatcher(s.MaxWorkers, s.MaxQueueSize, &factory)
+	dispatcher.SetKeyHash(s.DispatchKeyHash)
+	var pinner *CPUPinner
+	if s.PinToCPU {
+		var err error
+		if pinner, err = NewCPUPinner(s.PinCPUs); err != nil {
+			return err
+		}
+		dispatcher.SetCPUPinner(pinner)
+	}
 
 	var wgDispatcher sync.WaitGroup
 	defer wgDispatcher.Wait()                                       // Wait for dispatcher to shutdown
@@ -196,15 +625,33 @@ func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) erro
 			log.Panicf("Dispatcher quit unexpectedly: %v", dispErr)
 		}
 	}()
+	ctxSnapshot, cancelSnapshot := context.WithCancel(context.Background())
+	s.setDispatcher(ctxSnapshot, dispatcher)
+	defer func() {
+		// Must happen before the dispatcher is shut down to unblock in-flight Snapshot calls
+		s.setDispatcher(nil, nil)
+		cancelSnapshot()
+	}()
 
 	// 2. Start handlers
 	ip := gostatsd.UnknownIP
 
 	var handler Handler
-	handler = NewDispatchingHandler(dispatcher, s.Backends, s.DefaultTags, uint(s.MaxConcurrentEvents))
+	var cloudHandler *CloudHandler
+	tags := make(gostatsd.Tags, 0, len(s.DefaultTags)+len(s.DefaultTagsEnv))
+	tags = append(tags, s.DefaultTags...)
+	tags = append(tags, EnvTags(s.DefaultTagsEnv)...)
+	dh := NewDispatchingHandler(dispatcher, s.Backends, tags, uint(s.MaxConcurrentEvents))
+	metricSink := s.metricSink(dispatcher, tags)
+	dh.SetMetricSink(metricSink)
+	handler = dh
 	if s.CloudProvider != nil {
 		ch := NewCloudHandler(s.CloudProvider, handler, s.Limiter, nil)
+		if err := ch.SetMaxConcurrentLookups(s.MaxCloudLookups, s.CloudLookupPolicy); err != nil {
+			return err
+		}
 		handler = ch
+		cloudHandler = ch
 		var wgCloudHandler sync.WaitGroup
 		defer wgCloudHandler.Wait()                                           // Wait for handler to shutdown
 		ctxHandler, cancelHandler := context.WithCancel(context.Background()) // Separate context!
@@ -224,7 +671,39 @@ func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) erro
 		}
 	}
 
-	// 3. Start the Receiver
+	if s.DockerSocket != "" {
+		handler = NewContainerEnricher(NewDockerResolver(s.DockerSocket, s.DockerLabels), handler)
+	}
+
+	if s.TenantMode != TenantModeNone {
+		th, err := NewTenantHandler(handler, s.TenantMode, s.Tenants, s.DefaultTenant)
+		if err != nil {
+			return err
+		}
+		handler = th
+	}
+
+	// 3. Receive the state from the previous process before the socket is opened.
+	// The previous process closes its socket before sending the state.
+	// A recent snapshot is only restored if there is no previous process, e.g. after a crash.
+	var warmStarted bool
+	if s.WarmRestartSocket != "" {
+		warmStarted = s.warmStart(ctx, dispatcher)
+	}
+	if s.SnapshotPath != "" && !warmStarted {
+		s.restoreSnapshot(ctx, dispatcher)
+	}
+
+	// Health checks are served until all components below are stopped so that readiness reports the shutdown
+	health := &HealthServer{Addr: s.HealthAddr}
+	ctxHealth, cancelHealth := context.WithCancel(context.Background())
+	defer cancelHealth()
+
+	// Components below are stopped using ctxRun when the state is handed off to the next process
+	ctxRun, cancelRun := context.WithCancel(ctx)
+	defer cancelRun()
+
+	// 4. Start the Receiver
 	var wgReceiver sync.WaitGroup
 	defer wgReceiver.Wait() // Wait for all receivers to finish
 
@@ -233,54 +712,377 @@ func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) erro
 	if err != nil {
 		return err
 	}
-	defer func() {
-		// This makes receivers error out and stop
-		if e := c.Close(); e != nil {
-			log.Warnf("Error closing socket: %v", e)
-		}
-	}()
+	health.SetListening(true)
+	var closeOnce sync.Once
+	closeSocket := func() {
+		closeOnce.Do(func() {
+			health.SetListening(false)
+			// This makes receivers error out and stop
+			if e := c.Close(); e != nil {
+				log.Warnf("Error closing socket: %v", e)
+			}
+		})
+	}
+	defer closeSocket()
 
 	receiver := NewMetricReceiver(s.Namespace, handler)
+	receiver.SetRenameRules(s.RenameRules)
+	receiver.SetHistogramBuckets(s.HistogramBuckets)
+	receiver.SetUntypedType(s.UntypedMetricType)
+	receiver.SetDebugMetrics(s.DebugMetrics)
+	receiver.SetInternSize(s.InternSize)
+	receiver.SetMetricArenaSize(s.MetricArenaSize)
+	if s.Tracer != nil {
+		receiver.SetTracer(s.Tracer)
+	}
 	wgReceiver.Add(s.MaxReaders)
 	for r := 0; r < s.MaxReaders; r++ {
 		go func() {
 			defer wgReceiver.Done()
-			if e := receiver.Receive(ctx, c); unexpectedErr(e) {
+			pinner.pin("receiver")
+			if e := receiver.Receive(ctxRun, c); unexpectedErr(e) {
 				log.Panicf("Receiver quit unexpectedly: %v", e)
 			}
 		}()
 	}
+	if s.MetricsSocket != "" {
+		if err := s.receiveUnix(ctxRun, &wgReceiver, receiver); err != nil {
+			return err
+		}
+	}
+	if s.QUICAddr != "" {
+		quicReceiver := NewQUICReceiver(receiver, s.QUICTLSConfig, s.QUICMaxStreams)
+		wgReceiver.Add(1)
+		go func() {
+			defer wgReceiver.Done()
+			if e := quicReceiver.ListenAndServe(ctxRun, s.QUICAddr); unexpectedErr(e) {
+				log.Errorf("QUIC receiver failed: %v", e)
+			}
+		}()
+	}
 
-	// 4. Start the Flusher
+	// 5. Start the Flusher
 	hostname := getHost()
 	flusher := NewMetricFlusher(s.FlushInterval, dispatcher, receiver, handler, s.Backends, ip, hostname)
+	flusher.SetFlushObservers(s.FlushObserverTimeout, s.FlushObservers...)
+	flusher.SetErrorLogInterval(s.BackendErrorLogInterval)
+	cardinalityReportEvery := s.CardinalityReportEvery
+	if cardinalityReportEvery == 0 {
+		cardinalityReportEvery = 1
+	}
+	if err := flusher.SetCardinalityReport(s.CardinalityReport, cardinalityReportEvery); err != nil {
+		return err
+	}
+	flusher.SetCardinalityTracker(cardinalityTracker)
+	if s.Tracer != nil {
+		flusher.SetTracer(s.Tracer)
+	}
+	if len(s.PayloadBuckets) > 0 {
+		if err := flusher.SetPayloadBuckets(s.PayloadBuckets); err != nil {
+			return err
+		}
+	}
+	if s.SnapshotPath != "" {
+		snapshots := newSnapshotter(s.SnapshotPath, s.SnapshotInterval, dispatcher)
+		flusher.SetAfterFlush(snapshots.flushed)
+		var wgSnapshotter sync.WaitGroup
+		defer wgSnapshotter.Wait() // Wait for the last snapshot before the dispatcher is shut down
+		wgSnapshotter.Add(1)
+		go func() {
+			defer wgSnapshotter.Done()
+			if err := snapshots.Run(ctxRun); unexpectedErr(err) {
+				log.Errorf("Snapshotter quit unexpectedly: %v", err)
+			}
+		}()
+	}
+	flusher.SetPercentileTemplate(s.PercentileTemplate)
+	if err := flusher.SetBackendFlushIntervals(s.BackendFlushIntervals, s.PercentThreshold); err != nil {
+		return err
+	}
+	if err := flusher.SetBackendTimeouts(s.BackendTimeouts); err != nil {
+		return err
+	}
+	if len(s.SkipEmptyFlushBackends) > 0 {
+		if err := flusher.SetSkipEmptyFlushes(s.SkipEmptyFlushBackends); err != nil {
+			return err
+		}
+	}
+	if s.ValuePrecision != 0 {
+		if err := flusher.SetValuePrecision(s.ValuePrecision); err != nil {
+			return err
+		}
+	}
+	if s.BackendQueueSize > 0 {
+		if err := flusher.SetBackendQueues(s.BackendQueueSize, s.BackendQueuePolicy); err != nil {
+			return err
+		}
+	}
+	if s.TenantMode != TenantModeNone {
+		if err := flusher.SetTenants(s.Tenants, s.DefaultTenant); err != nil {
+			return err
+		}
+	}
+	if s.HeartbeatName != "" {
+		heartbeatType := s.HeartbeatType
+		if heartbeatType == 0 {
+			heartbeatType = DefaultHeartbeatType
+		}
+		flusher.SetHeartbeat(s.HeartbeatName, heartbeatType, s.HeartbeatValue)
+	}
+	if s.RuntimeMetrics {
+		flusher.SetRuntimeMetrics(s.RuntimeMetricsPrefix, s.RuntimeMetricsInterval)
+	}
+	if s.Leader != nil {
+		flusher.SetLeader(s.Leader)
+	}
+	if s.Cluster != nil {
+		flusher.SetCluster(s.Cluster)
+	}
+	if s.InternalMetricsClient != nil {
+		flusher.SetMetricClient(s.InternalMetricsClient)
+	}
+	if s.HostTag {
+		hostTagValue := s.HostTagValue
+		if hostTagValue == "" {
+			hostTagValue = hostname
+		}
+		flusher.SetHostTag(s.HostTagKey + ":" + hostTagValue)
+	}
 	var wgFlusher sync.WaitGroup
-	defer wgFlusher.Wait() // Wait for the Flusher to finish
+	defer wgFlusher.Wait() // Wait for the Flusher, the Leader and the Cluster to finish
+	if s.Cluster != nil {
+		wgFlusher.Add(1)
+		go func() {
+			defer wgFlusher.Done()
+			if err := s.Cluster.Run(ctxRun); unexpectedErr(err) {
+				log.Panicf("Cluster quit unexpectedly: %v", err)
+			}
+		}()
+	}
+	if s.Leader != nil {
+		wgFlusher.Add(1)
+		go func() {
+			defer wgFlusher.Done()
+			if err := s.Leader.Run(ctxRun); unexpectedErr(err) {
+				log.Panicf("Leader election quit unexpectedly: %v", err)
+			}
+		}()
+	}
 	wgFlusher.Add(1)
 	go func() {
 		defer wgFlusher.Done()
-		if err := flusher.Run(ctx); unexpectedErr(err) {
+		if err := flusher.Run(ctxRun); unexpectedErr(err) {
 			log.Panicf("Flusher quit unexpectedly: %v", err)
 		}
 	}()
 
-	// 5. Start the console(s)
-	if s.ConsoleAddr != "" {
-		console := ConsoleServer{s.ConsoleAddr, receiver, dispatcher, flusher}
-		go console.ListenAndServe(ctx)
+	if s.HealthAddr != "" {
+		health.Receiver = receiver
+		health.Flusher = flusher
+		go func() {
+			if err := health.ListenAndServe(ctxHealth); unexpectedErr(err) {
+				log.Errorf("Health server failed: %v", err)
+			}
+		}()
+	}
+
+	// 6. Start the console(s)
+	if s.ConsoleAddr == "" || s.DisableConsole {
+		log.Info("Console is disabled")
+	} else {
+		console := ConsoleServer{
+			Addr:             s.ConsoleAddr,
+			Receiver:         receiver,
+			Dispatcher:       dispatcher,
+			Flusher:          flusher,
+			TapCapacity:      s.TapCapacity,
+			IdleTimeout:      s.ConsoleIdleTimeout,
+			CommandInterval:  s.ConsoleCommandInterval,
+			NegativeCounters: s.NegativeCounters,
+			Credentials:      s.Credentials,
+			AuditLogWriter:   s.AuditLogWriter,
+			SourceKeys:       keyLimiter,
+			Cardinality:      cardinalityTracker,
+			CloudLookups:     cloudHandler,
+			StateDir:         s.ConsoleStateDir,
+			MetricSink:       metricSink,
+		}
+		go console.ListenAndServe(ctxRun)
+	}
+	if s.GRPCAddr != "" {
+		grpcServer := GRPCServer{
+			Addr:           s.GRPCAddr,
+			Receiver:       receiver,
+			Dispatcher:     dispatcher,
+			Flusher:        flusher,
+			Credentials:    s.Credentials,
+			AuditLogWriter: s.AuditLogWriter,
+		}
+		go func() {
+			if err := grpcServer.ListenAndServe(ctxRun); unexpectedErr(err) {
+				log.Errorf("gRPC server failed: %v", err)
+			}
+		}()
+	}
+	for _, service := range s.Services {
+		go func(service Service) {
+			if err := service(ctxRun, receiver, dispatcher, flusher); unexpectedErr(err) {
+				log.Errorf("Service failed: %v", err)
+			}
+		}(service)
+	}
+	if s.Signals {
+		notifySignals(ctxRun, receiver, flusher)
 	}
 	//if s.WebConsoleAddr != "" {
 	//	console := WebConsoleServer{s.WebConsoleAddr, aggregator}
 	//	go console.ListenAndServe()
 	//}
 
-	// 6. Send events on start and on stop
+	// 7. Send events on start and on stop
 	defer sendStopEvent(handler, ip, hostname)
-	sendStartEvent(ctx, handler, ip, hostname)
+	sendStartEvent(ctxRun, handler, ip, hostname)
+
+	// 8. Listen for the next process to hand off the state to
+	var handoff chan *net.UnixConn
+	if s.WarmRestartSocket != "" {
+		l, err := listenWarmRestart(s.WarmRestartSocket)
+		if err != nil {
+			return err
+		}
+		handoff = make(chan *net.UnixConn)
+		go acceptWarmRestart(ctxRun, l, handoff)
+	}
+
+	// 9. Listen until done or until the state is handed off
+	select {
+	case <-ctx.Done():
+		health.SetShuttingDown()
+		return ctx.Err()
+	case conn := <-handoff:
+		health.SetShuttingDown()
+		defer conn.Close()
+		// Stop receiving and flushing metrics, the dispatcher keeps running to take the snapshot
+		cancelRun()
+		closeSocket()
+		wgReceiver.Wait()
+		wgFlusher.Wait()
+		return s.handOff(conn, dispatcher)
+	}
+}
+
+// metricSink returns the pipeline of received metrics: metrics of dropped prefixes are filtered out, metrics
+// exceeding the rate are dropped, then the others are tagged and dispatched.
+func (s *Server) metricSink(dispatcher Dispatcher, tags gostatsd.Tags) MetricSink {
+	var sink MetricSink = NewEnrichSink(tags, NewDispatchSink(dispatcher))
+	if s.MaxMetricsPerSecond > 0 {
+		sink = NewRateLimitSink(rate.NewLimiter(rate.Limit(s.MaxMetricsPerSecond), s.MaxMetricsPerSecond), sink)
+	}
+	if len(s.DropPrefixes) > 0 {
+		sink = NewFilterSink(DropPrefixes(s.DropPrefixes), sink)
+	}
+	return sink
+}
+
+// warmStart receives the state from the previous process and seeds the dispatcher with it.
+// Errors are logged because the server can still start without the state. Returns whether the state was received.
+func (s *Server) warmStart(ctx context.Context, dispatcher Dispatcher) bool {
+	m, err := receiveWarmRestartState(ctx, s.WarmRestartSocket, s.FlushInterval)
+	if err != nil {
+		log.Warnf("Failed to receive state from the previous process: %v", err)
+		return false
+	}
+	if m == nil {
+		return false
+	}
+	n, err := SeedMetricState(ctx, dispatcher, m)
+	if err != nil {
+		log.Warnf("Failed to import state from the previous process: %v", err)
+		return true // Partially imported
+	}
+	log.Infof("Imported %d metrics from the previous process", n)
+	return true
+}
+
+// receiveUnix starts receiving metrics on the Unix socket until the context is done.
+func (s *Server) receiveUnix(ctx context.Context, wg *sync.WaitGroup, receiver *MetricReceiver) error {
+	if s.MetricsSocketFramed {
+		framedReceiver := NewFramedUnixReceiver(receiver)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if e := framedReceiver.ListenAndServe(ctx, s.MetricsSocket); unexpectedErr(e) {
+				log.Errorf("Unix socket receiver failed: %v", e)
+			}
+		}()
+		return nil
+	}
+	c, err := ListenUnixgram(s.MetricsSocket)
+	if err != nil {
+		return err
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		c.Close() // #nosec Makes the receiver stop
+	}()
+	go func() {
+		defer wg.Done()
+		if e := receiver.Receive(ctx, c); unexpectedErr(e) {
+			log.Errorf("Unix socket receiver failed: %v", e)
+		}
+	}()
+	return nil
+}
+
+// handOff sends the state of the dispatcher to the next process.
+// Must be called after receivers have been stopped.
+func (s *Server) handOff(conn *net.UnixConn, dispatcher Dispatcher) error {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), s.FlushInterval)
+	defer cancelFunc()
+	m, err := Snapshot(ctx, dispatcher)
+	if err != nil {
+		return fmt.Errorf("failed to take snapshot for the next process: %v", err)
+	}
+	if err = sendWarmRestartState(conn, m, s.FlushInterval); err != nil {
+		return fmt.Errorf("failed to send state to the next process: %v", err)
+	}
+	log.Info("Handed off state to the next process")
+	return nil
+}
+
+// Snapshot returns a point-in-time copy of all metrics aggregated by the running server.
+// See Snapshot function for details. An error is returned if the server is not running.
+func (s *Server) Snapshot(ctx context.Context) (*gostatsd.MetricMap, error) {
+	s.mu.RLock()
+	dispatcher := s.dispatcher
+	dispCtx := s.dispCtx
+	s.mu.RUnlock()
+	if dispatcher == nil {
+		return nil, errServerNotRunning
+	}
+	ctx, cancelFunc := context.WithCancel(ctx)
+	defer cancelFunc()
+	go func() {
+		select {
+		case <-dispCtx.Done():
+			cancelFunc() // Server is shutting down
+		case <-ctx.Done():
+		}
+	}()
+	snapshot, err := Snapshot(ctx, dispatcher)
+	if err != nil && dispCtx.Err() != nil {
+		return nil, errServerNotRunning
+	}
+	return snapshot, err
+}
 
-	// 7. Listen until done
-	<-ctx.Done()
-	return ctx.Err()
+func (s *Server) setDispatcher(ctx context.Context, dispatcher Dispatcher) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dispCtx = ctx
+	s.dispatcher = dispatcher
 }
 
 func sendStartEvent(ctx context.Context, handler Handler, selfIP gostatsd.IP, hostname string) {
@@ -324,12 +1126,44 @@ func getHost() string {
 }
 
 type agrFactory struct {
-	percentThresholds []float64
-	expiryInterval    time.Duration
+	percentThresholds       []float64
+	percentileTemplate      PercentileTemplate
+	expiryInterval          time.Duration
+	expiryIntervals         map[gostatsd.MetricType]time.Duration
+	negativeCounters        NegativeCounterPolicy
+	disableZeroFillCounters bool
+	disableZeroFillGauges   bool
+	setMode                 SetMode
+	exactSets               []string
+	timerMode               TimerMode
+	timerCompression        float64
+	broadcaster             *MetricBroadcaster
+	keyLimiter              *SourceKeyLimiter
+	cardinalityTracker      *cardinality.CardinalityTracker
 }
 
 func (af *agrFactory) Create() Aggregator {
-	return NewMetricAggregator(af.percentThresholds, af.expiryInterval)
+	a := NewMetricAggregator(af.percentThresholds, af.expiryInterval)
+	a.SetPercentileTemplate(af.percentileTemplate)
+	a.SetExpiryIntervals(af.expiryIntervals)
+	a.negativeCounters = af.negativeCounters
+	a.disableZeroFillCounters = af.disableZeroFillCounters
+	a.disableZeroFillGauges = af.disableZeroFillGauges
+	a.setMode = af.setMode
+	a.exactSets = make(map[string]bool, len(af.exactSets))
+	for _, name := range af.exactSets {
+		a.exactSets[name] = true
+	}
+	a.timerMode = af.timerMode
+	a.timerCompression = af.timerCompression
+	a.broadcaster = af.broadcaster
+	if af.keyLimiter != nil {
+		a.SetSourceKeyLimiter(af.keyLimiter)
+	}
+	if af.cardinalityTracker != nil {
+		a.SetCardinalityTracker(af.cardinalityTracker)
+	}
+	return a
 }
 
 func toStringSlice(fs []float64) []string {
@@ -340,6 +1174,30 @@ func toStringSlice(fs []float64) []string {
 	return s
 }
 
+func intsToStringSlice(is []int) []string {
+	s := make([]string, len(is))
+	for i, n := range is {
+		s[i] = strconv.Itoa(n)
+	}
+	return s
+}
+
+// EnvTags returns a tag for each of the named environment variables.
+// The key of the tag is the lowercase name of the variable, e.g. POD_NAME=web-1 becomes pod_name:web-1.
+// Variables that are not set or empty are skipped.
+func EnvTags(names []string) gostatsd.Tags {
+	tags := make(gostatsd.Tags, 0, len(names))
+	for _, name := range names {
+		value := os.Getenv(name)
+		if value == "" {
+			log.Warnf("Environment variable %s is not set, not adding it as a tag", name)
+			continue
+		}
+		tags = append(tags, strings.ToLower(name)+":"+value)
+	}
+	return tags
+}
+
 func unexpectedErr(err error) bool {
 	return err != nil && err != context.Canceled && err != context.DeadlineExceeded
 }
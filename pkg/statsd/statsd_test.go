@@ -3,7 +3,10 @@ package statsd
 import (
 	"context"
 	"math/rand"
+	"net"
+	"os"
 	"runtime"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -12,6 +15,8 @@ import (
 	"github.com/atlassian/gostatsd/pkg/fakesocket"
 
 	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/time/rate"
 )
 
@@ -100,3 +105,86 @@ func (fp *fakeProvider) Instance(ctx context.Context, IP gostatsd.IP) (*gostatsd
 func (fp *fakeProvider) SelfIP() (gostatsd.IP, error) {
 	return gostatsd.UnknownIP, nil
 }
+
+func TestEnvTags(t *testing.T) {
+	require.NoError(t, os.Setenv("GOSTATSD_TEST_POD_NAME", "web-1"))
+	require.NoError(t, os.Setenv("GOSTATSD_TEST_NODE_NAME", "node-2"))
+	defer os.Unsetenv("GOSTATSD_TEST_POD_NAME")  // #nosec
+	defer os.Unsetenv("GOSTATSD_TEST_NODE_NAME") // #nosec
+
+	var lock sync.Mutex
+	var tags gostatsd.Tags
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+	s := NewServer()
+	s.DefaultTags = gostatsd.Tags{"env:test"}
+	s.DefaultTagsEnv = []string{"GOSTATSD_TEST_POD_NAME", "GOSTATSD_TEST_MISSING", "GOSTATSD_TEST_NODE_NAME"}
+	s.ConsoleAddr = ""
+	s.WebConsoleAddr = ""
+	s.FlushInterval = 10 * time.Millisecond
+	s.FlushObservers = []FlushObserver{func(ctx context.Context, m *gostatsd.MetricMap) {
+		m.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+			lock.Lock()
+			defer lock.Unlock()
+			tags = counter.Tags
+			cancelFunc()
+		})
+	}}
+	err := s.RunWithCustomSocket(ctx, func() (net.PacketConn, error) {
+		return fakesocket.FakePacketConn{}, nil
+	})
+	if err != nil && err != context.Canceled {
+		t.Errorf("statsd run failed: %v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, gostatsd.Tags{"env:test", "gostatsd_test_node_name:node-2", "gostatsd_test_pod_name:web-1"}, tags) // Sorted by the aggregator
+}
+
+func TestServerDisableConsole(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+	s := NewServer()
+	s.ConsoleAddr = addr
+	s.DisableConsole = true
+	s.WebConsoleAddr = ""
+	s.FlushInterval = 10 * time.Millisecond
+	running := make(chan struct{})
+	var once sync.Once
+	s.FlushObservers = []FlushObserver{func(ctx context.Context, m *gostatsd.MetricMap) {
+		once.Do(func() {
+			close(running)
+		})
+	}}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := s.RunWithCustomSocket(ctx, func() (net.PacketConn, error) {
+			return fakesocket.FakePacketConn{}, nil
+		})
+		if err != nil && err != context.Canceled {
+			t.Errorf("statsd run failed: %v", err)
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("server did not flush")
+	case <-running:
+	}
+	// The address is free only if the console is not listening on it
+	l, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	cancelFunc()
+	wg.Wait()
+}
@@ -0,0 +1,110 @@
+package statsd
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// DefaultTapCapacity is the default number of metrics a MetricTap can hold.
+const DefaultTapCapacity = 10000
+
+// TappedMetric is a lightweight copy of a metric observed by a MetricTap.
+type TappedMetric struct {
+	Name string
+	Type gostatsd.MetricType
+}
+
+// MetricTap is a ring buffer of the most recently received metrics.
+// When the buffer is full the oldest metrics are overwritten.
+// Safe for concurrent use.
+type MetricTap struct {
+	mu    sync.Mutex
+	buf   []TappedMetric
+	next  int    // Position to write the next metric to
+	full  bool   // Whether buf has wrapped around
+	total uint64 // Total number of observed metrics, including overwritten ones
+}
+
+// NewMetricTap creates a new MetricTap with the provided capacity.
+// If capacity is not positive DefaultTapCapacity is used.
+func NewMetricTap(capacity int) *MetricTap {
+	if capacity <= 0 {
+		capacity = DefaultTapCapacity
+	}
+	return &MetricTap{
+		buf: make([]TappedMetric, capacity),
+	}
+}
+
+// Observe records the metric in the ring buffer.
+func (t *MetricTap) Observe(m *gostatsd.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf[t.next] = TappedMetric{Name: m.Name, Type: m.Type}
+	t.next++
+	if t.next == len(t.buf) {
+		t.next = 0
+		t.full = true
+	}
+	t.total++
+}
+
+// Snapshot returns the metrics currently held in the buffer, oldest first,
+// and the total number of metrics observed by the tap.
+func (t *MetricTap) Snapshot() ([]TappedMetric, uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.full {
+		result := make([]TappedMetric, t.next)
+		copy(result, t.buf[:t.next])
+		return result, t.total
+	}
+	result := make([]TappedMetric, 0, len(t.buf))
+	result = append(result, t.buf[t.next:]...)
+	result = append(result, t.buf[:t.next]...)
+	return result, t.total
+}
+
+// Tapper is implemented by Receivers that allow attaching MetricTaps to observe incoming metrics.
+type Tapper interface {
+	// AttachTap starts copying received metrics into the tap.
+	AttachTap(*MetricTap)
+	// DetachTap stops copying received metrics into the tap.
+	DetachTap(*MetricTap)
+}
+
+// taps is a copy-on-write set of attached taps.
+// Readers load the slice without locking, writers replace it while holding the lock.
+type taps struct {
+	mu   sync.Mutex   // Serializes writers
+	list atomic.Value // []*MetricTap
+}
+
+func (ts *taps) get() []*MetricTap {
+	list, _ := ts.list.Load().([]*MetricTap)
+	return list
+}
+
+func (ts *taps) attach(t *MetricTap) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	current := ts.get()
+	list := make([]*MetricTap, len(current), len(current)+1)
+	copy(list, current)
+	ts.list.Store(append(list, t))
+}
+
+func (ts *taps) detach(t *MetricTap) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	current := ts.get()
+	list := make([]*MetricTap, 0, len(current))
+	for _, tap := range current {
+		if tap != t {
+			list = append(list, tap)
+		}
+	}
+	ts.list.Store(list)
+}
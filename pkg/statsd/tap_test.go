@@ -0,0 +1,57 @@
+package statsd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/fakesocket"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricTapWrapsAround(t *testing.T) {
+	t.Parallel()
+	tap := NewMetricTap(3)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		tap.Observe(&gostatsd.Metric{Name: name, Type: gostatsd.COUNTER})
+	}
+	metrics, total := tap.Snapshot()
+	assert.Equal(t, uint64(5), total)
+	assert.Equal(t, []TappedMetric{
+		{Name: "c", Type: gostatsd.COUNTER},
+		{Name: "d", Type: gostatsd.COUNTER},
+		{Name: "e", Type: gostatsd.COUNTER},
+	}, metrics)
+}
+
+func TestMetricTapNotFull(t *testing.T) {
+	t.Parallel()
+	tap := NewMetricTap(3)
+	tap.Observe(&gostatsd.Metric{Name: "a", Type: gostatsd.GAUGE})
+	metrics, total := tap.Snapshot()
+	assert.Equal(t, uint64(1), total)
+	assert.Equal(t, []TappedMetric{{Name: "a", Type: gostatsd.GAUGE}}, metrics)
+}
+
+func TestReceiverTapAttachDetach(t *testing.T) {
+	t.Parallel()
+	ch := &countingHandler{}
+	mr := NewMetricReceiver("", ch)
+	tap := NewMetricTap(10)
+
+	require.NoError(t, mr.handlePacket(context.Background(), fakesocket.FakeAddr, []byte("a:1|c")))
+	mr.AttachTap(tap)
+	require.NoError(t, mr.handlePacket(context.Background(), fakesocket.FakeAddr, []byte("b:1|c\nc:2|g")))
+	mr.DetachTap(tap)
+	require.NoError(t, mr.handlePacket(context.Background(), fakesocket.FakeAddr, []byte("d:1|c")))
+
+	metrics, total := tap.Snapshot()
+	assert.Equal(t, uint64(2), total)
+	assert.Equal(t, []TappedMetric{
+		{Name: "b", Type: gostatsd.COUNTER},
+		{Name: "c", Type: gostatsd.GAUGE},
+	}, metrics)
+	assert.Len(t, ch.metrics, 4)
+}
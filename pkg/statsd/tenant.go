@@ -0,0 +1,275 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// TenantTagKey is the key of the tag with the tenant of a metric.
+const TenantTagKey = "tenant"
+
+// TenantMode is how the tenant of a received metric is determined.
+type TenantMode int
+
+const (
+	// TenantModeNone disables tenants.
+	TenantModeNone TenantMode = iota
+	// TenantModeName takes the tenant from the leading token of the name of a metric, which is removed.
+	TenantModeName
+	// TenantModeTag takes the tenant from the tenant tag of a metric.
+	TenantModeTag
+)
+
+var tenantModeNames = map[TenantMode]string{
+	TenantModeNone: "none",
+	TenantModeName: "name",
+	TenantModeTag:  "tag",
+}
+
+func (m TenantMode) String() string {
+	if name, ok := tenantModeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("TenantMode(%d)", int(m))
+}
+
+// ParseTenantMode returns the tenant mode with the name.
+func ParseTenantMode(name string) (TenantMode, error) {
+	for mode, modeName := range tenantModeNames {
+		if modeName == name {
+			return mode, nil
+		}
+	}
+	return TenantModeNone, fmt.Errorf("unknown tenant mode %q, must be one of none, name, tag", name)
+}
+
+// Tenant is a tenant whose metrics are aggregated and flushed separately from the metrics of other tenants.
+type Tenant struct {
+	Name     string
+	Prefix   string   // Prefix added to names of flushed metrics of the tenant, none if empty
+	Backends []string // Names of backends metrics of the tenant are flushed to, all backends if empty
+}
+
+// NewTenantsFromViper returns the tenants configured in the tenants section:
+//
+//	[[tenants]]
+//	name = "team-a"
+//	prefix = "team_a" # Optional
+//	backends = ["graphite"] # Optional, all backends if empty
+func NewTenantsFromViper(v *viper.Viper) ([]Tenant, error) {
+	entries := cast.ToSlice(v.Get("tenants"))
+	tenants := make([]Tenant, 0, len(entries))
+	for i, entry := range entries {
+		e := cast.ToStringMap(entry)
+		tenant := Tenant{
+			Name:     cast.ToString(e["name"]),
+			Prefix:   cast.ToString(e["prefix"]),
+			Backends: cast.ToStringSlice(e["backends"]),
+		}
+		if tenant.Name == "" {
+			return nil, fmt.Errorf("tenant %d: name is required", i)
+		}
+		tenants = append(tenants, tenant)
+	}
+	return tenants, nil
+}
+
+// tenancy partitions metrics by tenant.
+type tenancy struct {
+	tenants       map[string]Tenant
+	names         []string // Sorted names of the tenants
+	defaultTenant string   // Tenant of metrics without a known tenant
+}
+
+// newTenancy returns the tenancy of the tenants. The default tenant does not have to be configured, metrics of
+// an unconfigured tenant are flushed to all backends without a prefix.
+func newTenancy(tenants []Tenant, defaultTenant string) (*tenancy, error) {
+	if defaultTenant == "" {
+		return nil, fmt.Errorf("default tenant is required")
+	}
+	t := &tenancy{
+		tenants:       make(map[string]Tenant, len(tenants)+1),
+		defaultTenant: defaultTenant,
+	}
+	for _, tenant := range tenants {
+		if strings.ContainsAny(tenant.Name, ".:,") {
+			return nil, fmt.Errorf("tenant name %q must not contain '.', ':' or ','", tenant.Name)
+		}
+		if _, ok := t.tenants[tenant.Name]; ok {
+			return nil, fmt.Errorf("duplicate tenant %s", tenant.Name)
+		}
+		t.tenants[tenant.Name] = tenant
+	}
+	if _, ok := t.tenants[defaultTenant]; !ok {
+		t.tenants[defaultTenant] = Tenant{Name: defaultTenant}
+	}
+	for name := range t.tenants {
+		t.names = append(t.names, name)
+	}
+	sort.Strings(t.names)
+	return t, nil
+}
+
+// resolve returns the name of the tenant if it is known, the default tenant otherwise.
+func (t *tenancy) resolve(name string) string {
+	if _, ok := t.tenants[name]; ok {
+		return name
+	}
+	return t.defaultTenant
+}
+
+// tenantOf returns the tenant of the tags, the default tenant if there is no tenant tag.
+func (t *tenancy) tenantOf(tags gostatsd.Tags) string {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, TenantTagKey+":") {
+			return t.resolve(tag[len(TenantTagKey)+1:])
+		}
+	}
+	return t.defaultTenant
+}
+
+// TenantHandler assigns each metric to a tenant with the tenant tag and forwards it to the next Handler.
+// Metrics of different tenants are aggregated separately because their tags differ. Metrics without a known
+// tenant are assigned the default tenant. Events are forwarded unchanged.
+type TenantHandler struct {
+	handler Handler
+	mode    TenantMode
+	tenancy *tenancy
+}
+
+// NewTenantHandler initialises a new TenantHandler.
+func NewTenantHandler(handler Handler, mode TenantMode, tenants []Tenant, defaultTenant string) (*TenantHandler, error) {
+	t, err := newTenancy(tenants, defaultTenant)
+	if err != nil {
+		return nil, err
+	}
+	return &TenantHandler{
+		handler: handler,
+		mode:    mode,
+		tenancy: t,
+	}, nil
+}
+
+func (th *TenantHandler) DispatchMetric(ctx context.Context, m *gostatsd.Metric) error {
+	tenant := th.tenancy.defaultTenant
+	if th.mode == TenantModeName {
+		if i := strings.IndexByte(m.Name, '.'); i > 0 && i < len(m.Name)-1 {
+			if _, ok := th.tenancy.tenants[m.Name[:i]]; ok {
+				tenant = m.Name[:i]
+				m.Name = m.Name[i+1:]
+			}
+		}
+	}
+	tags := m.Tags[:0]
+	for _, tag := range m.Tags {
+		if strings.HasPrefix(tag, TenantTagKey+":") {
+			if th.mode == TenantModeTag {
+				tenant = th.tenancy.resolve(tag[len(TenantTagKey)+1:])
+			}
+			continue // Replaced by the tag of the resolved tenant
+		}
+		tags = append(tags, tag)
+	}
+	m.Tags = append(tags, TenantTagKey+":"+tenant)
+	return th.handler.DispatchMetric(ctx, m)
+}
+
+func (th *TenantHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) error {
+	return th.handler.DispatchEvent(ctx, e)
+}
+
+func (th *TenantHandler) WaitForEvents() {
+	th.handler.WaitForEvents()
+}
+
+// tenantMetrics are the metrics of a tenant.
+type tenantMetrics struct {
+	tenant Tenant
+	m      *gostatsd.MetricMap
+}
+
+// split returns the metrics of each tenant with their names prefixed by the prefix of the tenant, sorted by
+// tenant name. Tenants without metrics are omitted. The returned MetricMaps share tags with m.
+func (t *tenancy) split(m *gostatsd.MetricMap) []tenantMetrics {
+	parts := make(map[string]*gostatsd.MetricMap, len(t.tenants))
+	part := func(tags gostatsd.Tags) (*gostatsd.MetricMap, string) {
+		tenant := t.tenantOf(tags)
+		p, ok := parts[tenant]
+		if !ok {
+			p = newMetricMap()
+			p.FlushInterval = m.FlushInterval
+			parts[tenant] = p
+		}
+		p.NumStats++
+		return p, t.tenants[tenant].Prefix
+	}
+	prefixed := func(prefix, key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "." + key
+	}
+	m.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		p, prefix := part(counter.Tags)
+		key = prefixed(prefix, key)
+		if p.Counters[key] == nil {
+			p.Counters[key] = make(map[string]gostatsd.Counter)
+		}
+		p.Counters[key][tagsKey] = counter
+	})
+	m.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		p, prefix := part(timer.Tags)
+		key = prefixed(prefix, key)
+		if p.Timers[key] == nil {
+			p.Timers[key] = make(map[string]gostatsd.Timer)
+		}
+		p.Timers[key][tagsKey] = timer
+	})
+	m.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		p, prefix := part(gauge.Tags)
+		key = prefixed(prefix, key)
+		if p.Gauges[key] == nil {
+			p.Gauges[key] = make(map[string]gostatsd.Gauge)
+		}
+		p.Gauges[key][tagsKey] = gauge
+	})
+	m.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+		p, prefix := part(set.Tags)
+		key = prefixed(prefix, key)
+		if p.Sets[key] == nil {
+			p.Sets[key] = make(map[string]gostatsd.Set)
+		}
+		p.Sets[key][tagsKey] = set
+	})
+	result := make([]tenantMetrics, 0, len(parts))
+	for _, name := range t.names {
+		if p, ok := parts[name]; ok {
+			result = append(result, tenantMetrics{tenant: t.tenants[name], m: p})
+		}
+	}
+	return result
+}
+
+// route returns the backends metrics of the tenant are flushed to.
+func (tm tenantMetrics) route(backends []gostatsd.Backend) []gostatsd.Backend {
+	if len(tm.tenant.Backends) == 0 {
+		return backends
+	}
+	var result []gostatsd.Backend
+	for _, backend := range backends {
+		for _, name := range tm.tenant.Backends {
+			if backend.Name() == name {
+				result = append(result, backend)
+				break
+			}
+		}
+	}
+	return result
+}
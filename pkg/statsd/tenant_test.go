@@ -0,0 +1,145 @@
+package statsd
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testTenants = []Tenant{
+	{Name: "team-a", Prefix: "a", Backends: []string{"backendA"}},
+	{Name: "team-b", Backends: []string{"backendB"}},
+}
+
+func TestTenantHandler(t *testing.T) {
+	t.Parallel()
+	input := []struct {
+		mode     TenantMode
+		name     string
+		tags     gostatsd.Tags
+		expected gostatsd.Metric
+	}{
+		{TenantModeName, "team-a.x", gostatsd.Tags{"k:v"}, gostatsd.Metric{Name: "x", Tags: gostatsd.Tags{"k:v", "tenant:team-a"}}},
+		{TenantModeName, "team-c.x", nil, gostatsd.Metric{Name: "team-c.x", Tags: gostatsd.Tags{"tenant:shared"}}},
+		{TenantModeName, "team-a.", nil, gostatsd.Metric{Name: "team-a.", Tags: gostatsd.Tags{"tenant:shared"}}},
+		{TenantModeName, "x", gostatsd.Tags{"tenant:team-b"}, gostatsd.Metric{Name: "x", Tags: gostatsd.Tags{"tenant:shared"}}},
+		{TenantModeTag, "team-a.x", gostatsd.Tags{"tenant:team-b", "k:v"}, gostatsd.Metric{Name: "team-a.x", Tags: gostatsd.Tags{"k:v", "tenant:team-b"}}},
+		{TenantModeTag, "x", gostatsd.Tags{"tenant:team-c"}, gostatsd.Metric{Name: "x", Tags: gostatsd.Tags{"tenant:shared"}}},
+		{TenantModeTag, "x", nil, gostatsd.Metric{Name: "x", Tags: gostatsd.Tags{"tenant:shared"}}},
+	}
+	for _, in := range input {
+		ch := &countingHandler{}
+		th, err := NewTenantHandler(ch, in.mode, testTenants, "shared")
+		require.NoError(t, err)
+		require.NoError(t, th.DispatchMetric(context.Background(), &gostatsd.Metric{Name: in.name, Tags: in.tags}))
+		assert.Equal(t, []gostatsd.Metric{in.expected}, ch.metrics, "%v %s %v", in.mode, in.name, in.tags)
+	}
+}
+
+func TestNewTenantHandlerInvalid(t *testing.T) {
+	t.Parallel()
+	for _, tenants := range [][]Tenant{
+		{{Name: "a.b"}},
+		{{Name: "a"}, {Name: "a"}},
+	} {
+		_, err := NewTenantHandler(&countingHandler{}, TenantModeTag, tenants, "default")
+		assert.Error(t, err, "%v", tenants)
+	}
+	_, err := NewTenantHandler(&countingHandler{}, TenantModeTag, nil, "")
+	assert.Error(t, err)
+}
+
+func TestTenantsFlushToTheirBackends(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	d := NewMetricDispatcher(2, 10, &agrFactory{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	th, err := NewTenantHandler(NewDispatchingHandler(d, nil, nil, 1), TenantModeName, testTenants, "shared")
+	require.NoError(t, err)
+	receiver := NewMetricReceiver("", th)
+	_, _, err = receiver.HandleLines(ctx, &net.UDPAddr{}, []byte("team-a.requests:1|c\nteam-b.requests:5|c\nrequests:10|c\nteam-a.requests:2|c\nteam-b.temp:3|g"))
+	require.NoError(t, err)
+	waitForSnapshot(t, ctx, d, func(snapshot *gostatsd.MetricMap) bool {
+		return snapshot.NumStats == 5
+	})
+
+	backendA := &namedBackend{name: "backendA"}
+	backendB := &namedBackend{name: "backendB"}
+	fl := NewMetricFlusher(time.Second, d, nil, nil, []gostatsd.Backend{backendA, backendB}, gostatsd.UnknownIP, "host")
+	assert.Error(t, fl.SetTenants([]Tenant{{Name: "team-c", Backends: []string{"unknown"}}}, "shared"))
+	require.NoError(t, fl.SetTenants(testTenants, "shared"))
+	fl.flushData(ctx, false)
+
+	values := func(nb *namedBackend) map[string]float64 {
+		nb.mu.Lock()
+		defer nb.mu.Unlock()
+		result := make(map[string]float64)
+		for _, m := range nb.maps {
+			m.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+				result[key+" "+strings.Join(counter.Tags, ",")] += float64(counter.Value)
+			})
+			m.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+				result[key+" "+strings.Join(gauge.Tags, ",")] += gauge.Value
+			})
+		}
+		return result
+	}
+	// The shared tenant is not configured so its metrics are flushed to all backends
+	assert.Equal(t, map[string]float64{
+		"a.requests tenant:team-a": 3,
+		"requests tenant:shared":   10,
+	}, values(backendA))
+	assert.Equal(t, map[string]float64{
+		"requests tenant:team-b": 5,
+		"temp tenant:team-b":     3,
+		"requests tenant:shared": 10,
+	}, values(backendB))
+
+	cancelFunc()
+	wg.Wait()
+}
+
+func TestNewTenantsFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("tenants", []interface{}{
+		map[string]interface{}{"name": "team-a", "prefix": "a", "backends": []interface{}{"graphite"}},
+		map[string]interface{}{"name": "team-b"},
+	})
+	tenants, err := NewTenantsFromViper(v)
+	require.NoError(t, err)
+	assert.Equal(t, []Tenant{
+		{Name: "team-a", Prefix: "a", Backends: []string{"graphite"}},
+		{Name: "team-b"},
+	}, tenants)
+
+	v.Set("tenants", []interface{}{map[string]interface{}{"prefix": "a"}})
+	_, err = NewTenantsFromViper(v)
+	assert.Error(t, err)
+}
+
+func TestParseTenantMode(t *testing.T) {
+	t.Parallel()
+	for _, mode := range []TenantMode{TenantModeNone, TenantModeName, TenantModeTag} {
+		parsed, err := ParseTenantMode(mode.String())
+		require.NoError(t, err)
+		assert.Equal(t, mode, parsed)
+	}
+	_, err := ParseTenantMode("prefix")
+	assert.Error(t, err)
+}
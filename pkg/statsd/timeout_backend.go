@@ -0,0 +1,37 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// timeoutBackend bounds the sends of metrics to the backend. The context of a send has a deadline and its
+// callback is called with an error once the timeout has passed even if the backend has not returned, so that
+// a stalled backend does not block flushes. Other methods are delegated to the backend.
+type timeoutBackend struct {
+	gostatsd.Backend
+	timeout time.Duration
+}
+
+// SendMetricsAsync sends the metrics to the backend, the callback is called within the timeout.
+func (tb *timeoutBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	ctx, cancel := context.WithTimeout(ctx, tb.timeout)
+	var once sync.Once
+	finish := func(errs []error) {
+		once.Do(func() {
+			cancel()
+			cb(errs)
+		})
+	}
+	timer := time.AfterFunc(tb.timeout, func() {
+		finish([]error{fmt.Errorf("sending metrics to backend %s timed out after %v", tb.Name(), tb.timeout)})
+	})
+	tb.Backend.SendMetricsAsync(ctx, m, func(errs []error) {
+		timer.Stop()
+		finish(errs)
+	})
+}
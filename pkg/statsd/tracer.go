@@ -0,0 +1,23 @@
+package statsd
+
+import (
+	"context"
+)
+
+// Tracer traces the stages of processing metrics, e.g. receiving a packet, parsing and dispatching its lines,
+// and flushing. See package tracing/xray.
+type Tracer interface {
+	// Start starts the trace of the named stage and returns a context with the trace and a function ending it
+	// with the error of the stage. A stage started with a context of another stage is nested in it.
+	// Must be safe for concurrent use.
+	Start(ctx context.Context, name string) (context.Context, func(error))
+}
+
+// nopTracer does not trace.
+type nopTracer struct{}
+
+func nopEnd(error) {}
+
+func (nopTracer) Start(ctx context.Context, name string) (context.Context, func(error)) {
+	return ctx, nopEnd
+}
@@ -0,0 +1,78 @@
+package statsd
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stageKey is the key of the stage of a context traced by recordingTracer.
+type stageKey struct{}
+
+// recordingTracer records ended stages as <parent stage>/<stage>, followed by ! if the stage failed.
+type recordingTracer struct {
+	mu     sync.Mutex
+	stages []string
+}
+
+func (rt *recordingTracer) Start(ctx context.Context, name string) (context.Context, func(error)) {
+	if parent, ok := ctx.Value(stageKey{}).(string); ok {
+		name = parent + "/" + name
+	}
+	return context.WithValue(ctx, stageKey{}, name), func(err error) {
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		if err != nil {
+			name += "!"
+		}
+		rt.stages = append(rt.stages, name)
+	}
+}
+
+func (rt *recordingTracer) get() []string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.stages
+}
+
+func TestReceiverTracing(t *testing.T) {
+	t.Parallel()
+	rt := &recordingTracer{}
+	mr := NewMetricReceiver("", &countingHandler{})
+	mr.SetTracer(rt)
+
+	_, _, err := mr.HandleLines(context.Background(), &net.TCPAddr{}, []byte("f:2|c\nbad"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"lines/parse", "lines/dispatch", "lines/parse!", "lines"}, rt.get())
+}
+
+func TestFlusherTracing(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	d := NewMetricDispatcher(1, 10, &agrFactory{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, d.Run(ctx))
+	}()
+	require.NoError(t, d.DispatchMetric(ctx, &gostatsd.Metric{Name: "c", Value: 1, Type: gostatsd.COUNTER}))
+
+	rt := &recordingTracer{}
+	fl := NewMetricFlusher(time.Second, d, nil, nil, []gostatsd.Backend{&namedBackend{name: "backend"}, &failingBackend{}}, gostatsd.UnknownIP, "host")
+	fl.SetTracer(rt)
+	_, result := fl.flushData(ctx, false)
+	assert.Error(t, result.Err)
+	assert.ElementsMatch(t, []string{"flush/send:backend", "flush/send:capturingBackend!", "flush!"}, rt.get())
+
+	cancelFunc()
+	wg.Wait()
+}
@@ -27,6 +27,7 @@ type ProcessFunc func(*gostatsd.MetricMap)
 //
 // Incoming metrics should be passed via Receive function.
 type Aggregator interface {
+	// Receive aggregates the metric. The metric may be reused once Receive returns, only its tags can be kept.
 	Receive(*gostatsd.Metric, time.Time)
 	Flush(interval time.Duration)
 	Process(ProcessFunc)
@@ -46,10 +47,31 @@ type Dispatcher interface {
 	Process(context.Context, DispatcherProcessFunc) *sync.WaitGroup
 }
 
-// FlusherStats holds statistics about a Flusher.
+// FlushObserver is notified with metrics flushed on each interval after they have been sent to backends.
+// The MetricMap is a copy shared by all observers and must not be modified.
+type FlushObserver func(context.Context, *gostatsd.MetricMap)
+
+// Service is started by the Server with its running components and stopped when the context is done.
+// It can be used to provide additional interfaces to manage the server.
+type Service func(ctx context.Context, receiver Receiver, dispatcher Dispatcher, flusher Flusher) error
+
+// FlusherStats holds statistics about a Flusher. They are read by the console, the APIs and the signal handler.
 type FlusherStats struct {
-	LastFlush      time.Time // Last time the metrics where aggregated
-	LastFlushError time.Time // Time of the last flush error
+	LastFlush      time.Time `json:"last_flush"`       // Last time the metrics where aggregated
+	LastFlushError time.Time `json:"last_flush_error"` // Time of the last flush error
+	// Payloads are histograms of sizes of payloads serialized by backends, sorted by backend name.
+	// Only backends that implement gostatsd.PayloadReporter are included once they have sent a payload.
+	Payloads []PayloadStats `json:"payloads"`
+	// Queues are statistics of send queues of backends sorted by backend name, empty if queues are disabled.
+	Queues []QueueStats `json:"queues"`
+}
+
+// QueueStats holds statistics of the send queue of a backend.
+type QueueStats struct {
+	Backend  string `json:"backend"`
+	Depth    int    `json:"depth"`    // Number of queued flushes
+	Capacity int    `json:"capacity"` // Maximum number of queued flushes
+	Dropped  uint64 `json:"dropped"`  // Number of flushes dropped because the queue was full
 }
 
 // Flusher periodically flushes metrics from all Aggregators to Senders.
@@ -58,6 +80,40 @@ type Flusher interface {
 	GetStats() FlusherStats
 }
 
+// FlushResult is the result of a flush of metrics to backends.
+type FlushResult struct {
+	NumStats uint32 // Number of flushed metrics
+	Err      error  // Last error returned by backends, nil if all sends succeeded
+}
+
+// ForceFlusher is a Flusher that can flush metrics without waiting for the flush interval.
+type ForceFlusher interface {
+	// ForceFlush flushes metrics to backends and waits for the flush to finish.
+	// An error is only returned if the flush was not done, errors of backends are part of the result.
+	// Safe for concurrent use.
+	ForceFlush(context.Context) (FlushResult, error)
+}
+
+// BackendStatus holds the result of the most recent sends of metrics to a backend.
+type BackendStatus struct {
+	Name             string
+	LastSuccess      time.Time // Time of the last successful send, zero if none
+	LastError        time.Time // Time of the last failed send, zero if none
+	LastErrorMessage string
+}
+
+// Healthy returns true if the backend has not failed or if it has succeeded since the last failure.
+func (bs BackendStatus) Healthy() bool {
+	return bs.LastError.IsZero() || bs.LastSuccess.After(bs.LastError)
+}
+
+// BackendStatusReporter is a Flusher that reports statuses of its backends.
+type BackendStatusReporter interface {
+	// BackendStatuses returns statuses of all backends sorted by name.
+	// Safe for concurrent use.
+	BackendStatuses() []BackendStatus
+}
+
 // Receiver receives data on its PacketConn.
 type Receiver interface {
 	// Receive accepts incoming datagrams on packet connection.
@@ -68,11 +124,38 @@ type Receiver interface {
 	GetStats() ReceiverStats
 }
 
-// ReceiverStats holds statistics for a Receiver.
+// LineReceiver is a Receiver that also handles lines received by other transports than its PacketConn.
+type LineReceiver interface {
+	Receiver
+	// HandleLines handles newline-delimited metrics and events received from the address.
+	// It returns the numbers of dispatched metrics and events.
+	// Safe for concurrent use.
+	HandleLines(ctx context.Context, addr net.Addr, lines []byte) (metrics, events uint32, err error)
+}
+
+// ParsedReceiver is a Receiver that also handles metrics parsed by other transports than its PacketConn.
+type ParsedReceiver interface {
+	Receiver
+	// HandleMetric handles the metric like a metric parsed from a received line.
+	// Safe for concurrent use.
+	HandleMetric(ctx context.Context, m *gostatsd.Metric) error
+}
+
+// ReceiverStats holds statistics for a Receiver. They are read by the console, the APIs and the signal handler,
+// internal metrics derived from them are sent by the flusher like other internal metrics, see MetricClient.
 type ReceiverStats struct {
-	LastPacket      time.Time
-	BadLines        uint64
-	PacketsReceived uint64
-	MetricsReceived uint64
-	EventsReceived  uint64
+	LastPacket      time.Time `json:"last_packet"`
+	BadLines        uint64    `json:"bad_lines"`
+	PacketsReceived uint64    `json:"packets_received"`
+	MetricsReceived uint64    `json:"metrics_received"`
+	EventsReceived  uint64    `json:"events_received"`
+	UnknownFields   uint64    `json:"unknown_fields"` // Number of skipped fields with unknown markers in metric lines
+	UntypedLines    uint64    `json:"untyped_lines"`  // Number of metric lines without a type accepted with the default type
+	// Numbers of bad lines rejected for each of these reasons, also counted in BadLines.
+	EmptyNames        uint64 `json:"empty_names"`
+	EmptyValues       uint64 `json:"empty_values"`
+	EmptyTypes        uint64 `json:"empty_types"`
+	NonNumericValues  uint64 `json:"non_numeric_values"`
+	NonFiniteRejected uint64 `json:"non_finite_rejected"` // Inf and NaN values, including after sampling
+	UnknownTypes      uint64 `json:"unknown_types"`       // Types that are likely supported by other clients
 }
@@ -0,0 +1,138 @@
+package statsd
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// frameHeaderSize is the size of the length prefix of frames read by the FramedUnixReceiver.
+const frameHeaderSize = 4
+
+// FramedUnixReceiver receives metrics and events from Unix stream sockets framed like DogStatsD clients do:
+// each datagram is prefixed with its length as a 4-byte little-endian integer. Each frame is handled by the
+// MetricReceiver like a datagram. Frames larger than the maximum size of a datagram are skipped and counted
+// as bad lines.
+type FramedUnixReceiver struct {
+	receiver *MetricReceiver
+}
+
+// NewFramedUnixReceiver initialises a new FramedUnixReceiver.
+func NewFramedUnixReceiver(receiver *MetricReceiver) *FramedUnixReceiver {
+	return &FramedUnixReceiver{
+		receiver: receiver,
+	}
+}
+
+// ListenAndServe listens on the Unix socket and accepts connections until the context is done.
+// A stale socket file at the path is removed.
+func (fr *FramedUnixReceiver) ListenAndServe(ctx context.Context, path string) error {
+	if err := removeStaleSocket(path); err != nil {
+		return err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	return fr.Serve(ctx, l)
+}
+
+// Serve accepts connections on the listener until the context is done. The listener is closed on return.
+func (fr *FramedUnixReceiver) Serve(ctx context.Context, l net.Listener) error {
+	defer l.Close() // #nosec
+	var wg sync.WaitGroup
+	defer wg.Wait() // Wait for all connections to close
+	go func() {
+		<-ctx.Done()
+		l.Close() // #nosec Makes Accept return
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+				return err
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fr.serveConnection(ctx, conn)
+		}()
+	}
+}
+
+// serveConnection handles frames read from the connection until it is closed or the context is done.
+func (fr *FramedUnixReceiver) serveConnection(ctx context.Context, conn net.Conn) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		conn.Close() // #nosec
+	}()
+	header := make([]byte, frameHeaderSize)
+	buf := make([]byte, packetSizeUDP)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				log.Debugf("Error reading frame from Unix socket: %v", err)
+			}
+			return
+		}
+		size := binary.LittleEndian.Uint32(header)
+		if size > packetSizeUDP {
+			log.Debugf("Frame from Unix socket is longer than %d bytes", packetSizeUDP)
+			atomic.AddUint64(&fr.receiver.badLines, 1)
+			if _, err := io.CopyN(ioutil.Discard, conn, int64(size)); err != nil {
+				return
+			}
+			continue
+		}
+		if _, err := io.ReadFull(conn, buf[:size]); err != nil {
+			if ctx.Err() == nil {
+				log.Debugf("Error reading frame from Unix socket: %v", err)
+			}
+			return
+		}
+		if err := fr.receiver.receivePacket(ctx, conn.RemoteAddr(), buf[:size]); err != nil {
+			if err == context.Canceled || err == context.DeadlineExceeded {
+				return
+			}
+			log.Warnf("Failed to handle frame: %v", err)
+		}
+	}
+}
+
+// ListenUnixgram listens for datagrams on the Unix socket, e.g. for the MetricReceiver. A stale socket
+// file at the path is removed.
+func ListenUnixgram(path string) (net.PacketConn, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	return net.ListenPacket("unixgram", path)
+}
+
+// removeStaleSocket removes the socket file left at the path by a previous process. Other files are not removed.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
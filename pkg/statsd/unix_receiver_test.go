@@ -0,0 +1,102 @@
+package statsd
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// frame returns the datagram prefixed with its length.
+func frame(datagram string) []byte {
+	b := make([]byte, frameHeaderSize, frameHeaderSize+len(datagram))
+	binary.LittleEndian.PutUint32(b, uint32(len(datagram)))
+	return append(b, datagram...)
+}
+
+func TestFramedUnixReceiver(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "gostatsd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "dsd.sock")
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	ch := &countingHandler{}
+	mr := NewMetricReceiver("", ch)
+	fr := NewFramedUnixReceiver(mr)
+	done := make(chan error, 1)
+	go func() {
+		done <- fr.ListenAndServe(ctx, socket)
+	}()
+
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("unix", socket); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, err)
+	defer conn.Close()
+
+	oversized := make([]byte, frameHeaderSize+packetSizeUDP+1)
+	binary.LittleEndian.PutUint32(oversized, packetSizeUDP+1)
+	var data []byte
+	data = append(data, frame("a:1|c\nb:2|g")...)
+	data = append(data, oversized...) // Skipped
+	data = append(data, frame("c:3|ms")...)
+	// A frame split across writes is read whole
+	_, err = conn.Write(data[:len(data)-3])
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	_, err = conn.Write(data[len(data)-3:])
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"a", "b", "c"}, waitForMetricNames(t, ch, 3))
+	stats := mr.GetStats()
+	assert.EqualValues(t, 2, stats.PacketsReceived)
+	assert.EqualValues(t, 1, stats.BadLines)
+
+	cancelFunc()
+	assert.Equal(t, context.Canceled, <-done)
+}
+
+func TestListenUnixgram(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "gostatsd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "statsd.sock")
+	c, err := ListenUnixgram(socket)
+	require.NoError(t, err)
+	c.Close() // #nosec Leaves the socket file like a crashed process
+
+	// The stale socket is replaced
+	c, err = ListenUnixgram(socket)
+	require.NoError(t, err)
+	defer c.Close()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	ch := &countingHandler{}
+	go NewMetricReceiver("", ch).Receive(ctx, c)
+	client, err := net.Dial("unixgram", socket)
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("a:1|c\nb:2|c"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, waitForMetricNames(t, ch, 2))
+
+	// Other files are not removed
+	file := filepath.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(file, nil, 0600))
+	_, err = ListenUnixgram(file)
+	assert.Error(t, err)
+}
@@ -0,0 +1,156 @@
+//go:build !windows
+// +build !windows
+
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/pb"
+
+	log "github.com/Sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+)
+
+// receiveWarmRestartState connects to the warm restart socket of the previous process and receives its state.
+// The state is received as a file descriptor passed using SCM_RIGHTS.
+// Returns nil state if no process is listening on the socket.
+func receiveWarmRestartState(ctx context.Context, path string, timeout time.Duration) (*gostatsd.MetricMap, error) {
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		log.Infof("No previous process to receive state from: %v", err)
+		return nil, nil
+	}
+	defer conn.Close()
+	uc := conn.(*net.UnixConn)
+	if err = uc.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4)) // Space for a single file descriptor
+	_, oobn, _, _, err := uc.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive state: %v", err)
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse control message: %v", err)
+	}
+	if len(msgs) != 1 {
+		return nil, fmt.Errorf("expected 1 control message, got %d", len(msgs))
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse file descriptor: %v", err)
+	}
+	if len(fds) != 1 {
+		return nil, fmt.Errorf("expected 1 file descriptor, got %d", len(fds))
+	}
+	f := os.NewFile(uintptr(fds[0]), "warm-restart-state")
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state: %v", err)
+	}
+	return decodeWarmRestartState(data)
+}
+
+// decodeWarmRestartState decodes the state sent by sendWarmRestartState.
+// Versions before the protobuf representation sent the state with WriteMetricState, which is still accepted
+// for upgrades. Protobuf messages of pb.MetricMap cannot start with '{'.
+func decodeWarmRestartState(data []byte) (*gostatsd.MetricMap, error) {
+	if trimmed := bytes.TrimLeft(data, " \t\r\n"); len(trimmed) > 0 && trimmed[0] == '{' {
+		return ReadMetricState(bytes.NewReader(data))
+	}
+	var m pb.MetricMap
+	if err := proto.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to decode state: %v", err)
+	}
+	return pb.MetricMapFromProto(&m), nil
+}
+
+// listenWarmRestart listens on the warm restart socket.
+// The socket file left by the previous process is removed.
+func listenWarmRestart(path string) (*net.UnixListener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+}
+
+// acceptWarmRestart accepts a connection from the next process and sends it to the channel.
+// The listener is closed after a connection is accepted so that the next process can listen on the same path,
+// or when the context is done.
+func acceptWarmRestart(ctx context.Context, l *net.UnixListener, handoff chan<- *net.UnixConn) {
+	var closeOnce sync.Once
+	closeListener := func() {
+		closeOnce.Do(func() {
+			l.Close() // #nosec
+		})
+	}
+	defer closeListener()
+	go func() {
+		<-ctx.Done()
+		closeListener() // Unblock AcceptUnix
+	}()
+	conn, err := l.AcceptUnix()
+	if err != nil {
+		select {
+		case <-ctx.Done():
+		default:
+			log.Warnf("Failed to accept warm restart connection: %v", err)
+		}
+		return
+	}
+	closeListener()
+	select {
+	case <-ctx.Done():
+		conn.Close() // #nosec
+	case handoff <- conn:
+	}
+}
+
+// sendWarmRestartState writes the state as a pb.MetricMap into an unlinked temporary file and sends its file
+// descriptor to the next process.
+func sendWarmRestartState(conn *net.UnixConn, m *gostatsd.MetricMap, timeout time.Duration) error {
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile("", "gostatsd-state")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = os.Remove(f.Name()); err != nil {
+		return err
+	}
+	data, err := proto.Marshal(pb.MetricMapToProto(m))
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+	if _, err = f.Seek(0, 0); err != nil {
+		return err
+	}
+	n, oobn, err := conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(int(f.Fd())), nil)
+	if err != nil {
+		return err
+	}
+	if n != 1 || oobn == 0 {
+		return errors.New("short write")
+	}
+	return nil
+}
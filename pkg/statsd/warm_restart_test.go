@@ -0,0 +1,140 @@
+//go:build !windows
+// +build !windows
+
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/pb"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestReceiveWarmRestartStateNoPreviousProcess(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "gostatsd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m, err := receiveWarmRestartState(context.Background(), filepath.Join(dir, "restart.sock"), time.Second)
+	assert.NoError(t, err)
+	assert.Nil(t, m)
+}
+
+func TestDecodeWarmRestartState(t *testing.T) {
+	t.Parallel()
+	m := newMetricMap()
+	m.Counters["c"] = map[string]gostatsd.Counter{"a:b": gostatsd.NewCounter(10, 5, "h", gostatsd.Tags{"a:b"})}
+	m.Sets["s"] = map[string]gostatsd.Set{"": gostatsd.NewSet(10, map[string]struct{}{"x": {}}, "", nil)}
+
+	data, err := proto.Marshal(pb.MetricMapToProto(m))
+	require.NoError(t, err)
+	decoded, err := decodeWarmRestartState(data)
+	require.NoError(t, err)
+	assert.Equal(t, m, decoded)
+
+	// State sent by versions before the protobuf representation
+	buf := new(bytes.Buffer)
+	require.NoError(t, WriteMetricState(buf, m))
+	decoded, err = decodeWarmRestartState(buf.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, m, decoded)
+
+	_, err = decodeWarmRestartState([]byte{0xff})
+	assert.Error(t, err)
+}
+
+func newWarmRestartServer(socketPath string) *Server {
+	return &Server{
+		Limiter:           rate.NewLimiter(DefaultMaxCloudRequests, DefaultBurstCloudRequests),
+		FlushInterval:     time.Minute, // Metrics must not be flushed during the test
+		MaxReaders:        1,
+		MaxWorkers:        2,
+		MaxQueueSize:      DefaultMaxQueueSize,
+		PercentThreshold:  DefaultPercentThreshold,
+		WarmRestartSocket: socketPath,
+		Viper:             viper.New(),
+	}
+}
+
+func TestWarmRestartHandsOffState(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "gostatsd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "restart.sock")
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	socketFactory := func(addr *net.UDPAddr) SocketFactory {
+		return func() (net.PacketConn, error) {
+			return net.ListenUDP("udp", addr)
+		}
+	}
+
+	// Start the old process and feed it metrics
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	oldConn, err := net.ListenUDP("udp", addr)
+	require.NoError(t, err)
+	addr = oldConn.LocalAddr().(*net.UDPAddr)
+	require.NoError(t, oldConn.Close())
+	oldServer := newWarmRestartServer(socketPath)
+	oldDone := make(chan error, 1)
+	go func() {
+		oldDone <- oldServer.RunWithCustomSocket(ctx, socketFactory(addr))
+	}()
+	var client net.Conn
+	waitForSnapshot(t, context.Background(), oldServer, func(m *gostatsd.MetricMap) bool {
+		if client == nil {
+			client, err = net.DialUDP("udp", nil, addr)
+			require.NoError(t, err)
+			defer client.Close()
+			_, err = client.Write([]byte("foo.bar:5|c\nfoo.timer:10|ms\nfoo.set:a|s"))
+			require.NoError(t, err)
+		}
+		return m.NumStats == 3
+	})
+
+	// Start the new process on the same address, it should receive the state
+	newServer := newWarmRestartServer(socketPath)
+	newDone := make(chan error, 1)
+	go func() {
+		newDone <- newServer.RunWithCustomSocket(ctx, socketFactory(addr))
+	}()
+	select {
+	case err := <-oldDone:
+		assert.NoError(t, err) // Old process quits after the hand off
+	case <-time.After(5 * time.Second):
+		t.Fatal("old server did not quit")
+	}
+	m := waitForSnapshot(t, context.Background(), newServer, func(m *gostatsd.MetricMap) bool {
+		return m.NumStats == 3
+	})
+	tagsKey := formatTagsKey(nil, "127.0.0.1") // Hostname is set to the source IP
+	assert.Equal(t, int64(5), m.Counters["foo.bar"][tagsKey].Value)
+	assert.Equal(t, []float64{10}, m.Timers["foo.timer"][tagsKey].Values)
+	assert.Len(t, m.Sets["foo.set"][tagsKey].Values, 1)
+	_, err = os.Stat(socketPath)
+	assert.NoError(t, err) // New process listens for the next restart
+
+	cancelFunc()
+	select {
+	case err := <-newDone:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("new server did not quit")
+	}
+}
@@ -0,0 +1,27 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+)
+
+var errWarmRestartNotSupported = errors.New("warm restart is not supported on Windows")
+
+func receiveWarmRestartState(ctx context.Context, path string, timeout time.Duration) (*gostatsd.MetricMap, error) {
+	return nil, errWarmRestartNotSupported
+}
+
+func listenWarmRestart(path string) (*net.UnixListener, error) {
+	return nil, errWarmRestartNotSupported
+}
+
+func acceptWarmRestart(ctx context.Context, l *net.UnixListener, handoff chan<- *net.UnixConn) {
+}
+
+func sendWarmRestartState(conn *net.UnixConn, m *gostatsd.MetricMap, timeout time.Duration) error {
+	return errWarmRestartNotSupported
+}
@@ -0,0 +1,68 @@
+// Package fakeclient provides a statsd client sending metrics over UDP for integration tests.
+package fakeclient
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// Client sends each metric to a statsd server in its own UDP packet. Safe for concurrent use.
+type Client struct {
+	conn net.Conn
+}
+
+// NewClient returns a Client sending metrics to the UDP address.
+func NewClient(addr string) (*Client, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn}, nil
+}
+
+// Gauge sends a gauge.
+func (c *Client) Gauge(name string, value float64, tags gostatsd.Tags) error {
+	return c.send(name, strconv.FormatFloat(value, 'f', -1, 64), "g", tags)
+}
+
+// Counter sends a counter.
+func (c *Client) Counter(name string, value int64, tags gostatsd.Tags) error {
+	return c.send(name, strconv.FormatInt(value, 10), "c", tags)
+}
+
+// Timer sends a timer in milliseconds.
+func (c *Client) Timer(name string, value time.Duration, tags gostatsd.Tags) error {
+	ms := float64(value) / float64(time.Millisecond)
+	return c.send(name, strconv.FormatFloat(ms, 'f', -1, 64), "ms", tags)
+}
+
+// Set sends a value of a set.
+func (c *Client) Set(name string, value string, tags gostatsd.Tags) error {
+	return c.send(name, value, "s", tags)
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// send sends the metric as <name>:<value>|<type>[|#<tags>].
+func (c *Client) send(name, value, metricType string, tags gostatsd.Tags) error {
+	var buf bytes.Buffer
+	buf.WriteString(name)
+	buf.WriteByte(':')
+	buf.WriteString(value)
+	buf.WriteByte('|')
+	buf.WriteString(metricType)
+	if len(tags) > 0 {
+		buf.WriteString("|#")
+		buf.WriteString(strings.Join(tags, ","))
+	}
+	_, err := c.conn.Write(buf.Bytes())
+	return err
+}
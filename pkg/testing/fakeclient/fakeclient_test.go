@@ -0,0 +1,59 @@
+package fakeclient
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/gostatsdtest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient(t *testing.T) {
+	t.Parallel()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	c, err := NewClient(conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.NoError(t, c.Gauge("g", 1.5, nil))
+	require.NoError(t, c.Counter("c", -2, gostatsd.Tags{"a:1", "b"}))
+	require.NoError(t, c.Timer("t", 1500*time.Microsecond, nil))
+	require.NoError(t, c.Set("s", "joe", gostatsd.Tags{"a:1"}))
+
+	buf := make([]byte, 1024)
+	for _, expected := range []string{"g:1.5|g", "c:-2|c|#a:1,b", "t:1.5|ms", "s:joe|s|#a:1"} {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(buf[:n]))
+	}
+}
+
+func TestClientAggregation(t *testing.T) {
+	t.Parallel()
+	s, stop := gostatsdtest.NewTestServer()
+	defer stop()
+	c, err := NewClient(s.Addr.String())
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.NoError(t, c.Counter("requests", 2, gostatsd.Tags{"env:test"}))
+	require.NoError(t, c.Counter("requests", 3, gostatsd.Tags{"env:test"}))
+	for i := 0; i < 100; i++ {
+		var total int64
+		for _, counter := range s.Backend.RecordedCounters()["requests"] {
+			total += counter.Value
+		}
+		if total == 5 {
+			return
+		}
+		time.Sleep(gostatsdtest.TestFlushInterval / 2)
+	}
+	t.Fatal("counters were not aggregated")
+}
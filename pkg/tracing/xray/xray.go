@@ -0,0 +1,181 @@
+// Package xray traces the processing of metrics with AWS X-Ray.
+//
+// Segments are sent to the X-Ray daemon, which forwards them to the X-Ray service. A segment of the gostatsd
+// service is created for each sampled received packet, batch of lines received by other transports, e.g. HTTP,
+// and flush, with the stage annotated as stage. Nested stages, e.g. parsing and dispatching each line of a packet
+// or sending flushed metrics to each backend, are subsegments. Each segment and subsegment is sent to the daemon
+// when it ends so that subsegments ending after their parent, e.g. queued sends, are still recorded.
+package xray
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// DefaultDaemonAddr is the default address of the X-Ray daemon.
+	DefaultDaemonAddr = "127.0.0.1:2000"
+	// DefaultSamplingRate is the default fraction of packets and flushes that are traced.
+	DefaultSamplingRate = 0.01
+	// ParamDaemonAddr is the name of parameter with the address of the X-Ray daemon.
+	ParamDaemonAddr = "xray-daemon-addr"
+	// ParamSamplingRate is the name of parameter with the fraction of packets and flushes that are traced.
+	ParamSamplingRate = "xray-sampling-rate"
+	// ServiceName is the name of segments.
+	ServiceName = "gostatsd"
+	// header precedes each segment document sent to the daemon.
+	header = `{"format": "json", "version": 1}` + "\n"
+)
+
+// AddFlags adds flags to the specified FlagSet.
+func AddFlags(fs *pflag.FlagSet) {
+	fs.String(ParamDaemonAddr, "", "If set, trace processing of metrics with AWS X-Ray by sending segments to the daemon on the UDP address, e.g. "+DefaultDaemonAddr)
+	fs.Float64(ParamSamplingRate, DefaultSamplingRate, "Fraction of received packets and flushes traced with AWS X-Ray")
+}
+
+// segmentKey is the key of the segment of a context.
+type segmentKey struct{}
+
+// segment is a started segment or subsegment.
+type segment struct {
+	id      string
+	traceID string
+}
+
+// notSampled is the segment of stages that are not traced.
+var notSampled = &segment{}
+
+// document is a segment document, see https://docs.aws.amazon.com/xray/latest/devguide/xray-api-segmentdocuments.html
+type document struct {
+	Name        string            `json:"name"`
+	ID          string            `json:"id"`
+	TraceID     string            `json:"trace_id"`
+	ParentID    string            `json:"parent_id,omitempty"`
+	Type        string            `json:"type,omitempty"`
+	StartTime   float64           `json:"start_time"`
+	EndTime     float64           `json:"end_time"`
+	Error       bool              `json:"error,omitempty"`
+	Cause       *cause            `json:"cause,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// cause is the cause of an error.
+type cause struct {
+	Exceptions []exception `json:"exceptions"`
+}
+
+// exception is an error of a segment.
+type exception struct {
+	ID      string `json:"id"`
+	Message string `json:"message"`
+}
+
+// Tracer traces stages of processing metrics with AWS X-Ray. It implements statsd.Tracer.
+type Tracer struct {
+	sendErrors uint64 // Accessed atomically
+
+	now          func() time.Time // Returns current time. Useful for testing.
+	conn         net.Conn
+	samplingRate float64
+}
+
+// NewTracer returns a Tracer sending segments to the X-Ray daemon on the UDP address. The sampling rate is
+// the fraction of packets and flushes that are traced.
+func NewTracer(daemonAddr string, samplingRate float64) (*Tracer, error) {
+	if samplingRate < 0 || samplingRate > 1 {
+		return nil, fmt.Errorf("sampling rate %v must be between 0 and 1", samplingRate)
+	}
+	conn, err := net.Dial("udp", daemonAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &Tracer{
+		now:          time.Now,
+		conn:         conn,
+		samplingRate: samplingRate,
+	}, nil
+}
+
+// Start starts a segment of the named stage if the context has no segment and the stage is sampled, or a
+// subsegment of the segment of the context. Safe for concurrent use.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, func(error)) {
+	parent, _ := ctx.Value(segmentKey{}).(*segment)
+	if parent == notSampled {
+		return ctx, nopEnd
+	}
+	start := t.now()
+	doc := &document{ID: newID(), StartTime: timestamp(start)}
+	if parent == nil {
+		if rand.Float64() >= t.samplingRate {
+			return context.WithValue(ctx, segmentKey{}, notSampled), nopEnd
+		}
+		doc.Name = ServiceName
+		doc.TraceID = newTraceID(start)
+		doc.Annotations = map[string]string{"stage": name}
+	} else {
+		doc.Name = name
+		doc.TraceID = parent.traceID
+		doc.ParentID = parent.id
+		doc.Type = "subsegment"
+	}
+	ctx = context.WithValue(ctx, segmentKey{}, &segment{id: doc.ID, traceID: doc.TraceID})
+	return ctx, func(err error) {
+		doc.EndTime = timestamp(t.now())
+		if err != nil {
+			doc.Error = true
+			doc.Cause = &cause{Exceptions: []exception{{ID: newID(), Message: err.Error()}}}
+		}
+		t.send(doc)
+	}
+}
+
+// SendErrors returns the number of segments that could not be sent to the daemon. Safe for concurrent use.
+func (t *Tracer) SendErrors() uint64 {
+	return atomic.LoadUint64(&t.sendErrors)
+}
+
+// Close closes the connection to the daemon.
+func (t *Tracer) Close() error {
+	return t.conn.Close()
+}
+
+func (t *Tracer) send(doc *document) {
+	b, err := json.Marshal(doc)
+	if err == nil {
+		_, err = t.conn.Write(append([]byte(header), b...))
+	}
+	if err != nil {
+		if atomic.AddUint64(&t.sendErrors, 1) == 1 {
+			log.Warnf("Failed to send segment to the X-Ray daemon: %v", err)
+		} else {
+			log.Debugf("Failed to send segment to the X-Ray daemon: %v", err)
+		}
+	}
+}
+
+func nopEnd(error) {}
+
+// newID returns a random 64-bit identifier in 16 hexadecimal digits.
+func newID() string {
+	return fmt.Sprintf("%08x%08x", rand.Uint32(), rand.Uint32())
+}
+
+// newTraceID returns a trace ID of a trace started at the time: the version 1, the time in seconds in
+// 8 hexadecimal digits and a random 96-bit identifier in 24 hexadecimal digits.
+func newTraceID(start time.Time) string {
+	return fmt.Sprintf("1-%08x-%08x%08x%08x", start.Unix(), rand.Uint32(), rand.Uint32(), rand.Uint32())
+}
+
+// timestamp returns the time in seconds since the epoch with microsecond precision.
+func timestamp(t time.Time) float64 {
+	return math.Floor(float64(t.UnixNano())/1e3) / 1e6
+}
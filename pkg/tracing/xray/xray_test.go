@@ -0,0 +1,100 @@
+package xray
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startDaemon listens for segments like the X-Ray daemon.
+func startDaemon(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	return conn
+}
+
+// readDocument reads the next segment document sent to the daemon.
+func readDocument(t *testing.T, conn net.PacketConn) document {
+	buf := make([]byte, 64*1024)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(buf[:n]), header), string(buf[:n]))
+	var doc document
+	require.NoError(t, json.Unmarshal(buf[len(header):n], &doc))
+	return doc
+}
+
+func TestTracer(t *testing.T) {
+	t.Parallel()
+	daemon := startDaemon(t)
+	defer daemon.Close()
+	tracer, err := NewTracer(daemon.LocalAddr().String(), 1)
+	require.NoError(t, err)
+	defer tracer.Close()
+	now := time.Unix(1500000000, 250000000)
+	tracer.now = func() time.Time {
+		now = now.Add(time.Millisecond)
+		return now
+	}
+
+	ctx, end := tracer.Start(context.Background(), "packet")
+	_, endParse := tracer.Start(ctx, "parse")
+	endParse(errors.New("bad line"))
+	parse := readDocument(t, daemon)
+	end(nil)
+	packet := readDocument(t, daemon)
+
+	assert.Equal(t, ServiceName, packet.Name)
+	assert.Equal(t, map[string]string{"stage": "packet"}, packet.Annotations)
+	assert.Empty(t, packet.ParentID)
+	assert.Empty(t, packet.Type)
+	assert.False(t, packet.Error)
+	assert.Len(t, packet.ID, 16)
+	assert.Regexp(t, "^1-59682f00-[0-9a-f]{24}$", packet.TraceID)
+	assert.Equal(t, 1500000000.251, packet.StartTime)
+	assert.Equal(t, 1500000000.254, packet.EndTime)
+
+	assert.Equal(t, "parse", parse.Name)
+	assert.Equal(t, "subsegment", parse.Type)
+	assert.Equal(t, packet.ID, parse.ParentID)
+	assert.Equal(t, packet.TraceID, parse.TraceID)
+	assert.True(t, parse.Error)
+	require.NotNil(t, parse.Cause)
+	require.Len(t, parse.Cause.Exceptions, 1)
+	assert.Equal(t, "bad line", parse.Cause.Exceptions[0].Message)
+	assert.NotEqual(t, packet.ID, parse.ID)
+}
+
+func TestTracerNotSampled(t *testing.T) {
+	t.Parallel()
+	daemon := startDaemon(t)
+	defer daemon.Close()
+	tracer, err := NewTracer(daemon.LocalAddr().String(), 0)
+	require.NoError(t, err)
+	defer tracer.Close()
+
+	ctx, end := tracer.Start(context.Background(), "packet")
+	_, endParse := tracer.Start(ctx, "parse")
+	endParse(nil)
+	end(nil)
+	require.NoError(t, daemon.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, _, err = daemon.ReadFrom(make([]byte, 1024))
+	assert.Error(t, err, "nested stages of a stage that is not sampled are not traced")
+	assert.Zero(t, tracer.SendErrors())
+}
+
+func TestNewTracerInvalidSamplingRate(t *testing.T) {
+	t.Parallel()
+	for _, rate := range []float64{-0.1, 1.5} {
+		_, err := NewTracer(DefaultDaemonAddr, rate)
+		assert.Error(t, err, "%v", rate)
+	}
+}
@@ -0,0 +1,82 @@
+package gostatsd
+
+import (
+	"math"
+	"strconv"
+)
+
+// RoundValue rounds the value to the number of significant digits, ties are rounded to even. The value is
+// returned unchanged if digits is not positive, if it is not finite or if rounding would overflow.
+func RoundValue(value float64, digits int) float64 {
+	if digits <= 0 || value == 0 || math.IsInf(value, 0) || math.IsNaN(value) {
+		return value
+	}
+	// Formatting rounds the exact binary value, so the result does not depend on the magnitude of the value
+	rounded, err := strconv.ParseFloat(strconv.FormatFloat(value, 'e', digits-1, 64), 64)
+	if err != nil {
+		return value
+	}
+	return rounded
+}
+
+// FormatValue formats the value for text protocols. The value is formatted with six decimals like %f if digits
+// is not positive, otherwise it is rounded to the number of significant digits, see RoundValue, and formatted
+// without exponent and trailing zeros so that small values keep their significant digits.
+func FormatValue(value float64, digits int) string {
+	if digits <= 0 {
+		return strconv.FormatFloat(value, 'f', 6, 64)
+	}
+	return strconv.FormatFloat(RoundValue(value, digits), 'f', -1, 64)
+}
+
+// Round returns a copy of the MetricMap with the float values of counters, timers and gauges rounded to the
+// number of significant digits, see RoundValue. The MetricMap is not modified, sets are shared with the copy.
+func (m *MetricMap) Round(digits int) *MetricMap {
+	rounded := *m
+	rounded.Counters = make(Counters, len(m.Counters))
+	m.Counters.Each(func(key, tagsKey string, counter Counter) {
+		counter.PerSecond = RoundValue(counter.PerSecond, digits)
+		if rounded.Counters[key] == nil {
+			rounded.Counters[key] = make(map[string]Counter, len(m.Counters[key]))
+		}
+		rounded.Counters[key][tagsKey] = counter
+	})
+	rounded.Timers = make(Timers, len(m.Timers))
+	m.Timers.Each(func(key, tagsKey string, timer Timer) {
+		timer.PerSecond = RoundValue(timer.PerSecond, digits)
+		timer.Mean = RoundValue(timer.Mean, digits)
+		timer.Median = RoundValue(timer.Median, digits)
+		timer.Min = RoundValue(timer.Min, digits)
+		timer.Max = RoundValue(timer.Max, digits)
+		timer.StdDev = RoundValue(timer.StdDev, digits)
+		timer.Sum = RoundValue(timer.Sum, digits)
+		timer.SumSquares = RoundValue(timer.SumSquares, digits)
+		if timer.Values != nil {
+			values := make([]float64, len(timer.Values))
+			for i, value := range timer.Values {
+				values[i] = RoundValue(value, digits)
+			}
+			timer.Values = values
+		}
+		if timer.Percentiles != nil {
+			percentiles := make(Percentiles, len(timer.Percentiles))
+			for i, pct := range timer.Percentiles {
+				percentiles[i] = Percentile{Float: RoundValue(pct.Float, digits), Str: pct.Str}
+			}
+			timer.Percentiles = percentiles
+		}
+		if rounded.Timers[key] == nil {
+			rounded.Timers[key] = make(map[string]Timer, len(m.Timers[key]))
+		}
+		rounded.Timers[key][tagsKey] = timer
+	})
+	rounded.Gauges = make(Gauges, len(m.Gauges))
+	m.Gauges.Each(func(key, tagsKey string, gauge Gauge) {
+		gauge.Value = RoundValue(gauge.Value, digits)
+		if rounded.Gauges[key] == nil {
+			rounded.Gauges[key] = make(map[string]Gauge, len(m.Gauges[key]))
+		}
+		rounded.Gauges[key][tagsKey] = gauge
+	})
+	return &rounded
+}
@@ -0,0 +1,105 @@
+package gostatsd
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundValue(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		value    float64
+		digits   int
+		expected float64
+	}{
+		{123.456789012345, 6, 123.457},
+		{123.456789012345, 0, 123.456789012345},
+		{123.456789012345, -1, 123.456789012345},
+		// Exact ties are rounded to even
+		{0.125, 2, 0.12},
+		{0.375, 2, 0.38},
+		{2.5, 1, 2},
+		{3.5, 1, 4},
+		{-2.5, 1, -2},
+		{12345, 4, 12340},
+		{12355, 4, 12360},
+		// 2.675 is slightly less than the tie in binary
+		{2.675, 3, 2.67},
+		{1234567890123456789, 3, 1230000000000000000},
+		{1.23456789e300, 3, 1.23e300},
+		{0.000000000123456789, 3, 0.000000000123},
+		{5e-324, 1, 5e-324},
+		{0, 3, 0},
+		// Rounding up would overflow
+		{math.MaxFloat64, 1, math.MaxFloat64},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(strconv.FormatFloat(test.value, 'g', -1, 64)+"/"+strconv.Itoa(test.digits), func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, test.expected, RoundValue(test.value, test.digits))
+		})
+	}
+}
+
+func TestRoundValueNotFinite(t *testing.T) {
+	t.Parallel()
+	assert.True(t, math.IsNaN(RoundValue(math.NaN(), 3)))
+	assert.Equal(t, math.Inf(1), RoundValue(math.Inf(1), 3))
+	assert.Equal(t, math.Inf(-1), RoundValue(math.Inf(-1), 3))
+}
+
+func TestFormatValue(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "1230000000000000000", FormatValue(1234567890123456789, 3))
+	assert.Equal(t, "0.000000000123", FormatValue(0.000000000123456789, 3))
+	assert.Equal(t, "123.457", FormatValue(123.456789012345, 6))
+	assert.Equal(t, "1.5", FormatValue(1.5, 6))
+	// Without precision values are formatted like %f
+	assert.Equal(t, "1.500000", FormatValue(1.5, 0))
+	assert.Equal(t, "0.000000", FormatValue(0.000000000123456789, 0))
+}
+
+func TestMetricMapRound(t *testing.T) {
+	t.Parallel()
+	m := &MetricMap{
+		FlushInterval: 1,
+		Counters: Counters{
+			"c": {"": Counter{Value: 3, PerSecond: 0.333333333}},
+		},
+		Timers: Timers{
+			"t": {"a:1": Timer{
+				Count:       2,
+				Mean:        1.23456789,
+				Values:      []float64{1.11111, 1.35802578},
+				Percentiles: Percentiles{{Float: 1.35802578, Str: "upper_90"}},
+			}},
+		},
+		Gauges: Gauges{
+			"g": {"": Gauge{Value: 98765.4321}},
+		},
+		Sets: Sets{
+			"s": {"": Set{Values: map[string]struct{}{"joe": {}}}},
+		},
+	}
+	rounded := m.Round(3)
+	assert.Equal(t, Counter{Value: 3, PerSecond: 0.333}, rounded.Counters["c"][""])
+	assert.Equal(t, Timer{
+		Count:       2,
+		Mean:        1.23,
+		Values:      []float64{1.11, 1.36},
+		Percentiles: Percentiles{{Float: 1.36, Str: "upper_90"}},
+	}, rounded.Timers["t"]["a:1"])
+	assert.Equal(t, 98800.0, rounded.Gauges["g"][""].Value)
+	assert.Equal(t, m.Sets, rounded.Sets)
+	assert.Equal(t, m.FlushInterval, rounded.FlushInterval)
+
+	// The original is not modified
+	assert.Equal(t, 0.333333333, m.Counters["c"][""].PerSecond)
+	assert.Equal(t, []float64{1.11111, 1.35802578}, m.Timers["t"]["a:1"].Values)
+	assert.Equal(t, 1.35802578, m.Timers["t"]["a:1"].Percentiles[0].Float)
+	assert.Equal(t, 98765.4321, m.Gauges["g"][""].Value)
+}
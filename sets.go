@@ -6,6 +6,9 @@ type Set struct {
 	Timestamp Nanotime // Last time value was updated
 	Hostname  string   // Hostname of the source of the metric
 	Tags      Tags     // The tags for the set
+	Unit      string   // The unit of the values, empty if unknown
+	// Sketch estimates the number of distinct values instead of Values if the set is sketched, nil otherwise.
+	Sketch *HyperLogLog
 }
 
 // NewSet initialises a new set.
@@ -13,6 +16,14 @@ func NewSet(timestamp Nanotime, values map[string]struct{}, hostname string, tag
 	return Set{Values: values, Timestamp: timestamp, Hostname: hostname, Tags: tags}
 }
 
+// Cardinality returns the number of distinct values of the set, estimated by the sketch if the set is sketched.
+func (s Set) Cardinality() int {
+	if s.Sketch != nil {
+		return int(s.Sketch.Estimate())
+	}
+	return len(s.Values)
+}
+
 // Sets stores a map of sets by tags.
 type Sets map[string]map[string]Set
 
@@ -0,0 +1,322 @@
+package gostatsd
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+)
+
+// DefaultTDigestCompression is the default compression of a TDigest. A digest keeps about twice as many centroids,
+// quantiles are estimated within about 1% of the rank.
+const DefaultTDigestCompression = 100
+
+// TDigest is a sketch estimating quantiles of the values added to it with an amount of memory bounded by its
+// compression, regardless of the number of values. Values are grouped into weighted centroids that are smaller
+// near the extremes, so that extreme quantiles are more accurate. Digests are mergeable, merging the digests of
+// parts of the values estimates quantiles of all values about as well as a digest of all values.
+//
+// See Dunning and Ertl, Computing Extremely Accurate Quantiles Using t-Digests.
+type TDigest struct {
+	compression float64
+	centroids   []tdigestCentroid // Merged centroids sorted by mean
+	unmerged    []tdigestCentroid // Centroids added since the last merge
+	count       float64           // Total weight of the values
+	sum         float64           // Weighted sum of the values
+	sumSquares  float64           // Weighted sum of the squares of the values
+	min         float64
+	max         float64
+}
+
+type tdigestCentroid struct {
+	mean   float64
+	weight float64
+}
+
+// TDigestCentroid is a centroid of a TDigest, values with a total weight grouped by their mean.
+type TDigestCentroid struct {
+	Mean   float64 `json:"mean"`
+	Weight float64 `json:"weight"`
+}
+
+// tdigestJSON is the serialized form of a TDigest, written by MarshalJSON and with the schema of MetricMap.
+type tdigestJSON struct {
+	Compression float64           `json:"compression"`
+	Min         float64           `json:"min"`
+	Max         float64           `json:"max"`
+	Sum         float64           `json:"sum"`
+	SumSquares  float64           `json:"sum_squares"`
+	Centroids   []TDigestCentroid `json:"centroids"`
+}
+
+// NewTDigest initialises a new empty digest with the compression, DefaultTDigestCompression if not positive.
+// Higher compression is more accurate and uses more memory.
+func NewTDigest(compression float64) *TDigest {
+	if compression <= 0 {
+		compression = DefaultTDigestCompression
+	}
+	return &TDigest{
+		compression: compression,
+		min:         math.Inf(1),
+		max:         math.Inf(-1),
+	}
+}
+
+// Compression returns the compression of the digest.
+func (d *TDigest) Compression() float64 {
+	return d.compression
+}
+
+// Add adds the value to the digest once.
+func (d *TDigest) Add(value float64) {
+	d.AddWeighted(value, 1)
+}
+
+// AddWeighted adds the value to the digest as if it was added weight times, e.g. for sampled values.
+// Values with a weight that is not positive are ignored.
+func (d *TDigest) AddWeighted(value, weight float64) {
+	if weight <= 0 || math.IsNaN(value) {
+		return
+	}
+	d.unmerged = append(d.unmerged, tdigestCentroid{mean: value, weight: weight})
+	d.count += weight
+	d.sum += value * weight
+	d.sumSquares += value * value * weight
+	if value < d.min {
+		d.min = value
+	}
+	if value > d.max {
+		d.max = value
+	}
+	if len(d.unmerged) >= d.bufferSize() {
+		d.merge()
+	}
+}
+
+// Merge adds the values of the other digest to the digest.
+func (d *TDigest) Merge(other *TDigest) {
+	if other.count == 0 {
+		return
+	}
+	d.unmerged = append(d.unmerged, other.centroids...)
+	d.unmerged = append(d.unmerged, other.unmerged...)
+	d.count += other.count
+	d.sum += other.sum
+	d.sumSquares += other.sumSquares
+	if other.min < d.min {
+		d.min = other.min
+	}
+	if other.max > d.max {
+		d.max = other.max
+	}
+	d.merge()
+}
+
+// Clone returns a copy of the digest.
+func (d *TDigest) Clone() *TDigest {
+	c := *d
+	c.centroids = append([]tdigestCentroid(nil), d.centroids...)
+	c.unmerged = append([]tdigestCentroid(nil), d.unmerged...)
+	return &c
+}
+
+// Centroids returns the centroids of the digest sorted by mean, e.g. to serialize it with RestoreTDigest.
+func (d *TDigest) Centroids() []TDigestCentroid {
+	d.merge()
+	centroids := make([]TDigestCentroid, 0, len(d.centroids))
+	for _, c := range d.centroids {
+		centroids = append(centroids, TDigestCentroid{Mean: c.mean, Weight: c.weight})
+	}
+	return centroids
+}
+
+// RestoreTDigest returns the digest with the compression, the centroids and the exact minimum, maximum, sum and
+// sum of squares of a digest, e.g. deserialized. Centroids with a weight that is not positive are ignored.
+func RestoreTDigest(compression float64, centroids []TDigestCentroid, min, max, sum, sumSquares float64) *TDigest {
+	d := NewTDigest(compression)
+	for _, c := range centroids {
+		if c.Weight <= 0 || math.IsNaN(c.Mean) {
+			continue
+		}
+		d.unmerged = append(d.unmerged, tdigestCentroid{mean: c.Mean, weight: c.Weight})
+		d.count += c.Weight
+	}
+	if d.count == 0 {
+		return d
+	}
+	d.min, d.max = min, max
+	d.sum, d.sumSquares = sum, sumSquares
+	d.merge()
+	return d
+}
+
+// state returns the serialized form of the digest. The minimum and maximum of an empty digest are 0, because
+// infinities cannot be encoded as JSON.
+func (d *TDigest) state() *tdigestJSON {
+	state := &tdigestJSON{
+		Compression: d.compression,
+		Sum:         d.sum,
+		SumSquares:  d.sumSquares,
+		Centroids:   d.Centroids(),
+	}
+	if d.count > 0 {
+		state.Min, state.Max = d.min, d.max
+	}
+	return state
+}
+
+// digest returns the digest of the serialized form.
+func (state *tdigestJSON) digest() *TDigest {
+	return RestoreTDigest(state.Compression, state.Centroids, state.Min, state.Max, state.Sum, state.SumSquares)
+}
+
+// MarshalJSON encodes the digest with its centroids, so that timers are serialized with their digest.
+func (d *TDigest) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.state())
+}
+
+// UnmarshalJSON decodes a digest encoded by MarshalJSON.
+func (d *TDigest) UnmarshalJSON(b []byte) error {
+	var state tdigestJSON
+	if err := json.Unmarshal(b, &state); err != nil {
+		return err
+	}
+	*d = *state.digest()
+	return nil
+}
+
+// Count returns the total weight of the values added to the digest.
+func (d *TDigest) Count() float64 {
+	return d.count
+}
+
+// Sum returns the exact sum of the values added to the digest.
+func (d *TDigest) Sum() float64 {
+	return d.sum
+}
+
+// SumSquares returns the exact sum of the squares of the values added to the digest.
+func (d *TDigest) SumSquares() float64 {
+	return d.sumSquares
+}
+
+// Min returns the smallest value added to the digest, NaN if it is empty.
+func (d *TDigest) Min() float64 {
+	if d.count == 0 {
+		return math.NaN()
+	}
+	return d.min
+}
+
+// Max returns the largest value added to the digest, NaN if it is empty.
+func (d *TDigest) Max() float64 {
+	if d.count == 0 {
+		return math.NaN()
+	}
+	return d.max
+}
+
+// Quantile returns the estimated value at the quantile q between 0 and 1, NaN if the digest is empty.
+func (d *TDigest) Quantile(q float64) float64 {
+	if d.count == 0 || math.IsNaN(q) {
+		return math.NaN()
+	}
+	if q <= 0 {
+		return d.min
+	}
+	if q >= 1 {
+		return d.max
+	}
+	d.merge()
+	// Each centroid is centered on the middle of its weight, values are interpolated between the centers
+	target := q * d.count
+	cumulative := 0.0
+	for i, c := range d.centroids {
+		center := cumulative + c.weight/2
+		if target < center {
+			if i == 0 {
+				return d.min + (c.mean-d.min)*target/center
+			}
+			prev := d.centroids[i-1]
+			prevCenter := cumulative - prev.weight/2
+			return prev.mean + (c.mean-prev.mean)*(target-prevCenter)/(center-prevCenter)
+		}
+		cumulative += c.weight
+	}
+	last := d.centroids[len(d.centroids)-1]
+	lastCenter := d.count - last.weight/2
+	return last.mean + (d.max-last.mean)*(target-lastCenter)/(d.count-lastCenter)
+}
+
+// CumulativeSum returns the estimated number, sum and sum of squares of the values up to the quantile q between
+// 0 and 1, the centroid straddling the quantile is counted in proportion. Values of a centroid are estimated by
+// its mean.
+func (d *TDigest) CumulativeSum(q float64) (count, sum, sumSquares float64) {
+	if d.count == 0 || q <= 0 {
+		return 0, 0, 0
+	}
+	d.merge()
+	target := math.Min(q, 1) * d.count
+	for _, c := range d.centroids {
+		if count+c.weight >= target {
+			part := target - count
+			return target, sum + part*c.mean, sumSquares + part*c.mean*c.mean
+		}
+		count += c.weight
+		sum += c.weight * c.mean
+		sumSquares += c.weight * c.mean * c.mean
+	}
+	return count, sum, sumSquares
+}
+
+// bufferSize returns the number of centroids added before they are merged.
+func (d *TDigest) bufferSize() int {
+	return int(5 * d.compression)
+}
+
+// merge merges the unmerged centroids into the centroids. Adjacent centroids are combined as long as the
+// combined centroid spans at most one unit of the scale function k.
+func (d *TDigest) merge() {
+	if len(d.unmerged) == 0 {
+		return
+	}
+	all := append(d.unmerged, d.centroids...)
+	sort.Sort(tdigestCentroids(all))
+	merged := make([]tdigestCentroid, 0, len(d.centroids)+1)
+	current := all[0]
+	before := 0.0 // Weight of the centroids before the current one
+	kLow := d.k(0)
+	for _, c := range all[1:] {
+		if d.k((before+current.weight+c.weight)/d.count)-kLow <= 1 {
+			// Incremental mean keeps precision for large weights
+			current.weight += c.weight
+			current.mean += (c.mean - current.mean) * c.weight / current.weight
+			continue
+		}
+		merged = append(merged, current)
+		before += current.weight
+		kLow = d.k(before / d.count)
+		current = c
+	}
+	d.centroids = append(merged, current)
+	d.unmerged = d.unmerged[:0]
+}
+
+// k is the scale function mapping the quantile q to the index of a centroid, centroids are small near the
+// extremes where k is steep.
+func (d *TDigest) k(q float64) float64 {
+	return d.compression / (2 * math.Pi) * math.Asin(2*math.Min(q, 1)-1)
+}
+
+type tdigestCentroids []tdigestCentroid
+
+func (c tdigestCentroids) Len() int {
+	return len(c)
+}
+
+func (c tdigestCentroids) Less(i, j int) bool {
+	return c[i].mean < c[j].mean
+}
+
+func (c tdigestCentroids) Swap(i, j int) {
+	c[i], c[j] = c[j], c[i]
+}
@@ -0,0 +1,212 @@
+package gostatsd
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tdigestDistributions generate values of distributions the accuracy of digests is tested with.
+var tdigestDistributions = map[string]func(r *rand.Rand) float64{
+	"uniform": func(r *rand.Rand) float64 {
+		return r.Float64() * 1000
+	},
+	"normal": func(r *rand.Rand) float64 {
+		return r.NormFloat64()*50 + 200
+	},
+	"exponential": func(r *rand.Rand) float64 {
+		return r.ExpFloat64() * 100
+	},
+	"lognormal": func(r *rand.Rand) float64 {
+		return math.Exp(r.NormFloat64() * 2)
+	},
+}
+
+var tdigestQuantiles = []float64{0.001, 0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99, 0.999}
+
+// assertQuantiles asserts that the estimated quantiles of the digest are within maxError of the rank of the
+// exact quantiles of the sorted values.
+func assertQuantiles(t *testing.T, d *TDigest, sorted []float64, maxError float64, msg string) {
+	for _, q := range tdigestQuantiles {
+		estimate := d.Quantile(q)
+		rank := float64(sort.SearchFloat64s(sorted, estimate)) / float64(len(sorted))
+		assert.InDelta(t, q, rank, maxError, "%s: quantile %v estimated as %v", msg, q, estimate)
+	}
+}
+
+func TestTDigestQuantiles(t *testing.T) {
+	t.Parallel()
+	for name, dist := range tdigestDistributions {
+		r := rand.New(rand.NewSource(1))
+		d := NewTDigest(DefaultTDigestCompression)
+		values := make([]float64, 100000)
+		for i := range values {
+			values[i] = dist(r)
+			d.Add(values[i])
+		}
+		sort.Float64s(values)
+		assertQuantiles(t, d, values, 0.005, name)
+		assert.EqualValues(t, len(values), d.Count())
+		assert.Equal(t, values[0], d.Min())
+		assert.Equal(t, values[len(values)-1], d.Max())
+		assert.Equal(t, values[0], d.Quantile(0))
+		assert.Equal(t, values[len(values)-1], d.Quantile(1))
+		// Memory is bounded by the compression
+		d.merge()
+		assert.True(t, len(d.centroids) <= 2*DefaultTDigestCompression, "%s: %d centroids", name, len(d.centroids))
+	}
+}
+
+func TestTDigestMerge(t *testing.T) {
+	t.Parallel()
+	for name, dist := range tdigestDistributions {
+		r := rand.New(rand.NewSource(2))
+		d := NewTDigest(DefaultTDigestCompression)
+		var values []float64
+		// Digests of parts of the values, e.g. of several servers, with different sizes
+		for part := 1; part <= 10; part++ {
+			p := NewTDigest(DefaultTDigestCompression)
+			for i := 0; i < part*2000; i++ {
+				value := dist(r)
+				values = append(values, value)
+				p.Add(value)
+			}
+			d.Merge(p)
+		}
+		sort.Float64s(values)
+		assertQuantiles(t, d, values, 0.01, name)
+		assert.EqualValues(t, len(values), d.Count())
+		var sum float64
+		for _, value := range values {
+			sum += value
+		}
+		assert.InEpsilon(t, sum, d.Sum(), 1e-9, name)
+	}
+}
+
+func TestTDigestAddWeighted(t *testing.T) {
+	t.Parallel()
+	d := NewTDigest(DefaultTDigestCompression)
+	d.AddWeighted(1, 9)
+	d.AddWeighted(100, 1)
+	d.AddWeighted(5, 0) // Ignored
+	assert.EqualValues(t, 10, d.Count())
+	assert.Equal(t, 1.0, d.Quantile(0.4))
+	assert.Equal(t, 100.0, d.Max())
+	count, sum, sumSquares := d.CumulativeSum(0.9)
+	assert.InDelta(t, 9, count, 1e-9)
+	assert.InDelta(t, 9, sum, 1e-9)
+	assert.InDelta(t, 9, sumSquares, 1e-9)
+	assert.Equal(t, 109.0, d.Sum())
+	assert.Equal(t, 10009.0, d.SumSquares())
+}
+
+func TestTDigestCumulativeSum(t *testing.T) {
+	t.Parallel()
+	r := rand.New(rand.NewSource(3))
+	d := NewTDigest(DefaultTDigestCompression)
+	values := make([]float64, 10000)
+	for i := range values {
+		values[i] = r.Float64() * 1000
+		d.Add(values[i])
+	}
+	sort.Float64s(values)
+	var exact, exactSquares, total, totalSquares float64
+	for i, value := range values {
+		if i < 9000 {
+			exact += value
+			exactSquares += value * value
+		}
+		total += value
+		totalSquares += value * value
+	}
+	count, sum, sumSquares := d.CumulativeSum(0.9)
+	assert.InDelta(t, 9000, count, 1e-6)
+	assert.InEpsilon(t, exact, sum, 0.001)
+	assert.InEpsilon(t, exactSquares, sumSquares, 0.001)
+	count, _, _ = d.CumulativeSum(0)
+	assert.Zero(t, count)
+	assert.InEpsilon(t, total, d.Sum(), 1e-9)
+	assert.InEpsilon(t, totalSquares, d.SumSquares(), 1e-9)
+}
+
+func TestTDigestEmpty(t *testing.T) {
+	t.Parallel()
+	d := NewTDigest(0)
+	assert.EqualValues(t, DefaultTDigestCompression, d.Compression())
+	assert.True(t, math.IsNaN(d.Quantile(0.5)))
+	assert.True(t, math.IsNaN(d.Min()))
+	assert.True(t, math.IsNaN(d.Max()))
+	d.Merge(NewTDigest(0))
+	assert.Zero(t, d.Count())
+
+	d.Add(42)
+	require.EqualValues(t, 1, d.Count())
+	for _, q := range tdigestQuantiles {
+		assert.Equal(t, 42.0, d.Quantile(q))
+	}
+}
+
+func TestTDigestClone(t *testing.T) {
+	t.Parallel()
+	d := NewTDigest(DefaultTDigestCompression)
+	for i := 0; i < 1000; i++ {
+		d.Add(float64(i))
+	}
+	c := d.Clone()
+	c.Add(5000)
+	assert.EqualValues(t, 1000, d.Count())
+	assert.Equal(t, 999.0, d.Max())
+	assert.EqualValues(t, 1001, c.Count())
+}
+
+func TestTDigestRestore(t *testing.T) {
+	t.Parallel()
+	r := rand.New(rand.NewSource(4))
+	d := NewTDigest(50)
+	for i := 0; i < 10000; i++ {
+		d.Add(r.ExpFloat64() * 100)
+	}
+	restored := RestoreTDigest(d.Compression(), d.Centroids(), d.Min(), d.Max(), d.Sum(), d.SumSquares())
+	assert.Equal(t, d.Centroids(), restored.Centroids())
+	assert.EqualValues(t, 50, restored.Compression())
+	assert.Equal(t, d.Count(), restored.Count())
+	assert.Equal(t, d.Min(), restored.Min())
+	assert.Equal(t, d.Max(), restored.Max())
+	assert.Equal(t, d.Sum(), restored.Sum())
+	assert.Equal(t, d.SumSquares(), restored.SumSquares())
+	for _, q := range tdigestQuantiles {
+		assert.Equal(t, d.Quantile(q), restored.Quantile(q))
+	}
+
+	empty := RestoreTDigest(0, []TDigestCentroid{{Mean: 1, Weight: 0}}, 0, 0, 0, 0)
+	assert.Zero(t, empty.Count())
+	assert.True(t, math.IsNaN(empty.Min()))
+}
+
+func TestTDigestJSONRoundTrip(t *testing.T) {
+	t.Parallel()
+	d := NewTDigest(DefaultTDigestCompression)
+	for i := 1; i <= 1000; i++ {
+		d.Add(float64(i))
+	}
+	data, err := json.Marshal(d)
+	require.NoError(t, err)
+	var read TDigest
+	require.NoError(t, json.Unmarshal(data, &read))
+	assert.Equal(t, d.Count(), read.Count())
+	assert.Equal(t, 1.0, read.Min())
+	assert.Equal(t, 1000.0, read.Max())
+	assert.Equal(t, d.Quantile(0.5), read.Quantile(0.5))
+
+	// Infinite bounds of empty digests cannot be encoded
+	data, err = json.Marshal(NewTDigest(0))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &read))
+	assert.Zero(t, read.Count())
+}
@@ -16,6 +16,11 @@ type Timer struct {
 	Timestamp   Nanotime    // Last time value was updated
 	Hostname    string      // Hostname of the source of the metric
 	Tags        Tags        // The tags for the timer
+	Unit        string      // The unit of the values, empty if unknown
+	// Buckets are the histogram buckets computed by clients merged across samples, nil if none.
+	Buckets HistogramBuckets
+	// Digest estimates the distribution of the values instead of Values if the timer is digested, nil otherwise.
+	Digest *TDigest
 }
 
 // NewTimer initialises a new timer.
@@ -23,6 +28,14 @@ func NewTimer(timestamp Nanotime, values []float64, hostname string, tags Tags)
 	return Timer{Values: values, Timestamp: timestamp, Hostname: hostname, Tags: tags}
 }
 
+// NumValues returns the number of values of the timer, counted by the digest if the timer is digested.
+func (t Timer) NumValues() int {
+	if t.Digest != nil {
+		return int(t.Digest.Count())
+	}
+	return len(t.Values)
+}
+
 // Timers stores a map of timers by tags.
 type Timers map[string]map[string]Timer
 